@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The timeout of each request to the Argo CD API
+	API_REQUEST_TIMEOUT = 30 * time.Second
+	// The gRPC status code of a failed precondition, which Argo CD returns
+	// when another operation of the application is running
+	// See https://grpc.io/docs/guides/status-codes
+	GRPC_FAILED_PRECONDITION = 9
+)
+
+// The options for connecting to the Argo CD API server
+type serverOptions struct {
+	// The url of the Argo CD server (e.g. https://argocd.example.com). A
+	// server without a scheme uses https, as in the argocd CLI
+	server string
+	// The path to a file with the Argo CD token (e.g. a mounted secret of an
+	// account token)
+	tokenFile string
+	// Whether the TLS certificate of the server is not verified
+	insecure bool
+}
+
+// A client of the Argo CD API, which is the REST gateway of the gRPC API
+// See https://argo-cd.readthedocs.io/en/stable/developer-guide/api-docs
+type argocdClient struct {
+	serverUrl  string
+	token      string
+	httpClient *http.Client
+}
+
+// The fields of an Argo CD application
+// See https://argo-cd.readthedocs.io/en/stable/operator-manual/declarative-setup/#applications
+type application struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Operation *struct {
+		Sync *struct {
+			Revision string `json:"revision"`
+		} `json:"sync"`
+		Info []operationInfo `json:"info"`
+	} `json:"operation"`
+}
+
+// A name and value that is attached to an operation, which the Argo CD UI
+// shows
+type operationInfo struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func configureServerFlags(flags *pflag.FlagSet) {
+	flags.String("server", "", "The url of the Argo CD server (e.g. https://argocd.example.com)")
+	flags.String("token-file", "", "The path to a file with the Argo CD token (e.g. a mounted secret)")
+	flags.Bool("insecure", false, "Whether to skip the verification of the TLS certificate of the server")
+}
+
+func getServerOptions(flags *pflag.FlagSet) (serverOptions, error) {
+	var opts serverOptions
+	var err error
+
+	opts.server, err = flags.GetString("server")
+	if err != nil {
+		return opts, fmt.Errorf("error processing server flag")
+	}
+	if opts.server == "" {
+		return opts, fmt.Errorf("server must be set")
+	}
+	if !strings.Contains(opts.server, "://") {
+		opts.server = "https://" + opts.server
+	}
+	opts.server = strings.TrimSuffix(opts.server, "/")
+	serverUrl, err := url.Parse(opts.server)
+	if err != nil || serverUrl.Host == "" {
+		return opts, fmt.Errorf("server must be a url: %s", opts.server)
+	}
+
+	opts.tokenFile, err = flags.GetString("token-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing token-file flag")
+	}
+	if opts.tokenFile == "" {
+		return opts, fmt.Errorf("token-file must be set")
+	}
+
+	opts.insecure, err = flags.GetBool("insecure")
+	if err != nil {
+		return opts, fmt.Errorf("error processing insecure flag")
+	}
+	return opts, nil
+}
+
+func (opts serverOptions) logAttrs() []any {
+	return []any{
+		"server", opts.server,
+		"tokenFile", opts.tokenFile,
+		"insecure", opts.insecure,
+	}
+}
+
+// Returns the client of the server, with the token of the token file
+func (opts serverOptions) newClient() (argocdClient, error) {
+	tokenBytes, err := os.ReadFile(opts.tokenFile)
+	if err != nil {
+		return argocdClient{}, fmt.Errorf("error reading token file: %s", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return argocdClient{
+		serverUrl:  opts.server,
+		token:      strings.TrimSpace(string(tokenBytes)),
+		httpClient: &http.Client{Timeout: API_REQUEST_TIMEOUT, Transport: transport},
+	}, nil
+}
+
+// Returns the url of the application in the Argo CD UI
+func (c argocdClient) getApplicationUrl(name string, appNamespace string) string {
+	if appNamespace == "" {
+		return fmt.Sprintf("%s/applications/%s", c.serverUrl, url.PathEscape(name))
+	}
+	return fmt.Sprintf("%s/applications/%s/%s", c.serverUrl, url.PathEscape(appNamespace), url.PathEscape(name))
+}
+
+// Sends the request to the API path with the JSON body, if any, and decodes
+// the JSON response
+func (c argocdClient) do(ctx context.Context, method string, path string, body any, response any) error {
+	var requestBody []byte
+	if body != nil {
+		var err error
+		requestBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	requestUrl := c.serverUrl + path
+	slog.Debug("Sending Argo CD API request", "method", method, "url", requestUrl)
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newApiError(req.URL.Redacted(), resp, respBody)
+	}
+	err = json.Unmarshal(respBody, response)
+	if err != nil {
+		return fmt.Errorf("error parsing the response of %s: %s", path, err)
+	}
+	return nil
+}
+
+// A response of the Argo CD API that is not 2xx
+type apiError struct {
+	url        string
+	statusCode int
+	status     string
+	// The gRPC status code and message of the error, if the response is a
+	// gRPC error
+	code    int
+	message string
+}
+
+func newApiError(requestUrl string, resp *http.Response, respBody []byte) *apiError {
+	var grpcError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	message := strings.TrimSpace(string(respBody))
+	if json.Unmarshal(respBody, &grpcError) == nil && grpcError.Message != "" {
+		message = grpcError.Message
+	}
+	return &apiError{
+		url:        requestUrl,
+		statusCode: resp.StatusCode,
+		status:     resp.Status,
+		code:       grpcError.Code,
+		message:    message,
+	}
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s returned %s: %s", e.url, e.status, e.message)
+}
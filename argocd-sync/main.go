@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "argocd-sync"
+
+var mainCmd = &cobra.Command{
+	Use:   "argocd-sync",
+	Short: "Trigger the sync of an Argo CD application",
+	Long: `Triggers the sync of an Argo CD application.
+The sync is requested from the Argo CD API with the token of the token file,
+optionally pinned to a revision, such as the commit of gitops-update. The
+operation id is attached to the operation info and written to the result
+file, so argocd-wait can wait for the operation`,
+	PersistentPreRunE: loadFlagValues,
+	RunE:              handleMainCmd,
+}
+
+func configureCmds() {
+	flags := mainCmd.Flags()
+
+	configureSyncFlags(flags)
+	mainCmd.MarkFlagRequired("application")
+	mainCmd.MarkFlagRequired("server")
+	mainCmd.MarkFlagRequired("token-file")
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the API requests")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	syncOpts, err := getSyncOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Argo CD sync with params", syncOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	result, err := syncOpts.triggerSync(cmd.Context())
+	if err != nil {
+		return err
+	}
+	return syncOpts.writeResult(result)
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The name of the operation info with the operation id, which argocd-wait
+	// matches to find the operation
+	OPERATION_ID_INFO = "operationId"
+	// The default maximum duration to wait for the running operation of the
+	// application, such as an auto sync of the pushed change
+	DEFAULT_IN_PROGRESS_TIMEOUT = 5 * time.Minute
+	// The default interval between the sync attempts while an operation is
+	// running
+	DEFAULT_POLL_INTERVAL = 10 * time.Second
+)
+
+// The options for triggering the sync of an application
+type syncOptions struct {
+	application string
+	// The namespace of the application, for the applications outside of the
+	// Argo CD namespace
+	appNamespace string
+	project      string
+	// The revision to sync to (e.g. commit sha hash), instead of the target
+	// revision of the application
+	revision string
+	prune    bool
+	force    bool
+	dryRun   bool
+	// The sync options of the operation (e.g. ServerSideApply=true)
+	syncOptions []string
+	// The id that is attached to the operation, so the wait can find it
+	operationId string
+	infos       []operationInfo
+	// The maximum duration to wait for a running operation to finish
+	inProgressTimeout time.Duration
+	pollInterval      time.Duration
+	resultFile        string
+	server            serverOptions
+}
+
+// The result of the sync trigger, which is written to the result file
+type syncResult struct {
+	Application    string `json:"application"`
+	AppNamespace   string `json:"appNamespace,omitempty"`
+	OperationId    string `json:"operationId"`
+	Revision       string `json:"revision,omitempty"`
+	Prune          bool   `json:"prune"`
+	Force          bool   `json:"force"`
+	DryRun         bool   `json:"dryRun"`
+	ApplicationUrl string `json:"applicationUrl"`
+}
+
+// The body of the sync request
+// See https://argo-cd.readthedocs.io/en/stable/developer-guide/api-docs
+type syncRequest struct {
+	Name         string          `json:"name"`
+	AppNamespace string          `json:"appNamespace,omitempty"`
+	Project      string          `json:"project,omitempty"`
+	Revision     string          `json:"revision,omitempty"`
+	Prune        bool            `json:"prune"`
+	DryRun       bool            `json:"dryRun"`
+	Strategy     *syncStrategy   `json:"strategy,omitempty"`
+	SyncOptions  *syncOptionList `json:"syncOptions,omitempty"`
+	Infos        []operationInfo `json:"infos"`
+}
+
+// The hook sync strategy, which is the default of the argocd CLI. Force
+// deletes and recreates the resources that cannot be patched
+type syncStrategy struct {
+	Hook struct {
+		Force bool `json:"force"`
+	} `json:"hook"`
+}
+
+type syncOptionList struct {
+	Items []string `json:"items"`
+}
+
+func configureSyncFlags(flags *pflag.FlagSet) {
+	flags.String("application", "", "The name of the Argo CD application to sync")
+
+	flags.String(
+		"app-namespace",
+		"",
+		"The namespace of the application, for the applications outside of the Argo CD namespace")
+
+	flags.String("project", "", "The project of the application, which the server checks")
+
+	flags.String(
+		"revision",
+		"",
+		"The revision to sync to (e.g. the commit sha hash of gitops-update), instead of the target revision")
+
+	flags.Bool("prune", false, "Whether to delete the resources that are no longer in git")
+
+	flags.Bool("force", false, "Whether to delete and recreate the resources that cannot be patched")
+
+	flags.Bool("dry-run", false, "Whether to only preview the sync, without applying the resources")
+
+	flags.StringArray(
+		"sync-option",
+		nil,
+		"A sync option of the operation (e.g. ServerSideApply=true). Can be repeated")
+
+	flags.String(
+		"operation-id",
+		"",
+		"The id that is attached to the operation info, so argocd-wait can find it (e.g. the pipeline run id). "+
+			"Defaults to a random id")
+
+	flags.StringArray(
+		"info",
+		nil,
+		"A name=value that is attached to the operation info, which the Argo CD UI shows. Can be repeated")
+
+	flags.Duration(
+		"in-progress-timeout",
+		DEFAULT_IN_PROGRESS_TIMEOUT,
+		"The maximum duration to wait for a running operation of the application to finish, or 0 to fail right away")
+
+	flags.Duration("poll-interval", DEFAULT_POLL_INTERVAL, "The interval between the sync attempts")
+
+	flags.String(
+		"result-file",
+		"",
+		"The path to write the result to as JSON, with the operation id and the revision")
+
+	configureServerFlags(flags)
+}
+
+func getSyncOptions(flags *pflag.FlagSet) (syncOptions, error) {
+	var opts syncOptions
+	var err error
+
+	opts.application, err = flags.GetString("application")
+	if err != nil {
+		return opts, fmt.Errorf("error processing application flag")
+	}
+	if opts.application == "" {
+		return opts, fmt.Errorf("application must be set")
+	}
+
+	opts.appNamespace, err = flags.GetString("app-namespace")
+	if err != nil {
+		return opts, fmt.Errorf("error processing app-namespace flag")
+	}
+
+	opts.project, err = flags.GetString("project")
+	if err != nil {
+		return opts, fmt.Errorf("error processing project flag")
+	}
+
+	opts.revision, err = flags.GetString("revision")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revision flag")
+	}
+
+	opts.prune, err = flags.GetBool("prune")
+	if err != nil {
+		return opts, fmt.Errorf("error processing prune flag")
+	}
+
+	opts.force, err = flags.GetBool("force")
+	if err != nil {
+		return opts, fmt.Errorf("error processing force flag")
+	}
+
+	opts.dryRun, err = flags.GetBool("dry-run")
+	if err != nil {
+		return opts, fmt.Errorf("error processing dry-run flag")
+	}
+
+	opts.syncOptions, err = flags.GetStringArray("sync-option")
+	if err != nil {
+		return opts, fmt.Errorf("error processing sync-option flag")
+	}
+
+	opts.operationId, err = flags.GetString("operation-id")
+	if err != nil {
+		return opts, fmt.Errorf("error processing operation-id flag")
+	}
+	if opts.operationId == "" {
+		opts.operationId, err = newOperationId()
+		if err != nil {
+			return opts, err
+		}
+	}
+	opts.infos = []operationInfo{{Name: OPERATION_ID_INFO, Value: opts.operationId}}
+
+	infos, err := flags.GetStringArray("info")
+	if err != nil {
+		return opts, fmt.Errorf("error processing info flag")
+	}
+	for _, info := range infos {
+		name, value, found := strings.Cut(info, "=")
+		if !found || name == "" {
+			return opts, fmt.Errorf("info must be a name=value: %s", info)
+		}
+		if name == OPERATION_ID_INFO {
+			return opts, fmt.Errorf("info must not set %s. Use operation-id instead", OPERATION_ID_INFO)
+		}
+		opts.infos = append(opts.infos, operationInfo{Name: name, Value: value})
+	}
+
+	opts.inProgressTimeout, err = flags.GetDuration("in-progress-timeout")
+	if err != nil {
+		return opts, fmt.Errorf("error processing in-progress-timeout flag")
+	}
+	if opts.inProgressTimeout < 0 {
+		return opts, fmt.Errorf("in-progress-timeout must not be negative: %s", opts.inProgressTimeout)
+	}
+
+	opts.pollInterval, err = flags.GetDuration("poll-interval")
+	if err != nil {
+		return opts, fmt.Errorf("error processing poll-interval flag")
+	}
+	if opts.pollInterval <= 0 {
+		return opts, fmt.Errorf("poll-interval must be positive: %s", opts.pollInterval)
+	}
+
+	opts.resultFile, err = flags.GetString("result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing result-file flag")
+	}
+
+	opts.server, err = getServerOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (opts syncOptions) logAttrs() []any {
+	attrs := []any{
+		"application", opts.application,
+		"appNamespace", opts.appNamespace,
+		"project", opts.project,
+		"revision", opts.revision,
+		"prune", opts.prune,
+		"force", opts.force,
+		"dryRun", opts.dryRun,
+		"syncOptions", opts.syncOptions,
+		"operationId", opts.operationId,
+		"infos", opts.infos,
+		"inProgressTimeout", opts.inProgressTimeout,
+		"pollInterval", opts.pollInterval,
+		"resultFile", opts.resultFile,
+	}
+	return append(attrs, opts.server.logAttrs()...)
+}
+
+// Triggers the sync of the application. A running operation of the
+// application, such as an auto sync, is waited for until the in progress
+// timeout, since Argo CD runs one operation at a time
+func (opts syncOptions) triggerSync(ctx context.Context) (syncResult, error) {
+	result := syncResult{
+		Application:  opts.application,
+		AppNamespace: opts.appNamespace,
+		OperationId:  opts.operationId,
+		Revision:     opts.revision,
+		Prune:        opts.prune,
+		Force:        opts.force,
+		DryRun:       opts.dryRun,
+	}
+	client, err := opts.server.newClient()
+	if err != nil {
+		return result, err
+	}
+	result.ApplicationUrl = client.getApplicationUrl(opts.application, opts.appNamespace)
+
+	request := syncRequest{
+		Name:         opts.application,
+		AppNamespace: opts.appNamespace,
+		Project:      opts.project,
+		Revision:     opts.revision,
+		Prune:        opts.prune,
+		DryRun:       opts.dryRun,
+		Infos:        opts.infos,
+	}
+	if opts.force {
+		request.Strategy = &syncStrategy{}
+		request.Strategy.Hook.Force = true
+	}
+	if len(opts.syncOptions) > 0 {
+		request.SyncOptions = &syncOptionList{Items: opts.syncOptions}
+	}
+	path := fmt.Sprintf("/api/v1/applications/%s/sync", url.PathEscape(opts.application))
+
+	deadline := time.Now().Add(opts.inProgressTimeout)
+	for {
+		slog.Info("Triggering the sync", "application", opts.application, "operationId", opts.operationId)
+		var app application
+		err = client.do(ctx, http.MethodPost, path, request, &app)
+		if err == nil {
+			if app.Operation != nil && app.Operation.Sync != nil && app.Operation.Sync.Revision != "" {
+				result.Revision = app.Operation.Sync.Revision
+			}
+			slog.Info(
+				"Triggered the sync",
+				"application", opts.application,
+				"operationId", opts.operationId,
+				"revision", result.Revision,
+				"applicationUrl", result.ApplicationUrl)
+			return result, nil
+		}
+
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) || !isOperationInProgress(apiErr) {
+			return result, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return result, fmt.Errorf(
+				"another operation of %s is still in progress after %s: %s",
+				opts.application,
+				opts.inProgressTimeout,
+				result.ApplicationUrl)
+		}
+		slog.Info("Waiting for the running operation of the application", "application", opts.application)
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(min(opts.pollInterval, remaining)):
+		}
+	}
+}
+
+// Writes the result to the result file as JSON, if set
+func (opts syncOptions) writeResult(result syncResult) error {
+	if opts.resultFile == "" {
+		return nil
+	}
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling result file: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(opts.resultFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating result file dir: %s", err)
+	}
+	err = os.WriteFile(opts.resultFile, append(bytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing result file: %s", err)
+	}
+	return nil
+}
+
+// Returns whether the sync failed since another operation of the
+// application is running
+func isOperationInProgress(err *apiError) bool {
+	return err.code == GRPC_FAILED_PRECONDITION && strings.Contains(err.message, "in progress")
+}
+
+// Returns a random operation id
+func newOperationId() (string, error) {
+	idBytes := make([]byte, 8)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return "", fmt.Errorf("error generating operation id: %s", err)
+	}
+	return hex.EncodeToString(idBytes), nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Returns the sync options of the args
+func getTestSyncOptions(t *testing.T, args ...string) (syncOptions, error) {
+	t.Helper()
+	flags := pflag.NewFlagSet("argocd-sync", pflag.ContinueOnError)
+	configureSyncFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return getSyncOptions(flags)
+}
+
+// Writes the token file of the fake Argo CD server. Returns its path
+func writeTestTokenFile(t *testing.T) string {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("test-token\n"), 0600)
+	if err != nil {
+		t.Fatalf("error writing token file: %s", err)
+	}
+	return tokenFile
+}
+
+func TestGetSyncOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantServer string
+		wantInfos  []operationInfo
+		wantErr    string
+	}{
+		{
+			name:       "server without a scheme",
+			args:       []string{"--server", "argocd.example.com/", "--operation-id", "run-1", "--info", "pipeline=build=1"},
+			wantServer: "https://argocd.example.com",
+			wantInfos:  []operationInfo{{Name: OPERATION_ID_INFO, Value: "run-1"}, {Name: "pipeline", Value: "build=1"}},
+		},
+		{
+			name:       "server with a scheme",
+			args:       []string{"--server", "http://localhost:8080", "--operation-id", "run-1"},
+			wantServer: "http://localhost:8080",
+			wantInfos:  []operationInfo{{Name: OPERATION_ID_INFO, Value: "run-1"}},
+		},
+		{name: "no application", args: []string{"--application", ""}, wantErr: "application must be set"},
+		{name: "no server", args: []string{"--server", ""}, wantErr: "server must be set"},
+		{name: "invalid server", args: []string{"--server", "https://%zz"}, wantErr: "server must be a url: https://%zz"},
+		{name: "no token file", args: []string{"--token-file", ""}, wantErr: "token-file must be set"},
+		{name: "info without a value", args: []string{"--info", "pipeline"}, wantErr: "info must be a name=value: pipeline"},
+		{
+			name:    "info of the operation id",
+			args:    []string{"--info", "operationId=run-1"},
+			wantErr: "info must not set operationId. Use operation-id instead",
+		},
+		{
+			name:    "negative in progress timeout",
+			args:    []string{"--in-progress-timeout", "-1s"},
+			wantErr: "in-progress-timeout must not be negative: -1s",
+		},
+		{name: "zero poll interval", args: []string{"--poll-interval", "0s"}, wantErr: "poll-interval must be positive: 0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"--application", "app", "--server", "argocd.example.com", "--token-file", "token"}
+			opts, err := getTestSyncOptions(t, append(args, tt.args...)...)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("getSyncOptions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getSyncOptions() error = %v", err)
+			}
+			if opts.server.server != tt.wantServer {
+				t.Errorf("got server %q, want %q", opts.server.server, tt.wantServer)
+			}
+			if !reflect.DeepEqual(opts.infos, tt.wantInfos) {
+				t.Errorf("got infos %+v, want %+v", opts.infos, tt.wantInfos)
+			}
+		})
+	}
+}
+
+func TestGetSyncOptionsOperationId(t *testing.T) {
+	opts, err := getTestSyncOptions(t, "--application", "app", "--server", "argocd.example.com", "--token-file", "token")
+	if err != nil {
+		t.Fatalf("getSyncOptions() error = %v", err)
+	}
+	if len(opts.operationId) != 16 {
+		t.Errorf("got operation id %q, want a random id of 16 hex characters", opts.operationId)
+	}
+	want := []operationInfo{{Name: OPERATION_ID_INFO, Value: opts.operationId}}
+	if !reflect.DeepEqual(opts.infos, want) {
+		t.Errorf("got infos %+v, want %+v", opts.infos, want)
+	}
+}
+
+func TestTriggerSync(t *testing.T) {
+	requests := []syncRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/applications/app/sync" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var request syncRequest
+		json.Unmarshal(body, &request)
+		requests = append(requests, request)
+		// The first sync waits for the running auto sync
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code": 9, "message": "another operation is already in progress"}`))
+			return
+		}
+		w.Write([]byte(`{"metadata": {"name": "app"}, "operation": {"sync": {"revision": "abc123"}}}`))
+	}))
+	defer server.Close()
+
+	resultFile := filepath.Join(t.TempDir(), "result", "sync.json")
+	opts, err := getTestSyncOptions(
+		t,
+		"--application", "app",
+		"--app-namespace", "team",
+		"--project", "default",
+		"--prune",
+		"--force",
+		"--sync-option", "ServerSideApply=true",
+		"--operation-id", "run-1",
+		"--poll-interval", "10ms",
+		"--result-file", resultFile,
+		"--server", server.URL,
+		"--token-file", writeTestTokenFile(t),
+	)
+	if err != nil {
+		t.Fatalf("getSyncOptions() error = %v", err)
+	}
+	result, err := opts.triggerSync(context.Background())
+	if err != nil {
+		t.Fatalf("triggerSync() error = %v", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("got %d sync requests, want 2", len(requests))
+	}
+	wantRequest := syncRequest{
+		Name:         "app",
+		AppNamespace: "team",
+		Project:      "default",
+		Prune:        true,
+		Strategy:     &syncStrategy{},
+		SyncOptions:  &syncOptionList{Items: []string{"ServerSideApply=true"}},
+		Infos:        []operationInfo{{Name: OPERATION_ID_INFO, Value: "run-1"}},
+	}
+	wantRequest.Strategy.Hook.Force = true
+	if !reflect.DeepEqual(requests[1], wantRequest) {
+		t.Errorf("got sync request %+v, want %+v", requests[1], wantRequest)
+	}
+
+	want := syncResult{
+		Application:    "app",
+		AppNamespace:   "team",
+		OperationId:    "run-1",
+		Revision:       "abc123",
+		Prune:          true,
+		Force:          true,
+		ApplicationUrl: server.URL + "/applications/team/app",
+	}
+	if result != want {
+		t.Errorf("triggerSync() = %+v, want %+v", result, want)
+	}
+
+	err = opts.writeResult(result)
+	if err != nil {
+		t.Fatalf("writeResult() error = %v", err)
+	}
+	content, err := os.ReadFile(resultFile)
+	if err != nil {
+		t.Fatalf("error reading result file: %s", err)
+	}
+	var got syncResult
+	err = json.Unmarshal(content, &got)
+	if err != nil {
+		t.Fatalf("error unmarshalling result file: %s", err)
+	}
+	if got != want {
+		t.Errorf("got result file %+v, want %+v", got, want)
+	}
+}
+
+func TestTriggerSyncInProgress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code": 9, "message": "another operation is already in progress"}`))
+	}))
+	defer server.Close()
+
+	opts := syncOptions{
+		application:       "app",
+		operationId:       "run-1",
+		inProgressTimeout: 30 * time.Millisecond,
+		pollInterval:      10 * time.Millisecond,
+		server:            serverOptions{server: server.URL, tokenFile: writeTestTokenFile(t)},
+	}
+	_, err := opts.triggerSync(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "another operation of app is still in progress after 30ms") {
+		t.Errorf("triggerSync() error = %v, want an operation in progress", err)
+	}
+}
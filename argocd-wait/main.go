@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "argocd-wait"
+
+var mainCmd = &cobra.Command{
+	Use:   "argocd-wait",
+	Short: "Wait until an Argo CD application is synced and healthy",
+	Long: `Waits until an Argo CD application is synced and healthy.
+The application is polled with the Argo CD API until it is synced, optionally
+to a revision or by the operation of argocd-sync, and healthy. A failed sync
+operation fails right away, and the failed and unhealthy resources are listed
+with their messages, so the pipeline error is actionable`,
+	PersistentPreRunE: loadFlagValues,
+	RunE:              handleMainCmd,
+}
+
+func configureCmds() {
+	flags := mainCmd.Flags()
+
+	configureWaitFlags(flags)
+	mainCmd.MarkFlagRequired("application")
+	mainCmd.MarkFlagRequired("server")
+	mainCmd.MarkFlagRequired("token-file")
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the API requests")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	waitOpts, err := getWaitOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Argo CD wait with params", waitOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	result, err := waitOpts.waitForApplication(cmd.Context())
+	if err != nil {
+		return err
+	}
+	for _, resource := range result.Resources {
+		slog.Warn(
+			"Resource is not healthy",
+			"kind", resource.Kind,
+			"namespace", resource.Namespace,
+			"name", resource.Name,
+			"syncStatus", resource.SyncStatus,
+			"healthStatus", resource.HealthStatus,
+			"message", resource.Message)
+	}
+	err = waitOpts.writeResult(result)
+	if err != nil {
+		return err
+	}
+	if result.Status != HEALTHY_STATUS {
+		return &waitError{result: result}
+	}
+	slog.Info("The application is ready", "reason", result.Reason, "revision", result.Revision)
+	return nil
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		var waitErr *waitError
+		if errors.As(err, &waitErr) {
+			os.Exit(waitErr.exitCode())
+		}
+		os.Exit(1)
+	}
+}
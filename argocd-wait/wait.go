@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The application is synced and healthy
+	HEALTHY_STATUS = "healthy"
+	// The sync operation failed, or the application is degraded
+	FAILED_STATUS = "failed"
+	// The application is not synced and healthy before the timeout
+	TIMEOUT_STATUS = "timeout"
+
+	// The exit codes of the failed and the timed out waits, so a pipeline can
+	// tell them apart from the other errors
+	FAILED_EXIT_CODE  = 2
+	TIMEOUT_EXIT_CODE = 3
+
+	// The default maximum duration to wait for the application
+	DEFAULT_WAIT_TIMEOUT = 10 * time.Minute
+	// The default interval between the Argo CD API polls
+	DEFAULT_POLL_INTERVAL = 10 * time.Second
+
+	// The name of the operation info with the operation id, which
+	// argocd-sync attaches to the operation
+	OPERATION_ID_INFO = "operationId"
+
+	// The Argo CD statuses
+	// See https://argo-cd.readthedocs.io/en/stable/operator-manual/health
+	SYNCED_SYNC_STATUS        = "Synced"
+	HEALTHY_HEALTH_STATUS     = "Healthy"
+	SUSPENDED_HEALTH_STATUS   = "Suspended"
+	DEGRADED_HEALTH_STATUS    = "Degraded"
+	SUCCEEDED_OPERATION_PHASE = "Succeeded"
+	FAILED_OPERATION_PHASE    = "Failed"
+	ERROR_OPERATION_PHASE     = "Error"
+	SYNC_FAILED_STATUS        = "SyncFailed"
+)
+
+// The options for waiting until the application is synced and healthy
+type waitOptions struct {
+	application  string
+	appNamespace string
+	// The id of the operation to wait for, which argocd-sync attaches to
+	// the operation info
+	operationId string
+	// The revision that the application must be synced to (e.g. commit sha
+	// hash), which may be abbreviated
+	revision string
+	// Whether the suspended health is accepted, such as a paused canary of a
+	// rollout that is promoted after
+	allowSuspended bool
+	// Whether a degraded application fails the wait right away, once it is
+	// synced to the revision
+	failOnDegraded bool
+	refresh        bool
+	timeout        time.Duration
+	pollInterval   time.Duration
+	resultFile     string
+	server         serverOptions
+}
+
+// The result of the wait, which is written to the result file
+type waitResult struct {
+	Application      string `json:"application"`
+	Status           string `json:"status"`
+	Reason           string `json:"reason"`
+	SyncStatus       string `json:"syncStatus"`
+	HealthStatus     string `json:"healthStatus"`
+	Revision         string `json:"revision"`
+	OperationId      string `json:"operationId,omitempty"`
+	OperationPhase   string `json:"operationPhase,omitempty"`
+	OperationMessage string `json:"operationMessage,omitempty"`
+	// The resources that failed to sync or are not healthy
+	Resources      []resourceResult `json:"resources"`
+	ApplicationUrl string           `json:"applicationUrl"`
+}
+
+// A resource that failed to sync or is not healthy
+type resourceResult struct {
+	Kind         string `json:"kind"`
+	Namespace    string `json:"namespace,omitempty"`
+	Name         string `json:"name"`
+	SyncStatus   string `json:"syncStatus,omitempty"`
+	HealthStatus string `json:"healthStatus,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+// The error of a wait that failed or timed out, which sets the exit code
+type waitError struct {
+	result waitResult
+}
+
+func (e *waitError) Error() string {
+	message := fmt.Sprintf("the application %s failed: %s", e.result.Application, e.result.Reason)
+	if e.result.Status == TIMEOUT_STATUS {
+		message = fmt.Sprintf("the application %s is %s", e.result.Application, e.result.Reason)
+	}
+	lines := []string{message}
+	for _, resource := range e.result.Resources {
+		lines = append(lines, "  "+resource.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *waitError) exitCode() int {
+	if e.result.Status == TIMEOUT_STATUS {
+		return TIMEOUT_EXIT_CODE
+	}
+	return FAILED_EXIT_CODE
+}
+
+func (r resourceResult) String() string {
+	name := r.Kind + " " + r.Name
+	if r.Namespace != "" {
+		name = r.Kind + " " + r.Namespace + "/" + r.Name
+	}
+	status := strings.TrimSpace(r.SyncStatus + " " + r.HealthStatus)
+	if r.Message == "" {
+		return fmt.Sprintf("%s: %s", name, status)
+	}
+	return fmt.Sprintf("%s: %s: %s", name, status, r.Message)
+}
+
+func configureWaitFlags(flags *pflag.FlagSet) {
+	flags.String("application", "", "The name of the Argo CD application to wait for")
+
+	flags.String(
+		"app-namespace",
+		"",
+		"The namespace of the application, for the applications outside of the Argo CD namespace")
+
+	flags.String(
+		"operation-id",
+		"",
+		"The id of the sync operation to wait for, which argocd-sync attaches to the operation info")
+
+	flags.String(
+		"sync-result-file",
+		"",
+		"The path to the argocd-sync result file, whose operation id is waited for")
+
+	flags.String(
+		"revision",
+		"",
+		"The revision that the application must be synced to (e.g. the commit sha hash of gitops-update)")
+
+	flags.Bool(
+		"allow-suspended",
+		false,
+		"Whether the suspended health is accepted, such as a paused canary of a rollout that is promoted after")
+
+	flags.Bool(
+		"fail-on-degraded",
+		false,
+		"Whether a degraded application fails right away once it is synced, instead of waiting for it to recover")
+
+	flags.Bool("refresh", true, "Whether to refresh the application on the first poll, so the git changes are compared")
+
+	flags.Duration("timeout", DEFAULT_WAIT_TIMEOUT, "The maximum duration to wait for the application")
+
+	flags.Duration("poll-interval", DEFAULT_POLL_INTERVAL, "The interval between the Argo CD API polls")
+
+	flags.String(
+		"result-file",
+		"",
+		"The path to write the result to as JSON, with the status and the resources that are not healthy")
+
+	configureServerFlags(flags)
+}
+
+func getWaitOptions(flags *pflag.FlagSet) (waitOptions, error) {
+	var opts waitOptions
+	var err error
+
+	opts.application, err = flags.GetString("application")
+	if err != nil {
+		return opts, fmt.Errorf("error processing application flag")
+	}
+	if opts.application == "" {
+		return opts, fmt.Errorf("application must be set")
+	}
+
+	opts.appNamespace, err = flags.GetString("app-namespace")
+	if err != nil {
+		return opts, fmt.Errorf("error processing app-namespace flag")
+	}
+
+	opts.operationId, err = flags.GetString("operation-id")
+	if err != nil {
+		return opts, fmt.Errorf("error processing operation-id flag")
+	}
+
+	opts.revision, err = flags.GetString("revision")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revision flag")
+	}
+
+	syncResultFile, err := flags.GetString("sync-result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing sync-result-file flag")
+	}
+	if syncResultFile != "" {
+		err = opts.readSyncResultFile(syncResultFile)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	opts.allowSuspended, err = flags.GetBool("allow-suspended")
+	if err != nil {
+		return opts, fmt.Errorf("error processing allow-suspended flag")
+	}
+
+	opts.failOnDegraded, err = flags.GetBool("fail-on-degraded")
+	if err != nil {
+		return opts, fmt.Errorf("error processing fail-on-degraded flag")
+	}
+
+	opts.refresh, err = flags.GetBool("refresh")
+	if err != nil {
+		return opts, fmt.Errorf("error processing refresh flag")
+	}
+
+	opts.timeout, err = flags.GetDuration("timeout")
+	if err != nil {
+		return opts, fmt.Errorf("error processing timeout flag")
+	}
+	if opts.timeout <= 0 {
+		return opts, fmt.Errorf("timeout must be positive: %s", opts.timeout)
+	}
+
+	opts.pollInterval, err = flags.GetDuration("poll-interval")
+	if err != nil {
+		return opts, fmt.Errorf("error processing poll-interval flag")
+	}
+	if opts.pollInterval <= 0 {
+		return opts, fmt.Errorf("poll-interval must be positive: %s", opts.pollInterval)
+	}
+
+	opts.resultFile, err = flags.GetString("result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing result-file flag")
+	}
+
+	opts.server, err = getServerOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (opts waitOptions) logAttrs() []any {
+	attrs := []any{
+		"application", opts.application,
+		"appNamespace", opts.appNamespace,
+		"operationId", opts.operationId,
+		"revision", opts.revision,
+		"allowSuspended", opts.allowSuspended,
+		"failOnDegraded", opts.failOnDegraded,
+		"refresh", opts.refresh,
+		"timeout", opts.timeout,
+		"pollInterval", opts.pollInterval,
+		"resultFile", opts.resultFile,
+	}
+	return append(attrs, opts.server.logAttrs()...)
+}
+
+// Reads the operation id of the argocd-sync result file, unless the flag
+// sets it. The revision is not read, since the operation of the id is the
+// sync of its revision, which may be a branch
+func (opts *waitOptions) readSyncResultFile(syncResultFile string) error {
+	syncResultBytes, err := os.ReadFile(syncResultFile)
+	if err != nil {
+		return fmt.Errorf("error reading sync result file: %s", err)
+	}
+	var syncResult struct {
+		Application string `json:"application"`
+		OperationId string `json:"operationId"`
+	}
+	err = json.Unmarshal(syncResultBytes, &syncResult)
+	if err != nil {
+		return fmt.Errorf("error parsing sync result file: %s", err)
+	}
+	if syncResult.Application != opts.application {
+		return fmt.Errorf(
+			"the sync result file is for the application %s, not %s",
+			syncResult.Application,
+			opts.application)
+	}
+	if opts.operationId == "" {
+		opts.operationId = syncResult.OperationId
+	}
+	return nil
+}
+
+// Polls the application until it is synced and healthy, the operation
+// fails, or the timeout
+func (opts waitOptions) waitForApplication(ctx context.Context) (waitResult, error) {
+	client, err := opts.server.newClient()
+	if err != nil {
+		return waitResult{}, err
+	}
+	applicationUrl := client.getApplicationUrl(opts.application, opts.appNamespace)
+
+	deadline := time.Now().Add(opts.timeout)
+	refresh := opts.refresh
+	for {
+		app, err := client.getApplication(ctx, opts.application, opts.appNamespace, refresh)
+		if err != nil {
+			return waitResult{}, err
+		}
+		refresh = false
+
+		result := opts.getResult(app)
+		result.ApplicationUrl = applicationUrl
+		if result.Status != "" {
+			return result, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			result.Status = TIMEOUT_STATUS
+			result.Reason = fmt.Sprintf("not ready after %s: %s", opts.timeout, result.Reason)
+			return result, nil
+		}
+		slog.Info(
+			"Waiting for the application",
+			"application", opts.application,
+			"reason", result.Reason,
+			"syncStatus", result.SyncStatus,
+			"healthStatus", result.HealthStatus,
+			"revision", result.Revision)
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(min(opts.pollInterval, remaining)):
+		}
+	}
+}
+
+// Returns the result of the application state. The status is empty while
+// the wait continues, with the reason
+func (opts waitOptions) getResult(app application) waitResult {
+	result := waitResult{
+		Application:  opts.application,
+		SyncStatus:   app.Status.Sync.Status,
+		HealthStatus: app.Status.Health.Status,
+		Revision:     app.Status.Sync.Revision,
+		OperationId:  opts.operationId,
+		Resources:    getUnhealthyResources(app),
+	}
+	operationState := app.Status.OperationState
+	if operationState != nil {
+		result.OperationPhase = operationState.Phase
+		result.OperationMessage = operationState.Message
+	}
+
+	// The requested operation is pending until the controller starts it
+	if app.Operation != nil {
+		result.Reason = "the operation has not started"
+		return result
+	}
+	if opts.operationId != "" {
+		if operationState == nil || getOperationId(operationState.Operation) != opts.operationId {
+			result.Reason = fmt.Sprintf("the operation %s has not started", opts.operationId)
+			return result
+		}
+	}
+	if operationState != nil {
+		switch operationState.Phase {
+		case SUCCEEDED_OPERATION_PHASE:
+		case FAILED_OPERATION_PHASE, ERROR_OPERATION_PHASE:
+			// A failed operation of a previous revision is left to the sync
+			// of the revision
+			if opts.isOperationOfRevision(operationState.SyncResult) {
+				result.Status = FAILED_STATUS
+				result.Reason = fmt.Sprintf(
+					"the sync operation %s: %s",
+					strings.ToLower(operationState.Phase),
+					operationState.Message)
+				return result
+			}
+		default:
+			result.Reason = fmt.Sprintf("the sync operation is %s", strings.ToLower(operationState.Phase))
+			return result
+		}
+	}
+
+	if opts.revision != "" && !strings.HasPrefix(result.Revision, opts.revision) {
+		result.Reason = fmt.Sprintf("the synced revision %s is not %s", result.Revision, opts.revision)
+		return result
+	}
+	if result.SyncStatus != SYNCED_SYNC_STATUS {
+		result.Reason = fmt.Sprintf("the sync status is %s", result.SyncStatus)
+		for _, condition := range app.Status.Conditions {
+			result.Reason += fmt.Sprintf(". %s: %s", condition.Type, condition.Message)
+		}
+		return result
+	}
+	switch {
+	case result.HealthStatus == HEALTHY_HEALTH_STATUS,
+		result.HealthStatus == SUSPENDED_HEALTH_STATUS && opts.allowSuspended:
+		result.Status = HEALTHY_STATUS
+		result.Reason = fmt.Sprintf("the application is synced and %s", strings.ToLower(result.HealthStatus))
+		return result
+	case result.HealthStatus == DEGRADED_HEALTH_STATUS && opts.failOnDegraded:
+		result.Status = FAILED_STATUS
+	}
+	result.Reason = fmt.Sprintf("the health status is %s", result.HealthStatus)
+	if app.Status.Health.Message != "" {
+		result.Reason += ": " + app.Status.Health.Message
+	}
+	return result
+}
+
+// Returns whether the operation synced the revision. The operation of the
+// operation id is matched before, so any revision is matched with it
+func (opts waitOptions) isOperationOfRevision(syncResult *operationSyncResult) bool {
+	if opts.operationId != "" || opts.revision == "" {
+		return true
+	}
+	return syncResult != nil && strings.HasPrefix(syncResult.Revision, opts.revision)
+}
+
+// Returns the resources that failed to sync in the last operation, and the
+// resources that are not healthy, with the messages of the failures
+func getUnhealthyResources(app application) []resourceResult {
+	resources := []resourceResult{}
+	if operationState := app.Status.OperationState; operationState != nil && operationState.SyncResult != nil {
+		for _, resource := range operationState.SyncResult.Resources {
+			failed := resource.Status == SYNC_FAILED_STATUS ||
+				resource.HookPhase == FAILED_OPERATION_PHASE ||
+				resource.HookPhase == ERROR_OPERATION_PHASE
+			if !failed {
+				continue
+			}
+			resources = append(resources, resourceResult{
+				Kind:       resource.Kind,
+				Namespace:  resource.Namespace,
+				Name:       resource.Name,
+				SyncStatus: strings.TrimSpace(resource.Status + " " + resource.HookPhase),
+				Message:    resource.Message,
+			})
+		}
+	}
+	for _, resource := range app.Status.Resources {
+		if resource.Health == nil {
+			continue
+		}
+		switch resource.Health.Status {
+		case HEALTHY_HEALTH_STATUS, SUSPENDED_HEALTH_STATUS, "":
+			continue
+		}
+		resources = append(resources, resourceResult{
+			Kind:         resource.Kind,
+			Namespace:    resource.Namespace,
+			Name:         resource.Name,
+			SyncStatus:   resource.Status,
+			HealthStatus: resource.Health.Status,
+			Message:      resource.Health.Message,
+		})
+	}
+	return resources
+}
+
+// Returns the id that argocd-sync attached to the operation info, or empty
+func getOperationId(op operation) string {
+	for _, info := range op.Info {
+		if info.Name == OPERATION_ID_INFO {
+			return info.Value
+		}
+	}
+	return ""
+}
+
+// Writes the result to the result file as JSON, if set
+func (opts waitOptions) writeResult(result waitResult) error {
+	if opts.resultFile == "" {
+		return nil
+	}
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling result file: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(opts.resultFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating result file dir: %s", err)
+	}
+	err = os.WriteFile(opts.resultFile, append(bytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing result file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Writes the file in a temp dir. Returns its path
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("error writing %s: %s", name, err)
+	}
+	return path
+}
+
+// Returns the application of the JSON
+func parseTestApplication(t *testing.T, appJson string) application {
+	t.Helper()
+	var app application
+	err := json.Unmarshal([]byte(appJson), &app)
+	if err != nil {
+		t.Fatalf("error parsing application: %s", err)
+	}
+	return app
+}
+
+func TestGetWaitOptions(t *testing.T) {
+	syncResultFile := writeTestFile(t, "sync.json", `{"application": "app", "operationId": "run-1", "revision": "main"}`)
+	otherSyncResultFile := writeTestFile(t, "other.json", `{"application": "other", "operationId": "run-2"}`)
+	invalidSyncResultFile := writeTestFile(t, "invalid.json", `{"application"`)
+	tests := []struct {
+		name            string
+		args            []string
+		wantOperationId string
+		wantErr         string
+	}{
+		{name: "sync result file", args: []string{"--sync-result-file", syncResultFile}, wantOperationId: "run-1"},
+		{
+			name:            "operation id with the sync result file",
+			args:            []string{"--sync-result-file", syncResultFile, "--operation-id", "run-3"},
+			wantOperationId: "run-3",
+		},
+		{name: "no application", args: []string{"--application", ""}, wantErr: "application must be set"},
+		{
+			name:    "sync result file of another application",
+			args:    []string{"--sync-result-file", otherSyncResultFile},
+			wantErr: "the sync result file is for the application other, not app",
+		},
+		{
+			name:    "invalid sync result file",
+			args:    []string{"--sync-result-file", invalidSyncResultFile},
+			wantErr: "error parsing sync result file: unexpected end of JSON input",
+		},
+		{name: "zero timeout", args: []string{"--timeout", "0s"}, wantErr: "timeout must be positive: 0s"},
+		{name: "zero poll interval", args: []string{"--poll-interval", "0s"}, wantErr: "poll-interval must be positive: 0s"},
+		{name: "no server", args: []string{"--server", ""}, wantErr: "server must be set"},
+		{name: "no token file", args: []string{"--token-file", ""}, wantErr: "token-file must be set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet("argocd-wait", pflag.ContinueOnError)
+			configureWaitFlags(flags)
+			args := []string{"--application", "app", "--server", "argocd.example.com", "--token-file", "token"}
+			err := flags.Parse(append(args, tt.args...))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			opts, err := getWaitOptions(flags)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("getWaitOptions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getWaitOptions() error = %v", err)
+			}
+			if opts.operationId != tt.wantOperationId {
+				t.Errorf("got operation id %q, want %q", opts.operationId, tt.wantOperationId)
+			}
+		})
+	}
+}
+
+func TestGetResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       waitOptions
+		app        string
+		wantStatus string
+		wantReason string
+	}{
+		{
+			name:       "requested operation",
+			app:        `{"operation": {}, "status": {"sync": {"status": "Synced"}, "health": {"status": "Healthy"}}}`,
+			wantReason: "the operation has not started",
+		},
+		{
+			name: "operation of another id",
+			opts: waitOptions{operationId: "run-1"},
+			app: `{"status": {"sync": {"status": "Synced"}, "health": {"status": "Healthy"},
+				"operationState": {"phase": "Succeeded", "operation": {"info": [{"name": "operationId", "value": "run-0"}]}}}}`,
+			wantReason: "the operation run-1 has not started",
+		},
+		{
+			name: "running operation",
+			opts: waitOptions{operationId: "run-1"},
+			app: `{"status": {"sync": {"status": "OutOfSync"}, "health": {"status": "Progressing"},
+				"operationState": {"phase": "Running", "operation": {"info": [{"name": "operationId", "value": "run-1"}]}}}}`,
+			wantReason: "the sync operation is running",
+		},
+		{
+			name: "failed operation",
+			opts: waitOptions{operationId: "run-1"},
+			app: `{"status": {"sync": {"status": "OutOfSync"}, "health": {"status": "Healthy"},
+				"operationState": {"phase": "Failed", "message": "one or more objects failed to apply",
+					"operation": {"info": [{"name": "operationId", "value": "run-1"}]}}}}`,
+			wantStatus: FAILED_STATUS,
+			wantReason: "the sync operation failed: one or more objects failed to apply",
+		},
+		{
+			name: "failed operation of a previous revision",
+			opts: waitOptions{revision: "abc"},
+			app: `{"status": {"sync": {"status": "OutOfSync", "revision": "def456"}, "health": {"status": "Healthy"},
+				"operationState": {"phase": "Failed", "syncResult": {"revision": "def456"}}}}`,
+			wantReason: "the synced revision def456 is not abc",
+		},
+		{
+			name: "out of sync",
+			app: `{"status": {"sync": {"status": "OutOfSync"}, "health": {"status": "Healthy"},
+				"conditions": [{"type": "ComparisonError", "message": "the repo is not reachable"}]}}`,
+			wantReason: "the sync status is OutOfSync. ComparisonError: the repo is not reachable",
+		},
+		{
+			name:       "healthy",
+			opts:       waitOptions{revision: "abc"},
+			app:        `{"status": {"sync": {"status": "Synced", "revision": "abc123"}, "health": {"status": "Healthy"}}}`,
+			wantStatus: HEALTHY_STATUS,
+			wantReason: "the application is synced and healthy",
+		},
+		{
+			name:       "suspended",
+			app:        `{"status": {"sync": {"status": "Synced"}, "health": {"status": "Suspended"}}}`,
+			wantReason: "the health status is Suspended",
+		},
+		{
+			name:       "allowed suspended",
+			opts:       waitOptions{allowSuspended: true},
+			app:        `{"status": {"sync": {"status": "Synced"}, "health": {"status": "Suspended"}}}`,
+			wantStatus: HEALTHY_STATUS,
+			wantReason: "the application is synced and suspended",
+		},
+		{
+			name:       "degraded",
+			app:        `{"status": {"sync": {"status": "Synced"}, "health": {"status": "Degraded", "message": "crash loop"}}}`,
+			wantReason: "the health status is Degraded: crash loop",
+		},
+		{
+			name:       "failed on degraded",
+			opts:       waitOptions{failOnDegraded: true},
+			app:        `{"status": {"sync": {"status": "Synced"}, "health": {"status": "Degraded"}}}`,
+			wantStatus: FAILED_STATUS,
+			wantReason: "the health status is Degraded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.application = "app"
+			result := tt.opts.getResult(parseTestApplication(t, tt.app))
+			if result.Status != tt.wantStatus || result.Reason != tt.wantReason {
+				t.Errorf(
+					"getResult() = %q, %q, want %q, %q",
+					result.Status,
+					result.Reason,
+					tt.wantStatus,
+					tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestGetUnhealthyResources(t *testing.T) {
+	app := parseTestApplication(t, `{"status": {
+		"operationState": {"phase": "Failed", "syncResult": {"resources": [
+			{"kind": "Job", "namespace": "team", "name": "migrate", "hookPhase": "Failed", "message": "backoff limit"},
+			{"kind": "Service", "namespace": "team", "name": "app", "status": "Synced"},
+			{"kind": "ConfigMap", "namespace": "team", "name": "config", "status": "SyncFailed", "message": "invalid"}
+		]}},
+		"resources": [
+			{"kind": "Deployment", "namespace": "team", "name": "app", "status": "Synced",
+				"health": {"status": "Degraded", "message": "crash loop"}},
+			{"kind": "Service", "namespace": "team", "name": "app", "status": "Synced", "health": {"status": "Healthy"}},
+			{"kind": "ConfigMap", "namespace": "team", "name": "config", "status": "OutOfSync"}
+		]
+	}}`)
+	want := []resourceResult{
+		{Kind: "Job", Namespace: "team", Name: "migrate", SyncStatus: "Failed", Message: "backoff limit"},
+		{Kind: "ConfigMap", Namespace: "team", Name: "config", SyncStatus: "SyncFailed", Message: "invalid"},
+		{Kind: "Deployment", Namespace: "team", Name: "app", SyncStatus: "Synced", HealthStatus: "Degraded", Message: "crash loop"},
+	}
+	if got := getUnhealthyResources(app); !reflect.DeepEqual(got, want) {
+		t.Errorf("getUnhealthyResources() = %+v, want %+v", got, want)
+	}
+	if got := want[2].String(); got != "Deployment team/app: Synced Degraded: crash loop" {
+		t.Errorf("String() = %q, want the kind, the name, the statuses, and the message", got)
+	}
+}
+
+func TestWaitForApplication(t *testing.T) {
+	responses := []string{
+		`{"operation": {}, "status": {"sync": {"status": "OutOfSync"}, "health": {"status": "Healthy"}}}`,
+		`{"status": {"sync": {"status": "Synced", "revision": "abc123"}, "health": {"status": "Healthy"},
+			"operationState": {"phase": "Succeeded", "operation": {"info": [{"name": "operationId", "value": "run-1"}]}}}}`,
+	}
+	queries := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/applications/app" || r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		queries = append(queries, r.URL.RawQuery)
+		w.Write([]byte(responses[min(len(queries), len(responses))-1]))
+	}))
+	defer server.Close()
+
+	opts := waitOptions{
+		application:  "app",
+		appNamespace: "team",
+		operationId:  "run-1",
+		revision:     "abc",
+		refresh:      true,
+		timeout:      time.Minute,
+		pollInterval: 10 * time.Millisecond,
+		resultFile:   filepath.Join(t.TempDir(), "result", "wait.json"),
+		server:       serverOptions{server: server.URL, tokenFile: writeTestFile(t, "token", "test-token\n")},
+	}
+	result, err := opts.waitForApplication(context.Background())
+	if err != nil {
+		t.Fatalf("waitForApplication() error = %v", err)
+	}
+	// The application is only refreshed on the first poll
+	wantQueries := []string{"appNamespace=team&refresh=normal", "appNamespace=team"}
+	if !reflect.DeepEqual(queries, wantQueries) {
+		t.Errorf("got queries %q, want %q", queries, wantQueries)
+	}
+	want := waitResult{
+		Application:    "app",
+		Status:         HEALTHY_STATUS,
+		Reason:         "the application is synced and healthy",
+		SyncStatus:     "Synced",
+		HealthStatus:   "Healthy",
+		Revision:       "abc123",
+		OperationId:    "run-1",
+		OperationPhase: "Succeeded",
+		Resources:      []resourceResult{},
+		ApplicationUrl: server.URL + "/applications/team/app",
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("waitForApplication() = %+v, want %+v", result, want)
+	}
+
+	err = opts.writeResult(result)
+	if err != nil {
+		t.Fatalf("writeResult() error = %v", err)
+	}
+	content, err := os.ReadFile(opts.resultFile)
+	if err != nil {
+		t.Fatalf("error reading result file: %s", err)
+	}
+	var got waitResult
+	err = json.Unmarshal(content, &got)
+	if err != nil {
+		t.Fatalf("error unmarshalling result file: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got result file %+v, want %+v", got, want)
+	}
+}
+
+func TestWaitForApplicationTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": {"sync": {"status": "Synced"}, "health": {"status": "Progressing"}}}`))
+	}))
+	defer server.Close()
+
+	opts := waitOptions{
+		application:  "app",
+		timeout:      30 * time.Millisecond,
+		pollInterval: 10 * time.Millisecond,
+		server:       serverOptions{server: server.URL, tokenFile: writeTestFile(t, "token", "test-token\n")},
+	}
+	result, err := opts.waitForApplication(context.Background())
+	if err != nil {
+		t.Fatalf("waitForApplication() error = %v", err)
+	}
+	if result.Status != TIMEOUT_STATUS || result.Reason != "not ready after 30ms: the health status is Progressing" {
+		t.Errorf("waitForApplication() = %q, %q, want a timeout", result.Status, result.Reason)
+	}
+	waitErr := &waitError{result: result}
+	if waitErr.exitCode() != TIMEOUT_EXIT_CODE {
+		t.Errorf("got exit code %d, want %d", waitErr.exitCode(), TIMEOUT_EXIT_CODE)
+	}
+	if waitErr.Error() != "the application app is not ready after 30ms: the health status is Progressing" {
+		t.Errorf("got error %q, want the timeout reason", waitErr.Error())
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "commit-metadata"
+
+const (
+	// The default git path, which is resolved with the PATH
+	DEFAULT_GIT_PATH = "git"
+)
+
+var mainCmd = &cobra.Command{
+	Use:   "commit-metadata",
+	Short: "Extract the metadata of a commit in the clone",
+	Long: `Extracts the metadata of a commit in the clone.
+The author, committer, message, changed files, and PR number are written as a
+JSON document for the notification and changelog steps`,
+	PersistentPreRunE: loadFlagValues,
+	RunE:              handleMainCmd,
+}
+
+func configureCmds() {
+	flags := mainCmd.Flags()
+
+	flags.String("clone-path", "", "The path to the cloned repo")
+	mainCmd.MarkFlagRequired("clone-path")
+
+	flags.String("revision-hash", "HEAD", "The revision id of the commit (e.g. commit sha hash)")
+
+	flags.String(
+		"base-revision-hash",
+		"",
+		"The revision id to diff the commit against for the changed files (e.g. the PR base). Defaults to the parent "+
+			"of the commit")
+
+	flags.String("output-file", "", "The path to write the commit metadata JSON to")
+	mainCmd.MarkFlagRequired("output-file")
+
+	flags.String("git-path", DEFAULT_GIT_PATH, "The path to the git executable")
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the git args")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	flags := cmd.Flags()
+
+	clonePath, err := flags.GetString("clone-path")
+	if err != nil {
+		return fmt.Errorf("error processing clone-path flag")
+	}
+
+	revisionHash, err := flags.GetString("revision-hash")
+	if err != nil {
+		return fmt.Errorf("error processing revision-hash flag")
+	}
+
+	baseRevisionHash, err := flags.GetString("base-revision-hash")
+	if err != nil {
+		return fmt.Errorf("error processing base-revision-hash flag")
+	}
+
+	outputFile, err := flags.GetString("output-file")
+	if err != nil {
+		return fmt.Errorf("error processing output-file flag")
+	}
+
+	gitPath, err := flags.GetString("git-path")
+	if err != nil {
+		return fmt.Errorf("error processing git-path flag")
+	}
+
+	// Log command flags
+	slog.Info(
+		"Commit metadata with params",
+		"clonePath", clonePath,
+		"revisionHash", revisionHash,
+		"baseRevisionHash", baseRevisionHash,
+		"outputFile", outputFile,
+		"gitPath", gitPath,
+	)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	metadata, err := getCommitMetadata(cmd.Context(), gitPath, clonePath, revisionHash, baseRevisionHash)
+	if err != nil {
+		return err
+	}
+	slog.Info(
+		"Read the commit metadata",
+		"hash", metadata.Hash,
+		"author", metadata.Author.Email,
+		"subject", metadata.Subject,
+		"prNumber", metadata.PrNumber,
+		"changedFiles", len(metadata.ChangedFiles),
+	)
+	return writeCommitMetadata(metadata, outputFile)
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The hash of the empty git tree, which a root commit is diffed against
+const EMPTY_TREE_HASH = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+var (
+	// The git log format of the commit fields, separated by NUL. The message
+	// is last, since it can have any characters except NUL
+	commitLogFormat = strings.Join([]string{"%H", "%P", "%an", "%ae", "%aI", "%cn", "%ce", "%cI", "%B"}, "%x00")
+
+	// Match the PR number in the commit subject of a merged PR, for the
+	// merge commits (e.g. Merge pull request #123 from org/branch), and the
+	// squash merges (e.g. Add the feature (#123))
+	prNumberSubjectRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`^Merge pull request #(\d+) from `),
+		regexp.MustCompile(`\(#(\d+)\)$`),
+	}
+	// Matches the merge request number in the message of a GitLab merge
+	// commit (e.g. See merge request org/repo!123)
+	prNumberMessageRegexp = regexp.MustCompile(`(?m)^See merge request \S+!(\d+)$`)
+
+	// The changed file statuses of git diff --name-status
+	changedFileStatuses = map[string]string{
+		"A": "added",
+		"M": "modified",
+		"D": "deleted",
+		"T": "typeChanged",
+	}
+)
+
+// The metadata of a commit, which the notification and changelog steps
+// read
+type commitMetadata struct {
+	Hash      string      `json:"hash"`
+	ShortHash string      `json:"shortHash"`
+	Parents   []string    `json:"parents"`
+	Author    commitActor `json:"author"`
+	Committer commitActor `json:"committer"`
+	// The first line of the message
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+	// The number of the PR that the commit merged, if it can be derived
+	// from the message
+	PrNumber     int           `json:"prNumber,omitempty"`
+	ChangedFiles []changedFile `json:"changedFiles"`
+}
+
+// The author or committer of a commit
+type commitActor struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	// The date in the RFC 3339 format
+	Date string `json:"date"`
+}
+
+// A file that the commit changed, compared to the base
+type changedFile struct {
+	Path string `json:"path"`
+	// One of added, modified, deleted, or typeChanged
+	Status string `json:"status"`
+}
+
+// Returns the metadata of the revision in the clone. The changed files
+// are compared to the base revision, which defaults to the first parent
+func getCommitMetadata(
+	ctx context.Context,
+	gitPath string,
+	clonePath string,
+	revision string,
+	baseRevision string,
+) (commitMetadata, error) {
+	metadata := commitMetadata{}
+	output, err := runGit(ctx, gitPath, clonePath, "log", "-1", "--format="+commitLogFormat, revision, "--")
+	if err != nil {
+		return metadata, fmt.Errorf("error reading commit %s: %s", revision, err)
+	}
+	fields := strings.SplitN(output, "\x00", 9)
+	if len(fields) != 9 {
+		return metadata, fmt.Errorf("unexpected git log output for commit %s", revision)
+	}
+
+	metadata.Hash = fields[0]
+	metadata.ShortHash = fields[0][:min(len(fields[0]), 12)]
+	metadata.Parents = strings.Fields(fields[1])
+	metadata.Author = commitActor{Name: fields[2], Email: fields[3], Date: fields[4]}
+	metadata.Committer = commitActor{Name: fields[5], Email: fields[6], Date: fields[7]}
+	metadata.Message = strings.TrimSpace(fields[8])
+	metadata.Subject, _, _ = strings.Cut(metadata.Message, "\n")
+	metadata.PrNumber = getPrNumber(metadata.Subject, metadata.Message)
+
+	if baseRevision == "" {
+		// A root commit, or a shallow clone without the parent, has all of
+		// its files changed
+		baseRevision = EMPTY_TREE_HASH
+		if len(metadata.Parents) > 0 && hasCommit(ctx, gitPath, clonePath, metadata.Parents[0]) {
+			baseRevision = metadata.Parents[0]
+		} else if len(metadata.Parents) > 0 {
+			slog.Warn("The parent of the commit is not available, so all of the files are changed", "parent", metadata.Parents[0])
+		}
+	}
+	metadata.ChangedFiles, err = getChangedFiles(ctx, gitPath, clonePath, baseRevision, metadata.Hash)
+	if err != nil {
+		return metadata, err
+	}
+	return metadata, nil
+}
+
+// Returns the PR number from the commit subject or message of a merged PR,
+// or 0 if it cannot be derived
+func getPrNumber(subject string, message string) int {
+	for _, prNumberRegexp := range prNumberSubjectRegexps {
+		if match := prNumberRegexp.FindStringSubmatch(subject); match != nil {
+			prNumber, _ := strconv.Atoi(match[1])
+			return prNumber
+		}
+	}
+	if match := prNumberMessageRegexp.FindStringSubmatch(message); match != nil {
+		prNumber, _ := strconv.Atoi(match[1])
+		return prNumber
+	}
+	return 0
+}
+
+// Returns the files that changed between the base and the revision. A
+// renamed file is the deleted old path and the added new path
+func getChangedFiles(
+	ctx context.Context,
+	gitPath string,
+	clonePath string,
+	baseRevision string,
+	revision string,
+) ([]changedFile, error) {
+	output, err := runGit(ctx, gitPath, clonePath, "diff", "--name-status", "--no-renames", "-z", baseRevision, revision, "--")
+	if err != nil {
+		return nil, fmt.Errorf("error diffing %s and %s: %s", baseRevision, revision, err)
+	}
+
+	// The output alternates the status and the path
+	changedFiles := []changedFile{}
+	fields := strings.Split(strings.TrimSuffix(output, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, found := changedFileStatuses[fields[i]]
+		if !found {
+			status = fields[i]
+		}
+		changedFiles = append(changedFiles, changedFile{Path: fields[i+1], Status: status})
+	}
+	return changedFiles, nil
+}
+
+// Returns whether the commit is in the clone
+func hasCommit(ctx context.Context, gitPath string, clonePath string, commit string) bool {
+	_, err := runGit(ctx, gitPath, clonePath, "rev-parse", "--verify", "--quiet", commit+"^{commit}")
+	return err == nil
+}
+
+// Writes the metadata to the output file as JSON
+func writeCommitMetadata(metadata commitMetadata, outputFile string) error {
+	bytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling commit metadata: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(outputFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating output file dir: %s", err)
+	}
+	err = os.WriteFile(outputFile, append(bytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing output file: %s", err)
+	}
+	return nil
+}
+
+// Runs the git command in the clone path and returns the stdout
+func runGit(ctx context.Context, gitPath string, clonePath string, args ...string) (string, error) {
+	args = append([]string{"-C", clonePath}, args...)
+	slog.Debug("Running git", "args", args)
+
+	stdout := &bytes.Buffer{}
+	gitCmd := exec.CommandContext(ctx, gitPath, args...)
+	gitCmd.Stdout = stdout
+	gitCmd.Stderr = os.Stderr
+	err := gitCmd.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf("git %s failed: %w", args[2], err)
+	}
+	return stdout.String(), nil
+}
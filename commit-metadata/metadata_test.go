@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Creates a repo with a main branch in a temp dir. Returns the path of the
+// repo
+func newTestRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath(DEFAULT_GIT_PATH); err != nil {
+		t.Skip("git is not installed")
+	}
+	clonePath := t.TempDir()
+	gitTest(t, clonePath, "init", "--quiet", "--initial-branch=main")
+	gitTest(t, clonePath, "config", "user.name", "test")
+	gitTest(t, clonePath, "config", "user.email", "test@example.com")
+	gitTest(t, clonePath, "config", "commit.gpgsign", "false")
+	return clonePath
+}
+
+// Runs the git command in the clone, and returns the trimmed stdout
+func gitTest(t *testing.T, clonePath string, args ...string) string {
+	t.Helper()
+	output, err := runGit(context.Background(), DEFAULT_GIT_PATH, clonePath, args...)
+	if err != nil {
+		t.Fatalf("git %s failed: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(output)
+}
+
+// Writes the files, removes the files with no content, and commits them
+// with the message. Returns the commit hash
+func commitTestFiles(t *testing.T, clonePath string, message string, files map[string]string) string {
+	t.Helper()
+	for file, content := range files {
+		path := filepath.Join(clonePath, file)
+		var err error
+		if content == "" {
+			err = os.Remove(path)
+		} else {
+			err = os.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatalf("error updating %s: %s", file, err)
+		}
+	}
+	gitTest(t, clonePath, "add", "--all")
+	gitTest(t, clonePath, "commit", "--quiet", "--message", message)
+	return gitTest(t, clonePath, "rev-parse", "HEAD")
+}
+
+func TestGetPrNumber(t *testing.T) {
+	tests := []struct {
+		subject string
+		message string
+		want    int
+	}{
+		{subject: "Merge pull request #123 from org/branch", want: 123},
+		{subject: "Add the feature (#45)", want: 45},
+		{subject: "Merge branch 'feature' into 'main'", message: "Merge branch 'feature' into 'main'\n\nSee merge request org/repo!67", want: 67},
+		{subject: "Add the feature", want: 0},
+		{subject: "Fix #12 in the parser", want: 0},
+	}
+	for _, tt := range tests {
+		message := tt.message
+		if message == "" {
+			message = tt.subject
+		}
+		if got := getPrNumber(tt.subject, message); got != tt.want {
+			t.Errorf("getPrNumber(%q, %q) = %d, want %d", tt.subject, message, got, tt.want)
+		}
+	}
+}
+
+func TestGetCommitMetadata(t *testing.T) {
+	clonePath := newTestRepo(t)
+	root := commitTestFiles(t, clonePath, "Initial commit", map[string]string{"README.md": "readme", "old.txt": "old"})
+	base := commitTestFiles(t, clonePath, "Add the config", map[string]string{"config.yaml": "config"})
+	revision := commitTestFiles(
+		t,
+		clonePath,
+		"Add the feature (#45)\n\nThe feature body",
+		map[string]string{"README.md": "updated", "old.txt": "", "new.txt": "new"},
+	)
+
+	tests := []struct {
+		name             string
+		revision         string
+		baseRevision     string
+		wantParents      []string
+		wantSubject      string
+		wantMessage      string
+		wantPrNumber     int
+		wantChangedFiles []changedFile
+	}{
+		{
+			name:         "diff against the parent",
+			revision:     revision,
+			wantParents:  []string{base},
+			wantSubject:  "Add the feature (#45)",
+			wantMessage:  "Add the feature (#45)\n\nThe feature body",
+			wantPrNumber: 45,
+			wantChangedFiles: []changedFile{
+				{Path: "README.md", Status: "modified"},
+				{Path: "new.txt", Status: "added"},
+				{Path: "old.txt", Status: "deleted"},
+			},
+		},
+		{
+			name:         "diff against the base",
+			revision:     revision,
+			baseRevision: root,
+			wantParents:  []string{base},
+			wantSubject:  "Add the feature (#45)",
+			wantMessage:  "Add the feature (#45)\n\nThe feature body",
+			wantPrNumber: 45,
+			wantChangedFiles: []changedFile{
+				{Path: "README.md", Status: "modified"},
+				{Path: "config.yaml", Status: "added"},
+				{Path: "new.txt", Status: "added"},
+				{Path: "old.txt", Status: "deleted"},
+			},
+		},
+		{
+			name:        "root commit",
+			revision:    root,
+			wantParents: []string{},
+			wantSubject: "Initial commit",
+			wantMessage: "Initial commit",
+			wantChangedFiles: []changedFile{
+				{Path: "README.md", Status: "added"},
+				{Path: "old.txt", Status: "added"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getCommitMetadata(context.Background(), DEFAULT_GIT_PATH, clonePath, tt.revision, tt.baseRevision)
+			if err != nil {
+				t.Fatalf("getCommitMetadata() error = %v", err)
+			}
+			if got.Hash != tt.revision || got.ShortHash != tt.revision[:12] {
+				t.Errorf("got hash %s and short hash %s, want %s", got.Hash, got.ShortHash, tt.revision)
+			}
+			if !reflect.DeepEqual(got.Parents, tt.wantParents) {
+				t.Errorf("got parents %q, want %q", got.Parents, tt.wantParents)
+			}
+			if got.Author.Name != "test" || got.Author.Email != "test@example.com" || got.Author.Date == "" {
+				t.Errorf("got author %+v, want test <test@example.com> with a date", got.Author)
+			}
+			if got.Subject != tt.wantSubject || got.Message != tt.wantMessage {
+				t.Errorf("got subject %q and message %q, want %q and %q", got.Subject, got.Message, tt.wantSubject, tt.wantMessage)
+			}
+			if got.PrNumber != tt.wantPrNumber {
+				t.Errorf("got PR number %d, want %d", got.PrNumber, tt.wantPrNumber)
+			}
+			if !reflect.DeepEqual(got.ChangedFiles, tt.wantChangedFiles) {
+				t.Errorf("got changed files %+v, want %+v", got.ChangedFiles, tt.wantChangedFiles)
+			}
+		})
+	}
+}
+
+func TestGetCommitMetadataUnknownRevision(t *testing.T) {
+	clonePath := newTestRepo(t)
+	commitTestFiles(t, clonePath, "Initial commit", map[string]string{"README.md": "readme"})
+
+	_, err := getCommitMetadata(context.Background(), DEFAULT_GIT_PATH, clonePath, "unknown", "")
+	if err == nil || !strings.Contains(err.Error(), "error reading commit unknown") {
+		t.Errorf("getCommitMetadata() error = %v, want a read error", err)
+	}
+}
+
+func TestWriteCommitMetadata(t *testing.T) {
+	metadata := commitMetadata{
+		Hash:         "0123456789abcdef",
+		ShortHash:    "0123456789ab",
+		Parents:      []string{"fedcba9876543210"},
+		Author:       commitActor{Name: "test", Email: "test@example.com", Date: "2024-01-02T03:04:05Z"},
+		Committer:    commitActor{Name: "test", Email: "test@example.com", Date: "2024-01-02T03:04:05Z"},
+		Subject:      "Add the feature",
+		Message:      "Add the feature",
+		ChangedFiles: []changedFile{{Path: "README.md", Status: "modified"}},
+	}
+	outputFile := filepath.Join(t.TempDir(), "output", "metadata.json")
+	err := writeCommitMetadata(metadata, outputFile)
+	if err != nil {
+		t.Fatalf("writeCommitMetadata() error = %v", err)
+	}
+
+	content, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("error reading output file: %s", err)
+	}
+	if !strings.HasSuffix(string(content), "}\n") {
+		t.Errorf("got output %q, want a trailing newline", content)
+	}
+	// The PR number is left out when it is unknown
+	if strings.Contains(string(content), "prNumber") {
+		t.Errorf("got output %s, want no prNumber", content)
+	}
+	var got commitMetadata
+	err = json.Unmarshal(content, &got)
+	if err != nil {
+		t.Fatalf("error unmarshalling output file: %s", err)
+	}
+	if !reflect.DeepEqual(got, metadata) {
+		t.Errorf("got metadata %+v, want %+v", got, metadata)
+	}
+}
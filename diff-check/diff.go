@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The status written when relevant paths changed, so the build runs
+	CHANGED_STATUS = "Changed"
+	// The status written when no relevant paths changed, which docker-build
+	// reads to skip the build
+	SKIPPED_STATUS = "Skipped"
+)
+
+// The options for matching the changed paths against the paths of an image
+type diffOptions struct {
+	clonePath        string
+	dockerfile       string
+	dockerContextDir string
+	// The globs of the paths that need the build when changed. Defaults to
+	// the dockerfile and the docker context dir
+	paths []string
+	// The globs of the changed paths that never need the build
+	ignorePaths []string
+	statusFile  string
+	gitPath     string
+}
+
+// The content of the status file, which docker-build reads with the
+// status-file flag
+type statusFileContent struct {
+	Status string `json:"status"`
+	// Why the status was chosen (e.g. no changes in the docker context dir)
+	Reason string `json:"reason,omitempty"`
+	// All of the changed paths, which the matrix builds can filter on
+	ChangedPaths []string `json:"changedPaths,omitempty"`
+	// The changed paths that matched the path filters
+	MatchedPaths []string `json:"matchedPaths,omitempty"`
+}
+
+func getDiffOptions(flags *pflag.FlagSet, cmdName string) (diffOptions, error) {
+	var opts diffOptions
+	var err error
+
+	opts.clonePath, err = flags.GetString("clone-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s clone-path flag", cmdName)
+	}
+
+	opts.dockerfile, err = flags.GetString("dockerfile")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s dockerfile flag", cmdName)
+	}
+
+	opts.dockerContextDir, err = flags.GetString("docker-context-dir")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s docker-context-dir flag", cmdName)
+	}
+
+	opts.paths, err = flags.GetStringArray("path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s path flag", cmdName)
+	}
+
+	matrixFile, err := flags.GetString("matrix-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s matrix-file flag", cmdName)
+	}
+	matrixBuildName, err := flags.GetString("matrix-build")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s matrix-build flag", cmdName)
+	}
+	if (matrixFile == "") != (matrixBuildName == "") {
+		return opts, fmt.Errorf("matrix-file and matrix-build must be set together")
+	}
+	if matrixFile != "" {
+		if opts.dockerfile != "" || opts.dockerContextDir != "" || len(opts.paths) > 0 {
+			return opts, fmt.Errorf("dockerfile, docker-context-dir, and path cannot be set with matrix-file")
+		}
+		build, err := readMatrixBuild(matrixFile, matrixBuildName)
+		if err != nil {
+			return opts, err
+		}
+		opts.dockerfile = build.Dockerfile
+		opts.dockerContextDir = build.Context
+		opts.paths = build.Paths
+	}
+
+	opts.ignorePaths, err = flags.GetStringArray("ignore-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s ignore-path flag", cmdName)
+	}
+
+	opts.statusFile, err = flags.GetString("status-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s status-file flag", cmdName)
+	}
+
+	opts.gitPath, err = flags.GetString("git-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s git-path flag", cmdName)
+	}
+
+	// Validate the globs up front, so a typo fails before the diff
+	for _, path := range append(opts.paths, opts.ignorePaths...) {
+		_, err = compilePathPattern(path)
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+func (opts diffOptions) logAttrs() []any {
+	return []any{
+		"clonePath", opts.clonePath,
+		"dockerfile", opts.dockerfile,
+		"dockerContextDir", opts.dockerContextDir,
+		"paths", opts.paths,
+		"ignorePaths", opts.ignorePaths,
+		"statusFile", opts.statusFile,
+		"gitPath", opts.gitPath,
+	}
+}
+
+// Returns the path filters of the image. Without the path flag, the
+// filters are the dockerfile and the docker context dir. An empty list
+// means the build is always needed
+func (opts diffOptions) getPaths() []string {
+	if len(opts.paths) > 0 {
+		return opts.paths
+	}
+	if opts.dockerContextDir == "" {
+		// Without a docker context dir (e.g. a remote context), the
+		// changes in the repo cannot be matched to the build
+		return nil
+	}
+	paths := []string{opts.dockerContextDir}
+	if opts.dockerfile != "" {
+		paths = append(paths, opts.dockerfile)
+	}
+	return paths
+}
+
+// Returns the status of the changed paths. The ignored paths are removed
+// before the changed paths are matched against the path filters
+func (opts diffOptions) getStatus(changedPaths []string) (statusFileContent, error) {
+	content := statusFileContent{ChangedPaths: changedPaths}
+	paths := opts.getPaths()
+	if len(paths) == 0 {
+		content.Status = CHANGED_STATUS
+		content.Reason = "No docker context dir or path filters, so the build is always needed"
+		return content, nil
+	}
+
+	pathMatcher, err := newPathMatcher(paths)
+	if err != nil {
+		return content, err
+	}
+	ignoreMatcher, err := newPathMatcher(opts.ignorePaths)
+	if err != nil {
+		return content, err
+	}
+	for _, changedPath := range changedPaths {
+		if ignoreMatcher.matches(changedPath) {
+			slog.Debug("Ignoring changed path", "changedPath", changedPath)
+			continue
+		}
+		if pathMatcher.matches(changedPath) {
+			content.MatchedPaths = append(content.MatchedPaths, changedPath)
+		}
+	}
+
+	if len(content.MatchedPaths) == 0 {
+		content.Status = SKIPPED_STATUS
+		content.Reason = fmt.Sprintf("No changes in the paths %s", paths)
+		return content, nil
+	}
+	content.Status = CHANGED_STATUS
+	content.Reason = fmt.Sprintf("%d changed paths match the paths %s", len(content.MatchedPaths), paths)
+	return content, nil
+}
+
+// Writes the status of the changed paths to the status file as JSON
+func (opts diffOptions) writeStatus(changedPaths []string) error {
+	content, err := opts.getStatus(changedPaths)
+	if err != nil {
+		return err
+	}
+	slog.Info(
+		"Writing status file",
+		"status", content.Status,
+		"reason", content.Reason,
+		"matchedPaths", content.MatchedPaths,
+		"statusFile", opts.statusFile,
+	)
+
+	bytes, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling status file: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(opts.statusFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating status file dir: %s", err)
+	}
+	err = os.WriteFile(opts.statusFile, append(bytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing status file: %s", err)
+	}
+	return nil
+}
+
+// Matches the changed paths against a list of path globs
+type pathMatcher struct {
+	// Whether any path matches, for the clone root
+	matchAll bool
+	regexps  []*regexp.Regexp
+}
+
+func newPathMatcher(paths []string) (pathMatcher, error) {
+	matcher := pathMatcher{}
+	for _, path := range paths {
+		if normalizePath(path) == "." {
+			matcher.matchAll = true
+			continue
+		}
+		pathRegexp, err := compilePathPattern(path)
+		if err != nil {
+			return matcher, err
+		}
+		matcher.regexps = append(matcher.regexps, pathRegexp)
+	}
+	return matcher, nil
+}
+
+// Returns whether the changed path, relative to the clone path, matches
+// any of the globs
+func (m pathMatcher) matches(changedPath string) bool {
+	if m.matchAll {
+		return true
+	}
+	changedPath = normalizePath(changedPath)
+	for _, pathRegexp := range m.regexps {
+		if pathRegexp.MatchString(changedPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the path relative to the clone path with forward slashes. A
+// leading slash is removed, since the paths are relative to the clone
+func normalizePath(path string) string {
+	path = filepath.ToSlash(filepath.Clean(path))
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// Compiles a path glob to a regexp. The glob supports * and ? within a path
+// segment, ** across segments, and character classes. A glob matching a
+// dir also matches everything under it
+func compilePathPattern(pattern string) (*regexp.Regexp, error) {
+	normalized := normalizePath(pattern)
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(normalized); i++ {
+		ch := normalized[i]
+		switch {
+		case ch == '*' && strings.HasPrefix(normalized[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case ch == '*' && strings.HasPrefix(normalized[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case ch == '*':
+			sb.WriteString("[^/]*")
+		case ch == '?':
+			sb.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(normalized[i:], ']')
+			if end < 0 {
+				return nil, errors.New("invalid path glob: " + pattern)
+			}
+			class := normalized[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	sb.WriteString("(/.*)?$")
+	return regexp.Compile(sb.String())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCompilePathPattern(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		matches   []string
+		noMatches []string
+	}{
+		{
+			pattern:   "app",
+			matches:   []string{"app", "app/main.go", "app/src/lib.go"},
+			noMatches: []string{"application", "lib/app"},
+		},
+		{
+			pattern:   "/app/",
+			matches:   []string{"app/main.go"},
+			noMatches: []string{"other/main.go"},
+		},
+		{
+			pattern:   "app/*.go",
+			matches:   []string{"app/main.go"},
+			noMatches: []string{"app/README.md"},
+		},
+		{
+			pattern:   "app/**/*.go",
+			matches:   []string{"app/main.go", "app/src/lib.go", "app/src/pkg/lib.go"},
+			noMatches: []string{"app/src/README.md"},
+		},
+		{
+			pattern:   "**/Dockerfile",
+			matches:   []string{"Dockerfile", "app/Dockerfile", "a/b/Dockerfile"},
+			noMatches: []string{"Dockerfile.dev"},
+		},
+		{
+			pattern:   "app/**",
+			matches:   []string{"app/main.go", "app/src/lib.go"},
+			noMatches: []string{"lib/main.go"},
+		},
+		{
+			pattern:   "app/v?.go",
+			matches:   []string{"app/v1.go"},
+			noMatches: []string{"app/v10.go", "app/v/.go"},
+		},
+		{
+			pattern:   "app/[ab].go",
+			matches:   []string{"app/a.go", "app/b.go"},
+			noMatches: []string{"app/c.go"},
+		},
+		{
+			pattern:   "app/[!ab].go",
+			matches:   []string{"app/c.go"},
+			noMatches: []string{"app/a.go"},
+		},
+		{
+			pattern:   "app/main.go",
+			matches:   []string{"app/main.go"},
+			noMatches: []string{"app/mainxgo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			pathRegexp, err := compilePathPattern(tt.pattern)
+			if err != nil {
+				t.Fatalf("compilePathPattern(%q) error = %v", tt.pattern, err)
+			}
+			for _, path := range tt.matches {
+				if !pathRegexp.MatchString(normalizePath(path)) {
+					t.Errorf("compilePathPattern(%q) does not match %s", tt.pattern, path)
+				}
+			}
+			for _, path := range tt.noMatches {
+				if pathRegexp.MatchString(normalizePath(path)) {
+					t.Errorf("compilePathPattern(%q) matches %s", tt.pattern, path)
+				}
+			}
+		})
+	}
+}
+
+func TestCompilePathPatternInvalid(t *testing.T) {
+	_, err := compilePathPattern("app/[ab.go")
+	if err == nil {
+		t.Errorf("compilePathPattern() of an unclosed character class did not fail")
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	tests := []struct {
+		name             string
+		opts             diffOptions
+		changedPaths     []string
+		wantStatus       string
+		wantMatchedPaths []string
+	}{
+		{
+			name:         "no context dir",
+			opts:         diffOptions{},
+			changedPaths: []string{"README.md"},
+			wantStatus:   CHANGED_STATUS,
+		},
+		{
+			name:             "change in the context dir",
+			opts:             diffOptions{dockerContextDir: "app", dockerfile: "app/Dockerfile"},
+			changedPaths:     []string{"README.md", "app/main.go"},
+			wantStatus:       CHANGED_STATUS,
+			wantMatchedPaths: []string{"app/main.go"},
+		},
+		{
+			name:         "no change in the context dir",
+			opts:         diffOptions{dockerContextDir: "app", dockerfile: "app/Dockerfile"},
+			changedPaths: []string{"README.md", "lib/main.go"},
+			wantStatus:   SKIPPED_STATUS,
+		},
+		{
+			name:             "change in the dockerfile outside the context dir",
+			opts:             diffOptions{dockerContextDir: "app", dockerfile: "docker/app.Dockerfile"},
+			changedPaths:     []string{"docker/app.Dockerfile"},
+			wantStatus:       CHANGED_STATUS,
+			wantMatchedPaths: []string{"docker/app.Dockerfile"},
+		},
+		{
+			name:         "ignored change",
+			opts:         diffOptions{dockerContextDir: "app", ignorePaths: []string{"**/*.md"}},
+			changedPaths: []string{"app/README.md"},
+			wantStatus:   SKIPPED_STATUS,
+		},
+		{
+			name:             "path filters override the context dir",
+			opts:             diffOptions{dockerContextDir: "app", paths: []string{"lib/**/*.go"}},
+			changedPaths:     []string{"app/main.go", "lib/util/util.go"},
+			wantStatus:       CHANGED_STATUS,
+			wantMatchedPaths: []string{"lib/util/util.go"},
+		},
+		{
+			name:             "clone root context dir",
+			opts:             diffOptions{dockerContextDir: "."},
+			changedPaths:     []string{"README.md"},
+			wantStatus:       CHANGED_STATUS,
+			wantMatchedPaths: []string{"README.md"},
+		},
+		{
+			name:         "no changed paths",
+			opts:         diffOptions{dockerContextDir: "app"},
+			changedPaths: []string{},
+			wantStatus:   SKIPPED_STATUS,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := tt.opts.getStatus(tt.changedPaths)
+			if err != nil {
+				t.Fatalf("getStatus() error = %v", err)
+			}
+			if content.Status != tt.wantStatus {
+				t.Errorf("getStatus() status = %s, want %s: %s", content.Status, tt.wantStatus, content.Reason)
+			}
+			if !slices.Equal(content.MatchedPaths, tt.wantMatchedPaths) {
+				t.Errorf("getStatus() matched paths = %q, want %q", content.MatchedPaths, tt.wantMatchedPaths)
+			}
+		})
+	}
+}
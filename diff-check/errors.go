@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+)
+
+// The class of a diff-check failure. Each class maps to a distinct exit
+// code, so a pipeline can tell a misconfigured step from a failed diff. The
+// shared classes have the exit codes of docker-build
+type errorClass string
+
+const (
+	// An unexpected runtime failure without a more specific class, such as
+	// an IO error writing the status file
+	INTERNAL_ERROR errorClass = "InternalError"
+	// Invalid flags or configuration (e.g. a bad path pattern). Retrying
+	// will not help
+	FLAG_ERROR errorClass = "FlagError"
+	// The revisions could not be diffed (e.g. a revision was not fetched to
+	// the clone)
+	GIT_ERROR errorClass = "GitError"
+)
+
+// The exit code for each error class
+var errorClassExitCodes = map[errorClass]int{
+	INTERNAL_ERROR: 1,
+	FLAG_ERROR:     2,
+	GIT_ERROR:      3,
+}
+
+// An error with an error class
+type stepError struct {
+	class errorClass
+	err   error
+}
+
+func newStepError(class errorClass, err error) error {
+	return &stepError{class: class, err: err}
+}
+
+func (e *stepError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.err
+}
+
+// Returns the class of the error, or an empty class if the error
+// is not classified
+func getErrorClass(err error) errorClass {
+	var stepErr *stepError
+	if errors.As(err, &stepErr) {
+		return stepErr.class
+	}
+	return ""
+}
+
+// Returns the error with the class, unless the error is already classified
+func withDefaultClass(class errorClass, err error) error {
+	if getErrorClass(err) != "" {
+		return err
+	}
+	return newStepError(class, err)
+}
+
+// Returns the exit code for the error
+func getExitCode(err error) int {
+	exitCode, found := errorClassExitCodes[getErrorClass(err)]
+	if !found {
+		return 1
+	}
+	return exitCode
+}
+
+// Wraps a command handler so that any errors not classified by the
+// handler are classified. The handlers silence the usage once the flags
+// are validated, so the errors before that are flag errors, and the errors
+// after are internal errors
+func withErrorClasses(
+	handler func(cmd *cobra.Command, args []string) error,
+) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		err := handler(cmd, args)
+		if err == nil {
+			return nil
+		}
+		if cmd.SilenceUsage {
+			return withDefaultClass(INTERNAL_ERROR, err)
+		}
+		return withDefaultClass(FLAG_ERROR, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestWithErrorClasses(t *testing.T) {
+	tests := []struct {
+		name         string
+		silenceUsage bool
+		err          error
+		wantClass    errorClass
+		wantExitCode int
+	}{
+		{name: "no error", err: nil},
+		{name: "flag error", err: fmt.Errorf("bad path pattern"), wantClass: FLAG_ERROR, wantExitCode: 2},
+		{name: "internal error", silenceUsage: true, err: fmt.Errorf("io error"), wantClass: INTERNAL_ERROR, wantExitCode: 1},
+		{
+			name:         "git error",
+			silenceUsage: true,
+			err:          newStepError(GIT_ERROR, fmt.Errorf("unknown revision")),
+			wantClass:    GIT_ERROR,
+			wantExitCode: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := withErrorClasses(func(cmd *cobra.Command, args []string) error {
+				cmd.SilenceUsage = tt.silenceUsage
+				return tt.err
+			})
+			err := handler(&cobra.Command{}, nil)
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("got error %s, want nil", err)
+				}
+				return
+			}
+			if class := getErrorClass(err); class != tt.wantClass {
+				t.Errorf("got class %q, want %q", class, tt.wantClass)
+			}
+			if exitCode := getExitCode(err); exitCode != tt.wantExitCode {
+				t.Errorf("got exit code %d, want %d", exitCode, tt.wantExitCode)
+			}
+		})
+	}
+}
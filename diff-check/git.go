@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The hash of the empty git tree, which a root commit is diffed against
+const EMPTY_TREE_HASH = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// Returns the paths that changed between the base and the revision,
+// relative to the clone path. A renamed path is returned as the deleted
+// old path and the added new path, since either can match a filter
+func (opts diffOptions) getChangedPaths(
+	ctx context.Context,
+	baseRevisionHash string,
+	revisionHash string,
+) ([]string, error) {
+	output, err := runGit(
+		ctx,
+		opts.gitPath,
+		opts.clonePath,
+		"diff",
+		"--name-only",
+		"--no-renames",
+		"-z",
+		baseRevisionHash,
+		revisionHash,
+		"--")
+	if err != nil {
+		return nil, newStepError(GIT_ERROR, fmt.Errorf("error diffing %s and %s: %s", baseRevisionHash, revisionHash, err))
+	}
+
+	changedPaths := []string{}
+	for _, changedPath := range strings.Split(output, "\x00") {
+		if changedPath != "" {
+			changedPaths = append(changedPaths, changedPath)
+		}
+	}
+	slog.Info("Found changed paths", "count", len(changedPaths), "changedPaths", changedPaths)
+	return changedPaths, nil
+}
+
+// Returns the paths that the commit changed, compared to its first
+// parent. If the parent is not available (e.g. a root commit, or a
+// shallow clone without the parent), all of the files of the commit are
+// changed, so the build is not skipped by mistake
+func (opts diffOptions) getCommitChangedPaths(ctx context.Context, revisionHash string) ([]string, error) {
+	parent := revisionHash + "^1^{commit}"
+	baseRevisionHash, err := runGit(ctx, opts.gitPath, opts.clonePath, "rev-parse", "--verify", "--quiet", parent)
+	baseRevisionHash = strings.TrimSpace(baseRevisionHash)
+	if err != nil || baseRevisionHash == "" {
+		slog.Warn("The parent of the commit is not available, so all of the files are changed", "revisionHash", revisionHash)
+		baseRevisionHash = EMPTY_TREE_HASH
+	}
+	return opts.getChangedPaths(ctx, baseRevisionHash, revisionHash)
+}
+
+// Runs the git command in the clone path and returns the stdout
+func runGit(ctx context.Context, gitPath string, clonePath string, args ...string) (string, error) {
+	args = append([]string{"-C", clonePath}, args...)
+	slog.Debug("Running git", "args", args)
+
+	stdout := &bytes.Buffer{}
+	gitCmd := exec.CommandContext(ctx, gitPath, args...)
+	gitCmd.Stdout = stdout
+	gitCmd.Stderr = os.Stderr
+	err := gitCmd.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf("git %s failed: %w", args[2], err)
+	}
+	return stdout.String(), nil
+}
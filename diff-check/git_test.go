@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Creates a git repo in a temp dir. Returns the diff options for the repo
+func newTestRepo(t *testing.T) diffOptions {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	opts := diffOptions{clonePath: t.TempDir(), gitPath: "git"}
+	gitTest(t, opts, "init", "--quiet")
+	gitTest(t, opts, "config", "user.name", "test")
+	gitTest(t, opts, "config", "user.email", "test@example.com")
+	gitTest(t, opts, "config", "commit.gpgsign", "false")
+	return opts
+}
+
+// Runs the git command in the test repo, and returns the trimmed stdout
+func gitTest(t *testing.T, opts diffOptions, args ...string) string {
+	t.Helper()
+	output, err := runGit(context.Background(), opts.gitPath, opts.clonePath, args...)
+	if err != nil {
+		t.Fatalf("git %s failed: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(output)
+}
+
+// Writes the files, and commits them along with the removals. Returns the
+// commit hash
+func commitTestFiles(t *testing.T, opts diffOptions, files map[string]string, removals ...string) string {
+	t.Helper()
+	for file, content := range files {
+		path := filepath.Join(opts.clonePath, file)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatalf("error creating dir: %s", err)
+		}
+		err = os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("error writing file: %s", err)
+		}
+	}
+	for _, removal := range removals {
+		gitTest(t, opts, "rm", "--quiet", removal)
+	}
+	gitTest(t, opts, "add", "--all")
+	gitTest(t, opts, "commit", "--quiet", "--message", "test")
+	return gitTest(t, opts, "rev-parse", "HEAD")
+}
+
+func TestGetCommitChangedPaths(t *testing.T) {
+	opts := newTestRepo(t)
+	ctx := context.Background()
+
+	rootCommit := commitTestFiles(t, opts, map[string]string{
+		"README.md":      "readme",
+		"app/Dockerfile": "FROM scratch",
+		"app/main.go":    "package main",
+	})
+	// The root commit has no parent, so all of its files are changed
+	changedPaths, err := opts.getCommitChangedPaths(ctx, rootCommit)
+	if err != nil {
+		t.Fatalf("getCommitChangedPaths() error = %v", err)
+	}
+	want := []string{"README.md", "app/Dockerfile", "app/main.go"}
+	if !slices.Equal(changedPaths, want) {
+		t.Errorf("getCommitChangedPaths() of the root commit = %q, want %q", changedPaths, want)
+	}
+
+	gitTest(t, opts, "mv", "app/main.go", "app/server.go")
+	commit := commitTestFiles(t, opts, map[string]string{"lib/with space.go": "package lib"}, "README.md")
+	// The rename is the removed old path and the added new path
+	changedPaths, err = opts.getCommitChangedPaths(ctx, commit)
+	if err != nil {
+		t.Fatalf("getCommitChangedPaths() error = %v", err)
+	}
+	want = []string{"README.md", "app/main.go", "app/server.go", "lib/with space.go"}
+	if !slices.Equal(changedPaths, want) {
+		t.Errorf("getCommitChangedPaths() = %q, want %q", changedPaths, want)
+	}
+}
+
+func TestGetChangedPaths(t *testing.T) {
+	opts := newTestRepo(t)
+	ctx := context.Background()
+
+	baseCommit := commitTestFiles(t, opts, map[string]string{"app/main.go": "package main"})
+	commitTestFiles(t, opts, map[string]string{"app/main.go": "package main\n"})
+	commit := commitTestFiles(t, opts, map[string]string{"docs/index.md": "docs"})
+
+	// The changes of all of the commits since the base are included
+	changedPaths, err := opts.getChangedPaths(ctx, baseCommit, commit)
+	if err != nil {
+		t.Fatalf("getChangedPaths() error = %v", err)
+	}
+	want := []string{"app/main.go", "docs/index.md"}
+	if !slices.Equal(changedPaths, want) {
+		t.Errorf("getChangedPaths() = %q, want %q", changedPaths, want)
+	}
+
+	_, err = opts.getChangedPaths(ctx, "0000000000000000000000000000000000000000", commit)
+	if err == nil {
+		t.Errorf("getChangedPaths() of an unknown base did not fail")
+	} else if class := getErrorClass(err); class != GIT_ERROR {
+		t.Errorf("got class %q, want %q", class, GIT_ERROR)
+	}
+}
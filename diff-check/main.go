@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "diff-check"
+
+const (
+	// The default git path, which is resolved with the PATH
+	DEFAULT_GIT_PATH = "git"
+)
+
+var (
+	mainCmd = &cobra.Command{
+		Use:   "diff-check",
+		Short: "Check if a docker build is needed for a PR or Commit",
+		Long: `Checks if a docker build is needed for a PR or Commit.
+The changed paths are matched against the path filters of the image, and the
+status file is set to Changed or Skipped for docker-build`,
+		PersistentPreRunE: loadFlagValues,
+		RunE:              withErrorClasses(handleMainCmd),
+	}
+	prCmd = &cobra.Command{
+		Use:   "pr",
+		Short: "Check if a docker build is needed for a PR",
+		Long: `Checks if a docker build is needed for a PR.
+The changed paths are the diff between the base revision and the PR revision`,
+		RunE: withErrorClasses(handlePrCmd),
+	}
+	commitCmd = &cobra.Command{
+		Use:   "commit",
+		Short: "Check if a docker build is needed for a commit",
+		Long: `Checks if a docker build is needed for a commit.
+The changed paths are the diff between the base revision, which defaults to the
+parent of the commit, and the commit`,
+		RunE: withErrorClasses(handleCommitCmd),
+	}
+)
+
+func configureCmds() {
+	prFlags := prCmd.Flags()
+
+	prFlags.String("revision-hash", "", "The PR revision id (e.g. commit sha hash)")
+	prCmd.MarkFlagRequired("revision-hash")
+
+	prFlags.String("base-revision-hash", "", "The revision id of the PR base (e.g. commit sha hash)")
+	prCmd.MarkFlagRequired("base-revision-hash")
+
+	configureDiffFlags(prCmd)
+
+	commitFlags := commitCmd.Flags()
+
+	commitFlags.String("revision-hash", "", "The revision id (e.g. commit sha hash)")
+	commitCmd.MarkFlagRequired("revision-hash")
+
+	commitFlags.String(
+		"base-revision-hash",
+		"",
+		"The revision id to diff the commit against (e.g. the last built commit). Defaults to the parent of the "+
+			"commit, or all of the files for a root commit")
+
+	configureDiffFlags(commitCmd)
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the git args")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+
+	mainCmd.AddCommand(prCmd)
+	mainCmd.AddCommand(commitCmd)
+}
+
+// Configures the flags shared by the pr and commit subcommands
+func configureDiffFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.String("clone-path", "", "The path to the cloned repo, with the base and the revision fetched")
+	cmd.MarkFlagRequired("clone-path")
+
+	flags.String("dockerfile", "", "The path to the dockerfile to build, relative to the clone path")
+
+	flags.String(
+		"docker-context-dir",
+		"",
+		"The path to the docker context used for the build, relative to the clone path. If it is empty and no "+
+			"path is set, the build is always needed")
+
+	flags.StringArray(
+		"path",
+		nil,
+		"A glob of the paths that need the build when changed (e.g. services/api/** or libs/common). A dir "+
+			"matches everything under it. Defaults to the dockerfile and the docker context dir. Can be repeated")
+
+	flags.String(
+		"matrix-file",
+		"",
+		"The path to a build matrix file (e.g. written by the discover step), whose matrix-build sets the dockerfile, "+
+			"the docker context dir, and the paths")
+
+	flags.String("matrix-build", "", "The name of the build in the matrix file")
+
+	flags.StringArray(
+		"ignore-path",
+		nil,
+		"A glob of the changed paths that do not need the build (e.g. **/*.md). Can be repeated")
+
+	flags.String(
+		"status-file",
+		"",
+		"The path to write the status to. The status is Skipped if no relevant paths changed, and Changed otherwise")
+	cmd.MarkFlagRequired("status-file")
+
+	flags.String("git-path", DEFAULT_GIT_PATH, "The path to the git executable")
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	return fmt.Errorf("Must specify a subcommand")
+}
+
+func handlePrCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	prFlags := cmd.Flags()
+
+	revisionHash, err := prFlags.GetString("revision-hash")
+	if err != nil {
+		return fmt.Errorf("error processing pr revision-hash flag")
+	}
+
+	baseRevisionHash, err := prFlags.GetString("base-revision-hash")
+	if err != nil {
+		return fmt.Errorf("error processing pr base-revision-hash flag")
+	}
+
+	diffOpts, err := getDiffOptions(prFlags, "pr")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"revisionHash", revisionHash,
+		"baseRevisionHash", baseRevisionHash,
+	}
+	params = append(params, diffOpts.logAttrs()...)
+	slog.Info("PR diff check with params", params...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	changedPaths, err := diffOpts.getChangedPaths(cmd.Context(), baseRevisionHash, revisionHash)
+	if err != nil {
+		return err
+	}
+	return diffOpts.writeStatus(changedPaths)
+}
+
+func handleCommitCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	commitFlags := cmd.Flags()
+
+	revisionHash, err := commitFlags.GetString("revision-hash")
+	if err != nil {
+		return fmt.Errorf("error processing commit revision-hash flag")
+	}
+
+	baseRevisionHash, err := commitFlags.GetString("base-revision-hash")
+	if err != nil {
+		return fmt.Errorf("error processing commit base-revision-hash flag")
+	}
+
+	diffOpts, err := getDiffOptions(commitFlags, "commit")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"revisionHash", revisionHash,
+		"baseRevisionHash", baseRevisionHash,
+	}
+	params = append(params, diffOpts.logAttrs()...)
+	slog.Info("Commit diff check with params", params...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	var changedPaths []string
+	if baseRevisionHash == "" {
+		changedPaths, err = diffOpts.getCommitChangedPaths(cmd.Context(), revisionHash)
+	} else {
+		changedPaths, err = diffOpts.getChangedPaths(cmd.Context(), baseRevisionHash, revisionHash)
+	}
+	if err != nil {
+		return err
+	}
+	return diffOpts.writeStatus(changedPaths)
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err, "errorClass", getErrorClass(err))
+		// Errors not classified by the subcommands are from the cobra
+		// flag and arg validation
+		if getErrorClass(err) == "" {
+			err = newStepError(FLAG_ERROR, err)
+		}
+		os.Exit(getExitCode(err))
+	}
+}
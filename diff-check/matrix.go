@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The build matrix file of docker-build (e.g. written by the discover
+// step). Only the fields that select the paths of a build are read, since
+// docker-build validates the rest
+type buildMatrix struct {
+	Builds []matrixBuild `yaml:"builds"`
+}
+
+type matrixBuild struct {
+	Name       string   `yaml:"name"`
+	Dockerfile string   `yaml:"dockerfile"`
+	Context    string   `yaml:"context"`
+	Paths      []string `yaml:"paths"`
+}
+
+// Returns the build of the build matrix file with the name. The context
+// defaults to the dir of the dockerfile, and the name to the dockerfile,
+// as in docker-build matrix
+func readMatrixBuild(matrixFile string, name string) (matrixBuild, error) {
+	matrixBytes, err := os.ReadFile(matrixFile)
+	if err != nil {
+		return matrixBuild{}, fmt.Errorf("error reading build matrix file: %s", err)
+	}
+	matrix := buildMatrix{}
+	err = yaml.NewDecoder(bytes.NewReader(matrixBytes)).Decode(&matrix)
+	if err != nil {
+		return matrixBuild{}, fmt.Errorf("error parsing build matrix file %s: %s", matrixFile, err)
+	}
+
+	for _, build := range matrix.Builds {
+		if build.Name == "" {
+			build.Name = build.Dockerfile
+		}
+		if build.Name != name {
+			continue
+		}
+		if build.Context == "" {
+			build.Context = path.Dir(build.Dockerfile)
+		}
+		return build, nil
+	}
+	return matrixBuild{}, fmt.Errorf("matrix-build is not in the build matrix file %s: %s", matrixFile, name)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// The default globs of the dockerfiles to discover
+var defaultIncludeGlobs = []string{"**/Dockerfile", "**/Containerfile"}
+
+var (
+	// Matches the characters that are not valid in a build name, which is
+	// also used as an image repo name
+	invalidNameCharsRegexp = regexp.MustCompile(`[^a-z0-9._-]+`)
+	// The dirs that are never walked, since they have no dockerfiles of the
+	// repo
+	skippedDirs = []string{".git", "node_modules"}
+)
+
+// The options for discovering the dockerfiles of a repo
+type discoverOptions struct {
+	clonePath    string
+	includeGlobs []string
+	excludeGlobs []string
+	// The paths that trigger every build when changed (e.g. a shared lib)
+	sharedPaths []string
+	// The name of the build of a dockerfile in the repo root
+	rootName   string
+	outputFile string
+}
+
+// The build matrix file of docker-build, which the matrix subcommand and
+// diff-check read
+type buildMatrix struct {
+	Builds []matrixBuild `yaml:"builds"`
+}
+
+// A discovered build in the build matrix file
+type matrixBuild struct {
+	Name       string   `yaml:"name"`
+	Dockerfile string   `yaml:"dockerfile"`
+	Context    string   `yaml:"context"`
+	Paths      []string `yaml:"paths,omitempty"`
+}
+
+func configureDiscoverFlags(flags *pflag.FlagSet) {
+	flags.String("clone-path", "", "The path to the cloned repo to discover the dockerfiles of")
+	flags.StringArray(
+		"include",
+		defaultIncludeGlobs,
+		"A glob of the dockerfiles to discover, relative to the repo root. Supports ** to match any number of dirs. "+
+			"Can be repeated")
+	flags.StringArray(
+		"exclude",
+		nil,
+		"A glob of the paths to skip, relative to the repo root (e.g. **/testdata/**). A dir matches everything "+
+			"under it. Can be repeated")
+	flags.StringArray(
+		"shared-path",
+		nil,
+		"A path or glob that triggers every build when changed, in addition to the dockerfile and the context of the "+
+			"build (e.g. libs/common). Can be repeated")
+	flags.String("root-name", "root", "The build name of a dockerfile in the repo root")
+	flags.String("output-file", "", "The path to write the build matrix file to (e.g. .jettison/builds.yaml)")
+}
+
+func getDiscoverOptions(flags *pflag.FlagSet) (discoverOptions, error) {
+	var opts discoverOptions
+	var err error
+
+	opts.clonePath, err = flags.GetString("clone-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing clone-path flag")
+	}
+
+	opts.includeGlobs, err = flags.GetStringArray("include")
+	if err != nil {
+		return opts, fmt.Errorf("error processing include flag")
+	}
+
+	opts.excludeGlobs, err = flags.GetStringArray("exclude")
+	if err != nil {
+		return opts, fmt.Errorf("error processing exclude flag")
+	}
+
+	opts.sharedPaths, err = flags.GetStringArray("shared-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing shared-path flag")
+	}
+
+	opts.rootName, err = flags.GetString("root-name")
+	if err != nil {
+		return opts, fmt.Errorf("error processing root-name flag")
+	}
+	if getBuildName(opts.rootName) != opts.rootName {
+		return opts, fmt.Errorf("root-name must be lowercase letters, digits, and separators: %s", opts.rootName)
+	}
+
+	opts.outputFile, err = flags.GetString("output-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing output-file flag")
+	}
+	return opts, nil
+}
+
+func (opts discoverOptions) logAttrs() []any {
+	return []any{
+		"clonePath", opts.clonePath,
+		"includeGlobs", opts.includeGlobs,
+		"excludeGlobs", opts.excludeGlobs,
+		"sharedPaths", opts.sharedPaths,
+		"rootName", opts.rootName,
+		"outputFile", opts.outputFile,
+	}
+}
+
+// Returns a build for each dockerfile in the clone path that matches an
+// include glob and no exclude glob. The context is the dir of the
+// dockerfile, and the name is derived from the dir
+func (opts discoverOptions) discover() (buildMatrix, error) {
+	matrix := buildMatrix{Builds: []matrixBuild{}}
+	includeRegexps, err := compileGlobs(opts.includeGlobs)
+	if err != nil {
+		return matrix, err
+	}
+	excludeRegexps, err := compileGlobs(opts.excludeGlobs)
+	if err != nil {
+		return matrix, err
+	}
+
+	names := map[string]string{}
+	err = filepath.WalkDir(opts.clonePath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(opts.clonePath, filePath)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if relativePath == "." {
+			return nil
+		}
+		if matchesAny(excludeRegexps, relativePath) {
+			slog.Debug("Skipping excluded path", "path", relativePath)
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if slices.Contains(skippedDirs, entry.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !matchesAny(includeRegexps, relativePath) {
+			return nil
+		}
+
+		build := opts.newBuild(relativePath)
+		if dockerfile, found := names[build.Name]; found {
+			return fmt.Errorf("dockerfiles %s and %s have the same build name %s", dockerfile, relativePath, build.Name)
+		}
+		names[build.Name] = relativePath
+		slog.Info("Discovered dockerfile", "name", build.Name, "dockerfile", build.Dockerfile)
+		matrix.Builds = append(matrix.Builds, build)
+		return nil
+	})
+	if err != nil {
+		return matrix, fmt.Errorf("error discovering dockerfiles: %s", err)
+	}
+	return matrix, nil
+}
+
+// Returns the build of the dockerfile. The name is the dir with the path
+// separators replaced by "-" (e.g. services-api), and the suffix of a
+// dockerfile with a custom name (e.g. services-api-dev for Dockerfile.dev)
+func (opts discoverOptions) newBuild(dockerfile string) matrixBuild {
+	dir := path.Dir(dockerfile)
+	name := opts.rootName
+	if dir != "." {
+		name = getBuildName(dir)
+	}
+	// The suffix is the rest of a custom name (e.g. dev for Dockerfile.dev
+	// or dev.Dockerfile)
+	suffix := path.Base(dockerfile)
+	for _, dockerfileName := range []string{"Dockerfile", "Containerfile"} {
+		suffix = strings.TrimPrefix(suffix, dockerfileName)
+		suffix = strings.TrimSuffix(suffix, dockerfileName)
+	}
+	if suffix = getBuildName(suffix); suffix != "" {
+		name += "-" + suffix
+	}
+
+	build := matrixBuild{Name: name, Dockerfile: dockerfile, Context: dir}
+	if len(opts.sharedPaths) > 0 {
+		// The paths replace the default paths of the matrix build
+		build.Paths = append([]string{dockerfile, dir}, opts.sharedPaths...)
+	}
+	return build
+}
+
+// Returns the build name of the path, which is lowercase with the invalid
+// characters replaced by "-"
+func getBuildName(value string) string {
+	name := invalidNameCharsRegexp.ReplaceAllString(strings.ToLower(value), "-")
+	return strings.Trim(name, "-._")
+}
+
+// Writes the build matrix file. The file is only rewritten if the builds
+// changed, so a committed matrix file is not touched needlessly
+func writeBuildMatrix(matrix buildMatrix, outputFile string) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString("# Generated by the discover step\n")
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	err := encoder.Encode(matrix)
+	if err != nil {
+		return fmt.Errorf("error marshalling build matrix: %s", err)
+	}
+
+	existing, err := os.ReadFile(outputFile)
+	if err == nil && bytes.Equal(existing, buf.Bytes()) {
+		slog.Info("Build matrix file is up to date", "outputFile", outputFile)
+		return nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error reading build matrix file: %s", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(outputFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating build matrix file dir: %s", err)
+	}
+	err = os.WriteFile(outputFile, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing build matrix file: %s", err)
+	}
+	slog.Info("Wrote build matrix file", "outputFile", outputFile, "builds", len(matrix.Builds))
+	return nil
+}
+
+func compileGlobs(globs []string) ([]*regexp.Regexp, error) {
+	globRegexps := []*regexp.Regexp{}
+	for _, glob := range globs {
+		globRegexp, err := compileGlob(glob)
+		if err != nil {
+			return nil, err
+		}
+		globRegexps = append(globRegexps, globRegexp)
+	}
+	return globRegexps, nil
+}
+
+func matchesAny(globRegexps []*regexp.Regexp, relativePath string) bool {
+	for _, globRegexp := range globRegexps {
+		if globRegexp.MatchString(relativePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compiles a glob relative to the repo root to a regexp. The glob supports
+// * and ? within a path segment, ** across segments, and character
+// classes. A glob matching a dir also matches everything under it
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	pattern := strings.TrimPrefix(filepath.ToSlash(path.Clean(glob)), "/")
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == '*' && strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case ch == '*' && strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case ch == '*':
+			sb.WriteString("[^/]*")
+		case ch == '?':
+			sb.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("invalid glob: " + glob)
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	sb.WriteString("(/.*)?$")
+	return regexp.Compile(sb.String())
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Writes the files under the dir, creating their dirs
+func writeTestFiles(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, []byte("FROM scratch\n"), 0644)
+		}
+		if err != nil {
+			t.Fatalf("error writing %s: %s", file, err)
+		}
+	}
+}
+
+func TestGetDiscoverOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		wantRootName string
+		wantErr      string
+	}{
+		{name: "default root name", wantRootName: "root"},
+		{name: "root name", args: []string{"--root-name", "my-app.v2"}, wantRootName: "my-app.v2"},
+		{
+			name:    "uppercase root name",
+			args:    []string{"--root-name", "MyApp"},
+			wantErr: "root-name must be lowercase letters, digits, and separators: MyApp",
+		},
+		{
+			name:    "root name with a trailing separator",
+			args:    []string{"--root-name", "app-"},
+			wantErr: "root-name must be lowercase letters, digits, and separators: app-",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet("discover", pflag.ContinueOnError)
+			configureDiscoverFlags(flags)
+			err := flags.Parse(tt.args)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			opts, err := getDiscoverOptions(flags)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("getDiscoverOptions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getDiscoverOptions() error = %v", err)
+			}
+			if opts.rootName != tt.wantRootName {
+				t.Errorf("got root name %q, want %q", opts.rootName, tt.wantRootName)
+			}
+			if !reflect.DeepEqual(opts.includeGlobs, defaultIncludeGlobs) {
+				t.Errorf("got include globs %q, want %q", opts.includeGlobs, defaultIncludeGlobs)
+			}
+		})
+	}
+}
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		glob    string
+		path    string
+		matches bool
+	}{
+		{glob: "**/Dockerfile", path: "Dockerfile", matches: true},
+		{glob: "**/Dockerfile", path: "services/api/Dockerfile", matches: true},
+		{glob: "**/Dockerfile", path: "services/api/Dockerfile.dev", matches: false},
+		{glob: "services/*/Dockerfile", path: "services/api/Dockerfile", matches: true},
+		{glob: "services/*/Dockerfile", path: "services/api/v2/Dockerfile", matches: false},
+		{glob: "Dockerfile.???", path: "Dockerfile.dev", matches: true},
+		{glob: "Dockerfile.[!p]*", path: "Dockerfile.prod", matches: false},
+		{glob: "Dockerfile.[!p]*", path: "Dockerfile.dev", matches: true},
+		// A dir matches everything under it
+		{glob: "**/testdata", path: "pkg/testdata/Dockerfile", matches: true},
+		{glob: "/vendor/", path: "vendor/lib/Dockerfile", matches: true},
+		{glob: "a.b", path: "axb", matches: false},
+	}
+	for _, tt := range tests {
+		globRegexp, err := compileGlob(tt.glob)
+		if err != nil {
+			t.Fatalf("compileGlob(%q) error = %v", tt.glob, err)
+		}
+		if got := globRegexp.MatchString(tt.path); got != tt.matches {
+			t.Errorf("compileGlob(%q).MatchString(%q) = %v, want %v", tt.glob, tt.path, got, tt.matches)
+		}
+	}
+
+	_, err := compileGlob("Dockerfile.[dev")
+	if err == nil {
+		t.Errorf("compileGlob(%q) error = nil, want an invalid glob", "Dockerfile.[dev")
+	}
+}
+
+func TestGetBuildName(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "services/api", want: "services-api"},
+		{value: "Services/My API", want: "services-my-api"},
+		{value: ".dev", want: "dev"},
+		{value: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := getBuildName(tt.value); got != tt.want {
+			t.Errorf("getBuildName(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	clonePath := t.TempDir()
+	writeTestFiles(
+		t,
+		clonePath,
+		"Dockerfile",
+		"services/api/Dockerfile",
+		"services/api/Dockerfile.dev",
+		"services/web/Containerfile",
+		"services/web/testdata/Dockerfile",
+		"node_modules/lib/Dockerfile",
+		".git/Dockerfile",
+		"README.md",
+	)
+
+	opts := discoverOptions{
+		clonePath:    clonePath,
+		includeGlobs: defaultIncludeGlobs,
+		excludeGlobs: []string{"**/testdata"},
+		rootName:     "root",
+	}
+	matrix, err := opts.discover()
+	if err != nil {
+		t.Fatalf("discover() error = %v", err)
+	}
+	want := []matrixBuild{
+		{Name: "root", Dockerfile: "Dockerfile", Context: "."},
+		{Name: "services-api", Dockerfile: "services/api/Dockerfile", Context: "services/api"},
+		{Name: "services-web", Dockerfile: "services/web/Containerfile", Context: "services/web"},
+	}
+	if !reflect.DeepEqual(matrix.Builds, want) {
+		t.Errorf("discover() = %+v, want %+v", matrix.Builds, want)
+	}
+
+	// A custom dockerfile name is a build with the suffix, and the shared
+	// paths are added to the paths of every build
+	opts.includeGlobs = []string{"services/api/Dockerfile*"}
+	opts.sharedPaths = []string{"libs/common"}
+	matrix, err = opts.discover()
+	if err != nil {
+		t.Fatalf("discover() error = %v", err)
+	}
+	want = []matrixBuild{
+		{
+			Name:       "services-api",
+			Dockerfile: "services/api/Dockerfile",
+			Context:    "services/api",
+			Paths:      []string{"services/api/Dockerfile", "services/api", "libs/common"},
+		},
+		{
+			Name:       "services-api-dev",
+			Dockerfile: "services/api/Dockerfile.dev",
+			Context:    "services/api",
+			Paths:      []string{"services/api/Dockerfile.dev", "services/api", "libs/common"},
+		},
+	}
+	if !reflect.DeepEqual(matrix.Builds, want) {
+		t.Errorf("discover() = %+v, want %+v", matrix.Builds, want)
+	}
+}
+
+func TestDiscoverDuplicateName(t *testing.T) {
+	clonePath := t.TempDir()
+	writeTestFiles(t, clonePath, "My App/Dockerfile", "my-app/Dockerfile")
+
+	opts := discoverOptions{clonePath: clonePath, includeGlobs: defaultIncludeGlobs, rootName: "root"}
+	_, err := opts.discover()
+	if err == nil || !strings.Contains(err.Error(), "have the same build name my-app") {
+		t.Errorf("discover() error = %v, want a duplicate build name", err)
+	}
+}
+
+func TestWriteBuildMatrix(t *testing.T) {
+	matrix := buildMatrix{Builds: []matrixBuild{
+		{Name: "root", Dockerfile: "Dockerfile", Context: "."},
+		{Name: "api", Dockerfile: "api/Dockerfile", Context: "api", Paths: []string{"api/Dockerfile", "api", "libs"}},
+	}}
+	want := `# Generated by the discover step
+builds:
+  - name: root
+    dockerfile: Dockerfile
+    context: .
+  - name: api
+    dockerfile: api/Dockerfile
+    context: api
+    paths:
+      - api/Dockerfile
+      - api
+      - libs
+`
+	outputFile := filepath.Join(t.TempDir(), ".jettison", "builds.yaml")
+	err := writeBuildMatrix(matrix, outputFile)
+	if err != nil {
+		t.Fatalf("writeBuildMatrix() error = %v", err)
+	}
+	content, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("error reading build matrix file: %s", err)
+	}
+	if string(content) != want {
+		t.Errorf("got build matrix file:\n%s\nwant:\n%s", content, want)
+	}
+
+	// An up to date file is not rewritten
+	modTime := time.Unix(0, 0)
+	err = os.Chtimes(outputFile, modTime, modTime)
+	if err != nil {
+		t.Fatalf("error setting the build matrix file time: %s", err)
+	}
+	err = writeBuildMatrix(matrix, outputFile)
+	if err != nil {
+		t.Fatalf("writeBuildMatrix() error = %v", err)
+	}
+	info, err := os.Stat(outputFile)
+	if err != nil {
+		t.Fatalf("error reading build matrix file info: %s", err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("got build matrix file time %s, want it unchanged", info.ModTime())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "discover"
+
+var mainCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Discover the dockerfiles of a repo",
+	Long: `Discovers the dockerfiles of a repo.
+The build matrix file is written with a build for each dockerfile, which
+docker-build matrix and diff-check read, so a new service is built without a
+change to the CI config`,
+	PersistentPreRunE: loadFlagValues,
+	RunE:              handleMainCmd,
+}
+
+func configureCmds() {
+	flags := mainCmd.Flags()
+
+	configureDiscoverFlags(flags)
+	mainCmd.MarkFlagRequired("clone-path")
+	mainCmd.MarkFlagRequired("output-file")
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the excluded paths")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	discoverOpts, err := getDiscoverOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Discover with params", discoverOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	matrix, err := discoverOpts.discover()
+	if err != nil {
+		return err
+	}
+	if len(matrix.Builds) == 0 {
+		return fmt.Errorf("no dockerfiles match the include globs %s", discoverOpts.includeGlobs)
+	}
+	return writeBuildMatrix(matrix, discoverOpts.outputFile)
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		os.Exit(1)
+	}
+}
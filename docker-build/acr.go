@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// The default Microsoft Entra ID authority for the token requests
+	AZURE_AUTHORITY_HOST = "https://login.microsoftonline.com"
+	// The Azure Resource Manager resource, whose tokens ACR exchanges for
+	// a refresh token
+	AZURE_MANAGEMENT_RESOURCE = "https://management.azure.com/"
+	// The Azure instance metadata service endpoint for the managed identity
+	// tokens
+	// See https://learn.microsoft.com/en-us/entra/identity/managed-identities-azure-resources/how-to-use-vm-token
+	AZURE_IMDS_TOKEN_ENDPOINT = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// The timeout of the managed identity token requests, which is short
+	// since the instance metadata service is not reachable outside of Azure
+	AZURE_IMDS_TIMEOUT = 5 * time.Second
+	// The username for the ACR refresh token in the docker config
+	// See https://github.com/Azure/acr/blob/main/docs/AAD-OAuth.md
+	ACR_REFRESH_TOKEN_USERNAME = "00000000-0000-0000-0000-000000000000"
+)
+
+// Matches an ACR registry host in the public or sovereign clouds
+var acrRegistryRegexp = regexp.MustCompile(`^[a-zA-Z0-9-]+\.azurecr\.(io|cn|us)$`)
+
+// Returns the username and password for the ACR registry. The Microsoft
+// Entra ID token is exchanged for an ACR refresh token, which is valid
+// for about three hours
+func getAcrCredentials(ctx context.Context, host string) (string, string, error) {
+	if !acrRegistryRegexp.MatchString(host) {
+		return "", "", fmt.Errorf("not an ACR registry (e.g. myregistry.azurecr.io): %s", host)
+	}
+	accessToken, source, err := getAzureAccessToken(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"access_token": {accessToken},
+	}
+	if tenantId := os.Getenv("AZURE_TENANT_ID"); tenantId != "" {
+		form.Set("tenant", tenantId)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("https://%s/oauth2/exchange", host),
+		strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	respBody, err := doCredentialsRequest(req)
+	if err != nil {
+		return "", "", fmt.Errorf("error exchanging the %s token for an ACR refresh token: %w", source, err)
+	}
+
+	response := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	err = json.Unmarshal(respBody, &response)
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing the ACR exchange response: %w", err)
+	}
+	if response.RefreshToken == "" {
+		return "", "", errors.New("the ACR exchange returned no refresh token")
+	}
+	return ACR_REFRESH_TOKEN_USERNAME, response.RefreshToken, nil
+}
+
+// Returns a Microsoft Entra ID access token for Azure Resource Manager, and
+// where it was obtained from. The sources are checked in the order of the
+// Azure SDK default credential: the service principal secret, the AKS
+// workload identity, and the managed identity
+func getAzureAccessToken(ctx context.Context) (string, string, error) {
+	clientId := os.Getenv("AZURE_CLIENT_ID")
+	tenantId := os.Getenv("AZURE_TENANT_ID")
+
+	if clientSecret := os.Getenv("AZURE_CLIENT_SECRET"); clientSecret != "" {
+		if clientId == "" || tenantId == "" {
+			return "", "", errors.New("AZURE_CLIENT_ID and AZURE_TENANT_ID must be set with AZURE_CLIENT_SECRET")
+		}
+		token, err := getAzureClientCredentialsToken(ctx, tenantId, url.Values{
+			"client_id":     {clientId},
+			"client_secret": {clientSecret},
+		})
+		return token, "service principal", err
+	}
+
+	if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tokenFile != "" {
+		if clientId == "" || tenantId == "" {
+			return "", "", errors.New("AZURE_CLIENT_ID and AZURE_TENANT_ID must be set with AZURE_FEDERATED_TOKEN_FILE")
+		}
+		assertion, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading the federated token file: %w", err)
+		}
+		token, err := getAzureClientCredentialsToken(ctx, tenantId, url.Values{
+			"client_id":             {clientId},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		})
+		return token, "workload identity", err
+	}
+
+	token, err := getAzureManagedIdentityToken(ctx, clientId)
+	return token, "managed identity", err
+}
+
+// Returns an access token from the Microsoft Entra ID client credentials
+// flow, with a client secret or a federated token as the client assertion
+func getAzureClientCredentialsToken(ctx context.Context, tenantId string, clientCredentials url.Values) (string, error) {
+	authorityHost := strings.TrimSuffix(os.Getenv("AZURE_AUTHORITY_HOST"), "/")
+	if authorityHost == "" {
+		authorityHost = AZURE_AUTHORITY_HOST
+	}
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"scope":      {AZURE_MANAGEMENT_RESOURCE + ".default"},
+	}
+	for key, values := range clientCredentials {
+		form[key] = values
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("%s/%s/oauth2/v2.0/token", authorityHost, tenantId),
+		strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	respBody, err := doCredentialsRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("error getting the Microsoft Entra ID token: %w", err)
+	}
+	return parseAzureAccessToken(respBody)
+}
+
+// Returns an access token of the managed identity from the instance
+// metadata service. The client ID selects a user assigned identity, if set
+func getAzureManagedIdentityToken(ctx context.Context, clientId string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, AZURE_IMDS_TIMEOUT)
+	defer cancel()
+
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {AZURE_MANAGEMENT_RESOURCE},
+	}
+	if clientId != "" {
+		query.Set("client_id", clientId)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, AZURE_IMDS_TOKEN_ENDPOINT+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	respBody, err := doCredentialsRequest(req)
+	if err != nil {
+		return "", fmt.Errorf(
+			"no Azure service principal or workload identity found in the environment, "+
+				"and the managed identity is not available: %w", err)
+	}
+	return parseAzureAccessToken(respBody)
+}
+
+// Parses the access token from a token response
+func parseAzureAccessToken(respBody []byte) (string, error) {
+	response := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	err := json.Unmarshal(respBody, &response)
+	if err != nil {
+		return "", fmt.Errorf("error parsing the Microsoft Entra ID token response: %w", err)
+	}
+	if response.AccessToken == "" {
+		return "", errors.New("the Microsoft Entra ID token response has no access token")
+	}
+	return response.AccessToken, nil
+}
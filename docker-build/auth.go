@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// Logs in to AWS ECR with the IRSA, pod identity, or instance role credentials
+	ECR_REGISTRY_AUTH = "ecr"
+	// Logs in to Artifact Registry with the GKE Workload Identity
+	GCP_REGISTRY_AUTH = "gcp"
+	// Logs in to ACR with the service principal, AKS workload identity, or managed identity
+	ACR_REGISTRY_AUTH = "acr"
+	// Logs in with the registry username and password
+	BASIC_REGISTRY_AUTH = "basic"
+	// Configures the docker credential helpers, which the builder runs to
+	// get the credentials
+	HELPER_REGISTRY_AUTH = "helper"
+
+	// The Docker Hub registry host
+	DOCKER_HUB_REGISTRY = "index.docker.io"
+	// The key of the Docker Hub credentials in the docker config
+	DOCKER_HUB_CONFIG_KEY = "https://index.docker.io/v1/"
+	// The prefix of the docker credential helper executables
+	// See https://github.com/docker/docker-credential-helpers
+	CREDENTIAL_HELPER_PREFIX = "docker-credential-"
+
+	// Environment variable with the docker config dir, which kaniko and
+	// the registry checks read the credentials from
+	DOCKER_CONFIG_ENV = "DOCKER_CONFIG"
+
+	// The timeout of the requests for the registry credentials
+	AUTH_REQUEST_TIMEOUT = 30 * time.Second
+)
+
+var (
+	// The supported registry auth modes
+	registryAuths = []string{ECR_REGISTRY_AUTH, GCP_REGISTRY_AUTH, ACR_REGISTRY_AUTH, BASIC_REGISTRY_AUTH, HELPER_REGISTRY_AUTH}
+
+	// The client for the requests for the registry credentials
+	authHttpClient = &http.Client{Timeout: AUTH_REQUEST_TIMEOUT}
+)
+
+// The options for logging in to the registries before the build
+type registryAuthOptions struct {
+	// The registry auth mode. If empty, the existing docker config is used
+	mode string
+	// The registries to log in to, in addition to the push registry
+	registries []string
+	// The registry auth modes overriding the mode, by registry host
+	// (e.g. for mirroring the image to registries of different clouds)
+	registryModes map[string]string
+	// The username and password for the basic registry auth mode
+	username string
+	password string
+	// The credential helpers for the helper registry auth mode, by
+	// registry host. Overrides the detected helpers
+	credentialHelpers map[string]string
+}
+
+// Returns the registry auth options
+func getRegistryAuthOptions(flags *pflag.FlagSet, cmdName string) (registryAuthOptions, error) {
+	var opts registryAuthOptions
+	var err error
+
+	opts.mode, err = flags.GetString("registry-auth")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s registry-auth flag", cmdName)
+	}
+	if opts.mode != "" && !slices.Contains(registryAuths, opts.mode) {
+		return opts, fmt.Errorf("registry-auth must be one of %s: %s", registryAuths, opts.mode)
+	}
+
+	authRegistries, err := flags.GetStringArray("auth-registry")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s auth-registry flag", cmdName)
+	}
+	opts.registryModes = map[string]string{}
+	for _, authRegistry := range authRegistries {
+		registry, mode, found := strings.Cut(authRegistry, "=")
+		if found {
+			if !slices.Contains(registryAuths, mode) {
+				return opts, fmt.Errorf("auth-registry mode must be one of %s: %s", registryAuths, authRegistry)
+			}
+			opts.registryModes[getRegistryHost(registry)] = mode
+		} else if opts.mode == "" {
+			return opts, fmt.Errorf("auth-registry requires registry-auth to be set, or a mode in the format <registry>=<mode>")
+		}
+		opts.registries = append(opts.registries, registry)
+	}
+
+	opts.username, err = flags.GetString("registry-username")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s registry-username flag", cmdName)
+	}
+
+	opts.password, err = flags.GetString("registry-password")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s registry-password flag", cmdName)
+	}
+
+	// The username implies the basic registry auth mode
+	if opts.username != "" && opts.mode == "" {
+		opts.mode = BASIC_REGISTRY_AUTH
+	}
+	if opts.usesMode(BASIC_REGISTRY_AUTH) && (opts.username == "" || opts.password == "") {
+		return opts, fmt.Errorf("registry-username and registry-password must be set for the basic registry-auth")
+	}
+	if !opts.usesMode(BASIC_REGISTRY_AUTH) && (opts.username != "" || opts.password != "") {
+		return opts, fmt.Errorf("registry-username and registry-password are only used by the basic registry-auth")
+	}
+
+	credentialHelpers, err := flags.GetStringArray("credential-helper")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s credential-helper flag", cmdName)
+	}
+	opts.credentialHelpers = map[string]string{}
+	for _, credentialHelper := range credentialHelpers {
+		registry, helper, found := strings.Cut(credentialHelper, "=")
+		if !found || registry == "" || helper == "" {
+			return opts, fmt.Errorf("credential-helper must be in the format <registry>=<helper>: %s", credentialHelper)
+		}
+		opts.credentialHelpers[getRegistryHost(registry)] = strings.TrimPrefix(helper, CREDENTIAL_HELPER_PREFIX)
+	}
+	// The credential helpers imply the helper registry auth mode
+	if len(opts.credentialHelpers) > 0 && opts.mode == "" {
+		opts.mode = HELPER_REGISTRY_AUTH
+	}
+	if !opts.usesMode(HELPER_REGISTRY_AUTH) && len(opts.credentialHelpers) > 0 {
+		return opts, fmt.Errorf("credential-helper is only used by the helper registry-auth")
+	}
+
+	return opts, nil
+}
+
+// Returns whether the mode is used for any registry
+func (opts registryAuthOptions) usesMode(mode string) bool {
+	if opts.mode == mode {
+		return true
+	}
+	for _, registryMode := range opts.registryModes {
+		if registryMode == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the registry auth mode of the registry host. If empty, the
+// existing docker config is used for the registry
+func (opts registryAuthOptions) registryMode(host string) string {
+	if mode, ok := opts.registryModes[host]; ok {
+		return mode
+	}
+	return opts.mode
+}
+
+// Returns the log attributes for the registry auth options, with the
+// password masked
+func (opts registryAuthOptions) logAttrs() []any {
+	password := ""
+	if opts.password != "" {
+		password = REDACTED_VALUE
+	}
+	return []any{
+		"registryAuth", opts.mode,
+		"authRegistries", opts.registries,
+		"registryModes", opts.registryModes,
+		"registryUsername", opts.username,
+		"registryPassword", password,
+		"credentialHelpers", opts.credentialHelpers,
+	}
+}
+
+// Logs in to the auth registries and the given registries (e.g. the push
+// registries), then writes the credentials and the credential helpers to
+// the docker config. The registries without a registry auth mode use the
+// existing docker config
+func (opts registryAuthOptions) login(ctx context.Context, registries ...string) error {
+	if opts.mode == "" && len(opts.registryModes) == 0 {
+		return nil
+	}
+
+	hosts := []string{}
+	for _, registry := range append(slices.Clone(opts.registries), registries...) {
+		host := getRegistryHost(registry)
+		if host != "" && opts.registryMode(host) != "" && !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		slog.Warn("No registries to log in to with the registry auth mode", "registryAuth", opts.mode)
+		return nil
+	}
+
+	auths := map[string]string{}
+	credHelpers := map[string]string{}
+	for _, host := range hosts {
+		mode := opts.registryMode(host)
+		var username, password string
+		var err error
+		switch mode {
+		case ECR_REGISTRY_AUTH:
+			username, password, err = getEcrCredentials(ctx, host)
+		case GCP_REGISTRY_AUTH:
+			username, password, err = getGcpCredentials(ctx, host)
+		case ACR_REGISTRY_AUTH:
+			username, password, err = getAcrCredentials(ctx, host)
+		case BASIC_REGISTRY_AUTH:
+			username, password = opts.username, opts.password
+		case HELPER_REGISTRY_AUTH:
+			credHelpers[host], err = opts.getCredentialHelper(host)
+		}
+		if err != nil {
+			return newStepError(REGISTRY_AUTH_ERROR, fmt.Errorf("error logging in to %s with %s auth: %w", host, mode, err))
+		}
+		if mode == HELPER_REGISTRY_AUTH {
+			slog.Info("Using the credential helper for the registry", "registry", host, "credentialHelper", credHelpers[host])
+			continue
+		}
+		auths[host] = base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		slog.Info("Logged in to the registry", "registry", host, "registryAuth", mode)
+	}
+
+	configFile, err := writeDockerConfig(auths, credHelpers)
+	if err != nil {
+		return newStepError(REGISTRY_AUTH_ERROR, fmt.Errorf("error writing docker config: %w", err))
+	}
+	slog.Info("Wrote the registry credentials to the docker config", "configFile", configFile, "registries", hosts)
+	return nil
+}
+
+// Returns the host of the registry, which may be followed by a repo path
+// (e.g. the image-registry flag). As in image references, a blank registry
+// or a first path component without a dot or port is Docker Hub
+func getRegistryHost(registry string) string {
+	host, _, _ := strings.Cut(strings.TrimSpace(registry), "/")
+	if host == "docker.io" || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return DOCKER_HUB_REGISTRY
+	}
+	return host
+}
+
+// Returns the path of the docker config file. Defaults to ~/.docker
+func getDockerConfigFile() (string, error) {
+	configDir := os.Getenv(DOCKER_CONFIG_ENV)
+	if configDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		configDir = filepath.Join(homeDir, ".docker")
+	}
+	return filepath.Join(configDir, "config.json"), nil
+}
+
+// Returns the credential helper of the registry, which the builder runs to
+// get the credentials when it pulls or pushes
+func (opts registryAuthOptions) getCredentialHelper(host string) (string, error) {
+	helper := opts.credentialHelpers[host]
+	if helper == "" {
+		helper = detectCredentialHelper(host)
+	}
+	if helper == "" {
+		return "", fmt.Errorf(
+			"no %s<helper> executable found on the PATH. Set one with credential-helper",
+			CREDENTIAL_HELPER_PREFIX)
+	}
+	return helper, nil
+}
+
+// Returns the credential helper for the registry from the well known
+// helpers, if its executable is on the PATH
+func detectCredentialHelper(host string) string {
+	helper := ""
+	switch {
+	case ecrRegistryRegexp.MatchString(host):
+		helper = "ecr-login"
+	case gcpRegistryRegexp.MatchString(host):
+		helper = "gcr"
+	case acrRegistryRegexp.MatchString(host):
+		helper = "acr-env"
+	default:
+		return ""
+	}
+	_, err := exec.LookPath(CREDENTIAL_HELPER_PREFIX + helper)
+	if err != nil {
+		return ""
+	}
+	return helper
+}
+
+// Adds the auths and the credential helpers to the docker config file,
+// keeping the other entries. The file is replaced atomically, since
+// concurrent batch builds may log in at the same time. Returns the path of
+// the docker config file
+func writeDockerConfig(auths map[string]string, credHelpers map[string]string) (string, error) {
+	configFile, err := getDockerConfigFile()
+	if err != nil {
+		return "", err
+	}
+
+	dockerConfig := map[string]any{}
+	configBytes, err := os.ReadFile(configFile)
+	if err == nil {
+		err = json.Unmarshal(configBytes, &dockerConfig)
+		if err != nil {
+			return configFile, fmt.Errorf("error parsing %s: %w", configFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return configFile, err
+	}
+
+	configAuths, _ := dockerConfig["auths"].(map[string]any)
+	if configAuths == nil {
+		configAuths = map[string]any{}
+	}
+	for host, auth := range auths {
+		configKey := host
+		if host == DOCKER_HUB_REGISTRY {
+			configKey = DOCKER_HUB_CONFIG_KEY
+		}
+		configAuths[configKey] = map[string]any{"auth": auth}
+	}
+	dockerConfig["auths"] = configAuths
+
+	configCredHelpers, _ := dockerConfig["credHelpers"].(map[string]any)
+	if configCredHelpers == nil {
+		configCredHelpers = map[string]any{}
+	}
+	for host, helper := range credHelpers {
+		configCredHelpers[host] = helper
+	}
+	if len(configCredHelpers) > 0 {
+		dockerConfig["credHelpers"] = configCredHelpers
+	}
+
+	// The credential helpers take precedence over the auths
+	for host := range auths {
+		if dockerConfig["credsStore"] != nil || configCredHelpers[host] != nil {
+			slog.Warn("The docker config has a credential helper for the registry, which takes precedence", "registry", host)
+		}
+	}
+
+	configBytes, err = json.MarshalIndent(dockerConfig, "", "  ")
+	if err != nil {
+		return configFile, err
+	}
+	err = os.MkdirAll(filepath.Dir(configFile), 0o700)
+	if err != nil {
+		return configFile, err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(configFile), "config-*.json")
+	if err != nil {
+		return configFile, err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(configBytes)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return configFile, err
+	}
+	return configFile, os.Rename(tmpFile.Name(), configFile)
+}
+
+// Sends the credentials request and returns the response body. Returns an
+// error for non 2xx statuses
+func doCredentialsRequest(req *http.Request) ([]byte, error) {
+	resp, err := authHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s returned %s: %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
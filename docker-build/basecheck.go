@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// The base image matches the upstream tag
+	FRESH_BASE_STATUS = "Fresh"
+	// The upstream tag was updated since the base image was pinned or built
+	STALE_BASE_STATUS = "Stale"
+	// The base image is not pinned by digest, and no built image was given
+	// to compare with, so a rebuild uses the upstream tag regardless
+	UNPINNED_BASE_STATUS = "Unpinned"
+	// The base image is pinned by digest without a tag, so there is no
+	// upstream tag to compare with
+	UNTAGGED_BASE_STATUS = "Untagged"
+
+	// The default platform of the base images to compare the layers of
+	DEFAULT_BASE_CHECK_PLATFORM = "linux/amd64"
+)
+
+// The freshness of a base image in a dockerfile
+type baseImageCheck struct {
+	Dockerfile string `json:"dockerfile"`
+	Image      string `json:"image"`
+	Status     string `json:"status"`
+	// The digest the base image is pinned to, if any
+	PinnedDigest string `json:"pinnedDigest,omitempty"`
+	// The digest the upstream tag currently points to
+	CurrentDigest string `json:"currentDigest,omitempty"`
+}
+
+func handleBaseCheckCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	baseCheckFlags := cmd.Flags()
+
+	dockerfiles, err := baseCheckFlags.GetStringArray("dockerfile")
+	if err != nil {
+		return fmt.Errorf("error processing base-check dockerfile flag")
+	}
+
+	image, err := baseCheckFlags.GetString("image")
+	if err != nil {
+		return fmt.Errorf("error processing base-check image flag")
+	}
+	if image != "" && len(dockerfiles) > 1 {
+		return fmt.Errorf("image can only be set with one dockerfile")
+	}
+
+	platform, err := baseCheckFlags.GetString("platform")
+	if err != nil {
+		return fmt.Errorf("error processing base-check platform flag")
+	}
+	parsedPlatform, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return fmt.Errorf("platform is not a valid platform: %s", err)
+	}
+
+	failOnStale, err := baseCheckFlags.GetBool("fail-on-stale")
+	if err != nil {
+		return fmt.Errorf("error processing base-check fail-on-stale flag")
+	}
+
+	reportFile, err := baseCheckFlags.GetString("report-file")
+	if err != nil {
+		return fmt.Errorf("error processing base-check report-file flag")
+	}
+
+	insecureRegistries, err := baseCheckFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing base-check insecure-registry flag")
+	}
+
+	skipTlsVerify, err := baseCheckFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing base-check skip-tls-verify flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(baseCheckFlags, "base-check")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"dockerfiles", dockerfiles,
+		"image", image,
+		"platform", platform,
+		"failOnStale", failOnStale,
+		"reportFile", reportFile,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+	}
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("Base check with params", params...)
+
+	dockerfileBaseImages := map[string][]string{}
+	dockerfileFinalBaseImages := map[string]string{}
+	registries := []string{}
+	for _, dockerfile := range dockerfiles {
+		instructions, err := readDockerfile(dockerfile)
+		if err != nil {
+			return fmt.Errorf("error reading dockerfile %s: %s", dockerfile, err)
+		}
+		baseImages := getBaseImages(instructions)
+		for _, baseImage := range baseImages {
+			ref, err := parseImageReference(baseImage, insecureRegistries)
+			if err != nil {
+				return fmt.Errorf("base image %s of %s is not a valid image reference: %s", baseImage, dockerfile, err)
+			}
+			registries = append(registries, ref.Context().RegistryStr())
+		}
+		dockerfileBaseImages[dockerfile] = baseImages
+		dockerfileFinalBaseImages[dockerfile] = getFinalBaseImage(instructions)
+	}
+	var imageRef name.Reference
+	if image != "" {
+		imageRef, err = parseImageReference(image, insecureRegistries)
+		if err != nil {
+			return fmt.Errorf("image is not a valid image reference: %s", err)
+		}
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	if imageRef != nil {
+		registries = append(registries, imageRef.Context().RegistryStr())
+	}
+	err = registryAuthOpts.login(ctx, registries...)
+	if err != nil {
+		return err
+	}
+
+	remoteOpts := append(getRemoteOptions(ctx, skipTlsVerify), remote.WithPlatform(*parsedPlatform))
+	checks := []baseImageCheck{}
+	for _, dockerfile := range dockerfiles {
+		for _, baseImage := range dockerfileBaseImages[dockerfile] {
+			// The built image is compared with the base image of the final stage
+			var builtRef name.Reference
+			if baseImage == dockerfileFinalBaseImages[dockerfile] {
+				builtRef = imageRef
+			}
+			check, err := checkBaseImage(baseImage, builtRef, insecureRegistries, remoteOpts)
+			if err != nil {
+				return fmt.Errorf("error checking base image %s of %s: %w", baseImage, dockerfile, err)
+			}
+			check.Dockerfile = dockerfile
+			checks = append(checks, check)
+			slog.Info(
+				"Checked base image",
+				"dockerfile", dockerfile,
+				"image", baseImage,
+				"status", check.Status,
+				"pinnedDigest", check.PinnedDigest,
+				"currentDigest", check.CurrentDigest,
+			)
+		}
+	}
+
+	if reportFile != "" {
+		bytes, err := json.MarshalIndent(checks, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding base check report: %s", err)
+		}
+		err = os.WriteFile(reportFile, append(bytes, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing base check report file: %s", err)
+		}
+		slog.Info("Wrote base check report file", "reportFile", reportFile)
+	}
+
+	stale := 0
+	for _, check := range checks {
+		if check.Status == STALE_BASE_STATUS {
+			stale++
+		}
+	}
+	if stale == 0 {
+		slog.Info("No stale base images found", "baseImages", len(checks))
+		return nil
+	}
+	if failOnStale {
+		return newStepError(
+			STALE_BASE_IMAGE_ERROR,
+			fmt.Errorf("%d of %d base images are stale. A rebuild would pick up the updated base images", stale, len(checks)))
+	}
+	slog.Warn("Found stale base images. A rebuild would pick up the updated base images", "stale", stale, "baseImages", len(checks))
+	return nil
+}
+
+// Compares the base image with the digest its upstream tag currently points
+// to. A base image pinned by digest is stale if the tag moved. Otherwise,
+// the built image is stale if it is not built on the current layers of the
+// upstream tag
+func checkBaseImage(
+	baseImage string,
+	builtRef name.Reference,
+	insecureRegistries []string,
+	remoteOpts []remote.Option,
+) (baseImageCheck, error) {
+	check := baseImageCheck{Image: baseImage}
+
+	tagImage, pinnedDigest, _ := strings.Cut(baseImage, "@")
+	check.PinnedDigest = pinnedDigest
+	tagRef, err := parseImageReference(tagImage, insecureRegistries)
+	if err != nil {
+		return check, err
+	}
+	// The registry may have a port, so only the last path segment is
+	// checked for a tag
+	lastSegment := tagImage[strings.LastIndex(tagImage, "/")+1:]
+	if pinnedDigest != "" && !strings.Contains(lastSegment, ":") {
+		check.Status = UNTAGGED_BASE_STATUS
+		return check, nil
+	}
+
+	desc, err := remote.Head(tagRef, remoteOpts...)
+	if err != nil {
+		return check, err
+	}
+	check.CurrentDigest = desc.Digest.String()
+
+	switch {
+	case pinnedDigest != "":
+		check.Status = FRESH_BASE_STATUS
+		if pinnedDigest != check.CurrentDigest {
+			check.Status = STALE_BASE_STATUS
+		}
+	case builtRef != nil:
+		isBuiltOnBase, err := isBuiltOnBaseImage(builtRef, tagRef, remoteOpts)
+		if err != nil {
+			return check, err
+		}
+		check.Status = FRESH_BASE_STATUS
+		if !isBuiltOnBase {
+			check.Status = STALE_BASE_STATUS
+		}
+	default:
+		check.Status = UNPINNED_BASE_STATUS
+	}
+	return check, nil
+}
+
+// Returns whether the layers of the base image are the bottom layers of the
+// built image. The uncompressed layer digests are compared, since the layers
+// may be recompressed when the image is pushed
+func isBuiltOnBaseImage(builtRef name.Reference, baseRef name.Reference, remoteOpts []remote.Option) (bool, error) {
+	builtImage, err := remote.Image(builtRef, remoteOpts...)
+	if err != nil {
+		return false, fmt.Errorf("error reading the built image %s: %w", builtRef, err)
+	}
+	builtConfigFile, err := builtImage.ConfigFile()
+	if err != nil {
+		return false, err
+	}
+	baseImage, err := remote.Image(baseRef, remoteOpts...)
+	if err != nil {
+		return false, err
+	}
+	baseConfigFile, err := baseImage.ConfigFile()
+	if err != nil {
+		return false, err
+	}
+
+	builtLayers := builtConfigFile.RootFS.DiffIDs
+	baseLayers := baseConfigFile.RootFS.DiffIDs
+	if len(baseLayers) > len(builtLayers) {
+		return false, nil
+	}
+	return slices.Equal(builtLayers[:len(baseLayers)], baseLayers), nil
+}
+
+// Returns the base image of the final stage, following the stages built on
+// other stages. Returns an empty string if the final stage has no pullable
+// base image
+func getFinalBaseImage(instructions []instruction) string {
+	stages := getBuildStages(instructions)
+	if len(stages) == 0 {
+		return ""
+	}
+	stageImages := map[string]string{}
+	for _, stage := range stages {
+		if stage.name != "" {
+			stageImages[strings.ToLower(stage.name)] = stage.image
+		}
+	}
+	image := stages[len(stages)-1].image
+	for range stages {
+		stageImage, found := stageImages[strings.ToLower(image)]
+		if !found {
+			break
+		}
+		image = stageImage
+	}
+	if image == "scratch" || strings.Contains(image, "$") {
+		return ""
+	}
+	return image
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default number of builds that run concurrently in a batch
+	DEFAULT_BATCH_CONCURRENCY = 2
+)
+
+var (
+	// The subcommands that a batch can run
+	batchModes = []string{"pr", "commit"}
+
+	// Matches the characters replaced in the build arg names of dependencies
+	nonAlphanumericRegexp = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+)
+
+// A build in a batch
+type batchBuild struct {
+	// The name of the build. Defaults to the dockerfile dir
+	Name             string `json:"name,omitempty"`
+	Dockerfile       string `json:"dockerfile"`
+	DockerContextDir string `json:"dockerContextDir"`
+	DockerfileDir    string `json:"dockerfileDir"`
+	// The status file of the build, which is added to the status files
+	// passed to all of the builds
+	StatusFile string `json:"statusFile,omitempty"`
+	// The build args of the build, which are added to the build args
+	// passed to all of the builds
+	BuildArgs []string `json:"buildArgs,omitempty"`
+	// The additional tags of the build. Only used for commit builds
+	Tags []string `json:"tags,omitempty"`
+	// The names of the builds that must succeed before this build starts,
+	// such as a shared base image
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// The name of the build, which prefixes its output
+func (b batchBuild) name() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	if b.DockerfileDir != "" {
+		return b.DockerfileDir
+	}
+	return b.Dockerfile
+}
+
+// The report entry for a build in a batch
+type batchBuildReport struct {
+	batchBuild
+	ExitCode int `json:"exitCode"`
+	// The result written by the build, if any
+	Result *buildResult `json:"result,omitempty"`
+}
+
+// The report for all of the builds in a batch
+type batchReport struct {
+	Succeeded int                `json:"succeeded"`
+	Skipped   int                `json:"skipped"`
+	Failed    int                `json:"failed"`
+	Builds    []batchBuildReport `json:"builds"`
+}
+
+func handleBatchCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	batchFlags := cmd.Flags()
+
+	mode, err := batchFlags.GetString("mode")
+	if err != nil {
+		return fmt.Errorf("error processing batch mode flag")
+	}
+	if !slices.Contains(batchModes, mode) {
+		return fmt.Errorf("mode must be one of %s: %s", batchModes, mode)
+	}
+
+	clonePath, err := batchFlags.GetString("clone-path")
+	if err != nil {
+		return fmt.Errorf("error processing batch clone-path flag")
+	}
+
+	buildSpecs, err := batchFlags.GetStringArray("build")
+	if err != nil {
+		return fmt.Errorf("error processing batch build flag")
+	}
+
+	discoverGlobs, err := batchFlags.GetStringArray("discover")
+	if err != nil {
+		return fmt.Errorf("error processing batch discover flag")
+	}
+
+	concurrency, err := batchFlags.GetInt("concurrency")
+	if err != nil {
+		return fmt.Errorf("error processing batch concurrency flag")
+	}
+	if concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1: %d", concurrency)
+	}
+
+	reportFile, err := batchFlags.GetString("report-file")
+	if err != nil {
+		return fmt.Errorf("error processing batch report-file flag")
+	}
+
+	builds := []batchBuild{}
+	for _, buildSpec := range buildSpecs {
+		build, err := parseBatchBuild(buildSpec)
+		if err != nil {
+			return err
+		}
+		builds = append(builds, build)
+	}
+	for _, discoverGlob := range discoverGlobs {
+		discoveredBuilds, err := discoverBatchBuilds(clonePath, discoverGlob)
+		if err != nil {
+			return err
+		}
+		builds = append(builds, discoveredBuilds...)
+	}
+	if len(builds) == 0 {
+		return fmt.Errorf("at least one build must be set with the build or discover flags")
+	}
+
+	// Log command flags
+	slog.Info(
+		"Batch build with params",
+		"mode", mode,
+		"clonePath", clonePath,
+		"builds", getBatchBuildNames(builds),
+		"concurrency", concurrency,
+		"reportFile", reportFile,
+		"args", args,
+	)
+
+	return runBatch(cmd, mode, clonePath, builds, args, concurrency, reportFile)
+}
+
+// Returns the names of the builds for logging
+func getBatchBuildNames(builds []batchBuild) []string {
+	buildNames := []string{}
+	for _, build := range builds {
+		buildNames = append(buildNames, build.name())
+	}
+	return buildNames
+}
+
+// Runs the builds as child processes, with up to concurrency builds at the
+// same time, and aggregates their results into a report. The args are
+// passed to all of the builds
+func runBatch(
+	cmd *cobra.Command,
+	mode string,
+	clonePath string,
+	builds []batchBuild,
+	args []string,
+	concurrency int,
+	reportFile string,
+) error {
+	buildArgs := args
+	if clonePath != "" {
+		buildArgs = append([]string{fmt.Sprintf("--clone-path=%s", clonePath)}, buildArgs...)
+	}
+	buildArgs = append(getPassThroughArgs(cmd), buildArgs...)
+
+	// The registry password is passed to the builds in the environment, so
+	// it is not in their args
+	if flag := cmd.Flags().Lookup("registry-password"); flag != nil && flag.Changed {
+		os.Setenv(getFlagEnvName("registry-password"), flag.Value.String())
+	}
+	slog.Debug("Resolved batch build args", "buildArgs", buildArgs)
+
+	dependencies, err := getBatchDependencies(builds)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error resolving the docker-build executable: %s", err)
+	}
+
+	// The usage is not relevant for build errors
+	cmd.SilenceUsage = true
+
+	resultDir, err := os.MkdirTemp("", "docker-build-batch-")
+	if err != nil {
+		return fmt.Errorf("error creating the batch result dir: %s", err)
+	}
+	defer os.RemoveAll(resultDir)
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	startTime := time.Now()
+	reports := make([]batchBuildReport, len(builds))
+	semaphore := make(chan struct{}, concurrency)
+	// Closed when the build finishes, so its dependents can start
+	done := make([]chan struct{}, len(builds))
+	for i := range builds {
+		done[i] = make(chan struct{})
+	}
+	var wg sync.WaitGroup
+	var outputMu sync.Mutex
+	for i, build := range builds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[i])
+
+			// Dependents receive the digest of each dependency as a build arg
+			dependencyBuildArgs := []string{}
+			for _, dependency := range build.DependsOn {
+				j := dependencies[dependency]
+				<-done[j]
+				if reports[j].ExitCode != 0 {
+					slog.Info("Not starting batch build, since a dependency failed", "build", build.name(), "dependency", dependency)
+					reports[i] = batchBuildReport{
+						batchBuild: build,
+						ExitCode:   errorClassExitCodes[BUILD_ERROR],
+						Result: &buildResult{
+							Status:       FAILED_STATUS,
+							Error:        BUILD_ERROR,
+							ErrorMessage: fmt.Sprintf("dependency %s failed", dependency),
+						},
+					}
+					return
+				}
+				dependencyBuildArgs = append(dependencyBuildArgs, getDependencyBuildArgs(dependency, reports[j].Result)...)
+			}
+			build.BuildArgs = append(slices.Clone(build.BuildArgs), dependencyBuildArgs...)
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			resultFile := filepath.Join(resultDir, fmt.Sprintf("result-%d.json", i))
+			reports[i] = runBatchBuild(ctx, executable, mode, build, buildArgs, resultFile, &outputMu)
+		}()
+	}
+	wg.Wait()
+
+	report := batchReport{Builds: reports}
+	for _, buildReport := range reports {
+		switch {
+		case buildReport.ExitCode != 0:
+			report.Failed++
+		case buildReport.Result != nil && buildReport.Result.Status == SKIPPED_STATUS:
+			report.Skipped++
+		default:
+			report.Succeeded++
+		}
+	}
+	slog.Info(
+		"Batch build finished",
+		"duration", time.Since(startTime).Round(time.Second),
+		"succeeded", report.Succeeded,
+		"skipped", report.Skipped,
+		"failed", report.Failed,
+	)
+	for _, buildReport := range reports {
+		status := ""
+		if buildReport.Result != nil {
+			status = buildReport.Result.Status
+		}
+		slog.Info("Batch build result", "build", buildReport.name(), "status", status, "exitCode", buildReport.ExitCode)
+	}
+
+	if reportFile != "" {
+		bytes, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding batch report: %s", err)
+		}
+		err = os.WriteFile(reportFile, append(bytes, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing batch report file: %s", err)
+		}
+		slog.Info("Wrote batch report file", "reportFile", reportFile)
+	}
+
+	if report.Failed > 0 {
+		return newStepError(BUILD_ERROR, fmt.Errorf("%d of %d batch builds failed", report.Failed, len(builds)))
+	}
+	return nil
+}
+
+// Returns the index of each build that other builds depend on. Returns an
+// error if a dependency is unknown or ambiguous, or if the dependencies
+// have a cycle
+func getBatchDependencies(builds []batchBuild) (map[string]int, error) {
+	buildIndexes := map[string][]int{}
+	for i, build := range builds {
+		buildIndexes[build.name()] = append(buildIndexes[build.name()], i)
+	}
+	dependencies := map[string]int{}
+	for _, build := range builds {
+		for _, dependency := range build.DependsOn {
+			indexes := buildIndexes[dependency]
+			switch {
+			case len(indexes) == 0:
+				return nil, fmt.Errorf("build %s depends on an unknown build: %s", build.name(), dependency)
+			case len(indexes) > 1:
+				return nil, fmt.Errorf("build %s depends on a build name used more than once: %s", build.name(), dependency)
+			}
+			dependencies[dependency] = indexes[0]
+		}
+	}
+
+	// Check for cycles with a depth first search, since a cycle would wait forever
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make([]int, len(builds))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch states[i] {
+		case visiting:
+			return fmt.Errorf("build dependencies have a cycle including %s", builds[i].name())
+		case visited:
+			return nil
+		}
+		states[i] = visiting
+		for _, dependency := range builds[i].DependsOn {
+			err := visit(dependencies[dependency])
+			if err != nil {
+				return err
+			}
+		}
+		states[i] = visited
+		return nil
+	}
+	for i := range builds {
+		err := visit(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dependencies, nil
+}
+
+// Returns the build args with the fresh digest of a dependency:
+// <NAME>_DIGEST=<digest> and <NAME>_IMAGE=<image>@<digest>, where NAME is
+// the dependency name in upper case with the other characters replaced by
+// "_". Returns no build args if the dependency was not pushed (e.g. for PRs
+// or skipped builds)
+func getDependencyBuildArgs(dependency string, result *buildResult) []string {
+	if result == nil || result.Image == "" || result.Digest == "" {
+		return nil
+	}
+	name := strings.ToUpper(nonAlphanumericRegexp.ReplaceAllString(strings.Trim(dependency, "/"), "_"))
+	return []string{
+		fmt.Sprintf("%s_DIGEST=%s", name, result.Digest),
+		fmt.Sprintf("%s_IMAGE=%s@%s", name, result.Image, result.Digest),
+	}
+}
+
+// Parses a build in the format dockerfile=<path>,context=<dir>,dir=<dockerfile-dir>[,status-file=<path>]
+// with the optional name=<name> and depends-on=<name> fields. The
+// depends-on field can be repeated
+func parseBatchBuild(buildSpec string) (batchBuild, error) {
+	build := batchBuild{}
+	for _, field := range strings.Split(buildSpec, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return build, fmt.Errorf("build field must be in the format KEY=VALUE: %s", field)
+		}
+		switch key {
+		case "dockerfile":
+			build.Dockerfile = value
+		case "context":
+			build.DockerContextDir = value
+		case "dir":
+			build.DockerfileDir = value
+		case "status-file":
+			build.StatusFile = value
+		case "name":
+			build.Name = value
+		case "depends-on":
+			build.DependsOn = append(build.DependsOn, value)
+		default:
+			return build, fmt.Errorf("unknown build field: %s", key)
+		}
+	}
+	if build.Dockerfile == "" {
+		return build, fmt.Errorf("build must set the dockerfile: %s", buildSpec)
+	}
+	if build.DockerContextDir == "" {
+		build.DockerContextDir = filepath.Dir(build.Dockerfile)
+	}
+	return build, nil
+}
+
+// Returns a build for each dockerfile in the clone path matching the glob.
+// The glob supports "**" to match any number of directories. The docker
+// context dir is the dir of the dockerfile, and the dockerfile dir is
+// "/" followed by the same dir
+func discoverBatchBuilds(clonePath string, discoverGlob string) ([]batchBuild, error) {
+	if clonePath == "" {
+		return nil, fmt.Errorf("clone-path must be set to discover builds")
+	}
+	globRegexp, err := compileIgnorePattern(strings.TrimPrefix(discoverGlob, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	builds := []batchBuild{}
+	err = filepath.WalkDir(clonePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relativePath, err := filepath.Rel(clonePath, path)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if !globRegexp.MatchString(relativePath) {
+			return nil
+		}
+		dir := filepath.ToSlash(filepath.Dir(relativePath))
+		build := batchBuild{Dockerfile: relativePath, DockerContextDir: dir}
+		if dir != "." {
+			build.DockerfileDir = "/" + dir
+		}
+		builds = append(builds, build)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error discovering builds: %s", err)
+	}
+	slog.Info("Discovered builds", "glob", discoverGlob, "builds", len(builds))
+	return builds, nil
+}
+
+// Returns the persistent flags that were set, so they are passed to the builds
+func getPassThroughArgs(cmd *cobra.Command) []string {
+	passThroughArgs := []string{}
+	for _, flagName := range []string{
+		"auth-registry",
+		"builder",
+		"buildah-isolation",
+		"buildah-path",
+		"buildah-storage-driver",
+		"buildctl-path",
+		"buildkit-addr",
+		"buildkit-tls-ca-cert",
+		"buildkit-tls-cert",
+		"buildkit-tls-key",
+		"buildkit-tls-server-name",
+		"config",
+		"credential-helper",
+		"debug",
+		"dry-run",
+		"kaniko-path",
+		"log-format",
+		"rate-limit-backoff",
+		"rate-limit-retry",
+		"registry-auth",
+		"registry-username",
+	} {
+		flag := cmd.Flags().Lookup(flagName)
+		if flag == nil || !flag.Changed {
+			continue
+		}
+		// The repeatable flags are passed once per value
+		if sliceValue, ok := flag.Value.(pflag.SliceValue); ok {
+			for _, value := range sliceValue.GetSlice() {
+				passThroughArgs = append(passThroughArgs, fmt.Sprintf("--%s=%s", flagName, value))
+			}
+			continue
+		}
+		passThroughArgs = append(passThroughArgs, fmt.Sprintf("--%s=%s", flagName, flag.Value))
+	}
+	return passThroughArgs
+}
+
+// Runs a build in the batch as a child process, with its output prefixed
+// by the build name
+func runBatchBuild(
+	ctx context.Context,
+	executable string,
+	mode string,
+	build batchBuild,
+	buildArgs []string,
+	resultFile string,
+	outputMu *sync.Mutex,
+) batchBuildReport {
+	report := batchBuildReport{batchBuild: build}
+
+	childArgs := []string{
+		mode,
+		fmt.Sprintf("--dockerfile=%s", build.Dockerfile),
+		fmt.Sprintf("--docker-context-dir=%s", build.DockerContextDir),
+		fmt.Sprintf("--result-file=%s", resultFile),
+	}
+	if mode == "commit" {
+		childArgs = append(childArgs, fmt.Sprintf("--dockerfile-dir=%s", build.DockerfileDir))
+	}
+	if build.StatusFile != "" {
+		childArgs = append(childArgs, fmt.Sprintf("--status-file=%s", build.StatusFile))
+	}
+	for _, buildArg := range build.BuildArgs {
+		childArgs = append(childArgs, fmt.Sprintf("--build-arg=%s", buildArg))
+	}
+	if mode == "commit" {
+		for _, tag := range build.Tags {
+			childArgs = append(childArgs, fmt.Sprintf("--additional-tag=%s", tag))
+		}
+	}
+	childArgs = append(childArgs, buildArgs...)
+
+	slog.Info("Starting batch build", "build", build.name())
+	output := &prefixWriter{prefix: fmt.Sprintf("[%s] ", build.name()), out: os.Stdout, mu: outputMu}
+	childCmd := exec.CommandContext(ctx, executable, childArgs...)
+	childCmd.Stdout = output
+	childCmd.Stderr = output
+	childCmd.Cancel = func() error {
+		return childCmd.Process.Signal(syscall.SIGTERM)
+	}
+	// The child forwards SIGTERM to kaniko, so wait longer than its grace period
+	childCmd.WaitDelay = DEFAULT_GRACE_PERIOD + 5*time.Second
+
+	err := childCmd.Run()
+	output.flush()
+	if err != nil {
+		report.ExitCode = 1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			report.ExitCode = exitErr.ExitCode()
+		}
+	}
+
+	bytes, err := os.ReadFile(resultFile)
+	if err == nil {
+		result := buildResult{}
+		if json.Unmarshal(bytes, &result) == nil {
+			report.Result = &result
+		}
+	}
+	return report
+}
+
+// Writes each line with the prefix, so the output of concurrent builds
+// can be told apart
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	mu     *sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadBytes('\n')
+		if err != nil {
+			// Keep the partial line until the rest of it is written
+			w.buf.Write(line)
+			return len(p), nil
+		}
+		w.writeLine(line)
+	}
+}
+
+// Writes the remaining partial line, if any
+func (w *prefixWriter) flush() {
+	if w.buf.Len() > 0 {
+		w.writeLine(append(w.buf.Bytes(), '\n'))
+		w.buf.Reset()
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+}
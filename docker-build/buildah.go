@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Builds the images with buildah bud, then pushes them with buildah push.
+// Supports the rootless mode, for clusters that prefer it over kaniko
+// See https://github.com/containers/buildah/blob/main/docs/buildah-build.1.md
+type buildahBuilder struct {
+	commandRunner
+	path string
+	// The storage driver (e.g. vfs for rootless builds without fuse-overlayfs).
+	// Defaults to the buildah default
+	storageDriver string
+	// The isolation of the RUN instructions (e.g. chroot for rootless builds).
+	// Defaults to the buildah default
+	isolation string
+}
+
+func (b buildahBuilder) name() string {
+	return BUILDAH_BUILDER
+}
+
+func (b buildahBuilder) logAttrs() []any {
+	attrs := []any{
+		"builder", BUILDAH_BUILDER,
+		"buildahPath", b.path,
+		"buildahStorageDriver", b.storageDriver,
+		"buildahIsolation", b.isolation,
+	}
+	return append(attrs, b.runnerAttrs()...)
+}
+
+func (b buildahBuilder) build(ctx context.Context, spec buildSpec) (buildOutput, error) {
+	command, err := b.command(spec)
+	if err != nil {
+		return buildOutput{}, err
+	}
+	return b.run(ctx, command, spec)
+}
+
+// Returns the buildah bud invocation for the build spec, followed by a
+// buildah push invocation per destination. The kaniko options without a
+// buildah equivalent are ignored with a warning
+func (b buildahBuilder) command(spec buildSpec) (builderCommand, error) {
+	kanikoOnlyArgs := spec.kanikoOpts.kanikoOnlyArgs()
+	if len(kanikoOnlyArgs) > 0 {
+		slog.Warn("Ignoring the kaniko options that are not supported by the buildah builder", "args", kanikoOnlyArgs)
+	}
+	if spec.context.contextType != DIR_CONTEXT_TYPE {
+		return builderCommand{}, fmt.Errorf(
+			"the %s context type is not supported by the buildah builder", spec.context.contextType)
+	}
+
+	// The global options come before the subcommand
+	globalOpts := []string{}
+	if b.storageDriver != "" {
+		globalOpts = append(globalOpts, fmt.Sprintf("--storage-driver=%s", b.storageDriver))
+	}
+	insecure := len(spec.registry.insecureRegistries) > 0 || spec.registry.skipTlsVerify
+
+	args := []string{"buildah"}
+	args = append(args, globalOpts...)
+	args = append(args, "bud", fmt.Sprintf("--file=%s", spec.context.dockerfile))
+	if b.isolation != "" {
+		args = append(args, fmt.Sprintf("--isolation=%s", b.isolation))
+	}
+	if insecure || spec.registry.skipTlsVerifyPull {
+		args = append(args, "--tls-verify=false")
+	}
+	for _, buildArg := range spec.buildArgs {
+		args = append(args, fmt.Sprintf("--build-arg=%s", buildArg))
+	}
+	for _, secretFile := range spec.secretFiles {
+		args = append(args, fmt.Sprintf("--secret=id=%s,src=%s", secretFile.id, secretFile.path))
+	}
+	for _, label := range spec.labels {
+		args = append(args, fmt.Sprintf("--label=%s", label))
+	}
+	if spec.target != "" {
+		args = append(args, fmt.Sprintf("--target=%s", spec.target))
+	}
+	platform := spec.platform
+	if platform == "" {
+		platform = spec.kanikoOpts.platform
+	}
+	if platform != "" {
+		args = append(args, fmt.Sprintf("--platform=%s", platform))
+	}
+	if spec.kanikoOpts.imageDownloadRetry != 0 {
+		args = append(args, fmt.Sprintf("--retry=%d", spec.kanikoOpts.imageDownloadRetry))
+	}
+	if spec.kanikoOpts.cache {
+		args = append(args, "--layers")
+		cacheRepo := spec.cacheRepo()
+		if cacheRepo != "" {
+			args = append(args, fmt.Sprintf("--cache-from=%s", cacheRepo))
+			if spec.push {
+				args = append(args, fmt.Sprintf("--cache-to=%s", cacheRepo))
+			}
+		}
+	}
+	for _, destination := range spec.destinations {
+		args = append(args, fmt.Sprintf("--tag=%s", destination))
+	}
+	args = append(args, spec.context.dir)
+	command := builderCommand{builder: BUILDAH_BUILDER, path: b.path, args: args}
+
+	// Push the image, or write it to the tarball for PRs
+	switch {
+	case spec.tarPath != "" && len(spec.destinations) > 0:
+		pushArgs := []string{"buildah"}
+		pushArgs = append(pushArgs, globalOpts...)
+		pushArgs = append(
+			pushArgs,
+			"push",
+			spec.destinations[0],
+			fmt.Sprintf("docker-archive:%s:%s", spec.tarPath, spec.destinations[0]),
+		)
+		command.then = append(command.then, builderCommand{builder: BUILDAH_BUILDER, path: b.path, args: pushArgs})
+
+	case spec.push:
+		pushOpts := []string{}
+		if insecure {
+			pushOpts = append(pushOpts, "--tls-verify=false")
+		}
+		if spec.registry.pushRetry != 0 {
+			pushOpts = append(pushOpts, fmt.Sprintf("--retry=%d", spec.registry.pushRetry))
+		}
+
+		// buildah writes the digest file on push, so the first push writes
+		// a temporary digest file when only the image ref file is set
+		pushDigestFile := spec.digestFile
+		if pushDigestFile == "" && spec.imageRefFile != "" {
+			pushDigestFile = filepath.Join(os.TempDir(), fmt.Sprintf("docker-build-push-digest-%d", os.Getpid()))
+		}
+		for i, destination := range spec.destinations {
+			pushArgs := []string{"buildah"}
+			pushArgs = append(pushArgs, globalOpts...)
+			pushArgs = append(pushArgs, "push")
+			pushArgs = append(pushArgs, pushOpts...)
+			if i == 0 && pushDigestFile != "" {
+				pushArgs = append(pushArgs, fmt.Sprintf("--digestfile=%s", pushDigestFile))
+			}
+			pushArgs = append(pushArgs, destination)
+			command.then = append(command.then, builderCommand{builder: BUILDAH_BUILDER, path: b.path, args: pushArgs})
+		}
+		if spec.imageRefFile != "" && len(spec.destinations) > 0 {
+			command.finish = func() error {
+				if pushDigestFile != spec.digestFile {
+					defer os.Remove(pushDigestFile)
+				}
+				digest := readDigestFile(pushDigestFile)
+				return writeImageIndexFiles("", spec.imageRefFile, spec.destinations[0], digest)
+			}
+		}
+	}
+	return command, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// Build arg with the revision hash
+	GIT_COMMIT_BUILD_ARG = "GIT_COMMIT"
+	// Build arg with the revision ref (e.g. refs/heads/main)
+	GIT_REF_BUILD_ARG = "GIT_REF"
+	// Build arg with the short revision hash
+	GIT_SHORT_SHA_BUILD_ARG = "GIT_SHORT_SHA"
+	// Build arg with the build start time in RFC 3339 format
+	BUILD_TIMESTAMP_BUILD_ARG = "BUILD_TIMESTAMP"
+)
+
+// Returns the build args with the git build args appended. Only the git
+// build args declared by an ARG instruction in the dockerfile are passed,
+// since kaniko warns about unused build args. The build args that are
+// already set take precedence, as do the dockerfile defaults for the
+// values that are not known (e.g. the ref of a PR build)
+func appendGitBuildArgs(
+	buildArgs []string,
+	instructions []instruction,
+	revisionHash string,
+	revisionRef string,
+	buildTime time.Time,
+) []string {
+	shortSha := revisionHash
+	if len(shortSha) > SHORT_SHA_LENGTH {
+		shortSha = shortSha[:SHORT_SHA_LENGTH]
+	}
+	values := []struct {
+		name  string
+		value string
+	}{
+		{GIT_COMMIT_BUILD_ARG, revisionHash},
+		{GIT_REF_BUILD_ARG, revisionRef},
+		{GIT_SHORT_SHA_BUILD_ARG, shortSha},
+		{BUILD_TIMESTAMP_BUILD_ARG, buildTime.UTC().Format(time.RFC3339)},
+	}
+
+	declaredArgs := getDeclaredArgs(instructions)
+	setArgs := []string{}
+	for _, buildArg := range buildArgs {
+		key, _, _ := strings.Cut(buildArg, "=")
+		setArgs = append(setArgs, key)
+	}
+
+	gitBuildArgs := []string{}
+	for _, value := range values {
+		if value.value == "" || !slices.Contains(declaredArgs, value.name) || slices.Contains(setArgs, value.name) {
+			continue
+		}
+		gitBuildArgs = append(gitBuildArgs, fmt.Sprintf("%s=%s", value.name, value.value))
+	}
+	slog.Info("Adding the git build args declared by the dockerfile", "gitBuildArgs", gitBuildArgs)
+	return append(buildArgs, gitBuildArgs...)
+}
+
+// Returns the names of the build args declared by the ARG instructions.
+// An ARG instruction may declare multiple args, with optional defaults
+// (e.g. ARG GIT_COMMIT GIT_REF=unknown)
+func getDeclaredArgs(instructions []instruction) []string {
+	declaredArgs := []string{}
+	for _, inst := range instructions {
+		if inst.cmd != "ARG" {
+			continue
+		}
+		for _, field := range strings.Fields(inst.args) {
+			name, _, _ := strings.Cut(field, "=")
+			declaredArgs = append(declaredArgs, name)
+		}
+	}
+	return declaredArgs
+}
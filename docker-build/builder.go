@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// Builds the images with kaniko
+	KANIKO_BUILDER = "kaniko"
+	// Builds the images with buildctl and a buildkitd daemon
+	BUILDKIT_BUILDER = "buildkit"
+	// Builds the images with buildah, which supports rootless builds
+	BUILDAH_BUILDER = "buildah"
+	// Builds the images on a remote buildkitd endpoint over TCP, which
+	// receives the build context from buildctl
+	REMOTE_BUILDER = "remote"
+
+	// The default buildctl path, which is resolved with the PATH
+	DEFAULT_BUILDCTL_PATH = "buildctl"
+	// The default buildah path, which is resolved with the PATH
+	DEFAULT_BUILDAH_PATH = "buildah"
+
+	// The default number of retries when the registry rate limits the builder
+	DEFAULT_RATE_LIMIT_RETRY = 3
+	// The default wait before the first rate limit retry, which doubles
+	// for each retry
+	DEFAULT_RATE_LIMIT_BACKOFF = 30 * time.Second
+)
+
+// The supported builder backends
+var builders = []string{KANIKO_BUILDER, BUILDKIT_BUILDER, BUILDAH_BUILDER, REMOTE_BUILDER}
+
+// A backend that builds the images. Each builder translates the build
+// spec into its own invocation
+type imageBuilder interface {
+	// The name of the builder, as set with the builder flag
+	name() string
+	// Returns the log attributes for the builder
+	logAttrs() []any
+	// Returns the command that runs the build, which is logged for dry runs
+	command(spec buildSpec) (builderCommand, error)
+	// Runs the build
+	build(ctx context.Context, spec buildSpec) (buildOutput, error)
+}
+
+// The builder independent description of an image build
+type buildSpec struct {
+	context buildContext
+	// The image references to push to. For PRs, the image name recorded in
+	// the tarball, if any
+	destinations []string
+	// Whether to push the image to the destinations
+	push bool
+	// The path to write the image tarball to, if any
+	tarPath string
+	// Whether to clean up the filesystem after the build, so another build
+	// can run in the same container
+	cleanup bool
+	// The path to write the image digest to, if any
+	digestFile string
+	// The path to write the image reference with the digest to, if any
+	imageRefFile string
+	// The build args in the format KEY=VALUE
+	buildArgs []string
+	// The secret files exposed to the build
+	secretFiles []secretFile
+	// The labels in the format KEY=VALUE
+	labels []string
+	// The target stage. Defaults to the last stage
+	target string
+	// The platform to build for. Overrides the platform of the kaniko options
+	platform string
+	registry registryOptions
+	// The options passed through to kaniko. The cache options are also
+	// used by the other builders
+	kanikoOpts kanikoOptions
+}
+
+// The options for pushing to and pulling from the registries
+type registryOptions struct {
+	insecureRegistries []string
+	skipTlsVerify      bool
+	skipTlsVerifyPull  bool
+	pushRetry          int
+}
+
+// The output of a build
+type buildOutput struct {
+	// The tail of the builder output
+	output string
+	// The digest of the built image, if the digest file was set
+	digest string
+}
+
+// Returns the cache repo for the build. Matches the kaniko default of
+// <destination>/cache if the image is pushed
+func (spec buildSpec) cacheRepo() string {
+	if spec.kanikoOpts.cacheRepo != "" || !spec.push || len(spec.destinations) == 0 {
+		return spec.kanikoOpts.cacheRepo
+	}
+	cacheRepo := spec.destinations[0]
+	if i := strings.LastIndex(cacheRepo, ":"); i > strings.LastIndex(cacheRepo, "/") {
+		cacheRepo = cacheRepo[:i]
+	}
+	return cacheRepo + "/cache"
+}
+
+// A command that runs a build
+type builderCommand struct {
+	// The name of the builder that runs the command
+	builder string
+	path    string
+	// The args of the command, starting with the command name
+	args []string
+	// The commands that run after the command succeeds (e.g. the push
+	// after a build), if any
+	then []builderCommand
+	// Runs after the commands succeed, if set. Used for the outputs that
+	// the builder does not write itself (e.g. the digest file)
+	finish func() error
+}
+
+// Runs the builder commands as child processes. Embedded by the builders
+// that run a command line tool, which keeps the exec wiring out of the
+// translation of the build spec
+type commandRunner struct {
+	// The time to wait for the builder to exit after forwarding SIGTERM
+	gracePeriod time.Duration
+	// The number of retries when the registry rate limits the builder
+	// (e.g. the Docker Hub pull limit)
+	rateLimitRetry int
+	// The wait before the first rate limit retry, which doubles for each retry
+	rateLimitBackoff time.Duration
+}
+
+// Returns the log attributes for the runner options
+func (r commandRunner) runnerAttrs() []any {
+	return []any{
+		"rateLimitRetry", r.rateLimitRetry,
+		"rateLimitBackoff", r.rateLimitBackoff,
+	}
+}
+
+// Runs the command and returns the output and the digest of the build. The
+// command is retried with an exponential backoff if the registry rate
+// limits the builder
+func (r commandRunner) run(ctx context.Context, command builderCommand, spec buildSpec) (buildOutput, error) {
+	backoff := r.rateLimitBackoff
+	for retry := 0; ; retry++ {
+		output, err := runBuilder(ctx, command, r.gracePeriod, newRedactor(nil, nil, nil, "", spec.secretFiles))
+		if err == nil {
+			return buildOutput{output: output, digest: readDigestFile(spec.digestFile)}, nil
+		}
+		if getErrorClass(err) != RATE_LIMIT_ERROR || retry >= r.rateLimitRetry {
+			return buildOutput{output: output}, err
+		}
+
+		slog.Warn(
+			"The registry rate limited the builder. Retrying after the backoff",
+			"builder", command.builder,
+			"retry", retry+1,
+			"rateLimitRetry", r.rateLimitRetry,
+			"backoff", backoff,
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			if stoppedErr := getStoppedError(ctx, command.builder); stoppedErr != nil {
+				err = stoppedErr
+			}
+			return buildOutput{output: output}, err
+		}
+		backoff *= 2
+	}
+}
+
+// Returns the builder set with the builder flag
+func getImageBuilder(flags *pflag.FlagSet, cmdName string, gracePeriod time.Duration) (imageBuilder, error) {
+	runner := commandRunner{gracePeriod: gracePeriod}
+
+	builderName, err := flags.GetString("builder")
+	if err != nil {
+		return nil, fmt.Errorf("error processing %s builder flag", cmdName)
+	}
+
+	runner.rateLimitRetry, err = flags.GetInt("rate-limit-retry")
+	if err != nil {
+		return nil, fmt.Errorf("error processing %s rate-limit-retry flag", cmdName)
+	}
+	if runner.rateLimitRetry < 0 {
+		return nil, fmt.Errorf("rate-limit-retry must not be negative: %d", runner.rateLimitRetry)
+	}
+
+	runner.rateLimitBackoff, err = flags.GetDuration("rate-limit-backoff")
+	if err != nil {
+		return nil, fmt.Errorf("error processing %s rate-limit-backoff flag", cmdName)
+	}
+	if runner.rateLimitBackoff < 0 {
+		return nil, fmt.Errorf("rate-limit-backoff must not be negative: %s", runner.rateLimitBackoff)
+	}
+
+	switch builderName {
+	case KANIKO_BUILDER:
+		kanikoPath, err := flags.GetString("kaniko-path")
+		if err != nil {
+			return nil, fmt.Errorf("error processing %s kaniko-path flag", cmdName)
+		}
+		return kanikoBuilder{commandRunner: runner, path: resolveKanikoPath(kanikoPath)}, nil
+
+	case BUILDKIT_BUILDER, REMOTE_BUILDER:
+		buildctlPath, err := flags.GetString("buildctl-path")
+		if err != nil {
+			return nil, fmt.Errorf("error processing %s buildctl-path flag", cmdName)
+		}
+		buildkitAddr, err := flags.GetString("buildkit-addr")
+		if err != nil {
+			return nil, fmt.Errorf("error processing %s buildkit-addr flag", cmdName)
+		}
+		tls, err := getBuildkitTlsOptions(flags, cmdName)
+		if err != nil {
+			return nil, err
+		}
+		if builderName == REMOTE_BUILDER && !strings.HasPrefix(buildkitAddr, "tcp://") {
+			return nil, fmt.Errorf("buildkit-addr must be set to a tcp:// address for the remote builder: %s", buildkitAddr)
+		}
+		return buildkitBuilder{
+			commandRunner: runner,
+			builderName:   builderName,
+			path:          buildctlPath,
+			addr:          buildkitAddr,
+			tls:           tls,
+		}, nil
+
+	case BUILDAH_BUILDER:
+		buildahPath, err := flags.GetString("buildah-path")
+		if err != nil {
+			return nil, fmt.Errorf("error processing %s buildah-path flag", cmdName)
+		}
+		storageDriver, err := flags.GetString("buildah-storage-driver")
+		if err != nil {
+			return nil, fmt.Errorf("error processing %s buildah-storage-driver flag", cmdName)
+		}
+		isolation, err := flags.GetString("buildah-isolation")
+		if err != nil {
+			return nil, fmt.Errorf("error processing %s buildah-isolation flag", cmdName)
+		}
+		return buildahBuilder{
+			commandRunner: runner,
+			path:          buildahPath,
+			storageDriver: storageDriver,
+			isolation:     isolation,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("builder must be one of %s: %s", builders, builderName)
+	}
+}
+
+// Logs the resolved builder command at the given level, with one
+// attribute per arg to make it easier to inspect. The sensitive values
+// are masked
+func logBuilderCommand(level slog.Level, command builderCommand, redactor redactor) {
+	attrs := []any{slog.String("builder", command.builder), slog.String("path", command.path)}
+	for i, arg := range redactor.redactAll(command.args) {
+		attrs = append(attrs, slog.String(fmt.Sprintf("args[%d]", i), arg))
+	}
+	slog.Log(context.Background(), level, "Resolved builder invocation", attrs...)
+	for _, next := range command.then {
+		logBuilderCommand(level, next, redactor)
+	}
+}
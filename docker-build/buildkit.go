@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The buildctl metadata key with the digest of the built image
+	BUILDKIT_DIGEST_KEY = "containerimage.digest"
+)
+
+// Builds the images with buildctl, which connects to a buildkitd daemon.
+// Enables the dockerfile features that kaniko lacks, such as
+// RUN --mount=type=cache and secret mounts
+// See https://github.com/moby/buildkit#building-a-dockerfile-with-buildctl
+//
+// The remote builder uses the same invocation against a buildkitd endpoint
+// on a dedicated builder machine, so privileged and heavy builds do not
+// run in the pod
+type buildkitBuilder struct {
+	commandRunner
+	// The buildkit or remote builder
+	builderName string
+	path        string
+	// The buildkitd address. Defaults to the buildctl default, which reads
+	// the BUILDKIT_HOST environment variable
+	addr string
+	tls  buildkitTlsOptions
+}
+
+// The TLS options for connecting to the buildkitd endpoint
+// See https://github.com/moby/buildkit#expose-buildkit-as-a-tcp-service
+type buildkitTlsOptions struct {
+	caCert     string
+	cert       string
+	key        string
+	serverName string
+}
+
+// Returns the buildkit TLS options. The client cert and key must be set together
+func getBuildkitTlsOptions(flags *pflag.FlagSet, cmdName string) (buildkitTlsOptions, error) {
+	var tls buildkitTlsOptions
+	var err error
+
+	tls.caCert, err = flags.GetString("buildkit-tls-ca-cert")
+	if err != nil {
+		return tls, fmt.Errorf("error processing %s buildkit-tls-ca-cert flag", cmdName)
+	}
+
+	tls.cert, err = flags.GetString("buildkit-tls-cert")
+	if err != nil {
+		return tls, fmt.Errorf("error processing %s buildkit-tls-cert flag", cmdName)
+	}
+
+	tls.key, err = flags.GetString("buildkit-tls-key")
+	if err != nil {
+		return tls, fmt.Errorf("error processing %s buildkit-tls-key flag", cmdName)
+	}
+	if (tls.cert == "") != (tls.key == "") {
+		return tls, fmt.Errorf("buildkit-tls-cert and buildkit-tls-key must be set together")
+	}
+
+	tls.serverName, err = flags.GetString("buildkit-tls-server-name")
+	if err != nil {
+		return tls, fmt.Errorf("error processing %s buildkit-tls-server-name flag", cmdName)
+	}
+
+	return tls, nil
+}
+
+// Returns the buildctl global args for the TLS options
+func (tls buildkitTlsOptions) args() []string {
+	args := []string{}
+	if tls.caCert != "" {
+		args = append(args, fmt.Sprintf("--tlscacert=%s", tls.caCert))
+	}
+	if tls.cert != "" {
+		args = append(args, fmt.Sprintf("--tlscert=%s", tls.cert), fmt.Sprintf("--tlskey=%s", tls.key))
+	}
+	if tls.serverName != "" {
+		args = append(args, fmt.Sprintf("--tlsservername=%s", tls.serverName))
+	}
+	return args
+}
+
+func (b buildkitBuilder) name() string {
+	return b.builderName
+}
+
+func (b buildkitBuilder) logAttrs() []any {
+	attrs := []any{
+		"builder", b.builderName,
+		"buildctlPath", b.path,
+		"buildkitAddr", b.addr,
+		"buildkitTlsCaCert", b.tls.caCert,
+		"buildkitTlsCert", b.tls.cert,
+		"buildkitTlsKey", b.tls.key,
+		"buildkitTlsServerName", b.tls.serverName,
+	}
+	return append(attrs, b.runnerAttrs()...)
+}
+
+func (b buildkitBuilder) build(ctx context.Context, spec buildSpec) (buildOutput, error) {
+	command, err := b.command(spec)
+	if err != nil {
+		return buildOutput{}, err
+	}
+	return b.run(ctx, command, spec)
+}
+
+// Returns the buildctl build invocation for the build spec. The kaniko
+// options without a buildkit equivalent are ignored with a warning
+func (b buildkitBuilder) command(spec buildSpec) (builderCommand, error) {
+	kanikoOnlyArgs := spec.kanikoOpts.kanikoOnlyArgs()
+	if len(kanikoOnlyArgs) > 0 {
+		slog.Warn("Ignoring the kaniko options that are not supported by the builder", "builder", b.builderName, "args", kanikoOnlyArgs)
+	}
+
+	args := []string{"buildctl"}
+	if b.addr != "" {
+		args = append(args, fmt.Sprintf("--addr=%s", b.addr))
+	}
+	args = append(args, b.tls.args()...)
+	args = append(args, "build", "--frontend=dockerfile.v0")
+
+	contextArgs, err := getBuildkitContextArgs(spec.context)
+	if err != nil {
+		return builderCommand{}, err
+	}
+	args = append(args, contextArgs...)
+	for _, buildArg := range spec.buildArgs {
+		args = append(args, fmt.Sprintf("--opt=build-arg:%s", buildArg))
+	}
+	for _, secretFile := range spec.secretFiles {
+		args = append(args, fmt.Sprintf("--secret=id=%s,src=%s", secretFile.id, secretFile.path))
+	}
+	for _, label := range spec.labels {
+		args = append(args, fmt.Sprintf("--opt=label:%s", label))
+	}
+	if spec.target != "" {
+		args = append(args, fmt.Sprintf("--opt=target=%s", spec.target))
+	}
+	platform := spec.platform
+	if platform == "" {
+		platform = spec.kanikoOpts.platform
+	}
+	if platform != "" {
+		args = append(args, fmt.Sprintf("--opt=platform=%s", platform))
+	}
+
+	// The names are quoted, since buildctl parses the output as CSV
+	output := ""
+	names := strings.Join(spec.destinations, ",")
+	switch {
+	case spec.tarPath != "":
+		output = fmt.Sprintf(`type=docker,"name=%s",dest=%s`, names, spec.tarPath)
+	case len(spec.destinations) == 0:
+		output = "type=cacheonly"
+	default:
+		output = fmt.Sprintf(`type=image,"name=%s",push=%t`, names, spec.push)
+		if len(spec.registry.insecureRegistries) > 0 || spec.registry.skipTlsVerify {
+			output += ",registry.insecure=true"
+		}
+	}
+	args = append(args, fmt.Sprintf("--output=%s", output))
+
+	cacheRepo := spec.cacheRepo()
+	if spec.kanikoOpts.cache && cacheRepo != "" {
+		args = append(
+			args,
+			fmt.Sprintf("--export-cache=type=registry,ref=%s,mode=max", cacheRepo),
+			fmt.Sprintf("--import-cache=type=registry,ref=%s", cacheRepo),
+		)
+	}
+
+	command := builderCommand{builder: b.builderName, path: b.path, args: args}
+	if spec.digestFile == "" && spec.imageRefFile == "" {
+		return command, nil
+	}
+
+	// buildctl writes the digest to the metadata file, so the digest
+	// files are written after the build
+	metadataFile := filepath.Join(os.TempDir(), fmt.Sprintf("docker-build-metadata-%d.json", os.Getpid()))
+	command.args = append(command.args, fmt.Sprintf("--metadata-file=%s", metadataFile))
+	command.finish = func() error {
+		defer os.Remove(metadataFile)
+		digest, err := readBuildkitDigest(metadataFile)
+		if err != nil {
+			return err
+		}
+		imageRef := ""
+		if len(spec.destinations) > 0 {
+			imageRef = spec.destinations[0]
+		}
+		return writeImageIndexFiles(spec.digestFile, spec.imageRefFile, imageRef, digest)
+	}
+	return command, nil
+}
+
+// Returns the buildctl args for the build context. The dir context is
+// passed as local dirs, and the git context as a remote context
+// See https://docs.docker.com/build/concepts/context/#git-repositories
+func getBuildkitContextArgs(buildCtx buildContext) ([]string, error) {
+	switch buildCtx.contextType {
+	case DIR_CONTEXT_TYPE:
+		return []string{
+			fmt.Sprintf("--local=context=%s", buildCtx.dir),
+			fmt.Sprintf("--local=dockerfile=%s", filepath.Dir(buildCtx.dockerfile)),
+			fmt.Sprintf("--opt=filename=%s", filepath.Base(buildCtx.dockerfile)),
+		}, nil
+
+	case GIT_CONTEXT_TYPE:
+		// The kaniko git source is <repo>[#<ref>[#<commit>]], while buildkit
+		// takes <repo>#<ref or commit>[:<subdir>]
+		repo, ref, _ := strings.Cut(buildCtx.source, "#")
+		if refName, commit, found := strings.Cut(ref, "#"); found {
+			ref = commit
+			if commit == "" {
+				ref = refName
+			}
+		}
+		if !strings.Contains(repo, "://") {
+			repo = "https://" + repo
+		}
+		subPath := strings.Trim(buildCtx.subPath, "/")
+		fragment := ref
+		if subPath != "" {
+			fragment = fmt.Sprintf("%s:%s", ref, subPath)
+		}
+		gitContext := repo
+		if fragment != "" {
+			gitContext = fmt.Sprintf("%s#%s", repo, fragment)
+		}
+		return []string{
+			fmt.Sprintf("--opt=context=%s", gitContext),
+			fmt.Sprintf("--opt=filename=%s", buildCtx.dockerfile),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("the %s context type is not supported by the buildkit and remote builders", buildCtx.contextType)
+	}
+}
+
+// Reads the image digest from the buildctl metadata file
+func readBuildkitDigest(metadataFile string) (string, error) {
+	bytes, err := os.ReadFile(metadataFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading buildctl metadata file: %s", err)
+	}
+	metadata := map[string]any{}
+	err = json.Unmarshal(bytes, &metadata)
+	if err != nil {
+		return "", fmt.Errorf("error parsing buildctl metadata file: %s", err)
+	}
+	digest, _ := metadata[BUILDKIT_DIGEST_KEY].(string)
+	if digest == "" {
+		return "", fmt.Errorf("buildctl metadata file has no %s", BUILDKIT_DIGEST_KEY)
+	}
+	return digest, nil
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// The options that the pr and commit builds share
+type buildOptions struct {
+	clonePath        string
+	dockerfile       string
+	dockerContextDir string
+	statusFiles      []string
+	statusCombine    string
+	buildArgs        []string
+	buildArgEnvs     []string
+	gitBuildArgs     bool
+	// The build args whose values are masked in the logs
+	sensitiveBuildArgs []string
+	secretFileFlags    []string
+	secretFiles        []secretFile
+	target             string
+	labels             []string
+	ociLabels          bool
+	contextType        string
+	contextSource      string
+	kaniko             kanikoOptions
+	sbom               sbomOptions
+	scan               scanOptions
+	license            licenseOptions
+	nonRoot            nonRootOptions
+	requiredLabel      requiredLabelOptions
+	policy             policyOptions
+	remoteContent      remoteContentOptions
+	contextSize        contextSizeOptions
+	verify             verifyOptions
+	timeout            time.Duration
+	gracePeriod        time.Duration
+	outputs            resultOutputs
+	lintMode           string
+	pinBaseImages      bool
+	contentHashFile    string
+	force              bool
+	debug              bool
+	dryRun             bool
+	builder            imageBuilder
+	registryAuth       registryAuthOptions
+}
+
+// The options of a PR build
+type prOptions struct {
+	buildOptions
+	// The tarball that the PR image is written to, since it is not pushed
+	tarPath  string
+	tarImage string
+}
+
+// The options of a commit build
+type commitOptions struct {
+	buildOptions
+	revisionHash  string
+	revisionRef   string
+	imageRegistry string
+	// The registries that the commit image is mirrored to
+	extraDestinationRegistries []string
+	imageRepo                  string
+	dockerfileDir              string
+	additionalTags             []string
+	tagTemplate                string
+	registry                   registryOptions
+	multiPlatforms             []string
+	skipIfExists               bool
+	noOverwrite                bool
+	digestFile                 string
+	imageRefFile               string
+	layerReportFile            string
+	sign                       bool
+	signing                    signOptions
+	encrypt                    encryptOptions
+	// The tarball that the commit image is written to, when it is encrypted
+	// or checked before the push
+	tarPath                string
+	contentHashImage       string
+	ecrCreateRepository    bool
+	ecrLifecyclePolicyFile string
+	// The content of the ECR lifecycle policy file
+	ecrLifecyclePolicy string
+	registryPreflight  bool
+}
+
+// Returns the options that the pr and commit builds share. The result
+// outputs are read first, so the failed result is written for the errors of
+// the other flags
+func getBuildOptions(flags *pflag.FlagSet, cmdName string) (buildOptions, error) {
+	var opts buildOptions
+	var err error
+
+	opts.outputs.resultFile, err = flags.GetString("result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s result-file flag", cmdName)
+	}
+
+	opts.outputs.argoOutputsDir, err = flags.GetString("argo-outputs-dir")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s argo-outputs-dir flag", cmdName)
+	}
+
+	opts.outputs.tektonResultsDir, err = flags.GetString("tekton-results-dir")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s tekton-results-dir flag", cmdName)
+	}
+
+	opts.clonePath, err = flags.GetString("clone-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s clone-path flag", cmdName)
+	}
+
+	opts.dockerfile, err = flags.GetString("dockerfile")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s dockerfile flag", cmdName)
+	}
+
+	opts.dockerContextDir, err = flags.GetString("docker-context-dir")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s docker-context-dir flag", cmdName)
+	}
+
+	opts.statusFiles, err = flags.GetStringArray("status-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s status-file flag", cmdName)
+	}
+
+	opts.statusCombine, err = flags.GetString("status-combine")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s status-combine flag", cmdName)
+	}
+	if !slices.Contains(statusCombineModes, opts.statusCombine) {
+		return opts, fmt.Errorf("status-combine must be one of %s: %s", statusCombineModes, opts.statusCombine)
+	}
+
+	opts.buildArgs, err = flags.GetStringArray("build-arg")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s build-arg flag", cmdName)
+	}
+
+	opts.buildArgEnvs, err = flags.GetStringArray("build-arg-env")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s build-arg-env flag", cmdName)
+	}
+
+	opts.gitBuildArgs, err = flags.GetBool("git-build-args")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s git-build-args flag", cmdName)
+	}
+
+	opts.sensitiveBuildArgs, err = flags.GetStringArray("sensitive-build-arg")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s sensitive-build-arg flag", cmdName)
+	}
+
+	opts.secretFileFlags, err = flags.GetStringArray("secret-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s secret-file flag", cmdName)
+	}
+	opts.secretFiles, err = getSecretFiles(opts.secretFileFlags)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.target, err = flags.GetString("target")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s target flag", cmdName)
+	}
+
+	opts.labels, err = flags.GetStringArray("label")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s label flag", cmdName)
+	}
+
+	opts.ociLabels, err = flags.GetBool("oci-labels")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s oci-labels flag", cmdName)
+	}
+
+	opts.contextType, err = flags.GetString("context-type")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s context-type flag", cmdName)
+	}
+
+	opts.contextSource, err = flags.GetString("context-source")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s context-source flag", cmdName)
+	}
+
+	err = validateContext(opts.contextType, opts.contextSource, opts.clonePath)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.kaniko, err = getKanikoOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.sbom, err = getSbomOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.scan, err = getScanOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.license, err = getLicenseOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.nonRoot, err = getNonRootOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.requiredLabel, err = getRequiredLabelOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.policy, err = getPolicyOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.remoteContent, err = getRemoteContentOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.contextSize, err = getContextSizeOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.verify, err = getVerifyOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.timeout, err = flags.GetDuration("timeout")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s timeout flag", cmdName)
+	}
+	if opts.timeout < 0 {
+		return opts, fmt.Errorf("timeout must not be negative: %s", opts.timeout)
+	}
+
+	opts.gracePeriod, err = flags.GetDuration("grace-period")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s grace-period flag", cmdName)
+	}
+
+	opts.lintMode, err = flags.GetString("lint")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s lint flag", cmdName)
+	}
+	if !slices.Contains(lintModes, opts.lintMode) {
+		return opts, fmt.Errorf("lint must be one of %s: %s", lintModes, opts.lintMode)
+	}
+
+	opts.pinBaseImages, err = flags.GetBool("pin-base-images")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s pin-base-images flag", cmdName)
+	}
+
+	opts.contentHashFile, err = flags.GetString("content-hash-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s content-hash-file flag", cmdName)
+	}
+
+	opts.force, err = flags.GetBool("force")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s force flag", cmdName)
+	}
+
+	opts.debug, err = flags.GetBool("debug")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s debug flag", cmdName)
+	}
+
+	opts.dryRun, err = flags.GetBool("dry-run")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s dry-run flag", cmdName)
+	}
+
+	opts.builder, err = getImageBuilder(flags, cmdName, opts.gracePeriod)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.registryAuth, err = getRegistryAuthOptions(flags, cmdName)
+	if err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func getPrOptions(flags *pflag.FlagSet) (prOptions, error) {
+	var opts prOptions
+	var err error
+
+	opts.buildOptions, err = getBuildOptions(flags, "pr")
+	if err != nil {
+		return opts, err
+	}
+
+	opts.tarPath, err = flags.GetString("tar-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing pr tar-path flag")
+	}
+
+	opts.tarImage, err = flags.GetString("tar-image")
+	if err != nil {
+		return opts, fmt.Errorf("error processing pr tar-image flag")
+	}
+
+	// PR images are not pushed, so the SBOM is generated from the tarball,
+	// and the tarball is checked
+	if opts.sbom.enabled && opts.tarPath == "" {
+		return opts, fmt.Errorf("tar-path must be set when generating the SBOM for a PR build")
+	}
+	if opts.scan.enabled && opts.tarPath == "" {
+		return opts, fmt.Errorf("tar-path must be set when scanning a PR build")
+	}
+	if opts.license.enabled && opts.tarPath == "" {
+		return opts, fmt.Errorf("tar-path must be set when scanning the licenses of a PR build")
+	}
+	if opts.nonRoot.mode != NON_ROOT_MODE_OFF && opts.tarPath == "" {
+		return opts, fmt.Errorf("tar-path must be set when checking the user of a PR build")
+	}
+	if len(opts.requiredLabel.labels) > 0 && opts.tarPath == "" {
+		return opts, fmt.Errorf("tar-path must be set when checking the labels of a PR build")
+	}
+
+	// PR images are not pushed, so there is no destination to derive the cache repo from
+	if opts.kaniko.cache && opts.kaniko.cacheRepo == "" {
+		return opts, fmt.Errorf("cache-repo must be set when using the cache for a PR build")
+	}
+	return opts, nil
+}
+
+func getCommitOptions(flags *pflag.FlagSet) (commitOptions, error) {
+	var opts commitOptions
+	var err error
+
+	opts.buildOptions, err = getBuildOptions(flags, "commit")
+	if err != nil {
+		return opts, err
+	}
+
+	opts.revisionHash, err = flags.GetString("revision-hash")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit revision-hash flag")
+	}
+
+	opts.revisionRef, err = flags.GetString("revision-ref")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit revision-ref flag")
+	}
+
+	opts.imageRegistry, err = flags.GetString("image-registry")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit image-registry flag")
+	}
+
+	opts.extraDestinationRegistries, err = flags.GetStringArray("extra-destination-registry")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit extra-destination-registry flag")
+	}
+
+	opts.imageRepo, err = flags.GetString("image-repo")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit image-repo flag")
+	}
+
+	opts.dockerfileDir, err = flags.GetString("dockerfile-dir")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit dockerfile-dir flag")
+	}
+
+	opts.additionalTags, err = flags.GetStringArray("additional-tag")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit additional-tag flag")
+	}
+	for _, additionalTag := range opts.additionalTags {
+		if !imageTagRegexp.MatchString(additionalTag) {
+			return opts, fmt.Errorf("additional-tag is not a valid image tag: %s", additionalTag)
+		}
+	}
+
+	opts.tagTemplate, err = flags.GetString("tag-template")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit tag-template flag")
+	}
+
+	opts.registry.insecureRegistries, err = flags.GetStringArray("insecure-registry")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit insecure-registry flag")
+	}
+
+	opts.registry.skipTlsVerify, err = flags.GetBool("skip-tls-verify")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit skip-tls-verify flag")
+	}
+
+	opts.registry.skipTlsVerifyPull, err = flags.GetBool("skip-tls-verify-pull")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit skip-tls-verify-pull flag")
+	}
+
+	opts.registry.pushRetry, err = flags.GetInt("push-retry")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit push-retry flag")
+	}
+	if opts.registry.pushRetry < 0 {
+		return opts, fmt.Errorf("push-retry must not be negative: %d", opts.registry.pushRetry)
+	}
+
+	opts.multiPlatforms, err = flags.GetStringArray("multi-platform")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit multi-platform flag")
+	}
+	for _, platform := range opts.multiPlatforms {
+		err = validatePlatform(platform)
+		if err != nil {
+			return opts, err
+		}
+	}
+	if len(opts.multiPlatforms) > 0 && opts.kaniko.platform != "" {
+		return opts, fmt.Errorf("platform and multi-platform must not both be set")
+	}
+
+	opts.skipIfExists, err = flags.GetBool("skip-if-exists")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit skip-if-exists flag")
+	}
+
+	opts.noOverwrite, err = flags.GetBool("no-overwrite")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit no-overwrite flag")
+	}
+
+	opts.digestFile, err = flags.GetString("digest-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit digest-file flag")
+	}
+
+	opts.imageRefFile, err = flags.GetString("image-ref-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit image-ref-file flag")
+	}
+
+	opts.layerReportFile, err = flags.GetString("layer-report-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit layer-report-file flag")
+	}
+
+	opts.sign, err = flags.GetBool("sign")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit sign flag")
+	}
+
+	opts.signing, err = getSignOptions(flags, "commit")
+	if err != nil {
+		return opts, err
+	}
+
+	opts.encrypt, err = getEncryptOptions(flags, "commit")
+	if err != nil {
+		return opts, err
+	}
+
+	opts.tarPath, err = flags.GetString("tar-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit tar-path flag")
+	}
+	if opts.encrypt.enabled() {
+		if opts.tarPath == "" {
+			return opts, fmt.Errorf("tar-path must be set when encrypting the image layers")
+		}
+		if len(opts.multiPlatforms) > 0 {
+			return opts, fmt.Errorf("encrypt-key is not supported for multi platform builds")
+		}
+		// The cache layers are pushed by the builder, so they are not encrypted
+		if opts.kaniko.cache {
+			return opts, fmt.Errorf("cache must not be set when encrypting the image layers, since the cached layers are not encrypted")
+		}
+		if opts.sbom.enabled {
+			return opts, fmt.Errorf("sbom must not be set when encrypting the image layers, since the SBOM is generated from the pushed layers")
+		}
+	}
+
+	// The checked image is written to the tarball, and pushed after the
+	// checks pass. The platform images are checked in the registry instead
+	checkTarball := opts.checks().beforePush() && len(opts.multiPlatforms) == 0
+	if checkTarball && opts.tarPath == "" {
+		return opts, fmt.Errorf("tar-path must be set when checking the image, since the image is checked before the push")
+	}
+	if opts.tarPath != "" && !opts.encrypt.enabled() && !checkTarball {
+		return opts, fmt.Errorf("encrypt-key or an image check must be set with tar-path for a single platform build")
+	}
+
+	opts.contentHashImage, err = flags.GetString("content-hash-image")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit content-hash-image flag")
+	}
+
+	opts.ecrCreateRepository, err = flags.GetBool("ecr-create-repository")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit ecr-create-repository flag")
+	}
+	if opts.ecrCreateRepository && !opts.registryAuth.usesMode(ECR_REGISTRY_AUTH) {
+		return opts, fmt.Errorf("ecr-create-repository requires the %s registry-auth", ECR_REGISTRY_AUTH)
+	}
+
+	opts.registryPreflight, err = flags.GetBool("registry-preflight")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit registry-preflight flag")
+	}
+
+	opts.ecrLifecyclePolicyFile, err = flags.GetString("ecr-lifecycle-policy-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit ecr-lifecycle-policy-file flag")
+	}
+	if opts.ecrLifecyclePolicyFile != "" {
+		if !opts.ecrCreateRepository {
+			return opts, fmt.Errorf("ecr-lifecycle-policy-file requires ecr-create-repository to be set")
+		}
+		policyBytes, err := os.ReadFile(opts.ecrLifecyclePolicyFile)
+		if err != nil {
+			return opts, fmt.Errorf("error reading ecr-lifecycle-policy-file: %s", err)
+		}
+		opts.ecrLifecyclePolicy = string(policyBytes)
+	}
+	return opts, nil
+}
+
+// Returns the redactor of the sensitive values of the build
+func (opts buildOptions) getRedactor() redactor {
+	return newRedactor(opts.buildArgs, opts.buildArgEnvs, opts.sensitiveBuildArgs, opts.contextSource, opts.secretFiles)
+}
+
+// Returns the checks of the built image
+func (opts buildOptions) checks() imageChecks {
+	return imageChecks{
+		scan:          opts.scan,
+		license:       opts.license,
+		nonRoot:       opts.nonRoot,
+		requiredLabel: opts.requiredLabel,
+	}
+}
+
+// Returns the log attrs of the shared options, with the sensitive values
+// masked
+func (opts buildOptions) logAttrs(redactor redactor) []any {
+	attrs := []any{
+		"clonePath", opts.clonePath,
+		"dockerfile", opts.dockerfile,
+		"dockerContextDir", opts.dockerContextDir,
+		"statusFiles", opts.statusFiles,
+		"statusCombine", opts.statusCombine,
+		"buildArgs", redactor.redactAll(opts.buildArgs),
+		"buildArgEnvs", opts.buildArgEnvs,
+		"gitBuildArgs", opts.gitBuildArgs,
+		"sensitiveBuildArgs", opts.sensitiveBuildArgs,
+		"secretFiles", opts.secretFileFlags,
+		"target", opts.target,
+		"labels", opts.labels,
+		"ociLabels", opts.ociLabels,
+		"contextType", opts.contextType,
+		"contextSource", redactor.redact(opts.contextSource),
+	}
+	attrs = append(attrs, opts.kaniko.logAttrs()...)
+	attrs = append(
+		attrs,
+		"timeout", opts.timeout,
+		"gracePeriod", opts.gracePeriod,
+		"resultFile", opts.outputs.resultFile,
+		"argoOutputsDir", opts.outputs.argoOutputsDir,
+		"tektonResultsDir", opts.outputs.tektonResultsDir,
+		"lintMode", opts.lintMode,
+		"pinBaseImages", opts.pinBaseImages,
+		"contentHashFile", opts.contentHashFile,
+		"force", opts.force,
+		"debug", opts.debug,
+		"dryRun", opts.dryRun,
+	)
+	attrs = append(attrs, opts.sbom.logAttrs()...)
+	attrs = append(attrs, opts.scan.logAttrs()...)
+	attrs = append(attrs, opts.license.logAttrs()...)
+	attrs = append(attrs, opts.nonRoot.logAttrs()...)
+	attrs = append(attrs, opts.requiredLabel.logAttrs()...)
+	attrs = append(attrs, opts.policy.logAttrs()...)
+	attrs = append(attrs, opts.remoteContent.logAttrs()...)
+	attrs = append(attrs, opts.contextSize.logAttrs()...)
+	attrs = append(attrs, opts.verify.logAttrs()...)
+	attrs = append(attrs, opts.builder.logAttrs()...)
+	attrs = append(attrs, opts.registryAuth.logAttrs()...)
+	return attrs
+}
+
+func (opts prOptions) logAttrs(redactor redactor) []any {
+	attrs := opts.buildOptions.logAttrs(redactor)
+	return append(
+		attrs,
+		"tarPath", opts.tarPath,
+		"tarImage", opts.tarImage,
+	)
+}
+
+func (opts commitOptions) logAttrs(redactor redactor) []any {
+	attrs := opts.buildOptions.logAttrs(redactor)
+	attrs = append(
+		attrs,
+		"revisionHash", opts.revisionHash,
+		"revisionRef", opts.revisionRef,
+		"imageRegistry", opts.imageRegistry,
+		"extraDestinationRegistries", opts.extraDestinationRegistries,
+		"imageRepo", opts.imageRepo,
+		"dockerfileDir", opts.dockerfileDir,
+		"additionalTags", opts.additionalTags,
+		"tagTemplate", opts.tagTemplate,
+		"insecureRegistries", opts.registry.insecureRegistries,
+		"skipTlsVerify", opts.registry.skipTlsVerify,
+		"skipTlsVerifyPull", opts.registry.skipTlsVerifyPull,
+		"pushRetry", opts.registry.pushRetry,
+		"multiPlatforms", opts.multiPlatforms,
+		"skipIfExists", opts.skipIfExists,
+		"noOverwrite", opts.noOverwrite,
+		"digestFile", opts.digestFile,
+		"imageRefFile", opts.imageRefFile,
+		"layerReportFile", opts.layerReportFile,
+		"contentHashImage", opts.contentHashImage,
+		"ecrCreateRepository", opts.ecrCreateRepository,
+		"ecrLifecyclePolicyFile", opts.ecrLifecyclePolicyFile,
+		"registryPreflight", opts.registryPreflight,
+		"sign", opts.sign,
+	)
+	attrs = append(attrs, opts.signing.logAttrs()...)
+	attrs = append(attrs, opts.encrypt.logAttrs()...)
+	return append(attrs, "tarPath", opts.tarPath)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// Matches a byte size with an optional unit (e.g. 20Gi, 500MB, 1024)
+	byteSizeRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([a-zA-Z]*)$`)
+
+	// The multiplier of each byte size unit. The binary units use powers
+	// of 1024, and the decimal units use powers of 1000
+	byteSizeUnits = map[string]float64{
+		"":   1,
+		"b":  1,
+		"k":  1e3,
+		"kb": 1e3,
+		"m":  1e6,
+		"mb": 1e6,
+		"g":  1e9,
+		"gb": 1e9,
+		"t":  1e12,
+		"tb": 1e12,
+		"ki": 1 << 10,
+		"mi": 1 << 20,
+		"gi": 1 << 30,
+		"ti": 1 << 40,
+	}
+)
+
+// An entry in a cache, which is pruned as a unit. For the cache repo, an
+// image. For the cache dir, a cached file and its metadata file
+type cacheEntry struct {
+	name    string
+	size    int64
+	created time.Time
+	remove  func() error
+}
+
+func handleCachePruneCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	pruneFlags := cmd.Flags()
+
+	cacheRepo, err := pruneFlags.GetString("cache-repo")
+	if err != nil {
+		return fmt.Errorf("error processing prune cache-repo flag")
+	}
+
+	cacheDir, err := pruneFlags.GetString("cache-dir")
+	if err != nil {
+		return fmt.Errorf("error processing prune cache-dir flag")
+	}
+	if cacheRepo == "" && cacheDir == "" {
+		return fmt.Errorf("at least one of cache-repo or cache-dir must be set")
+	}
+
+	olderThan, err := pruneFlags.GetDuration("older-than")
+	if err != nil {
+		return fmt.Errorf("error processing prune older-than flag")
+	}
+	if olderThan < 0 {
+		return fmt.Errorf("older-than must not be negative: %s", olderThan)
+	}
+
+	maxSizeFlag, err := pruneFlags.GetString("max-size")
+	if err != nil {
+		return fmt.Errorf("error processing prune max-size flag")
+	}
+	maxSize := int64(-1)
+	if maxSizeFlag != "" {
+		maxSize, err = parseByteSize(maxSizeFlag)
+		if err != nil {
+			return fmt.Errorf("max-size is not a valid size: %s", err)
+		}
+	}
+	if olderThan == 0 && maxSize < 0 {
+		return fmt.Errorf("at least one of older-than or max-size must be set")
+	}
+
+	insecureRegistries, err := pruneFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing prune insecure-registry flag")
+	}
+
+	skipTlsVerify, err := pruneFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing prune skip-tls-verify flag")
+	}
+
+	dryRun, err := pruneFlags.GetBool("dry-run")
+	if err != nil {
+		return fmt.Errorf("error processing prune dry-run flag")
+	}
+
+	// Log command flags
+	slog.Info(
+		"Cache prune with params",
+		"cacheRepo", cacheRepo,
+		"cacheDir", cacheDir,
+		"olderThan", olderThan,
+		"maxSize", maxSizeFlag,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+		"dryRun", dryRun,
+	)
+
+	// The usage is not relevant for prune errors
+	cmd.SilenceUsage = true
+	now := time.Now()
+
+	if cacheRepo != "" {
+		entries, err := getCacheRepoEntries(cacheRepo, insecureRegistries, skipTlsVerify)
+		if err != nil {
+			return newStepError(PRUNE_ERROR, fmt.Errorf("error listing cache repo %s: %w", cacheRepo, err))
+		}
+		err = pruneCacheEntries("cache repo", entries, olderThan, maxSize, now, dryRun)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cacheDir != "" {
+		entries, err := getCacheDirEntries(cacheDir)
+		if err != nil {
+			return newStepError(PRUNE_ERROR, fmt.Errorf("error listing cache dir %s: %w", cacheDir, err))
+		}
+		err = pruneCacheEntries("cache dir", entries, olderThan, maxSize, now, dryRun)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the entries older than olderThan, then the oldest entries until
+// the total size is at most maxSize. A zero olderThan or negative maxSize
+// disables the corresponding policy
+func pruneCacheEntries(
+	cacheName string,
+	entries []cacheEntry,
+	olderThan time.Duration,
+	maxSize int64,
+	now time.Time,
+	dryRun bool,
+) error {
+	// Keep the newest entries first, so the size limit prunes the oldest
+	slices.SortFunc(entries, func(a, b cacheEntry) int {
+		return b.created.Compare(a.created)
+	})
+
+	// Once an entry does not fit, the older entries are pruned as well,
+	// even if they are smaller
+	keptSize := int64(0)
+	prunedSize := int64(0)
+	pruned := []cacheEntry{}
+	isFull := false
+	for _, entry := range entries {
+		isExpired := olderThan != 0 && now.Sub(entry.created) > olderThan
+		isFull = isFull || (maxSize >= 0 && keptSize+entry.size > maxSize)
+		if isExpired || isFull {
+			pruned = append(pruned, entry)
+			prunedSize += entry.size
+			continue
+		}
+		keptSize += entry.size
+	}
+
+	slog.Info(
+		"Pruning cache entries",
+		"cache", cacheName,
+		"entries", len(entries),
+		"pruned", len(pruned),
+		"prunedBytes", prunedSize,
+		"keptBytes", keptSize,
+	)
+	failures := 0
+	for _, entry := range pruned {
+		if dryRun {
+			slog.Info("Dry run is set. Skipping cache entry removal", "cache", cacheName, "entry", entry.name)
+			continue
+		}
+		err := entry.remove()
+		if err != nil {
+			failures++
+			slog.Error("Error removing cache entry", "cache", cacheName, "entry", entry.name, "error", err)
+			continue
+		}
+		slog.Info(
+			"Removed cache entry",
+			"cache", cacheName,
+			"entry", entry.name,
+			"bytes", entry.size,
+			"created", entry.created.Format(time.RFC3339),
+		)
+	}
+	if failures > 0 {
+		return newStepError(PRUNE_ERROR, fmt.Errorf("%d of %d %s entries could not be removed", failures, len(pruned), cacheName))
+	}
+	return nil
+}
+
+// Returns the images in the cache repo. The creation time is read from the
+// image config, which kaniko sets when pushing a cached layer
+func getCacheRepoEntries(cacheRepo string, insecureRegistries []string, skipTlsVerify bool) ([]cacheEntry, error) {
+	repo, err := name.NewRepository(cacheRepo)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(insecureRegistries, repo.RegistryStr()) {
+		repo, err = name.NewRepository(cacheRepo, name.Insecure)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts := getRemoteOptions(context.Background(), skipTlsVerify)
+
+	tags, err := remote.List(repo, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tags with the same digest are one image, which is deleted by digest
+	entries := []cacheEntry{}
+	digests := map[string]bool{}
+	for _, tag := range tags {
+		desc, err := remote.Get(repo.Tag(tag), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("error getting cache image %s: %w", tag, err)
+		}
+		digest := desc.Digest.String()
+		if digests[digest] {
+			continue
+		}
+		digests[digest] = true
+
+		img, err := desc.Image()
+		if err != nil {
+			return nil, fmt.Errorf("error reading cache image %s: %w", tag, err)
+		}
+		configFile, err := img.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("error reading cache image %s config: %w", tag, err)
+		}
+		manifest, err := img.Manifest()
+		if err != nil {
+			return nil, fmt.Errorf("error reading cache image %s manifest: %w", tag, err)
+		}
+		size := desc.Size + manifest.Config.Size
+		for _, layer := range manifest.Layers {
+			size += layer.Size
+		}
+
+		ref := repo.Digest(digest)
+		entries = append(entries, cacheEntry{
+			name:    ref.String(),
+			size:    size,
+			created: configFile.Created.Time,
+			remove:  func() error { return remote.Delete(ref, opts...) },
+		})
+	}
+	return entries, nil
+}
+
+// Returns the cached base images in the cache dir. The kaniko warmer
+// writes each image as a <digest> file with a <digest>.json metadata file,
+// which are pruned together
+func getCacheDirEntries(cacheDir string) ([]cacheEntry, error) {
+	dirEntries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	entriesByName := map[string]*cacheEntry{}
+	paths := map[string][]string{}
+	names := []string{}
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.Type().IsRegular() {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+		entryName := strings.TrimSuffix(dirEntry.Name(), ".json")
+		entry, found := entriesByName[entryName]
+		if !found {
+			entry = &cacheEntry{name: entryName}
+			entriesByName[entryName] = entry
+			names = append(names, entryName)
+		}
+		entry.size += info.Size()
+		if info.ModTime().After(entry.created) {
+			entry.created = info.ModTime()
+		}
+		paths[entryName] = append(paths[entryName], filepath.Join(cacheDir, dirEntry.Name()))
+	}
+
+	entries := []cacheEntry{}
+	for _, entryName := range names {
+		entry := entriesByName[entryName]
+		entryPaths := paths[entryName]
+		entry.remove = func() error {
+			for _, path := range entryPaths {
+				err := os.Remove(path)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			return nil
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+// Parses a byte size with an optional binary (e.g. Gi) or decimal
+// (e.g. G or GB) unit. A size without a unit is in bytes
+func parseByteSize(size string) (int64, error) {
+	match := byteSizeRegexp.FindStringSubmatch(strings.TrimSpace(size))
+	if match == nil {
+		return 0, fmt.Errorf("expected a number with an optional unit (e.g. 20Gi): %s", size)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	multiplier, found := byteSizeUnits[strings.ToLower(match[2])]
+	if !found {
+		return 0, fmt.Errorf("unknown size unit %s: %s", match[2], size)
+	}
+	return int64(value * multiplier), nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// The OCI label with the revision ref of the image, which the branch
+	// of the image is read from
+	REF_NAME_LABEL = "org.opencontainers.image.ref.name"
+	// The OCI label with the revision hash of the image. The tags of the
+	// same revision (e.g. the additional and platform tags) are kept or
+	// deleted together
+	REVISION_LABEL = "org.opencontainers.image.revision"
+	// The default pattern of the PR image tags
+	DEFAULT_PR_TAG_REGEX = "^pr-"
+)
+
+// The default patterns of the release tags, which are always kept
+var defaultKeepTagRegexes = []string{semVerTagRegexp.String(), "^latest$"}
+
+// A tag in the image repo, with the fields the retention rules use
+type repoTag struct {
+	tag      string
+	digest   string
+	created  time.Time
+	branch   string
+	revision string
+	// Whether the retention rules delete the tag, and why
+	remove bool
+	reason string
+}
+
+func handleCleanupCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	cleanupFlags := cmd.Flags()
+
+	repo, err := cleanupFlags.GetString("repo")
+	if err != nil {
+		return fmt.Errorf("error processing cleanup repo flag")
+	}
+
+	keepPerBranch, err := cleanupFlags.GetInt("keep-per-branch")
+	if err != nil {
+		return fmt.Errorf("error processing cleanup keep-per-branch flag")
+	}
+	if keepPerBranch < 0 {
+		return fmt.Errorf("keep-per-branch must not be negative: %d", keepPerBranch)
+	}
+
+	prTagRegex, err := cleanupFlags.GetString("pr-tag-regex")
+	if err != nil {
+		return fmt.Errorf("error processing cleanup pr-tag-regex flag")
+	}
+	prTagRegexp, err := regexp.Compile(prTagRegex)
+	if err != nil {
+		return fmt.Errorf("pr-tag-regex is not a valid regex: %s", err)
+	}
+
+	prOlderThan, err := cleanupFlags.GetDuration("pr-older-than")
+	if err != nil {
+		return fmt.Errorf("error processing cleanup pr-older-than flag")
+	}
+	if prOlderThan < 0 {
+		return fmt.Errorf("pr-older-than must not be negative: %s", prOlderThan)
+	}
+	if keepPerBranch == 0 && prOlderThan == 0 {
+		return fmt.Errorf("at least one of keep-per-branch or pr-older-than must be set")
+	}
+
+	keepTagRegexes, err := cleanupFlags.GetStringArray("keep-tag-regex")
+	if err != nil {
+		return fmt.Errorf("error processing cleanup keep-tag-regex flag")
+	}
+	keepTagRegexps := []*regexp.Regexp{}
+	for _, keepTagRegex := range keepTagRegexes {
+		keepTagRegexp, err := regexp.Compile(keepTagRegex)
+		if err != nil {
+			return fmt.Errorf("keep-tag-regex is not a valid regex: %s", err)
+		}
+		keepTagRegexps = append(keepTagRegexps, keepTagRegexp)
+	}
+
+	insecureRegistries, err := cleanupFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing cleanup insecure-registry flag")
+	}
+
+	skipTlsVerify, err := cleanupFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing cleanup skip-tls-verify flag")
+	}
+
+	dryRun, err := cleanupFlags.GetBool("dry-run")
+	if err != nil {
+		return fmt.Errorf("error processing cleanup dry-run flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(cleanupFlags, "cleanup")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"repo", repo,
+		"keepPerBranch", keepPerBranch,
+		"prTagRegex", prTagRegex,
+		"prOlderThan", prOlderThan,
+		"keepTagRegexes", keepTagRegexes,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+		"dryRun", dryRun,
+	}
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("Cleanup with params", params...)
+
+	repoName, err := name.NewRepository(repo)
+	if err != nil {
+		return fmt.Errorf("repo is not a valid image repo: %s", err)
+	}
+	if slices.Contains(insecureRegistries, repoName.RegistryStr()) {
+		repoName, err = name.NewRepository(repo, name.Insecure)
+		if err != nil {
+			return fmt.Errorf("repo is not a valid image repo: %s", err)
+		}
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	err = registryAuthOpts.login(ctx, repoName.RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	remoteOpts := getRemoteOptions(ctx, skipTlsVerify)
+	tags, err := getRepoTags(repoName, remoteOpts)
+	if err != nil {
+		return newStepError(PRUNE_ERROR, fmt.Errorf("error listing repo %s: %w", repo, err))
+	}
+
+	applyRetentionRules(tags, keepTagRegexps, prTagRegexp, prOlderThan, keepPerBranch, time.Now())
+	return deleteRepoTags(repoName, tags, remoteOpts, dryRun)
+}
+
+// Marks the tags to delete. The release tags are always kept. The PR tags
+// are deleted when older than prOlderThan. The other tags are grouped by
+// branch, and the tags of the newest keepPerBranch revisions are kept. A
+// zero prOlderThan or keepPerBranch disables the corresponding rule
+func applyRetentionRules(
+	tags []*repoTag,
+	keepTagRegexps []*regexp.Regexp,
+	prTagRegexp *regexp.Regexp,
+	prOlderThan time.Duration,
+	keepPerBranch int,
+	now time.Time,
+) {
+	// Keep the newest tags first, so the newest revisions are kept
+	slices.SortFunc(tags, func(a, b *repoTag) int {
+		return b.created.Compare(a.created)
+	})
+
+	branchRevisions := map[string][]string{}
+	for _, tag := range tags {
+		isRelease := slices.ContainsFunc(keepTagRegexps, func(keepTagRegexp *regexp.Regexp) bool {
+			return keepTagRegexp.MatchString(tag.tag)
+		})
+		switch {
+		case isRelease:
+			tag.reason = "release tag"
+		case prTagRegexp.MatchString(tag.tag):
+			if prOlderThan != 0 && now.Sub(tag.created) > prOlderThan {
+				tag.remove = true
+				tag.reason = fmt.Sprintf("PR tag older than %s", prOlderThan)
+			} else {
+				tag.reason = "recent PR tag"
+			}
+		default:
+			revisions := branchRevisions[tag.branch]
+			if !slices.Contains(revisions, tag.revision) {
+				revisions = append(revisions, tag.revision)
+				branchRevisions[tag.branch] = revisions
+			}
+			if keepPerBranch != 0 && slices.Index(revisions, tag.revision) >= keepPerBranch {
+				tag.remove = true
+				tag.reason = fmt.Sprintf("not in the newest %d revisions of the branch", keepPerBranch)
+			} else {
+				tag.reason = "recent branch revision"
+			}
+		}
+	}
+}
+
+// Deletes the images of the tags marked for deletion. Registries delete the
+// images by digest, which removes all of the tags of the image, so an image
+// with a kept tag is not deleted
+func deleteRepoTags(repo name.Repository, tags []*repoTag, remoteOpts []remote.Option, dryRun bool) error {
+	digests := []string{}
+	digestTags := map[string][]*repoTag{}
+	for _, tag := range tags {
+		if _, found := digestTags[tag.digest]; !found {
+			digests = append(digests, tag.digest)
+		}
+		digestTags[tag.digest] = append(digestTags[tag.digest], tag)
+	}
+
+	deleted := []string{}
+	for _, digest := range digests {
+		keptTags := []string{}
+		removedTags := []string{}
+		for _, tag := range digestTags[digest] {
+			if tag.remove {
+				removedTags = append(removedTags, tag.tag)
+			} else {
+				keptTags = append(keptTags, tag.tag)
+			}
+		}
+		if len(removedTags) == 0 {
+			continue
+		}
+		if len(keptTags) > 0 {
+			slog.Info("Skipping image with a kept tag", "digest", digest, "tags", removedTags, "keptTags", keptTags)
+			continue
+		}
+		deleted = append(deleted, digest)
+	}
+
+	slog.Info("Deleting images", "repo", repo.String(), "tags", len(tags), "images", len(digests), "deleted", len(deleted))
+	failures := 0
+	for _, digest := range deleted {
+		reasons := []string{}
+		for _, tag := range digestTags[digest] {
+			reasons = append(reasons, fmt.Sprintf("%s (%s)", tag.tag, tag.reason))
+		}
+		if dryRun {
+			slog.Info("Dry run is set. Skipping image deletion", "digest", digest, "tags", reasons)
+			continue
+		}
+		err := remote.Delete(repo.Digest(digest), remoteOpts...)
+		if err != nil {
+			failures++
+			slog.Error("Error deleting image", "digest", digest, "tags", reasons, "error", err)
+			continue
+		}
+		slog.Info("Deleted image", "digest", digest, "tags", reasons)
+	}
+	if failures > 0 {
+		return newStepError(PRUNE_ERROR, fmt.Errorf("%d of %d images could not be deleted from %s", failures, len(deleted), repo))
+	}
+	return nil
+}
+
+// Returns the tags in the repo. The creation time, branch, and revision are
+// read from the image config. For an image index, the config of the first
+// image is used
+func getRepoTags(repo name.Repository, remoteOpts []remote.Option) ([]*repoTag, error) {
+	tagNames, err := remote.List(repo, remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []*repoTag{}
+	configFiles := map[string]*v1.ConfigFile{}
+	for _, tagName := range tagNames {
+		desc, err := remote.Get(repo.Tag(tagName), remoteOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("error getting image %s: %w", tagName, err)
+		}
+		digest := desc.Digest.String()
+
+		configFile, found := configFiles[digest]
+		if !found {
+			configFile, err = getDescriptorConfigFile(desc)
+			if err != nil {
+				return nil, fmt.Errorf("error reading image %s config: %w", tagName, err)
+			}
+			configFiles[digest] = configFile
+		}
+
+		// The images without the OCI labels are grouped by digest
+		labels := configFile.Config.Labels
+		revision := labels[REVISION_LABEL]
+		if revision == "" {
+			revision = digest
+		}
+		tags = append(tags, &repoTag{
+			tag:      tagName,
+			digest:   digest,
+			created:  configFile.Created.Time,
+			branch:   strings.TrimPrefix(labels[REF_NAME_LABEL], "refs/heads/"),
+			revision: revision,
+		})
+	}
+	return tags, nil
+}
+
+// Returns the config of the image, or of the first image of the image index
+func getDescriptorConfigFile(desc *remote.Descriptor) (*v1.ConfigFile, error) {
+	img, err := getDescriptorImage(desc)
+	if err != nil {
+		return nil, err
+	}
+	return img.ConfigFile()
+}
+
+// Returns the image, or the first image of the image index
+func getDescriptorImage(desc *remote.Descriptor) (v1.Image, error) {
+	if !desc.MediaType.IsIndex() {
+		return desc.Image()
+	}
+
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, manifest := range indexManifest.Manifests {
+		if manifest.MediaType.IsImage() {
+			return index.Image(manifest.Digest)
+		}
+	}
+	return nil, fmt.Errorf("the image index has no images")
+}
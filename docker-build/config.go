@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Environment variable with the config file path. Used if the config
+	// flag is not set
+	CONFIG_ENV = "DEPLOY_STEPS_CONFIG"
+	// Prefix of the environment variables bound to the flags
+	// (e.g. DOCKER_BUILD_IMAGE_REGISTRY for --image-registry)
+	FLAG_ENV_PREFIX = "DOCKER_BUILD_"
+)
+
+// Loads the flag values that were not set on the command line. The
+// precedence is flag > environment variable > config file. The logging
+// is configured once the flag values are loaded
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	err := applyFlagEnvVars(cmd)
+	if err != nil {
+		return err
+	}
+	configFile, err := applyConfigFile(cmd)
+	if err != nil {
+		return err
+	}
+
+	logFormat, err := cmd.Flags().GetString("log-format")
+	if err != nil {
+		return fmt.Errorf("error processing %s log-format flag", cmd.Name())
+	}
+	debug, err := cmd.Flags().GetBool("debug")
+	if err != nil {
+		return fmt.Errorf("error processing %s debug flag", cmd.Name())
+	}
+	err = logging.Configure(logFormat, debug, STEP_NAME, cmd.Name())
+	if err != nil {
+		return err
+	}
+
+	if configFile != "" {
+		slog.Info("Loaded config file", "configFile", configFile)
+	}
+	return nil
+}
+
+// Returns the name of the environment variable bound to the flag
+func getFlagEnvName(flagName string) string {
+	return FLAG_ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Applies the environment variables bound to the flags of the subcommand
+// that were not set on the command line. Repeatable flags take newline
+// separated values, since the values may contain commas
+func applyFlagEnvVars(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "help" {
+			return
+		}
+		envName := getFlagEnvName(flag.Name)
+		value, found := os.LookupEnv(envName)
+		if !found {
+			return
+		}
+
+		values := []string{value}
+		if _, isSlice := flag.Value.(pflag.SliceValue); isSlice {
+			values = strings.Split(strings.TrimSpace(value), "\n")
+		}
+		for _, value := range values {
+			setErr := cmd.Flags().Set(flag.Name, value)
+			if setErr != nil {
+				err = fmt.Errorf("invalid value for %s environment variable: %s", envName, setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// Loads the config file, if set, and applies its values to the flags of
+// the subcommand that were not already set. Returns the config file path.
+//
+// The config file is YAML or JSON. The top level keys are flag names, and
+// apply to all subcommands. A key with the subcommand name (e.g. commit)
+// holds values that only apply to that subcommand and take precedence
+// over the top level values. List values are used for repeatable flags:
+//
+//	image-registry: ghcr.io/
+//	build-arg:
+//	  - GO_VERSION=1.24
+//	commit:
+//	  target: release
+func applyConfigFile(cmd *cobra.Command) (string, error) {
+	configFile, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return "", fmt.Errorf("error processing %s config flag", cmd.Name())
+	}
+	if configFile == "" {
+		configFile = os.Getenv(CONFIG_ENV)
+	}
+	if configFile == "" {
+		return "", nil
+	}
+
+	bytes, err := os.ReadFile(configFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading config file: %s", err)
+	}
+	config := map[string]any{}
+	err = yaml.Unmarshal(bytes, &config)
+	if err != nil {
+		return "", fmt.Errorf("error parsing config file: %s", err)
+	}
+
+	// Split the subcommand sections from the top level values
+	subcommandNames := []string{}
+	for _, subcommand := range cmd.Root().Commands() {
+		subcommandNames = append(subcommandNames, subcommand.Name())
+	}
+	values := map[string]any{}
+	subcommandValues := map[string]any{}
+	for key, value := range config {
+		if !slices.Contains(subcommandNames, key) {
+			values[key] = value
+			continue
+		}
+		section, ok := value.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("config file section must be a map: %s", key)
+		}
+		if key == cmd.Name() {
+			subcommandValues = section
+		}
+	}
+	for key, value := range subcommandValues {
+		values[key] = value
+	}
+
+	for key, value := range values {
+		flag := cmd.Flags().Lookup(key)
+		if flag == nil {
+			// The top level values are shared by all subcommands, so only
+			// the keys that are not a flag of any subcommand are errors
+			if _, isSubcommandValue := subcommandValues[key]; isSubcommandValue || !isKnownFlag(cmd.Root(), key) {
+				return "", fmt.Errorf("unknown flag in config file: %s", key)
+			}
+			continue
+		}
+		if flag.Changed {
+			continue
+		}
+		err = setFlagFromConfig(cmd.Flags(), key, value)
+		if err != nil {
+			return "", err
+		}
+	}
+	return configFile, nil
+}
+
+// Sets the flag to the config value. List values set each item, which
+// is how repeatable flags are specified
+func setFlagFromConfig(flags *pflag.FlagSet, key string, value any) error {
+	items, isList := value.([]any)
+	if !isList {
+		items = []any{value}
+	}
+	for _, item := range items {
+		if _, isMap := item.(map[string]any); isMap {
+			return fmt.Errorf("config file value must be a scalar or a list: %s", key)
+		}
+		if item == nil {
+			continue
+		}
+		err := flags.Set(key, fmt.Sprint(item))
+		if err != nil {
+			return fmt.Errorf("invalid config file value for %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// Returns whether the flag is defined for any subcommand
+func isKnownFlag(root *cobra.Command, key string) bool {
+	if root.PersistentFlags().Lookup(key) != nil {
+		return true
+	}
+	for _, subcommand := range root.Commands() {
+		if subcommand.Flags().Lookup(key) != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const (
+	// The image label with the content hash of the build inputs
+	CONTENT_HASH_LABEL = "dev.jettison.content-hash"
+)
+
+// Computes a deterministic hash of the build inputs: the dockerfile, the
+// files in the docker context dir that are not excluded by .dockerignore,
+// the build args, and the target. The file modes are included, but not
+// the modification times, so the hash only changes if the content does
+func computeContentHash(
+	dockerfilePath string,
+	contextDir string,
+	buildArgs []string,
+	target string,
+) (string, error) {
+	hash := sha256.New()
+
+	dockerfile, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return "", fmt.Errorf("error reading dockerfile: %s", err)
+	}
+	fmt.Fprintf(hash, "dockerfile %d\n", len(dockerfile))
+	hash.Write(dockerfile)
+
+	patterns, err := readDockerignore(contextDir)
+	if err != nil {
+		return "", fmt.Errorf("error reading .dockerignore: %s", err)
+	}
+
+	// WalkDir visits the files in lexical order, so the hash is deterministic
+	err = filepath.WalkDir(contextDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(contextDir, path)
+		if err != nil {
+			return err
+		}
+		if relativePath == "." || entry.IsDir() || isIgnored(relativePath, patterns) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "file %s %s %d\n", filepath.ToSlash(relativePath), info.Mode(), info.Size())
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(hash, target)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(hash, file)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error hashing the docker context dir: %s", err)
+	}
+
+	for _, buildArg := range buildArgs {
+		fmt.Fprintf(hash, "build-arg %s\n", buildArg)
+	}
+	fmt.Fprintf(hash, "target %s\n", target)
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Returns the content hash recorded for the last successful build. The
+// hash is read from the cache file if set, otherwise from the content hash
+// label of the image if set. Returns an empty hash if none is recorded
+func getLastContentHash(cacheFile string, image string, insecureRegistries []string) (string, error) {
+	if cacheFile != "" {
+		bytes, err := os.ReadFile(cacheFile)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return "", nil
+			}
+			return "", err
+		}
+		return strings.TrimSpace(string(bytes)), nil
+	}
+	if image == "" {
+		return "", nil
+	}
+
+	_, exists, err := getRemoteImageDigest(image, insecureRegistries)
+	if err != nil || !exists {
+		return "", err
+	}
+	ref, err := parseImageReference(image, insecureRegistries)
+	if err != nil {
+		return "", err
+	}
+	remoteImage, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", err
+	}
+	config, err := remoteImage.ConfigFile()
+	if err != nil {
+		return "", err
+	}
+	return config.Config.Labels[CONTENT_HASH_LABEL], nil
+}
+
+// Returns a post build hook that records the content hash in the cache
+// file if the build succeeded. Does nothing if the cache file is not set
+func writeContentHashHook(cacheFile string, contentHash string) postBuildHook {
+	return func(outcome *buildOutcome) error {
+		if cacheFile == "" || outcome.err != nil {
+			return nil
+		}
+		err := os.WriteFile(cacheFile, []byte(contentHash+"\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing content hash cache file: %s", err)
+		}
+		slog.Info("Recorded content hash", "contentHash", contentHash, "contentHashFile", cacheFile)
+		return nil
+	}
+}
+
+// Computes the content hash of the build inputs and returns whether it
+// matches the content hash recorded for the last successful build
+func checkContentHash(
+	dockerfilePath string,
+	contextDir string,
+	buildArgs []string,
+	target string,
+	cacheFile string,
+	image string,
+	insecureRegistries []string,
+) (string, bool, error) {
+	contentHash, err := computeContentHash(dockerfilePath, contextDir, buildArgs, target)
+	if err != nil {
+		return "", false, err
+	}
+	lastContentHash, err := getLastContentHash(cacheFile, image, insecureRegistries)
+	if err != nil {
+		return "", false, fmt.Errorf("error reading the last content hash: %s", err)
+	}
+	slog.Info("Computed content hash", "contentHash", contentHash, "lastContentHash", lastContentHash)
+	return contentHash, contentHash == lastContentHash, nil
+}
+
+// Tags the image of the last successful build with the destinations of the
+// revision, since the build inputs did not change, so the revision has an
+// image to deploy. The image is the content hash image, if its content hash
+// label matches. The manifest is copied by its digest, so nothing is
+// rebuilt. Returns the image ref and the digest, which are empty if there
+// is no matching image, such as when only the content hash file is set
+func tagUnchangedImage(
+	ctx context.Context,
+	contentHashImage string,
+	contentHash string,
+	destinations []string,
+	registryOpts registryOptions,
+	dryRun bool,
+) (string, string, error) {
+	if contentHashImage == "" {
+		slog.Info("No content hash image is set, so no image is tagged for the revision")
+		return "", "", nil
+	}
+	ref, err := parseImageReference(contentHashImage, registryOpts.insecureRegistries)
+	if err != nil {
+		return "", "", newStepError(FLAG_ERROR, fmt.Errorf("content-hash-image is not a valid image reference: %s", err))
+	}
+	desc, err := remote.Get(ref, getRemoteOptions(ctx, registryOpts.skipTlsVerify)...)
+	if err != nil {
+		return "", "", newStepError(PUSH_ERROR, fmt.Errorf("error reading the content hash image %s: %w", ref, err))
+	}
+	remoteImage, err := desc.Image()
+	if err != nil {
+		return "", "", newStepError(PUSH_ERROR, fmt.Errorf("error reading the content hash image %s: %w", ref, err))
+	}
+	config, err := remoteImage.ConfigFile()
+	if err != nil {
+		return "", "", newStepError(PUSH_ERROR, fmt.Errorf("error reading the content hash image config: %w", err))
+	}
+	if config.Config.Labels[CONTENT_HASH_LABEL] != contentHash {
+		slog.Info(
+			"The content hash image is from other build inputs, so no image is tagged for the revision",
+			"contentHashImage", contentHashImage)
+		return "", "", nil
+	}
+
+	digest := desc.Digest.String()
+	srcRef := ref.Context().Digest(digest)
+	for _, destination := range destinations {
+		dstRef, err := parseImageReference(destination, registryOpts.insecureRegistries)
+		if err != nil {
+			return "", "", newStepError(FLAG_ERROR, fmt.Errorf("destination is not a valid image reference: %s", err))
+		}
+		_, err = copyImage(ctx, srcRef, dstRef, registryOpts.skipTlsVerify, dryRun)
+		if err != nil {
+			return "", "", withDefaultClass(PUSH_ERROR, err)
+		}
+	}
+	return destinations[0], digest, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// Uses the docker context dir under the clone path
+	DIR_CONTEXT_TYPE = "dir"
+	// Uses a git repo as the context. kaniko clones the repo itself
+	GIT_CONTEXT_TYPE = "git"
+	// Uses a local tar.gz file as the context
+	TAR_CONTEXT_TYPE = "tar"
+)
+
+// The supported context types
+var contextTypes = []string{DIR_CONTEXT_TYPE, GIT_CONTEXT_TYPE, TAR_CONTEXT_TYPE}
+
+// Validates the context flags for the given context type
+func validateContext(contextType string, contextSource string, clonePath string) error {
+	if !slices.Contains(contextTypes, contextType) {
+		return fmt.Errorf("context-type must be one of %s: %s", contextTypes, contextType)
+	}
+	if contextType == DIR_CONTEXT_TYPE {
+		if clonePath == "" {
+			return fmt.Errorf("clone-path must be set for the %s context type", contextType)
+		}
+		return nil
+	}
+	if contextSource == "" {
+		return fmt.Errorf("context-source must be set for the %s context type", contextType)
+	}
+	return nil
+}
+
+// The dockerfile and the build context of a build
+type buildContext struct {
+	contextType string
+	// The path to the dockerfile. For the git and tar context types, the
+	// path is relative to the sub path of the source
+	dockerfile string
+	// The docker context dir for the dir context type
+	dir string
+	// The source of the git and tar context types, without the type prefix
+	source string
+	// The docker context dir within the source of the git and tar
+	// context types, if any
+	subPath string
+}
+
+// Returns the dockerfile and the build context.
+//
+// For the dir context type, the paths are under the clone path. For the
+// git and tar context types, the docker context dir is used as the
+// context sub path, and the dockerfile is resolved relative to it.
+//
+// For the git context type, the revision ref and hash are added to the
+// source if it does not specify a reference already
+func getBuildContext(
+	contextType string,
+	contextSource string,
+	clonePath string,
+	dockerfile string,
+	dockerContextDir string,
+	revisionRef string,
+	revisionHash string,
+) (buildContext, error) {
+	switch contextType {
+	case DIR_CONTEXT_TYPE:
+		return buildContext{
+			contextType: contextType,
+			dockerfile:  fmt.Sprintf("%s/%s", clonePath, dockerfile),
+			dir:         fmt.Sprintf("%s/%s", clonePath, dockerContextDir),
+		}, nil
+
+	case GIT_CONTEXT_TYPE, TAR_CONTEXT_TYPE:
+		relativeDockerfile, err := filepath.Rel(filepath.Join("/", dockerContextDir), filepath.Join("/", dockerfile))
+		if err != nil {
+			return buildContext{}, fmt.Errorf("error resolving dockerfile relative to the docker context dir: %s", err)
+		}
+
+		source := strings.TrimPrefix(contextSource, contextType+"://")
+		if contextType == GIT_CONTEXT_TYPE && !strings.Contains(source, "#") && revisionRef != "" {
+			// See https://github.com/GoogleContainerTools/kaniko#using-private-git-repository
+			source = fmt.Sprintf("%s#%s", source, revisionRef)
+			if revisionHash != "" {
+				source = fmt.Sprintf("%s#%s", source, revisionHash)
+			}
+		}
+
+		return buildContext{
+			contextType: contextType,
+			dockerfile:  relativeDockerfile,
+			source:      source,
+			subPath:     dockerContextDir,
+		}, nil
+
+	default:
+		return buildContext{}, fmt.Errorf("unknown context type: %s", contextType)
+	}
+}
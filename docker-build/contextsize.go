@@ -0,0 +1,220 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// The number of largest top level paths logged when the context is large
+const CONTEXT_SIZE_TOP_PATHS = 5
+
+// The options for the guardrail on the docker context size, since a large
+// context is sent to or read by the builder on every build
+type contextSizeOptions struct {
+	// The sizes in bytes above which the context size is logged or fails
+	// the build, or 0 if not set
+	warnSize int64
+	maxSize  int64
+	// Whether the docker context dir must have a .dockerignore file
+	requireDockerignore bool
+}
+
+// The size of the docker context, excluding the .dockerignore paths
+type contextSize struct {
+	bytes int64
+	files int
+	// The size of each top level path of the context
+	topLevelBytes map[string]int64
+}
+
+func configureContextSizeFlags(flags *pflag.FlagSet) {
+	flags.String(
+		"context-size-warn",
+		"",
+		"The docker context size above which a warning is logged (e.g. 500MB). The .dockerignore paths are excluded")
+	flags.String(
+		"context-size-max",
+		"",
+		"The docker context size above which the build fails before it starts (e.g. 2Gi). The .dockerignore paths "+
+			"are excluded")
+	flags.Bool(
+		"require-dockerignore",
+		false,
+		"Whether to fail the build before it starts if the docker context dir has no .dockerignore file")
+}
+
+func getContextSizeOptions(flags *pflag.FlagSet, cmdName string) (contextSizeOptions, error) {
+	var opts contextSizeOptions
+
+	warnSize, err := flags.GetString("context-size-warn")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s context-size-warn flag", cmdName)
+	}
+	if warnSize != "" {
+		opts.warnSize, err = parseByteSize(warnSize)
+		if err != nil {
+			return opts, fmt.Errorf("context-size-warn is not a valid size: %s", err)
+		}
+	}
+
+	maxSize, err := flags.GetString("context-size-max")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s context-size-max flag", cmdName)
+	}
+	if maxSize != "" {
+		opts.maxSize, err = parseByteSize(maxSize)
+		if err != nil {
+			return opts, fmt.Errorf("context-size-max is not a valid size: %s", err)
+		}
+	}
+
+	opts.requireDockerignore, err = flags.GetBool("require-dockerignore")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s require-dockerignore flag", cmdName)
+	}
+	return opts, nil
+}
+
+func (opts contextSizeOptions) logAttrs() []any {
+	return []any{
+		"contextSizeWarn", opts.warnSize,
+		"contextSizeMax", opts.maxSize,
+		"requireDockerignore", opts.requireDockerignore,
+	}
+}
+
+// Returns whether any of the context checks are enabled
+func (opts contextSizeOptions) enabled() bool {
+	return opts.warnSize > 0 || opts.maxSize > 0 || opts.requireDockerignore
+}
+
+// Checks that the docker context dir has a .dockerignore file, if required,
+// and that the context size is within the thresholds. The largest top level
+// paths are logged above a threshold, since they are the candidates for the
+// .dockerignore file
+func (opts contextSizeOptions) check(contextDir string) error {
+	if !opts.enabled() {
+		return nil
+	}
+
+	if opts.requireDockerignore {
+		_, err := os.Stat(filepath.Join(contextDir, ".dockerignore"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return newStepError(
+				POLICY_ERROR,
+				fmt.Errorf("the docker context dir %s has no .dockerignore file. Add one to exclude the files "+
+					"that the build does not need (e.g. .git and node_modules)", contextDir))
+		}
+		if err != nil {
+			return newStepError(POLICY_ERROR, fmt.Errorf("error reading .dockerignore: %s", err))
+		}
+	}
+	if opts.warnSize == 0 && opts.maxSize == 0 {
+		return nil
+	}
+
+	size, err := measureContextSize(contextDir)
+	if err != nil {
+		return newStepError(POLICY_ERROR, err)
+	}
+	slog.Info("Measured the docker context size", "contextDir", contextDir, "bytes", size.bytes, "files", size.files)
+
+	exceedsMax := opts.maxSize > 0 && size.bytes > opts.maxSize
+	exceedsWarn := opts.warnSize > 0 && size.bytes > opts.warnSize
+	if !exceedsMax && !exceedsWarn {
+		return nil
+	}
+	topPaths := size.getTopPaths(CONTEXT_SIZE_TOP_PATHS)
+	if exceedsMax {
+		return newStepError(
+			POLICY_ERROR,
+			fmt.Errorf(
+				"the docker context is %d bytes, which is more than the max of %d bytes. Exclude the files that the "+
+					"build does not need with .dockerignore. The largest paths are %s",
+				size.bytes,
+				opts.maxSize,
+				topPaths))
+	}
+	slog.Warn(
+		"The docker context is larger than the warning size. Exclude the files that the build does not need with .dockerignore",
+		"bytes", size.bytes,
+		"contextSizeWarn", opts.warnSize,
+		"largestPaths", topPaths,
+	)
+	return nil
+}
+
+// Returns the largest top level paths with their sizes (e.g. node_modules=1234)
+func (size contextSize) getTopPaths(count int) []string {
+	paths := []string{}
+	for path := range size.topLevelBytes {
+		paths = append(paths, path)
+	}
+	slices.SortFunc(paths, func(a, b string) int {
+		return cmp.Or(cmp.Compare(size.topLevelBytes[b], size.topLevelBytes[a]), strings.Compare(a, b))
+	})
+	if len(paths) > count {
+		paths = paths[:count]
+	}
+	for i, path := range paths {
+		paths[i] = fmt.Sprintf("%s=%d", path, size.topLevelBytes[path])
+	}
+	return paths
+}
+
+// Measures the size of the files in the docker context dir that are not
+// excluded by .dockerignore. The ignored dirs are skipped if no pattern
+// re-includes paths, so a large ignored dir is not walked
+func measureContextSize(contextDir string) (contextSize, error) {
+	size := contextSize{topLevelBytes: map[string]int64{}}
+	patterns, err := readDockerignore(contextDir)
+	if err != nil {
+		return size, fmt.Errorf("error reading .dockerignore: %s", err)
+	}
+	hasExclusions := slices.ContainsFunc(patterns, func(pattern ignorePattern) bool { return pattern.exclusion })
+
+	err = filepath.WalkDir(contextDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(contextDir, path)
+		if err != nil {
+			return err
+		}
+		if relativePath == "." {
+			return nil
+		}
+		if isIgnored(relativePath, patterns) {
+			if entry.IsDir() && !hasExclusions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		topLevelPath, _, _ := strings.Cut(filepath.ToSlash(relativePath), "/")
+		size.bytes += info.Size()
+		size.files++
+		size.topLevelBytes[topLevelPath] += info.Size()
+		return nil
+	})
+	if err != nil {
+		return size, fmt.Errorf("error measuring the docker context dir: %s", err)
+	}
+	return size, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+func handleCopyCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	copyFlags := cmd.Flags()
+
+	src, err := copyFlags.GetString("src")
+	if err != nil {
+		return fmt.Errorf("error processing copy src flag")
+	}
+
+	dst, err := copyFlags.GetString("dst")
+	if err != nil {
+		return fmt.Errorf("error processing copy dst flag")
+	}
+
+	insecureRegistries, err := copyFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing copy insecure-registry flag")
+	}
+
+	skipTlsVerify, err := copyFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing copy skip-tls-verify flag")
+	}
+
+	digestFile, err := copyFlags.GetString("digest-file")
+	if err != nil {
+		return fmt.Errorf("error processing copy digest-file flag")
+	}
+
+	dryRun, err := copyFlags.GetBool("dry-run")
+	if err != nil {
+		return fmt.Errorf("error processing copy dry-run flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(copyFlags, "copy")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"src", src,
+		"dst", dst,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+		"digestFile", digestFile,
+		"dryRun", dryRun,
+	}
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("Copy with params", params...)
+
+	srcRef, err := parseImageReference(src, insecureRegistries)
+	if err != nil {
+		return fmt.Errorf("src is not a valid image reference: %s", err)
+	}
+	dstRef, err := parseImageReference(dst, insecureRegistries)
+	if err != nil {
+		return fmt.Errorf("dst is not a valid image reference: %s", err)
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	err = registryAuthOpts.login(ctx, srcRef.Context().RegistryStr(), dstRef.Context().RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	digest, err := copyImage(ctx, srcRef, dstRef, skipTlsVerify, dryRun)
+	if err != nil {
+		return err
+	}
+
+	if digestFile != "" && !dryRun {
+		err = os.WriteFile(digestFile, []byte(digest), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing digest file: %s", err)
+		}
+	}
+	return nil
+}
+
+// Copies the image or image index from the src to the dst by its manifest,
+// so the digest is preserved. The blobs are mounted from the src repo if it
+// is in the same registry. Returns the digest
+func copyImage(ctx context.Context, srcRef name.Reference, dstRef name.Reference, skipTlsVerify bool, dryRun bool) (string, error) {
+	remoteOpts := getRemoteOptions(ctx, skipTlsVerify)
+
+	desc, err := remote.Get(srcRef, remoteOpts...)
+	if err != nil {
+		return "", fmt.Errorf("error reading the src image %s: %w", srcRef, err)
+	}
+	digest := desc.Digest.String()
+
+	// A dst digest must match, since the manifest is copied as is
+	if dstDigest, ok := dstRef.(name.Digest); ok && dstDigest.DigestStr() != digest {
+		return "", newStepError(
+			FLAG_ERROR,
+			fmt.Errorf("the dst digest %s does not match the src digest %s", dstDigest.DigestStr(), digest))
+	}
+
+	if dryRun {
+		slog.Info("Dry run is set. Exiting without copying", "src", srcRef.String(), "dst", dstRef.String(), "digest", digest)
+		return digest, nil
+	}
+
+	slog.Info("Copying image", "src", srcRef.String(), "dst", dstRef.String(), "digest", digest, "mediaType", desc.MediaType)
+	switch {
+	case desc.MediaType.IsIndex():
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return "", err
+		}
+		err = remote.WriteIndex(dstRef, index, remoteOpts...)
+	case desc.MediaType.IsImage():
+		image, err := desc.Image()
+		if err != nil {
+			return "", err
+		}
+		err = remote.Write(dstRef, image, remoteOpts...)
+	default:
+		// Other manifests (e.g. artifacts) are copied without their blobs
+		err = remote.Put(dstRef, desc, remoteOpts...)
+	}
+	if err != nil {
+		return "", newStepError(PUSH_ERROR, fmt.Errorf("error copying the image to %s: %w", dstRef, err))
+	}
+	slog.Info("Copied image", "src", srcRef.String(), "dst", dstRef.String(), "digest", digest)
+	return digest, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// An instruction in a Dockerfile
+type instruction struct {
+	// The line number the instruction starts on
+	line int
+	// The upper case instruction name (e.g. FROM, RUN)
+	cmd string
+	// The instruction flags (e.g. --from=builder for COPY)
+	flags []string
+	// The instruction arguments after the flags. Line continuations are
+	// joined with a space, and heredoc bodies are appended with newlines
+	args string
+}
+
+var (
+	// Matches a parser directive at the top of the Dockerfile (e.g. # escape=`)
+	parserDirectiveRegexp = regexp.MustCompile(`^#\s*([a-zA-Z]+)\s*=\s*(\S+)\s*$`)
+	// Matches a heredoc start (e.g. <<EOF or <<-"EOF"), but not a here string (<<<)
+	heredocRegexp = regexp.MustCompile(`(?:^|[^<])<<-?\s*["']?([a-zA-Z_][a-zA-Z0-9_]*)["']?`)
+)
+
+// The instructions supported by the Dockerfile syntax
+var dockerfileInstructions = map[string]bool{
+	"ADD":         true,
+	"ARG":         true,
+	"CMD":         true,
+	"COPY":        true,
+	"ENTRYPOINT":  true,
+	"ENV":         true,
+	"EXPOSE":      true,
+	"FROM":        true,
+	"HEALTHCHECK": true,
+	"LABEL":       true,
+	"MAINTAINER":  true,
+	"ONBUILD":     true,
+	"RUN":         true,
+	"SHELL":       true,
+	"STOPSIGNAL":  true,
+	"USER":        true,
+	"VOLUME":      true,
+	"WORKDIR":     true,
+}
+
+// Reads and parses the Dockerfile at the given path
+func readDockerfile(path string) ([]instruction, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDockerfile(string(bytes))
+}
+
+// Parses the Dockerfile content into instructions. This handles the
+// escape parser directive, comments, line continuations, and heredocs,
+// which covers what the checks in docker-build need
+// See https://docs.docker.com/reference/dockerfile/
+func parseDockerfile(content string) ([]instruction, error) {
+	escape := `\`
+	instructions := []instruction{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNum := 0
+	inDirectives := true
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if inDirectives {
+			matches := parserDirectiveRegexp.FindStringSubmatch(line)
+			if matches != nil {
+				if strings.ToLower(matches[1]) == "escape" {
+					escape = matches[2]
+				}
+				continue
+			}
+			inDirectives = false
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Join the continuation lines
+		startLine := lineNum
+		for strings.HasSuffix(line, escape) {
+			line = strings.TrimSpace(strings.TrimSuffix(line, escape))
+			if !scanner.Scan() {
+				break
+			}
+			lineNum++
+			nextLine := strings.TrimSpace(scanner.Text())
+			for nextLine == "" || strings.HasPrefix(nextLine, "#") {
+				if !scanner.Scan() {
+					break
+				}
+				lineNum++
+				nextLine = strings.TrimSpace(scanner.Text())
+			}
+			line = line + " " + nextLine
+		}
+
+		cmd, rest := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			cmd, rest = line[:i], line[i+1:]
+		}
+		cmd = strings.ToUpper(cmd)
+		if !dockerfileInstructions[cmd] {
+			return nil, fmt.Errorf("unknown instruction on line %d: %s", startLine, cmd)
+		}
+
+		flags, args := splitInstructionFlags(strings.TrimSpace(rest))
+
+		// Append the heredoc bodies to the args
+		heredocs := [][]string{}
+		if cmd == "RUN" || cmd == "COPY" || cmd == "ADD" {
+			heredocs = heredocRegexp.FindAllStringSubmatch(args, -1)
+		}
+		for _, heredoc := range heredocs {
+			terminator := heredoc[1]
+			for scanner.Scan() {
+				lineNum++
+				heredocLine := scanner.Text()
+				if strings.TrimSpace(heredocLine) == terminator {
+					break
+				}
+				args = args + "\n" + heredocLine
+			}
+		}
+
+		instructions = append(instructions, instruction{
+			line:  startLine,
+			cmd:   cmd,
+			flags: flags,
+			args:  args,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return instructions, nil
+}
+
+// Splits the leading --flag arguments from the rest of the args
+func splitInstructionFlags(rest string) ([]string, string) {
+	flags := []string{}
+	for strings.HasPrefix(rest, "--") {
+		flag, remaining, _ := strings.Cut(rest, " ")
+		flags = append(flags, flag)
+		rest = strings.TrimSpace(remaining)
+	}
+	return flags, rest
+}
+
+// Returns the value of the instruction flag (e.g. "from" for --from=x),
+// and whether the flag is set
+func (inst instruction) flagValue(name string) (string, bool) {
+	for _, flag := range inst.flags {
+		key, value, _ := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+		if key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// A build stage declared by a FROM instruction
+type buildStage struct {
+	// The FROM instruction of the stage
+	from instruction
+	// The base image reference, which may contain ARG variables
+	image string
+	// The stage name from "AS <name>", or empty if not named
+	name string
+}
+
+// Returns the build stages declared in the Dockerfile
+func getBuildStages(instructions []instruction) []buildStage {
+	stages := []buildStage{}
+	for _, inst := range instructions {
+		if inst.cmd != "FROM" {
+			continue
+		}
+		fields := strings.Fields(inst.args)
+		stage := buildStage{from: inst}
+		if len(fields) > 0 {
+			stage.image = fields[0]
+		}
+		if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+			stage.name = fields[2]
+		}
+		stages = append(stages, stage)
+	}
+	return stages
+}
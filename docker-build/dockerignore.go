@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A pattern from the .dockerignore file
+type ignorePattern struct {
+	regexp *regexp.Regexp
+	// Whether the pattern starts with "!", which re-includes matching paths
+	exclusion bool
+}
+
+// Reads the .dockerignore patterns from the docker context dir. Returns
+// no patterns if the file does not exist
+// See https://docs.docker.com/build/concepts/context/#dockerignore-files
+func readDockerignore(contextDir string) ([]ignorePattern, error) {
+	file, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	patterns := []ignorePattern{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		exclusion := strings.HasPrefix(line, "!")
+		line = strings.TrimSpace(strings.TrimPrefix(line, "!"))
+		line = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(line)), "/")
+		if line == "." {
+			continue
+		}
+
+		patternRegexp, err := compileIgnorePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, ignorePattern{regexp: patternRegexp, exclusion: exclusion})
+	}
+	return patterns, scanner.Err()
+}
+
+// Compiles a .dockerignore pattern into a regexp. The pattern uses the
+// filepath.Match syntax, with the addition of "**", which matches any
+// number of directories
+func compileIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == '*' && strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case ch == '*' && strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case ch == '*':
+			sb.WriteString("[^/]*")
+		case ch == '?':
+			sb.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("invalid .dockerignore pattern: " + pattern)
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	// A pattern matching a dir also matches everything under it
+	sb.WriteString("(/.*)?$")
+	return regexp.Compile(sb.String())
+}
+
+// Returns whether the path, relative to the docker context dir, is
+// ignored. The last matching pattern wins
+func isIgnored(relativePath string, patterns []ignorePattern) bool {
+	relativePath = filepath.ToSlash(relativePath)
+	ignored := false
+	for _, pattern := range patterns {
+		if pattern.regexp.MatchString(relativePath) {
+			ignored = !pattern.exclusion
+		}
+	}
+	return ignored
+}
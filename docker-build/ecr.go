@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// The ECR API version prefix of the X-Amz-Target header
+	ECR_API_TARGET_PREFIX = "AmazonEC2ContainerRegistry_V20150921."
+	// The ECR error type when the repository already exists
+	ECR_REPOSITORY_EXISTS_ERROR = "RepositoryAlreadyExistsException"
+
+	// The IMDSv2 endpoint for the instance role credentials
+	// See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instancedata-data-retrieval.html
+	AWS_IMDS_ENDPOINT = "http://169.254.169.254"
+	// The ECS endpoint for the relative container credentials URI
+	AWS_CONTAINER_CREDENTIALS_ENDPOINT = "http://169.254.170.2"
+	// The timeout of the instance metadata requests, which is short since
+	// the instance metadata service is not reachable outside of EC2
+	AWS_IMDS_TIMEOUT = 5 * time.Second
+)
+
+var (
+	// Matches an ECR registry host, with the account ID, region, and
+	// optional China partition suffix
+	// See https://docs.aws.amazon.com/AmazonECR/latest/userguide/Registries.html
+	ecrRegistryRegexp = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+)
+
+// AWS credentials for signing the API requests
+type awsCredentials struct {
+	accessKeyId     string
+	secretAccessKey string
+	sessionToken    string
+	// Where the credentials were resolved from, for logging
+	source string
+}
+
+// An ECR registry, parsed from the registry host
+type ecrRegistry struct {
+	accountId string
+	region    string
+	// The API endpoint, which depends on the partition
+	endpoint string
+}
+
+// An error returned by the ECR API
+type ecrApiError struct {
+	errorType string
+	message   string
+}
+
+func (e *ecrApiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.errorType, e.message)
+}
+
+// Parses the ECR registry host
+func parseEcrRegistry(host string) (ecrRegistry, error) {
+	match := ecrRegistryRegexp.FindStringSubmatch(host)
+	if match == nil {
+		return ecrRegistry{}, fmt.Errorf("not an ECR registry (e.g. 123456789012.dkr.ecr.us-east-1.amazonaws.com): %s", host)
+	}
+	return ecrRegistry{
+		accountId: match[1],
+		region:    match[2],
+		endpoint:  fmt.Sprintf("https://api.ecr.%s.amazonaws.com%s/", match[2], match[3]),
+	}, nil
+}
+
+// Returns the username and password for the ECR registry, from the ECR
+// GetAuthorizationToken API. The token is valid for 12 hours
+func getEcrCredentials(ctx context.Context, host string) (string, string, error) {
+	registry, err := parseEcrRegistry(host)
+	if err != nil {
+		return "", "", err
+	}
+	creds, err := getAwsCredentials(ctx, registry.region)
+	if err != nil {
+		return "", "", err
+	}
+	slog.Info("Resolved the AWS credentials", "source", creds.source)
+
+	response := struct {
+		AuthorizationData []struct {
+			AuthorizationToken string `json:"authorizationToken"`
+		} `json:"authorizationData"`
+	}{}
+	err = callEcrApi(ctx, registry, creds, "GetAuthorizationToken", map[string]any{
+		"registryIds": []string{registry.accountId},
+	}, &response)
+	if err != nil {
+		return "", "", err
+	}
+	if len(response.AuthorizationData) == 0 {
+		return "", "", errors.New("ECR returned no authorization data")
+	}
+	token, err := base64.StdEncoding.DecodeString(response.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return "", "", fmt.Errorf("error decoding the ECR authorization token: %w", err)
+	}
+	username, password, found := strings.Cut(string(token), ":")
+	if !found {
+		return "", "", errors.New("the ECR authorization token is not in the format <username>:<password>")
+	}
+	return username, password, nil
+}
+
+// Creates the ECR repositories of the images if they do not exist. The
+// lifecycle policy, if set, is only applied to the created repositories,
+// so the existing policies are not overwritten
+func createEcrRepositories(ctx context.Context, images []string, lifecyclePolicy string) error {
+	for _, image := range images {
+		host, repositoryName, _ := strings.Cut(image, "/")
+		registry, err := parseEcrRegistry(host)
+		if err != nil {
+			return err
+		}
+		creds, err := getAwsCredentials(ctx, registry.region)
+		if err != nil {
+			return err
+		}
+
+		err = callEcrApi(ctx, registry, creds, "CreateRepository", map[string]any{
+			"registryId":     registry.accountId,
+			"repositoryName": repositoryName,
+		}, nil)
+		var apiErr *ecrApiError
+		if errors.As(err, &apiErr) && apiErr.errorType == ECR_REPOSITORY_EXISTS_ERROR {
+			slog.Info("ECR repository already exists", "repository", image)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error creating ECR repository %s: %w", image, err)
+		}
+		slog.Info("Created ECR repository", "repository", image)
+
+		if lifecyclePolicy == "" {
+			continue
+		}
+		err = callEcrApi(ctx, registry, creds, "PutLifecyclePolicy", map[string]any{
+			"registryId":          registry.accountId,
+			"repositoryName":      repositoryName,
+			"lifecyclePolicyText": lifecyclePolicy,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("error putting the lifecycle policy of ECR repository %s: %w", image, err)
+		}
+		slog.Info("Put the lifecycle policy of the ECR repository", "repository", image)
+	}
+	return nil
+}
+
+// Calls the ECR JSON API action, and decodes the response into the
+// response value if set
+// See https://docs.aws.amazon.com/AmazonECR/latest/APIReference/Welcome.html
+func callEcrApi(ctx context.Context, registry ecrRegistry, creds awsCredentials, action string, request any, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, registry.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", ECR_API_TARGET_PREFIX+action)
+	signAwsRequest(req, body, creds, registry.region, "ecr", time.Now())
+
+	resp, err := authHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		errResponse := struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}{}
+		json.Unmarshal(respBody, &errResponse)
+		// The type may be prefixed with the namespace (e.g. com.amazonaws.ecr#...)
+		errorType := errResponse.Type[strings.LastIndex(errResponse.Type, "#")+1:]
+		if errorType == "" {
+			errorType = resp.Status
+		}
+		return &ecrApiError{errorType: errorType, message: errResponse.Message}
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, response)
+}
+
+// Returns the AWS credentials from the first available source, in the
+// order of the AWS SDK default chain: the environment variables, the web
+// identity token (IRSA), the container credentials (ECS and EKS pod
+// identity), and the instance role
+func getAwsCredentials(ctx context.Context, region string) (awsCredentials, error) {
+	if accessKeyId := os.Getenv("AWS_ACCESS_KEY_ID"); accessKeyId != "" {
+		return awsCredentials{
+			accessKeyId:     accessKeyId,
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			source:          "environment",
+		}, nil
+	}
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+		return getAwsWebIdentityCredentials(ctx, tokenFile, region)
+	}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" {
+		return getAwsContainerCredentials(ctx)
+	}
+	return getAwsInstanceCredentials(ctx)
+}
+
+// Exchanges the web identity token for the role credentials with the STS
+// AssumeRoleWithWebIdentity API, which does not need signing
+// See https://docs.aws.amazon.com/eks/latest/userguide/iam-roles-for-service-accounts.html
+func getAwsWebIdentityCredentials(ctx context.Context, tokenFile string, region string) (awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error reading the web identity token file: %w", err)
+	}
+	roleArn := os.Getenv("AWS_ROLE_ARN")
+	if roleArn == "" {
+		return awsCredentials{}, errors.New("AWS_ROLE_ARN must be set with AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("docker-build-%d", time.Now().Unix())
+	}
+	if envRegion := os.Getenv("AWS_REGION"); envRegion != "" {
+		region = envRegion
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleArn},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	stsEndpoint := fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	if strings.HasPrefix(region, "cn-") {
+		stsEndpoint = fmt.Sprintf("https://sts.%s.amazonaws.com.cn/", region)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stsEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	respBody, err := doCredentialsRequest(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error assuming role %s with the web identity token: %w", roleArn, err)
+	}
+
+	response := struct {
+		Credentials struct {
+			AccessKeyId     string `xml:"AccessKeyId"`
+			SecretAccessKey string `xml:"SecretAccessKey"`
+			SessionToken    string `xml:"SessionToken"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}{}
+	err = xml.Unmarshal(respBody, &response)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error parsing the STS response: %w", err)
+	}
+	return awsCredentials{
+		accessKeyId:     response.Credentials.AccessKeyId,
+		secretAccessKey: response.Credentials.SecretAccessKey,
+		sessionToken:    response.Credentials.SessionToken,
+		source:          "web identity",
+	}, nil
+}
+
+// Returns the credentials from the container credentials endpoint, which
+// is set by ECS and EKS pod identity
+// See https://docs.aws.amazon.com/sdkref/latest/guide/feature-container-credentials.html
+func getAwsContainerCredentials(ctx context.Context) (awsCredentials, error) {
+	credentialsUri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if credentialsUri == "" {
+		credentialsUri = AWS_CONTAINER_CREDENTIALS_ENDPOINT + os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, credentialsUri, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	authToken := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if authTokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); authTokenFile != "" {
+		authTokenBytes, err := os.ReadFile(authTokenFile)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("error reading the container authorization token file: %w", err)
+		}
+		authToken = strings.TrimSpace(string(authTokenBytes))
+	}
+	if authToken != "" {
+		req.Header.Set("Authorization", authToken)
+	}
+	respBody, err := doCredentialsRequest(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error getting the container credentials: %w", err)
+	}
+	return parseAwsCredentialsJson(respBody, "container")
+}
+
+// Returns the instance role credentials from the instance metadata
+// service, using an IMDSv2 session token
+func getAwsInstanceCredentials(ctx context.Context) (awsCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, AWS_IMDS_TIMEOUT)
+	defer cancel()
+
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, AWS_IMDS_ENDPOINT+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := doCredentialsRequest(tokenReq)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf(
+			"no AWS credentials found in the environment, web identity, or container credentials, "+
+				"and the instance metadata service is not available: %w", err)
+	}
+
+	getMetadata := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, AWS_IMDS_ENDPOINT+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return doCredentialsRequest(req)
+	}
+	roleName, err := getMetadata("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error getting the instance role: %w", err)
+	}
+	respBody, err := getMetadata("/latest/meta-data/iam/security-credentials/" + strings.TrimSpace(string(roleName)))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error getting the instance role credentials: %w", err)
+	}
+	return parseAwsCredentialsJson(respBody, "instance role")
+}
+
+// Parses the JSON credentials returned by the container credentials
+// endpoint and the instance metadata service
+func parseAwsCredentialsJson(respBody []byte, source string) (awsCredentials, error) {
+	response := struct {
+		AccessKeyId     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+	}{}
+	err := json.Unmarshal(respBody, &response)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error parsing the %s credentials: %w", source, err)
+	}
+	return awsCredentials{
+		accessKeyId:     response.AccessKeyId,
+		secretAccessKey: response.SecretAccessKey,
+		sessionToken:    response.Token,
+		source:          source,
+	}, nil
+}
+
+// Signs the request with AWS Signature Version 4. Only requests without a
+// query string are supported, which covers the JSON APIs
+// See https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+func signAwsRequest(req *http.Request, body []byte, creds awsCredentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", amzDate[:8], region, service)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	slices.Sort(headerNames)
+	canonicalHeaders := ""
+	for _, name := range headerNames {
+		canonicalHeaders += fmt.Sprintf("%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		signingKey = hmacSha256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+	req.Header.Set(
+		"Authorization",
+		fmt.Sprintf(
+			"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+			creds.accessKeyId,
+			scope,
+			signedHeaders,
+			signature,
+		))
+}
+
+// Returns the HMAC-SHA256 of the data with the key
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
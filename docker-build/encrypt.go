@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default skopeo path, which is resolved with the PATH
+	DEFAULT_SKOPEO_PATH = "skopeo"
+	// The environment variable of the ocicrypt key provider config, which
+	// configures the KMS key providers
+	OCICRYPT_KEYPROVIDER_CONFIG_ENV = "OCICRYPT_KEYPROVIDER_CONFIG"
+)
+
+// The ocicrypt key protocols that skopeo supports for encryption. The
+// provider protocol wraps the layer keys with a key provider, such as a
+// KMS key provider
+var encryptKeyProtocols = []string{"jwe", "pkcs7", "pgp", "provider"}
+
+// The options for encrypting the image layers before the push, so the
+// layers cannot be read without the private key (e.g. by the registry
+// admins). The layers are encrypted with ocicrypt by skopeo
+// See https://github.com/containers/ocicrypt
+type encryptOptions struct {
+	// The ocicrypt recipients that can decrypt the layers (e.g.
+	// jwe:/keys/public.pem, or provider:aws-kms for a KMS key provider)
+	keys []string
+	// The indexes of the layers to encrypt. Negative indexes count from
+	// the last layer. Defaults to all of the layers
+	layers []int
+	// The ocicrypt key provider config, for the provider keys
+	keyProviderConfig string
+	skopeoPath        string
+}
+
+func configureEncryptFlags(flags *pflag.FlagSet) {
+	flags.StringArray(
+		"encrypt-key",
+		nil,
+		fmt.Sprintf(
+			"An ocicrypt recipient to encrypt the image layers for before the push, in the format <protocol>:<key>. "+
+				"The protocol is one of %s (e.g. jwe:/keys/public.pem, or provider:aws-kms for a KMS key provider). "+
+				"Can be repeated",
+			encryptKeyProtocols))
+	flags.IntSlice(
+		"encrypt-layer",
+		nil,
+		"The index of an image layer to encrypt. Negative indexes count from the last layer (e.g. -1). "+
+			"Defaults to all of the layers. Can be repeated")
+	flags.String(
+		"encrypt-keyprovider-config",
+		"",
+		fmt.Sprintf(
+			"The path to the ocicrypt key provider config, which configures the KMS key providers. "+
+				"Defaults to the %s environment variable",
+			OCICRYPT_KEYPROVIDER_CONFIG_ENV))
+	flags.String("skopeo-path", DEFAULT_SKOPEO_PATH, "The path to the skopeo executable")
+}
+
+func getEncryptOptions(flags *pflag.FlagSet, cmdName string) (encryptOptions, error) {
+	var opts encryptOptions
+	var err error
+
+	opts.keys, err = flags.GetStringArray("encrypt-key")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s encrypt-key flag", cmdName)
+	}
+	for _, key := range opts.keys {
+		protocol, value, found := strings.Cut(key, ":")
+		if !found || value == "" || !slices.Contains(encryptKeyProtocols, protocol) {
+			return opts, fmt.Errorf(
+				"encrypt-key must be in the format <protocol>:<key> with a protocol of %s: %s",
+				encryptKeyProtocols,
+				key)
+		}
+	}
+
+	opts.layers, err = flags.GetIntSlice("encrypt-layer")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s encrypt-layer flag", cmdName)
+	}
+	if len(opts.layers) > 0 && len(opts.keys) == 0 {
+		return opts, fmt.Errorf("encrypt-key must be set with encrypt-layer")
+	}
+
+	opts.keyProviderConfig, err = flags.GetString("encrypt-keyprovider-config")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s encrypt-keyprovider-config flag", cmdName)
+	}
+
+	opts.skopeoPath, err = flags.GetString("skopeo-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s skopeo-path flag", cmdName)
+	}
+	return opts, nil
+}
+
+func (opts encryptOptions) logAttrs() []any {
+	return []any{
+		"encryptKeys", opts.keys,
+		"encryptLayers", opts.layers,
+		"encryptKeyproviderConfig", opts.keyProviderConfig,
+		"skopeoPath", opts.skopeoPath,
+	}
+}
+
+// Returns whether the image layers are encrypted
+func (opts encryptOptions) enabled() bool {
+	return len(opts.keys) > 0
+}
+
+// Returns the skopeo args to push the image tarball to the destination
+// with the layers encrypted, if enabled
+func (opts encryptOptions) args(
+	tarPath string,
+	destination string,
+	digestFile string,
+	authFile string,
+	registry registryOptions,
+) []string {
+	args := []string{"copy"}
+	for _, key := range opts.keys {
+		args = append(args, fmt.Sprintf("--encryption-key=%s", key))
+	}
+	for _, layer := range opts.layers {
+		args = append(args, fmt.Sprintf("--encrypt-layer=%d", layer))
+	}
+	args = append(args, fmt.Sprintf("--digestfile=%s", digestFile))
+	if authFile != "" {
+		args = append(args, fmt.Sprintf("--dest-authfile=%s", authFile))
+	}
+	if registry.skipTlsVerify || slices.Contains(registry.insecureRegistries, getRegistryHost(destination)) {
+		args = append(args, "--dest-tls-verify=false")
+	}
+	if registry.pushRetry != 0 {
+		args = append(args, fmt.Sprintf("--retry-times=%d", registry.pushRetry))
+	}
+	return append(args, fmt.Sprintf("docker-archive:%s", tarPath), fmt.Sprintf("docker://%s", destination))
+}
+
+// Pushes the image tarball to the destinations, with the layers encrypted
+// if enabled, and returns the digest. The layer keys are random on each
+// encryption, so the image is pushed once to the first destination, and
+// copied to the others by its manifest, so each destination has the same
+// digest
+func (opts encryptOptions) push(
+	ctx context.Context,
+	tarPath string,
+	destinations []string,
+	registry registryOptions,
+) (string, error) {
+	digestFile, err := os.CreateTemp("", "docker-build-push-digest-")
+	if err != nil {
+		return "", fmt.Errorf("error creating the pushed image digest file: %s", err)
+	}
+	digestFile.Close()
+	defer os.Remove(digestFile.Name())
+
+	// The credentials are read from the docker config, which is where the
+	// builders read them from
+	authFile, err := getDockerConfigFile()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(authFile); err != nil {
+		authFile = ""
+	}
+
+	args := opts.args(tarPath, destinations[0], digestFile.Name(), authFile, registry)
+	slog.Info("Pushing image tarball", "image", destinations[0], "encrypted", opts.enabled(), "args", args)
+
+	skopeoCmd := exec.CommandContext(ctx, opts.skopeoPath, args...)
+	skopeoCmd.Stdout = os.Stdout
+	skopeoCmd.Stderr = os.Stderr
+	if opts.keyProviderConfig != "" {
+		skopeoCmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", OCICRYPT_KEYPROVIDER_CONFIG_ENV, opts.keyProviderConfig))
+	}
+	err = skopeoCmd.Run()
+	if err != nil {
+		if stoppedErr := getStoppedError(ctx, "skopeo"); stoppedErr != nil {
+			return "", stoppedErr
+		}
+		if notFoundErr := getToolNotFoundError(err, "skopeo", opts.skopeoPath); notFoundErr != nil {
+			return "", notFoundErr
+		}
+		return "", newStepError(PUSH_ERROR, fmt.Errorf("error pushing the image tarball to %s: %w", destinations[0], err))
+	}
+	digest := readDigestFile(digestFile.Name())
+	if digest == "" {
+		return "", newStepError(PUSH_ERROR, fmt.Errorf("the digest of the pushed image %s is unknown", destinations[0]))
+	}
+	slog.Info("Pushed image tarball", "image", destinations[0], "digest", digest)
+
+	ref, err := parseImageReference(destinations[0], registry.insecureRegistries)
+	if err != nil {
+		return "", err
+	}
+	srcRef := ref.Context().Digest(digest)
+	for _, destination := range destinations[1:] {
+		dstRef, err := parseImageReference(destination, registry.insecureRegistries)
+		if err != nil {
+			return "", err
+		}
+		_, err = copyImage(ctx, srcRef, dstRef, registry.skipTlsVerify, false)
+		if err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// The class of a docker-build failure. Each class maps to a distinct exit
+// code and is written to the result file, so orchestrators can implement
+// retry policies per failure class
+type errorClass string
+
+const (
+	// An unexpected runtime failure without a more specific class, such as
+	// an IO or git error
+	INTERNAL_ERROR errorClass = "InternalError"
+	// Invalid flags or configuration. Retrying will not help
+	FLAG_ERROR errorClass = "FlagError"
+	// The status file could not be checked
+	SKIP_CHECK_ERROR errorClass = "SkipCheckError"
+	// The dockerfile failed the lint checks
+	LINT_ERROR errorClass = "LintError"
+	// The image build failed
+	BUILD_ERROR errorClass = "BuildError"
+	// The image was built, but could not be pushed to the registry
+	PUSH_ERROR errorClass = "PushError"
+	// The build exceeded the timeout
+	TIMEOUT_ERROR errorClass = "TimeoutError"
+	// The build was cancelled by a signal
+	CANCELLED_ERROR errorClass = "CancelledError"
+	// The cache or the image repo could not be pruned
+	PRUNE_ERROR errorClass = "PruneError"
+	// The registry login or the repo setup before the push failed
+	REGISTRY_AUTH_ERROR errorClass = "RegistryAuthError"
+	// The registry rate limited the builder, even after the retries
+	RATE_LIMIT_ERROR errorClass = "RateLimitError"
+	// The registry was unreachable or unauthorized in the preflight check,
+	// before the build started, or when resolving an image digest
+	REGISTRY_PREFLIGHT_ERROR errorClass = "RegistryPreflightError"
+	// The base images of the dockerfile are stale compared to the upstream
+	// tags
+	STALE_BASE_IMAGE_ERROR errorClass = "StaleBaseImageError"
+	// The image was pushed, but could not be signed
+	SIGN_ERROR errorClass = "SignError"
+	// The image was built, but its SBOM could not be generated or attached
+	SBOM_ERROR errorClass = "SbomError"
+	// The image has vulnerabilities that meet the scan severity threshold,
+	// or could not be scanned
+	VULNERABILITY_ERROR errorClass = "VulnerabilityError"
+	// The dockerfile or the build spec violates the policies, or the
+	// policies could not be evaluated
+	POLICY_ERROR errorClass = "PolicyError"
+	// The image has packages with denied licenses, or its licenses could
+	// not be scanned
+	LICENSE_ERROR errorClass = "LicenseError"
+	// A base image of the dockerfile is unsigned or untrusted by the
+	// verification trust policy
+	UNTRUSTED_BASE_IMAGE_ERROR errorClass = "UntrustedBaseImageError"
+	// The image failed the checks of the verification policy
+	IMAGE_VERIFICATION_ERROR errorClass = "ImageVerificationError"
+	// The built image runs as root, or its user could not be checked
+	ROOT_USER_ERROR errorClass = "RootUserError"
+	// The image tag already exists, and the build must not overwrite it
+	TAG_EXISTS_ERROR errorClass = "TagExistsError"
+	// An external tool, such as the vulnerability scanner, was not found at
+	// its path. The image or the tool path flag is misconfigured, so
+	// retrying will not help
+	TOOL_NOT_FOUND_ERROR errorClass = "ToolNotFoundError"
+)
+
+// The exit code for each error class
+var errorClassExitCodes = map[errorClass]int{
+	INTERNAL_ERROR:             1,
+	FLAG_ERROR:                 2,
+	SKIP_CHECK_ERROR:           3,
+	BUILD_ERROR:                4,
+	PUSH_ERROR:                 5,
+	LINT_ERROR:                 6,
+	PRUNE_ERROR:                7,
+	REGISTRY_AUTH_ERROR:        8,
+	RATE_LIMIT_ERROR:           9,
+	REGISTRY_PREFLIGHT_ERROR:   10,
+	STALE_BASE_IMAGE_ERROR:     11,
+	SIGN_ERROR:                 12,
+	SBOM_ERROR:                 13,
+	VULNERABILITY_ERROR:        14,
+	POLICY_ERROR:               15,
+	LICENSE_ERROR:              16,
+	UNTRUSTED_BASE_IMAGE_ERROR: 17,
+	IMAGE_VERIFICATION_ERROR:   18,
+	ROOT_USER_ERROR:            19,
+	TAG_EXISTS_ERROR:           20,
+	TOOL_NOT_FOUND_ERROR:       21,
+	TIMEOUT_ERROR:              TIMEOUT_EXIT_CODE,
+	CANCELLED_ERROR:            CANCELLED_EXIT_CODE,
+}
+
+// An error with an error class
+type stepError struct {
+	class errorClass
+	err   error
+}
+
+func newStepError(class errorClass, err error) error {
+	return &stepError{class: class, err: err}
+}
+
+func (e *stepError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.err
+}
+
+// Returns the class of the error, or an empty class if the error
+// is not classified
+func getErrorClass(err error) errorClass {
+	var stepErr *stepError
+	if errors.As(err, &stepErr) {
+		return stepErr.class
+	}
+	return ""
+}
+
+// Returns the error with the class, unless the error is already classified
+func withDefaultClass(class errorClass, err error) error {
+	if getErrorClass(err) != "" {
+		return err
+	}
+	return newStepError(class, err)
+}
+
+// Returns the exit code for the error
+func getExitCode(err error) int {
+	exitCode, found := errorClassExitCodes[getErrorClass(err)]
+	if !found {
+		return 1
+	}
+	return exitCode
+}
+
+// Wraps a command handler so that any errors not classified by the
+// handler are classified. The handlers silence the usage once the flags
+// are validated, so the errors before that are flag errors, and the errors
+// after are internal errors
+func withErrorClasses(
+	handler func(cmd *cobra.Command, args []string) error,
+) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		err := handler(cmd, args)
+		if err == nil {
+			return nil
+		}
+		if cmd.SilenceUsage {
+			return withDefaultClass(INTERNAL_ERROR, err)
+		}
+		return withDefaultClass(FLAG_ERROR, err)
+	}
+}
+
+// Error returned when the builder (e.g. kaniko) exits with a nonzero exit code
+type kanikoExitError struct {
+	builder  string
+	exitCode int
+}
+
+func (e *kanikoExitError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", e.builder, e.exitCode)
+}
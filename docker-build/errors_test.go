@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestWithErrorClasses(t *testing.T) {
+	tests := []struct {
+		name         string
+		silenceUsage bool
+		err          error
+		wantClass    errorClass
+		wantExitCode int
+	}{
+		{name: "no error", err: nil, wantClass: "", wantExitCode: 1},
+		{name: "flag error", err: fmt.Errorf("bad flag"), wantClass: FLAG_ERROR, wantExitCode: 2},
+		{name: "internal error", silenceUsage: true, err: fmt.Errorf("io error"), wantClass: INTERNAL_ERROR, wantExitCode: 1},
+		{
+			name:         "classified error",
+			silenceUsage: true,
+			err:          newStepError(PUSH_ERROR, fmt.Errorf("push error")),
+			wantClass:    PUSH_ERROR,
+			wantExitCode: 5,
+		},
+		{
+			name:         "classified error before the flags are validated",
+			err:          newStepError(SKIP_CHECK_ERROR, fmt.Errorf("status file error")),
+			wantClass:    SKIP_CHECK_ERROR,
+			wantExitCode: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := withErrorClasses(func(cmd *cobra.Command, args []string) error {
+				cmd.SilenceUsage = tt.silenceUsage
+				return tt.err
+			})
+			err := handler(&cobra.Command{}, nil)
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("got error %s, want nil", err)
+				}
+				return
+			}
+			if class := getErrorClass(err); class != tt.wantClass {
+				t.Errorf("got class %q, want %q", class, tt.wantClass)
+			}
+			if exitCode := getExitCode(err); exitCode != tt.wantExitCode {
+				t.Errorf("got exit code %d, want %d", exitCode, tt.wantExitCode)
+			}
+		})
+	}
+}
+
+func TestNewBuildResultDefaultsToInternalError(t *testing.T) {
+	result := newBuildResult(buildOutcome{err: fmt.Errorf("io error")})
+	if result.Status != FAILED_STATUS || result.Error != INTERNAL_ERROR {
+		t.Errorf("got status %q and class %q, want %q and %q", result.Status, result.Error, FAILED_STATUS, INTERNAL_ERROR)
+	}
+}
+
+func TestGetToolNotFoundError(t *testing.T) {
+	missingPath := filepath.Join(t.TempDir(), "trivy")
+	tests := []struct {
+		name      string
+		toolPath  string
+		wantClass errorClass
+	}{
+		{name: "missing path", toolPath: missingPath, wantClass: TOOL_NOT_FOUND_ERROR},
+		{name: "missing name", toolPath: "docker-build-missing-tool", wantClass: TOOL_NOT_FOUND_ERROR},
+		{name: "failed tool", toolPath: "false", wantClass: VULNERABILITY_ERROR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runTrivy(context.Background(), tt.toolPath, nil, "app:latest", "", false, VULNERABILITY_ERROR)
+			if getErrorClass(err) != tt.wantClass {
+				t.Errorf("runTrivy() error class = %q, want %q: %v", getErrorClass(err), tt.wantClass, err)
+			}
+		})
+	}
+}
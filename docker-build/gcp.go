@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+)
+
+const (
+	// The GKE metadata server, which serves the Workload Identity tokens
+	// See https://cloud.google.com/kubernetes-engine/docs/concepts/workload-identity#metadata_server
+	GCP_METADATA_HOST = "metadata.google.internal"
+	// Environment variable overriding the metadata server host, as in the
+	// Google Cloud client libraries
+	GCP_METADATA_HOST_ENV = "GCE_METADATA_HOST"
+	// The username for the access token in the docker config
+	// See https://cloud.google.com/artifact-registry/docs/docker/authentication#token
+	GCP_ACCESS_TOKEN_USERNAME = "oauth2accesstoken"
+)
+
+// Matches an Artifact Registry or Container Registry host
+var gcpRegistryRegexp = regexp.MustCompile(`^([a-z0-9-]+-docker\.pkg\.dev|([a-z]+\.)?gcr\.io)$`)
+
+// Returns the username and password for the Artifact Registry host, with an
+// access token of the Workload Identity service account from the metadata
+// server. The token is valid for about an hour
+func getGcpCredentials(ctx context.Context, host string) (string, string, error) {
+	if !gcpRegistryRegexp.MatchString(host) {
+		return "", "", fmt.Errorf("not an Artifact Registry host (e.g. us-docker.pkg.dev): %s", host)
+	}
+
+	metadataHost := os.Getenv(GCP_METADATA_HOST_ENV)
+	if metadataHost == "" {
+		metadataHost = GCP_METADATA_HOST
+	}
+	tokenUrl := fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/default/token", metadataHost)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenUrl, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	respBody, err := doCredentialsRequest(req)
+	if err != nil {
+		return "", "", fmt.Errorf("error getting the Workload Identity access token from the metadata server: %w", err)
+	}
+
+	response := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.Unmarshal(respBody, &response)
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing the metadata server token: %w", err)
+	}
+	if response.AccessToken == "" {
+		return "", "", errors.New("the metadata server returned no access token")
+	}
+	return GCP_ACCESS_TOKEN_USERNAME, response.AccessToken, nil
+}
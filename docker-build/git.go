@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+)
+
+// The git binary is not available in the kaniko image, so the
+// metadata of the cloned repo is read directly from the .git dir
+
+// Returns the path to the .git dir of the clone path. Handles the
+// case where .git is a file pointing to the actual git dir
+func getGitDir(clonePath string) (string, error) {
+	gitPath := filepath.Join(clonePath, ".git")
+	info, err := os.Stat(gitPath)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return gitPath, nil
+	}
+
+	bytes, err := os.ReadFile(gitPath)
+	if err != nil {
+		return "", err
+	}
+	gitDir, found := strings.CutPrefix(strings.TrimSpace(string(bytes)), "gitdir:")
+	if !found {
+		return "", fmt.Errorf("unexpected .git file content in %s", gitPath)
+	}
+	gitDir = strings.TrimSpace(gitDir)
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(clonePath, gitDir)
+	}
+	return gitDir, nil
+}
+
+// Returns the url of the origin remote in the cloned repo. Any
+// credentials in the url are removed
+func getGitOriginUrl(clonePath string) (string, error) {
+	gitDir, err := getGitDir(clonePath)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(filepath.Join(gitDir, "config"))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	inOrigin := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inOrigin = line == `[remote "origin"]`
+			continue
+		}
+		if !inOrigin {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if found && strings.TrimSpace(key) == "url" {
+			return gitrepo.RedactUrlCredentials(strings.TrimSpace(value)), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no origin remote url found in %s", gitDir)
+}
+
+// Returns the commit hash that HEAD points to in the cloned repo
+func getGitHeadHash(clonePath string) (string, error) {
+	gitDir, err := getGitDir(clonePath)
+	if err != nil {
+		return "", err
+	}
+
+	bytes, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	head := strings.TrimSpace(string(bytes))
+	ref, found := strings.CutPrefix(head, "ref:")
+	if !found {
+		return head, nil
+	}
+	return resolveGitRef(gitDir, strings.TrimSpace(ref))
+}
+
+// Resolves a ref (e.g. refs/heads/main) to a commit hash using either
+// the loose ref files or the packed-refs file
+func resolveGitRef(gitDir string, ref string) (string, error) {
+	bytes, err := os.ReadFile(filepath.Join(gitDir, ref))
+	if err == nil {
+		return strings.TrimSpace(string(bytes)), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	packedRefs, err := readGitPackedRefs(gitDir)
+	if err != nil {
+		return "", err
+	}
+	hash, found := packedRefs[ref]
+	if !found {
+		return "", fmt.Errorf("ref not found: %s", ref)
+	}
+	return hash, nil
+}
+
+// Returns a map of ref name to commit hash from the packed-refs file.
+// For annotated tags, the peeled commit hash is used
+func readGitPackedRefs(gitDir string) (map[string]string, error) {
+	packedRefs := map[string]string{}
+
+	file, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return packedRefs, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	lastRef := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if peeled, found := strings.CutPrefix(line, "^"); found {
+			if lastRef != "" {
+				packedRefs[lastRef] = peeled
+			}
+			continue
+		}
+		hash, ref, found := strings.Cut(line, " ")
+		if !found {
+			continue
+		}
+		packedRefs[ref] = hash
+		lastRef = ref
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return packedRefs, nil
+}
+
+// Returns the names of the tags in the cloned repo that point to the
+// given commit hash. Annotated tags are peeled when the tag object is
+// available as a loose object or in the packed-refs file
+func getGitTags(clonePath string, commitHash string) ([]string, error) {
+	gitDir, err := getGitDir(clonePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tagHashes, err := readGitPackedRefs(gitDir)
+	if err != nil {
+		return nil, err
+	}
+
+	tagsDir := filepath.Join(gitDir, "refs", "tags")
+	err = filepath.WalkDir(tagsDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		ref, err := filepath.Rel(gitDir, path)
+		if err != nil {
+			return err
+		}
+		tagHashes[filepath.ToSlash(ref)] = peelGitTag(gitDir, strings.TrimSpace(string(bytes)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []string{}
+	for ref, hash := range tagHashes {
+		tag, found := strings.CutPrefix(ref, "refs/tags/")
+		if found && hash == commitHash {
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+	return tags, nil
+}
+
+// Returns the commit hash that an annotated tag object points to. If
+// the hash is not a loose tag object, it is returned unchanged
+func peelGitTag(gitDir string, hash string) string {
+	if len(hash) < 3 {
+		return hash
+	}
+	file, err := os.Open(filepath.Join(gitDir, "objects", hash[:2], hash[2:]))
+	if err != nil {
+		return hash
+	}
+	defer file.Close()
+
+	reader, err := zlib.NewReader(file)
+	if err != nil {
+		return hash
+	}
+	defer reader.Close()
+
+	// The object header is "tag <size>\x00" followed by the
+	// "object <hash>" line for annotated tags
+	object, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil {
+		return hash
+	}
+	object, found := strings.CutPrefix(object, "tag ")
+	if !found {
+		return hash
+	}
+	_, object, found = strings.Cut(object, "\x00")
+	if !found {
+		return hash
+	}
+	peeled, found := strings.CutPrefix(strings.TrimSpace(object), "object ")
+	if !found {
+		return hash
+	}
+	return peeled
+}
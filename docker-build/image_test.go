@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+// Returns the paths that the COPY instructions of the stage add to the
+// image. The stage is the last one if the name is empty
+func getStageCopyPaths(t *testing.T, stageName string) map[string]bool {
+	t.Helper()
+	instructions, err := readDockerfile("Dockerfile")
+	if err != nil {
+		t.Fatalf("error reading the Dockerfile: %s", err)
+	}
+	stageStart := -1
+	stageEnd := len(instructions)
+	for i, inst := range instructions {
+		if inst.cmd != "FROM" {
+			continue
+		}
+		if stageStart >= 0 && stageName != "" {
+			stageEnd = i
+			break
+		}
+		stages := getBuildStages([]instruction{inst})
+		if stageName == "" || stages[0].name == stageName {
+			stageStart = i
+		}
+	}
+	if stageStart < 0 {
+		t.Fatalf("the Dockerfile has no %s stage", stageName)
+	}
+
+	copyPaths := map[string]bool{}
+	for _, inst := range instructions[stageStart+1 : stageEnd] {
+		if inst.cmd != "COPY" {
+			continue
+		}
+		fields := strings.Fields(inst.args)
+		copyPaths[fields[len(fields)-1]] = true
+	}
+	return copyPaths
+}
+
+// Returns the path that the tool path resolves to in the image, where the
+// bare names are looked up in /kaniko, which is on the PATH of the kaniko
+// executor image
+func getImageToolPath(toolPath string) string {
+	if path.IsAbs(toolPath) {
+		return toolPath
+	}
+	return path.Join("/kaniko", toolPath)
+}
+
+func TestDefaultToolPathsResolveInImage(t *testing.T) {
+	// The executor is part of the kaniko executor base image
+	baseImagePaths := map[string]bool{DEFAULT_KANIKO_PATH: true}
+	copyPaths := getStageCopyPaths(t, "")
+
+	tests := []struct {
+		tool        string
+		defaultPath string
+	}{
+		{tool: "kaniko", defaultPath: DEFAULT_KANIKO_PATH},
+		{tool: "buildctl", defaultPath: DEFAULT_BUILDCTL_PATH},
+		{tool: "warmer", defaultPath: DEFAULT_WARMER_PATH},
+		{tool: "cosign", defaultPath: DEFAULT_COSIGN_PATH},
+		{tool: "syft", defaultPath: DEFAULT_SYFT_PATH},
+		{tool: "trivy", defaultPath: DEFAULT_TRIVY_PATH},
+		{tool: "opa", defaultPath: DEFAULT_OPA_PATH},
+		{tool: "skopeo", defaultPath: DEFAULT_SKOPEO_PATH},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tool, func(t *testing.T) {
+			imagePath := getImageToolPath(tt.defaultPath)
+			if !copyPaths[imagePath] && !baseImagePaths[imagePath] {
+				t.Errorf("the default %s path %s is not in the image at %s", tt.tool, tt.defaultPath, imagePath)
+			}
+		})
+	}
+}
+
+func TestBuildahImage(t *testing.T) {
+	copyPaths := getStageCopyPaths(t, "buildah")
+	if !copyPaths["/usr/local/bin/docker-build"] {
+		t.Errorf("the buildah image has no docker-build on the PATH")
+	}
+	// buildah is on the PATH of the buildah image
+	if path.IsAbs(DEFAULT_BUILDAH_PATH) {
+		t.Errorf("the default buildah path %s is not looked up on the PATH", DEFAULT_BUILDAH_PATH)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+// The inspect report of an image
+type imageInspection struct {
+	Image            string            `json:"image"`
+	Digest           string            `json:"digest"`
+	MediaType        string            `json:"mediaType"`
+	Platform         string            `json:"platform,omitempty"`
+	Created          time.Time         `json:"created"`
+	Labels           map[string]string `json:"labels"`
+	Entrypoint       []string          `json:"entrypoint"`
+	Cmd              []string          `json:"cmd"`
+	WorkingDir       string            `json:"workingDir,omitempty"`
+	User             string            `json:"user,omitempty"`
+	Layers           []layerInspection `json:"layers"`
+	CompressedSize   int64             `json:"compressedSize"`
+	UncompressedSize int64             `json:"uncompressedSize,omitempty"`
+}
+
+// A layer of an inspected image
+type layerInspection struct {
+	Digest           string `json:"digest"`
+	MediaType        string `json:"mediaType"`
+	CompressedSize   int64  `json:"compressedSize"`
+	UncompressedSize int64  `json:"uncompressedSize,omitempty"`
+	// The dockerfile instruction that created the layer, from the image
+	// config history
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+func handleInspectCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	inspectFlags := cmd.Flags()
+
+	image := args[0]
+
+	platform, err := inspectFlags.GetString("platform")
+	if err != nil {
+		return fmt.Errorf("error processing inspect platform flag")
+	}
+
+	uncompressedSize, err := inspectFlags.GetBool("uncompressed-size")
+	if err != nil {
+		return fmt.Errorf("error processing inspect uncompressed-size flag")
+	}
+
+	outputFile, err := inspectFlags.GetString("output-file")
+	if err != nil {
+		return fmt.Errorf("error processing inspect output-file flag")
+	}
+
+	insecureRegistries, err := inspectFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing inspect insecure-registry flag")
+	}
+
+	skipTlsVerify, err := inspectFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing inspect skip-tls-verify flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(inspectFlags, "inspect")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"image", image,
+		"platform", platform,
+		"uncompressedSize", uncompressedSize,
+		"outputFile", outputFile,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+	}
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("Inspect with params", params...)
+
+	ref, err := parseImageReference(image, insecureRegistries)
+	if err != nil {
+		return fmt.Errorf("image is not a valid image reference: %s", err)
+	}
+	remoteOpts := []remote.Option{}
+	if platform != "" {
+		parsedPlatform, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return fmt.Errorf("platform is not a valid platform: %s", err)
+		}
+		remoteOpts = append(remoteOpts, remote.WithPlatform(*parsedPlatform))
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	err = registryAuthOpts.login(ctx, ref.Context().RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	// For an image index, the image of the platform is inspected
+	remoteOpts = append(remoteOpts, getRemoteOptions(ctx, skipTlsVerify)...)
+	img, err := remote.Image(ref, remoteOpts...)
+	if err != nil {
+		return fmt.Errorf("error reading the image %s: %w", ref, err)
+	}
+	inspection, err := inspectImage(img, uncompressedSize)
+	if err != nil {
+		return fmt.Errorf("error inspecting the image %s: %w", ref, err)
+	}
+	inspection.Image = ref.String()
+
+	bytes, err := json.MarshalIndent(inspection, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding the inspect report: %s", err)
+	}
+	if outputFile != "" {
+		err = os.WriteFile(outputFile, append(bytes, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing the inspect output file: %s", err)
+		}
+		slog.Info("Wrote the inspect output file", "outputFile", outputFile)
+		return nil
+	}
+	_, err = fmt.Fprintln(cmd.OutOrStdout(), string(bytes))
+	return err
+}
+
+// Returns the inspect report of the image. The uncompressed sizes require
+// reading the layers, so they are only computed if set
+func inspectImage(img v1.Image, uncompressedSize bool) (imageInspection, error) {
+	inspection := imageInspection{}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return inspection, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return inspection, err
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return inspection, err
+	}
+	layers, err := getLayerInspections(img, configFile, uncompressedSize)
+	if err != nil {
+		return inspection, err
+	}
+
+	inspection = imageInspection{
+		Digest:     digest.String(),
+		MediaType:  string(mediaType),
+		Created:    configFile.Created.Time,
+		Labels:     configFile.Config.Labels,
+		Entrypoint: configFile.Config.Entrypoint,
+		Cmd:        configFile.Config.Cmd,
+		WorkingDir: configFile.Config.WorkingDir,
+		User:       configFile.Config.User,
+		Layers:     layers,
+	}
+	if configFile.OS != "" {
+		inspection.Platform = configFile.Platform().String()
+	}
+	for _, layer := range layers {
+		inspection.CompressedSize += layer.CompressedSize
+		inspection.UncompressedSize += layer.UncompressedSize
+	}
+	return inspection, nil
+}
+
+// Returns the layers of the image, with the dockerfile instruction that
+// created each layer. The history entries of the instructions without a
+// layer (e.g. ENV) are skipped, so the remaining entries match the layers
+func getLayerInspections(img v1.Image, configFile *v1.ConfigFile, uncompressedSize bool) ([]layerInspection, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	createdBy := []string{}
+	for _, history := range configFile.History {
+		if !history.EmptyLayer {
+			createdBy = append(createdBy, history.CreatedBy)
+		}
+	}
+
+	inspections := []layerInspection{}
+	for i, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+		inspection := layerInspection{
+			Digest:         digest.String(),
+			MediaType:      string(mediaType),
+			CompressedSize: size,
+		}
+		if len(createdBy) == len(layers) {
+			inspection.CreatedBy = createdBy[i]
+		}
+		if uncompressedSize {
+			inspection.UncompressedSize, err = getUncompressedSize(layer)
+			if err != nil {
+				return nil, fmt.Errorf("error reading layer %s: %w", digest, err)
+			}
+		}
+		inspections = append(inspections, inspection)
+	}
+	return inspections, nil
+}
+
+// Returns the uncompressed size of the layer, which is not in the manifest,
+// by reading the layer
+func getUncompressedSize(layer v1.Layer) (int64, error) {
+	reader, err := layer.Uncompressed()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return io.Copy(io.Discard, reader)
+}
+
+// The layer report of a built image, for finding the dockerfile
+// instructions that add the most to the image size
+type layerReport struct {
+	Image          string            `json:"image"`
+	Digest         string            `json:"digest"`
+	LayerCount     int               `json:"layerCount"`
+	CompressedSize int64             `json:"compressedSize"`
+	Layers         []layerInspection `json:"layers"`
+}
+
+// Returns a post build hook that writes the layer report of the pushed
+// image to the layer report file. The layer sizes are the compressed sizes
+// from the manifest, so the layers are not downloaded. For an image index,
+// the first image is reported
+func writeLayerReportHook(
+	layerReportFile string,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) postBuildHook {
+	return func(outcome *buildOutcome) error {
+		if layerReportFile == "" || outcome.err != nil || outcome.image == "" {
+			return nil
+		}
+		ref, err := parseImageReference(outcome.image, insecureRegistries)
+		if err != nil {
+			return err
+		}
+		if outcome.digest != "" {
+			ref = ref.Context().Digest(outcome.digest)
+		}
+		desc, err := remote.Get(ref, getRemoteOptions(context.Background(), skipTlsVerify)...)
+		if err != nil {
+			return fmt.Errorf("error reading the image for the layer report: %s", err)
+		}
+		img, err := getDescriptorImage(desc)
+		if err != nil {
+			return fmt.Errorf("error reading the image for the layer report: %s", err)
+		}
+		configFile, err := img.ConfigFile()
+		if err != nil {
+			return fmt.Errorf("error reading the image config for the layer report: %s", err)
+		}
+		layers, err := getLayerInspections(img, configFile, false)
+		if err != nil {
+			return fmt.Errorf("error reading the image layers for the layer report: %s", err)
+		}
+
+		report := layerReport{
+			Image:      outcome.image,
+			Digest:     desc.Digest.String(),
+			LayerCount: len(layers),
+			Layers:     layers,
+		}
+		largestLayer := layerInspection{}
+		for _, layer := range layers {
+			report.CompressedSize += layer.CompressedSize
+			if layer.CompressedSize > largestLayer.CompressedSize {
+				largestLayer = layer
+			}
+		}
+
+		bytes, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding the layer report: %s", err)
+		}
+		err = os.WriteFile(layerReportFile, append(bytes, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing the layer report file: %s", err)
+		}
+		slog.Info(
+			"Wrote layer report file",
+			"layerReportFile", layerReportFile,
+			"layers", report.LayerCount,
+			"compressedSize", report.CompressedSize,
+			"largestLayerSize", largestLayer.CompressedSize,
+			"largestLayerCreatedBy", largestLayer.CreatedBy,
+		)
+		return nil
+	}
+}
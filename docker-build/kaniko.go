@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Options that are passed through to kaniko for both the pr and
+// commit subcommands
+type kanikoOptions struct {
+	cache     bool
+	cacheRepo string
+	cacheTtl  time.Duration
+
+	snapshotMode   string
+	useNewRun      bool
+	singleSnapshot bool
+
+	extraArgs []string
+
+	verbosity string
+
+	platform string
+
+	imageDownloadRetry  int
+	imageFsExtractRetry int
+
+	ignorePaths []string
+}
+
+const (
+	// Default number of retries for transient registry errors
+	DEFAULT_REGISTRY_RETRY = 3
+	// Default number of retries for transient filesystem extract errors
+	DEFAULT_FS_EXTRACT_RETRY = 3
+)
+
+// The snapshot modes supported by kaniko
+var snapshotModes = []string{"full", "redo", "time"}
+
+// The log levels supported by kaniko
+var verbosityLevels = []string{"panic", "fatal", "error", "warn", "info", "debug", "trace"}
+
+// The kaniko args generated by docker-build, which cannot be passed
+// through with the kaniko-arg flag
+var reservedKanikoArgs = []string{
+	"--dockerfile",
+	"-f",
+	"--context",
+	"-c",
+	"--destination",
+	"-d",
+	"--target",
+}
+
+func configureKanikoFlags(flags *pflag.FlagSet) {
+	flags.Bool("cache", false, "Whether to use kaniko layer caching")
+	flags.String(
+		"cache-repo",
+		"",
+		"The repo used to store cached layers. For commits, defaults to <destination>/cache when caching is enabled")
+	flags.Duration("cache-ttl", 0, "The cache timeout (e.g. 168h). Defaults to the kaniko default of two weeks")
+
+	flags.String(
+		"snapshot-mode",
+		"",
+		fmt.Sprintf("The kaniko snapshot mode. One of %s. Defaults to the kaniko default of full", snapshotModes))
+	flags.Bool("use-new-run", false, "Whether to use the experimental kaniko run implementation for detecting changes")
+	flags.Bool(
+		"single-snapshot",
+		false,
+		"Whether to take a single snapshot of the filesystem at the end of the build. Speeds up images with few layers")
+
+	flags.StringArray(
+		"kaniko-arg",
+		nil,
+		"An arg appended verbatim to the kaniko args (e.g. --compressed-caching=false). Can be repeated")
+
+	flags.String(
+		"kaniko-verbosity",
+		"",
+		fmt.Sprintf("The kaniko log level. One of %s. Defaults to the kaniko default of info", verbosityLevels))
+
+	flags.String(
+		"platform",
+		"",
+		"The platform to build the image for in the format os/arch[/variant] (e.g. linux/arm64). "+
+			"Defaults to the platform of the build node")
+
+	flags.Int(
+		"image-download-retry",
+		DEFAULT_REGISTRY_RETRY,
+		"The number of retries for downloading the remote images, so transient registry errors do not fail the build")
+	flags.Int(
+		"image-fs-extract-retry",
+		DEFAULT_FS_EXTRACT_RETRY,
+		"The number of retries for extracting the image filesystem, so transient extract errors do not fail the build")
+
+	flags.StringArray(
+		"ignore-path",
+		nil,
+		"A path to exclude from the kaniko filesystem snapshots (e.g. /app/node_modules). Can be repeated")
+}
+
+func getKanikoOptions(flags *pflag.FlagSet, cmdName string) (kanikoOptions, error) {
+	var opts kanikoOptions
+	var err error
+
+	opts.cache, err = flags.GetBool("cache")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s cache flag", cmdName)
+	}
+
+	opts.cacheRepo, err = flags.GetString("cache-repo")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s cache-repo flag", cmdName)
+	}
+
+	opts.cacheTtl, err = flags.GetDuration("cache-ttl")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s cache-ttl flag", cmdName)
+	}
+
+	opts.snapshotMode, err = flags.GetString("snapshot-mode")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s snapshot-mode flag", cmdName)
+	}
+	if opts.snapshotMode != "" && !slices.Contains(snapshotModes, opts.snapshotMode) {
+		return opts, fmt.Errorf("snapshot-mode must be one of %s: %s", snapshotModes, opts.snapshotMode)
+	}
+
+	opts.useNewRun, err = flags.GetBool("use-new-run")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s use-new-run flag", cmdName)
+	}
+
+	opts.singleSnapshot, err = flags.GetBool("single-snapshot")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s single-snapshot flag", cmdName)
+	}
+
+	opts.extraArgs, err = flags.GetStringArray("kaniko-arg")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s kaniko-arg flag", cmdName)
+	}
+	for _, extraArg := range opts.extraArgs {
+		argName, _, _ := strings.Cut(extraArg, "=")
+		if slices.Contains(reservedKanikoArgs, argName) {
+			return opts, fmt.Errorf("kaniko-arg conflicts with an arg set by docker-build: %s", extraArg)
+		}
+	}
+
+	opts.verbosity, err = flags.GetString("kaniko-verbosity")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s kaniko-verbosity flag", cmdName)
+	}
+	if opts.verbosity != "" && !slices.Contains(verbosityLevels, opts.verbosity) {
+		return opts, fmt.Errorf("kaniko-verbosity must be one of %s: %s", verbosityLevels, opts.verbosity)
+	}
+
+	opts.platform, err = flags.GetString("platform")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s platform flag", cmdName)
+	}
+	if opts.platform != "" {
+		err = validatePlatform(opts.platform)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	opts.imageDownloadRetry, err = flags.GetInt("image-download-retry")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s image-download-retry flag", cmdName)
+	}
+	if opts.imageDownloadRetry < 0 {
+		return opts, fmt.Errorf("image-download-retry must not be negative: %d", opts.imageDownloadRetry)
+	}
+
+	opts.imageFsExtractRetry, err = flags.GetInt("image-fs-extract-retry")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s image-fs-extract-retry flag", cmdName)
+	}
+	if opts.imageFsExtractRetry < 0 {
+		return opts, fmt.Errorf("image-fs-extract-retry must not be negative: %d", opts.imageFsExtractRetry)
+	}
+
+	opts.ignorePaths, err = flags.GetStringArray("ignore-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s ignore-path flag", cmdName)
+	}
+
+	return opts, nil
+}
+
+// Returns the log attributes for the pass through options
+func (opts kanikoOptions) logAttrs() []any {
+	return []any{
+		"cache", opts.cache,
+		"cacheRepo", opts.cacheRepo,
+		"cacheTtl", opts.cacheTtl,
+		"snapshotMode", opts.snapshotMode,
+		"useNewRun", opts.useNewRun,
+		"singleSnapshot", opts.singleSnapshot,
+		"extraArgs", opts.extraArgs,
+		"verbosity", opts.verbosity,
+		"platform", opts.platform,
+		"imageDownloadRetry", opts.imageDownloadRetry,
+		"imageFsExtractRetry", opts.imageFsExtractRetry,
+		"ignorePaths", opts.ignorePaths,
+	}
+}
+
+// Returns the kaniko args for the pass through options
+func (opts kanikoOptions) args() []string {
+	args := []string{}
+	if opts.cache {
+		args = append(args, "--cache=true")
+	}
+	if opts.cacheRepo != "" {
+		args = append(args, fmt.Sprintf("--cache-repo=%s", opts.cacheRepo))
+	}
+	if opts.cacheTtl != 0 {
+		args = append(args, fmt.Sprintf("--cache-ttl=%s", opts.cacheTtl))
+	}
+	if opts.snapshotMode != "" {
+		args = append(args, fmt.Sprintf("--snapshot-mode=%s", opts.snapshotMode))
+	}
+	if opts.useNewRun {
+		args = append(args, "--use-new-run")
+	}
+	if opts.singleSnapshot {
+		args = append(args, "--single-snapshot")
+	}
+	if opts.verbosity != "" {
+		args = append(args, fmt.Sprintf("--verbosity=%s", opts.verbosity))
+	}
+	if opts.platform != "" {
+		args = append(args, fmt.Sprintf("--custom-platform=%s", opts.platform))
+	}
+	if opts.imageDownloadRetry != 0 {
+		args = append(args, fmt.Sprintf("--image-download-retry=%d", opts.imageDownloadRetry))
+	}
+	if opts.imageFsExtractRetry != 0 {
+		args = append(args, fmt.Sprintf("--image-fs-extract-retry=%d", opts.imageFsExtractRetry))
+	}
+	for _, ignorePath := range opts.ignorePaths {
+		args = append(args, fmt.Sprintf("--ignore-path=%s", ignorePath))
+	}
+	args = append(args, opts.extraArgs...)
+	return args
+}
+
+// Returns the kaniko args for the options that only kaniko supports, so
+// the other builders can warn that they are ignored. The retries are
+// excluded, since the other builders retry the transient errors themselves
+func (opts kanikoOptions) kanikoOnlyArgs() []string {
+	opts.cache = false
+	opts.cacheRepo = ""
+	opts.platform = ""
+	opts.imageDownloadRetry = 0
+	opts.imageFsExtractRetry = 0
+	return opts.args()
+}
+
+// Builds the images with the kaniko executor
+type kanikoBuilder struct {
+	commandRunner
+	path string
+}
+
+func (b kanikoBuilder) name() string {
+	return KANIKO_BUILDER
+}
+
+func (b kanikoBuilder) logAttrs() []any {
+	return append([]any{"builder", KANIKO_BUILDER, "kanikoPath", b.path}, b.runnerAttrs()...)
+}
+
+func (b kanikoBuilder) build(ctx context.Context, spec buildSpec) (buildOutput, error) {
+	command, err := b.command(spec)
+	if err != nil {
+		return buildOutput{}, err
+	}
+	return b.run(ctx, command, spec)
+}
+
+// Returns the kaniko executor invocation for the build spec
+// See https://github.com/GoogleContainerTools/kaniko#additional-flags
+func (b kanikoBuilder) command(spec buildSpec) (builderCommand, error) {
+	args := []string{KANIKO_NAME}
+	args = append(args, getKanikoContextArgs(spec.context)...)
+	for _, destination := range spec.destinations {
+		args = append(args, fmt.Sprintf("--destination=%s", destination))
+	}
+	if !spec.push {
+		// The destination of a PR build only names the image in the tarball
+		args = append(args, "--no-push")
+	}
+	if spec.tarPath != "" {
+		args = append(args, fmt.Sprintf("--tar-path=%s", spec.tarPath))
+	}
+	if spec.cleanup {
+		args = append(args, "--cleanup")
+	}
+	if spec.digestFile != "" {
+		args = append(args, fmt.Sprintf("--digest-file=%s", spec.digestFile))
+	}
+	if spec.imageRefFile != "" {
+		args = append(args, fmt.Sprintf("--image-name-tag-with-digest-file=%s", spec.imageRefFile))
+	}
+	for _, buildArg := range spec.buildArgs {
+		args = append(args, fmt.Sprintf("--build-arg=%s", buildArg))
+	}
+	// Kaniko does not support secret mounts, so the secrets are build args
+	for _, secretFile := range spec.secretFiles {
+		args = append(args, fmt.Sprintf("--build-arg=%s=%s", secretFile.id, secretFile.value))
+	}
+	for _, label := range spec.labels {
+		args = append(args, fmt.Sprintf("--label=%s", label))
+	}
+	for _, insecureRegistry := range spec.registry.insecureRegistries {
+		args = append(args, fmt.Sprintf("--insecure-registry=%s", insecureRegistry))
+	}
+	if spec.registry.skipTlsVerify {
+		args = append(args, "--skip-tls-verify")
+	}
+	if spec.registry.skipTlsVerifyPull {
+		args = append(args, "--skip-tls-verify-pull")
+	}
+	if spec.registry.pushRetry != 0 {
+		args = append(args, fmt.Sprintf("--push-retry=%d", spec.registry.pushRetry))
+	}
+	kanikoOpts := spec.kanikoOpts
+	if spec.platform != "" {
+		kanikoOpts.platform = spec.platform
+	}
+	args = append(args, kanikoOpts.args()...)
+	if spec.target != "" {
+		args = append(args, fmt.Sprintf("--target=%s", spec.target))
+	}
+	return builderCommand{builder: KANIKO_BUILDER, path: b.path, args: args}, nil
+}
+
+// Returns the kaniko args that specify the dockerfile and the build context.
+// For the git and tar context types, the docker context dir is used as the
+// kaniko context sub path
+func getKanikoContextArgs(buildCtx buildContext) []string {
+	if buildCtx.contextType == DIR_CONTEXT_TYPE {
+		return []string{
+			fmt.Sprintf("--dockerfile=%s", buildCtx.dockerfile),
+			fmt.Sprintf("--context=dir://%s", buildCtx.dir),
+		}
+	}
+	contextArgs := []string{
+		fmt.Sprintf("--dockerfile=%s", buildCtx.dockerfile),
+		fmt.Sprintf("--context=%s://%s", buildCtx.contextType, buildCtx.source),
+	}
+	if buildCtx.subPath != "" {
+		contextArgs = append(contextArgs, fmt.Sprintf("--context-sub-path=%s", buildCtx.subPath))
+	}
+	return contextArgs
+}
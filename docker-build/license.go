@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// The options for scanning the licenses of the built image packages with
+// trivy. The trivy path is shared with the vulnerability scan
+// See https://trivy.dev/latest/docs/scanner/license/
+type licenseOptions struct {
+	enabled   bool
+	trivyPath string
+	// The license patterns that fail the build (e.g. GPL-3.0*). The
+	// patterns are matched case insensitively against the SPDX ids
+	deniedLicenses []string
+	// The path to write the JSON license report to, if any
+	reportFile string
+}
+
+// A license of a package in the image
+type scannedLicense struct {
+	Name     string `json:"name"`
+	Package  string `json:"package,omitempty"`
+	FilePath string `json:"filePath,omitempty"`
+	// The trivy license category (e.g. restricted, notice)
+	Category string `json:"category,omitempty"`
+	// Whether the license matches a denied license pattern
+	Denied bool `json:"denied,omitempty"`
+}
+
+// The license inventory of the image
+type licenseReport struct {
+	Image          string   `json:"image"`
+	DeniedLicenses []string `json:"deniedLicenses"`
+	// Whether a license matched a denied license pattern
+	Failed bool `json:"failed"`
+	// The number of packages by license
+	LicenseCounts map[string]int   `json:"licenseCounts"`
+	Licenses      []scannedLicense `json:"licenses"`
+}
+
+// The fields of the trivy JSON license report used by the license scan
+type trivyLicenseReport struct {
+	Results []struct {
+		Target   string `json:"Target"`
+		Licenses []struct {
+			Name     string `json:"Name"`
+			PkgName  string `json:"PkgName"`
+			FilePath string `json:"FilePath"`
+			Category string `json:"Category"`
+		} `json:"Licenses"`
+	} `json:"Results"`
+}
+
+func configureLicenseFlags(flags *pflag.FlagSet) {
+	flags.Bool("license-scan", false, "Whether to scan the licenses of the built image packages with trivy")
+	flags.StringArray(
+		"license-deny",
+		nil,
+		"A license that fails the build, as an SPDX id or pattern (e.g. GPL-3.0* or AGPL-*). Can be repeated")
+	flags.String("license-report-file", "", "The path to write the JSON license report to")
+}
+
+func getLicenseOptions(flags *pflag.FlagSet, cmdName string) (licenseOptions, error) {
+	var opts licenseOptions
+	var err error
+
+	opts.enabled, err = flags.GetBool("license-scan")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s license-scan flag", cmdName)
+	}
+
+	opts.deniedLicenses, err = flags.GetStringArray("license-deny")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s license-deny flag", cmdName)
+	}
+	for _, deniedLicense := range opts.deniedLicenses {
+		_, err = path.Match(deniedLicense, "")
+		if err != nil {
+			return opts, fmt.Errorf("license-deny is not a valid pattern: %s", deniedLicense)
+		}
+	}
+
+	opts.reportFile, err = flags.GetString("license-report-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s license-report-file flag", cmdName)
+	}
+
+	opts.trivyPath, err = flags.GetString("trivy-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s trivy-path flag", cmdName)
+	}
+	return opts, nil
+}
+
+func (opts licenseOptions) logAttrs() []any {
+	return []any{
+		"licenseScan", opts.enabled,
+		"licenseDeny", opts.deniedLicenses,
+		"licenseReportFile", opts.reportFile,
+	}
+}
+
+// Scans the licenses of the image packages, writes the license inventory
+// to the report file, and fails if a license is denied. With a tar path,
+// the image tarball is scanned. Otherwise, the pushed image is scanned.
+// Does nothing if the license scan is not enabled
+func (opts licenseOptions) scan(ctx context.Context, image string, tarPath string, insecure bool) error {
+	if !opts.enabled {
+		return nil
+	}
+
+	slog.Info("Scanning image licenses", "image", image, "tarPath", tarPath)
+	bytes, err := runTrivy(ctx, opts.trivyPath, []string{"--scanners", "license"}, image, tarPath, insecure, LICENSE_ERROR)
+	if err != nil {
+		return err
+	}
+	trivyResults := trivyLicenseReport{}
+	err = json.Unmarshal(bytes, &trivyResults)
+	if err != nil {
+		return newStepError(LICENSE_ERROR, fmt.Errorf("error parsing the trivy license report: %s", err))
+	}
+
+	report := newLicenseReport(trivyResults, opts.deniedLicenses)
+	report.Image = image
+	if opts.reportFile != "" {
+		bytes, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding the license report: %s", err)
+		}
+		err = os.WriteFile(opts.reportFile, append(bytes, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing the license report file: %s", err)
+		}
+		slog.Info("Wrote license report file", "licenseReportFile", opts.reportFile)
+	}
+
+	deniedLicenses := []string{}
+	for _, license := range report.Licenses {
+		if license.Denied {
+			slog.Error(
+				"License is denied",
+				"license", license.Name,
+				"package", license.Package,
+				"filePath", license.FilePath,
+			)
+			if !slices.Contains(deniedLicenses, license.Name) {
+				deniedLicenses = append(deniedLicenses, license.Name)
+			}
+		}
+	}
+	slog.Info("Scanned image licenses", "licenseCounts", report.LicenseCounts, "licenseDeny", opts.deniedLicenses)
+	if report.Failed {
+		return newStepError(
+			LICENSE_ERROR,
+			fmt.Errorf("the image has packages with denied licenses: %s", strings.Join(deniedLicenses, ", ")))
+	}
+	return nil
+}
+
+// Returns the license report of the trivy results. The same package
+// license may be reported for multiple targets, so each is reported once
+func newLicenseReport(trivyResults trivyLicenseReport, deniedLicenses []string) licenseReport {
+	report := licenseReport{
+		DeniedLicenses: deniedLicenses,
+		LicenseCounts:  map[string]int{},
+		Licenses:       []scannedLicense{},
+	}
+	if report.DeniedLicenses == nil {
+		report.DeniedLicenses = []string{}
+	}
+	seen := map[string]bool{}
+	for _, result := range trivyResults.Results {
+		for _, lic := range result.Licenses {
+			key := strings.Join([]string{lic.Name, lic.PkgName, lic.FilePath}, "/")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			license := scannedLicense{
+				Name:     lic.Name,
+				Package:  lic.PkgName,
+				FilePath: lic.FilePath,
+				Category: lic.Category,
+				Denied:   isDeniedLicense(lic.Name, deniedLicenses),
+			}
+			report.Licenses = append(report.Licenses, license)
+			report.LicenseCounts[license.Name]++
+			if license.Denied {
+				report.Failed = true
+			}
+		}
+	}
+	return report
+}
+
+// Returns whether the license matches any of the denied license patterns
+func isDeniedLicense(license string, deniedLicenses []string) bool {
+	for _, deniedLicense := range deniedLicenses {
+		matched, _ := path.Match(strings.ToLower(deniedLicense), strings.ToLower(license))
+		if matched {
+			return true
+		}
+	}
+	return false
+}
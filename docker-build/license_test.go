@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestLicenseScanToolNotFound(t *testing.T) {
+	opts := licenseOptions{
+		enabled:   true,
+		trivyPath: filepath.Join(t.TempDir(), "trivy"),
+	}
+	err := opts.scan(context.Background(), "app:latest", "", false)
+	if getErrorClass(err) != TOOL_NOT_FOUND_ERROR {
+		t.Errorf("scan() error class = %q, want %q: %v", getErrorClass(err), TOOL_NOT_FOUND_ERROR, err)
+	}
+}
+
+func TestNewLicenseReport(t *testing.T) {
+	// The same package license is reported for two targets
+	trivyOutput := `{
+  "Results": [
+    {"Target": "OS Packages", "Licenses": [
+      {"Name": "GPL-3.0-only", "PkgName": "bash", "Category": "restricted"},
+      {"Name": "MIT", "PkgName": "libffi", "Category": "notice"}
+    ]},
+    {"Target": "Node.js", "Licenses": [
+      {"Name": "GPL-3.0-only", "PkgName": "bash", "Category": "restricted"}
+    ]}
+  ]
+}`
+	trivyResults := trivyLicenseReport{}
+	err := json.Unmarshal([]byte(trivyOutput), &trivyResults)
+	if err != nil {
+		t.Fatalf("error parsing the trivy output: %s", err)
+	}
+
+	tests := []struct {
+		name           string
+		deniedLicenses []string
+		wantFailed     bool
+	}{
+		{name: "no denied licenses", deniedLicenses: nil, wantFailed: false},
+		{name: "denied pattern", deniedLicenses: []string{"gpl-3.0*"}, wantFailed: true},
+		{name: "other denied license", deniedLicenses: []string{"AGPL-*"}, wantFailed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := newLicenseReport(trivyResults, tt.deniedLicenses)
+			if report.Failed != tt.wantFailed {
+				t.Errorf("newLicenseReport() failed = %t, want %t", report.Failed, tt.wantFailed)
+			}
+			if len(report.Licenses) != 2 {
+				t.Errorf("newLicenseReport() has %d licenses, want 2", len(report.Licenses))
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// Lint findings are not checked
+	LINT_MODE_OFF = "off"
+	// Lint findings are printed, but do not fail the build
+	LINT_MODE_WARN = "warn"
+	// Lint findings with the error or warning severity fail the build
+	LINT_MODE_ERROR = "error"
+
+	// Severity of findings that are likely to break the build or the image
+	SEVERITY_ERROR = "error"
+	// Severity of findings that violate the Dockerfile policy
+	SEVERITY_WARNING = "warning"
+	// Severity of findings that are suggestions
+	SEVERITY_INFO = "info"
+)
+
+// The supported lint modes
+var lintModes = []string{LINT_MODE_OFF, LINT_MODE_WARN, LINT_MODE_ERROR}
+
+// A lint finding for a Dockerfile instruction
+type lintFinding struct {
+	line     int
+	rule     string
+	severity string
+	message  string
+}
+
+func (f lintFinding) String() string {
+	return fmt.Sprintf("line %d: %s %s: %s", f.line, f.rule, f.severity, f.message)
+}
+
+// A lint rule, which is checked against all of the instructions. The
+// rule codes match the hadolint rules they are based on
+// See https://github.com/hadolint/hadolint#rules
+type lintRule struct {
+	code     string
+	severity string
+	message  string
+	check    func(instructions []instruction) []int
+}
+
+var (
+	// Matches a sudo command in a RUN instruction
+	sudoRegexp = regexp.MustCompile(`(^|[;&|(]\s*|\s)sudo\s`)
+	// Matches a cd command in a RUN instruction
+	cdRegexp = regexp.MustCompile(`(^|[;&|]\s*)cd\s`)
+	// Matches the apt command, which is not meant for scripts
+	aptRegexp = regexp.MustCompile(`(^|[;&|]\s*)apt\s`)
+	// Matches apt-get install
+	aptGetInstallRegexp = regexp.MustCompile(`apt-get\s+(-\S+\s+)*install`)
+	// Matches a url
+	urlRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+	// Matches an archive that ADD extracts
+	archiveRegexp = regexp.MustCompile(`\.(tar|tar\.\w+|tgz|tbz2|txz)$`)
+)
+
+var lintRules = []lintRule{
+	{
+		code:     "DL3000",
+		severity: SEVERITY_ERROR,
+		message:  "Use absolute WORKDIR",
+		check: matchInstructions("WORKDIR", func(inst instruction) bool {
+			workdir := strings.Trim(inst.args, `"'`)
+			return !strings.HasPrefix(workdir, "/") && !strings.HasPrefix(workdir, "$")
+		}),
+	},
+	{
+		code:     "DL3002",
+		severity: SEVERITY_WARNING,
+		message:  "Last USER should not be root",
+		check:    checkLastUserRoot,
+	},
+	{
+		code:     "DL3003",
+		severity: SEVERITY_WARNING,
+		message:  "Use WORKDIR to switch to a directory",
+		check: matchInstructions("RUN", func(inst instruction) bool {
+			return cdRegexp.MatchString(inst.args)
+		}),
+	},
+	{
+		code:     "DL3004",
+		severity: SEVERITY_ERROR,
+		message:  "Do not use sudo as it leads to unpredictable behavior",
+		check: matchInstructions("RUN", func(inst instruction) bool {
+			return sudoRegexp.MatchString(inst.args)
+		}),
+	},
+	{
+		code:     "DL3006",
+		severity: SEVERITY_WARNING,
+		message:  "Always tag the version of an image explicitly",
+		check:    checkUntaggedImages,
+	},
+	{
+		code:     "DL3007",
+		severity: SEVERITY_WARNING,
+		message:  "Using latest is prone to errors if the image will ever update. Pin the version explicitly",
+		check: func(instructions []instruction) []int {
+			lines := []int{}
+			for _, stage := range getBuildStages(instructions) {
+				if strings.HasSuffix(stage.image, ":latest") {
+					lines = append(lines, stage.from.line)
+				}
+			}
+			return lines
+		},
+	},
+	{
+		code:     "DL3015",
+		severity: SEVERITY_INFO,
+		message:  "Avoid additional packages by specifying --no-install-recommends",
+		check: matchInstructions("RUN", func(inst instruction) bool {
+			return aptGetInstallRegexp.MatchString(inst.args) && !strings.Contains(inst.args, "--no-install-recommends")
+		}),
+	},
+	{
+		code:     "DL3020",
+		severity: SEVERITY_ERROR,
+		message:  "Use COPY instead of ADD for files and folders",
+		check: matchInstructions("ADD", func(inst instruction) bool {
+			sources := strings.Fields(inst.args)
+			if len(sources) < 2 || strings.HasPrefix(inst.args, "[") || strings.Contains(inst.args, "<<") {
+				return false
+			}
+			for _, source := range sources[:len(sources)-1] {
+				if urlRegexp.MatchString(source) || archiveRegexp.MatchString(source) {
+					return false
+				}
+			}
+			return true
+		}),
+	},
+	{
+		code:     "DL3024",
+		severity: SEVERITY_ERROR,
+		message:  "FROM aliases (stage names) must be unique",
+		check: func(instructions []instruction) []int {
+			lines := []int{}
+			names := map[string]bool{}
+			for _, stage := range getBuildStages(instructions) {
+				name := strings.ToLower(stage.name)
+				if name != "" && names[name] {
+					lines = append(lines, stage.from.line)
+				}
+				names[name] = true
+			}
+			return lines
+		},
+	},
+	{
+		code:     "DL3025",
+		severity: SEVERITY_WARNING,
+		message:  "Use arguments JSON notation for CMD and ENTRYPOINT arguments",
+		check: func(instructions []instruction) []int {
+			lines := []int{}
+			for _, inst := range instructions {
+				if (inst.cmd == "CMD" || inst.cmd == "ENTRYPOINT") && !strings.HasPrefix(inst.args, "[") {
+					lines = append(lines, inst.line)
+				}
+			}
+			return lines
+		},
+	},
+	{
+		code:     "DL3027",
+		severity: SEVERITY_WARNING,
+		message:  "Do not use apt as it is meant to be an end-user tool, use apt-get or apt-cache instead",
+		check: matchInstructions("RUN", func(inst instruction) bool {
+			return aptRegexp.MatchString(inst.args)
+		}),
+	},
+	{
+		code:     "DL4000",
+		severity: SEVERITY_ERROR,
+		message:  "MAINTAINER is deprecated",
+		check: matchInstructions("MAINTAINER", func(inst instruction) bool {
+			return true
+		}),
+	},
+	{
+		code:     "DL4003",
+		severity: SEVERITY_WARNING,
+		message:  "Multiple CMD instructions found. Only the last one takes effect",
+		check:    checkRepeatedPerStage("CMD"),
+	},
+	{
+		code:     "DL4004",
+		severity: SEVERITY_ERROR,
+		message:  "Multiple ENTRYPOINT instructions found. Only the last one takes effect",
+		check:    checkRepeatedPerStage("ENTRYPOINT"),
+	},
+}
+
+// Returns a check that matches the instructions with the given name
+// for which the predicate is true
+func matchInstructions(cmd string, predicate func(inst instruction) bool) func([]instruction) []int {
+	return func(instructions []instruction) []int {
+		lines := []int{}
+		for _, inst := range instructions {
+			if inst.cmd == cmd && predicate(inst) {
+				lines = append(lines, inst.line)
+			}
+		}
+		return lines
+	}
+}
+
+// Returns a check that matches repeated instructions within a build stage
+func checkRepeatedPerStage(cmd string) func([]instruction) []int {
+	return func(instructions []instruction) []int {
+		lines := []int{}
+		count := 0
+		for _, inst := range instructions {
+			switch inst.cmd {
+			case "FROM":
+				count = 0
+			case cmd:
+				count++
+				if count > 1 {
+					lines = append(lines, inst.line)
+				}
+			}
+		}
+		return lines
+	}
+}
+
+// Checks whether the last USER of the final stage is root
+func checkLastUserRoot(instructions []instruction) []int {
+	var lastUser *instruction
+	for i, inst := range instructions {
+		switch inst.cmd {
+		case "FROM":
+			lastUser = nil
+		case "USER":
+			lastUser = &instructions[i]
+		}
+	}
+	if lastUser == nil {
+		return nil
+	}
+	user, _, _ := strings.Cut(lastUser.args, ":")
+	if user == "root" || user == "0" {
+		return []int{lastUser.line}
+	}
+	return nil
+}
+
+// Checks for FROM images without a tag or digest. Stage names, scratch,
+// and images from ARG variables are excluded
+func checkUntaggedImages(instructions []instruction) []int {
+	lines := []int{}
+	stageNames := map[string]bool{}
+	for _, stage := range getBuildStages(instructions) {
+		image := stage.image
+		_, name := path.Split(image)
+		isExcluded := image == "scratch" ||
+			strings.Contains(image, "$") ||
+			stageNames[strings.ToLower(image)]
+		if !isExcluded && !strings.Contains(name, ":") && !strings.Contains(name, "@") {
+			lines = append(lines, stage.from.line)
+		}
+		if stage.name != "" {
+			stageNames[strings.ToLower(stage.name)] = true
+		}
+	}
+	return lines
+}
+
+// Lints the Dockerfile and returns the findings, sorted by line
+func lintDockerfile(instructions []instruction) []lintFinding {
+	findings := []lintFinding{}
+	for _, rule := range lintRules {
+		for _, line := range rule.check(instructions) {
+			findings = append(findings, lintFinding{
+				line:     line,
+				rule:     rule.code,
+				severity: rule.severity,
+				message:  rule.message,
+			})
+		}
+	}
+	slices.SortStableFunc(findings, func(a, b lintFinding) int {
+		return a.line - b.line
+	})
+	return findings
+}
+
+// Runs the lint phase for the Dockerfile at the given path. Returns an
+// error if the lint mode is error and there are findings with the error
+// or warning severity
+func runLint(lintMode string, dockerfilePath string) error {
+	if lintMode == LINT_MODE_OFF {
+		return nil
+	}
+
+	slog.Info("Linting dockerfile", "dockerfile", dockerfilePath)
+	instructions, err := readDockerfile(dockerfilePath)
+	if err != nil {
+		return newStepError(LINT_ERROR, fmt.Errorf("error parsing dockerfile: %s", err))
+	}
+
+	failures := 0
+	findings := lintDockerfile(instructions)
+	for _, finding := range findings {
+		slog.Info(
+			"Lint finding",
+			"line", finding.line,
+			"rule", finding.rule,
+			"severity", finding.severity,
+			"message", finding.message,
+		)
+		if finding.severity != SEVERITY_INFO {
+			failures++
+		}
+	}
+	slog.Info("Linted dockerfile", "findings", len(findings), "failures", failures)
+
+	if lintMode == LINT_MODE_ERROR && failures > 0 {
+		return newStepError(
+			LINT_ERROR,
+			fmt.Errorf("dockerfile has %d lint findings with the error or warning severity", failures),
+		)
+	}
+	return nil
+}
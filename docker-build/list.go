@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// Prints one line per image
+	OUTPUT_FORMAT_TEXT = "text"
+	// Prints a JSON document
+	OUTPUT_FORMAT_JSON = "json"
+)
+
+// The supported output formats
+var outputFormats = []string{OUTPUT_FORMAT_TEXT, OUTPUT_FORMAT_JSON}
+
+// An image in the registry, with all of its tags
+type listedImage struct {
+	Repo     string   `json:"repo"`
+	Digest   string   `json:"digest"`
+	Tags     []string `json:"tags"`
+	Revision string   `json:"revision,omitempty"`
+}
+
+func handleListCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	listFlags := cmd.Flags()
+
+	imageRegistry, err := listFlags.GetString("image-registry")
+	if err != nil {
+		return fmt.Errorf("error processing list image-registry flag")
+	}
+
+	imageRepo, err := listFlags.GetString("image-repo")
+	if err != nil {
+		return fmt.Errorf("error processing list image-repo flag")
+	}
+
+	revision, err := listFlags.GetString("revision")
+	if err != nil {
+		return fmt.Errorf("error processing list revision flag")
+	}
+
+	output, err := listFlags.GetString("output")
+	if err != nil {
+		return fmt.Errorf("error processing list output flag")
+	}
+	if !slices.Contains(outputFormats, output) {
+		return fmt.Errorf("output must be one of %s: %s", outputFormats, output)
+	}
+
+	insecureRegistries, err := listFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing list insecure-registry flag")
+	}
+
+	skipTlsVerify, err := listFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing list skip-tls-verify flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(listFlags, "list")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"imageRegistry", imageRegistry,
+		"imageRepo", imageRepo,
+		"revision", revision,
+		"output", output,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+	}
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("List with params", params...)
+
+	// The image repos of the repo are <image-registry><image-repo><dockerfile-dir>,
+	// so they are found by prefix in the registry catalog
+	repoPrefix, err := name.NewRepository(fmt.Sprintf("%s%s", imageRegistry, imageRepo))
+	if err != nil {
+		return fmt.Errorf("image-registry and image-repo are not a valid image repo: %s", err)
+	}
+	registryOpts := []name.Option{}
+	if slices.Contains(insecureRegistries, repoPrefix.RegistryStr()) {
+		registryOpts = append(registryOpts, name.Insecure)
+	}
+	registry, err := name.NewRegistry(repoPrefix.RegistryStr(), registryOpts...)
+	if err != nil {
+		return fmt.Errorf("image-registry is not a valid registry: %s", err)
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	err = registryAuthOpts.login(ctx, registry.RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	images, err := listRepoImages(ctx, registry, repoPrefix.RepositoryStr(), revision, skipTlsVerify)
+	if err != nil {
+		return err
+	}
+	slog.Info("Listed images", "imageRepo", repoPrefix.String(), "revision", revision, "images", len(images))
+	return writeListedImages(cmd.OutOrStdout(), images, output)
+}
+
+// Returns the images in the repos with the repo prefix. If the revision is
+// set, only the images whose revision label starts with it are returned
+func listRepoImages(
+	ctx context.Context,
+	registry name.Registry,
+	repoPrefix string,
+	revision string,
+	skipTlsVerify bool,
+) ([]listedImage, error) {
+	remoteOpts := getRemoteOptions(ctx, skipTlsVerify)
+
+	repos, err := remote.Catalog(ctx, registry, remoteOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the %s registry catalog: %w", registry, err)
+	}
+
+	images := []listedImage{}
+	for _, repoName := range repos {
+		isRepoImage := repoName == repoPrefix ||
+			repoName == repoPrefix+"-integration-test" ||
+			strings.HasPrefix(repoName, repoPrefix+"/")
+		if !isRepoImage {
+			continue
+		}
+		repo := registry.Repo(repoName)
+		tags, err := remote.List(repo, remoteOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("error listing the %s tags: %w", repo, err)
+		}
+
+		// The tags with the same digest are one image
+		repoImages := map[string]*listedImage{}
+		digests := []string{}
+		for _, tag := range tags {
+			desc, err := remote.Get(repo.Tag(tag), remoteOpts...)
+			if err != nil {
+				return nil, fmt.Errorf("error getting image %s: %w", repo.Tag(tag), err)
+			}
+			digest := desc.Digest.String()
+			image, found := repoImages[digest]
+			if !found {
+				image = &listedImage{Repo: repo.String(), Digest: digest}
+				if revision != "" {
+					configFile, err := getDescriptorConfigFile(desc)
+					if err != nil {
+						return nil, fmt.Errorf("error reading image %s config: %w", repo.Tag(tag), err)
+					}
+					image.Revision = configFile.Config.Labels[REVISION_LABEL]
+				}
+				repoImages[digest] = image
+				digests = append(digests, digest)
+			}
+			image.Tags = append(image.Tags, tag)
+		}
+
+		for _, digest := range digests {
+			image := repoImages[digest]
+			if revision != "" && (image.Revision == "" || !strings.HasPrefix(image.Revision, revision)) {
+				continue
+			}
+			images = append(images, *image)
+		}
+	}
+	return images, nil
+}
+
+// Writes the images in the output format
+func writeListedImages(out io.Writer, images []listedImage, output string) error {
+	if output == OUTPUT_FORMAT_JSON {
+		bytes, err := json.MarshalIndent(images, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding images: %s", err)
+		}
+		_, err = fmt.Fprintln(out, string(bytes))
+		return err
+	}
+	for _, image := range images {
+		_, err := fmt.Fprintf(out, "%s@%s %s\n", image.Repo, image.Digest, strings.Join(image.Tags, ","))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
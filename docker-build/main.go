@@ -1,74 +1,384 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
-	"syscall"
+	"time"
 
+	"github.com/osoriano/deploy-steps/internal/logging"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
+// The name of the step, added to the JSON logs
+const STEP_NAME = "docker-build"
+
 const (
-	// Path to the kaniko executable
+	// Default path to the kaniko executable
 	// See https://github.com/GoogleContainerTools/kaniko/blob/main/deploy/Dockerfile#L96
-	KANIKO_PATH = "/kaniko/executor"
+	DEFAULT_KANIKO_PATH = "/kaniko/executor"
+	// Environment variable that overrides the default kaniko path
+	KANIKO_PATH_ENV = "KANIKO_PATH"
 	// Name of the kaniko executable
 	KANIKO_NAME = "executor"
 	// String written to the status-path when the image build is skipped
 	SKIPPED_STATUS = "Skipped"
+	// The build is skipped if any of the status files are Skipped
+	STATUS_COMBINE_ANY = "any"
+	// The build is skipped only if all of the status files are Skipped
+	STATUS_COMBINE_ALL = "all"
+	// String printed in place of secret values
+	REDACTED_VALUE = "<redacted>"
 )
 
 var (
+	// The supported modes for combining multiple status files
+	statusCombineModes = []string{STATUS_COMBINE_ANY, STATUS_COMBINE_ALL}
+
+	// Valid image tag format
+	// See https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pulling-manifests
+	imageTagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
 	mainCmd = &cobra.Command{
 		Use:   "docker-build",
 		Short: "Build a docker image for a PR or Commit",
 		Long: `Builds a docker image for a PR or Commit.
 For commits, the docker image will be pushed if the build is successful`,
-		RunE: handleMainCmd,
+		PersistentPreRunE: loadFlagValues,
+		RunE:              handleMainCmd,
 	}
 	prCmd = &cobra.Command{
 		Use:   "pr",
 		Short: "Build a docker image for a PR",
 		Long: `Builds a docker image for a PR.
 All layers will be built, but the image will not be pushed`,
-		RunE: handlePrCmd,
+		RunE: withErrorClasses(handlePrCmd),
 	}
 	commitCmd = &cobra.Command{
 		Use:   "commit",
 		Short: "Build a docker image for a commit",
 		Long: `Builds a docker image for a commit.
 Builds all layers and pushes the image to a registry if successful`,
-		RunE: handleCommitCmd,
+		RunE: withErrorClasses(handleCommitCmd),
+	}
+	validateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Run the preflight checks for a build",
+		Long: `Runs the preflight checks that can be done cheaply before a build.
+Checks the clone path, dockerfile, docker context dir, destination, and registry credentials`,
+		RunE: withErrorClasses(handleValidateCmd),
+	}
+	batchCmd = &cobra.Command{
+		Use:   "batch [-- <pr or commit flags>]",
+		Short: "Build multiple docker images concurrently",
+		Long: `Builds multiple dockerfiles concurrently, each in a pr or commit subprocess.
+The flags after "--" are passed to every build. The results are aggregated into one report`,
+		Args: cobra.ArbitraryArgs,
+		RunE: withErrorClasses(handleBatchCmd),
+	}
+	matrixCmd = &cobra.Command{
+		Use:   "matrix [-- <pr or commit flags>]",
+		Short: "Build the images declared in a build matrix file",
+		Long: `Builds the images declared in the build matrix file of a repo.
+Only the images with changed paths are built, concurrently as in the batch subcommand`,
+		Args: cobra.ArbitraryArgs,
+		RunE: withErrorClasses(handleMatrixCmd),
+	}
+	warmCmd = &cobra.Command{
+		Use:   "warm",
+		Short: "Warm the kaniko base image cache",
+		Long: `Pulls the base images into the kaniko cache dir with the kaniko warmer.
+Run before the builds (e.g. on a schedule) so they do not pull the base images cold`,
+		RunE: withErrorClasses(handleWarmCmd),
+	}
+	cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the kaniko caches",
+		RunE:  withErrorClasses(handleMainCmd),
+	}
+	cachePruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Prune the kaniko cache repo and cache dir",
+		Long: `Prunes the images in the kaniko cache repo and the base images in the cache dir.
+Removes the entries older than the older-than duration, then the oldest entries until the cache fits in max-size`,
+		RunE: withErrorClasses(handleCachePruneCmd),
+	}
+	copyCmd = &cobra.Command{
+		Use:   "copy",
+		Short: "Copy an image between registries or repos",
+		Long: `Copies an already built image or image index from the src to the dst without rebuilding.
+The manifest is copied as is, so the digest is preserved (e.g. for promoting an image between environments)`,
+		RunE: withErrorClasses(handleCopyCmd),
+	}
+	tagCmd = &cobra.Command{
+		Use:   "tag",
+		Short: "Tag an existing image without rebuilding",
+		Long: `Adds tags to an image that is already in the registry by putting its manifest.
+Used to stamp release tags (e.g. v1.2.3 or stable) on commit images that were already built`,
+		RunE: withErrorClasses(handleTagCmd),
+	}
+	resolveCmd = &cobra.Command{
+		Use:   "resolve",
+		Short: "Resolve the digest of an image tag",
+		Long: `Looks up the current digest of the image tag in the registry and writes it to the output files.
+Used to pin the deployed images by digest`,
+		RunE: withErrorClasses(handleResolveCmd),
+	}
+	waitCmd = &cobra.Command{
+		Use:   "wait",
+		Short: "Wait for an image to be available in the registry",
+		Long: `Polls the registry until the image tag or digest is available, then writes its digest to the output files.
+Used to synchronize a deploy with a build that runs elsewhere (e.g. in another cluster)`,
+		RunE: withErrorClasses(handleWaitCmd),
+	}
+	cleanupCmd = &cobra.Command{
+		Use:   "cleanup",
+		Short: "Delete the old images of an image repo",
+		Long: `Deletes the old images of an image repo with the retention rules, so the registry storage does not grow forever.
+Keeps the release tags, the newest revisions of each branch, and the recent PR tags`,
+		RunE: withErrorClasses(handleCleanupCmd),
+	}
+	listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the images built for a repo",
+		Long: `Lists the images in the image repos of a repo, optionally only the images built for a revision.
+The image repos are found in the registry catalog, so the registry must support the catalog API`,
+		RunE: withErrorClasses(handleListCmd),
+	}
+	inspectCmd = &cobra.Command{
+		Use:   "inspect <image>",
+		Short: "Inspect an image in the registry",
+		Long: `Reads the manifest and config of an image in the registry and prints a JSON report of its
+labels, entrypoint, layers, sizes, and creation time, for the checks of the built images`,
+		Args: cobra.ExactArgs(1),
+		RunE: withErrorClasses(handleInspectCmd),
+	}
+	signCmd = &cobra.Command{
+		Use:   "sign",
+		Short: "Sign an image with cosign",
+		Long: `Signs the digest of an image in the registry with cosign, and pushes the signature to the image repo.
+Supports a private key or KMS key, and keyless signing with the OIDC identity of the workload`,
+		RunE: withErrorClasses(handleSignCmd),
+	}
+	verifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the signature, SBOM, and attestations of an image",
+		Long: `Verifies an image against a verification policy file before it is promoted (e.g. to production).
+The policy can require a cosign signature with a key or keyless identity, an attached SBOM, and verified attestations,
+such as the SLSA provenance. All of the checks are reported, and the command fails if any of them fails`,
+		RunE: withErrorClasses(handleVerifyCmd),
+	}
+	baseCheckCmd = &cobra.Command{
+		Use:   "base-check",
+		Short: "Check the dockerfile base images for updates",
+		Long: `Compares the FROM images of the dockerfiles with the digests currently published for their tags,
+and reports the stale base images, so a rebuild can pick up the patched base layers.
+The base images pinned by digest are compared with the tag. The other base images are compared with the built image`,
+		RunE: withErrorClasses(handleBaseCheckCmd),
 	}
 )
 
 func configureCmds() {
-	prFlags := prCmd.Flags()
+	configurePrCmd()
+	configureCommitCmd()
+	configureValidateCmd()
+	configureBatchCmd()
+	configureMatrixCmd()
+	configureWarmCmd()
+	configureCacheCmd()
+	configureCopyCmd()
+	configureTagCmd()
+	configureResolveCmd()
+	configureWaitCmd()
+	configureCleanupCmd()
+	configureListCmd()
+	configureInspectCmd()
+	configureBaseCheckCmd()
+	configureSignCmd()
+	configureVerifyCmd()
+	configureMainCmd()
 
-	prFlags.String("clone-path", "", "the path to the cloned repo")
-	prCmd.MarkFlagRequired("clone-path")
+	mainCmd.AddCommand(prCmd, commitCmd, validateCmd, batchCmd, matrixCmd, warmCmd, cacheCmd, copyCmd, tagCmd, resolveCmd, waitCmd, cleanupCmd, listCmd, inspectCmd, baseCheckCmd, signCmd, verifyCmd)
+}
 
-	prFlags.String("dockerfile", "", "the path to the dockerfile to build")
-	prCmd.MarkFlagRequired("dockerfile")
+// Adds the flags that the pr and commit builds share
+func configureBuildFlags(flags *pflag.FlagSet) {
+	flags.String("clone-path", "", "the path to the cloned repo. Required for the dir context type")
 
-	prFlags.String("docker-context-dir", "", "the path to the docker context used for the build")
-	prCmd.MarkFlagRequired("docker-context-dir")
+	flags.String("dockerfile", "", "the path to the dockerfile to build")
+	cobra.MarkFlagRequired(flags, "dockerfile")
 
-	prFlags.String(
+	flags.String("docker-context-dir", "", "the path to the docker context used for the build")
+	cobra.MarkFlagRequired(flags, "docker-context-dir")
+
+	flags.StringArray(
 		"status-file",
-		"",
+		nil,
 		"The path to the status file provided by the diff check. If the content is set to Skipped, "+
-			"no image build is performed and the command exits successfully")
-	prCmd.MarkFlagRequired("status-file")
+			"no image build is performed and the command exits successfully. Can be repeated")
+	cobra.MarkFlagRequired(flags, "status-file")
+
+	flags.String(
+		"status-combine",
+		STATUS_COMBINE_ANY,
+		fmt.Sprintf(
+			"How multiple status files are combined. One of %s. With any, the build is skipped if any "+
+				"status file is Skipped. With all, the build is skipped only if all status files are Skipped",
+			statusCombineModes))
+
+	flags.StringArray(
+		"build-arg",
+		nil,
+		"A build arg passed to kaniko in the format KEY=VALUE. Can be repeated")
+
+	flags.StringArray(
+		"build-arg-env",
+		nil,
+		"The name of an environment variable to pass to kaniko as a build arg. Can be repeated")
+
+	flags.Bool(
+		"git-build-args",
+		false,
+		fmt.Sprintf(
+			"Whether to pass the %s, %s, %s, and %s build args, if the dockerfile declares them with ARG. "+
+				"The build args that are set explicitly take precedence. Only for the dir context type",
+			GIT_COMMIT_BUILD_ARG,
+			GIT_REF_BUILD_ARG,
+			GIT_SHORT_SHA_BUILD_ARG,
+			BUILD_TIMESTAMP_BUILD_ARG))
+
+	flags.StringArray(
+		"sensitive-build-arg",
+		nil,
+		"The name of a build arg whose value is masked in the logs. Build args with names containing "+
+			"password, token, secret, credential, or key are masked by default. Can be repeated")
+
+	flags.StringArray(
+		"secret-file",
+		nil,
+		"A secret file exposed to the build in the format ID=PATH (e.g. NPM_TOKEN=/secrets/npm-token). The file is "+
+			"mounted with RUN --mount=type=secret,id=ID by the buildkit and buildah builders, and passed as the ID "+
+			"build arg by kaniko. The content is masked in the logs and the builder output. Can be repeated")
+
+	flags.String("target", "", "The target stage to build in a multi-stage dockerfile. Defaults to the last stage")
+
+	flags.StringArray(
+		"label",
+		nil,
+		"A label added to the image in the format KEY=VALUE. Overrides the standard OCI labels. Can be repeated")
+
+	flags.Bool(
+		"oci-labels",
+		true,
+		"Whether to add the standard OCI labels (revision, source, created, ref.name) to the image")
+
+	flags.String(
+		"context-type",
+		DIR_CONTEXT_TYPE,
+		fmt.Sprintf(
+			"The type of the build context. One of %s. The dir type uses the clone path, "+
+				"while the git and tar types use the context-source", contextTypes))
+
+	flags.String(
+		"context-source",
+		"",
+		"The source of the build context for the git and tar context types. "+
+			"For git, the repo url with an optional #<ref> (e.g. github.com/org/repo.git#refs/heads/main). "+
+			"For tar, the path to a tar.gz file. The docker-context-dir is used as a sub path of the context")
+
+	configureKanikoFlags(flags)
+
+	flags.Duration(
+		"timeout",
+		0,
+		fmt.Sprintf(
+			"The maximum duration of the build (e.g. 45m). On expiry, kaniko is killed and the exit code is %d. "+
+				"Defaults to no timeout", TIMEOUT_EXIT_CODE))
+
+	flags.Duration(
+		"grace-period",
+		DEFAULT_GRACE_PERIOD,
+		"The time to wait for kaniko to exit after forwarding SIGTERM on cancellation or timeout, before killing it")
+
+	flags.String(
+		"result-file",
+		"",
+		"The path to write the build result to as JSON. "+
+			"The result includes the status, image, digest, timestamps, and kaniko exit code. "+
+			"The status is one of Built, Skipped, Failed, Timeout, or Cancelled")
+
+	flags.String(
+		"argo-outputs-dir",
+		"",
+		"The dir to write the image, digest, and status files to, for use as Argo Workflows output parameters")
+
+	flags.String(
+		"tekton-results-dir",
+		"",
+		"The Tekton results dir (e.g. /tekton/results) to write the IMAGE_URL and IMAGE_DIGEST results to, "+
+			"so the step can run as a Tekton task")
+
+	flags.String(
+		"lint",
+		LINT_MODE_OFF,
+		fmt.Sprintf(
+			"The mode of the dockerfile lint checks that run before the build. One of %s. "+
+				"The error mode fails the build on findings with the error or warning severity", lintModes))
+
+	flags.Bool(
+		"pin-base-images",
+		false,
+		"Whether to resolve the FROM image tags to their current digests before the build, and rewrite the "+
+			"dockerfile to pin them. The pins are recorded in the result file. Only for the dir context type")
+
+	flags.String(
+		"content-hash-file",
+		"",
+		"A file that records the content hash of the dockerfile, docker context, and build args for the last "+
+			"successful build. The build is skipped if the content hash did not change. Only for the dir context type")
 
+	flags.Bool(
+		"force",
+		false,
+		"Whether to build the image even if the status file is set to Skipped (e.g. to pick up a patched base image)")
+
+	configureSbomFlags(flags)
+	configureScanFlags(flags)
+	configureLicenseFlags(flags)
+	configureNonRootFlags(flags)
+	configureRequiredLabelFlags(flags)
+	configurePolicyFlags(flags)
+	configureRemoteContentFlags(flags)
+	configureContextSizeFlags(flags)
+	configureCosignFlags(flags)
+	configureVerifyFlags(flags)
+}
+
+func configurePrCmd() {
+	prFlags := prCmd.Flags()
+
+	configureBuildFlags(prFlags)
+
+	prFlags.String(
+		"tar-path",
+		"",
+		"The path to write the built image to as a tarball, so it can be archived. Defaults to not writing a tarball")
+
+	prFlags.String("tar-image", "image:pr", "The image name recorded in the tarball. Only used with tar-path")
+}
+
+func configureCommitCmd() {
 	commitFlags := commitCmd.Flags()
 
-	commitFlags.String("clone-path", "", "the path to the cloned repo")
-	commitCmd.MarkFlagRequired("clone-path")
+	configureBuildFlags(commitFlags)
 
 	commitFlags.String("revision-hash", "", "the revision id (e.g. commit sha hash)")
 	commitCmd.MarkFlagRequired("revision-hash")
@@ -76,15 +386,15 @@ func configureCmds() {
 	commitFlags.String("revision-ref", "", "the ref that will be used locally")
 	commitCmd.MarkFlagRequired("revision-ref")
 
-	commitFlags.String("dockerfile", "", "the path to the dockerfile to build")
-	commitCmd.MarkFlagRequired("dockerfile")
-
-	commitFlags.String("docker-context-dir", "", "the path to the docker context used for the build")
-	commitCmd.MarkFlagRequired("docker-context-dir")
-
 	commitFlags.String("image-registry", "", "The image registry used for pushing images. Set to blank to use docker hub")
 	commitCmd.MarkFlagRequired("image-registry")
 
+	commitFlags.StringArray(
+		"extra-destination-registry",
+		nil,
+		"An additional image registry the commit image is pushed to, with the same image repo and tags "+
+			"(e.g. to mirror the image to an on-prem registry). Can be repeated")
+
 	commitFlags.String("image-repo", "", "The image repo used for pushing images. Typically the repo name")
 	commitCmd.MarkFlagRequired("image-repo")
 
@@ -93,17 +403,621 @@ func configureCmds() {
 		"",
 		"The dockerfile-dir is used as a suffix in the image repo. "+
 			"This can be blank, but can be set to distinguish images in a monorepo. "+
-			"The full image format is: <image-registry><image-repo><dockerfile-dir>:<revision>")
+			"The full image format is: <image-registry><image-repo><dockerfile-dir>:<tag>")
 	commitCmd.MarkFlagRequired("dockerfile-dir")
 
 	commitFlags.String(
-		"status-file",
+		"content-hash-image",
 		"",
-		"The path to the status file provided by the diff check. If the content is set to Skipped, "+
-			"no image build is performed and the command exits successfully")
-	commitCmd.MarkFlagRequired("status-file")
+		fmt.Sprintf(
+			"An image whose %s label is compared to the content hash, to skip the build if the build inputs "+
+				"did not change (e.g. the image with an additional tag such as latest)", CONTENT_HASH_LABEL))
+
+	commitFlags.StringArray(
+		"additional-tag",
+		nil,
+		"An additional tag to push the commit image with (e.g. latest). Can be repeated")
+
+	commitFlags.String(
+		"tag-template",
+		DEFAULT_TAG_TEMPLATE,
+		"The template for the image tag. Supports the placeholders {{.Sha}}, {{.ShortSha}}, {{.Ref}}, "+
+			"{{.Branch}}, {{.Timestamp}}, and {{.SemVer}} (e.g. {{.Branch}}-{{.ShortSha}})")
+
+	commitFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to push to and pull from using plain HTTP. Can be repeated")
+
+	commitFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification when pushing images")
+
+	commitFlags.Bool(
+		"skip-tls-verify-pull",
+		false,
+		"Whether to skip TLS certificate verification when pulling images")
+
+	commitFlags.Bool(
+		"ecr-create-repository",
+		false,
+		"Whether to create the ECR repos of the commit and integration test images if they do not exist. "+
+			"Requires the ecr registry-auth")
+
+	commitFlags.String(
+		"ecr-lifecycle-policy-file",
+		"",
+		"The path to an ECR lifecycle policy JSON file, applied to the repos created by ecr-create-repository")
+
+	commitFlags.Bool(
+		"registry-preflight",
+		false,
+		"Whether to check that the registry is reachable and the credentials can push to the "+
+			"commit and integration test image repos before the build, so the build fails fast")
+
+	commitFlags.Int(
+		"push-retry",
+		DEFAULT_REGISTRY_RETRY,
+		"The number of retries for pushing the image, so transient registry errors do not fail the build")
+
+	commitFlags.StringArray(
+		"multi-platform",
+		nil,
+		"A platform to build the image for in the format os/arch[/variant]. Can be repeated. "+
+			"Each platform image is pushed with the <tag>-<os>-<arch> tag, then an image index "+
+			"is pushed to the image tags. Each platform is built sequentially, so the build node "+
+			"must be able to run the platform binaries (e.g. with QEMU emulation)")
+
+	commitFlags.Bool(
+		"skip-if-exists",
+		false,
+		"Whether to skip the build if the image tag already exists in the registry, "+
+			"to avoid duplicate builds on workflow retries. Overridden by the force flag")
+
+	commitFlags.Bool(
+		"no-overwrite",
+		false,
+		"Whether to fail the build if the image tag already exists in the image repo or the extra destination "+
+			"registries, instead of overwriting it. The additional tags are not checked, since they are expected to move")
+
+	commitFlags.String("digest-file", "", "The path to write the digest of the pushed commit image to")
+
+	commitFlags.String(
+		"image-ref-file",
+		"",
+		"The path to write the full reference of the pushed commit image to, in the format <image>:<tag>@<digest>")
+
+	commitFlags.String(
+		"layer-report-file",
+		"",
+		"The path to write the JSON layer report of the pushed commit image to, with the size of each layer "+
+			"and the dockerfile instruction that created it")
+
+	commitFlags.Bool(
+		"sign",
+		false,
+		"Whether to sign the pushed commit image digest with cosign, in the image repo and the extra destination registries")
+	configureSignFlags(commitFlags)
+	configureEncryptFlags(commitFlags)
+	commitFlags.String(
+		"tar-path",
+		"",
+		"The path to write the built image to as a tarball, which is checked before the push. "+
+			"Required with encrypt-key, and with the image checks of a single platform build (e.g. scan). "+
+			"Must be on a volume, since the builder may clean up the filesystem after the build")
+}
+
+func configureValidateCmd() {
+	validateFlags := validateCmd.Flags()
+
+	validateFlags.String("clone-path", "", "the path to the cloned repo. Required for the dir context type")
+
+	validateFlags.String("dockerfile", "", "the path to the dockerfile to build")
+	validateCmd.MarkFlagRequired("dockerfile")
+
+	validateFlags.String("docker-context-dir", "", "the path to the docker context used for the build")
+	validateCmd.MarkFlagRequired("docker-context-dir")
+
+	validateFlags.String(
+		"context-type",
+		DIR_CONTEXT_TYPE,
+		fmt.Sprintf(
+			"The type of the build context. One of %s. The local path checks only run for the dir type",
+			contextTypes))
+
+	validateFlags.String(
+		"context-source",
+		"",
+		"The source of the build context for the git and tar context types")
+
+	validateFlags.String("image-registry", "", "The image registry used for pushing images. Set to blank to use docker hub")
+
+	validateFlags.String(
+		"image-repo",
+		"",
+		"The image repo used for pushing images. The destination checks are skipped if not set (e.g. for PRs)")
+
+	validateFlags.String("dockerfile-dir", "", "The dockerfile-dir suffix of the image repo")
+
+	validateFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to check using plain HTTP. Can be repeated")
+
+	validateFlags.Bool(
+		"check-credentials",
+		true,
+		"Whether to check that the registry credentials can push to the destination")
+}
+
+func configureBatchCmd() {
+	batchFlags := batchCmd.Flags()
+
+	batchFlags.String("mode", "commit", fmt.Sprintf("The subcommand used for each build. One of %s", batchModes))
+
+	batchFlags.String(
+		"clone-path",
+		"",
+		"the path to the cloned repo. Passed to every build, and required for the discover flag")
+
+	batchFlags.StringArray(
+		"build",
+		nil,
+		"A build in the format dockerfile=<path>,context=<dir>,dir=<dockerfile-dir>[,status-file=<path>]. "+
+			"The context defaults to the dir of the dockerfile. Can be repeated")
+
+	batchFlags.StringArray(
+		"discover",
+		nil,
+		"A glob, relative to the clone path, matching the dockerfiles to build (e.g. services/**/Dockerfile). "+
+			"The context is the dir of each dockerfile, which is also used as the dockerfile-dir. Can be repeated")
+
+	batchFlags.Int("concurrency", DEFAULT_BATCH_CONCURRENCY, "The maximum number of builds to run at the same time")
+
+	batchFlags.String("report-file", "", "The path to write the JSON report of all of the builds to")
+}
+
+func configureMatrixCmd() {
+	matrixFlags := matrixCmd.Flags()
+
+	matrixFlags.String("mode", "commit", fmt.Sprintf("The subcommand used for each build. One of %s", batchModes))
+
+	matrixFlags.String("clone-path", "", "the path to the cloned repo. Passed to every build")
+	matrixCmd.MarkFlagRequired("clone-path")
+
+	matrixFlags.String(
+		"matrix-file",
+		"",
+		fmt.Sprintf("The path to the build matrix file. Defaults to %s in the clone path", DEFAULT_MATRIX_FILE))
+
+	matrixFlags.StringArray(
+		"changed-path",
+		nil,
+		"A changed path, relative to the clone path. Only the builds matching a changed path run. Can be repeated")
+
+	matrixFlags.String(
+		"changed-paths-file",
+		"",
+		"The path to a file with the changed paths, one per line, or a JSON status file with the changedPaths field. "+
+			"All of the builds run if neither this nor changed-path is set")
+
+	matrixFlags.Int("concurrency", DEFAULT_BATCH_CONCURRENCY, "The maximum number of builds to run at the same time")
+
+	matrixFlags.String("report-file", "", "The path to write the JSON report of all of the builds to")
+}
+
+func configureWarmCmd() {
+	warmFlags := warmCmd.Flags()
+
+	warmFlags.String("warmer-path", DEFAULT_WARMER_PATH, "The path to the kaniko warmer executable")
+
+	warmFlags.String(
+		"cache-dir",
+		DEFAULT_WARMER_CACHE_DIR,
+		"The dir to cache the base images in. Should match the cache-dir of the builds")
+
+	warmFlags.StringArray("image", nil, "A base image to cache (e.g. golang:1.24). Can be repeated")
+
+	warmFlags.String(
+		"images-file",
+		"",
+		"The path to a file with the base images to cache, one per line. Lines starting with # are ignored")
+
+	warmFlags.StringArray(
+		"dockerfile",
+		nil,
+		"The path to a dockerfile whose FROM images are cached. Stage names and images with ARG variables are skipped. "+
+			"Can be repeated")
+
+	warmFlags.Bool("force", false, "Whether to pull the images even if they are already cached")
+
+	warmFlags.Bool("insecure-pull", false, "Whether to pull the images from registries using plain HTTP")
+
+	warmFlags.Bool("skip-tls-verify-pull", false, "Whether to skip TLS certificate verification when pulling the images")
+
+	warmFlags.StringArray("registry-mirror", nil, "A registry mirror to pull the images from. Can be repeated")
+
+	warmFlags.Duration(
+		"timeout",
+		0,
+		fmt.Sprintf(
+			"The maximum duration of the warmer (e.g. 10m). On expiry, the warmer is killed and the exit code is %d. "+
+				"Defaults to no timeout", TIMEOUT_EXIT_CODE))
+
+	warmFlags.Duration(
+		"grace-period",
+		DEFAULT_GRACE_PERIOD,
+		"The time to wait for the warmer to exit after forwarding SIGTERM on cancellation or timeout, before killing it")
+}
+
+func configureCacheCmd() {
+	pruneFlags := cachePruneCmd.Flags()
+
+	pruneFlags.String("cache-repo", "", "The kaniko cache repo to prune (e.g. registry.example.com/app/cache)")
+
+	pruneFlags.String("cache-dir", "", "The kaniko base image cache dir to prune (e.g. /cache)")
+
+	pruneFlags.Duration("older-than", 0, "Remove the entries created longer ago than the duration (e.g. 168h)")
+
+	pruneFlags.String(
+		"max-size",
+		"",
+		"Remove the oldest entries until the cache is at most the size (e.g. 20Gi or 500MB). Applies to each cache")
+
+	pruneFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	pruneFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the cache repo")
+
+	cacheCmd.AddCommand(cachePruneCmd)
+}
+
+func configureCopyCmd() {
+	copyFlags := copyCmd.Flags()
+
+	copyFlags.String("src", "", "The image to copy (e.g. registry.example.com/app@sha256:...)")
+	copyCmd.MarkFlagRequired("src")
+
+	copyFlags.String("dst", "", "The image to copy to (e.g. registry.example.com/prod/app:v1.2.3)")
+	copyCmd.MarkFlagRequired("dst")
+
+	copyFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	copyFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registries")
+
+	copyFlags.String("digest-file", "", "The path to write the digest of the copied image to")
+}
+
+func configureTagCmd() {
+	tagFlags := tagCmd.Flags()
+
+	tagFlags.String("image", "", "The image to tag, preferably pinned by digest (e.g. registry.example.com/app@sha256:...)")
+	tagCmd.MarkFlagRequired("image")
+
+	tagFlags.StringArray("tag", nil, "A tag to add to the image in the image repo (e.g. v1.2.3). Can be repeated")
+	tagCmd.MarkFlagRequired("tag")
+
+	tagFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	tagFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registry")
+}
+
+func configureResolveCmd() {
+	resolveFlags := resolveCmd.Flags()
+
+	resolveFlags.String("image", "", "The image to resolve (e.g. registry.example.com/app:v1.2.3)")
+	resolveCmd.MarkFlagRequired("image")
+
+	resolveFlags.String("digest-file", "", "The path to write the digest of the image to")
+
+	resolveFlags.String(
+		"image-ref-file",
+		"",
+		"The path to write the full reference of the image to, in the format <image>:<tag>@<digest>")
+
+	resolveFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	resolveFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registry")
+}
+
+func configureWaitCmd() {
+	waitFlags := waitCmd.Flags()
+
+	waitFlags.String("image", "", "The image to wait for (e.g. registry.example.com/app:<sha> or registry.example.com/app@sha256:...)")
+	waitCmd.MarkFlagRequired("image")
+
+	waitFlags.Duration(
+		"timeout",
+		DEFAULT_WAIT_TIMEOUT,
+		fmt.Sprintf("The maximum duration to wait for the image. On expiry, the exit code is %d", TIMEOUT_EXIT_CODE))
+
+	waitFlags.Duration("poll-interval", DEFAULT_WAIT_POLL_INTERVAL, "The interval between the registry polls")
+
+	waitFlags.String("digest-file", "", "The path to write the digest of the image to")
+
+	waitFlags.String(
+		"image-ref-file",
+		"",
+		"The path to write the full reference of the image to, in the format <image>:<tag>@<digest>")
+
+	waitFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	waitFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registry")
+}
+
+func configureCleanupCmd() {
+	cleanupFlags := cleanupCmd.Flags()
+
+	cleanupFlags.String("repo", "", "The image repo to clean up (e.g. registry.example.com/app)")
+	cleanupCmd.MarkFlagRequired("repo")
+
+	cleanupFlags.Int(
+		"keep-per-branch",
+		0,
+		fmt.Sprintf(
+			"The number of the newest revisions to keep for each branch. The branch and revision are read from the "+
+				"%s and %s labels (see oci-labels). Defaults to keeping all of the branch tags", REF_NAME_LABEL, REVISION_LABEL))
+
+	cleanupFlags.String("pr-tag-regex", DEFAULT_PR_TAG_REGEX, "The regex matching the PR tags")
+
+	cleanupFlags.Duration(
+		"pr-older-than",
+		0,
+		"Delete the PR tags created longer ago than the duration (e.g. 720h). Defaults to keeping all of the PR tags")
+
+	cleanupFlags.StringArray(
+		"keep-tag-regex",
+		defaultKeepTagRegexes,
+		"A regex matching the release tags, which are always kept. Can be repeated. Defaults to the semver and latest tags")
+
+	cleanupFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	cleanupFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registry")
+}
+
+func configureListCmd() {
+	listFlags := listCmd.Flags()
+
+	listFlags.String("image-registry", "", "The image registry of the images. Set to blank to use docker hub")
+
+	listFlags.String(
+		"image-repo",
+		"",
+		"The image repo of the images. The images of all of the dockerfile-dir suffixes are listed")
+	listCmd.MarkFlagRequired("image-repo")
+
+	listFlags.String(
+		"revision",
+		"",
+		fmt.Sprintf("The revision hash or a prefix of it. Only the images with a matching %s label are listed", REVISION_LABEL))
+
+	listFlags.String("output", OUTPUT_FORMAT_TEXT, fmt.Sprintf("The output format. One of %s", outputFormats))
+
+	listFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	listFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registry")
+}
+
+func configureInspectCmd() {
+	inspectFlags := inspectCmd.Flags()
+
+	inspectFlags.String(
+		"platform",
+		"",
+		"The platform of the image to inspect in an image index, in the format os/arch[/variant]. Defaults to linux/amd64")
+
+	inspectFlags.Bool(
+		"uncompressed-size",
+		true,
+		"Whether to report the uncompressed layer sizes, which requires downloading the layers")
+
+	inspectFlags.String("output-file", "", "The path to write the JSON report to. Defaults to printing it")
 
-	mainCmd.AddCommand(prCmd, commitCmd)
+	inspectFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	inspectFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registry")
+}
+
+func configureBaseCheckCmd() {
+	baseCheckFlags := baseCheckCmd.Flags()
+
+	baseCheckFlags.StringArray(
+		"dockerfile",
+		nil,
+		"The path to a dockerfile whose FROM images are checked. Stage names and images with ARG variables are skipped. "+
+			"Can be repeated")
+	baseCheckCmd.MarkFlagRequired("dockerfile")
+
+	baseCheckFlags.String(
+		"image",
+		"",
+		"The image built from the dockerfile. If set, the base image of the final stage is stale if the image "+
+			"is not built on the current layers of its tag. Requires a single dockerfile")
+
+	baseCheckFlags.String(
+		"platform",
+		DEFAULT_BASE_CHECK_PLATFORM,
+		"The platform of the images to compare the layers of, in the format os/arch[/variant]")
+
+	baseCheckFlags.Bool("fail-on-stale", false, "Whether to fail if a base image is stale, instead of only reporting it")
+
+	baseCheckFlags.String("report-file", "", "The path to write the JSON report of the base images to")
+
+	baseCheckFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	baseCheckFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registry")
+}
+
+func configureSignCmd() {
+	signFlags := signCmd.Flags()
+
+	signFlags.String("image", "", "The image to sign. A tag is resolved to its current digest")
+	signCmd.MarkFlagRequired("image")
+
+	configureCosignFlags(signFlags)
+	configureSignFlags(signFlags)
+
+	signFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	signFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registry")
+}
+
+func configureVerifyCmd() {
+	verifyFlags := verifyCmd.Flags()
+
+	verifyFlags.String("image", "", "The image to verify. A tag is resolved to its current digest")
+	verifyCmd.MarkFlagRequired("image")
+
+	verifyFlags.String("policy", "", "The path to the YAML verification policy file")
+	verifyCmd.MarkFlagRequired("policy")
+
+	configureCosignFlags(verifyFlags)
+
+	verifyFlags.StringArray(
+		"insecure-registry",
+		nil,
+		"A registry to access using plain HTTP. Can be repeated")
+
+	verifyFlags.Bool("skip-tls-verify", false, "Whether to skip TLS certificate verification for the registry")
+}
+
+func configureMainCmd() {
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the fully resolved builder args before running the builder")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s. The json format adds fields for log pipelines to index", logging.LogFormats))
+	mainCmd.PersistentFlags().String(
+		"kaniko-path",
+		"",
+		fmt.Sprintf(
+			"The path to the kaniko executable. Defaults to the %s environment variable if set, otherwise %s",
+			KANIKO_PATH_ENV,
+			DEFAULT_KANIKO_PATH,
+		))
+	mainCmd.PersistentFlags().String(
+		"builder",
+		KANIKO_BUILDER,
+		fmt.Sprintf(
+			"The builder backend. One of %s. The buildkit builder runs buildctl against a buildkitd daemon, "+
+				"the remote builder runs buildctl against a remote buildkitd endpoint set with buildkit-addr, "+
+				"and the buildah builder runs buildah bud and push. They ignore the kaniko specific options", builders))
+	mainCmd.PersistentFlags().String(
+		"buildctl-path",
+		DEFAULT_BUILDCTL_PATH,
+		"The path to the buildctl executable for the buildkit builder")
+	mainCmd.PersistentFlags().String(
+		"buildkit-addr",
+		"",
+		"The buildkitd address for the buildkit builder (e.g. tcp://buildkitd:1234). "+
+			"Defaults to the BUILDKIT_HOST environment variable. Required for the remote builder")
+	mainCmd.PersistentFlags().String(
+		"buildkit-tls-ca-cert",
+		"",
+		"The CA certificate for verifying the buildkitd endpoint of the buildkit and remote builders")
+	mainCmd.PersistentFlags().String(
+		"buildkit-tls-cert",
+		"",
+		"The client certificate for the buildkitd endpoint of the buildkit and remote builders. Requires buildkit-tls-key")
+	mainCmd.PersistentFlags().String(
+		"buildkit-tls-key",
+		"",
+		"The client key for the buildkitd endpoint of the buildkit and remote builders. Requires buildkit-tls-cert")
+	mainCmd.PersistentFlags().String(
+		"buildkit-tls-server-name",
+		"",
+		"The server name for verifying the buildkitd endpoint certificate. Defaults to the host of buildkit-addr")
+	mainCmd.PersistentFlags().String(
+		"buildah-path",
+		DEFAULT_BUILDAH_PATH,
+		"The path to the buildah executable for the buildah builder")
+	mainCmd.PersistentFlags().String(
+		"buildah-storage-driver",
+		"",
+		"The storage driver for the buildah builder (e.g. vfs for rootless builds). Defaults to the buildah default")
+	mainCmd.PersistentFlags().String(
+		"buildah-isolation",
+		"",
+		"The isolation of the RUN instructions for the buildah builder (e.g. chroot for rootless builds). "+
+			"Defaults to the buildah default")
+	mainCmd.PersistentFlags().Int(
+		"rate-limit-retry",
+		DEFAULT_RATE_LIMIT_RETRY,
+		"The number of times to retry the build when the registry rate limits it (e.g. with a 429 TOOMANYREQUESTS)")
+	mainCmd.PersistentFlags().Duration(
+		"rate-limit-backoff",
+		DEFAULT_RATE_LIMIT_BACKOFF,
+		"The wait before the first rate limit retry, which doubles for each retry")
+	mainCmd.PersistentFlags().String(
+		"registry-auth",
+		"",
+		fmt.Sprintf(
+			"The registry auth mode, which writes the registry credentials to the docker config before the build. "+
+				"One of %s. The ecr mode uses the AWS credentials from IRSA, pod identity, or the instance role, "+
+				"the gcp mode uses the GKE Workload Identity for Artifact Registry, "+
+				"the acr mode uses the Azure service principal, workload identity, or managed identity, "+
+				"the basic mode uses registry-username and registry-password, "+
+				"and the helper mode configures the docker credential helpers. "+
+				"Defaults to the existing docker config", registryAuths))
+	mainCmd.PersistentFlags().String(
+		"registry-username",
+		"",
+		"The username for the basic registry-auth mode, which is implied if set")
+	mainCmd.PersistentFlags().String(
+		"registry-password",
+		"",
+		fmt.Sprintf(
+			"The password or token for the basic registry-auth mode. Prefer the %s environment variable, "+
+				"so the password is not in the process args", getFlagEnvName("registry-password")))
+	mainCmd.PersistentFlags().StringArray(
+		"credential-helper",
+		nil,
+		"The docker credential helper of a registry for the helper registry-auth mode, which is implied if set, "+
+			"in the format <registry>=<helper> (e.g. ghcr.io=pass for docker-credential-pass). "+
+			"The ecr-login, gcr, and acr-env helpers are detected on the PATH by default. Can be repeated")
+	mainCmd.PersistentFlags().StringArray(
+		"auth-registry",
+		nil,
+		"A registry to log in to with the registry-auth mode (e.g. to pull the base images), "+
+			"or with its own mode in the format <registry>=<mode>. The mode also applies to the registry "+
+			"if it is a push registry. The image registries of commit builds are included. Can be repeated")
+	mainCmd.PersistentFlags().String(
+		"config",
+		"",
+		fmt.Sprintf(
+			"The path to a YAML or JSON config file with flag values. Flags set on the command line take precedence. "+
+				"Defaults to the %s environment variable", CONFIG_ENV))
+	mainCmd.PersistentFlags().Bool(
+		"dry-run",
+		false,
+		"Perform the validation and skip checks, then print the builder invocation and exit without building")
 }
 
 func handleMainCmd(cmd *cobra.Command, args []string) error {
@@ -112,216 +1026,878 @@ func handleMainCmd(cmd *cobra.Command, args []string) error {
 
 func handlePrCmd(cmd *cobra.Command, args []string) error {
 	// Parse command flags
-	prFlags := cmd.Flags()
-
-	clonePath, err := prFlags.GetString("clone-path")
+	opts, err := getPrOptions(cmd.Flags())
 	if err != nil {
-		return fmt.Errorf("error processing pr clone-path flag")
+		return opts.outputs.writeFailed(withDefaultClass(FLAG_ERROR, err))
 	}
 
-	dockerfile, err := prFlags.GetString("dockerfile")
+	// Log command flags, with the sensitive values masked
+	redactor := opts.getRedactor()
+	slog.Info("PR build with params", opts.logAttrs(redactor)...)
+
+	// Check status file and skip build if necessary
+	skipped, skipReason, err := shouldSkipBuild(opts.statusFiles, opts.statusCombine, opts.force)
 	if err != nil {
-		return fmt.Errorf("error processing pr dockerfile flag")
+		err = newStepError(SKIP_CHECK_ERROR, fmt.Errorf("error checking skip status: %s", err))
+		return opts.outputs.writeFailed(err)
+	}
+	if skipped {
+		slog.Info("Build is skipped. Exiting early", "reason", skipReason)
+		return opts.outputs.write(buildResult{Status: SKIPPED_STATUS, SkipReason: skipReason})
+	}
+	slog.Info("Continuing build")
+
+	// Lint the dockerfile before the expensive build
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = runLint(opts.lintMode, filepath.Join(opts.clonePath, opts.dockerfile))
+		if err != nil {
+			return opts.outputs.writeFailed(err)
+		}
+	} else if opts.lintMode != LINT_MODE_OFF {
+		slog.Info("Skipping lint for the context type", "contextType", opts.contextType)
+	}
+
+	// Check the base image registries before any of them are pulled
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = opts.policy.checkBaseRegistries(filepath.Join(opts.clonePath, opts.dockerfile))
+		if err != nil {
+			// The usage is not relevant for policy violations
+			cmd.SilenceUsage = true
+			return opts.outputs.writeFailed(err)
+		}
+	} else if len(opts.policy.allowedBaseRegistries) > 0 {
+		slog.Info("Skipping the base registry check for the context type", "contextType", opts.contextType)
 	}
 
-	dockerContextDir, err := prFlags.GetString("docker-context-dir")
+	// Check the remote downloads before the build runs them
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = opts.remoteContent.check(filepath.Join(opts.clonePath, opts.dockerfile))
+		if err != nil {
+			// The usage is not relevant for policy violations
+			cmd.SilenceUsage = true
+			return opts.outputs.writeFailed(err)
+		}
+	} else if opts.remoteContent.mode != REMOTE_CONTENT_MODE_OFF {
+		slog.Info("Skipping the remote content check for the context type", "contextType", opts.contextType)
+	}
+
+	// Check the docker context before the builder reads it
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = opts.contextSize.check(filepath.Join(opts.clonePath, opts.dockerContextDir))
+		if err != nil {
+			// The usage is not relevant for policy violations
+			cmd.SilenceUsage = true
+			return opts.outputs.writeFailed(err)
+		}
+	} else if opts.contextSize.enabled() {
+		slog.Info("Skipping the docker context check for the context type", "contextType", opts.contextType)
+	}
+
+	// Log in to the registries before the registry checks and the build
+	err = opts.registryAuth.login(context.Background())
 	if err != nil {
-		return fmt.Errorf("error processing pr docker-context-dir flag")
+		// The usage is not relevant for registry errors
+		cmd.SilenceUsage = true
+		return opts.outputs.writeFailed(err)
 	}
 
-	statusFile, err := prFlags.GetString("status-file")
+	resolvedBuildArgs, err := getBuildArgs(opts.buildArgs, opts.buildArgEnvs)
 	if err != nil {
-		return fmt.Errorf("error processing pr status-file flag")
+		return opts.outputs.writeFailed(newStepError(FLAG_ERROR, fmt.Errorf("error processing build args: %s", err)))
+	}
+
+	// Pin the base images before the content hash, so a moved tag changes the content hash
+	var baseImagePins map[string]string
+	if opts.pinBaseImages {
+		if opts.contextType != DIR_CONTEXT_TYPE {
+			slog.Info("Skipping the base image pinning for the context type", "contextType", opts.contextType)
+		} else {
+			baseImagePins, err = pinBaseImages(
+				context.Background(),
+				filepath.Join(opts.clonePath, opts.dockerfile),
+				nil,
+				false,
+			)
+			if err != nil {
+				// The usage is not relevant for registry errors
+				cmd.SilenceUsage = true
+				return opts.outputs.writeFailed(newStepError(REGISTRY_PREFLIGHT_ERROR, fmt.Errorf("error pinning base images: %w", err)))
+			}
+		}
 	}
 
-	// Print command flags
-	fmt.Printf("PR build with params:\n")
-	fmt.Printf("- clonePath: %s\n", clonePath)
-	fmt.Printf("- dockerfile: %s\n", dockerfile)
-	fmt.Printf("- dockerContextDir: %s\n", dockerContextDir)
-	fmt.Printf("- statusFile: %s\n", statusFile)
+	// Verify the base images after the pinning, so the pinned digests are verified
+	if opts.verify.enabled {
+		if opts.contextType != DIR_CONTEXT_TYPE {
+			slog.Info("Skipping the base image verification for the context type", "contextType", opts.contextType)
+		} else {
+			err = opts.verify.verifyBaseImages(
+				context.Background(),
+				filepath.Join(opts.clonePath, opts.dockerfile),
+				nil,
+				false,
+			)
+			if err != nil {
+				// The usage is not relevant for verification errors
+				cmd.SilenceUsage = true
+				return opts.outputs.writeFailed(err)
+			}
+		}
+	}
 
-	// Check status file and skip build if necessary
-	skipped, err := isBuildSkipped(statusFile)
+	// Skip the build if the build inputs did not change since the last successful build
+	contentHash := ""
+	if opts.contentHashFile != "" {
+		if opts.contextType != DIR_CONTEXT_TYPE {
+			slog.Info("Skipping the content hash check for the context type", "contextType", opts.contextType)
+		} else {
+			var unchanged bool
+			contentHash, unchanged, err = checkContentHash(
+				filepath.Join(opts.clonePath, opts.dockerfile),
+				filepath.Join(opts.clonePath, opts.dockerContextDir),
+				resolvedBuildArgs,
+				opts.target,
+				opts.contentHashFile,
+				"",
+				nil,
+			)
+			if err != nil {
+				err = newStepError(SKIP_CHECK_ERROR, fmt.Errorf("error checking content hash: %s", err))
+				return opts.outputs.writeFailed(err)
+			}
+			if unchanged && !opts.force {
+				slog.Info("Content hash matches the last successful build. Exiting early", "contentHash", contentHash)
+				return opts.outputs.write(buildResult{
+					Status:      SKIPPED_STATUS,
+					SkipReason:  "The build inputs did not change since the last successful build",
+					ContentHash: contentHash,
+				})
+			}
+		}
+	}
+
+	// The PR revision is not passed in, so it is read from the clone
+	revisionHash := ""
+	if opts.clonePath != "" {
+		revisionHash, err = getGitHeadHash(opts.clonePath)
+		if err != nil {
+			slog.Warn("Unable to read the PR revision from the clone", "error", err)
+		}
+	}
+	slog.SetDefault(slog.Default().With("revision", revisionHash))
+	// The git build args are added after the content hash, since they change on every build
+	if opts.gitBuildArgs {
+		if opts.contextType != DIR_CONTEXT_TYPE {
+			slog.Info("Skipping the git build args for the context type", "contextType", opts.contextType)
+		} else {
+			instructions, err := readDockerfile(filepath.Join(opts.clonePath, opts.dockerfile))
+			if err != nil {
+				return opts.outputs.writeFailed(newStepError(BUILD_ERROR, fmt.Errorf("error reading dockerfile: %s", err)))
+			}
+			resolvedBuildArgs = appendGitBuildArgs(resolvedBuildArgs, instructions, revisionHash, "", time.Now())
+		}
+	}
+
+	imageLabels, err := getImageLabels(opts.clonePath, revisionHash, "", opts.labels, opts.ociLabels)
 	if err != nil {
-		return fmt.Errorf("error checking skip status: %s", err)
+		return opts.outputs.writeFailed(newStepError(FLAG_ERROR, fmt.Errorf("error processing labels: %s", err)))
 	}
-	if skipped {
-		fmt.Println("Build is skipped. Exiting early")
-		return nil
+	if contentHash != "" {
+		imageLabels = append(imageLabels, fmt.Sprintf("%s=%s", CONTENT_HASH_LABEL, contentHash))
 	}
-	fmt.Println("Continuing build")
 
-	// Build the PR image
-	kanikoArgs := []string{
-		KANIKO_NAME,
-		fmt.Sprintf("--dockerfile=%s/%s", clonePath, dockerfile),
-		fmt.Sprintf("--context=dir://%s/%s", clonePath, dockerContextDir),
-		"--no-push",
-	}
-	fmt.Printf(
-		"Starting image build for PR using %s with args %s\n",
-		KANIKO_PATH,
-		kanikoArgs,
+	buildCtx, err := getBuildContext(
+		opts.contextType,
+		opts.contextSource,
+		opts.clonePath,
+		opts.dockerfile,
+		opts.dockerContextDir,
+		"",
+		"",
 	)
-	err = syscall.Exec(KANIKO_PATH, kanikoArgs, os.Environ())
 	if err != nil {
-		panic(err)
+		return opts.outputs.writeFailed(withDefaultClass(FLAG_ERROR, err))
 	}
 
-	return nil
+	// Build the PR image
+	resultDigestFile := getResultDigestFile("", opts.outputs)
+	spec := buildSpec{
+		context:     buildCtx,
+		tarPath:     opts.tarPath,
+		digestFile:  resultDigestFile,
+		buildArgs:   resolvedBuildArgs,
+		secretFiles: opts.secretFiles,
+		labels:      imageLabels,
+		target:      opts.target,
+		kanikoOpts:  opts.kaniko,
+	}
+	if opts.tarPath != "" {
+		// The image is named in the tarball, but not pushed
+		spec.destinations = []string{opts.tarImage}
+	}
+
+	// Check the policies against the resolved build spec before the expensive build
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = opts.policy.check(context.Background(), "pr", opts.clonePath, opts.dockerfile, spec, nil, redactor)
+		if err != nil {
+			// The usage is not relevant for policy violations
+			cmd.SilenceUsage = true
+			return opts.outputs.writeFailed(err)
+		}
+	} else if len(opts.policy.policyDirs) > 0 {
+		slog.Info("Skipping the policy check for the context type", "contextType", opts.contextType)
+	}
+	buildCommand, err := opts.builder.command(spec)
+	if err != nil {
+		return opts.outputs.writeFailed(withDefaultClass(FLAG_ERROR, err))
+	}
+	if opts.dryRun {
+		slog.Info("Dry run is set. Exiting without building")
+		logBuilderCommand(slog.LevelInfo, buildCommand, redactor)
+		return nil
+	}
+
+	// The usage is not relevant for build errors
+	cmd.SilenceUsage = true
+	postBuildHooks := []postBuildHook{
+		logBuildOutcome,
+		opts.outputs.hook(),
+		writeContentHashHook(opts.contentHashFile, contentHash),
+		generateSbomHook(opts.sbom, opts.tarPath, nil, nil, false),
+	}
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+	if opts.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.timeout, errBuildTimeout)
+		defer cancel()
+	}
+
+	outcome := runPrBuild(ctx, opts.builder, spec, opts.tarImage, opts.checks(), redactor)
+	outcome.contentHash = contentHash
+	outcome.baseImagePins = baseImagePins
+	if resultDigestFile != "" {
+		os.Remove(resultDigestFile)
+	}
+	return runPostBuildHooks(postBuildHooks, outcome)
 }
 
 func handleCommitCmd(cmd *cobra.Command, args []string) error {
 	// Parse command flags
-	commitFlags := cmd.Flags()
-
-	clonePath, err := commitFlags.GetString("clone-path")
+	opts, err := getCommitOptions(cmd.Flags())
 	if err != nil {
-		return fmt.Errorf("error processing commit clone-path flag")
+		return opts.outputs.writeFailed(withDefaultClass(FLAG_ERROR, err))
 	}
 
-	revisionHash, err := commitFlags.GetString("revision-hash")
+	// Log command flags, with the sensitive values masked
+	redactor := opts.getRedactor()
+	slog.Info("Commmit build with params", opts.logAttrs(redactor)...)
+
+	// Add the build fields to the following JSON log records
+	imageName := fmt.Sprintf("%s%s%s", opts.imageRegistry, opts.imageRepo, opts.dockerfileDir)
+	slog.SetDefault(slog.Default().With("image", imageName, "revision", opts.revisionHash))
+
+	// Check status file and skip build if necessary
+	skipped, skipReason, err := shouldSkipBuild(opts.statusFiles, opts.statusCombine, opts.force)
 	if err != nil {
-		return fmt.Errorf("error processing commit revision-hash flag")
+		err = newStepError(SKIP_CHECK_ERROR, fmt.Errorf("error checking skip status: %s", err))
+		return opts.outputs.writeFailed(err)
+	}
+	if skipped {
+		slog.Info("Build is skipped. Exiting early", "reason", skipReason)
+		return opts.outputs.write(buildResult{Status: SKIPPED_STATUS, SkipReason: skipReason})
 	}
+	slog.Info("Continuing build")
 
-	revisionRef, err := commitFlags.GetString("revision-ref")
-	if err != nil {
-		return fmt.Errorf("error processing commit revision-ref flag")
+	// Lint the dockerfile before the expensive build
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = runLint(opts.lintMode, filepath.Join(opts.clonePath, opts.dockerfile))
+		if err != nil {
+			return opts.outputs.writeFailed(err)
+		}
+	} else if opts.lintMode != LINT_MODE_OFF {
+		slog.Info("Skipping lint for the context type", "contextType", opts.contextType)
 	}
 
-	dockerfile, err := commitFlags.GetString("dockerfile")
-	if err != nil {
-		return fmt.Errorf("error processing commit dockerfile flag")
+	// Check the base image registries before any of them are pulled
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = opts.policy.checkBaseRegistries(filepath.Join(opts.clonePath, opts.dockerfile))
+		if err != nil {
+			// The usage is not relevant for policy violations
+			cmd.SilenceUsage = true
+			return opts.outputs.writeFailed(err)
+		}
+	} else if len(opts.policy.allowedBaseRegistries) > 0 {
+		slog.Info("Skipping the base registry check for the context type", "contextType", opts.contextType)
 	}
 
-	dockerContextDir, err := commitFlags.GetString("docker-context-dir")
+	// Check the remote downloads before the build runs them
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = opts.remoteContent.check(filepath.Join(opts.clonePath, opts.dockerfile))
+		if err != nil {
+			// The usage is not relevant for policy violations
+			cmd.SilenceUsage = true
+			return opts.outputs.writeFailed(err)
+		}
+	} else if opts.remoteContent.mode != REMOTE_CONTENT_MODE_OFF {
+		slog.Info("Skipping the remote content check for the context type", "contextType", opts.contextType)
+	}
+
+	// Check the docker context before the builder reads it
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = opts.contextSize.check(filepath.Join(opts.clonePath, opts.dockerContextDir))
+		if err != nil {
+			// The usage is not relevant for policy violations
+			cmd.SilenceUsage = true
+			return opts.outputs.writeFailed(err)
+		}
+	} else if opts.contextSize.enabled() {
+		slog.Info("Skipping the docker context check for the context type", "contextType", opts.contextType)
+	}
+
+	// Log in to the registries before the registry checks and the build
+	err = opts.registryAuth.login(context.Background(), append([]string{opts.imageRegistry}, opts.extraDestinationRegistries...)...)
 	if err != nil {
-		return fmt.Errorf("error processing commit docker-context-dir flag")
+		// The usage is not relevant for registry errors
+		cmd.SilenceUsage = true
+		return opts.outputs.writeFailed(err)
 	}
 
-	statusFile, err := commitFlags.GetString("status-file")
+	resolvedBuildArgs, err := getBuildArgs(opts.buildArgs, opts.buildArgEnvs)
 	if err != nil {
-		return fmt.Errorf("error processing commit status-file flag")
+		return opts.outputs.writeFailed(newStepError(FLAG_ERROR, fmt.Errorf("error processing build args: %s", err)))
+	}
+
+	// Pin the base images before the content hash, so a moved tag changes the content hash
+	var baseImagePins map[string]string
+	if opts.pinBaseImages {
+		if opts.contextType != DIR_CONTEXT_TYPE {
+			slog.Info("Skipping the base image pinning for the context type", "contextType", opts.contextType)
+		} else {
+			baseImagePins, err = pinBaseImages(
+				context.Background(),
+				filepath.Join(opts.clonePath, opts.dockerfile),
+				opts.registry.insecureRegistries,
+				opts.registry.skipTlsVerifyPull,
+			)
+			if err != nil {
+				// The usage is not relevant for registry errors
+				cmd.SilenceUsage = true
+				return opts.outputs.writeFailed(newStepError(REGISTRY_PREFLIGHT_ERROR, fmt.Errorf("error pinning base images: %w", err)))
+			}
+		}
 	}
 
-	imageRegistry, err := commitFlags.GetString("image-registry")
+	// Verify the base images after the pinning, so the pinned digests are verified
+	if opts.verify.enabled {
+		if opts.contextType != DIR_CONTEXT_TYPE {
+			slog.Info("Skipping the base image verification for the context type", "contextType", opts.contextType)
+		} else {
+			err = opts.verify.verifyBaseImages(
+				context.Background(),
+				filepath.Join(opts.clonePath, opts.dockerfile),
+				opts.registry.insecureRegistries,
+				opts.registry.skipTlsVerifyPull,
+			)
+			if err != nil {
+				// The usage is not relevant for verification errors
+				cmd.SilenceUsage = true
+				return opts.outputs.writeFailed(err)
+			}
+		}
+	}
+
+	// Skip the build if the build inputs did not change since the last successful build
+	contentHash := ""
+	contentUnchanged := false
+	if opts.contentHashFile != "" || opts.contentHashImage != "" {
+		if opts.contextType != DIR_CONTEXT_TYPE {
+			slog.Info("Skipping the content hash check for the context type", "contextType", opts.contextType)
+		} else {
+			var unchanged bool
+			contentHash, unchanged, err = checkContentHash(
+				filepath.Join(opts.clonePath, opts.dockerfile),
+				filepath.Join(opts.clonePath, opts.dockerContextDir),
+				resolvedBuildArgs,
+				opts.target,
+				opts.contentHashFile,
+				opts.contentHashImage,
+				opts.registry.insecureRegistries,
+			)
+			if err != nil {
+				err = newStepError(SKIP_CHECK_ERROR, fmt.Errorf("error checking content hash: %s", err))
+				return opts.outputs.writeFailed(err)
+			}
+			// The image of the last successful build is tagged for the
+			// revision once the destinations are known
+			contentUnchanged = unchanged && !opts.force
+		}
+	}
+
+	// The git build args are added after the content hash, since they change on every build
+	if opts.gitBuildArgs {
+		if opts.contextType != DIR_CONTEXT_TYPE {
+			slog.Info("Skipping the git build args for the context type", "contextType", opts.contextType)
+		} else {
+			instructions, err := readDockerfile(filepath.Join(opts.clonePath, opts.dockerfile))
+			if err != nil {
+				return opts.outputs.writeFailed(newStepError(BUILD_ERROR, fmt.Errorf("error reading dockerfile: %s", err)))
+			}
+			resolvedBuildArgs = appendGitBuildArgs(resolvedBuildArgs, instructions, opts.revisionHash, opts.revisionRef, time.Now())
+		}
+	}
+
+	imageLabels, err := getImageLabels(opts.clonePath, opts.revisionHash, opts.revisionRef, opts.labels, opts.ociLabels)
 	if err != nil {
-		return fmt.Errorf("error processing commit image-registry flag")
+		return opts.outputs.writeFailed(newStepError(FLAG_ERROR, fmt.Errorf("error processing labels: %s", err)))
+	}
+	if contentHash != "" {
+		imageLabels = append(imageLabels, fmt.Sprintf("%s=%s", CONTENT_HASH_LABEL, contentHash))
 	}
 
-	imageRepo, err := commitFlags.GetString("image-repo")
+	buildCtx, err := getBuildContext(
+		opts.contextType,
+		opts.contextSource,
+		opts.clonePath,
+		opts.dockerfile,
+		opts.dockerContextDir,
+		opts.revisionRef,
+		opts.revisionHash,
+	)
 	if err != nil {
-		return fmt.Errorf("error processing commit image-repo flag")
+		return opts.outputs.writeFailed(withDefaultClass(FLAG_ERROR, err))
 	}
 
-	dockerfileDir, err := commitFlags.GetString("dockerfile-dir")
+	tagTemplateData := getTagTemplateData(opts.clonePath, opts.revisionHash, opts.revisionRef)
+	imageTag, err := renderTagTemplate(opts.tagTemplate, tagTemplateData)
 	if err != nil {
-		return fmt.Errorf("error processing commit dockerfile-dir flag")
+		return opts.outputs.writeFailed(withDefaultClass(FLAG_ERROR, err))
 	}
+	slog.Info("Using image tag", "imageTag", imageTag)
 
-	// Print command flags
-	fmt.Printf("Commmit build with params:\n")
-	fmt.Printf("- clonePath: %s\n", clonePath)
-	fmt.Printf("- revisionHash: %s\n", revisionHash)
-	fmt.Printf("- revisionRef: %s\n", revisionRef)
-	fmt.Printf("- dockerfile: %s\n", dockerfile)
-	fmt.Printf("- dockerContextDir: %s\n", dockerContextDir)
-	fmt.Printf("- statusFile: %s\n", statusFile)
-	fmt.Printf("- imageRegistry: %s\n", imageRegistry)
-	fmt.Printf("- imageRepo: %s\n", imageRepo)
-	fmt.Printf("- dockerfileDir: %s\n", dockerfileDir)
+	// Skip the build if the image was already pushed (e.g. on a workflow retry)
+	imageRef := fmt.Sprintf("%s:%s", imageName, imageTag)
+	if opts.skipIfExists && !opts.force {
+		digest, exists, err := getRemoteImageDigest(imageRef, opts.registry.insecureRegistries)
+		if err != nil {
+			slog.Warn("Unable to check whether the image exists. Continuing build", "error", err)
+		} else if exists {
+			slog.Info("Image already exists in the registry. Exiting early", "image", imageRef, "digest", digest)
+			return opts.outputs.write(buildResult{
+				Status:     SKIPPED_STATUS,
+				SkipReason: "The image already exists in the registry",
+				Image:      imageRef,
+				Digest:     digest,
+			})
+		}
+	}
 
-	// Check status file and skip build if necessary
-	skipped, err := isBuildSkipped(statusFile)
+	// Build the commit image
+	destinations := []string{imageRef}
+	for _, additionalTag := range opts.additionalTags {
+		destinations = append(destinations, fmt.Sprintf("%s:%s", imageName, additionalTag))
+	}
+	// The same image is pushed to the extra registries
+	extraImageNames := []string{}
+	for _, extraDestinationRegistry := range opts.extraDestinationRegistries {
+		extraImageName := fmt.Sprintf("%s%s%s", extraDestinationRegistry, opts.imageRepo, opts.dockerfileDir)
+		extraImageNames = append(extraImageNames, extraImageName)
+		for _, tag := range append([]string{imageTag}, opts.additionalTags...) {
+			destinations = append(destinations, fmt.Sprintf("%s:%s", extraImageName, tag))
+		}
+	}
+
+	// The image tag is immutable with no overwrite, so a revision hash
+	// collision or a manual push is not silently overwritten
+	if opts.noOverwrite {
+		imageTagRefs := []string{imageRef}
+		for _, extraImageName := range extraImageNames {
+			imageTagRefs = append(imageTagRefs, fmt.Sprintf("%s:%s", extraImageName, imageTag))
+		}
+		err = checkTagsNotExist(imageTagRefs, opts.registry.insecureRegistries)
+		if err != nil {
+			// The usage is not relevant for registry errors
+			cmd.SilenceUsage = true
+			return opts.outputs.writeFailed(err)
+		}
+	}
+
+	// The build inputs did not change, so the image of the last successful
+	// build is tagged for the revision instead of a new build
+	if contentUnchanged {
+		slog.Info("Content hash matches the last successful build. Skipping the build", "contentHash", contentHash)
+		// The usage is not relevant for registry errors
+		cmd.SilenceUsage = true
+		image, digest, err := tagUnchangedImage(
+			context.Background(),
+			opts.contentHashImage,
+			contentHash,
+			destinations,
+			opts.registry,
+			opts.dryRun,
+		)
+		if err != nil {
+			return opts.outputs.writeFailed(err)
+		}
+		return opts.outputs.write(buildResult{
+			Status:      SKIPPED_STATUS,
+			SkipReason:  "The build inputs did not change since the last successful build",
+			Image:       image,
+			Digest:      digest,
+			ContentHash: contentHash,
+		})
+	}
+	resultDigestFile := getResultDigestFile(opts.digestFile, opts.outputs)
+	build := commitBuild{
+		imageName: imageName,
+		imageRef:  imageRef,
+		imageSpec: buildSpec{
+			context:      buildCtx,
+			destinations: destinations,
+			push:         true,
+			cleanup:      true,
+			digestFile:   resultDigestFile,
+			imageRefFile: opts.imageRefFile,
+			buildArgs:    resolvedBuildArgs,
+			secretFiles:  opts.secretFiles,
+			labels:       imageLabels,
+			target:       opts.target,
+			registry:     opts.registry,
+			kanikoOpts:   opts.kaniko,
+		},
+		platforms:      opts.multiPlatforms,
+		platformImages: map[string]string{},
+		// The commit integration test image
+		testImageSpec: buildSpec{
+			context:      buildCtx,
+			destinations: []string{fmt.Sprintf("%s-integration-test:%s", imageName, imageTag)},
+			push:         true,
+			buildArgs:    resolvedBuildArgs,
+			secretFiles:  opts.secretFiles,
+			labels:       imageLabels,
+			target:       "integration-test",
+			registry:     opts.registry,
+			kanikoOpts:   opts.kaniko,
+		},
+		digestFile:   opts.digestFile,
+		imageRefFile: opts.imageRefFile,
+		encrypt:      opts.encrypt,
+		registry:     opts.registry,
+		checks:       opts.checks(),
+	}
+
+	// For multi platform builds, each platform image is pushed with a
+	// platform tag. The image index is then pushed to the image tags
+	for _, platform := range opts.multiPlatforms {
+		platformImage := fmt.Sprintf("%s:%s", imageName, getPlatformTag(imageTag, platform))
+		build.platformImages[platform] = platformImage
+		build.platformSpecs = append(build.platformSpecs, buildSpec{
+			context:      buildCtx,
+			destinations: []string{platformImage},
+			push:         true,
+			cleanup:      true,
+			buildArgs:    resolvedBuildArgs,
+			secretFiles:  opts.secretFiles,
+			labels:       imageLabels,
+			target:       opts.target,
+			platform:     platform,
+			registry:     opts.registry,
+			kanikoOpts:   opts.kaniko,
+		})
+	}
+
+	// With encryption, or when the image is checked, the image is written to
+	// the tarball, and pushed by skopeo after the checks pass
+	if opts.tarPath != "" {
+		build.imageSpec.push = false
+		build.imageSpec.tarPath = opts.tarPath
+		build.imageSpec.digestFile = ""
+		build.imageSpec.imageRefFile = ""
+		defer os.Remove(opts.tarPath)
+	}
+	// With encryption, the integration test image is also pushed from the
+	// tarball, which is reused, since the commit image was already pushed
+	if opts.encrypt.enabled() {
+		build.testImageSpec.push = false
+		build.testImageSpec.tarPath = opts.tarPath
+	}
+
+	// Check the policies against the resolved build spec before the expensive build
+	if opts.contextType == DIR_CONTEXT_TYPE {
+		err = opts.policy.check(context.Background(), "commit", opts.clonePath, opts.dockerfile, build.imageSpec, opts.multiPlatforms, redactor)
+		if err != nil {
+			// The usage is not relevant for policy violations
+			cmd.SilenceUsage = true
+			return opts.outputs.writeFailed(err)
+		}
+	} else if len(opts.policy.policyDirs) > 0 {
+		slog.Info("Skipping the policy check for the context type", "contextType", opts.contextType)
+	}
+
+	buildImgCommand, err := opts.builder.command(build.imageSpec)
 	if err != nil {
-		return fmt.Errorf("error checking skip status: %s", err)
+		return opts.outputs.writeFailed(withDefaultClass(FLAG_ERROR, err))
 	}
-	if skipped {
-		fmt.Println("Build is skipped. Exiting early")
+	platformImgCommands := []builderCommand{}
+	for _, platformImgSpec := range build.platformSpecs {
+		platformImgCommand, err := opts.builder.command(platformImgSpec)
+		if err != nil {
+			return opts.outputs.writeFailed(withDefaultClass(FLAG_ERROR, err))
+		}
+		platformImgCommands = append(platformImgCommands, platformImgCommand)
+	}
+	buildTestImgCommand, err := opts.builder.command(build.testImageSpec)
+	if err != nil {
+		return opts.outputs.writeFailed(withDefaultClass(FLAG_ERROR, err))
+	}
+
+	if opts.dryRun {
+		slog.Info("Dry run is set. Exiting without building")
+		if len(opts.multiPlatforms) == 0 {
+			logBuilderCommand(slog.LevelInfo, buildImgCommand, redactor)
+		}
+		for _, platformImgCommand := range platformImgCommands {
+			logBuilderCommand(slog.LevelInfo, platformImgCommand, redactor)
+		}
+		logBuilderCommand(slog.LevelInfo, buildTestImgCommand, redactor)
 		return nil
 	}
-	fmt.Println("Continuing build")
 
-	// Build the commit image
-	buildImgArgs := []string{
-		KANIKO_NAME,
-		fmt.Sprintf("--dockerfile=%s/%s", clonePath, dockerfile),
-		fmt.Sprintf("--context=dir://%s/%s", clonePath, dockerContextDir),
-		fmt.Sprintf(
-			"--destination=%s%s%s:%s",
-			imageRegistry,
-			imageRepo,
-			dockerfileDir,
-			revisionHash,
-		),
-		"--cleanup",
-	}
-	fmt.Printf(
-		"Starting image build for commit using %s with args %s\n",
-		KANIKO_PATH,
-		buildImgArgs,
-	)
+	// The usage is not relevant for build errors
+	cmd.SilenceUsage = true
 
-	buildImgCmd := exec.Cmd{
-		Path:   KANIKO_PATH,
-		Args:   buildImgArgs,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+	// Create the image repos before the push, since ECR does not create them on push
+	pushImageNames := append([]string{imageName, fmt.Sprintf("%s-integration-test", imageName)}, extraImageNames...)
+	if opts.ecrCreateRepository {
+		ecrImageNames := []string{}
+		for _, pushImageName := range pushImageNames {
+			if opts.registryAuth.registryMode(getRegistryHost(pushImageName)) == ECR_REGISTRY_AUTH {
+				ecrImageNames = append(ecrImageNames, pushImageName)
+			}
+		}
+		err = createEcrRepositories(context.Background(), ecrImageNames, opts.ecrLifecyclePolicy)
+		if err != nil {
+			return opts.outputs.writeFailed(newStepError(REGISTRY_AUTH_ERROR, err))
+		}
 	}
-	err = buildImgCmd.Run()
-	if err != nil {
-		return fmt.Errorf("Image build for commit failed: %s", err)
+
+	// Check the registry before the build, which may take a while to fail on push
+	if opts.registryPreflight {
+		err = checkRegistryPush(context.Background(), pushImageNames, opts.registry.insecureRegistries, opts.registry.skipTlsVerify)
+		if err != nil {
+			return opts.outputs.writeFailed(err)
+		}
+	}
+	postBuildHooks := []postBuildHook{
+		logBuildOutcome,
+		// The image is signed before the result is written, so the result
+		// has the transparency log entries
+		signImageHook(opts.sign, opts.signing, append([]string{imageName}, extraImageNames...), opts.registry.insecureRegistries, opts.registry.skipTlsVerify),
+		opts.outputs.hook(),
+		writeContentHashHook(opts.contentHashFile, contentHash),
+		writeLayerReportHook(opts.layerReportFile, opts.registry.insecureRegistries, opts.registry.skipTlsVerify),
+		generateSbomHook(opts.sbom, "", append([]string{imageName}, extraImageNames...), opts.registry.insecureRegistries, opts.registry.skipTlsVerify),
 	}
 
-	// Build the commit integration test image
-	buildTestImgArgs := []string{
-		KANIKO_NAME,
-		fmt.Sprintf("--dockerfile=%s/%s", clonePath, dockerfile),
-		fmt.Sprintf("--context=dir://%s/%s", clonePath, dockerContextDir),
-		fmt.Sprintf(
-			"--destination=%s%s%s-integration-test:%s",
-			imageRegistry,
-			imageRepo,
-			dockerfileDir,
-			revisionHash,
-		),
-		"--target=integration-test",
-	}
-	fmt.Printf(
-		"Starting integration test image build for commit using %s with args %s\n",
-		KANIKO_PATH,
-		buildTestImgArgs,
-	)
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+	if opts.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.timeout, errBuildTimeout)
+		defer cancel()
+	}
+
+	outcome := runCommitBuild(ctx, opts.builder, build, redactor)
+	outcome.contentHash = contentHash
+	outcome.baseImagePins = baseImagePins
+	if resultDigestFile != opts.digestFile {
+		os.Remove(resultDigestFile)
+	}
+	return runPostBuildHooks(postBuildHooks, outcome)
+}
+
+// Returns the kaniko path to use. The kaniko-path flag takes precedence
+// over the environment variable, which takes precedence over the default
+func resolveKanikoPath(kanikoPathFlag string) string {
+	if kanikoPathFlag != "" {
+		return kanikoPathFlag
+	}
+	if kanikoPathEnv := os.Getenv(KANIKO_PATH_ENV); kanikoPathEnv != "" {
+		return kanikoPathEnv
+	}
+	return DEFAULT_KANIKO_PATH
+}
+
+// The content of the status file written by the diff check. The status
+// file is either the plain status (e.g. Skipped), or a JSON document with
+// the reason metadata
+type statusFileContent struct {
+	Status string `json:"status"`
+	// Why the status was chosen (e.g. no changes in the docker context dir)
+	Reason string `json:"reason,omitempty"`
+	// The changed paths that drove the decision
+	ChangedPaths []string `json:"changedPaths,omitempty"`
+}
+
+// Returns whether the build should be skipped based on the status files,
+// and the reasons from the skipped status files. The status files are
+// combined with the status combine mode. If force is set, the skip
+// decision from the status files is overridden
+func shouldSkipBuild(statusFiles []string, statusCombine string, force bool) (bool, string, error) {
+	skipped, reason, err := combineStatusFiles(statusFiles, statusCombine)
+	if !force {
+		return skipped, reason, err
+	}
 
-	err = syscall.Exec(KANIKO_PATH, buildTestImgArgs, os.Environ())
 	if err != nil {
-		panic(err)
+		slog.Warn("Ignoring error checking skip status due to the force flag", "error", err)
+	} else if skipped {
+		slog.Info("Status file is set to Skipped, but the skip is overridden by the force flag")
 	}
+	return false, "", nil
+}
 
-	return nil
+// Returns whether the combined status files are Skipped, and the reasons
+// from the skipped status files
+func combineStatusFiles(statusFiles []string, statusCombine string) (bool, string, error) {
+	skippedCount := 0
+	reasons := []string{}
+	for _, statusFile := range statusFiles {
+		skipped, reason, err := isBuildSkipped(statusFile)
+		if err != nil {
+			return false, "", fmt.Errorf("%s: %s", statusFile, err)
+		}
+		if skipped {
+			skippedCount++
+			if reason != "" {
+				reasons = append(reasons, reason)
+			}
+		}
+	}
+
+	skipped := skippedCount > 0
+	if statusCombine == STATUS_COMBINE_ALL {
+		skipped = skippedCount == len(statusFiles)
+	}
+	if !skipped {
+		return false, "", nil
+	}
+	return true, strings.Join(reasons, "; "), nil
 }
 
-func isBuildSkipped(statusFile string) (bool, error) {
-	fmt.Println("Checking status file for skipped status")
+func isBuildSkipped(statusFile string) (bool, string, error) {
+	slog.Info("Checking status file for skipped status", "statusFile", statusFile)
 
 	bytes, err := os.ReadFile(statusFile)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
-			fmt.Println("Continuing build due to no status file found")
-			return false, nil
+			slog.Info("Continuing build due to no status file found")
+			return false, "", nil
 		}
-		return false, err
+		return false, "", err
 	}
-	skippedStatus := strings.TrimSpace(string(bytes))
-	return skippedStatus == SKIPPED_STATUS, nil
+
+	content := statusFileContent{Status: strings.TrimSpace(string(bytes))}
+	if strings.HasPrefix(content.Status, "{") {
+		content = statusFileContent{}
+		err = json.Unmarshal(bytes, &content)
+		if err != nil {
+			return false, "", fmt.Errorf("error parsing status file: %s", err)
+		}
+	}
+	slog.Info(
+		"Read status file",
+		"status", content.Status,
+		"reason", content.Reason,
+		"changedPaths", content.ChangedPaths,
+	)
+	return content.Status == SKIPPED_STATUS, content.Reason, nil
+}
+
+// Returns the build args, with the build arg envs appended. The build args
+// are expected in the format KEY=VALUE. The build arg envs are the names
+// of environment variables whose values are used
+func getBuildArgs(buildArgs []string, buildArgEnvs []string) ([]string, error) {
+	resolvedBuildArgs := make([]string, 0, len(buildArgs)+len(buildArgEnvs))
+
+	for _, buildArg := range buildArgs {
+		key, _, found := strings.Cut(buildArg, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("build arg must be in the format KEY=VALUE: %s", buildArg)
+		}
+		resolvedBuildArgs = append(resolvedBuildArgs, buildArg)
+	}
+
+	for _, buildArgEnv := range buildArgEnvs {
+		value, found := os.LookupEnv(buildArgEnv)
+		if !found {
+			return nil, fmt.Errorf("build arg env is not set: %s", buildArgEnv)
+		}
+		resolvedBuildArgs = append(resolvedBuildArgs, fmt.Sprintf("%s=%s", buildArgEnv, value))
+	}
+
+	return resolvedBuildArgs, nil
+}
+
+// Returns the labels for the image in the format KEY=VALUE. The standard OCI
+// labels are derived from the revision and the cloned repo. The custom
+// labels are expected in the format KEY=VALUE and take precedence
+// See https://github.com/opencontainers/image-spec/blob/main/annotations.md
+func getImageLabels(
+	clonePath string,
+	revisionHash string,
+	revisionRef string,
+	labels []string,
+	ociLabels bool,
+) ([]string, error) {
+	customLabelKeys := map[string]bool{}
+	for _, label := range labels {
+		key, _, found := strings.Cut(label, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("label must be in the format KEY=VALUE: %s", label)
+		}
+		customLabelKeys[key] = true
+	}
+
+	imageLabels := []string{}
+	addOciLabel := func(key string, value string) {
+		if value == "" || customLabelKeys[key] {
+			return
+		}
+		imageLabels = append(imageLabels, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	if ociLabels {
+		sourceUrl := ""
+		if clonePath != "" {
+			var err error
+			sourceUrl, err = getGitOriginUrl(clonePath)
+			if err != nil {
+				slog.Warn("Unable to read the source url from the clone", "error", err)
+			}
+		}
+		addOciLabel("org.opencontainers.image.revision", revisionHash)
+		addOciLabel("org.opencontainers.image.source", sourceUrl)
+		addOciLabel("org.opencontainers.image.created", time.Now().UTC().Format(time.RFC3339))
+		addOciLabel("org.opencontainers.image.ref.name", revisionRef)
+	}
+
+	imageLabels = append(imageLabels, labels...)
+
+	return imageLabels, nil
 }
 
 func main() {
 	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
 	if err := mainCmd.Execute(); err != nil {
-		fmt.Printf("error executing command: %s\n", err)
-		os.Exit(1)
+		slog.Error("Error executing command", "error", err, "errorClass", getErrorClass(err))
+		// Errors not classified by the subcommands are from the cobra
+		// flag and arg validation
+		if getErrorClass(err) == "" {
+			err = newStepError(FLAG_ERROR, err)
+		}
+		os.Exit(getExitCode(err))
 	}
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// The path of the build matrix file, relative to the clone path
+	DEFAULT_MATRIX_FILE = ".jettison/builds.yaml"
+)
+
+// The build matrix file, which declares the images built from a repo
+type buildMatrix struct {
+	Builds []matrixBuild `yaml:"builds"`
+}
+
+// An image in the build matrix file
+type matrixBuild struct {
+	Name          string   `yaml:"name"`
+	Dockerfile    string   `yaml:"dockerfile"`
+	Context       string   `yaml:"context"`
+	DockerfileDir string   `yaml:"dockerfile-dir"`
+	BuildArgs     []string `yaml:"build-args"`
+	Tags          []string `yaml:"tags"`
+	// The globs of the paths that trigger the build when changed. Defaults
+	// to the dockerfile and the context
+	Paths []string `yaml:"paths"`
+	// The names of the builds that are built and pushed before this build,
+	// such as a shared base image
+	DependsOn []string `yaml:"depends-on"`
+}
+
+func handleMatrixCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	matrixFlags := cmd.Flags()
+
+	mode, err := matrixFlags.GetString("mode")
+	if err != nil {
+		return fmt.Errorf("error processing matrix mode flag")
+	}
+	if !slices.Contains(batchModes, mode) {
+		return fmt.Errorf("mode must be one of %s: %s", batchModes, mode)
+	}
+
+	clonePath, err := matrixFlags.GetString("clone-path")
+	if err != nil {
+		return fmt.Errorf("error processing matrix clone-path flag")
+	}
+
+	matrixFile, err := matrixFlags.GetString("matrix-file")
+	if err != nil {
+		return fmt.Errorf("error processing matrix matrix-file flag")
+	}
+	if matrixFile == "" {
+		matrixFile = filepath.Join(clonePath, DEFAULT_MATRIX_FILE)
+	}
+
+	changedPaths, err := matrixFlags.GetStringArray("changed-path")
+	if err != nil {
+		return fmt.Errorf("error processing matrix changed-path flag")
+	}
+
+	changedPathsFile, err := matrixFlags.GetString("changed-paths-file")
+	if err != nil {
+		return fmt.Errorf("error processing matrix changed-paths-file flag")
+	}
+
+	concurrency, err := matrixFlags.GetInt("concurrency")
+	if err != nil {
+		return fmt.Errorf("error processing matrix concurrency flag")
+	}
+	if concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1: %d", concurrency)
+	}
+
+	reportFile, err := matrixFlags.GetString("report-file")
+	if err != nil {
+		return fmt.Errorf("error processing matrix report-file flag")
+	}
+
+	// Log command flags
+	slog.Info(
+		"Matrix build with params",
+		"mode", mode,
+		"clonePath", clonePath,
+		"matrixFile", matrixFile,
+		"changedPaths", changedPaths,
+		"changedPathsFile", changedPathsFile,
+		"concurrency", concurrency,
+		"reportFile", reportFile,
+		"args", args,
+	)
+
+	matrix, err := readBuildMatrix(matrixFile)
+	if err != nil {
+		return err
+	}
+
+	// All of the builds run if the changed paths are not set
+	filterChangedPaths := changedPathsFile != "" || len(changedPaths) > 0
+	if changedPathsFile != "" {
+		filePaths, err := readChangedPathsFile(changedPathsFile)
+		if err != nil {
+			return err
+		}
+		changedPaths = append(changedPaths, filePaths...)
+	}
+
+	selected := map[string]bool{}
+	for _, build := range matrix.Builds {
+		if filterChangedPaths {
+			changed, err := isMatrixBuildChanged(build, changedPaths)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				continue
+			}
+		}
+		selected[build.Name] = true
+	}
+	// The dependents of a selected build are also selected, so they are
+	// rebuilt with the fresh dependency
+	for added := true; added; {
+		added = false
+		for _, build := range matrix.Builds {
+			if !selected[build.Name] && slices.ContainsFunc(build.DependsOn, func(name string) bool { return selected[name] }) {
+				selected[build.Name] = true
+				added = true
+			}
+		}
+	}
+
+	builds := []batchBuild{}
+	for _, build := range matrix.Builds {
+		if !selected[build.Name] {
+			slog.Info("Skipping matrix build without changed paths", "build", build.Name)
+			continue
+		}
+		// Dependencies that are not rebuilt are not waited for
+		dependsOn := slices.DeleteFunc(slices.Clone(build.DependsOn), func(name string) bool { return !selected[name] })
+		builds = append(builds, batchBuild{
+			Name:             build.Name,
+			Dockerfile:       build.Dockerfile,
+			DockerContextDir: build.Context,
+			DockerfileDir:    build.DockerfileDir,
+			BuildArgs:        build.BuildArgs,
+			Tags:             build.Tags,
+			DependsOn:        dependsOn,
+		})
+	}
+	slog.Info("Selected matrix builds", "builds", getBatchBuildNames(builds), "total", len(matrix.Builds))
+
+	return runBatch(cmd, mode, clonePath, builds, args, concurrency, reportFile)
+}
+
+// Reads and validates the build matrix file. The context defaults to the
+// dir of the dockerfile, and the dockerfile dir defaults to "/" followed
+// by the context
+func readBuildMatrix(matrixFile string) (buildMatrix, error) {
+	matrix := buildMatrix{}
+	matrixBytes, err := os.ReadFile(matrixFile)
+	if err != nil {
+		return matrix, fmt.Errorf("error reading build matrix file: %s", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(matrixBytes))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&matrix)
+	if err != nil {
+		return matrix, fmt.Errorf("error parsing build matrix file %s: %s", matrixFile, err)
+	}
+	if len(matrix.Builds) == 0 {
+		return matrix, fmt.Errorf("build matrix file has no builds: %s", matrixFile)
+	}
+
+	names := map[string]bool{}
+	for i := range matrix.Builds {
+		build := &matrix.Builds[i]
+		if build.Dockerfile == "" {
+			return matrix, fmt.Errorf("build %d in the build matrix file must set the dockerfile", i)
+		}
+		if build.Context == "" {
+			build.Context = filepath.Dir(build.Dockerfile)
+		}
+		if build.DockerfileDir == "" && build.Context != "." {
+			build.DockerfileDir = "/" + filepath.ToSlash(build.Context)
+		}
+		if build.Name == "" {
+			build.Name = build.Dockerfile
+		}
+		if names[build.Name] {
+			return matrix, fmt.Errorf("duplicate build name in the build matrix file: %s", build.Name)
+		}
+		names[build.Name] = true
+		for _, tag := range build.Tags {
+			if !imageTagRegexp.MatchString(tag) {
+				return matrix, fmt.Errorf("tag of build %s is not a valid image tag: %s", build.Name, tag)
+			}
+		}
+	}
+	for _, build := range matrix.Builds {
+		for _, dependency := range build.DependsOn {
+			if !names[dependency] {
+				return matrix, fmt.Errorf("build %s depends on an unknown build: %s", build.Name, dependency)
+			}
+		}
+	}
+	return matrix, nil
+}
+
+// Reads the changed paths from a JSON status file with the changedPaths
+// field, or from a file with one path per line
+func readChangedPathsFile(changedPathsFile string) ([]string, error) {
+	fileBytes, err := os.ReadFile(changedPathsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading changed paths file: %s", err)
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(fileBytes)), "{") {
+		content := statusFileContent{}
+		err = json.Unmarshal(fileBytes, &content)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing changed paths file: %s", err)
+		}
+		return content.ChangedPaths, nil
+	}
+
+	changedPaths := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(fileBytes))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			changedPaths = append(changedPaths, line)
+		}
+	}
+	return changedPaths, scanner.Err()
+}
+
+// Returns whether any of the changed paths match the paths of the build
+func isMatrixBuildChanged(build matrixBuild, changedPaths []string) (bool, error) {
+	paths := build.Paths
+	if len(paths) == 0 {
+		paths = []string{build.Dockerfile, build.Context}
+	}
+	pathRegexps := []*regexp.Regexp{}
+	for _, path := range paths {
+		path = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path)), "/")
+		if path == "." {
+			// The build matches any change in the repo
+			return len(changedPaths) > 0, nil
+		}
+		pathRegexp, err := compileIgnorePattern(path)
+		if err != nil {
+			return false, err
+		}
+		pathRegexps = append(pathRegexps, pathRegexp)
+	}
+	for _, changedPath := range changedPaths {
+		changedPath = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(changedPath)), "/")
+		for _, pathRegexp := range pathRegexps {
+			if pathRegexp.MatchString(changedPath) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
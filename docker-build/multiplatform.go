@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Validates the platform format os/arch[/variant]
+func validatePlatform(platform string) error {
+	platformParts := strings.Split(platform, "/")
+	if len(platformParts) < 2 || len(platformParts) > 3 || slices.Contains(platformParts, "") {
+		return fmt.Errorf("platform must be in the format os/arch[/variant]: %s", platform)
+	}
+	return nil
+}
+
+// Returns the tag of the image for one platform of a multi platform
+// build (e.g. <tag>-linux-arm64)
+func getPlatformTag(imageTag string, platform string) string {
+	return fmt.Sprintf("%s-%s", imageTag, strings.ReplaceAll(platform, "/", "-"))
+}
+
+// Assembles an image index from the platform images, which were pushed
+// by kaniko, and pushes it to each of the destinations. Returns the
+// digest of the image index
+func pushImageIndex(
+	ctx context.Context,
+	platformImages map[string]string,
+	platforms []string,
+	destinations []string,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) (string, error) {
+	remoteOpts := getRemoteOptions(ctx, skipTlsVerify)
+
+	var index v1.ImageIndex = empty.Index
+	for i, platform := range platforms {
+		ref, err := parseImageReference(platformImages[platform], insecureRegistries)
+		if err != nil {
+			return "", err
+		}
+		image, err := remote.Image(ref, remoteOpts...)
+		if err != nil {
+			return "", fmt.Errorf("error reading the %s image: %s", platform, err)
+		}
+		parsedPlatform, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return "", err
+		}
+
+		// Match the index media type to the image manifests, since
+		// kaniko pushes docker manifests unless configured otherwise
+		if i == 0 {
+			mediaType, err := image.MediaType()
+			if err != nil {
+				return "", err
+			}
+			indexMediaType := types.OCIImageIndex
+			if mediaType == types.DockerManifestSchema2 {
+				indexMediaType = types.DockerManifestList
+			}
+			index = mutate.IndexMediaType(index, indexMediaType)
+		}
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        image,
+			Descriptor: v1.Descriptor{Platform: parsedPlatform},
+		})
+	}
+
+	for _, destination := range destinations {
+		ref, err := parseImageReference(destination, insecureRegistries)
+		if err != nil {
+			return "", err
+		}
+		slog.Info("Pushing image index", "destination", destination, "platforms", platforms)
+		err = remote.WriteIndex(ref, index, remoteOpts...)
+		if err != nil {
+			return "", fmt.Errorf("error pushing the image index to %s: %s", destination, err)
+		}
+	}
+
+	digest, err := index.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// Writes the digest and the image reference with the digest for a multi
+// platform build, which kaniko writes for single platform builds
+func writeImageIndexFiles(digestFile string, imageRefFile string, imageRef string, digest string) error {
+	if digestFile != "" {
+		err := os.WriteFile(digestFile, []byte(digest), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing digest file: %s", err)
+		}
+	}
+	if imageRefFile != "" {
+		err := os.WriteFile(imageRefFile, []byte(fmt.Sprintf("%s@%s", imageRef, digest)), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing image ref file: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The image user is not checked
+	NON_ROOT_MODE_OFF = "off"
+	// A root image user is logged, but does not fail the build
+	NON_ROOT_MODE_WARN = "warn"
+	// A root image user fails the build
+	NON_ROOT_MODE_ERROR = "error"
+)
+
+// The supported non root modes
+var nonRootModes = []string{NON_ROOT_MODE_OFF, NON_ROOT_MODE_WARN, NON_ROOT_MODE_ERROR}
+
+// The options for checking that the built image does not run as root.
+// The user is read from the config of the built image, so it reflects the
+// final USER of the target stage, including the USER of the base image
+type nonRootOptions struct {
+	mode string
+	// The image repos that are allowed to run as root (e.g. a privileged
+	// node agent)
+	allowedImages []string
+}
+
+func configureNonRootFlags(flags *pflag.FlagSet) {
+	flags.String(
+		"non-root",
+		NON_ROOT_MODE_OFF,
+		fmt.Sprintf(
+			"The mode of the check that the built image does not run as root. One of %s. The image runs as root if "+
+				"the final USER is root, 0, or unset", nonRootModes))
+	flags.StringArray(
+		"root-allowed-image",
+		nil,
+		"An image repo that is allowed to run as root (e.g. registry.example.com/node-agent). Can be repeated")
+}
+
+func getNonRootOptions(flags *pflag.FlagSet, cmdName string) (nonRootOptions, error) {
+	var opts nonRootOptions
+	var err error
+
+	opts.mode, err = flags.GetString("non-root")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s non-root flag", cmdName)
+	}
+	if !slices.Contains(nonRootModes, opts.mode) {
+		return opts, fmt.Errorf("non-root must be one of %s: %s", nonRootModes, opts.mode)
+	}
+
+	opts.allowedImages, err = flags.GetStringArray("root-allowed-image")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s root-allowed-image flag", cmdName)
+	}
+	return opts, nil
+}
+
+func (opts nonRootOptions) logAttrs() []any {
+	return []any{
+		"nonRootMode", opts.mode,
+		"rootAllowedImages", opts.allowedImages,
+	}
+}
+
+// Checks that the pushed image does not run as root. For an image index,
+// the first image is checked, since the platform images share the USER of
+// the dockerfile
+func (opts nonRootOptions) checkImage(
+	ctx context.Context,
+	imageName string,
+	digest string,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) error {
+	if opts.mode == NON_ROOT_MODE_OFF {
+		return nil
+	}
+
+	ref, err := parseImageReference(fmt.Sprintf("%s@%s", imageName, digest), insecureRegistries)
+	if err != nil {
+		return err
+	}
+	desc, err := remote.Get(ref, getRemoteOptions(ctx, skipTlsVerify)...)
+	if err != nil {
+		return newStepError(ROOT_USER_ERROR, fmt.Errorf("error reading image %s: %w", ref, err))
+	}
+	configFile, err := getDescriptorConfigFile(desc)
+	if err != nil {
+		return newStepError(ROOT_USER_ERROR, fmt.Errorf("error reading image %s config: %w", ref, err))
+	}
+	return opts.checkConfigFile(imageName, configFile)
+}
+
+// Checks that the image in the tarball does not run as root
+func (opts nonRootOptions) checkTarball(imageName string, tarPath string) error {
+	if opts.mode == NON_ROOT_MODE_OFF {
+		return nil
+	}
+
+	img, err := tarball.ImageFromPath(tarPath, nil)
+	if err != nil {
+		return newStepError(ROOT_USER_ERROR, fmt.Errorf("error reading image tarball %s: %w", tarPath, err))
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return newStepError(ROOT_USER_ERROR, fmt.Errorf("error reading image tarball %s config: %w", tarPath, err))
+	}
+	return opts.checkConfigFile(imageName, configFile)
+}
+
+// Checks the user of the image config. The allowed images may run as root,
+// and in the warn mode, a root user is only logged
+func (opts nonRootOptions) checkConfigFile(imageName string, configFile *v1.ConfigFile) error {
+	user := configFile.Config.User
+	if !isRootUser(user) {
+		slog.Info("Image does not run as root", "image", imageName, "user", user)
+		return nil
+	}
+	if user == "" {
+		user = "unset"
+	}
+	if opts.isAllowedImage(imageName) {
+		slog.Info("Image runs as root, but is allowed to", "image", imageName, "user", user)
+		return nil
+	}
+
+	err := fmt.Errorf(
+		"image %s runs as root (user %s). Set a non root USER (e.g. USER 65532) in the final stage of the dockerfile",
+		imageName,
+		user)
+	if opts.mode == NON_ROOT_MODE_WARN {
+		slog.Warn("Image runs as root", "image", imageName, "error", err)
+		return nil
+	}
+	return newStepError(ROOT_USER_ERROR, err)
+}
+
+// Returns whether the image repo is allowed to run as root. The repos are
+// normalized, so a tag in the image name or a Docker Hub repo without a
+// registry still match
+func (opts nonRootOptions) isAllowedImage(imageName string) bool {
+	repoName := imageName
+	if ref, err := name.ParseReference(imageName); err == nil {
+		repoName = ref.Context().Name()
+	}
+	for _, allowedImage := range opts.allowedImages {
+		allowedRepoName := allowedImage
+		if repo, err := name.NewRepository(allowedImage); err == nil {
+			allowedRepoName = repo.Name()
+		}
+		if repoName == allowedRepoName {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the USER of the image config is root. The user may be
+// a name or uid, with an optional group (e.g. root:root or 0:0). An unset
+// user defaults to root
+func isRootUser(user string) bool {
+	user, _, _ = strings.Cut(user, ":")
+	return user == "" || user == "root" || user == "0"
+}
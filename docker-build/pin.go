@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Resolves the floating tags of the FROM images to their current digests,
+// and rewrites the dockerfile to pin them (e.g. alpine:3.19 to
+// alpine:3.19@sha256:...), so the build uses the resolved base images.
+// Returns the pins by the original image, for the provenance in the
+// result file. Images already pinned by digest, stage names, scratch, and
+// images from ARG variables are not pinned
+func pinBaseImages(
+	ctx context.Context,
+	dockerfilePath string,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) (map[string]string, error) {
+	bytes, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dockerfile: %s", err)
+	}
+	instructions, err := parseDockerfile(string(bytes))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing dockerfile: %s", err)
+	}
+
+	baseImages := getBaseImages(instructions)
+	pins := map[string]string{}
+	remoteOpts := getRemoteOptions(ctx, skipTlsVerify)
+	for _, baseImage := range baseImages {
+		if _, found := pins[baseImage]; found || strings.Contains(baseImage, "@") {
+			continue
+		}
+		ref, err := parseImageReference(baseImage, insecureRegistries)
+		if err != nil {
+			return nil, fmt.Errorf("base image %s is not a valid image reference: %s", baseImage, err)
+		}
+		// The digest of an image index is pinned, so multi platform builds
+		// still select the image of their platform
+		desc, err := remote.Head(ref, remoteOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving base image %s: %w", baseImage, err)
+		}
+		pins[baseImage] = fmt.Sprintf("%s@%s", baseImage, desc.Digest)
+	}
+	if len(pins) == 0 {
+		slog.Info("No base images to pin", "dockerfile", dockerfilePath)
+		return pins, nil
+	}
+
+	content, err := rewriteBaseImages(string(bytes), instructions, pins)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(dockerfilePath, []byte(content), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error writing pinned dockerfile: %s", err)
+	}
+	for image, pinnedImage := range pins {
+		slog.Info("Pinned base image", "image", image, "pinnedImage", pinnedImage)
+	}
+	return pins, nil
+}
+
+// Replaces the images of the FROM instructions with their pinned images.
+// The image is replaced on the lines of the FROM instruction, which may
+// span multiple lines with line continuations
+func rewriteBaseImages(content string, instructions []instruction, pins map[string]string) (string, error) {
+	lines := strings.Split(content, "\n")
+	for i, inst := range instructions {
+		if inst.cmd != "FROM" {
+			continue
+		}
+		fields := strings.Fields(inst.args)
+		if len(fields) == 0 {
+			continue
+		}
+		pinnedImage, found := pins[fields[0]]
+		if !found {
+			continue
+		}
+
+		endLine := len(lines)
+		if i+1 < len(instructions) {
+			endLine = instructions[i+1].line - 1
+		}
+		imageRegexp := regexp.MustCompile(`(^|\s)` + regexp.QuoteMeta(fields[0]) + `(\s|$)`)
+		replaced := false
+		for lineNum := inst.line; lineNum <= endLine && !replaced; lineNum++ {
+			line := lines[lineNum-1]
+			// Only the first match is the image. A later match may be the
+			// stage name
+			match := imageRegexp.FindStringSubmatchIndex(line)
+			if match != nil {
+				lines[lineNum-1] = line[:match[3]] + pinnedImage + line[match[4]:]
+				replaced = true
+			}
+		}
+		if !replaced {
+			return "", fmt.Errorf("unable to pin base image %s on line %d", fields[0], inst.line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// The checks of a built image, which fail the build before the image is
+// pushed to the image tags
+type imageChecks struct {
+	scan          scanOptions
+	license       licenseOptions
+	nonRoot       nonRootOptions
+	requiredLabel requiredLabelOptions
+}
+
+// The builds of a commit. A checked commit image is written to the tarball,
+// and pushed to the image tags after the checks pass. The platform images of
+// a multi platform build are pushed with their platform tags, and checked
+// before their image index is pushed to the image tags. The integration test
+// image is built last
+type commitBuild struct {
+	imageName string
+	imageRef  string
+	imageSpec buildSpec
+	// The platforms of a multi platform build, with the spec and the image
+	// of each platform
+	platforms      []string
+	platformSpecs  []buildSpec
+	platformImages map[string]string
+	testImageSpec  buildSpec
+	// The files that the digest and the image reference with the digest are
+	// written to, for the pushes that the builder does not do itself
+	digestFile   string
+	imageRefFile string
+	encrypt      encryptOptions
+	registry     registryOptions
+	checks       imageChecks
+}
+
+// The built commit image, before it is pushed to the image tags
+type builtImage struct {
+	// The output of the last build
+	output string
+	// The digest of the image, if the builder pushed it
+	digest string
+	// The digests of the platform images, which the builder pushed with the
+	// platform tags, if known
+	platformDigests map[string]string
+}
+
+// Returns whether the image is checked before the push. The checks read
+// the image tarball, or the platform images of a multi platform build
+func (checks imageChecks) beforePush() bool {
+	return checks.scan.enabled || checks.license.enabled || checks.nonRoot.mode != NON_ROOT_MODE_OFF ||
+		len(checks.requiredLabel.labels) > 0
+}
+
+// Builds the PR image, and checks the image tarball, since PR images are
+// not pushed
+func runPrBuild(
+	ctx context.Context,
+	builder imageBuilder,
+	spec buildSpec,
+	tarImage string,
+	checks imageChecks,
+	redactor redactor,
+) buildOutcome {
+	outcome := buildOutcome{startTime: time.Now()}
+	if spec.tarPath != "" {
+		outcome.image = tarImage
+	}
+	err := logBuildStart("Starting image build for PR", builder, spec, redactor)
+	if err != nil {
+		outcome.err = fmt.Errorf("Image build for PR failed: %w", err)
+		outcome.endTime = time.Now()
+		return outcome
+	}
+
+	output, err := builder.build(ctx, spec)
+	outcome.digest = output.digest
+	outcome.output = output.output
+	outcome.endTime = time.Now()
+	if err != nil {
+		outcome.err = fmt.Errorf("Image build for PR failed: %w", err)
+		return outcome
+	}
+	outcome.err = checks.checkTarball(ctx, "PR", tarImage, spec.tarPath)
+	return outcome
+}
+
+// Builds the commit image, checks it, pushes it to the image tags, and
+// builds the integration test image
+func runCommitBuild(ctx context.Context, builder imageBuilder, build commitBuild, redactor redactor) buildOutcome {
+	outcome := buildOutcome{image: build.imageRef, startTime: time.Now()}
+
+	built, err := build.buildImage(ctx, builder, redactor)
+	outcome.output = built.output
+	if err != nil {
+		outcome.err = fmt.Errorf("Image build for commit failed: %w", err)
+	}
+
+	// Check the image before it is pushed to the image tags, so the
+	// vulnerable images, the denied licenses, the root images, and the
+	// images without the required labels are never pushed to them
+	if outcome.err == nil {
+		outcome.err = build.checkImage(ctx, built)
+	}
+
+	if outcome.err == nil {
+		outcome.digest, err = build.pushImage(ctx, built)
+		if err != nil {
+			outcome.err = fmt.Errorf("Image push for commit failed: %w", err)
+		}
+	}
+
+	if outcome.err == nil {
+		outcome.output, err = build.buildTestImage(ctx, builder, redactor)
+		if err != nil {
+			outcome.err = fmt.Errorf("Integration test image build for commit failed: %w", err)
+		}
+	}
+	outcome.endTime = time.Now()
+	return outcome
+}
+
+// Builds the commit image, which the builder pushes to the image tags,
+// unless it is written to the tarball. The platform images are pushed with
+// their platform tags
+func (build commitBuild) buildImage(ctx context.Context, builder imageBuilder, redactor redactor) (builtImage, error) {
+	built := builtImage{platformDigests: map[string]string{}}
+	if len(build.platforms) == 0 {
+		err := logBuildStart("Starting image build for commit", builder, build.imageSpec, redactor)
+		if err != nil {
+			return built, err
+		}
+		output, err := builder.build(ctx, build.imageSpec)
+		built.output = output.output
+		built.digest = output.digest
+		return built, err
+	}
+
+	for i, platform := range build.platforms {
+		output := buildOutput{}
+		err := logBuildStart("Starting platform image build for commit", builder, build.platformSpecs[i], redactor, "platform", platform)
+		if err == nil {
+			output, err = builder.build(ctx, build.platformSpecs[i])
+		}
+		built.output = output.output
+		if err != nil {
+			return built, fmt.Errorf("%s platform: %w", platform, err)
+		}
+		built.platformDigests[platform] = output.digest
+	}
+	return built, nil
+}
+
+// Checks the commit image before it is pushed to the image tags. The image
+// is read from the tarball, and the platform images from the registry
+func (build commitBuild) checkImage(ctx context.Context, built builtImage) error {
+	if !build.checks.beforePush() {
+		return nil
+	}
+	if len(build.platforms) == 0 {
+		return build.checks.checkTarball(ctx, "commit", build.imageRef, build.imageSpec.tarPath)
+	}
+	for _, platform := range build.platforms {
+		err := build.checkPlatformImage(ctx, platform, built.platformDigests[platform])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks the platform image, which is pushed with its platform tag, so the
+// image index is not pushed to the image tags if it fails the checks
+func (build commitBuild) checkPlatformImage(ctx context.Context, platform string, digest string) error {
+	if digest == "" {
+		ref, err := parseImageReference(build.platformImages[platform], build.registry.insecureRegistries)
+		if err == nil {
+			digest, err = resolveImageDigest(ctx, ref, build.registry.skipTlsVerify)
+		}
+		if err != nil {
+			return fmt.Errorf("Image check for commit failed: %s platform: %w", platform, err)
+		}
+	}
+	image := fmt.Sprintf("%s@%s", build.imageName, digest)
+	insecure := build.registry.skipTlsVerify ||
+		slices.Contains(build.registry.insecureRegistries, getRegistryHost(build.imageName))
+
+	err := build.checks.scan.scan(ctx, image, "", insecure)
+	if err != nil {
+		return fmt.Errorf("Vulnerability scan for commit failed: %s platform: %w", platform, err)
+	}
+	err = build.checks.license.scan(ctx, image, "", insecure)
+	if err != nil {
+		return fmt.Errorf("License scan for commit failed: %s platform: %w", platform, err)
+	}
+	err = build.checks.nonRoot.checkImage(
+		ctx, build.imageName, digest, build.registry.insecureRegistries, build.registry.skipTlsVerify)
+	if err != nil {
+		return fmt.Errorf("Image user check for commit failed: %s platform: %w", platform, err)
+	}
+	err = build.checks.requiredLabel.checkImage(
+		ctx, build.imageName, digest, build.registry.insecureRegistries, build.registry.skipTlsVerify)
+	if err != nil {
+		return fmt.Errorf("Required label check for commit failed: %s platform: %w", platform, err)
+	}
+	return nil
+}
+
+// Pushes the checked commit image to the image tags, and returns the
+// digest. The builder already pushed the image, unless it was written to
+// the tarball, or it is a multi platform image
+func (build commitBuild) pushImage(ctx context.Context, built builtImage) (string, error) {
+	var digest string
+	var err error
+	switch {
+	case len(build.platforms) > 0:
+		digest, err = pushImageIndex(
+			ctx,
+			build.platformImages,
+			build.platforms,
+			build.imageSpec.destinations,
+			build.registry.insecureRegistries,
+			build.registry.skipTlsVerify,
+		)
+		if err != nil {
+			return "", newStepError(PUSH_ERROR, err)
+		}
+	case build.imageSpec.tarPath != "":
+		// The layers are encrypted on the push, if enabled
+		digest, err = build.encrypt.push(ctx, build.imageSpec.tarPath, build.imageSpec.destinations, build.registry)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return built.digest, nil
+	}
+
+	err = writeImageIndexFiles(build.digestFile, build.imageRefFile, build.imageRef, digest)
+	if err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// Builds and pushes the integration test image. Returns the output of the
+// build
+func (build commitBuild) buildTestImage(ctx context.Context, builder imageBuilder, redactor redactor) (string, error) {
+	err := logBuildStart("Starting integration test image build for commit", builder, build.testImageSpec, redactor)
+	if err != nil {
+		return "", err
+	}
+	output, err := builder.build(ctx, build.testImageSpec)
+	if err == nil && build.encrypt.enabled() {
+		_, err = build.encrypt.push(ctx, build.testImageSpec.tarPath, build.testImageSpec.destinations, build.registry)
+	}
+	return output.output, err
+}
+
+// Checks the image tarball of the event (e.g. PR)
+func (checks imageChecks) checkTarball(ctx context.Context, event string, image string, tarPath string) error {
+	err := checks.scan.scan(ctx, image, tarPath, false)
+	if err != nil {
+		return fmt.Errorf("Vulnerability scan for %s failed: %w", event, err)
+	}
+	err = checks.license.scan(ctx, image, tarPath, false)
+	if err != nil {
+		return fmt.Errorf("License scan for %s failed: %w", event, err)
+	}
+	err = checks.nonRoot.checkTarball(image, tarPath)
+	if err != nil {
+		return fmt.Errorf("Image user check for %s failed: %w", event, err)
+	}
+	err = checks.requiredLabel.checkTarball(image, tarPath)
+	if err != nil {
+		return fmt.Errorf("Required label check for %s failed: %w", event, err)
+	}
+	return nil
+}
+
+// Logs the builder command of the spec before the build, with the
+// sensitive values masked
+func logBuildStart(message string, builder imageBuilder, spec buildSpec, redactor redactor, attrs ...any) error {
+	command, err := builder.command(spec)
+	if err != nil {
+		return withDefaultClass(FLAG_ERROR, err)
+	}
+	attrs = append(attrs, "builder", command.builder, "args", redactor.redactAll(command.args))
+	slog.Info(message, attrs...)
+	logBuilderCommand(slog.LevelDebug, command, redactor)
+	return nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// A builder that records the built specs, and returns the output and the
+// error of the first destination of each spec instead of running a build.
+// The image is written to the tarball of the spec, if set
+type fakeBuilder struct {
+	built   *[]string
+	outputs map[string]buildOutput
+	errs    map[string]error
+	image   v1.Image
+}
+
+func newFakeBuilder() fakeBuilder {
+	return fakeBuilder{
+		built:   &[]string{},
+		outputs: map[string]buildOutput{},
+		errs:    map[string]error{},
+	}
+}
+
+func (builder fakeBuilder) name() string {
+	return "fake"
+}
+
+func (builder fakeBuilder) logAttrs() []any {
+	return nil
+}
+
+func (builder fakeBuilder) command(spec buildSpec) (builderCommand, error) {
+	return builderCommand{builder: "fake", path: "fake", args: append([]string{"build"}, spec.destinations...)}, nil
+}
+
+func (builder fakeBuilder) build(ctx context.Context, spec buildSpec) (buildOutput, error) {
+	destination := spec.destinations[0]
+	*builder.built = append(*builder.built, destination)
+	if spec.tarPath != "" && builder.image != nil {
+		err := tarball.WriteToFile(spec.tarPath, nil, builder.image)
+		if err != nil {
+			return buildOutput{}, err
+		}
+	}
+	return builder.outputs[destination], builder.errs[destination]
+}
+
+// Returns the checks of a build with the image checks disabled
+func getTestImageChecks() imageChecks {
+	return imageChecks{nonRoot: nonRootOptions{mode: NON_ROOT_MODE_OFF}}
+}
+
+func TestRunPrBuild(t *testing.T) {
+	spec := buildSpec{destinations: []string{"app:pr"}}
+	redactor := newRedactor(nil, nil, nil, "", nil)
+
+	t.Run("success", func(t *testing.T) {
+		builder := newFakeBuilder()
+		builder.outputs["app:pr"] = buildOutput{output: "built", digest: "sha256:pr"}
+		outcome := runPrBuild(context.Background(), builder, spec, "app:pr", getTestImageChecks(), redactor)
+		if outcome.err != nil {
+			t.Fatalf("runPrBuild() error = %v", outcome.err)
+		}
+		if outcome.digest != "sha256:pr" || outcome.output != "built" {
+			t.Errorf("runPrBuild() = %q %q, want the digest and the output of the build", outcome.digest, outcome.output)
+		}
+		if !slices.Equal(*builder.built, []string{"app:pr"}) {
+			t.Errorf("built %q, want the PR image", *builder.built)
+		}
+		if outcome.endTime.Before(outcome.startTime) {
+			t.Errorf("end time %s is before the start time %s", outcome.endTime, outcome.startTime)
+		}
+	})
+
+	t.Run("build failure", func(t *testing.T) {
+		builder := newFakeBuilder()
+		builder.outputs["app:pr"] = buildOutput{output: "failed"}
+		builder.errs["app:pr"] = newStepError(BUILD_ERROR, errors.New("exit status 1"))
+		outcome := runPrBuild(context.Background(), builder, spec, "app:pr", getTestImageChecks(), redactor)
+		if outcome.err == nil {
+			t.Fatalf("runPrBuild() did not fail")
+		}
+		if !strings.HasPrefix(outcome.err.Error(), "Image build for PR failed") {
+			t.Errorf("error = %q, want the PR build error", outcome.err)
+		}
+		if class := getErrorClass(outcome.err); class != BUILD_ERROR {
+			t.Errorf("got class %q, want %q", class, BUILD_ERROR)
+		}
+		if outcome.output != "failed" {
+			t.Errorf("output = %q, want the output of the failed build", outcome.output)
+		}
+	})
+}
+
+func TestRunCommitBuild(t *testing.T) {
+	tests := []struct {
+		name      string
+		platforms []string
+		errs      map[string]error
+		wantBuilt []string
+		wantErr   string
+		// The error class, if the build fails
+		wantClass  errorClass
+		wantDigest string
+	}{
+		{
+			name:       "success",
+			wantBuilt:  []string{"app:v1", "app:v1-test"},
+			wantDigest: "sha256:image",
+		},
+		{
+			name:      "image build failure",
+			errs:      map[string]error{"app:v1": newStepError(BUILD_ERROR, errors.New("exit status 1"))},
+			wantBuilt: []string{"app:v1"},
+			wantErr:   "Image build for commit failed",
+			wantClass: BUILD_ERROR,
+		},
+		{
+			name:       "test image build failure",
+			errs:       map[string]error{"app:v1-test": newStepError(BUILD_ERROR, errors.New("exit status 1"))},
+			wantBuilt:  []string{"app:v1", "app:v1-test"},
+			wantErr:    "Integration test image build for commit failed",
+			wantClass:  BUILD_ERROR,
+			wantDigest: "sha256:image",
+		},
+		{
+			name:      "platform build failure",
+			platforms: []string{"linux/amd64", "linux/arm64", "linux/arm/v7"},
+			errs:      map[string]error{"app:v1-linux-arm64": newStepError(BUILD_ERROR, errors.New("exit status 1"))},
+			wantBuilt: []string{"app:v1-linux-amd64", "app:v1-linux-arm64"},
+			wantErr:   "Image build for commit failed: linux/arm64 platform",
+			wantClass: BUILD_ERROR,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := newFakeBuilder()
+			builder.outputs["app:v1"] = buildOutput{output: "image", digest: "sha256:image"}
+			builder.outputs["app:v1-test"] = buildOutput{output: "test image"}
+			for destination, err := range tt.errs {
+				builder.errs[destination] = err
+			}
+
+			build := commitBuild{
+				imageName:     "app",
+				imageRef:      "app:v1",
+				imageSpec:     buildSpec{destinations: []string{"app:v1"}, push: true},
+				testImageSpec: buildSpec{destinations: []string{"app:v1-test"}, push: true, target: "integration-test"},
+				checks:        getTestImageChecks(),
+			}
+			build.platforms = tt.platforms
+			build.platformImages = map[string]string{}
+			for _, platform := range tt.platforms {
+				image := "app:v1-" + strings.ReplaceAll(platform, "/", "-")
+				build.platformSpecs = append(build.platformSpecs, buildSpec{destinations: []string{image}, platform: platform})
+				build.platformImages[platform] = image
+			}
+
+			outcome := runCommitBuild(context.Background(), builder, build, newRedactor(nil, nil, nil, "", nil))
+			if !slices.Equal(*builder.built, tt.wantBuilt) {
+				t.Errorf("built %q, want %q", *builder.built, tt.wantBuilt)
+			}
+			if outcome.image != "app:v1" || outcome.digest != tt.wantDigest {
+				t.Errorf("runCommitBuild() = %q %q, want %q %q", outcome.image, outcome.digest, "app:v1", tt.wantDigest)
+			}
+			if tt.wantErr == "" {
+				if outcome.err != nil {
+					t.Fatalf("runCommitBuild() error = %v", outcome.err)
+				}
+				if outcome.output != "test image" {
+					t.Errorf("output = %q, want the output of the last build", outcome.output)
+				}
+				return
+			}
+			if outcome.err == nil || !strings.HasPrefix(outcome.err.Error(), tt.wantErr) {
+				t.Fatalf("runCommitBuild() error = %v, want %q", outcome.err, tt.wantErr)
+			}
+			if class := getErrorClass(outcome.err); class != tt.wantClass {
+				t.Errorf("got class %q, want %q", class, tt.wantClass)
+			}
+		})
+	}
+}
+
+// Writes an executable script to the dir, and returns its path
+func writeTestScript(t *testing.T, dir string, name string, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatalf("error writing the %s script: %s", name, err)
+	}
+	return path
+}
+
+// Returns a commit build that writes the image to the tarball, with a fake
+// skopeo that logs its args to skopeo.log and writes the pushed digest
+func getTestTarballBuild(t *testing.T, dir string) commitBuild {
+	t.Helper()
+	skopeoPath := writeTestScript(t, dir, "skopeo", `echo "$@" >> "$(dirname "$0")/skopeo.log"
+for arg in "$@"; do
+	case "$arg" in --digestfile=*) printf sha256:pushed > "${arg#--digestfile=}";; esac
+done
+`)
+	return commitBuild{
+		imageName:     "app",
+		imageRef:      "app:v1",
+		imageSpec:     buildSpec{destinations: []string{"app:v1"}, tarPath: filepath.Join(dir, "image.tar")},
+		testImageSpec: buildSpec{destinations: []string{"app:v1-test"}, push: true, target: "integration-test"},
+		digestFile:    filepath.Join(dir, "digest"),
+		encrypt:       encryptOptions{skopeoPath: skopeoPath},
+		checks:        getTestImageChecks(),
+	}
+}
+
+func TestRunCommitBuildScansBeforePush(t *testing.T) {
+	tests := []struct {
+		name     string
+		severity string
+		wantErr  string
+	}{
+		{name: "clean image", severity: "LOW"},
+		{name: "vulnerable image", severity: "CRITICAL", wantErr: "Vulnerability scan for commit failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			build := getTestTarballBuild(t, dir)
+			build.checks.scan = scanOptions{
+				enabled: true,
+				failOn:  DEFAULT_SCAN_FAIL_ON,
+				trivyPath: writeTestScript(t, dir, "trivy", `while [ $# -gt 0 ]; do
+	if [ "$1" = --output ]; then output=$2; fi
+	shift
+done
+echo '{"Results":[{"Vulnerabilities":[{"VulnerabilityID":"CVE-2024-1234","PkgName":"openssl","Severity":"`+tt.severity+`"}]}]}' > "$output"
+`),
+			}
+			builder := newFakeBuilder()
+			outcome := runCommitBuild(context.Background(), builder, build, newRedactor(nil, nil, nil, "", nil))
+
+			skopeoLog, _ := os.ReadFile(filepath.Join(dir, "skopeo.log"))
+			if tt.wantErr != "" {
+				if outcome.err == nil || !strings.HasPrefix(outcome.err.Error(), tt.wantErr) {
+					t.Fatalf("runCommitBuild() error = %v, want %q", outcome.err, tt.wantErr)
+				}
+				if class := getErrorClass(outcome.err); class != VULNERABILITY_ERROR {
+					t.Errorf("got class %q, want %q", class, VULNERABILITY_ERROR)
+				}
+				if len(skopeoLog) > 0 {
+					t.Errorf("the vulnerable image was pushed: %s", skopeoLog)
+				}
+				if !slices.Equal(*builder.built, []string{"app:v1"}) {
+					t.Errorf("built %q, want only the commit image", *builder.built)
+				}
+				return
+			}
+
+			if outcome.err != nil {
+				t.Fatalf("runCommitBuild() error = %v", outcome.err)
+			}
+			if !strings.Contains(string(skopeoLog), "docker-archive:"+build.imageSpec.tarPath+" docker://app:v1") {
+				t.Errorf("skopeo args = %q, want a push of the tarball to the image tag", skopeoLog)
+			}
+			digest, _ := os.ReadFile(build.digestFile)
+			if outcome.digest != "sha256:pushed" || string(digest) != "sha256:pushed" {
+				t.Errorf("digest = %q, digest file = %q, want the pushed digest", outcome.digest, digest)
+			}
+			if !slices.Equal(*builder.built, []string{"app:v1", "app:v1-test"}) {
+				t.Errorf("built %q, want the commit image and the integration test image", *builder.built)
+			}
+		})
+	}
+}
+
+// Returns a random image with the config
+func getTestImage(t *testing.T, config v1.Config) v1.Image {
+	t.Helper()
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("error creating the image: %s", err)
+	}
+	img, err = mutate.Config(img, config)
+	if err != nil {
+		t.Fatalf("error setting the image config: %s", err)
+	}
+	return img
+}
+
+func TestRunCommitBuildChecksUserBeforePush(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		wantErr bool
+	}{
+		{name: "non root image", user: "65532"},
+		{name: "root image", user: "root", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			build := getTestTarballBuild(t, dir)
+			build.checks.nonRoot = nonRootOptions{mode: NON_ROOT_MODE_ERROR}
+			builder := newFakeBuilder()
+			builder.image = getTestImage(t, v1.Config{User: tt.user})
+			outcome := runCommitBuild(context.Background(), builder, build, newRedactor(nil, nil, nil, "", nil))
+
+			skopeoLog, _ := os.ReadFile(filepath.Join(dir, "skopeo.log"))
+			if !tt.wantErr {
+				if outcome.err != nil {
+					t.Fatalf("runCommitBuild() error = %v", outcome.err)
+				}
+				if len(skopeoLog) == 0 || outcome.digest != "sha256:pushed" {
+					t.Errorf("the checked image was not pushed, digest %q", outcome.digest)
+				}
+				return
+			}
+			if outcome.err == nil || !strings.HasPrefix(outcome.err.Error(), "Image user check for commit failed") {
+				t.Fatalf("runCommitBuild() error = %v, want the image user check error", outcome.err)
+			}
+			if class := getErrorClass(outcome.err); class != ROOT_USER_ERROR {
+				t.Errorf("got class %q, want %q", class, ROOT_USER_ERROR)
+			}
+			if len(skopeoLog) > 0 {
+				t.Errorf("the root image was pushed: %s", skopeoLog)
+			}
+		})
+	}
+}
+
+func TestRunCommitBuildChecksLabelsBeforePush(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{name: "labeled image", labels: map[string]string{"team": "deploy"}},
+		{name: "unlabeled image", labels: map[string]string{"team": ""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			build := getTestTarballBuild(t, dir)
+			build.checks.requiredLabel = requiredLabelOptions{labels: []string{"team"}}
+			builder := newFakeBuilder()
+			builder.image = getTestImage(t, v1.Config{User: "65532", Labels: tt.labels})
+			outcome := runCommitBuild(context.Background(), builder, build, newRedactor(nil, nil, nil, "", nil))
+
+			skopeoLog, _ := os.ReadFile(filepath.Join(dir, "skopeo.log"))
+			if !tt.wantErr {
+				if outcome.err != nil {
+					t.Fatalf("runCommitBuild() error = %v", outcome.err)
+				}
+				if len(skopeoLog) == 0 || outcome.digest != "sha256:pushed" {
+					t.Errorf("the checked image was not pushed, digest %q", outcome.digest)
+				}
+				return
+			}
+			if outcome.err == nil || !strings.HasPrefix(outcome.err.Error(), "Required label check for commit failed") {
+				t.Fatalf("runCommitBuild() error = %v, want the required label check error", outcome.err)
+			}
+			if class := getErrorClass(outcome.err); class != POLICY_ERROR {
+				t.Errorf("got class %q, want %q", class, POLICY_ERROR)
+			}
+			if len(skopeoLog) > 0 {
+				t.Errorf("the unlabeled image was pushed: %s", skopeoLog)
+			}
+		})
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default package of the policy rules
+	DEFAULT_POLICY_PACKAGE = "docker_build"
+
+	// The default opa path, which is resolved with the PATH
+	DEFAULT_OPA_PATH = "opa"
+)
+
+// The options for evaluating the dockerfile and the build spec against
+// Rego policies with opa. The deny rules of the policy package fail the
+// build, and the warn rules are only logged
+// See https://www.openpolicyagent.org/docs/latest/policy-language/
+type policyOptions struct {
+	// The dirs (e.g. a mounted ConfigMap) or files with the policies. The
+	// policies are not evaluated if empty
+	policyDirs []string
+	// The package of the deny and warn rules (e.g. docker_build for
+	// data.docker_build.deny)
+	policyPackage string
+	opaPath       string
+	// The registries, or registry and repo path prefixes, that the FROM
+	// images must be pulled from. Any registry is allowed if empty
+	allowedBaseRegistries []string
+}
+
+// The input document of the policies
+type policyInput struct {
+	// The path of the dockerfile, relative to the clone
+	Dockerfile   string                   `json:"dockerfile"`
+	Instructions []policyInputInstruction `json:"instructions"`
+	Stages       []policyInputStage       `json:"stages"`
+	Build        policyInputBuild         `json:"build"`
+}
+
+// A dockerfile instruction of the policy input
+type policyInputInstruction struct {
+	Line  int      `json:"line"`
+	Cmd   string   `json:"cmd"`
+	Flags []string `json:"flags"`
+	Args  string   `json:"args"`
+}
+
+// A build stage of the policy input
+type policyInputStage struct {
+	// The line of the FROM instruction
+	Line  int    `json:"line"`
+	Image string `json:"image"`
+	Name  string `json:"name,omitempty"`
+}
+
+// The resolved build spec of the policy input
+type policyInputBuild struct {
+	// The build command (e.g. pr or commit)
+	Mode        string `json:"mode"`
+	ContextType string `json:"contextType"`
+	Target      string `json:"target,omitempty"`
+	// The build args, with the sensitive values masked
+	BuildArgs    map[string]string `json:"buildArgs"`
+	Labels       map[string]string `json:"labels"`
+	Destinations []string          `json:"destinations"`
+	Platforms    []string          `json:"platforms,omitempty"`
+}
+
+// A deny or warn result of the policies
+type policyViolation struct {
+	message string
+	// The dockerfile line of the violation, if the rule returned one
+	line int
+}
+
+func (v policyViolation) String() string {
+	if v.line == 0 {
+		return v.message
+	}
+	return fmt.Sprintf("line %d: %s", v.line, v.message)
+}
+
+// The fields of the opa eval JSON output used by the policy check
+type opaEvalOutput struct {
+	Result []struct {
+		Expressions []struct {
+			Value struct {
+				Deny []any `json:"deny"`
+				Warn []any `json:"warn"`
+			} `json:"value"`
+		} `json:"expressions"`
+	} `json:"result"`
+}
+
+func configurePolicyFlags(flags *pflag.FlagSet) {
+	flags.StringArray(
+		"policy-dir",
+		nil,
+		"A dir (e.g. a mounted ConfigMap) or file with the Rego policies the dockerfile and build spec are "+
+			"checked against before the build. Can be repeated")
+	flags.String(
+		"policy-package",
+		DEFAULT_POLICY_PACKAGE,
+		"The package of the policy deny and warn rules. The deny rules fail the build")
+	flags.String("opa-path", DEFAULT_OPA_PATH, "The path to the opa executable")
+	flags.StringArray(
+		"allowed-base-registry",
+		nil,
+		"A registry, or registry and repo path prefix (e.g. registry.example.com/mirror), that the FROM images must "+
+			"be pulled from. Can be repeated. Defaults to allowing any registry")
+}
+
+func getPolicyOptions(flags *pflag.FlagSet, cmdName string) (policyOptions, error) {
+	var opts policyOptions
+	var err error
+
+	opts.policyDirs, err = flags.GetStringArray("policy-dir")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s policy-dir flag", cmdName)
+	}
+
+	opts.policyPackage, err = flags.GetString("policy-package")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s policy-package flag", cmdName)
+	}
+	if opts.policyPackage == "" {
+		return opts, fmt.Errorf("policy-package must not be empty")
+	}
+
+	opts.opaPath, err = flags.GetString("opa-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s opa-path flag", cmdName)
+	}
+
+	opts.allowedBaseRegistries, err = flags.GetStringArray("allowed-base-registry")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s allowed-base-registry flag", cmdName)
+	}
+	for _, allowedBaseRegistry := range opts.allowedBaseRegistries {
+		_, err = getAllowedBaseRepoPrefix(allowedBaseRegistry)
+		if err != nil {
+			return opts, fmt.Errorf("allowed-base-registry is not a valid registry or repo: %s", allowedBaseRegistry)
+		}
+	}
+	return opts, nil
+}
+
+func (opts policyOptions) logAttrs() []any {
+	return []any{
+		"policyDirs", opts.policyDirs,
+		"policyPackage", opts.policyPackage,
+		"opaPath", opts.opaPath,
+		"allowedBaseRegistries", opts.allowedBaseRegistries,
+	}
+}
+
+// Checks the dockerfile and the build spec against the policies, and
+// fails if any deny rule matches. The build args are masked with the
+// redactor, since the input is written to a temp file. Does nothing if
+// there are no policy dirs
+func (opts policyOptions) check(
+	ctx context.Context,
+	mode string,
+	clonePath string,
+	dockerfile string,
+	spec buildSpec,
+	platforms []string,
+	redactor redactor,
+) error {
+	if len(opts.policyDirs) == 0 {
+		return nil
+	}
+
+	instructions, err := readDockerfile(filepath.Join(clonePath, dockerfile))
+	if err != nil {
+		return newStepError(POLICY_ERROR, fmt.Errorf("error parsing dockerfile: %s", err))
+	}
+	input := newPolicyInput(mode, dockerfile, instructions, spec, platforms, redactor)
+	bytes, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("error encoding the policy input: %s", err)
+	}
+	inputFile := filepath.Join(os.TempDir(), fmt.Sprintf("docker-build-policy-input-%d.json", os.Getpid()))
+	defer os.Remove(inputFile)
+	err = os.WriteFile(inputFile, bytes, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing the policy input: %s", err)
+	}
+
+	// The hidden files are ignored, since a mounted ConfigMap links each
+	// key to a hidden timestamped dir, which would load the policies twice
+	query := fmt.Sprintf("data.%s", opts.policyPackage)
+	args := []string{"eval", "--format", "json", "--input", inputFile, "--ignore", ".*"}
+	for _, policyDir := range opts.policyDirs {
+		args = append(args, "--data", policyDir)
+	}
+	args = append(args, query)
+	slog.Info("Checking policies", "dockerfile", dockerfile, "args", args)
+
+	output := &strings.Builder{}
+	opaCmd := exec.CommandContext(ctx, opts.opaPath, args...)
+	opaCmd.Stdout = output
+	opaCmd.Stderr = os.Stderr
+	err = opaCmd.Run()
+	if err != nil {
+		if stoppedErr := getStoppedError(ctx, "opa"); stoppedErr != nil {
+			return stoppedErr
+		}
+		if notFoundErr := getToolNotFoundError(err, "opa", opts.opaPath); notFoundErr != nil {
+			return notFoundErr
+		}
+		return newStepError(POLICY_ERROR, fmt.Errorf("error running opa: %w", err))
+	}
+
+	evalOutput := opaEvalOutput{}
+	err = json.Unmarshal([]byte(output.String()), &evalOutput)
+	if err != nil {
+		return newStepError(POLICY_ERROR, fmt.Errorf("error parsing the opa output: %s", err))
+	}
+	if len(evalOutput.Result) == 0 || len(evalOutput.Result[0].Expressions) == 0 {
+		// Likely a typo in the package, which would silently pass every build
+		slog.Warn("The policy package is not defined by the policies", "query", query)
+		return nil
+	}
+
+	value := evalOutput.Result[0].Expressions[0].Value
+	for _, warning := range getPolicyViolations(value.Warn) {
+		slog.Warn("Policy warning", "line", warning.line, "message", warning.message)
+	}
+	violations := getPolicyViolations(value.Deny)
+	for _, violation := range violations {
+		slog.Error("Policy violation", "line", violation.line, "message", violation.message)
+	}
+	slog.Info("Checked policies", "violations", len(violations), "warnings", len(value.Warn))
+
+	if len(violations) > 0 {
+		messages := make([]string, len(violations))
+		for i, violation := range violations {
+			messages[i] = violation.String()
+		}
+		return newStepError(
+			POLICY_ERROR,
+			fmt.Errorf("dockerfile %s has %d policy violations: %s", dockerfile, len(violations), strings.Join(messages, "; ")),
+		)
+	}
+	return nil
+}
+
+// Checks that the FROM images of the dockerfile are pulled from the allowed
+// base registries. The stage names and scratch are skipped. The images from
+// ARG variables cannot be checked, so they are not allowed. Does nothing if
+// any registry is allowed
+func (opts policyOptions) checkBaseRegistries(dockerfilePath string) error {
+	if len(opts.allowedBaseRegistries) == 0 {
+		return nil
+	}
+
+	instructions, err := readDockerfile(dockerfilePath)
+	if err != nil {
+		return newStepError(POLICY_ERROR, fmt.Errorf("error parsing dockerfile: %s", err))
+	}
+	violations := []policyViolation{}
+	stageNames := map[string]bool{}
+	for _, stage := range getBuildStages(instructions) {
+		image := stage.image
+		isExcluded := image == "" || image == "scratch" || stageNames[strings.ToLower(image)]
+		if stage.name != "" {
+			stageNames[strings.ToLower(stage.name)] = true
+		}
+		if isExcluded {
+			continue
+		}
+
+		violation := policyViolation{line: stage.from.line}
+		if strings.Contains(image, "$") {
+			violation.message = fmt.Sprintf(
+				"base image %s uses an ARG variable, so its registry cannot be checked. Use the image directly", image)
+			violations = append(violations, violation)
+			continue
+		}
+		ref, err := parseImageReference(image, nil)
+		if err != nil {
+			violation.message = fmt.Sprintf("base image %s is not a valid image reference: %s", image, err)
+			violations = append(violations, violation)
+			continue
+		}
+		if !isAllowedBaseImage(ref, opts.allowedBaseRegistries) {
+			violation.message = fmt.Sprintf(
+				"base image %s is pulled from %s, which is not an allowed base registry. Use an image from %s",
+				image,
+				ref.Context().Name(),
+				strings.Join(opts.allowedBaseRegistries, ", "))
+			violations = append(violations, violation)
+		}
+	}
+
+	for _, violation := range violations {
+		slog.Error("Base registry violation", "line", violation.line, "message", violation.message)
+	}
+	if len(violations) > 0 {
+		messages := make([]string, len(violations))
+		for i, violation := range violations {
+			messages[i] = violation.String()
+		}
+		return newStepError(
+			POLICY_ERROR,
+			fmt.Errorf(
+				"dockerfile has %d base images that are not from the allowed base registries: %s",
+				len(violations),
+				strings.Join(messages, "; ")),
+		)
+	}
+	slog.Info("Checked the base image registries", "allowedBaseRegistries", opts.allowedBaseRegistries)
+	return nil
+}
+
+// Returns whether the image is in one of the allowed registries, or repo
+// path prefixes
+func isAllowedBaseImage(ref name.Reference, allowedBaseRegistries []string) bool {
+	repoName := ref.Context().Name()
+	for _, allowedBaseRegistry := range allowedBaseRegistries {
+		prefix, err := getAllowedBaseRepoPrefix(allowedBaseRegistry)
+		if err != nil {
+			continue
+		}
+		if repoName == prefix || strings.HasPrefix(repoName, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the normalized repo prefix of the allowed base registry, so
+// docker.io matches the Docker Hub images without a registry (e.g. alpine)
+func getAllowedBaseRepoPrefix(allowedBaseRegistry string) (string, error) {
+	if !strings.Contains(allowedBaseRegistry, "/") {
+		registry, err := name.NewRegistry(allowedBaseRegistry)
+		if err != nil {
+			return "", err
+		}
+		return registry.RegistryStr(), nil
+	}
+	repo, err := name.NewRepository(allowedBaseRegistry)
+	if err != nil {
+		return "", err
+	}
+	return repo.Name(), nil
+}
+
+// Returns the policy input for the dockerfile instructions and the build
+// spec
+func newPolicyInput(
+	mode string,
+	dockerfile string,
+	instructions []instruction,
+	spec buildSpec,
+	platforms []string,
+	redactor redactor,
+) policyInput {
+	input := policyInput{
+		Dockerfile:   dockerfile,
+		Instructions: []policyInputInstruction{},
+		Stages:       []policyInputStage{},
+		Build: policyInputBuild{
+			Mode:         mode,
+			ContextType:  spec.context.contextType,
+			Target:       spec.target,
+			BuildArgs:    map[string]string{},
+			Labels:       map[string]string{},
+			Destinations: spec.destinations,
+			Platforms:    platforms,
+		},
+	}
+	for _, inst := range instructions {
+		flags := inst.flags
+		if flags == nil {
+			flags = []string{}
+		}
+		input.Instructions = append(input.Instructions, policyInputInstruction{
+			Line:  inst.line,
+			Cmd:   inst.cmd,
+			Flags: flags,
+			Args:  inst.args,
+		})
+	}
+	for _, stage := range getBuildStages(instructions) {
+		input.Stages = append(input.Stages, policyInputStage{
+			Line:  stage.from.line,
+			Image: stage.image,
+			Name:  stage.name,
+		})
+	}
+	for _, buildArg := range redactor.redactAll(spec.buildArgs) {
+		key, value, _ := strings.Cut(buildArg, "=")
+		input.Build.BuildArgs[key] = value
+	}
+	for _, label := range spec.labels {
+		key, value, _ := strings.Cut(label, "=")
+		input.Build.Labels[key] = value
+	}
+	if input.Build.Destinations == nil {
+		input.Build.Destinations = []string{}
+	}
+	return input
+}
+
+// Returns the violations of the deny or warn rule results. A result is
+// either the message, or an object with the msg and an optional line, so
+// the violation can point to the instruction
+func getPolicyViolations(results []any) []policyViolation {
+	violations := []policyViolation{}
+	for _, result := range results {
+		switch result := result.(type) {
+		case string:
+			violations = append(violations, policyViolation{message: result})
+		case map[string]any:
+			violation := policyViolation{}
+			if msg, ok := result["msg"].(string); ok {
+				violation.message = msg
+			} else {
+				violation.message = fmt.Sprint(result)
+			}
+			if line, ok := result["line"].(float64); ok {
+				violation.line = int(line)
+			}
+			violations = append(violations, violation)
+		default:
+			violations = append(violations, policyViolation{message: fmt.Sprint(result)})
+		}
+	}
+	return violations
+}
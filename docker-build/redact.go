@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Matches the build arg names that are sensitive without being marked
+// with the sensitive-build-arg flag
+var sensitiveNameRegexp = regexp.MustCompile(`(?i)password|passwd|token|secret|credential|api_?key|private_?key`)
+
+// Masks the sensitive values in the logged params and kaniko args.
+// The sensitive values are:
+// - the values of the build args marked sensitive or with a sensitive name
+// - the values of the build arg envs, which are typically secrets
+// - the credentials in the context source url
+// - the contents of the secret files
+type redactor struct {
+	secrets []string
+}
+
+func newRedactor(
+	buildArgs []string,
+	buildArgEnvs []string,
+	sensitiveBuildArgs []string,
+	contextSource string,
+	secretFiles []secretFile,
+) redactor {
+	secrets := []string{}
+	for _, buildArg := range buildArgs {
+		key, value, _ := strings.Cut(buildArg, "=")
+		if slices.Contains(sensitiveBuildArgs, key) || sensitiveNameRegexp.MatchString(key) {
+			secrets = append(secrets, value)
+		}
+	}
+	for _, buildArgEnv := range buildArgEnvs {
+		secrets = append(secrets, os.Getenv(buildArgEnv))
+	}
+	secrets = append(secrets, getUrlCredentials(contextSource)...)
+	secrets = append(secrets, getSecretFileValues(secretFiles)...)
+
+	// Replace the longest secrets first, in case one contains another
+	secrets = slices.DeleteFunc(secrets, func(secret string) bool { return secret == "" })
+	slices.SortFunc(secrets, func(a, b string) int { return cmp.Compare(len(b), len(a)) })
+	return redactor{secrets: secrets}
+}
+
+// Returns the value with the sensitive values masked
+func (r redactor) redact(value string) string {
+	for _, secret := range r.secrets {
+		value = strings.ReplaceAll(value, secret, REDACTED_VALUE)
+	}
+	return value
+}
+
+// Returns a copy of the values with the sensitive values masked
+func (r redactor) redactAll(values []string) []string {
+	redactedValues := make([]string, len(values))
+	for i, value := range values {
+		redactedValues[i] = r.redact(value)
+	}
+	return redactedValues
+}
+
+// Returns the user info of the url (e.g. a token in https://<token>@host),
+// or nil if the url has no credentials
+func getUrlCredentials(rawUrl string) []string {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil || parsedUrl.User == nil {
+		return nil
+	}
+	password, hasPassword := parsedUrl.User.Password()
+	if hasPassword {
+		return []string{password}
+	}
+	return []string{parsedUrl.User.Username()}
+}
+
+// A writer that masks the sensitive values in the output written to it.
+// The output is masked line by line, so a value split across writes is
+// still masked. Flush writes the last line if it has no newline
+type redactingWriter struct {
+	writer   io.Writer
+	redactor redactor
+	line     []byte
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.line = append(w.line, p...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		_, err := io.WriteString(w.writer, w.redactor.redact(string(w.line[:i+1])))
+		w.line = w.line[i+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Writes the buffered output that does not end with a newline
+func (w *redactingWriter) Flush() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.writer, w.redactor.redact(string(w.line)))
+	w.line = nil
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// The timeout of the registry preflight check of each repo
+const REGISTRY_PREFLIGHT_TIMEOUT = 30 * time.Second
+
+// Parses the image reference. Images in the insecure registries are
+// accessed using plain HTTP
+func parseImageReference(image string, insecureRegistries []string) (name.Reference, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(insecureRegistries, ref.Context().RegistryStr()) {
+		return name.ParseReference(image, name.Insecure)
+	}
+	return ref, nil
+}
+
+// Returns the options for the registry requests. The registry credentials
+// are read from the docker config, which is where kaniko reads them from
+func getRemoteOptions(ctx context.Context, skipTlsVerify bool) []remote.Option {
+	opts := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+	}
+	if skipTlsVerify {
+		transport := remote.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		opts = append(opts, remote.WithTransport(transport))
+	}
+	return opts
+}
+
+// Returns the digest of the image if it exists in the registry
+func getRemoteImageDigest(image string, insecureRegistries []string) (string, bool, error) {
+	ref, err := parseImageReference(image, insecureRegistries)
+	if err != nil {
+		return "", false, err
+	}
+
+	desc, err := remote.Head(ref, getRemoteOptions(context.Background(), false)...)
+	if err != nil {
+		var transportErr *transport.Error
+		if errors.As(err, &transportErr) && transportErr.StatusCode == http.StatusNotFound {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return desc.Digest.String(), true, nil
+}
+
+// Checks that none of the image tags already exist, so the push does not
+// overwrite them. The first existing tag fails with the digest it points to
+func checkTagsNotExist(images []string, insecureRegistries []string) error {
+	for _, image := range images {
+		digest, exists, err := getRemoteImageDigest(image, insecureRegistries)
+		if err != nil {
+			return newStepError(REGISTRY_PREFLIGHT_ERROR, fmt.Errorf("error checking whether %s exists: %w", image, err))
+		}
+		if exists {
+			return newStepError(
+				TAG_EXISTS_ERROR,
+				fmt.Errorf("image tag %s already exists with digest %s. Refusing to overwrite it", image, digest))
+		}
+		slog.Debug("Image tag does not exist", "image", image)
+	}
+	return nil
+}
+
+// Checks that the registry is reachable and the credentials can push to each
+// image repo. An upload session is started and then cancelled, so nothing is
+// written to the repos
+func checkRegistryPush(ctx context.Context, images []string, insecureRegistries []string, skipTlsVerify bool) error {
+	baseTransport := remote.DefaultTransport.(*http.Transport).Clone()
+	if skipTlsVerify {
+		baseTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	for _, image := range images {
+		ref, err := parseImageReference(image, insecureRegistries)
+		if err != nil {
+			return newStepError(FLAG_ERROR, err)
+		}
+
+		slog.Info("Checking the registry push permission", "repo", ref.Context().Name())
+		checkCtx, cancel := context.WithTimeout(ctx, REGISTRY_PREFLIGHT_TIMEOUT)
+		err = remote.CheckPushPermission(ref, authn.DefaultKeychain, contextTransport{ctx: checkCtx, base: baseTransport})
+		cancel()
+		if err != nil {
+			var transportErr *transport.Error
+			if errors.As(err, &transportErr) &&
+				(transportErr.StatusCode == http.StatusUnauthorized || transportErr.StatusCode == http.StatusForbidden) {
+				return newStepError(
+					REGISTRY_PREFLIGHT_ERROR,
+					fmt.Errorf("registry unauthorized: the credentials cannot push to %s: %w", ref.Context().Name(), err))
+			}
+			return newStepError(
+				REGISTRY_PREFLIGHT_ERROR,
+				fmt.Errorf("registry unreachable: unable to check the push permission for %s: %w", ref.Context().Name(), err))
+		}
+	}
+	slog.Info("The registry credentials can push to the image repos", "images", images)
+	return nil
+}
+
+// Sets the context of the requests, for the registry calls that do not
+// take a context
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The remote downloads are not checked
+	REMOTE_CONTENT_MODE_OFF = "off"
+	// The remote downloads without a checksum are logged, but do not fail
+	// the build
+	REMOTE_CONTENT_MODE_WARN = "warn"
+	// The remote downloads without a checksum fail the build
+	REMOTE_CONTENT_MODE_ERROR = "error"
+)
+
+// The supported remote content modes
+var remoteContentModes = []string{REMOTE_CONTENT_MODE_OFF, REMOTE_CONTENT_MODE_WARN, REMOTE_CONTENT_MODE_ERROR}
+
+var (
+	// Matches a command that downloads a url in a RUN instruction
+	downloadRegexp = regexp.MustCompile(`(^|[\s;&|(])(curl|wget)\s`)
+	// Matches a http url in a RUN instruction
+	httpUrlRegexp = regexp.MustCompile(`https?://[^\s'"|;&()<>]+`)
+	// Matches a command that verifies the checksum or signature of a
+	// download in a RUN instruction
+	checksumRegexp = regexp.MustCompile(`(^|[\s;&|(])(sha256sum|sha384sum|sha512sum|shasum|gpg\s+(\S+\s+)*--verify|cosign\s+verify-blob)(\s|$)`)
+)
+
+// The options for checking that the remote content the dockerfile
+// downloads is pinned with a checksum, since an unpinned download can
+// change without a change to the dockerfile
+type remoteContentOptions struct {
+	mode string
+	// The url prefixes that do not need a checksum (e.g. an internal
+	// artifact repo with immutable versions)
+	allowedUrls []string
+}
+
+// A remote download without a checksum
+type remoteContentFinding struct {
+	line    int
+	url     string
+	message string
+}
+
+func (f remoteContentFinding) String() string {
+	return fmt.Sprintf("line %d: %s", f.line, f.message)
+}
+
+func configureRemoteContentFlags(flags *pflag.FlagSet) {
+	flags.String(
+		"remote-content",
+		REMOTE_CONTENT_MODE_OFF,
+		fmt.Sprintf(
+			"The mode of the check that the ADD and RUN instructions of the dockerfile verify a checksum of the "+
+				"remote urls they download. One of %s", remoteContentModes))
+	flags.StringArray(
+		"remote-content-allowed-url",
+		nil,
+		"A url prefix that can be downloaded without a checksum (e.g. https://artifacts.example.com/releases/). "+
+			"Can be repeated")
+}
+
+func getRemoteContentOptions(flags *pflag.FlagSet, cmdName string) (remoteContentOptions, error) {
+	var opts remoteContentOptions
+	var err error
+
+	opts.mode, err = flags.GetString("remote-content")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s remote-content flag", cmdName)
+	}
+	if !slices.Contains(remoteContentModes, opts.mode) {
+		return opts, fmt.Errorf("remote-content must be one of %s: %s", remoteContentModes, opts.mode)
+	}
+
+	opts.allowedUrls, err = flags.GetStringArray("remote-content-allowed-url")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s remote-content-allowed-url flag", cmdName)
+	}
+	return opts, nil
+}
+
+func (opts remoteContentOptions) logAttrs() []any {
+	return []any{
+		"remoteContentMode", opts.mode,
+		"remoteContentAllowedUrls", opts.allowedUrls,
+	}
+}
+
+// Checks that the remote urls downloaded by the dockerfile are pinned with
+// a checksum. An ADD url must set the --checksum flag, and a RUN
+// instruction that downloads a url with curl or wget must verify it (e.g.
+// with sha256sum -c)
+func (opts remoteContentOptions) check(dockerfilePath string) error {
+	if opts.mode == REMOTE_CONTENT_MODE_OFF {
+		return nil
+	}
+
+	slog.Info("Checking the dockerfile remote content", "dockerfile", dockerfilePath)
+	instructions, err := readDockerfile(dockerfilePath)
+	if err != nil {
+		return newStepError(POLICY_ERROR, fmt.Errorf("error parsing dockerfile: %s", err))
+	}
+
+	findings := opts.getFindings(instructions)
+	for _, finding := range findings {
+		slog.Warn("Remote content without a checksum", "line", finding.line, "url", finding.url, "message", finding.message)
+	}
+	slog.Info("Checked the dockerfile remote content", "findings", len(findings))
+
+	if opts.mode == REMOTE_CONTENT_MODE_ERROR && len(findings) > 0 {
+		return newStepError(
+			POLICY_ERROR,
+			fmt.Errorf("dockerfile has %d remote downloads without a checksum: %s", len(findings), findings))
+	}
+	return nil
+}
+
+// Returns the remote downloads of the instructions without a checksum
+func (opts remoteContentOptions) getFindings(instructions []instruction) []remoteContentFinding {
+	findings := []remoteContentFinding{}
+	for _, inst := range instructions {
+		switch inst.cmd {
+		case "ADD":
+			if _, ok := inst.flagValue("checksum"); ok {
+				continue
+			}
+			for _, source := range getAddSources(inst.args) {
+				if !isRemoteSource(source) || opts.isAllowedUrl(source) {
+					continue
+				}
+				// The checksum of a git repo is the commit hash
+				checksum := "sha256:<digest>"
+				if strings.HasPrefix(source, "git@") || strings.Contains(source, ".git") {
+					checksum = "<commit>"
+				}
+				findings = append(findings, remoteContentFinding{
+					line:    inst.line,
+					url:     source,
+					message: fmt.Sprintf("ADD %s has no checksum. Set --checksum=%s", source, checksum),
+				})
+			}
+		case "RUN":
+			if !downloadRegexp.MatchString(inst.args) || checksumRegexp.MatchString(inst.args) {
+				continue
+			}
+			for _, url := range httpUrlRegexp.FindAllString(inst.args, -1) {
+				if opts.isAllowedUrl(url) {
+					continue
+				}
+				findings = append(findings, remoteContentFinding{
+					line:    inst.line,
+					url:     url,
+					message: fmt.Sprintf("RUN downloads %s without verifying a checksum (e.g. with sha256sum -c)", url),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// Returns whether the url matches an allowed url prefix
+func (opts remoteContentOptions) isAllowedUrl(url string) bool {
+	for _, allowedUrl := range opts.allowedUrls {
+		if strings.HasPrefix(url, allowedUrl) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the sources of the ADD args, in the shell or the JSON form. The
+// last arg is the destination
+func getAddSources(args string) []string {
+	var sources []string
+	if strings.HasPrefix(args, "[") {
+		if json.Unmarshal([]byte(args), &sources) != nil {
+			return nil
+		}
+	} else {
+		sources = strings.Fields(args)
+	}
+	if len(sources) < 2 {
+		return nil
+	}
+	return sources[:len(sources)-1]
+}
+
+// Returns whether the ADD source is a remote url or git repo
+func isRemoteSource(source string) bool {
+	return urlRegexp.MatchString(source) || strings.HasPrefix(source, "git@")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/spf13/pflag"
+)
+
+// The options for requiring labels on the built image, which the asset
+// inventory reads (e.g. the team and cost center). The labels are read from
+// the config of the built image, so they include the labels of the LABEL
+// instructions, the label flag, and the base image
+type requiredLabelOptions struct {
+	labels []string
+}
+
+func configureRequiredLabelFlags(flags *pflag.FlagSet) {
+	flags.StringArray(
+		"required-label",
+		nil,
+		"A label key that the built image must have with a non empty value (e.g. team or "+
+			"org.opencontainers.image.source). Can be repeated")
+}
+
+func getRequiredLabelOptions(flags *pflag.FlagSet, cmdName string) (requiredLabelOptions, error) {
+	var opts requiredLabelOptions
+	var err error
+
+	opts.labels, err = flags.GetStringArray("required-label")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s required-label flag", cmdName)
+	}
+	for _, label := range opts.labels {
+		if label == "" || strings.ContainsAny(label, "= ") {
+			return opts, fmt.Errorf("required-label must be a label key: %s", label)
+		}
+	}
+	return opts, nil
+}
+
+func (opts requiredLabelOptions) logAttrs() []any {
+	return []any{
+		"requiredLabels", opts.labels,
+	}
+}
+
+// Checks that the pushed image has the required labels. For an image
+// index, the first image is checked, since the platform images share the
+// labels of the build
+func (opts requiredLabelOptions) checkImage(
+	ctx context.Context,
+	imageName string,
+	digest string,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) error {
+	if len(opts.labels) == 0 {
+		return nil
+	}
+
+	ref, err := parseImageReference(fmt.Sprintf("%s@%s", imageName, digest), insecureRegistries)
+	if err != nil {
+		return err
+	}
+	desc, err := remote.Get(ref, getRemoteOptions(ctx, skipTlsVerify)...)
+	if err != nil {
+		return newStepError(POLICY_ERROR, fmt.Errorf("error reading image %s: %w", ref, err))
+	}
+	configFile, err := getDescriptorConfigFile(desc)
+	if err != nil {
+		return newStepError(POLICY_ERROR, fmt.Errorf("error reading image %s config: %w", ref, err))
+	}
+	return opts.checkConfigFile(imageName, configFile)
+}
+
+// Checks that the image in the tarball has the required labels
+func (opts requiredLabelOptions) checkTarball(imageName string, tarPath string) error {
+	if len(opts.labels) == 0 {
+		return nil
+	}
+
+	img, err := tarball.ImageFromPath(tarPath, nil)
+	if err != nil {
+		return newStepError(POLICY_ERROR, fmt.Errorf("error reading image tarball %s: %w", tarPath, err))
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return newStepError(POLICY_ERROR, fmt.Errorf("error reading image tarball %s config: %w", tarPath, err))
+	}
+	return opts.checkConfigFile(imageName, configFile)
+}
+
+// Checks the labels of the image config. A label with an empty value is
+// missing, since it does not identify anything for the inventory
+func (opts requiredLabelOptions) checkConfigFile(imageName string, configFile *v1.ConfigFile) error {
+	missingLabels := []string{}
+	presentLabels := []string{}
+	for _, label := range opts.labels {
+		if strings.TrimSpace(configFile.Config.Labels[label]) == "" {
+			slog.Error("Image is missing a required label", "image", imageName, "label", label)
+			missingLabels = append(missingLabels, label)
+			continue
+		}
+		presentLabels = append(presentLabels, label)
+	}
+	if len(missingLabels) == 0 {
+		slog.Info("Image has the required labels", "image", imageName, "requiredLabels", opts.labels)
+		return nil
+	}
+	return newStepError(
+		POLICY_ERROR,
+		fmt.Errorf(
+			"image %s is missing the required labels %s (present %s). Add them with LABEL in the dockerfile or "+
+				"with the label flag",
+			imageName,
+			missingLabels,
+			presentLabels))
+}
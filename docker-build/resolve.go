@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+func handleResolveCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	resolveFlags := cmd.Flags()
+
+	image, err := resolveFlags.GetString("image")
+	if err != nil {
+		return fmt.Errorf("error processing resolve image flag")
+	}
+
+	digestFile, err := resolveFlags.GetString("digest-file")
+	if err != nil {
+		return fmt.Errorf("error processing resolve digest-file flag")
+	}
+
+	imageRefFile, err := resolveFlags.GetString("image-ref-file")
+	if err != nil {
+		return fmt.Errorf("error processing resolve image-ref-file flag")
+	}
+
+	insecureRegistries, err := resolveFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing resolve insecure-registry flag")
+	}
+
+	skipTlsVerify, err := resolveFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing resolve skip-tls-verify flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(resolveFlags, "resolve")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"image", image,
+		"digestFile", digestFile,
+		"imageRefFile", imageRefFile,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+	}
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("Resolve with params", params...)
+
+	ref, err := parseImageReference(image, insecureRegistries)
+	if err != nil {
+		return fmt.Errorf("image is not a valid image reference: %s", err)
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	err = registryAuthOpts.login(ctx, ref.Context().RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	digest, err := resolveImageDigest(ctx, ref, skipTlsVerify)
+	if err != nil {
+		return err
+	}
+	slog.Info("Resolved image digest", "image", ref.String(), "digest", digest)
+
+	// The image ref is pinned to the digest, keeping the tag for readability
+	imageRef := ref.String()
+	if _, ok := ref.(name.Digest); ok {
+		imageRef = ref.Context().Name()
+	}
+	return writeImageIndexFiles(digestFile, imageRefFile, imageRef, digest)
+}
+
+// Returns the current digest of the image in the registry. The manifest is
+// requested with HEAD, falling back to GET for registries that do not return
+// the digest header
+func resolveImageDigest(ctx context.Context, ref name.Reference, skipTlsVerify bool) (string, error) {
+	remoteOpts := getRemoteOptions(ctx, skipTlsVerify)
+
+	desc, err := remote.Head(ref, remoteOpts...)
+	if err == nil {
+		return desc.Digest.String(), nil
+	}
+	slog.Debug("Unable to resolve the image digest with HEAD. Retrying with GET", "image", ref.String(), "error", err)
+
+	getDesc, err := remote.Get(ref, remoteOpts...)
+	if err != nil {
+		return "", newStepError(REGISTRY_PREFLIGHT_ERROR, fmt.Errorf("error resolving the digest of %s: %w", ref, err))
+	}
+	return getDesc.Digest.String(), nil
+}
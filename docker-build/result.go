@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Result status when the image build succeeds
+	BUILT_STATUS = "Built"
+	// Result status when the image build fails
+	FAILED_STATUS = "Failed"
+	// Result status when the image build exceeds the timeout
+	TIMEOUT_STATUS = "Timeout"
+	// Result status when the image build is cancelled by a signal
+	CANCELLED_STATUS = "Cancelled"
+)
+
+// The result written to the result file. This is the source of truth
+// for the downstream deploy and notification steps
+type buildResult struct {
+	Status string `json:"status"`
+	// The reason the build was skipped, from the status file
+	SkipReason string `json:"skipReason,omitempty"`
+	// The image reference, including the tag
+	Image string `json:"image,omitempty"`
+	// The digest of the image, if it was built
+	Digest string `json:"digest,omitempty"`
+	// The content hash of the build inputs, if computed
+	ContentHash string `json:"contentHash,omitempty"`
+	// The pinned image of each FROM image, if the base images were pinned
+	BaseImagePins map[string]string `json:"baseImagePins,omitempty"`
+	// The start and end time of the build, if it started
+	StartTime time.Time `json:"startTime,omitzero"`
+	EndTime   time.Time `json:"endTime,omitzero"`
+	// The duration of the build in seconds
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	// The transparency log entries of the image signatures, if the image
+	// was signed with the transparency log upload
+	TransparencyLogEntries []transparencyLogEntry `json:"transparencyLogEntries,omitempty"`
+	// The exit code of the last kaniko run, if kaniko ran
+	KanikoExitCode *int `json:"kanikoExitCode,omitempty"`
+	// The class of the error if the build did not succeed
+	Error errorClass `json:"error,omitempty"`
+	// The human readable error message if the build did not succeed
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// Returns the build result for the build outcome
+func newBuildResult(outcome buildOutcome) buildResult {
+	result := buildResult{
+		Status:                 BUILT_STATUS,
+		Image:                  outcome.image,
+		Digest:                 outcome.digest,
+		ContentHash:            outcome.contentHash,
+		BaseImagePins:          outcome.baseImagePins,
+		StartTime:              outcome.startTime,
+		EndTime:                outcome.endTime,
+		TransparencyLogEntries: outcome.transparencyLogEntries,
+	}
+	if !outcome.startTime.IsZero() {
+		result.DurationSeconds = outcome.endTime.Sub(outcome.startTime).Seconds()
+		exitCode := 0
+		var kanikoErr *kanikoExitError
+		if errors.As(outcome.err, &kanikoErr) {
+			exitCode = kanikoErr.exitCode
+		}
+		if outcome.err == nil || kanikoErr != nil {
+			result.KanikoExitCode = &exitCode
+		}
+	}
+	if outcome.err == nil {
+		return result
+	}
+
+	result.Status = FAILED_STATUS
+	result.Error = getErrorClass(outcome.err)
+	if result.Error == "" {
+		result.Error = INTERNAL_ERROR
+	}
+	result.ErrorMessage = outcome.err.Error()
+	switch result.Error {
+	case TIMEOUT_ERROR:
+		result.Status = TIMEOUT_STATUS
+	case CANCELLED_ERROR:
+		result.Status = CANCELLED_STATUS
+	}
+	return result
+}
+
+// The outputs that the build result is written to
+type resultOutputs struct {
+	// The path to write the result to as JSON
+	resultFile string
+	// The dir to write the Argo Workflows output parameter files to
+	argoOutputsDir string
+	// The dir to write the Tekton result files to (e.g. /tekton/results)
+	tektonResultsDir string
+}
+
+// Returns whether any of the result outputs are set
+func (o resultOutputs) isSet() bool {
+	return o.resultFile != "" || o.argoOutputsDir != "" || o.tektonResultsDir != ""
+}
+
+// Writes the result to each of the outputs that are set
+func (o resultOutputs) write(result buildResult) error {
+	err := writeResultFile(o.resultFile, result)
+	if err != nil {
+		return err
+	}
+	err = writeArgoOutputs(o.argoOutputsDir, result)
+	if err != nil {
+		return err
+	}
+	return writeTektonResults(o.tektonResultsDir, result)
+}
+
+// Writes the failed result for an error that occurs before the build
+// starts, and returns the error
+func (o resultOutputs) writeFailed(err error) error {
+	resultErr := o.write(newBuildResult(buildOutcome{err: err}))
+	if resultErr != nil {
+		slog.Warn("Unable to write the failed result", "error", resultErr)
+	}
+	return err
+}
+
+// Returns a post build hook that writes the build result to the outputs
+func (o resultOutputs) hook() postBuildHook {
+	return func(outcome *buildOutcome) error {
+		return o.write(newBuildResult(*outcome))
+	}
+}
+
+// Writes the result as JSON to the result file. Does nothing if the
+// result file is not set
+func writeResultFile(resultFile string, result buildResult) error {
+	if resultFile == "" {
+		return nil
+	}
+
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding result: %s", err)
+	}
+	err = os.WriteFile(resultFile, append(bytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing result file: %s", err)
+	}
+	slog.Info("Wrote result file", "status", result.Status, "resultFile", resultFile)
+	return nil
+}
+
+// Writes the image, digest, and status of the result to individual files
+// in the Argo outputs dir, so they can be read as output parameters with
+// valueFrom.path. The files are written even if the values are empty, since
+// Argo fails the step if an output parameter file is missing. Does nothing
+// if the dir is not set
+// See https://argo-workflows.readthedocs.io/en/latest/walk-through/output-parameters/
+func writeArgoOutputs(argoOutputsDir string, result buildResult) error {
+	if argoOutputsDir == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(argoOutputsDir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating argo outputs dir: %s", err)
+	}
+	outputs := map[string]string{
+		"image":  result.Image,
+		"digest": result.Digest,
+		"status": result.Status,
+	}
+	for name, value := range outputs {
+		err = os.WriteFile(filepath.Join(argoOutputsDir, name), []byte(value), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing argo output %s: %s", name, err)
+		}
+	}
+	slog.Info("Wrote argo outputs", "status", result.Status, "argoOutputsDir", argoOutputsDir)
+	return nil
+}
+
+// Writes the image url and digest of the result to the Tekton results dir,
+// using the IMAGE_URL and IMAGE_DIGEST result names that Tekton Chains
+// recognizes for provenance. Does nothing if the dir is not set
+// See https://tekton.dev/docs/pipelines/tasks/#emitting-results
+func writeTektonResults(tektonResultsDir string, result buildResult) error {
+	if tektonResultsDir == "" {
+		return nil
+	}
+
+	results := map[string]string{
+		"IMAGE_URL":    result.Image,
+		"IMAGE_DIGEST": result.Digest,
+	}
+	for name, value := range results {
+		err := os.WriteFile(filepath.Join(tektonResultsDir, name), []byte(value), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing tekton result %s: %s", name, err)
+		}
+	}
+	slog.Info("Wrote tekton results", "status", result.Status, "tektonResultsDir", tektonResultsDir)
+	return nil
+}
+
+// Returns the digest file for kaniko to write to. If the digest file is
+// not set, but the digest is needed for the result, a temp file is used
+func getResultDigestFile(digestFile string, outputs resultOutputs) string {
+	if digestFile != "" || !outputs.isSet() {
+		return digestFile
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("docker-build-digest-%d", os.Getpid()))
+}
+
+// Reads the image digest written by kaniko. Returns an empty digest if
+// the digest file is not set or could not be read
+func readDigestFile(digestFile string) string {
+	if digestFile == "" {
+		return ""
+	}
+	bytes, err := os.ReadFile(digestFile)
+	if err != nil {
+		slog.Warn("Unable to read the image digest", "error", err)
+		return ""
+	}
+	return strings.TrimSpace(string(bytes))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+func handleTagCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	tagFlags := cmd.Flags()
+
+	image, err := tagFlags.GetString("image")
+	if err != nil {
+		return fmt.Errorf("error processing tag image flag")
+	}
+
+	tags, err := tagFlags.GetStringArray("tag")
+	if err != nil {
+		return fmt.Errorf("error processing tag tag flag")
+	}
+	if len(tags) == 0 {
+		return fmt.Errorf("at least one tag must be set")
+	}
+
+	insecureRegistries, err := tagFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing tag insecure-registry flag")
+	}
+
+	skipTlsVerify, err := tagFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing tag skip-tls-verify flag")
+	}
+
+	dryRun, err := tagFlags.GetBool("dry-run")
+	if err != nil {
+		return fmt.Errorf("error processing tag dry-run flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(tagFlags, "tag")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"image", image,
+		"tags", tags,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+		"dryRun", dryRun,
+	}
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("Tag with params", params...)
+
+	ref, err := parseImageReference(image, insecureRegistries)
+	if err != nil {
+		return fmt.Errorf("image is not a valid image reference: %s", err)
+	}
+	if _, ok := ref.(name.Digest); !ok {
+		slog.Warn("The image is not pinned by digest. Tagging the image the tag currently points to", "image", image)
+	}
+	newTags := []name.Tag{}
+	for _, tag := range tags {
+		_, err := name.NewTag(fmt.Sprintf("%s:%s", ref.Context().Name(), tag), name.StrictValidation)
+		if err != nil {
+			return fmt.Errorf("tag is not a valid image tag: %s", err)
+		}
+		// The repo keeps the insecure registry option of the image
+		newTags = append(newTags, ref.Context().Tag(tag))
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	err = registryAuthOpts.login(ctx, ref.Context().RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	return tagImage(ctx, ref, newTags, skipTlsVerify, dryRun)
+}
+
+// Adds the tags to the existing image by putting its manifest, so the image
+// is not pulled or rebuilt
+func tagImage(ctx context.Context, ref name.Reference, tags []name.Tag, skipTlsVerify bool, dryRun bool) error {
+	remoteOpts := getRemoteOptions(ctx, skipTlsVerify)
+
+	desc, err := remote.Get(ref, remoteOpts...)
+	if err != nil {
+		return fmt.Errorf("error reading the image %s: %w", ref, err)
+	}
+	digest := desc.Digest.String()
+
+	for _, tag := range tags {
+		if dryRun {
+			slog.Info("Dry run is set. Skipping tag", "tag", tag.String(), "digest", digest)
+			continue
+		}
+		err = remote.Tag(tag, desc, remoteOpts...)
+		if err != nil {
+			return newStepError(PUSH_ERROR, fmt.Errorf("error tagging the image as %s: %w", tag, err))
+		}
+		slog.Info("Tagged image", "tag", tag.String(), "digest", digest)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Number of bytes kept from the end of the kaniko output
+	KANIKO_OUTPUT_TAIL_SIZE = 64 * 1024
+	// Exit code when the build exceeds the timeout. Matches the exit
+	// code of the coreutils timeout command
+	TIMEOUT_EXIT_CODE = 124
+	// Exit code when the build is cancelled by a SIGTERM or SIGINT signal.
+	// Matches the shell convention for processes terminated by SIGTERM
+	CANCELLED_EXIT_CODE = 143
+	// Default time to wait for kaniko to exit after forwarding SIGTERM,
+	// before it is killed. Should be less than the pod termination grace
+	// period, which defaults to 30s
+	DEFAULT_GRACE_PERIOD = 20 * time.Second
+)
+
+var (
+	// Matches the builder output when the image is built, but the push fails
+	kanikoPushErrorRegexp = regexp.MustCompile(`(?i)error pushing image|failed to push`)
+	// Matches the builder output when the registry rate limits the pulls or
+	// pushes (e.g. the Docker Hub pull limit)
+	// See https://docs.docker.com/docker-hub/usage/pulls/
+	rateLimitErrorRegexp = regexp.MustCompile(`(?i)toomanyrequests|429 too many requests|reached your pull rate limit`)
+
+	// Error returned when the build exceeds the timeout
+	errBuildTimeout = errors.New("build timed out")
+	// Error returned when the build is cancelled by a signal
+	errBuildCancelled = errors.New("build cancelled")
+)
+
+// Returns a context that is cancelled with errBuildCancelled when a
+// SIGTERM or SIGINT signal is received (e.g. when Argo deletes the pod).
+// The returned func stops the signal handling
+func withTerminationSignals(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Info("Received signal. Cancelling the build", "signal", sig.String())
+			cancel(errBuildCancelled)
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel(nil)
+	}
+}
+
+// Keeps the last bytes written to it, so the end of the kaniko output
+// can be inspected after the build
+type tailBuffer struct {
+	mu    sync.Mutex
+	limit int
+	data  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data = append(b.data, p...)
+	if len(b.data) > b.limit {
+		b.data = b.data[len(b.data)-b.limit:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return string(b.data)
+}
+
+// Runs the builder command as a child process. The output is streamed to
+// stdout and stderr, and the tail of the output is returned.
+//
+// When the context is done, SIGTERM is forwarded to the builder. If the
+// builder does not exit within the grace period, it is killed
+func runBuilder(
+	ctx context.Context,
+	command builderCommand,
+	gracePeriod time.Duration,
+	redactor redactor,
+) (string, error) {
+	output := &tailBuffer{limit: KANIKO_OUTPUT_TAIL_SIZE}
+	builderCmd := exec.CommandContext(ctx, command.path)
+	builderCmd.Args = command.args
+	builderCmd.Stdout = io.MultiWriter(os.Stdout, output)
+	builderCmd.Stderr = io.MultiWriter(os.Stderr, output)
+	// The builder output is masked if there are secrets, since a builder
+	// may print the build args or a RUN may print a secret
+	redactingWriters := []*redactingWriter{}
+	if len(redactor.secrets) > 0 {
+		stdout := &redactingWriter{writer: builderCmd.Stdout, redactor: redactor}
+		stderr := &redactingWriter{writer: builderCmd.Stderr, redactor: redactor}
+		redactingWriters = append(redactingWriters, stdout, stderr)
+		builderCmd.Stdout = stdout
+		builderCmd.Stderr = stderr
+	}
+	builderCmd.Cancel = func() error {
+		slog.Info("Sending SIGTERM to the builder. Waiting for it to exit", "builder", command.builder, "gracePeriod", gracePeriod)
+		return builderCmd.Process.Signal(syscall.SIGTERM)
+	}
+	builderCmd.WaitDelay = gracePeriod
+
+	err := builderCmd.Run()
+	for _, redactingWriter := range redactingWriters {
+		redactingWriter.Flush()
+	}
+	if err != nil && ctx.Err() != nil {
+		if stoppedErr := getStoppedError(ctx, command.builder); stoppedErr != nil {
+			return output.String(), stoppedErr
+		}
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if notFoundErr := getToolNotFoundError(err, command.builder, command.path); notFoundErr != nil {
+			return output.String(), notFoundErr
+		}
+		if !errors.As(err, &exitErr) {
+			return output.String(), newStepError(BUILD_ERROR, fmt.Errorf("error running %s: %w", command.builder, err))
+		}
+		kanikoErr := &kanikoExitError{builder: command.builder, exitCode: exitErr.ExitCode()}
+		if rateLimitErrorRegexp.MatchString(output.String()) {
+			return output.String(), newStepError(RATE_LIMIT_ERROR, kanikoErr)
+		}
+		if kanikoPushErrorRegexp.MatchString(output.String()) {
+			return output.String(), newStepError(PUSH_ERROR, kanikoErr)
+		}
+		return output.String(), newStepError(BUILD_ERROR, kanikoErr)
+	}
+	for _, next := range command.then {
+		nextOutput, err := runBuilder(ctx, next, gracePeriod, redactor)
+		if err != nil {
+			return nextOutput, err
+		}
+	}
+	if command.finish != nil {
+		err = command.finish()
+		if err != nil {
+			return output.String(), newStepError(BUILD_ERROR, err)
+		}
+	}
+	return output.String(), nil
+}
+
+// Returns the classified error if the context was stopped by the timeout
+// or a termination signal, or nil otherwise
+func getStoppedError(ctx context.Context, builder string) error {
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, errBuildTimeout):
+		return newStepError(TIMEOUT_ERROR, fmt.Errorf("%s was stopped: %w", builder, errBuildTimeout))
+	case errors.Is(cause, errBuildCancelled):
+		return newStepError(CANCELLED_ERROR, fmt.Errorf("%s was stopped: %w", builder, errBuildCancelled))
+	}
+	return nil
+}
+
+// Returns the tool not found error if the tool executable does not exist
+// at its path, or nil otherwise. This keeps a misconfigured image apart from
+// the failures of the tool, such as the vulnerabilities found by a scanner
+func getToolNotFoundError(err error, tool string, toolPath string) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return newStepError(TOOL_NOT_FOUND_ERROR, fmt.Errorf("%s was not found at %s: %w", tool, toolPath, err))
+	}
+	return nil
+}
+
+// Checks that the tool executable exists at its path, so a misconfigured
+// image fails before the slow registry calls
+func checkToolPath(tool string, toolPath string) error {
+	_, err := exec.LookPath(toolPath)
+	if err != nil {
+		return newStepError(TOOL_NOT_FOUND_ERROR, fmt.Errorf("%s was not found at %s: %w", tool, toolPath, err))
+	}
+	return nil
+}
+
+// The outcome of the kaniko builds for a subcommand
+type buildOutcome struct {
+	// The reference of the built image, if any
+	image string
+	// The digest of the built image, if known
+	digest string
+	// The content hash of the build inputs, if computed
+	contentHash string
+	// The pinned image of each FROM image, if the base images were pinned
+	baseImagePins map[string]string
+	startTime     time.Time
+	endTime       time.Time
+	// The tail of the output of the last kaniko run
+	output string
+	// The transparency log entries of the image signatures, if signed
+	transparencyLogEntries []transparencyLogEntry
+	// The build error, or nil if the build succeeded
+	err error
+}
+
+// A hook that runs after the build completes, whether or not it succeeded.
+// This is the extension point for post build work such as writing results.
+// The hooks run in order, so a hook may record its work in the outcome for
+// the later hooks (e.g. the signatures for the result)
+type postBuildHook func(outcome *buildOutcome) error
+
+// Runs all of the post build hooks and returns the build error, if any.
+// Otherwise, the first error from the hooks is returned
+func runPostBuildHooks(hooks []postBuildHook, outcome buildOutcome) error {
+	var hookErr error
+	for _, hook := range hooks {
+		err := hook(&outcome)
+		if err == nil {
+			continue
+		}
+		slog.Error("Post build hook failed", "error", err)
+		if hookErr == nil {
+			hookErr = err
+		}
+	}
+
+	if outcome.err != nil {
+		return outcome.err
+	}
+	return hookErr
+}
+
+// Post build hook that logs whether the build succeeded and its duration
+func logBuildOutcome(outcome *buildOutcome) error {
+	duration := outcome.endTime.Sub(outcome.startTime).Round(time.Second)
+	if outcome.err != nil {
+		slog.Error("Build failed", "duration", duration, "error", outcome.err, "errorClass", getErrorClass(outcome.err))
+		return nil
+	}
+	slog.Info("Build succeeded", "duration", duration)
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The SPDX JSON SBOM format
+	SPDX_SBOM_FORMAT = "spdx-json"
+	// The CycloneDX JSON SBOM format
+	CYCLONEDX_SBOM_FORMAT = "cyclonedx-json"
+
+	// The default syft path, which is resolved with the PATH
+	DEFAULT_SYFT_PATH = "syft"
+)
+
+// The supported SBOM formats
+var sbomFormats = []string{SPDX_SBOM_FORMAT, CYCLONEDX_SBOM_FORMAT}
+
+// The media type of each SBOM format, which is the artifact type of the
+// attached SBOM
+var sbomMediaTypes = map[string]types.MediaType{
+	SPDX_SBOM_FORMAT:      "application/spdx+json",
+	CYCLONEDX_SBOM_FORMAT: "application/vnd.cyclonedx+json",
+}
+
+// The options for generating the SBOM of the built image with syft
+// See https://github.com/anchore/syft
+type sbomOptions struct {
+	enabled  bool
+	syftPath string
+	format   string
+	// The path to write the SBOM to, if any
+	file string
+}
+
+func configureSbomFlags(flags *pflag.FlagSet) {
+	flags.Bool("sbom", false, "Whether to generate the SBOM of the built image with syft")
+	flags.String("sbom-format", SPDX_SBOM_FORMAT, fmt.Sprintf("The SBOM format. One of %s", sbomFormats))
+	flags.String("sbom-file", "", "The path to write the SBOM to (e.g. in the result dir)")
+	flags.String("syft-path", DEFAULT_SYFT_PATH, "The path to the syft executable")
+}
+
+func getSbomOptions(flags *pflag.FlagSet, cmdName string) (sbomOptions, error) {
+	var opts sbomOptions
+	var err error
+
+	opts.enabled, err = flags.GetBool("sbom")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s sbom flag", cmdName)
+	}
+
+	opts.format, err = flags.GetString("sbom-format")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s sbom-format flag", cmdName)
+	}
+	if !slices.Contains(sbomFormats, opts.format) {
+		return opts, fmt.Errorf("sbom-format must be one of %s: %s", sbomFormats, opts.format)
+	}
+
+	opts.file, err = flags.GetString("sbom-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s sbom-file flag", cmdName)
+	}
+
+	opts.syftPath, err = flags.GetString("syft-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s syft-path flag", cmdName)
+	}
+	return opts, nil
+}
+
+func (opts sbomOptions) logAttrs() []any {
+	return []any{
+		"sbom", opts.enabled,
+		"sbomFormat", opts.format,
+		"sbomFile", opts.file,
+		"syftPath", opts.syftPath,
+	}
+}
+
+// Generates the SBOM of the image source with syft (e.g. registry:<image>
+// or docker-archive:<tar-path>). The registry images are pulled with the
+// credentials of the docker config
+func generateSbom(
+	ctx context.Context,
+	opts sbomOptions,
+	source string,
+	allowHttp bool,
+	skipTlsVerify bool,
+) ([]byte, error) {
+	sbomFile := opts.file
+	if sbomFile == "" {
+		sbomFile = filepath.Join(os.TempDir(), fmt.Sprintf("docker-build-sbom-%d", os.Getpid()))
+		defer os.Remove(sbomFile)
+	}
+	args := []string{"scan", source, "--output", fmt.Sprintf("%s=%s", opts.format, sbomFile)}
+	slog.Info("Generating SBOM", "source", source, "args", args)
+
+	syftCmd := exec.CommandContext(ctx, opts.syftPath, args...)
+	syftCmd.Stdout = os.Stdout
+	syftCmd.Stderr = os.Stderr
+	syftCmd.Env = os.Environ()
+	if allowHttp {
+		syftCmd.Env = append(syftCmd.Env, "SYFT_REGISTRY_INSECURE_USE_HTTP=true")
+	}
+	if skipTlsVerify {
+		syftCmd.Env = append(syftCmd.Env, "SYFT_REGISTRY_INSECURE_SKIP_TLS_VERIFY=true")
+	}
+	err := syftCmd.Run()
+	if err != nil {
+		if stoppedErr := getStoppedError(ctx, "syft"); stoppedErr != nil {
+			return nil, stoppedErr
+		}
+		if notFoundErr := getToolNotFoundError(err, "syft", opts.syftPath); notFoundErr != nil {
+			return nil, notFoundErr
+		}
+		return nil, fmt.Errorf("error running syft: %w", err)
+	}
+
+	sbom, err := os.ReadFile(sbomFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the SBOM: %s", err)
+	}
+	slog.Info("Generated SBOM", "source", source, "size", len(sbom), "sbomFile", opts.file)
+	return sbom, nil
+}
+
+// Attaches the SBOM to the image as an OCI referrer, so it can be found
+// with the referrers API (e.g. oras discover). For registries without the
+// referrers API, the referrers tag schema is used
+// See https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+func attachSbom(ctx context.Context, ref name.Digest, sbom []byte, format string, skipTlsVerify bool) error {
+	remoteOpts := getRemoteOptions(ctx, skipTlsVerify)
+	subject, err := remote.Head(ref, remoteOpts...)
+	if err != nil {
+		return fmt.Errorf("error reading the image %s: %w", ref, err)
+	}
+
+	mediaType := sbomMediaTypes[format]
+	artifact, err := mutate.AppendLayers(empty.Image, static.NewLayer(sbom, mediaType))
+	if err != nil {
+		return err
+	}
+	artifact = mutate.MediaType(artifact, types.OCIManifestSchema1)
+	artifact = mutate.ConfigMediaType(artifact, mediaType)
+	artifact = mutate.Subject(artifact, *subject).(v1.Image)
+	digest, err := artifact.Digest()
+	if err != nil {
+		return err
+	}
+
+	err = remote.Write(ref.Context().Digest(digest.String()), artifact, remoteOpts...)
+	if err != nil {
+		return fmt.Errorf("error pushing the SBOM for %s: %w", ref, err)
+	}
+	slog.Info("Attached SBOM", "image", ref.String(), "sbomDigest", digest.String(), "mediaType", mediaType)
+	return nil
+}
+
+// Returns a post build hook that generates the SBOM of the built image.
+// With a tar path, the image tarball is scanned. Otherwise, the pushed
+// image is scanned, and the SBOM is attached to the image in each of the
+// image repos. Does nothing if the build failed
+func generateSbomHook(
+	opts sbomOptions,
+	tarPath string,
+	imageNames []string,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) postBuildHook {
+	return func(outcome *buildOutcome) error {
+		if !opts.enabled || outcome.err != nil {
+			return nil
+		}
+		ctx, stopSignals := withTerminationSignals(context.Background())
+		defer stopSignals()
+
+		if tarPath != "" {
+			_, err := generateSbom(ctx, opts, fmt.Sprintf("docker-archive:%s", tarPath), false, false)
+			if err != nil {
+				return newStepError(SBOM_ERROR, err)
+			}
+			return nil
+		}
+
+		if outcome.image == "" {
+			return nil
+		}
+		ref, err := parseImageReference(outcome.image, insecureRegistries)
+		if err != nil {
+			return err
+		}
+		digest := outcome.digest
+		if digest == "" {
+			digest, err = resolveImageDigest(ctx, ref, skipTlsVerify)
+			if err != nil {
+				return newStepError(SBOM_ERROR, fmt.Errorf("error resolving the image digest for the SBOM: %w", err))
+			}
+		}
+		digestRef := ref.Context().Digest(digest)
+		allowHttp := slices.Contains(insecureRegistries, digestRef.RegistryStr())
+		sbom, err := generateSbom(ctx, opts, fmt.Sprintf("registry:%s", digestRef), allowHttp, skipTlsVerify)
+		if err != nil {
+			return newStepError(SBOM_ERROR, err)
+		}
+
+		for _, imageName := range imageNames {
+			imageRef, err := parseImageReference(fmt.Sprintf("%s@%s", imageName, digest), insecureRegistries)
+			if err != nil {
+				return err
+			}
+			err = attachSbom(ctx, imageRef.(name.Digest), sbom, opts.format, skipTlsVerify)
+			if err != nil {
+				return newStepError(SBOM_ERROR, err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The vulnerability severities reported by trivy, from the least to
+	// the most severe
+	UNKNOWN_VULN_SEVERITY  = "UNKNOWN"
+	LOW_VULN_SEVERITY      = "LOW"
+	MEDIUM_VULN_SEVERITY   = "MEDIUM"
+	HIGH_VULN_SEVERITY     = "HIGH"
+	CRITICAL_VULN_SEVERITY = "CRITICAL"
+
+	// The scan never fails the build. The vulnerabilities are only reported
+	SCAN_FAIL_ON_NONE = "none"
+	// The default severity threshold of the scan
+	DEFAULT_SCAN_FAIL_ON = "critical"
+
+	// The default trivy path, which is resolved with the PATH
+	DEFAULT_TRIVY_PATH = "trivy"
+)
+
+// The vulnerability severities, from the least to the most severe
+var vulnSeverities = []string{
+	UNKNOWN_VULN_SEVERITY,
+	LOW_VULN_SEVERITY,
+	MEDIUM_VULN_SEVERITY,
+	HIGH_VULN_SEVERITY,
+	CRITICAL_VULN_SEVERITY,
+}
+
+// The supported severity thresholds of the scan
+var scanFailOnThresholds = []string{SCAN_FAIL_ON_NONE, "low", "medium", "high", DEFAULT_SCAN_FAIL_ON}
+
+// The options for scanning the built image for vulnerabilities with trivy
+// See https://trivy.dev/latest/docs/target/container_image/
+type scanOptions struct {
+	enabled   bool
+	trivyPath string
+	// The lowest severity that fails the build, or none
+	failOn string
+	// The path to a file with the vulnerability ids to ignore, if any
+	ignoreFile string
+	// The path to an OpenVEX document with the vulnerabilities that do not
+	// affect the image, if any
+	vexFile string
+	// The age after which the VEX statements expire, if any
+	vexMaxAge time.Duration
+	// The path to write the JSON scan report to, if any
+	reportFile string
+}
+
+// A vulnerability found in the image
+type scannedVulnerability struct {
+	Id               string `json:"id"`
+	Severity         string `json:"severity"`
+	Package          string `json:"package"`
+	InstalledVersion string `json:"installedVersion"`
+	FixedVersion     string `json:"fixedVersion,omitempty"`
+	Title            string `json:"title,omitempty"`
+	// Whether the vulnerability has an exception in the ignore file or the
+	// VEX file, and the reason
+	Ignored      bool   `json:"ignored,omitempty"`
+	IgnoreReason string `json:"ignoreReason,omitempty"`
+}
+
+// The report of the vulnerability scan
+type scanReport struct {
+	Image  string `json:"image"`
+	FailOn string `json:"failOn"`
+	// Whether a vulnerability that is not ignored met the threshold
+	Failed bool `json:"failed"`
+	// The number of vulnerabilities by severity, excluding the ignored
+	SeverityCounts  map[string]int         `json:"severityCounts"`
+	Vulnerabilities []scannedVulnerability `json:"vulnerabilities"`
+}
+
+// The fields of the trivy JSON report used by the scan
+type trivyReport struct {
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			InstalledVersion string `json:"InstalledVersion"`
+			FixedVersion     string `json:"FixedVersion"`
+			Title            string `json:"Title"`
+			Severity         string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+func configureScanFlags(flags *pflag.FlagSet) {
+	flags.Bool("scan", false, "Whether to scan the built image for vulnerabilities with trivy")
+	flags.String(
+		"scan-fail-on",
+		DEFAULT_SCAN_FAIL_ON,
+		fmt.Sprintf(
+			"The lowest vulnerability severity that fails the build. One of %s. The none threshold only reports "+
+				"the vulnerabilities", scanFailOnThresholds))
+	flags.String(
+		"scan-ignore-file",
+		"",
+		"The path to a file with the vulnerability ids to ignore (e.g. CVE-2024-1234), one per line. An id may "+
+			"be followed by an expiry date (e.g. exp:2025-12-31), after which it is no longer ignored. Lines "+
+			"starting with # are ignored")
+	flags.String(
+		"scan-vex-file",
+		"",
+		"The path to an OpenVEX document. The vulnerabilities with the not_affected or fixed status are ignored")
+	flags.Duration(
+		"scan-vex-max-age",
+		0,
+		"The age after which the VEX statements expire and are no longer ignored (e.g. 2160h). Defaults to no expiry")
+	flags.String("scan-report-file", "", "The path to write the JSON vulnerability scan report to")
+	flags.String("trivy-path", DEFAULT_TRIVY_PATH, "The path to the trivy executable")
+}
+
+func getScanOptions(flags *pflag.FlagSet, cmdName string) (scanOptions, error) {
+	var opts scanOptions
+	var err error
+
+	opts.enabled, err = flags.GetBool("scan")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s scan flag", cmdName)
+	}
+
+	opts.failOn, err = flags.GetString("scan-fail-on")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s scan-fail-on flag", cmdName)
+	}
+	if !slices.Contains(scanFailOnThresholds, opts.failOn) {
+		return opts, fmt.Errorf("scan-fail-on must be one of %s: %s", scanFailOnThresholds, opts.failOn)
+	}
+
+	opts.ignoreFile, err = flags.GetString("scan-ignore-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s scan-ignore-file flag", cmdName)
+	}
+
+	opts.vexFile, err = flags.GetString("scan-vex-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s scan-vex-file flag", cmdName)
+	}
+
+	opts.vexMaxAge, err = flags.GetDuration("scan-vex-max-age")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s scan-vex-max-age flag", cmdName)
+	}
+	if opts.vexMaxAge < 0 {
+		return opts, fmt.Errorf("scan-vex-max-age must not be negative: %s", opts.vexMaxAge)
+	}
+
+	opts.reportFile, err = flags.GetString("scan-report-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s scan-report-file flag", cmdName)
+	}
+
+	opts.trivyPath, err = flags.GetString("trivy-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s trivy-path flag", cmdName)
+	}
+	return opts, nil
+}
+
+func (opts scanOptions) logAttrs() []any {
+	return []any{
+		"scan", opts.enabled,
+		"scanFailOn", opts.failOn,
+		"scanIgnoreFile", opts.ignoreFile,
+		"scanVexFile", opts.vexFile,
+		"scanVexMaxAge", opts.vexMaxAge,
+		"scanReportFile", opts.reportFile,
+		"trivyPath", opts.trivyPath,
+	}
+}
+
+// Scans the image for vulnerabilities and fails if a vulnerability that is
+// not ignored meets the severity threshold. With a tar path, the image
+// tarball is scanned. Otherwise, the pushed image is scanned, allowing
+// plain HTTP and skipping the TLS verification if insecure. Does nothing if
+// the scan is not enabled
+func (opts scanOptions) scan(ctx context.Context, image string, tarPath string, insecure bool) error {
+	if !opts.enabled {
+		return nil
+	}
+
+	// The exceptions are read on every scan, so the expired exceptions
+	// resurface without a change to the files
+	exceptions := map[string]string{}
+	if opts.ignoreFile != "" {
+		ignoreFileExceptions, err := readScanIgnoreFile(opts.ignoreFile, time.Now())
+		if err != nil {
+			return err
+		}
+		maps.Copy(exceptions, ignoreFileExceptions)
+	}
+	if opts.vexFile != "" {
+		vexExceptions, err := readScanVexFile(opts.vexFile, opts.vexMaxAge, time.Now())
+		if err != nil {
+			return err
+		}
+		maps.Copy(exceptions, vexExceptions)
+	}
+
+	slog.Info("Scanning image for vulnerabilities", "image", image, "tarPath", tarPath)
+	bytes, err := runTrivy(ctx, opts.trivyPath, nil, image, tarPath, insecure, VULNERABILITY_ERROR)
+	if err != nil {
+		return err
+	}
+	trivyResults := trivyReport{}
+	err = json.Unmarshal(bytes, &trivyResults)
+	if err != nil {
+		return newStepError(VULNERABILITY_ERROR, fmt.Errorf("error parsing the trivy report: %s", err))
+	}
+
+	report := newScanReport(trivyResults, exceptions, opts.failOn)
+	report.Image = image
+	if opts.reportFile != "" {
+		bytes, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding the scan report: %s", err)
+		}
+		err = os.WriteFile(opts.reportFile, append(bytes, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing the scan report file: %s", err)
+		}
+		slog.Info("Wrote scan report file", "scanReportFile", opts.reportFile)
+	}
+
+	for _, vulnerability := range report.Vulnerabilities {
+		if !vulnerability.Ignored && meetsScanThreshold(vulnerability.Severity, opts.failOn) {
+			slog.Error(
+				"Vulnerability meets the severity threshold",
+				"id", vulnerability.Id,
+				"severity", vulnerability.Severity,
+				"package", vulnerability.Package,
+				"installedVersion", vulnerability.InstalledVersion,
+				"fixedVersion", vulnerability.FixedVersion,
+			)
+		}
+	}
+	slog.Info("Scanned image for vulnerabilities", "severityCounts", report.SeverityCounts, "failOn", opts.failOn)
+	if report.Failed {
+		return newStepError(
+			VULNERABILITY_ERROR,
+			fmt.Errorf("the image has vulnerabilities with the %s severity or higher", strings.ToUpper(opts.failOn)))
+	}
+	return nil
+}
+
+// Runs trivy on the image with the extra args (e.g. the scanners), and
+// returns the JSON report. With a tar path, the image tarball is scanned.
+// Otherwise, the pushed image is scanned, allowing plain HTTP and skipping
+// the TLS verification if insecure. The errors have the error class
+func runTrivy(
+	ctx context.Context,
+	trivyPath string,
+	extraArgs []string,
+	image string,
+	tarPath string,
+	insecure bool,
+	class errorClass,
+) ([]byte, error) {
+	trivyReportFile := filepath.Join(os.TempDir(), fmt.Sprintf("docker-build-trivy-%d", os.Getpid()))
+	defer os.Remove(trivyReportFile)
+	args := []string{"image", "--format", "json", "--output", trivyReportFile, "--quiet"}
+	args = append(args, extraArgs...)
+	if insecure {
+		args = append(args, "--insecure")
+	}
+	if tarPath != "" {
+		args = append(args, "--input", tarPath)
+	} else {
+		args = append(args, image)
+	}
+	slog.Info("Running trivy", "image", image, "tarPath", tarPath, "args", args)
+
+	trivyCmd := exec.CommandContext(ctx, trivyPath, args...)
+	trivyCmd.Stdout = os.Stdout
+	trivyCmd.Stderr = os.Stderr
+	err := trivyCmd.Run()
+	if err != nil {
+		if stoppedErr := getStoppedError(ctx, "trivy"); stoppedErr != nil {
+			return nil, stoppedErr
+		}
+		if notFoundErr := getToolNotFoundError(err, "trivy", trivyPath); notFoundErr != nil {
+			return nil, notFoundErr
+		}
+		return nil, newStepError(class, fmt.Errorf("error running trivy: %w", err))
+	}
+
+	bytes, err := os.ReadFile(trivyReportFile)
+	if err != nil {
+		return nil, newStepError(class, fmt.Errorf("error reading the trivy report: %s", err))
+	}
+	return bytes, nil
+}
+
+// Returns the scan report of the trivy results. The same vulnerability
+// may be reported for multiple targets, so each package vulnerability is
+// reported once
+func newScanReport(trivyResults trivyReport, exceptions map[string]string, failOn string) scanReport {
+	report := scanReport{
+		FailOn:          failOn,
+		SeverityCounts:  map[string]int{},
+		Vulnerabilities: []scannedVulnerability{},
+	}
+	seen := map[string]bool{}
+	for _, result := range trivyResults.Results {
+		for _, vuln := range result.Vulnerabilities {
+			key := strings.Join([]string{vuln.VulnerabilityID, vuln.PkgName, vuln.InstalledVersion}, "/")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			ignoreReason, ignored := exceptions[vuln.VulnerabilityID]
+			vulnerability := scannedVulnerability{
+				Id:               vuln.VulnerabilityID,
+				Severity:         vuln.Severity,
+				Package:          vuln.PkgName,
+				InstalledVersion: vuln.InstalledVersion,
+				FixedVersion:     vuln.FixedVersion,
+				Title:            vuln.Title,
+				Ignored:          ignored,
+				IgnoreReason:     ignoreReason,
+			}
+			report.Vulnerabilities = append(report.Vulnerabilities, vulnerability)
+			if vulnerability.Ignored {
+				continue
+			}
+			report.SeverityCounts[vulnerability.Severity]++
+			if meetsScanThreshold(vulnerability.Severity, failOn) {
+				report.Failed = true
+			}
+		}
+	}
+	return report
+}
+
+// Returns whether the severity is at least the threshold
+func meetsScanThreshold(severity string, failOn string) bool {
+	if failOn == SCAN_FAIL_ON_NONE {
+		return false
+	}
+	return slices.Index(vulnSeverities, severity) >= slices.Index(vulnSeverities, strings.ToUpper(failOn))
+}
+
+// Reads the vulnerability ids from the ignore file, with the reason they
+// are ignored. Blank lines and lines starting with # are ignored. An id may
+// be followed by an expiry date (e.g. exp:2025-12-31), after which it is no
+// longer ignored. This matches the .trivyignore format
+func readScanIgnoreFile(ignoreFile string, now time.Time) (map[string]string, error) {
+	file, err := os.Open(ignoreFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scan ignore file: %s", err)
+	}
+	defer file.Close()
+
+	exceptions := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		id := fields[0]
+		reason := "Ignored by the scan ignore file"
+		for _, field := range fields[1:] {
+			expiry, found := strings.CutPrefix(field, "exp:")
+			if !found {
+				continue
+			}
+			expiryDate, err := time.Parse(time.DateOnly, expiry)
+			if err != nil {
+				return nil, fmt.Errorf("scan ignore file has an invalid expiry date on line %d: %s", lineNum, field)
+			}
+			if now.After(expiryDate) {
+				slog.Warn("Scan ignore file exception expired", "id", id, "expiry", expiry, "line", lineNum)
+				reason = ""
+				break
+			}
+			reason = fmt.Sprintf("Ignored by the scan ignore file until %s", expiry)
+		}
+		if reason != "" {
+			exceptions[id] = reason
+		}
+	}
+	return exceptions, scanner.Err()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Matches a secret id, which is also the build arg name for kaniko
+var secretIdRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// A file whose content is exposed to the build as a secret (e.g. a token
+// for a private package registry). The builders that support secret mounts
+// mount the file with RUN --mount=type=secret,id=<id>. Kaniko does not, so
+// the content is passed as the <id> build arg
+type secretFile struct {
+	id   string
+	path string
+	// The content of the file, without the trailing newline
+	value string
+}
+
+// Returns the secret files of the secret-file flags, which are expected in
+// the format ID=PATH. The files are read up front, so the contents can be
+// masked in all of the logs
+func getSecretFiles(secretFileFlags []string) ([]secretFile, error) {
+	secretFiles := []secretFile{}
+	ids := map[string]bool{}
+	for _, secretFileFlag := range secretFileFlags {
+		id, path, found := strings.Cut(secretFileFlag, "=")
+		if !found || path == "" || !secretIdRegexp.MatchString(id) {
+			return nil, fmt.Errorf("secret-file must be in the format ID=PATH with a valid build arg name: %s", secretFileFlag)
+		}
+		if ids[id] {
+			return nil, fmt.Errorf("secret-file id is set more than once: %s", id)
+		}
+		ids[id] = true
+
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading secret file %s: %s", id, err)
+		}
+		secretFiles = append(secretFiles, secretFile{
+			id:    id,
+			path:  path,
+			value: strings.TrimRight(string(bytes), "\r\n"),
+		})
+	}
+	return secretFiles, nil
+}
+
+// Returns the values to mask for the secret files. The lines of a multi
+// line secret are masked separately, since the builder output is masked
+// line by line
+func getSecretFileValues(secretFiles []secretFile) []string {
+	values := []string{}
+	for _, secretFile := range secretFiles {
+		values = append(values, secretFile.value)
+		if !strings.Contains(secretFile.value, "\n") {
+			continue
+		}
+		for _, line := range strings.Split(secretFile.value, "\n") {
+			values = append(values, strings.TrimSpace(line))
+		}
+	}
+	return values
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default cosign path, which is resolved with the PATH
+	DEFAULT_COSIGN_PATH = "cosign"
+	// The path of the projected service account token for keyless signing.
+	// This is the path cosign reads the OIDC token from by default
+	// See https://github.com/sigstore/cosign/tree/main/pkg/providers/filesystem
+	SERVICE_ACCOUNT_TOKEN_PATH = "/var/run/sigstore/cosign/oidc-token"
+	// The url of the public Rekor instance, which cosign uses by default
+	DEFAULT_REKOR_URL = "https://rekor.sigstore.dev"
+)
+
+// Matches the log index that cosign prints after uploading the signature
+// to the transparency log
+var tlogEntryPattern = regexp.MustCompile(`tlog entry created with index: (\d+)`)
+
+// The options for signing the images with cosign. Without a key, the
+// keyless flow is used, which gets a certificate for the OIDC identity of
+// the workload from Fulcio
+// See https://docs.sigstore.dev/cosign/signing/overview/
+type signOptions struct {
+	cosignPath string
+	// The path to the private key, or a KMS URI (e.g. awskms:///<key-arn>).
+	// The key password is read by cosign from COSIGN_PASSWORD
+	key string
+	// The path to the OIDC token for the keyless flow. Defaults to the
+	// cosign detection of the CI provider token
+	identityTokenFile string
+	// Whether to use the projected Kubernetes service account token as the
+	// OIDC token for the keyless flow
+	serviceAccountToken bool
+	// The Fulcio and Rekor urls of a private Sigstore deployment, if any
+	fulcioUrl string
+	rekorUrl  string
+	// Whether to upload the signature to the Rekor transparency log
+	tlogUpload bool
+	// The args passed through to cosign sign
+	extraArgs []string
+}
+
+// Configures the cosign path flag, which is shared by the signing and the
+// signature verification
+func configureCosignFlags(flags *pflag.FlagSet) {
+	flags.String("cosign-path", DEFAULT_COSIGN_PATH, "The path to the cosign executable")
+}
+
+func configureSignFlags(flags *pflag.FlagSet) {
+	flags.String(
+		"sign-key",
+		"",
+		"The path to the cosign private key, or a KMS URI (e.g. awskms:///<key-arn>). The key password is read from "+
+			"COSIGN_PASSWORD. Defaults to keyless signing with the OIDC identity of the workload")
+	flags.String(
+		"sign-identity-token-file",
+		"",
+		"The path to the OIDC token for keyless signing. Defaults to the token cosign detects for the CI provider")
+	flags.Bool(
+		"sign-service-account-token",
+		false,
+		fmt.Sprintf(
+			"Whether to sign keyless with the projected Kubernetes service account token as the OIDC identity. "+
+				"The token is read from %s, unless sign-identity-token-file is set",
+			SERVICE_ACCOUNT_TOKEN_PATH))
+	flags.String("fulcio-url", "", "The url of the Fulcio instance for keyless signing. Defaults to the public instance")
+	flags.String("rekor-url", "", "The url of the Rekor transparency log. Defaults to the public instance")
+	flags.Bool(
+		"tlog-upload",
+		true,
+		"Whether to upload the signature to the Rekor transparency log. The log index is recorded in the result")
+	flags.StringArray(
+		"cosign-arg",
+		nil,
+		"An arg passed through to cosign sign (e.g. --recursive). Can be repeated")
+}
+
+func getSignOptions(flags *pflag.FlagSet, cmdName string) (signOptions, error) {
+	var opts signOptions
+	var err error
+
+	opts.cosignPath, err = flags.GetString("cosign-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s cosign-path flag", cmdName)
+	}
+
+	opts.key, err = flags.GetString("sign-key")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s sign-key flag", cmdName)
+	}
+
+	opts.identityTokenFile, err = flags.GetString("sign-identity-token-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s sign-identity-token-file flag", cmdName)
+	}
+	if opts.key != "" && opts.identityTokenFile != "" {
+		return opts, fmt.Errorf("sign-key and sign-identity-token-file cannot both be set")
+	}
+
+	opts.serviceAccountToken, err = flags.GetBool("sign-service-account-token")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s sign-service-account-token flag", cmdName)
+	}
+	if opts.serviceAccountToken {
+		if opts.key != "" {
+			return opts, fmt.Errorf("sign-key and sign-service-account-token cannot both be set")
+		}
+		if opts.identityTokenFile == "" {
+			opts.identityTokenFile = SERVICE_ACCOUNT_TOKEN_PATH
+		}
+	}
+
+	opts.fulcioUrl, err = flags.GetString("fulcio-url")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s fulcio-url flag", cmdName)
+	}
+
+	opts.rekorUrl, err = flags.GetString("rekor-url")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s rekor-url flag", cmdName)
+	}
+
+	opts.tlogUpload, err = flags.GetBool("tlog-upload")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s tlog-upload flag", cmdName)
+	}
+
+	opts.extraArgs, err = flags.GetStringArray("cosign-arg")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s cosign-arg flag", cmdName)
+	}
+	return opts, nil
+}
+
+func (opts signOptions) logAttrs() []any {
+	return []any{
+		"cosignPath", opts.cosignPath,
+		"signKey", opts.key,
+		"signIdentityTokenFile", opts.identityTokenFile,
+		"signServiceAccountToken", opts.serviceAccountToken,
+		"fulcioUrl", opts.fulcioUrl,
+		"rekorUrl", opts.rekorUrl,
+		"tlogUpload", opts.tlogUpload,
+		"cosignArgs", opts.extraArgs,
+	}
+}
+
+// Returns the cosign args to sign the image digest
+func (opts signOptions) args(ref name.Digest, insecureRegistries []string, skipTlsVerify bool) []string {
+	args := []string{"sign", "--yes"}
+	if opts.key != "" {
+		args = append(args, fmt.Sprintf("--key=%s", opts.key))
+	}
+	if opts.identityTokenFile != "" {
+		args = append(args, fmt.Sprintf("--identity-token=%s", opts.identityTokenFile))
+	}
+	if opts.fulcioUrl != "" {
+		args = append(args, fmt.Sprintf("--fulcio-url=%s", opts.fulcioUrl))
+	}
+	if opts.rekorUrl != "" {
+		args = append(args, fmt.Sprintf("--rekor-url=%s", opts.rekorUrl))
+	}
+	if !opts.tlogUpload {
+		args = append(args, "--tlog-upload=false")
+	}
+	if slices.Contains(insecureRegistries, ref.RegistryStr()) {
+		args = append(args, "--allow-http-registry")
+	}
+	if skipTlsVerify {
+		args = append(args, "--allow-insecure-registry")
+	}
+	args = append(args, opts.extraArgs...)
+	return append(args, ref.String())
+}
+
+// Returns the url of the Rekor instance that the signatures are uploaded to
+func (opts signOptions) getRekorUrl() string {
+	if opts.rekorUrl != "" {
+		return opts.rekorUrl
+	}
+	return DEFAULT_REKOR_URL
+}
+
+// An entry of a signature in the Rekor transparency log, which can be used
+// to verify the signature later (e.g. rekor-cli get --log-index)
+type transparencyLogEntry struct {
+	// The image digest reference that was signed
+	Image    string `json:"image"`
+	LogIndex int64  `json:"logIndex"`
+	RekorUrl string `json:"rekorUrl"`
+}
+
+// Signs the image digest with cosign, which pushes the signature to the
+// repo of the image. Returns the transparency log entry of the signature,
+// or nil if the signature was not uploaded to the transparency log
+func signImage(
+	ctx context.Context,
+	opts signOptions,
+	ref name.Digest,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) (*transparencyLogEntry, error) {
+	// The projected token is rotated by the kubelet, so it is read by cosign
+	// at signing time. A missing token is a misconfigured pod spec
+	if opts.serviceAccountToken {
+		_, err := os.Stat(opts.identityTokenFile)
+		if err != nil {
+			return nil, newStepError(
+				SIGN_ERROR,
+				fmt.Errorf(
+					"the service account token is not mounted at %s. Project a service account token with the "+
+						"sigstore audience to the path: %s", opts.identityTokenFile, err))
+		}
+	}
+	args := opts.args(ref, insecureRegistries, skipTlsVerify)
+	slog.Info("Signing image", "image", ref.String(), "args", args)
+
+	// The log index is only printed by cosign, so the output is captured
+	// as well as streamed
+	output := bytes.Buffer{}
+	cosignCmd := exec.CommandContext(ctx, opts.cosignPath, args...)
+	cosignCmd.Stdout = io.MultiWriter(os.Stdout, &output)
+	cosignCmd.Stderr = io.MultiWriter(os.Stderr, &output)
+	err := cosignCmd.Run()
+	if err != nil {
+		if stoppedErr := getStoppedError(ctx, "cosign"); stoppedErr != nil {
+			return nil, stoppedErr
+		}
+		if notFoundErr := getToolNotFoundError(err, "cosign", opts.cosignPath); notFoundErr != nil {
+			return nil, notFoundErr
+		}
+		return nil, newStepError(SIGN_ERROR, fmt.Errorf("error signing image %s: %w", ref, err))
+	}
+	if !opts.tlogUpload {
+		slog.Info("Signed image", "image", ref.String())
+		return nil, nil
+	}
+
+	match := tlogEntryPattern.FindSubmatch(output.Bytes())
+	if match == nil {
+		slog.Warn("Signed image, but the transparency log index was not found in the cosign output", "image", ref.String())
+		return nil, nil
+	}
+	logIndex, err := strconv.ParseInt(string(match[1]), 10, 64)
+	if err != nil {
+		return nil, newStepError(SIGN_ERROR, fmt.Errorf("error parsing the transparency log index: %s", err))
+	}
+	entry := &transparencyLogEntry{
+		Image:    ref.String(),
+		LogIndex: logIndex,
+		RekorUrl: opts.getRekorUrl(),
+	}
+	slog.Info("Signed image", "image", ref.String(), "logIndex", entry.LogIndex, "rekorUrl", entry.RekorUrl)
+	return entry, nil
+}
+
+func handleSignCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	signFlags := cmd.Flags()
+
+	image, err := signFlags.GetString("image")
+	if err != nil {
+		return fmt.Errorf("error processing sign image flag")
+	}
+
+	signOpts, err := getSignOptions(signFlags, "sign")
+	if err != nil {
+		return err
+	}
+
+	insecureRegistries, err := signFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing sign insecure-registry flag")
+	}
+
+	skipTlsVerify, err := signFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing sign skip-tls-verify flag")
+	}
+
+	dryRun, err := signFlags.GetBool("dry-run")
+	if err != nil {
+		return fmt.Errorf("error processing sign dry-run flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(signFlags, "sign")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"image", image,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+		"dryRun", dryRun,
+	}
+	params = append(params, signOpts.logAttrs()...)
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("Sign with params", params...)
+
+	ref, err := parseImageReference(image, insecureRegistries)
+	if err != nil {
+		return fmt.Errorf("image is not a valid image reference: %s", err)
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	err = registryAuthOpts.login(ctx, ref.Context().RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	// The tag is resolved to the digest, since signing a tag signs whatever
+	// the tag points to when cosign reads it
+	digestRef, ok := ref.(name.Digest)
+	if !ok {
+		digest, err := resolveImageDigest(ctx, ref, skipTlsVerify)
+		if err != nil {
+			return fmt.Errorf("error resolving image %s: %w", ref, err)
+		}
+		digestRef = ref.Context().Digest(digest)
+		slog.Info("Resolved image digest", "image", ref.String(), "digest", digest)
+	}
+
+	if dryRun {
+		slog.Info("Dry run is set. Skipping signing", "image", digestRef.String(), "args", signOpts.args(digestRef, insecureRegistries, skipTlsVerify))
+		return nil
+	}
+	_, err = signImage(ctx, signOpts, digestRef, insecureRegistries, skipTlsVerify)
+	return err
+}
+
+// Returns a post build hook that signs the pushed image digest in each of
+// the image repos, and records the transparency log entries in the outcome.
+// Does nothing if the build failed
+func signImageHook(
+	sign bool,
+	signOpts signOptions,
+	imageNames []string,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) postBuildHook {
+	return func(outcome *buildOutcome) error {
+		if !sign || outcome.err != nil || outcome.image == "" {
+			return nil
+		}
+		ctx, stopSignals := withTerminationSignals(context.Background())
+		defer stopSignals()
+
+		digest := outcome.digest
+		if digest == "" {
+			ref, err := parseImageReference(outcome.image, insecureRegistries)
+			if err != nil {
+				return err
+			}
+			digest, err = resolveImageDigest(ctx, ref, skipTlsVerify)
+			if err != nil {
+				return newStepError(SIGN_ERROR, fmt.Errorf("error resolving the image digest to sign: %w", err))
+			}
+		}
+		for _, imageName := range imageNames {
+			ref, err := parseImageReference(fmt.Sprintf("%s@%s", imageName, digest), insecureRegistries)
+			if err != nil {
+				return err
+			}
+			entry, err := signImage(ctx, signOpts, ref.(name.Digest), insecureRegistries, skipTlsVerify)
+			if err != nil {
+				return err
+			}
+			if entry != nil {
+				outcome.transparencyLogEntries = append(outcome.transparencyLogEntries, *entry)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// The default tag template, which tags the image with the revision hash
+	DEFAULT_TAG_TEMPLATE = "{{.Sha}}"
+	// Length of the revision hash used for the ShortSha placeholder
+	SHORT_SHA_LENGTH = 7
+)
+
+var (
+	// Characters that are not allowed in an image tag
+	invalidTagCharsRegexp = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+	// Semantic version tags, with an optional v prefix
+	// See https://semver.org/#is-there-a-suggested-regular-expression-regex-to-check-a-semver-string
+	semVerTagRegexp = regexp.MustCompile(`^v?(\d+\.\d+\.\d+(?:-[0-9A-Za-z.-]+)?(?:\+[0-9A-Za-z.-]+)?)$`)
+)
+
+// The placeholders available in the tag template
+type tagTemplateData struct {
+	// The full revision hash
+	Sha string
+	// The abbreviated revision hash
+	ShortSha string
+	// The revision ref (e.g. refs/heads/main)
+	Ref string
+	// The branch name from the revision ref, with any characters that
+	// are invalid in a tag replaced with "-"
+	Branch string
+	// The UTC build time in the format YYYYMMDDhhmmss
+	Timestamp string
+	// The semantic version from a git tag pointing at the revision,
+	// without the v prefix. The "+" of the build metadata is replaced with
+	// "_", since it is not allowed in an image tag. Empty if there is no
+	// such tag
+	SemVer string
+}
+
+// Returns the tag template data for the revision. The git tags are
+// read from the clone path to determine the SemVer placeholder
+func getTagTemplateData(clonePath string, revisionHash string, revisionRef string) tagTemplateData {
+	shortSha := revisionHash
+	if len(shortSha) > SHORT_SHA_LENGTH {
+		shortSha = shortSha[:SHORT_SHA_LENGTH]
+	}
+
+	branch := revisionRef
+	branch = strings.TrimPrefix(branch, "refs/heads/")
+	branch = strings.TrimPrefix(branch, "refs/tags/")
+	branch = invalidTagCharsRegexp.ReplaceAllString(branch, "-")
+
+	gitTags := []string{}
+	if clonePath != "" {
+		var err error
+		gitTags, err = getGitTags(clonePath, revisionHash)
+		if err != nil {
+			slog.Warn("Unable to read the git tags from the clone", "error", err)
+		}
+	}
+
+	return tagTemplateData{
+		Sha:       revisionHash,
+		ShortSha:  shortSha,
+		Ref:       revisionRef,
+		Branch:    branch,
+		Timestamp: time.Now().UTC().Format("20060102150405"),
+		SemVer:    getSemVer(gitTags),
+	}
+}
+
+// Returns the semantic version of the first semantic version tag, or an
+// empty string if there is none. The build metadata is kept, with the "+"
+// replaced, so the version is a valid image tag (e.g. v1.2.3+build.5 is
+// 1.2.3_build.5), as in the docker metadata action
+func getSemVer(gitTags []string) string {
+	for _, gitTag := range gitTags {
+		matches := semVerTagRegexp.FindStringSubmatch(gitTag)
+		if matches != nil {
+			return strings.ReplaceAll(matches[1], "+", "_")
+		}
+	}
+	return ""
+}
+
+// Evaluates the tag template and validates the result is a valid image tag
+func renderTagTemplate(tagTemplate string, data tagTemplateData) (string, error) {
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(tagTemplate)
+	if err != nil {
+		return "", fmt.Errorf("error parsing tag template: %s", err)
+	}
+
+	var tag strings.Builder
+	err = tmpl.Execute(&tag, data)
+	if err != nil {
+		return "", fmt.Errorf("error evaluating tag template: %s", err)
+	}
+
+	if !imageTagRegexp.MatchString(tag.String()) {
+		return "", fmt.Errorf("tag template evaluated to an invalid image tag: %q", tag.String())
+	}
+	return tag.String(), nil
+}
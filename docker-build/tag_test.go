@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestGetSemVer(t *testing.T) {
+	tests := []struct {
+		name    string
+		gitTags []string
+		want    string
+	}{
+		{name: "no tags", gitTags: []string{}, want: ""},
+		{name: "not semver", gitTags: []string{"latest", "release-1"}, want: ""},
+		{name: "v prefix", gitTags: []string{"v1.2.3"}, want: "1.2.3"},
+		{name: "no prefix", gitTags: []string{"1.2.3"}, want: "1.2.3"},
+		{name: "pre-release", gitTags: []string{"v1.2.3-rc.1"}, want: "1.2.3-rc.1"},
+		{name: "build metadata", gitTags: []string{"v1.2.3+build.5"}, want: "1.2.3_build.5"},
+		{name: "pre-release and build metadata", gitTags: []string{"v1.2.3-rc.1+build.5"}, want: "1.2.3-rc.1_build.5"},
+		{name: "first semver tag", gitTags: []string{"latest", "v2.0.0", "v1.0.0"}, want: "2.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getSemVer(tt.gitTags)
+			if got != tt.want {
+				t.Errorf("getSemVer(%q) = %q, want %q", tt.gitTags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTagTemplate(t *testing.T) {
+	data := tagTemplateData{
+		Sha:      "0123456789abcdef0123456789abcdef01234567",
+		ShortSha: "0123456",
+		Branch:   "feature-x",
+		SemVer:   getSemVer([]string{"v1.2.3+build.5"}),
+	}
+	tests := []struct {
+		name        string
+		tagTemplate string
+		want        string
+		wantErr     bool
+	}{
+		{name: "sha", tagTemplate: "{{.Sha}}", want: data.Sha},
+		{name: "branch and short sha", tagTemplate: "{{.Branch}}-{{.ShortSha}}", want: "feature-x-0123456"},
+		{name: "semver with build metadata", tagTemplate: "v{{.SemVer}}", want: "v1.2.3_build.5"},
+		{name: "unknown placeholder", tagTemplate: "{{.Unknown}}", wantErr: true},
+		{name: "invalid tag", tagTemplate: "{{.Branch}}+x", wantErr: true},
+		{name: "empty tag", tagTemplate: "{{.Ref}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTagTemplate(tt.tagTemplate, data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("renderTagTemplate(%q) = %q, want an error", tt.tagTemplate, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderTagTemplate(%q) error: %s", tt.tagTemplate, err)
+			}
+			if got != tt.want {
+				t.Errorf("renderTagTemplate(%q) = %q, want %q", tt.tagTemplate, got, tt.want)
+			}
+		})
+	}
+}
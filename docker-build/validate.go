@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/spf13/cobra"
+)
+
+// A preflight check run by the validate subcommand
+type validateCheck struct {
+	name  string
+	check func() error
+}
+
+func handleValidateCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	validateFlags := cmd.Flags()
+
+	clonePath, err := validateFlags.GetString("clone-path")
+	if err != nil {
+		return fmt.Errorf("error processing validate clone-path flag")
+	}
+
+	dockerfile, err := validateFlags.GetString("dockerfile")
+	if err != nil {
+		return fmt.Errorf("error processing validate dockerfile flag")
+	}
+
+	dockerContextDir, err := validateFlags.GetString("docker-context-dir")
+	if err != nil {
+		return fmt.Errorf("error processing validate docker-context-dir flag")
+	}
+
+	contextType, err := validateFlags.GetString("context-type")
+	if err != nil {
+		return fmt.Errorf("error processing validate context-type flag")
+	}
+
+	contextSource, err := validateFlags.GetString("context-source")
+	if err != nil {
+		return fmt.Errorf("error processing validate context-source flag")
+	}
+
+	err = validateContext(contextType, contextSource, clonePath)
+	if err != nil {
+		return err
+	}
+
+	imageRegistry, err := validateFlags.GetString("image-registry")
+	if err != nil {
+		return fmt.Errorf("error processing validate image-registry flag")
+	}
+
+	imageRepo, err := validateFlags.GetString("image-repo")
+	if err != nil {
+		return fmt.Errorf("error processing validate image-repo flag")
+	}
+
+	dockerfileDir, err := validateFlags.GetString("dockerfile-dir")
+	if err != nil {
+		return fmt.Errorf("error processing validate dockerfile-dir flag")
+	}
+
+	insecureRegistries, err := validateFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing validate insecure-registry flag")
+	}
+
+	checkCredentials, err := validateFlags.GetBool("check-credentials")
+	if err != nil {
+		return fmt.Errorf("error processing validate check-credentials flag")
+	}
+
+	// Log command flags
+	slog.Info(
+		"Validate with params",
+		"clonePath", clonePath,
+		"dockerfile", dockerfile,
+		"dockerContextDir", dockerContextDir,
+		"contextType", contextType,
+		"contextSource", gitrepo.RedactUrlCredentials(contextSource),
+		"imageRegistry", imageRegistry,
+		"imageRepo", imageRepo,
+		"dockerfileDir", dockerfileDir,
+		"insecureRegistries", insecureRegistries,
+		"checkCredentials", checkCredentials,
+	)
+
+	checks := []validateCheck{}
+
+	// The local paths are only available for the dir context type
+	if contextType == DIR_CONTEXT_TYPE {
+		dockerfilePath := filepath.Join(clonePath, dockerfile)
+		contextDirPath := filepath.Join(clonePath, dockerContextDir)
+		checks = append(
+			checks,
+			validateCheck{
+				name:  "clone path exists",
+				check: func() error { return checkDirExists(clonePath) },
+			},
+			validateCheck{
+				name: "dockerfile exists and parses",
+				check: func() error {
+					_, err := readDockerfile(dockerfilePath)
+					return err
+				},
+			},
+			validateCheck{
+				name:  "docker context dir exists",
+				check: func() error { return checkDirExists(contextDirPath) },
+			},
+		)
+	} else {
+		slog.Info("Skipping the local path checks for the context type", "contextType", contextType)
+	}
+
+	// The destination is only set for commit builds
+	if imageRepo != "" {
+		imageName := fmt.Sprintf("%s%s%s", imageRegistry, imageRepo, dockerfileDir)
+		var ref name.Reference
+		checks = append(checks, validateCheck{
+			name: "destination is a valid image reference",
+			check: func() error {
+				var err error
+				ref, err = parseImageReference(imageName, insecureRegistries)
+				return err
+			},
+		})
+		if checkCredentials {
+			checks = append(checks, validateCheck{
+				name: "registry credentials can push to the destination",
+				check: func() error {
+					if ref == nil {
+						return errors.New("the destination is not a valid image reference")
+					}
+					return remote.CheckPushPermission(ref, authn.DefaultKeychain, http.DefaultTransport)
+				},
+			})
+		}
+	} else {
+		slog.Info("Skipping the destination checks since image-repo is not set")
+	}
+
+	failures := 0
+	slog.Info("Running validation checks", "checks", len(checks))
+	for _, check := range checks {
+		err := check.check()
+		if err != nil {
+			failures++
+			slog.Error("Validation check failed", "check", check.name, "error", err)
+			continue
+		}
+		slog.Info("Validation check passed", "check", check.name)
+	}
+
+	if failures > 0 {
+		cmd.SilenceUsage = true
+		return fmt.Errorf("%d of %d validation checks failed", failures, len(checks))
+	}
+	slog.Info("All validation checks passed", "checks", len(checks))
+	return nil
+}
+
+// Returns an error if the path is not an existing directory
+func checkDirExists(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory: %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// The trust policy for verifying the cosign signatures of the base images
+// before the build. The signatures are verified with the public key, or
+// with the certificate identity and issuer for the keyless flow
+// See https://docs.sigstore.dev/cosign/verifying/verify/
+type verifyOptions struct {
+	enabled    bool
+	cosignPath string
+	// The path to the public key, or a KMS URI (e.g. awskms:///<key-arn>)
+	key string
+	// The regexp of the signing certificate identity for the keyless flow
+	// (e.g. ^https://github.com/example/.*)
+	certificateIdentityRegexp string
+	// The OIDC issuer of the signing certificate for the keyless flow
+	// (e.g. https://token.actions.githubusercontent.com)
+	certificateOidcIssuer string
+	// The predicate type of the attestation to verify (e.g. slsaprovenance),
+	// if any
+	attestationType string
+}
+
+func configureVerifyFlags(flags *pflag.FlagSet) {
+	flags.Bool(
+		"verify-base-images",
+		false,
+		"Whether to verify the cosign signatures of the FROM images before the build, and refuse to build on "+
+			"unsigned or untrusted base images")
+	flags.String(
+		"verify-key",
+		"",
+		"The path to the cosign public key, or a KMS URI, that the base images must be signed with")
+	flags.String(
+		"verify-certificate-identity-regexp",
+		"",
+		"The regexp of the certificate identity that the base images must be signed by with keyless signing")
+	flags.String(
+		"verify-certificate-oidc-issuer",
+		"",
+		"The OIDC issuer of the certificate that the base images must be signed by with keyless signing "+
+			"(e.g. https://token.actions.githubusercontent.com)")
+	flags.String(
+		"verify-attestation-type",
+		"",
+		"The predicate type of an attestation that the base images must also have (e.g. slsaprovenance)")
+}
+
+func getVerifyOptions(flags *pflag.FlagSet, cmdName string) (verifyOptions, error) {
+	var opts verifyOptions
+	var err error
+
+	opts.enabled, err = flags.GetBool("verify-base-images")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s verify-base-images flag", cmdName)
+	}
+
+	opts.cosignPath, err = flags.GetString("cosign-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s cosign-path flag", cmdName)
+	}
+
+	opts.key, err = flags.GetString("verify-key")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s verify-key flag", cmdName)
+	}
+
+	opts.certificateIdentityRegexp, err = flags.GetString("verify-certificate-identity-regexp")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s verify-certificate-identity-regexp flag", cmdName)
+	}
+
+	opts.certificateOidcIssuer, err = flags.GetString("verify-certificate-oidc-issuer")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s verify-certificate-oidc-issuer flag", cmdName)
+	}
+
+	opts.attestationType, err = flags.GetString("verify-attestation-type")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s verify-attestation-type flag", cmdName)
+	}
+
+	if !opts.enabled {
+		return opts, nil
+	}
+	isKeyless := opts.certificateIdentityRegexp != "" || opts.certificateOidcIssuer != ""
+	if opts.key != "" && isKeyless {
+		return opts, fmt.Errorf("verify-key and the verify-certificate flags cannot both be set")
+	}
+	if opts.key == "" && (opts.certificateIdentityRegexp == "" || opts.certificateOidcIssuer == "") {
+		return opts, fmt.Errorf(
+			"verify-key, or verify-certificate-identity-regexp and verify-certificate-oidc-issuer, must be set " +
+				"when verifying base images")
+	}
+	return opts, nil
+}
+
+func (opts verifyOptions) logAttrs() []any {
+	return []any{
+		"verifyBaseImages", opts.enabled,
+		"verifyKey", opts.key,
+		"verifyCertificateIdentityRegexp", opts.certificateIdentityRegexp,
+		"verifyCertificateOidcIssuer", opts.certificateOidcIssuer,
+		"verifyAttestationType", opts.attestationType,
+	}
+}
+
+// Returns the cosign args to verify the image with the trust policy. The
+// cosign command is verify, or verify-attestation
+func (opts verifyOptions) args(
+	cosignCommand string,
+	ref name.Reference,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) []string {
+	args := []string{cosignCommand}
+	if cosignCommand == "verify-attestation" {
+		args = append(args, fmt.Sprintf("--type=%s", opts.attestationType))
+	}
+	if opts.key != "" {
+		args = append(args, fmt.Sprintf("--key=%s", opts.key))
+	} else {
+		args = append(
+			args,
+			fmt.Sprintf("--certificate-identity-regexp=%s", opts.certificateIdentityRegexp),
+			fmt.Sprintf("--certificate-oidc-issuer=%s", opts.certificateOidcIssuer),
+		)
+	}
+	if slices.Contains(insecureRegistries, ref.Context().RegistryStr()) {
+		args = append(args, "--allow-http-registry")
+	}
+	if skipTlsVerify {
+		args = append(args, "--allow-insecure-registry")
+	}
+	return append(args, ref.String())
+}
+
+// Verifies the signatures, and the attestations if configured, of the
+// FROM images of the dockerfile. The stage names and scratch are skipped.
+// The images from ARG variables cannot be verified, so they fail the
+// verification. Does nothing if the verification is not enabled
+func (opts verifyOptions) verifyBaseImages(
+	ctx context.Context,
+	dockerfilePath string,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+) error {
+	if !opts.enabled {
+		return nil
+	}
+
+	instructions, err := readDockerfile(dockerfilePath)
+	if err != nil {
+		return newStepError(UNTRUSTED_BASE_IMAGE_ERROR, fmt.Errorf("error parsing dockerfile: %s", err))
+	}
+	baseImages := []string{}
+	stageNames := map[string]bool{}
+	for _, stage := range getBuildStages(instructions) {
+		image := stage.image
+		isExcluded := image == "" ||
+			image == "scratch" ||
+			stageNames[strings.ToLower(image)] ||
+			slices.Contains(baseImages, image)
+		if stage.name != "" {
+			stageNames[strings.ToLower(stage.name)] = true
+		}
+		if isExcluded {
+			continue
+		}
+		if strings.Contains(image, "$") {
+			return newStepError(
+				UNTRUSTED_BASE_IMAGE_ERROR,
+				fmt.Errorf("base image %s on line %d uses an ARG variable, so it cannot be verified", image, stage.from.line))
+		}
+		baseImages = append(baseImages, image)
+	}
+
+	for _, baseImage := range baseImages {
+		ref, err := parseImageReference(baseImage, insecureRegistries)
+		if err != nil {
+			return newStepError(
+				UNTRUSTED_BASE_IMAGE_ERROR,
+				fmt.Errorf("base image %s is not a valid image reference: %s", baseImage, err))
+		}
+		err = opts.runCosignVerify(ctx, "verify", ref, insecureRegistries, skipTlsVerify, UNTRUSTED_BASE_IMAGE_ERROR)
+		if err != nil {
+			return err
+		}
+		if opts.attestationType != "" {
+			err = opts.runCosignVerify(ctx, "verify-attestation", ref, insecureRegistries, skipTlsVerify, UNTRUSTED_BASE_IMAGE_ERROR)
+			if err != nil {
+				return err
+			}
+		}
+		slog.Info("Verified base image", "image", baseImage)
+	}
+	return nil
+}
+
+// Runs the cosign verify command (verify or verify-attestation) on the
+// image with the trust policy. The errors have the error class
+func (opts verifyOptions) runCosignVerify(
+	ctx context.Context,
+	cosignCommand string,
+	ref name.Reference,
+	insecureRegistries []string,
+	skipTlsVerify bool,
+	class errorClass,
+) error {
+	args := opts.args(cosignCommand, ref, insecureRegistries, skipTlsVerify)
+	slog.Info("Verifying image", "image", ref.String(), "args", args)
+
+	// The verified payloads are not logged, since they are verbose
+	cosignCmd := exec.CommandContext(ctx, opts.cosignPath, args...)
+	cosignCmd.Stderr = os.Stderr
+	err := cosignCmd.Run()
+	if err != nil {
+		if stoppedErr := getStoppedError(ctx, "cosign"); stoppedErr != nil {
+			return stoppedErr
+		}
+		if notFoundErr := getToolNotFoundError(err, "cosign", opts.cosignPath); notFoundErr != nil {
+			return notFoundErr
+		}
+		return newStepError(class, fmt.Errorf("image %s failed the cosign %s with the trust policy: %w", ref, cosignCommand, err))
+	}
+	return nil
+}
+
+// The verification policy of the verify subcommand, read from a YAML file
+type imageVerifyPolicy struct {
+	// The trust policy of the signature. The signature is not verified if
+	// not set
+	Signature *struct {
+		Key                       string `yaml:"key"`
+		CertificateIdentityRegexp string `yaml:"certificate-identity-regexp"`
+		CertificateOidcIssuer     string `yaml:"certificate-oidc-issuer"`
+	} `yaml:"signature"`
+	Sbom struct {
+		Required bool `yaml:"required"`
+		// The accepted SBOM formats. Defaults to all of the SBOM formats
+		Formats []string `yaml:"formats"`
+	} `yaml:"sbom"`
+	// The attestations the image must have, which are verified with the
+	// trust policy of the signature
+	Attestations []struct {
+		// The predicate type (e.g. slsaprovenance)
+		Type string `yaml:"type"`
+	} `yaml:"attestations"`
+}
+
+// Reads and validates the verification policy file
+func readImageVerifyPolicy(policyFile string) (imageVerifyPolicy, error) {
+	policy := imageVerifyPolicy{}
+	policyBytes, err := os.ReadFile(policyFile)
+	if err != nil {
+		return policy, fmt.Errorf("error reading verification policy file: %s", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(policyBytes))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&policy)
+	if err != nil {
+		return policy, fmt.Errorf("error parsing verification policy file %s: %s", policyFile, err)
+	}
+
+	if policy.Signature != nil {
+		isKeyless := policy.Signature.CertificateIdentityRegexp != "" || policy.Signature.CertificateOidcIssuer != ""
+		if policy.Signature.Key != "" && isKeyless {
+			return policy, fmt.Errorf("the signature key and certificate cannot both be set in the verification policy")
+		}
+		if policy.Signature.Key == "" &&
+			(policy.Signature.CertificateIdentityRegexp == "" || policy.Signature.CertificateOidcIssuer == "") {
+			return policy, fmt.Errorf(
+				"the signature key, or certificate-identity-regexp and certificate-oidc-issuer, must be set in the " +
+					"verification policy")
+		}
+	}
+	for _, format := range policy.Sbom.Formats {
+		if !slices.Contains(sbomFormats, format) {
+			return policy, fmt.Errorf("the SBOM format must be one of %s in the verification policy: %s", sbomFormats, format)
+		}
+	}
+	if len(policy.Sbom.Formats) == 0 {
+		policy.Sbom.Formats = sbomFormats
+	}
+	for i, attestation := range policy.Attestations {
+		if attestation.Type == "" {
+			return policy, fmt.Errorf("attestation %d in the verification policy must set the type", i)
+		}
+	}
+	if len(policy.Attestations) > 0 && policy.Signature == nil {
+		return policy, fmt.Errorf("the signature must be set in the verification policy to verify the attestations")
+	}
+	return policy, nil
+}
+
+func handleVerifyCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	verifyFlags := cmd.Flags()
+
+	image, err := verifyFlags.GetString("image")
+	if err != nil {
+		return fmt.Errorf("error processing verify image flag")
+	}
+
+	policyFile, err := verifyFlags.GetString("policy")
+	if err != nil {
+		return fmt.Errorf("error processing verify policy flag")
+	}
+
+	cosignPath, err := verifyFlags.GetString("cosign-path")
+	if err != nil {
+		return fmt.Errorf("error processing verify cosign-path flag")
+	}
+
+	insecureRegistries, err := verifyFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing verify insecure-registry flag")
+	}
+
+	skipTlsVerify, err := verifyFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing verify skip-tls-verify flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(verifyFlags, "verify")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"image", image,
+		"policy", policyFile,
+		"cosignPath", cosignPath,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+	}
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("Verify with params", params...)
+
+	policy, err := readImageVerifyPolicy(policyFile)
+	if err != nil {
+		return err
+	}
+
+	ref, err := parseImageReference(image, insecureRegistries)
+	if err != nil {
+		return fmt.Errorf("image is not a valid image reference: %s", err)
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	// A missing cosign fails before the registry calls, instead of being
+	// reported as a failed check
+	if policy.Signature != nil {
+		err = checkToolPath("cosign", cosignPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	err = registryAuthOpts.login(ctx, ref.Context().RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	// The tag is resolved to the digest, so each check verifies the same image
+	digestRef, ok := ref.(name.Digest)
+	if !ok {
+		digest, err := resolveImageDigest(ctx, ref, skipTlsVerify)
+		if err != nil {
+			return newStepError(IMAGE_VERIFICATION_ERROR, fmt.Errorf("error resolving image %s: %w", ref, err))
+		}
+		digestRef = ref.Context().Digest(digest)
+		slog.Info("Resolved image digest", "image", ref.String(), "digest", digest)
+	}
+
+	// All of the checks run, so each failure is reported
+	failures := []string{}
+	if policy.Signature != nil {
+		opts := verifyOptions{
+			enabled:                   true,
+			cosignPath:                cosignPath,
+			key:                       policy.Signature.Key,
+			certificateIdentityRegexp: policy.Signature.CertificateIdentityRegexp,
+			certificateOidcIssuer:     policy.Signature.CertificateOidcIssuer,
+		}
+		err = opts.runCosignVerify(ctx, "verify", digestRef, insecureRegistries, skipTlsVerify, IMAGE_VERIFICATION_ERROR)
+		if err != nil {
+			if getErrorClass(err) != IMAGE_VERIFICATION_ERROR {
+				return err
+			}
+			slog.Error("Signature check failed", "error", err)
+			failures = append(failures, "signature")
+		} else {
+			slog.Info("Signature check passed", "image", digestRef.String())
+		}
+
+		for _, attestation := range policy.Attestations {
+			opts.attestationType = attestation.Type
+			err = opts.runCosignVerify(ctx, "verify-attestation", digestRef, insecureRegistries, skipTlsVerify, IMAGE_VERIFICATION_ERROR)
+			if err != nil {
+				if getErrorClass(err) != IMAGE_VERIFICATION_ERROR {
+					return err
+				}
+				slog.Error("Attestation check failed", "type", attestation.Type, "error", err)
+				failures = append(failures, fmt.Sprintf("%s attestation", attestation.Type))
+			} else {
+				slog.Info("Attestation check passed", "image", digestRef.String(), "type", attestation.Type)
+			}
+		}
+	}
+
+	if policy.Sbom.Required {
+		sbomType, err := findSbomReferrer(ctx, digestRef, policy.Sbom.Formats, skipTlsVerify)
+		if err != nil {
+			return newStepError(IMAGE_VERIFICATION_ERROR, err)
+		}
+		if sbomType == "" {
+			slog.Error("SBOM check failed. The image has no attached SBOM", "formats", policy.Sbom.Formats)
+			failures = append(failures, "SBOM")
+		} else {
+			slog.Info("SBOM check passed", "image", digestRef.String(), "artifactType", sbomType)
+		}
+	}
+
+	if len(failures) > 0 {
+		return newStepError(
+			IMAGE_VERIFICATION_ERROR,
+			fmt.Errorf("image %s failed the verification policy checks: %s", digestRef, strings.Join(failures, ", ")))
+	}
+	slog.Info("Image passed the verification policy", "image", digestRef.String())
+	return nil
+}
+
+// Returns the artifact type of an SBOM attached to the image as an OCI
+// referrer in one of the formats, or empty if there is none
+func findSbomReferrer(ctx context.Context, ref name.Digest, formats []string, skipTlsVerify bool) (string, error) {
+	index, err := remote.Referrers(ref, getRemoteOptions(ctx, skipTlsVerify)...)
+	if err != nil {
+		return "", fmt.Errorf("error listing the referrers of %s: %w", ref, err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return "", fmt.Errorf("error reading the referrers of %s: %w", ref, err)
+	}
+	for _, desc := range manifest.Manifests {
+		for _, format := range formats {
+			if desc.ArtifactType == string(sbomMediaTypes[format]) {
+				return desc.ArtifactType, nil
+			}
+		}
+	}
+	return "", nil
+}
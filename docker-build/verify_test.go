@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyBaseImagesToolNotFound(t *testing.T) {
+	dockerfilePath := filepath.Join(t.TempDir(), "Dockerfile")
+	err := os.WriteFile(dockerfilePath, []byte("FROM alpine:3.20 AS base\nFROM base\n"), 0644)
+	if err != nil {
+		t.Fatalf("error writing the Dockerfile: %s", err)
+	}
+	opts := verifyOptions{
+		enabled:    true,
+		cosignPath: filepath.Join(t.TempDir(), "cosign"),
+		key:        "cosign.pub",
+	}
+	err = opts.verifyBaseImages(context.Background(), dockerfilePath, nil, false)
+	if getErrorClass(err) != TOOL_NOT_FOUND_ERROR {
+		t.Errorf("verifyBaseImages() error class = %q, want %q: %v", getErrorClass(err), TOOL_NOT_FOUND_ERROR, err)
+	}
+}
+
+func TestCheckToolPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		toolPath string
+		wantErr  bool
+	}{
+		{name: "name on the path", toolPath: "sh", wantErr: false},
+		{name: "missing name", toolPath: "docker-build-missing-tool", wantErr: true},
+		{name: "missing path", toolPath: filepath.Join(t.TempDir(), "cosign"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkToolPath("cosign", tt.toolPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkToolPath() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil && getErrorClass(err) != TOOL_NOT_FOUND_ERROR {
+				t.Errorf("checkToolPath() error class = %q, want %q", getErrorClass(err), TOOL_NOT_FOUND_ERROR)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	// The VEX status of a vulnerability that does not affect the image
+	NOT_AFFECTED_VEX_STATUS = "not_affected"
+	// The VEX status of a vulnerability that is fixed in the image
+	FIXED_VEX_STATUS = "fixed"
+)
+
+// The VEX statuses that ignore a vulnerability
+var ignoredVexStatuses = []string{NOT_AFFECTED_VEX_STATUS, FIXED_VEX_STATUS}
+
+// The fields of the OpenVEX document used by the scan. The statements
+// apply to the scanned image, so the products are not matched
+// See https://github.com/openvex/spec/blob/main/OPENVEX-SPEC.md
+type openVexDocument struct {
+	Timestamp  *time.Time `json:"timestamp"`
+	Statements []struct {
+		// The vulnerability is an object with the name in v0.2.0, and the
+		// name in the earlier versions
+		Vulnerability   json.RawMessage `json:"vulnerability"`
+		Status          string          `json:"status"`
+		Justification   string          `json:"justification"`
+		ImpactStatement string          `json:"impact_statement"`
+		Timestamp       *time.Time      `json:"timestamp"`
+	} `json:"statements"`
+}
+
+// Reads the vulnerability ids that do not affect the image from the
+// OpenVEX document, with the reason they are ignored. With a max age, the
+// statements expire after the age of their timestamp, or of the document
+// timestamp. The statements without a timestamp cannot expire, so they
+// are not used with a max age
+func readScanVexFile(vexFile string, maxAge time.Duration, now time.Time) (map[string]string, error) {
+	bytes, err := os.ReadFile(vexFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scan VEX file: %s", err)
+	}
+	document := openVexDocument{}
+	err = json.Unmarshal(bytes, &document)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing scan VEX file %s: %s", vexFile, err)
+	}
+
+	exceptions := map[string]string{}
+	for i, statement := range document.Statements {
+		id, err := getVexVulnerabilityName(statement.Vulnerability)
+		if err != nil {
+			return nil, fmt.Errorf("statement %d of the scan VEX file has an invalid vulnerability: %s", i, err)
+		}
+		if !slices.Contains(ignoredVexStatuses, statement.Status) {
+			continue
+		}
+
+		timestamp := statement.Timestamp
+		if timestamp == nil {
+			timestamp = document.Timestamp
+		}
+		if maxAge != 0 {
+			if timestamp == nil {
+				slog.Warn("Scan VEX statement has no timestamp, so it cannot expire. Not ignoring", "id", id)
+				continue
+			}
+			if now.Sub(*timestamp) > maxAge {
+				slog.Warn("Scan VEX statement expired", "id", id, "timestamp", timestamp, "maxAge", maxAge)
+				continue
+			}
+		}
+
+		reason := fmt.Sprintf("VEX %s", statement.Status)
+		if statement.Justification != "" {
+			reason = fmt.Sprintf("%s: %s", reason, statement.Justification)
+		} else if statement.ImpactStatement != "" {
+			reason = fmt.Sprintf("%s: %s", reason, statement.ImpactStatement)
+		}
+		exceptions[id] = reason
+	}
+	return exceptions, nil
+}
+
+// Returns the name of the VEX statement vulnerability (e.g. CVE-2024-1234)
+func getVexVulnerabilityName(vulnerability json.RawMessage) (string, error) {
+	var id string
+	if json.Unmarshal(vulnerability, &id) == nil && id != "" {
+		return id, nil
+	}
+	var object struct {
+		Name string `json:"name"`
+	}
+	err := json.Unmarshal(vulnerability, &object)
+	if err != nil {
+		return "", err
+	}
+	if object.Name == "" {
+		return "", fmt.Errorf("the vulnerability name is empty")
+	}
+	return object.Name, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// The default maximum duration to wait for the image
+	DEFAULT_WAIT_TIMEOUT = 10 * time.Minute
+	// The default interval between the registry polls
+	DEFAULT_WAIT_POLL_INTERVAL = 10 * time.Second
+)
+
+func handleWaitCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	waitFlags := cmd.Flags()
+
+	image, err := waitFlags.GetString("image")
+	if err != nil {
+		return fmt.Errorf("error processing wait image flag")
+	}
+
+	timeout, err := waitFlags.GetDuration("timeout")
+	if err != nil {
+		return fmt.Errorf("error processing wait timeout flag")
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("timeout must be positive: %s", timeout)
+	}
+
+	pollInterval, err := waitFlags.GetDuration("poll-interval")
+	if err != nil {
+		return fmt.Errorf("error processing wait poll-interval flag")
+	}
+	if pollInterval <= 0 {
+		return fmt.Errorf("poll-interval must be positive: %s", pollInterval)
+	}
+
+	digestFile, err := waitFlags.GetString("digest-file")
+	if err != nil {
+		return fmt.Errorf("error processing wait digest-file flag")
+	}
+
+	imageRefFile, err := waitFlags.GetString("image-ref-file")
+	if err != nil {
+		return fmt.Errorf("error processing wait image-ref-file flag")
+	}
+
+	insecureRegistries, err := waitFlags.GetStringArray("insecure-registry")
+	if err != nil {
+		return fmt.Errorf("error processing wait insecure-registry flag")
+	}
+
+	skipTlsVerify, err := waitFlags.GetBool("skip-tls-verify")
+	if err != nil {
+		return fmt.Errorf("error processing wait skip-tls-verify flag")
+	}
+
+	registryAuthOpts, err := getRegistryAuthOptions(waitFlags, "wait")
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	params := []any{
+		"image", image,
+		"timeout", timeout,
+		"pollInterval", pollInterval,
+		"digestFile", digestFile,
+		"imageRefFile", imageRefFile,
+		"insecureRegistries", insecureRegistries,
+		"skipTlsVerify", skipTlsVerify,
+	}
+	params = append(params, registryAuthOpts.logAttrs()...)
+	slog.Info("Wait with params", params...)
+
+	ref, err := parseImageReference(image, insecureRegistries)
+	if err != nil {
+		return fmt.Errorf("image is not a valid image reference: %s", err)
+	}
+
+	// The usage is not relevant for registry errors
+	cmd.SilenceUsage = true
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+
+	err = registryAuthOpts.login(ctx, ref.Context().RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, errBuildTimeout)
+	defer cancel()
+	digest, err := waitForImage(ctx, ref, pollInterval, skipTlsVerify)
+	if err != nil {
+		return err
+	}
+
+	imageRef := ref.String()
+	if _, ok := ref.(name.Digest); ok {
+		imageRef = ref.Context().Name()
+	}
+	return writeImageIndexFiles(digestFile, imageRefFile, imageRef, digest)
+}
+
+// Polls the registry until the image is available, then returns its
+// digest. Any registry error is retried, since some registries deny the
+// requests for repos that do not exist yet
+func waitForImage(ctx context.Context, ref name.Reference, pollInterval time.Duration, skipTlsVerify bool) (string, error) {
+	startTime := time.Now()
+	for attempt := 1; ; attempt++ {
+		digest, err := resolveImageDigest(ctx, ref, skipTlsVerify)
+		if err == nil {
+			slog.Info(
+				"Image is available",
+				"image", ref.String(),
+				"digest", digest,
+				"waited", time.Since(startTime).Round(time.Second),
+			)
+			return digest, nil
+		}
+		slog.Info("Image is not available yet", "image", ref.String(), "attempt", attempt, "error", err)
+
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			if errors.Is(context.Cause(ctx), errBuildTimeout) {
+				return "", newStepError(
+					TIMEOUT_ERROR,
+					fmt.Errorf("image %s was not available after %s", ref, time.Since(startTime).Round(time.Second)))
+			}
+			return "", getStoppedError(ctx, "wait")
+		}
+	}
+}
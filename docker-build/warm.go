@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// The default path of the kaniko warmer executable
+	DEFAULT_WARMER_PATH = "/kaniko/warmer"
+	// The default kaniko base image cache dir, which is usually a volume
+	// shared with the builds
+	DEFAULT_WARMER_CACHE_DIR = "/cache"
+	// The builder name of the warmer in the logs and errors
+	WARMER_BUILDER = "warmer"
+)
+
+func handleWarmCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	warmFlags := cmd.Flags()
+
+	warmerPath, err := warmFlags.GetString("warmer-path")
+	if err != nil {
+		return fmt.Errorf("error processing warm warmer-path flag")
+	}
+
+	cacheDir, err := warmFlags.GetString("cache-dir")
+	if err != nil {
+		return fmt.Errorf("error processing warm cache-dir flag")
+	}
+
+	images, err := warmFlags.GetStringArray("image")
+	if err != nil {
+		return fmt.Errorf("error processing warm image flag")
+	}
+
+	imagesFile, err := warmFlags.GetString("images-file")
+	if err != nil {
+		return fmt.Errorf("error processing warm images-file flag")
+	}
+
+	dockerfiles, err := warmFlags.GetStringArray("dockerfile")
+	if err != nil {
+		return fmt.Errorf("error processing warm dockerfile flag")
+	}
+
+	force, err := warmFlags.GetBool("force")
+	if err != nil {
+		return fmt.Errorf("error processing warm force flag")
+	}
+
+	insecurePull, err := warmFlags.GetBool("insecure-pull")
+	if err != nil {
+		return fmt.Errorf("error processing warm insecure-pull flag")
+	}
+
+	skipTlsVerifyPull, err := warmFlags.GetBool("skip-tls-verify-pull")
+	if err != nil {
+		return fmt.Errorf("error processing warm skip-tls-verify-pull flag")
+	}
+
+	registryMirrors, err := warmFlags.GetStringArray("registry-mirror")
+	if err != nil {
+		return fmt.Errorf("error processing warm registry-mirror flag")
+	}
+
+	timeout, err := warmFlags.GetDuration("timeout")
+	if err != nil {
+		return fmt.Errorf("error processing warm timeout flag")
+	}
+	if timeout < 0 {
+		return fmt.Errorf("timeout must not be negative: %s", timeout)
+	}
+
+	gracePeriod, err := warmFlags.GetDuration("grace-period")
+	if err != nil {
+		return fmt.Errorf("error processing warm grace-period flag")
+	}
+
+	dryRun, err := warmFlags.GetBool("dry-run")
+	if err != nil {
+		return fmt.Errorf("error processing warm dry-run flag")
+	}
+
+	// Log command flags
+	slog.Info(
+		"Warm with params",
+		"warmerPath", warmerPath,
+		"cacheDir", cacheDir,
+		"images", images,
+		"imagesFile", imagesFile,
+		"dockerfiles", dockerfiles,
+		"force", force,
+		"insecurePull", insecurePull,
+		"skipTlsVerifyPull", skipTlsVerifyPull,
+		"registryMirrors", registryMirrors,
+		"timeout", timeout,
+		"gracePeriod", gracePeriod,
+		"dryRun", dryRun,
+	)
+
+	if imagesFile != "" {
+		fileImages, err := readWarmImagesFile(imagesFile)
+		if err != nil {
+			return err
+		}
+		images = append(images, fileImages...)
+	}
+	for _, dockerfile := range dockerfiles {
+		instructions, err := readDockerfile(dockerfile)
+		if err != nil {
+			return fmt.Errorf("error reading dockerfile %s: %s", dockerfile, err)
+		}
+		images = append(images, getBaseImages(instructions)...)
+	}
+	images = slices.Compact(slices.Sorted(slices.Values(images)))
+	if len(images) == 0 {
+		return fmt.Errorf("at least one image must be set with the image, images-file, or dockerfile flags")
+	}
+
+	warmerArgs := []string{WARMER_BUILDER, fmt.Sprintf("--cache-dir=%s", cacheDir)}
+	for _, image := range images {
+		warmerArgs = append(warmerArgs, fmt.Sprintf("--image=%s", image))
+	}
+	if force {
+		warmerArgs = append(warmerArgs, "--force")
+	}
+	if insecurePull {
+		warmerArgs = append(warmerArgs, "--insecure-pull")
+	}
+	if skipTlsVerifyPull {
+		warmerArgs = append(warmerArgs, "--skip-tls-verify-pull")
+	}
+	for _, registryMirror := range registryMirrors {
+		warmerArgs = append(warmerArgs, fmt.Sprintf("--registry-mirror=%s", registryMirror))
+	}
+	warmerCommand := builderCommand{builder: WARMER_BUILDER, path: warmerPath, args: warmerArgs}
+
+	redactor := newRedactor(nil, nil, nil, "", nil)
+	if dryRun {
+		slog.Info("Dry run is set. Exiting without warming the cache")
+		logBuilderCommand(slog.LevelInfo, warmerCommand, redactor)
+		return nil
+	}
+
+	// The usage is not relevant for warmer errors
+	cmd.SilenceUsage = true
+	slog.Info("Starting cache warmer", "images", images, "cacheDir", cacheDir)
+	logBuilderCommand(slog.LevelDebug, warmerCommand, redactor)
+
+	ctx, stopSignals := withTerminationSignals(context.Background())
+	defer stopSignals()
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, errBuildTimeout)
+		defer cancel()
+	}
+
+	_, err = runBuilder(ctx, warmerCommand, gracePeriod, redactor)
+	if err != nil {
+		return fmt.Errorf("Cache warmer failed: %w", err)
+	}
+	slog.Info("Cache warmer succeeded", "images", len(images))
+	return nil
+}
+
+// Reads the images from a file with one image per line. Blank lines and
+// lines starting with # are ignored
+func readWarmImagesFile(imagesFile string) ([]string, error) {
+	file, err := os.Open(imagesFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading images file: %s", err)
+	}
+	defer file.Close()
+
+	images := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			images = append(images, line)
+		}
+	}
+	return images, scanner.Err()
+}
+
+// Returns the base images of the FROM instructions. Stage names, scratch,
+// and images from ARG variables are excluded, since they cannot be pulled
+// without the build
+func getBaseImages(instructions []instruction) []string {
+	images := []string{}
+	stageNames := map[string]bool{}
+	for _, stage := range getBuildStages(instructions) {
+		image := stage.image
+		isExcluded := image == "" ||
+			image == "scratch" ||
+			strings.Contains(image, "$") ||
+			stageNames[strings.ToLower(image)]
+		if !isExcluded {
+			images = append(images, image)
+		}
+		if stage.name != "" {
+			stageNames[strings.ToLower(stage.name)] = true
+		}
+	}
+	return images
+}
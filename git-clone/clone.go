@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/spf13/pflag"
+)
+
+// The options for cloning the repo to the clone path
+type cloneOptions struct {
+	repo      string
+	clonePath string
+	// The revision to check out (e.g. commit sha hash), and the local
+	// branch to check it out as, or a detached HEAD if not set
+	revisionHash string
+	revisionRef  string
+	// The revision of the PR base, which is also fetched for the diff check
+	baseRevisionHash string
+	// Whether the revision is merged onto the base, so the PR build has
+	// the post merge state
+	merge bool
+	// The number of commits to fetch, or 0 for the full history
+	depth      int
+	fetchTags  bool
+	submodules bool
+	lfs        bool
+	// The dir with the files that are copied to the clone path after the
+	// checkout (e.g. a generated config)
+	overrideDir string
+	gitPath     string
+	auth        gitrepo.AuthOptions
+	sparse      sparseOptions
+}
+
+func getCloneOptions(flags *pflag.FlagSet) (cloneOptions, error) {
+	var opts cloneOptions
+	var err error
+
+	opts.repo, err = flags.GetString("repo")
+	if err != nil {
+		return opts, fmt.Errorf("error processing repo flag")
+	}
+
+	opts.clonePath, err = flags.GetString("clone-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing clone-path flag")
+	}
+
+	opts.revisionHash, err = flags.GetString("revision-hash")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revision-hash flag")
+	}
+
+	opts.revisionRef, err = flags.GetString("revision-ref")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revision-ref flag")
+	}
+
+	opts.baseRevisionHash, err = flags.GetString("base-revision-hash")
+	if err != nil {
+		return opts, fmt.Errorf("error processing base-revision-hash flag")
+	}
+
+	opts.merge, err = flags.GetBool("merge")
+	if err != nil {
+		return opts, fmt.Errorf("error processing merge flag")
+	}
+	if opts.merge && opts.baseRevisionHash == "" {
+		return opts, fmt.Errorf("base-revision-hash must be set with merge")
+	}
+
+	opts.depth, err = flags.GetInt("depth")
+	if err != nil {
+		return opts, fmt.Errorf("error processing depth flag")
+	}
+	if opts.depth < 0 {
+		return opts, fmt.Errorf("depth must be at least 0: %d", opts.depth)
+	}
+
+	opts.fetchTags, err = flags.GetBool("fetch-tags")
+	if err != nil {
+		return opts, fmt.Errorf("error processing fetch-tags flag")
+	}
+
+	opts.submodules, err = flags.GetBool("submodules")
+	if err != nil {
+		return opts, fmt.Errorf("error processing submodules flag")
+	}
+
+	opts.lfs, err = flags.GetBool("lfs")
+	if err != nil {
+		return opts, fmt.Errorf("error processing lfs flag")
+	}
+
+	opts.overrideDir, err = flags.GetString("override-dir")
+	if err != nil {
+		return opts, fmt.Errorf("error processing override-dir flag")
+	}
+
+	opts.gitPath, err = flags.GetString("git-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing git-path flag")
+	}
+
+	opts.auth, err = gitrepo.GetAuthOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.sparse, err = getSparseOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (opts cloneOptions) logAttrs() []any {
+	attrs := []any{
+		"repo", gitrepo.RedactUrlCredentials(opts.repo),
+		"clonePath", opts.clonePath,
+		"revisionHash", opts.revisionHash,
+		"revisionRef", opts.revisionRef,
+		"baseRevisionHash", opts.baseRevisionHash,
+		"merge", opts.merge,
+		"depth", opts.depth,
+		"fetchTags", opts.fetchTags,
+		"submodules", opts.submodules,
+		"lfs", opts.lfs,
+		"overrideDir", opts.overrideDir,
+		"gitPath", opts.gitPath,
+	}
+	attrs = append(attrs, opts.auth.LogAttrs()...)
+	return append(attrs, opts.sparse.logAttrs()...)
+}
+
+// Clones the revision to the clone path. The repo is initialized and only
+// the revisions are fetched, instead of a git clone, so a PR or a commit
+// that is not on a branch can be checked out. The clone has the origin
+// remote and HEAD at the revision, which docker-build reads for the labels
+// and the git build args
+func (opts cloneOptions) clone(ctx context.Context) error {
+	err := gitrepo.CheckClonePathEmpty(opts.clonePath)
+	if err != nil {
+		return err
+	}
+	authEnv, cleanup, err := opts.auth.Env(opts.repo)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	git := gitrepo.Runner{
+		GitPath:   opts.gitPath,
+		ClonePath: opts.clonePath,
+		// The lfs files are pulled in one batch after the checkout, and a
+		// prompt for credentials would hang the step
+		Env: append(authEnv, "GIT_TERMINAL_PROMPT=0", "GIT_LFS_SKIP_SMUDGE=1"),
+	}
+
+	slog.Info("Initializing the clone", "clonePath", opts.clonePath)
+	_, err = git.Run(ctx, "init", "--quiet")
+	if err != nil {
+		return err
+	}
+	_, err = git.Run(ctx, "remote", "add", "origin", opts.repo)
+	if err != nil {
+		return err
+	}
+
+	// Only the tree of the base is needed for the diff check, and the
+	// history for the merge is fetched after
+	baseCommit := ""
+	if opts.baseRevisionHash != "" {
+		slog.Info("Fetching the base revision", "baseRevisionHash", opts.baseRevisionHash)
+		baseCommit, err = fetch(ctx, git, opts.fetchArgs(getDepthArg(1), opts.baseRevisionHash))
+		if err != nil {
+			return err
+		}
+	}
+	slog.Info("Fetching the revision", "revisionHash", opts.revisionHash, "depth", opts.depth)
+	revisionCommit, err := fetch(ctx, git, opts.fetchArgs(getDepthArg(opts.depth), opts.revisionHash))
+	if err != nil {
+		return err
+	}
+
+	if opts.sparse.enabled() {
+		err = opts.sparse.configure(ctx, git, revisionCommit)
+		if err != nil {
+			return err
+		}
+	}
+
+	// In the merge mode, the base is checked out and the revision is
+	// merged onto it
+	checkoutCommit := revisionCommit
+	if opts.merge {
+		err = opts.fetchMergeBase(ctx, git, baseCommit, revisionCommit)
+		if err != nil {
+			return err
+		}
+		checkoutCommit = baseCommit
+	}
+	checkoutArgs := []string{"checkout", "--quiet", "--force", "--detach", checkoutCommit}
+	if opts.revisionRef != "" {
+		branch := strings.TrimPrefix(opts.revisionRef, "refs/heads/")
+		checkoutArgs = []string{"checkout", "--quiet", "--force", "-B", branch, checkoutCommit}
+	}
+	_, err = git.Run(ctx, checkoutArgs...)
+	if err != nil {
+		return err
+	}
+	if opts.merge {
+		err = opts.mergeRevision(ctx, git, baseCommit, revisionCommit)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.submodules {
+		slog.Info("Updating the submodules")
+		submoduleArgs := []string{"submodule", "update", "--init", "--recursive", "--force"}
+		if opts.depth > 0 {
+			submoduleArgs = append(submoduleArgs, "--depth", strconv.Itoa(opts.depth))
+		}
+		_, err = git.Run(ctx, submoduleArgs...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.lfs {
+		slog.Info("Pulling the lfs files")
+		_, err = git.Run(ctx, "lfs", "install", "--local")
+		if err != nil {
+			return err
+		}
+		_, err = git.Run(ctx, "lfs", "pull")
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.overrideDir != "" {
+		err = copyOverrideFiles(opts.overrideDir, opts.clonePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	head, err := git.Run(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	slog.Info("Cloned the repo", "clonePath", opts.clonePath, "head", strings.TrimSpace(head))
+	return nil
+}
+
+// Returns the args to fetch the revisions from the origin remote. The
+// depth arg limits the history (e.g. --depth=1), or is empty for the full
+// history
+func (opts cloneOptions) fetchArgs(depthArg string, revisions ...string) []string {
+	args := []string{"fetch", "--quiet", "--recurse-submodules=no"}
+	if opts.fetchTags {
+		args = append(args, "--tags")
+	} else {
+		args = append(args, "--no-tags")
+	}
+	if depthArg != "" {
+		args = append(args, depthArg)
+	}
+	if opts.sparse.enabled() {
+		// The file contents are fetched on the checkout, so only the
+		// contents of the sparse paths are downloaded
+		args = append(args, "--filter=blob:none")
+	}
+	args = append(args, "origin")
+	return append(args, revisions...)
+}
+
+// Returns the fetch arg for the depth, or empty for the full history
+func getDepthArg(depth int) string {
+	if depth == 0 {
+		return ""
+	}
+	return fmt.Sprintf("--depth=%d", depth)
+}
+
+// Copies the files of the override dir to the same relative paths in the
+// clone path. Symlinks are followed, since the files of a mounted config
+// map or secret are symlinks
+func copyOverrideFiles(overrideDir string, clonePath string) error {
+	if _, err := os.Stat(overrideDir); errors.Is(err, fs.ErrNotExist) {
+		slog.Info("Skipping override files. No override dir exists", "overrideDir", overrideDir)
+		return nil
+	}
+
+	slog.Info("Adding files from override dir to clone dir", "overrideDir", overrideDir)
+	return filepath.WalkDir(overrideDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// The internal dirs of a mounted config map (e.g. ..data) are
+		// skipped, since the files link to them
+		if strings.HasPrefix(entry.Name(), "..") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(overrideDir, path)
+		if err != nil {
+			return err
+		}
+		clonePathFile := filepath.Join(clonePath, relativePath)
+		slog.Info("Adding override file", "overrideFile", path, "cloneFile", clonePathFile)
+		err = os.MkdirAll(filepath.Dir(clonePathFile), 0755)
+		if err != nil {
+			return err
+		}
+		return copyFile(path, clonePathFile, info.Mode().Perm())
+	})
+}
+
+func copyFile(src string, dst string, perm fs.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dstFile, srcFile)
+	if err != nil {
+		dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
+
+// Runs the git fetch and returns the commit hash of FETCH_HEAD
+func fetch(ctx context.Context, git gitrepo.Runner, args []string) (string, error) {
+	_, err := git.Run(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	commit, err := git.Run(ctx, "rev-parse", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(commit), nil
+}
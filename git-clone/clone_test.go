@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/spf13/pflag"
+)
+
+// Creates a repo with a main branch in a temp dir, to clone from. Returns
+// the path of the repo
+func newTestOrigin(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	origin := t.TempDir()
+	gitTest(t, origin, "init", "--quiet", "--initial-branch=main")
+	gitTest(t, origin, "config", "user.name", "test")
+	gitTest(t, origin, "config", "user.email", "test@example.com")
+	gitTest(t, origin, "config", "commit.gpgsign", "false")
+	return origin
+}
+
+// Runs the git command in the repo, and returns the trimmed stdout
+func gitTest(t *testing.T, repoPath string, args ...string) string {
+	t.Helper()
+	git := gitrepo.Runner{GitPath: gitrepo.DEFAULT_GIT_PATH, ClonePath: repoPath}
+	output, err := git.Run(context.Background(), args...)
+	if err != nil {
+		t.Fatalf("git %s failed: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(output)
+}
+
+// Writes the file and commits it. Returns the commit hash
+func commitTestFile(t *testing.T, repoPath string, file string, content string) string {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(repoPath, file), []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("error writing file: %s", err)
+	}
+	gitTest(t, repoPath, "add", "--all")
+	gitTest(t, repoPath, "commit", "--quiet", "--message", "Update "+file)
+	return gitTest(t, repoPath, "rev-parse", "HEAD")
+}
+
+// Returns the clone options of the args
+func getTestCloneOptions(t *testing.T, args ...string) (cloneOptions, error) {
+	t.Helper()
+	flags := pflag.NewFlagSet("git-clone", pflag.ContinueOnError)
+	configureCloneFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return getCloneOptions(flags)
+}
+
+func TestGetCloneOptions(t *testing.T) {
+	required := []string{"--repo", "https://github.com/org/repo.git", "--clone-path", "/workspace", "--revision-hash", "abc"}
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "valid", args: []string{"--depth", "0", "--merge", "--base-revision-hash", "def"}},
+		{name: "merge without the base", args: []string{"--merge"}, wantErr: "base-revision-hash must be set with merge"},
+		{name: "negative depth", args: []string{"--depth", "-1"}, wantErr: "depth must be at least 0: -1"},
+		{
+			name:    "sparse matrix build without the matrix file",
+			args:    []string{"--sparse-matrix-build", "api"},
+			wantErr: "sparse-matrix-file must be set with sparse-matrix-build",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getTestCloneOptions(t, append(slices.Clone(required), tt.args...)...)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("getCloneOptions() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("getCloneOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	origin := newTestOrigin(t)
+	commitTestFile(t, origin, "README.md", "first")
+	revision := commitTestFile(t, origin, "README.md", "second")
+	// A later commit of the branch is not checked out
+	commitTestFile(t, origin, "README.md", "third")
+
+	overrideDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(overrideDir, "config.yaml"), []byte("override"), 0644)
+	if err != nil {
+		t.Fatalf("error writing the override file: %s", err)
+	}
+
+	clonePath := filepath.Join(t.TempDir(), "clone")
+	opts, err := getTestCloneOptions(
+		t,
+		"--repo", "file://"+origin,
+		"--clone-path", clonePath,
+		"--revision-hash", revision,
+		"--revision-ref", "refs/heads/main",
+		"--override-dir", overrideDir,
+	)
+	if err != nil {
+		t.Fatalf("getCloneOptions() error = %v", err)
+	}
+	err = opts.clone(context.Background())
+	if err != nil {
+		t.Fatalf("clone() error = %v", err)
+	}
+
+	if head := gitTest(t, clonePath, "rev-parse", "HEAD"); head != revision {
+		t.Errorf("got HEAD %s, want %s", head, revision)
+	}
+	if branch := gitTest(t, clonePath, "symbolic-ref", "--short", "HEAD"); branch != "main" {
+		t.Errorf("got branch %q, want %q", branch, "main")
+	}
+	// The default depth only fetches the revision
+	if count := gitTest(t, clonePath, "rev-list", "--count", "HEAD"); count != "1" {
+		t.Errorf("got %s commits, want 1", count)
+	}
+	readme, err := os.ReadFile(filepath.Join(clonePath, "README.md"))
+	if err != nil || string(readme) != "second" {
+		t.Errorf("got README.md %q, want %q: %v", readme, "second", err)
+	}
+	override, err := os.ReadFile(filepath.Join(clonePath, "config.yaml"))
+	if err != nil || string(override) != "override" {
+		t.Errorf("got the override file %q, want %q: %v", override, "override", err)
+	}
+}
+
+func TestCloneMerge(t *testing.T) {
+	origin := newTestOrigin(t)
+	commitTestFile(t, origin, "README.md", "first")
+	gitTest(t, origin, "checkout", "--quiet", "-b", "feature")
+	feature := commitTestFile(t, origin, "feature.txt", "feature")
+	conflict := commitTestFile(t, origin, "README.md", "feature")
+	gitTest(t, origin, "checkout", "--quiet", "main")
+	base := commitTestFile(t, origin, "README.md", "main")
+
+	tests := []struct {
+		name         string
+		revision     string
+		wantConflict bool
+	}{
+		{name: "clean merge", revision: feature},
+		{name: "merge conflict", revision: conflict, wantConflict: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clonePath := filepath.Join(t.TempDir(), "clone")
+			opts, err := getTestCloneOptions(
+				t,
+				"--repo", "file://"+origin,
+				"--clone-path", clonePath,
+				"--revision-hash", tt.revision,
+				"--base-revision-hash", base,
+				"--merge",
+			)
+			if err != nil {
+				t.Fatalf("getCloneOptions() error = %v", err)
+			}
+			err = opts.clone(context.Background())
+
+			var conflictErr *mergeConflictError
+			if tt.wantConflict {
+				if !errors.As(err, &conflictErr) {
+					t.Fatalf("clone() error = %v, want a merge conflict", err)
+				}
+				if !slices.Equal(conflictErr.paths, []string{"README.md"}) {
+					t.Errorf("got conflict paths %q, want %q", conflictErr.paths, []string{"README.md"})
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("clone() error = %v", err)
+			}
+			// The merge has the base and the revision as its parents
+			parents := gitTest(t, clonePath, "rev-parse", "HEAD^1", "HEAD^2")
+			if parents != base+"\n"+tt.revision {
+				t.Errorf("got merge parents %q, want %s and %s", parents, base, tt.revision)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+module github.com/osoriano/deploy-steps/git-clone
+
+go 1.24.1
+
+require (
+	github.com/osoriano/deploy-steps/internal v0.0.0
+	github.com/spf13/cobra v1.9.1
+	github.com/spf13/pflag v1.0.6
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/inconshreveable/mousetrap v1.1.0 // indirect
+
+replace github.com/osoriano/deploy-steps/internal => ../internal
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "git-clone"
+
+// The default number of commits to fetch, which is enough to build
+const DEFAULT_DEPTH = 1
+
+var mainCmd = &cobra.Command{
+	Use:   "git-clone",
+	Short: "Clone a revision of a repo for a docker build",
+	Long: `Clones a revision of a repo for a docker build.
+The revision is checked out to the clone path, in the layout that docker-build
+and diff-check read`,
+	PersistentPreRunE: loadFlagValues,
+	RunE:              handleMainCmd,
+}
+
+func configureCmds() {
+	configureCloneFlags(mainCmd.Flags())
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the git args")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+}
+
+func configureCloneFlags(flags *pflag.FlagSet) {
+	flags.String("repo", "", "The repo clone url (e.g. https://github.com/org/repo.git or git@github.com:org/repo.git)")
+	cobra.MarkFlagRequired(flags, "repo")
+
+	flags.String("clone-path", "", "The path to clone the repo to. Must be empty or not exist")
+	cobra.MarkFlagRequired(flags, "clone-path")
+
+	flags.String("revision-hash", "", "The revision id to check out (e.g. commit sha hash)")
+	cobra.MarkFlagRequired(flags, "revision-hash")
+
+	flags.String(
+		"revision-ref",
+		"",
+		"The local branch that the revision is checked out as (e.g. main). HEAD is detached if not set")
+
+	flags.String(
+		"base-revision-hash",
+		"",
+		"The revision id of the PR base (e.g. commit sha hash), which is also fetched so diff-check can diff the PR")
+
+	flags.Bool(
+		"merge",
+		false,
+		"Whether to merge the revision onto the base revision, so a PR build has the post merge state instead of "+
+			"the PR branch tip. The history is fetched until the merge base. A merge conflict exits with code 2")
+
+	flags.Int(
+		"depth",
+		DEFAULT_DEPTH,
+		"The number of commits of the revision to fetch, or 0 for the full history. Use 2 so diff-check can diff "+
+			"a commit against its parent")
+
+	flags.Bool("fetch-tags", false, "Whether to fetch the tags, which docker-build adds to the git build args")
+
+	flags.Bool("submodules", false, "Whether to check out the submodules recursively, with the same depth")
+
+	flags.Bool("lfs", false, "Whether to pull the Git LFS files. Otherwise, the LFS files are left as pointer files")
+
+	flags.String(
+		"override-dir",
+		"",
+		"The dir with the files that are copied to the same relative paths in the clone path after the checkout "+
+			"(e.g. a mounted config map). Skipped if the dir does not exist")
+
+	flags.String("git-path", gitrepo.DEFAULT_GIT_PATH, "The path to the git executable")
+
+	gitrepo.ConfigureAuthFlags(flags)
+
+	configureSparseFlags(flags)
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	cloneOpts, err := getCloneOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Git clone with params", cloneOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	return cloneOpts.clone(cmd.Context())
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		var conflictErr *mergeConflictError
+		if errors.As(err, &conflictErr) {
+			os.Exit(MERGE_CONFLICT_EXIT_CODE)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+)
+
+const (
+	// The number of commits that the history is deepened by on each fetch,
+	// until the merge base of the revision and the base is fetched
+	MERGE_DEEPEN = 50
+	// The number of fetches that deepen the history before the full history
+	// is fetched
+	MERGE_DEEPEN_ATTEMPTS = 5
+	// The identity of the merge commit, which is only in the clone
+	MERGE_AUTHOR_NAME  = "git-clone"
+	MERGE_AUTHOR_EMAIL = "git-clone@localhost"
+	// The exit code of a merge conflict, so the workflow can report it
+	// separately from a clone failure
+	MERGE_CONFLICT_EXIT_CODE = 2
+)
+
+// Error returned when the revision cannot be merged onto the base
+type mergeConflictError struct {
+	baseCommit     string
+	revisionCommit string
+	// The paths with conflicts
+	paths []string
+}
+
+func (e *mergeConflictError) Error() string {
+	return fmt.Sprintf(
+		"the revision %s has merge conflicts with the base %s in the paths %s. Merge or rebase the base into the PR "+
+			"and resolve the conflicts",
+		e.revisionCommit,
+		e.baseCommit,
+		e.paths)
+}
+
+// Fetches the history of the revision and the base until their merge
+// base, which the merge needs. The history is deepened in steps, since
+// the PR branch is usually a few commits ahead of the base
+func (opts cloneOptions) fetchMergeBase(ctx context.Context, git gitrepo.Runner, baseCommit string, revisionCommit string) error {
+	if opts.depth == 0 {
+		// The full history of the revision was fetched, but the base was
+		// fetched with a depth of 1
+		_, err := git.Run(ctx, opts.fetchArgs("", baseCommit)...)
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		_, err := git.Run(ctx, "merge-base", baseCommit, revisionCommit)
+		if err == nil {
+			return nil
+		}
+		depthArg := fmt.Sprintf("--deepen=%d", MERGE_DEEPEN)
+		if attempt == MERGE_DEEPEN_ATTEMPTS {
+			depthArg = "--unshallow"
+		} else if attempt > MERGE_DEEPEN_ATTEMPTS {
+			return fmt.Errorf("the revision %s and the base %s have no merge base", revisionCommit, baseCommit)
+		}
+		slog.Info("Fetching the history until the merge base", "depthArg", depthArg)
+		_, err = git.Run(ctx, opts.fetchArgs(depthArg, baseCommit, revisionCommit)...)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Merges the revision onto the checked out base with a merge commit. A
+// merge conflict returns a mergeConflictError with the conflicting paths
+func (opts cloneOptions) mergeRevision(ctx context.Context, git gitrepo.Runner, baseCommit string, revisionCommit string) error {
+	slog.Info("Merging the revision onto the base", "revisionCommit", revisionCommit, "baseCommit", baseCommit)
+	mergeGit := git
+	mergeGit.Env = append(
+		append([]string{}, git.Env...),
+		"GIT_AUTHOR_NAME="+MERGE_AUTHOR_NAME,
+		"GIT_AUTHOR_EMAIL="+MERGE_AUTHOR_EMAIL,
+		"GIT_COMMITTER_NAME="+MERGE_AUTHOR_NAME,
+		"GIT_COMMITTER_EMAIL="+MERGE_AUTHOR_EMAIL,
+	)
+	_, err := mergeGit.Run(
+		ctx,
+		"merge",
+		"--no-ff",
+		"--no-edit",
+		"-m",
+		fmt.Sprintf("Merge %s into %s", revisionCommit, baseCommit),
+		revisionCommit)
+	if err == nil {
+		return nil
+	}
+
+	// A merge conflict exits with code 1, and leaves the unmerged paths
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return err
+	}
+	unmerged, diffErr := git.Run(ctx, "diff", "--name-only", "--diff-filter=U")
+	if diffErr != nil {
+		return err
+	}
+	paths := strings.Fields(unmerged)
+	if len(paths) == 0 {
+		return err
+	}
+	for _, path := range paths {
+		slog.Error("Merge conflict", "path", path)
+	}
+	return &mergeConflictError{baseCommit: baseCommit, revisionCommit: revisionCommit, paths: paths}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// The options for a sparse checkout, so only the paths that the build
+// needs are checked out of a monorepo
+type sparseOptions struct {
+	// The paths or globs to check out, relative to the repo root
+	paths []string
+	// The path of a build matrix file in the repo, whose builds add their
+	// paths, dockerfiles, and contexts to the sparse paths
+	matrixFile string
+	// The names of the matrix builds whose paths are added. Defaults to
+	// all of the builds
+	matrixBuilds []string
+}
+
+// The build matrix file of docker-build. Only the fields that select the
+// paths of a build are read, since docker-build validates the rest
+type buildMatrix struct {
+	Builds []matrixBuild `yaml:"builds"`
+}
+
+type matrixBuild struct {
+	Name       string   `yaml:"name"`
+	Dockerfile string   `yaml:"dockerfile"`
+	Context    string   `yaml:"context"`
+	Paths      []string `yaml:"paths"`
+}
+
+func configureSparseFlags(flags *pflag.FlagSet) {
+	flags.StringArray(
+		"sparse-path",
+		nil,
+		"A path or glob to check out, relative to the repo root (e.g. services/api or libs/**/*.proto). The "+
+			"other paths are not checked out, and their file contents are not fetched. Can be repeated")
+	flags.String(
+		"sparse-matrix-file",
+		"",
+		"The path of a build matrix file in the repo (e.g. .jettison/builds.yaml), whose builds add their paths, "+
+			"dockerfiles, and contexts to the sparse paths")
+	flags.StringArray(
+		"sparse-matrix-build",
+		nil,
+		"The name of a build in the sparse matrix file whose paths are added. Defaults to all of the builds. "+
+			"Can be repeated")
+}
+
+func getSparseOptions(flags *pflag.FlagSet) (sparseOptions, error) {
+	var opts sparseOptions
+	var err error
+
+	opts.paths, err = flags.GetStringArray("sparse-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing sparse-path flag")
+	}
+
+	opts.matrixFile, err = flags.GetString("sparse-matrix-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing sparse-matrix-file flag")
+	}
+
+	opts.matrixBuilds, err = flags.GetStringArray("sparse-matrix-build")
+	if err != nil {
+		return opts, fmt.Errorf("error processing sparse-matrix-build flag")
+	}
+	if len(opts.matrixBuilds) > 0 && opts.matrixFile == "" {
+		return opts, fmt.Errorf("sparse-matrix-file must be set with sparse-matrix-build")
+	}
+	return opts, nil
+}
+
+func (opts sparseOptions) logAttrs() []any {
+	return []any{
+		"sparsePaths", opts.paths,
+		"sparseMatrixFile", opts.matrixFile,
+		"sparseMatrixBuilds", opts.matrixBuilds,
+	}
+}
+
+// Returns whether the checkout is sparse
+func (opts sparseOptions) enabled() bool {
+	return len(opts.paths) > 0 || opts.matrixFile != ""
+}
+
+// Configures the sparse checkout of the fetched revision, before it is
+// checked out. The checkout is not sparse if a path matches the whole repo
+func (opts sparseOptions) configure(ctx context.Context, git gitrepo.Runner, revisionCommit string) error {
+	paths := slices.Clone(opts.paths)
+	if opts.matrixFile != "" {
+		// The matrix file is read from the fetched revision, since the
+		// working tree is not checked out yet
+		matrixBytes, err := git.Run(ctx, "show", fmt.Sprintf("%s:%s", revisionCommit, strings.TrimPrefix(opts.matrixFile, "/")))
+		if err != nil {
+			return fmt.Errorf("error reading sparse matrix file %s: %s", opts.matrixFile, err)
+		}
+		matrixPaths, err := opts.getMatrixPaths([]byte(matrixBytes))
+		if err != nil {
+			return err
+		}
+		// The matrix file is checked out, so docker-build matrix can read it
+		paths = append(paths, opts.matrixFile)
+		paths = append(paths, matrixPaths...)
+	}
+
+	patterns := []string{}
+	for _, sparsePath := range paths {
+		pattern := path.Clean("/" + strings.TrimPrefix(sparsePath, "/"))
+		if pattern == "/" {
+			slog.Info("A sparse path matches the whole repo, so the checkout is not sparse", "sparsePath", sparsePath)
+			return nil
+		}
+		if !slices.Contains(patterns, pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	slog.Info("Configuring the sparse checkout", "patterns", patterns)
+
+	// The patterns are gitignore patterns anchored to the repo root, which
+	// match a file or a dir with everything under it
+	_, err := git.RunInput(ctx, strings.Join(patterns, "\n")+"\n", "sparse-checkout", "set", "--no-cone", "--stdin")
+	return err
+}
+
+// Returns the paths of the matrix builds, which are the dockerfile and the
+// context that the build reads, and the paths that trigger the build
+func (opts sparseOptions) getMatrixPaths(matrixBytes []byte) ([]string, error) {
+	matrix := buildMatrix{}
+	err := yaml.NewDecoder(bytes.NewReader(matrixBytes)).Decode(&matrix)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing sparse matrix file %s: %s", opts.matrixFile, err)
+	}
+
+	paths := []string{}
+	found := map[string]bool{}
+	for _, build := range matrix.Builds {
+		name := build.Name
+		if name == "" {
+			name = build.Dockerfile
+		}
+		if len(opts.matrixBuilds) > 0 && !slices.Contains(opts.matrixBuilds, name) {
+			continue
+		}
+		found[name] = true
+
+		contextDir := build.Context
+		if contextDir == "" {
+			contextDir = path.Dir(build.Dockerfile)
+		}
+		paths = append(paths, build.Dockerfile, contextDir)
+		paths = append(paths, build.Paths...)
+	}
+	for _, name := range opts.matrixBuilds {
+		if !found[name] {
+			return nil, fmt.Errorf("sparse matrix build is not in the sparse matrix file %s: %s", opts.matrixFile, name)
+		}
+	}
+	slog.Info("Read the sparse paths of the matrix builds", "matrixFile", opts.matrixFile, "paths", paths)
+	return paths, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default author of the commits
+	DEFAULT_AUTHOR_NAME  = "gitops-update"
+	DEFAULT_AUTHOR_EMAIL = "gitops-update@localhost"
+)
+
+// The options for updating the image in the manifests repo
+type gitopsOptions struct {
+	branch     gitrepo.BranchOptions
+	resultFile string
+	update     updateOptions
+	pr         prOptions
+}
+
+// The result of the update, which is written to the result file
+type gitopsResult struct {
+	// Whether the update changed any files. An image that is already at the
+	// version is not committed
+	Changed bool     `json:"changed"`
+	Files   []string `json:"files"`
+	Commit  string   `json:"commit,omitempty"`
+	// The branch that the commit is pushed to, which is the PR branch in the
+	// PR mode
+	Branch   string `json:"branch,omitempty"`
+	Pushed   bool   `json:"pushed"`
+	PrNumber int    `json:"prNumber,omitempty"`
+	PrUrl    string `json:"prUrl,omitempty"`
+}
+
+// The change of the image in the files of the manifests repo
+type updateChange struct {
+	update updateOptions
+}
+
+func getGitopsOptions(flags *pflag.FlagSet) (gitopsOptions, error) {
+	var opts gitopsOptions
+	var err error
+
+	opts.branch, err = gitrepo.GetBranchOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.resultFile, err = flags.GetString("result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing result-file flag")
+	}
+
+	opts.update, err = getUpdateOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.pr, err = getPrOptions(flags, opts.branch.Repo(), opts.update)
+	if err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (opts gitopsOptions) logAttrs() []any {
+	attrs := opts.branch.LogAttrs()
+	attrs = append(attrs, "resultFile", opts.resultFile)
+	attrs = append(attrs, opts.update.logAttrs()...)
+	return append(attrs, opts.pr.logAttrs()...)
+}
+
+// Clones the branch of the manifests repo, updates the image, and commits
+// and pushes the change. In the PR mode, the commit is pushed to the PR
+// branch and a PR is opened instead
+func (opts gitopsOptions) updateManifests(ctx context.Context) (gitopsResult, error) {
+	result := gitopsResult{Files: []string{}}
+	change := updateChange{update: opts.update}
+
+	git, cleanup, err := opts.branch.Clone(ctx, "gitops-update-", "--depth=1")
+	defer cleanup()
+	if err != nil {
+		return result, err
+	}
+
+	branchResult, err := opts.branch.CommitChange(ctx, git, change)
+	result = withBranchResult(result, branchResult)
+	if err != nil || !branchResult.Changed {
+		return result, err
+	}
+
+	if !opts.branch.Push() {
+		slog.Info("Skipping the push", "commit", result.Commit)
+		return result, nil
+	}
+	if opts.pr.enabled {
+		commitMessage := opts.branch.GetCommitMessage(change, result.Files)
+		return opts.pr.pushPullRequest(ctx, git, opts.branch.Branch(), commitMessage, result)
+	}
+	result.Branch = opts.branch.Branch()
+	branchResult, err = opts.branch.PushBranch(ctx, git, change, branchResult, "--depth=1")
+	return withBranchResult(result, branchResult), err
+}
+
+// Returns the result with the files, the commit, and the push of the branch
+// result
+func withBranchResult(result gitopsResult, branchResult gitrepo.BranchResult) gitopsResult {
+	result.Changed = branchResult.Changed
+	result.Files = branchResult.Files
+	result.Commit = branchResult.Commit
+	result.Pushed = branchResult.Pushed
+	return result
+}
+
+// Updates the image in the files of the clone
+func (change updateChange) Apply(ctx context.Context, git gitrepo.Runner) ([]string, error) {
+	return change.update.updateFiles(git.ClonePath)
+}
+
+// Returns the commit message, which defaults to the message of the argocd
+// step
+func (change updateChange) CommitMessage(files []string) string {
+	path := strings.Join(files, ", ")
+	return fmt.Sprintf(
+		"Bump %s to `%s`\n\nBump resource %s to version:\n%s\n",
+		path,
+		change.update.getShortVersion(),
+		path,
+		change.update.getVersion())
+}
+
+// Writes the result to the result file as JSON, if set
+func (opts gitopsOptions) writeResult(result gitopsResult) error {
+	if opts.resultFile == "" {
+		return nil
+	}
+	resultBytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(opts.resultFile, append(resultBytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing result file: %s", err)
+	}
+	return nil
+}
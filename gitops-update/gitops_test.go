@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/spf13/pflag"
+)
+
+// Creates a bare manifests repo with a main branch and the kustomization of
+// the app in a temp dir. Returns the path of the bare repo
+func newTestOrigin(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath(gitrepo.DEFAULT_GIT_PATH); err != nil {
+		t.Skip("git is not installed")
+	}
+	origin := t.TempDir()
+	gitTest(t, origin, "init", "--quiet", "--bare", "--initial-branch=main")
+
+	seed := t.TempDir()
+	gitTest(t, seed, "clone", "--quiet", "--", origin, ".")
+	gitTest(t, seed, "config", "user.name", "test")
+	gitTest(t, seed, "config", "user.email", "test@example.com")
+	gitTest(t, seed, "config", "commit.gpgsign", "false")
+	writeTestFile(t, seed, "app/kustomization.yaml", "images:\n  - name: ghcr.io/org/app\n    newTag: v1.0.0\n")
+	gitTest(t, seed, "add", "--all")
+	gitTest(t, seed, "commit", "--quiet", "--message", "Add the app")
+	gitTest(t, seed, "push", "--quiet", "origin", "HEAD:refs/heads/main")
+	return origin
+}
+
+// Runs the git command in the path, and returns the trimmed stdout
+func gitTest(t *testing.T, path string, args ...string) string {
+	t.Helper()
+	git := gitrepo.Runner{GitPath: gitrepo.DEFAULT_GIT_PATH, ClonePath: path}
+	output, err := git.Run(context.Background(), args...)
+	if err != nil {
+		t.Fatalf("git %s failed: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(output)
+}
+
+// Returns the gitops options of the args
+func getTestGitopsOptions(t *testing.T, args ...string) (gitopsOptions, error) {
+	t.Helper()
+	flags := pflag.NewFlagSet("gitops-update", pflag.ContinueOnError)
+	configureGitopsFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return getGitopsOptions(flags)
+}
+
+func TestGetGitopsOptions(t *testing.T) {
+	repo := []string{"--repo", "git@github.com:org/manifests.git"}
+	kustomize := []string{"--type", "kustomize", "--file", "app", "--image-name", "ghcr.io/org/app", "--image-tag", "v1.2.3"}
+	tests := []struct {
+		name         string
+		args         []string
+		wantPrBranch string
+		wantPrRepo   string
+		wantErr      string
+	}{
+		{name: "kustomize", args: kustomize},
+		{
+			name:    "unknown type",
+			args:    []string{"--type", "jsonnet", "--file", "app", "--image-tag", "v1"},
+			wantErr: "type must be one of [kustomize helm yaml]: jsonnet",
+		},
+		{name: "no file", args: []string{"--type", "helm", "--image-tag", "v1"}, wantErr: "file must be set"},
+		{
+			name:    "file out of the repo",
+			args:    []string{"--type", "helm", "--file", "../values.yaml", "--image-tag", "v1"},
+			wantErr: "file must be a relative path in the manifests repo: ../values.yaml",
+		},
+		{
+			name:    "no version",
+			args:    []string{"--type", "helm", "--file", "values.yaml"},
+			wantErr: "image-tag or image-digest must be set",
+		},
+		{
+			name:    "invalid digest",
+			args:    []string{"--type", "helm", "--file", "values.yaml", "--image-digest", "sha256:abc"},
+			wantErr: "image-digest must be a digest (e.g. sha256:...): sha256:abc",
+		},
+		{
+			name:    "kustomize without the image name",
+			args:    []string{"--type", "kustomize", "--file", "app", "--image-tag", "v1"},
+			wantErr: "image-name must be set for the kustomize updates",
+		},
+		{
+			name:    "helm without the tag key",
+			args:    []string{"--type", "helm", "--file", "values.yaml", "--image-tag", "v1", "--helm-tag-key", ""},
+			wantErr: "helm-tag-key must be set with image-tag",
+		},
+		{
+			name:    "yaml without the json path",
+			args:    []string{"--type", "yaml", "--file", "deployment.yaml", "--image-tag", "v1"},
+			wantErr: "json-path must be set for the yaml updates",
+		},
+		{
+			name:    "invalid json path",
+			args:    []string{"--type", "yaml", "--file", "deployment.yaml", "--image-tag", "v1", "--json-path", "{.spec[}"},
+			wantErr: "invalid JSONPath {.spec[}",
+		},
+		{
+			name: "yaml digest without the digest",
+			args: []string{
+				"--type", "yaml", "--file", "deployment.yaml", "--image-tag", "v1",
+				"--json-path", "{.spec.image}", "--value-format", "digest",
+			},
+			wantErr: "image-digest must be set for the digest value format",
+		},
+		{
+			name:         "pr",
+			args:         append([]string{"--pr", "--token-file", "token"}, kustomize...),
+			wantPrBranch: "gitops-update/app-v1.2.3",
+			wantPrRepo:   "org/manifests",
+		},
+		{
+			name:    "pr without a token",
+			args:    append([]string{"--pr"}, kustomize...),
+			wantErr: "api-token-file or token-file must be set with pr",
+		},
+		{
+			name:    "pr of a repo that is not on GitHub",
+			args:    append([]string{"--pr", "--token-file", "token", "--repo", "/srv/manifests"}, kustomize...),
+			wantErr: "github-repo must be set, since the GitHub repo is not in the repo url: /srv/manifests",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := getTestGitopsOptions(t, append(repo, tt.args...)...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("getGitopsOptions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getGitopsOptions() error = %v", err)
+			}
+			if opts.pr.branch != tt.wantPrBranch || opts.pr.githubRepo != tt.wantPrRepo {
+				t.Errorf(
+					"got PR branch %q and repo %q, want %q and %q",
+					opts.pr.branch,
+					opts.pr.githubRepo,
+					tt.wantPrBranch,
+					tt.wantPrRepo)
+			}
+		})
+	}
+}
+
+func TestUpdateManifests(t *testing.T) {
+	origin := newTestOrigin(t)
+	resultFile := filepath.Join(t.TempDir(), "result.json")
+	opts, err := getTestGitopsOptions(
+		t,
+		"--repo", origin,
+		"--type", "kustomize",
+		"--file", "app",
+		"--image-name", "ghcr.io/org/app",
+		"--image-tag", "v1.2.3",
+		"--result-file", resultFile,
+	)
+	if err != nil {
+		t.Fatalf("getGitopsOptions() error = %v", err)
+	}
+
+	result, err := opts.updateManifests(context.Background())
+	if err != nil {
+		t.Fatalf("updateManifests() error = %v", err)
+	}
+	originCommit := gitTest(t, origin, "rev-parse", "main")
+	want := gitopsResult{
+		Changed: true,
+		Files:   []string{"app/kustomization.yaml"},
+		Commit:  originCommit,
+		Branch:  "main",
+		Pushed:  true,
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("updateManifests() = %+v, want %+v", result, want)
+	}
+	message := gitTest(t, origin, "log", "-1", "--format=%an %s", "main")
+	if message != "gitops-update Bump app/kustomization.yaml to `v1.2.3`" {
+		t.Errorf("got commit %q, want the default author and commit message", message)
+	}
+
+	err = opts.writeResult(result)
+	if err != nil {
+		t.Fatalf("writeResult() error = %v", err)
+	}
+	content, err := os.ReadFile(resultFile)
+	if err != nil {
+		t.Fatalf("error reading result file: %s", err)
+	}
+	var got gitopsResult
+	err = json.Unmarshal(content, &got)
+	if err != nil {
+		t.Fatalf("error unmarshalling result file: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got result file %+v, want %+v", got, want)
+	}
+
+	// The image is already at the version, so nothing is committed
+	result, err = opts.updateManifests(context.Background())
+	if err != nil {
+		t.Fatalf("updateManifests() error = %v", err)
+	}
+	if result.Changed || result.Pushed || result.Commit != "" || len(result.Files) != 0 {
+		t.Errorf("updateManifests() again = %+v, want no change", result)
+	}
+	if commit := gitTest(t, origin, "rev-parse", "main"); commit != originCommit {
+		t.Errorf("got origin main %s, want %s", commit, originCommit)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Matches a filter of a JSONPath segment (e.g. ?(@.name=="app")), with the
+// keys of the item and the compared string
+var jsonPathFilterRegexp = regexp.MustCompile(`^\?\(\s*@((?:\.[A-Za-z0-9_-]+)+)\s*==\s*(?:"([^"]*)"|'([^']*)')\s*\)$`)
+
+// A segment of a JSONPath, which selects the children of the matched nodes
+type jsonPathSegment struct {
+	// The key of a mapping, or empty for the other selectors
+	key string
+	// The index of a sequence item, or -1
+	index int
+	// Whether all of the children are selected (e.g. [*])
+	wildcard bool
+	// The filter of the sequence items (e.g. [?(@.name=="app")])
+	filterKeys  []string
+	filterValue string
+}
+
+// Parses a JSONPath with the subset of the syntax that selects the fields of
+// a manifest: the keys (.key or ['key']), the indexes ([0]), the wildcards
+// ([*] or .*), and the equality filters ([?(@.name=="app")])
+// See https://kubernetes.io/docs/reference/kubectl/jsonpath
+func parseJsonPath(path string) ([]jsonPathSegment, error) {
+	rest := strings.TrimSpace(path)
+	// The kubectl templates wrap the path in braces (e.g. {.spec.image})
+	if strings.HasPrefix(rest, "{") && strings.HasSuffix(rest, "}") {
+		rest = rest[1 : len(rest)-1]
+	}
+	rest = strings.TrimPrefix(rest, "$")
+
+	segments := []jsonPathSegment{}
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			key := rest[:end]
+			rest = rest[end:]
+			if key == "" {
+				return nil, fmt.Errorf("invalid JSONPath %s: empty key", path)
+			}
+			if key == "*" {
+				segments = append(segments, jsonPathSegment{index: -1, wildcard: true})
+			} else {
+				segments = append(segments, jsonPathSegment{key: key, index: -1})
+			}
+		case strings.HasPrefix(rest, "["):
+			end := findBracketEnd(rest)
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %s: unclosed [", path)
+			}
+			segment, err := parseJsonPathBracket(strings.TrimSpace(rest[1:end]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSONPath %s: %s", path, err)
+			}
+			segments = append(segments, segment)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSONPath %s: unexpected %s", path, rest)
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("invalid JSONPath %s: no fields selected", path)
+	}
+	return segments, nil
+}
+
+// Returns the index of the ] that closes the [ at the start, skipping the
+// quoted strings
+func findBracketEnd(text string) int {
+	var quote rune
+	for i, ch := range text {
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+func parseJsonPathBracket(selector string) (jsonPathSegment, error) {
+	switch {
+	case selector == "*":
+		return jsonPathSegment{index: -1, wildcard: true}, nil
+	case len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]:
+		return jsonPathSegment{key: selector[1 : len(selector)-1], index: -1}, nil
+	case strings.HasPrefix(selector, "?"):
+		match := jsonPathFilterRegexp.FindStringSubmatch(selector)
+		if match == nil {
+			return jsonPathSegment{}, fmt.Errorf("unsupported filter %s", selector)
+		}
+		return jsonPathSegment{
+			index:       -1,
+			filterKeys:  strings.Split(strings.TrimPrefix(match[1], "."), "."),
+			filterValue: match[2] + match[3],
+		}, nil
+	}
+	index, err := strconv.Atoi(selector)
+	if err != nil || index < 0 {
+		return jsonPathSegment{}, fmt.Errorf("unsupported selector %s", selector)
+	}
+	return jsonPathSegment{index: index}, nil
+}
+
+// Returns the nodes that the JSONPath selects in the document
+func selectJsonPath(root *yaml.Node, segments []jsonPathSegment) []*yaml.Node {
+	nodes := []*yaml.Node{root}
+	for _, segment := range segments {
+		selected := []*yaml.Node{}
+		for _, node := range nodes {
+			selected = append(selected, segment.selectChildren(node)...)
+		}
+		nodes = selected
+	}
+	return nodes
+}
+
+func (s jsonPathSegment) selectChildren(node *yaml.Node) []*yaml.Node {
+	switch {
+	case s.key != "":
+		if child := getMappingValue(node, s.key); child != nil {
+			return []*yaml.Node{child}
+		}
+	case s.wildcard:
+		if node.Kind == yaml.SequenceNode {
+			return node.Content
+		}
+		if node.Kind == yaml.MappingNode {
+			children := []*yaml.Node{}
+			for i := 1; i < len(node.Content); i += 2 {
+				children = append(children, node.Content[i])
+			}
+			return children
+		}
+	case s.filterKeys != nil:
+		if node.Kind != yaml.SequenceNode {
+			return nil
+		}
+		children := []*yaml.Node{}
+		for _, item := range node.Content {
+			value := item
+			for _, key := range s.filterKeys {
+				value = getMappingValue(value, key)
+				if value == nil {
+					break
+				}
+			}
+			if value != nil && value.Kind == yaml.ScalarNode && value.Value == s.filterValue {
+				children = append(children, item)
+			}
+		}
+		return children
+	case s.index >= 0:
+		if node.Kind == yaml.SequenceNode && s.index < len(node.Content) {
+			return []*yaml.Node{node.Content[s.index]}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "gitops-update"
+
+var mainCmd = &cobra.Command{
+	Use:   "gitops-update",
+	Short: "Update the image of an application in a manifests repo",
+	Long: `Updates the image of an application in a manifests repo.
+The branch is cloned, the image tag or digest is set in the kustomization, the
+Helm values, or the yaml fields of a JSONPath, and the change is committed and
+pushed, so Argo CD syncs the new version. The comments and the formatting of
+the files are kept. An image that is already at the version is a no-op`,
+	PersistentPreRunE: loadFlagValues,
+	RunE:              handleMainCmd,
+}
+
+func configureCmds() {
+	configureGitopsFlags(mainCmd.Flags())
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the git args")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+}
+
+func configureGitopsFlags(flags *pflag.FlagSet) {
+	flags.String(
+		"repo",
+		"",
+		"The manifests repo clone url (e.g. https://github.com/org/manifests.git or git@github.com:org/manifests.git)")
+	cobra.MarkFlagRequired(flags, "repo")
+
+	flags.String("branch", gitrepo.DEFAULT_BRANCH, "The branch of the manifests repo to update")
+
+	flags.String("clone-path", "", "The path to clone the repo to. Must be empty or not exist. Defaults to a temp dir")
+
+	configureUpdateFlags(flags)
+
+	flags.String(
+		"commit-message",
+		"",
+		"The commit message. Defaults to \"Bump <file> to `<version>`\", with the full version in the body")
+
+	flags.String("author-name", DEFAULT_AUTHOR_NAME, "The name of the commit author and committer")
+
+	flags.String("author-email", DEFAULT_AUTHOR_EMAIL, "The email of the commit author and committer")
+
+	flags.Bool("push", true, "Whether to push the commit. Set to false for a dry run")
+
+	flags.Int(
+		"push-attempts",
+		gitrepo.DEFAULT_PUSH_ATTEMPTS,
+		"The number of push attempts. A rejected push applies the update again on the branch tip")
+
+	configurePrFlags(flags)
+
+	flags.String(
+		"result-file",
+		"",
+		"The path to write the result to as JSON, with the changed files, the commit, and the PR")
+
+	flags.String("git-path", gitrepo.DEFAULT_GIT_PATH, "The path to the git executable")
+
+	gitrepo.ConfigureAuthFlags(flags)
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	gitopsOpts, err := getGitopsOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("GitOps update with params", gitopsOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	result, err := gitopsOpts.updateManifests(cmd.Context())
+	if err != nil {
+		return err
+	}
+	return gitopsOpts.writeResult(result)
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default url of the GitHub API. GitHub Enterprise Server has the
+	// API under /api/v3 of its host
+	DEFAULT_API_URL = "https://api.github.com"
+	// The GitHub API version of the requests
+	// See https://docs.github.com/en/rest/about-the-rest-api/api-versions
+	API_VERSION = "2022-11-28"
+	// The timeout of each request to the GitHub API
+	API_REQUEST_TIMEOUT = 30 * time.Second
+	// The prefix of the default PR branch
+	DEFAULT_PR_BRANCH_PREFIX = "gitops-update/"
+)
+
+var (
+	// The client for the requests to the GitHub API
+	apiHttpClient = &http.Client{Timeout: API_REQUEST_TIMEOUT}
+
+	// Matches the owner and name of a GitHub repo in an https or ssh clone
+	// url (e.g. https://github.com/org/repo.git or git@github.com:org/repo.git)
+	githubRepoRegexp = regexp.MustCompile(`^(?:[a-z+]+://)?(?:[^@/]+@)?[^/:]+(?::[0-9]+)?[/:]([^/]+/[^/]+?)(?:\.git)?/?$`)
+
+	// Matches the characters that are replaced in the default PR branch
+	prBranchReplaceRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// The options for opening a PR with the update, instead of pushing to the
+// branch
+type prOptions struct {
+	enabled bool
+	// The owner and name of the GitHub repo (e.g. org/manifests)
+	githubRepo string
+	// The branch that the commit is pushed to, which is overwritten by each
+	// update of the same image
+	branch string
+	title  string
+	body   string
+	draft  bool
+	apiUrl string
+	// The file with the token for the GitHub API, which defaults to the
+	// token of the git auth
+	tokenFile string
+}
+
+// The fields of a pull request
+// See https://docs.github.com/en/rest/pulls/pulls#create-a-pull-request
+type pullRequest struct {
+	Number  int    `json:"number"`
+	HtmlUrl string `json:"html_url"`
+}
+
+func configurePrFlags(flags *pflag.FlagSet) {
+	flags.Bool(
+		"pr",
+		false,
+		"Whether to push the commit to the PR branch and open a PR to the branch, instead of pushing to the branch. "+
+			"An open PR of the PR branch is reused")
+
+	flags.String(
+		"github-repo",
+		"",
+		"The owner and name of the GitHub repo for the PR (e.g. org/manifests). Defaults to the owner and name in repo")
+
+	flags.String(
+		"pr-branch",
+		"",
+		"The branch of the PR, which is force pushed. Defaults to "+DEFAULT_PR_BRANCH_PREFIX+"<image>-<version>")
+
+	flags.String("pr-title", "", "The title of the PR. Defaults to the subject of the commit message")
+
+	flags.String("pr-body", "", "The body of the PR. Defaults to the body of the commit message")
+
+	flags.Bool("pr-draft", false, "Whether to open the PR as a draft")
+
+	flags.String(
+		"api-token-file",
+		"",
+		"The path to the file with the token for the GitHub API, for the ssh repo urls. Defaults to token-file")
+
+	flags.String("api-url", DEFAULT_API_URL, "The url of the GitHub API (e.g. https://github.example.com/api/v3)")
+}
+
+func getPrOptions(flags *pflag.FlagSet, repo string, update updateOptions) (prOptions, error) {
+	var opts prOptions
+	var err error
+
+	opts.enabled, err = flags.GetBool("pr")
+	if err != nil {
+		return opts, fmt.Errorf("error processing pr flag")
+	}
+
+	opts.githubRepo, err = flags.GetString("github-repo")
+	if err != nil {
+		return opts, fmt.Errorf("error processing github-repo flag")
+	}
+
+	opts.branch, err = flags.GetString("pr-branch")
+	if err != nil {
+		return opts, fmt.Errorf("error processing pr-branch flag")
+	}
+
+	opts.title, err = flags.GetString("pr-title")
+	if err != nil {
+		return opts, fmt.Errorf("error processing pr-title flag")
+	}
+
+	opts.body, err = flags.GetString("pr-body")
+	if err != nil {
+		return opts, fmt.Errorf("error processing pr-body flag")
+	}
+
+	opts.draft, err = flags.GetBool("pr-draft")
+	if err != nil {
+		return opts, fmt.Errorf("error processing pr-draft flag")
+	}
+
+	opts.apiUrl, err = flags.GetString("api-url")
+	if err != nil {
+		return opts, fmt.Errorf("error processing api-url flag")
+	}
+	opts.apiUrl = strings.TrimSuffix(opts.apiUrl, "/")
+
+	opts.tokenFile, err = flags.GetString("api-token-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing api-token-file flag")
+	}
+	if opts.tokenFile == "" {
+		opts.tokenFile, err = flags.GetString("token-file")
+		if err != nil {
+			return opts, fmt.Errorf("error processing token-file flag")
+		}
+	}
+
+	if !opts.enabled {
+		return opts, nil
+	}
+	if opts.tokenFile == "" {
+		return opts, fmt.Errorf("api-token-file or token-file must be set with pr")
+	}
+	if opts.githubRepo == "" {
+		match := githubRepoRegexp.FindStringSubmatch(repo)
+		if match == nil {
+			return opts, fmt.Errorf("github-repo must be set, since the GitHub repo is not in the repo url: %s", repo)
+		}
+		opts.githubRepo = match[1]
+	}
+	if opts.branch == "" {
+		opts.branch = getDefaultPrBranch(update)
+	}
+	return opts, nil
+}
+
+func (opts prOptions) logAttrs() []any {
+	return []any{
+		"pr", opts.enabled,
+		"githubRepo", opts.githubRepo,
+		"prBranch", opts.branch,
+		"prTitle", opts.title,
+		"prDraft", opts.draft,
+		"apiUrl", opts.apiUrl,
+		"apiTokenFile", opts.tokenFile,
+	}
+}
+
+// Returns the default PR branch, which is the same for each update of the
+// image to the version, so a rerun updates the open PR
+func getDefaultPrBranch(update updateOptions) string {
+	name := path.Base(update.imageName)
+	if update.imageName == "" {
+		name = strings.TrimSuffix(update.files[0], path.Ext(update.files[0]))
+	}
+	name = prBranchReplaceRegexp.ReplaceAllString(name, "-")
+	version := prBranchReplaceRegexp.ReplaceAllString(update.getShortVersion(), "-")
+	return DEFAULT_PR_BRANCH_PREFIX + strings.Trim(name, "-.") + "-" + strings.Trim(version, "-.")
+}
+
+// Force pushes the commit to the PR branch, and opens a PR to the base
+// branch. The open PR of the PR branch is reused, since the push updates it
+func (opts prOptions) pushPullRequest(
+	ctx context.Context,
+	git gitrepo.Runner,
+	base string,
+	commitMessage string,
+	result gitopsResult,
+) (gitopsResult, error) {
+	result.Branch = opts.branch
+	slog.Info("Pushing the commit to the PR branch", "prBranch", opts.branch, "commit", result.Commit)
+	_, err := git.Run(ctx, "push", "--quiet", "--force", "origin", "HEAD:refs/heads/"+opts.branch)
+	if err != nil {
+		return result, err
+	}
+	result.Pushed = true
+
+	tokenBytes, err := os.ReadFile(opts.tokenFile)
+	if err != nil {
+		return result, fmt.Errorf("error reading token file: %s", err)
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+
+	title, body, _ := strings.Cut(strings.TrimSpace(commitMessage), "\n")
+	if opts.title != "" {
+		title = opts.title
+	}
+	body = strings.TrimSpace(body)
+	if opts.body != "" {
+		body = opts.body
+	}
+
+	pr, err := opts.createPullRequest(ctx, token, base, title, body)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.statusCode == http.StatusUnprocessableEntity {
+		// The PR of the branch is already open, which the push updated
+		slog.Info("Finding the open PR of the PR branch", "prBranch", opts.branch, "error", err)
+		pr, err = opts.findPullRequest(ctx, token, base)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.PrNumber = pr.Number
+	result.PrUrl = pr.HtmlUrl
+	slog.Info("Opened the PR", "prNumber", pr.Number, "prUrl", pr.HtmlUrl)
+	return result, nil
+}
+
+// Creates the PR of the PR branch to the base branch
+// See https://docs.github.com/en/rest/pulls/pulls#create-a-pull-request
+func (opts prOptions) createPullRequest(
+	ctx context.Context,
+	token string,
+	base string,
+	title string,
+	body string,
+) (pullRequest, error) {
+	var pr pullRequest
+	requestBody, err := json.Marshal(map[string]any{
+		"title": title,
+		"body":  body,
+		"head":  opts.branch,
+		"base":  base,
+		"draft": opts.draft,
+	})
+	if err != nil {
+		return pr, err
+	}
+	requestUrl := fmt.Sprintf("%s/repos/%s/pulls", opts.apiUrl, opts.githubRepo)
+	respBody, err := doApiRequest(ctx, http.MethodPost, requestUrl, token, requestBody)
+	if err != nil {
+		return pr, err
+	}
+	err = json.Unmarshal(respBody, &pr)
+	if err != nil {
+		return pr, fmt.Errorf("error parsing the created PR: %s", err)
+	}
+	return pr, nil
+}
+
+// Returns the open PR of the PR branch to the base branch
+// See https://docs.github.com/en/rest/pulls/pulls#list-pull-requests
+func (opts prOptions) findPullRequest(ctx context.Context, token string, base string) (pullRequest, error) {
+	owner, _, _ := strings.Cut(opts.githubRepo, "/")
+	query := url.Values{
+		"head":  {owner + ":" + opts.branch},
+		"base":  {base},
+		"state": {"open"},
+	}
+	requestUrl := fmt.Sprintf("%s/repos/%s/pulls?%s", opts.apiUrl, opts.githubRepo, query.Encode())
+	respBody, err := doApiRequest(ctx, http.MethodGet, requestUrl, token, nil)
+	if err != nil {
+		return pullRequest{}, err
+	}
+	var prs []pullRequest
+	err = json.Unmarshal(respBody, &prs)
+	if err != nil {
+		return pullRequest{}, fmt.Errorf("error parsing the PRs: %s", err)
+	}
+	if len(prs) == 0 {
+		return pullRequest{}, fmt.Errorf("the PR could not be created, and no PR of %s is open", opts.branch)
+	}
+	return prs[0], nil
+}
+
+// Sends the request to the GitHub API with the JSON body, if any, and
+// returns the response body. A response that is not 2xx is an error
+func doApiRequest(ctx context.Context, method string, requestUrl string, token string, body []byte) ([]byte, error) {
+	slog.Debug("Sending GitHub API request", "method", method, "url", requestUrl)
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("X-GitHub-Api-Version", API_VERSION)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := apiHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &apiError{
+			url:        req.URL.Redacted(),
+			statusCode: resp.StatusCode,
+			status:     resp.Status,
+			body:       strings.TrimSpace(string(respBody)),
+		}
+	}
+	return respBody, nil
+}
+
+// A response of the GitHub API that is not 2xx
+type apiError struct {
+	url        string
+	statusCode int
+	status     string
+	body       string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s returned %s: %s", e.url, e.status, e.body)
+}
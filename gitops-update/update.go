@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Updates the images field of a kustomization
+	KUSTOMIZE_UPDATE = "kustomize"
+	// Updates the image keys of a Helm values file
+	HELM_UPDATE = "helm"
+	// Updates the fields of a yaml file selected with a JSONPath
+	YAML_UPDATE = "yaml"
+
+	// The image reference (e.g. ghcr.io/org/app:v1.2.3@sha256:...)
+	IMAGE_VALUE_FORMAT = "image"
+	// The image tag (e.g. v1.2.3)
+	TAG_VALUE_FORMAT = "tag"
+	// The image digest (e.g. sha256:...)
+	DIGEST_VALUE_FORMAT = "digest"
+
+	// The default keys of the image tag and digest in the Helm values,
+	// which most charts use
+	DEFAULT_HELM_TAG_KEY    = "image.tag"
+	DEFAULT_HELM_DIGEST_KEY = "image.digest"
+)
+
+var (
+	updateTypes  = []string{KUSTOMIZE_UPDATE, HELM_UPDATE, YAML_UPDATE}
+	valueFormats = []string{IMAGE_VALUE_FORMAT, TAG_VALUE_FORMAT, DIGEST_VALUE_FORMAT}
+
+	// The file names of a kustomization in a dir, in the order kustomize
+	// reads them
+	kustomizationFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+	// Matches an image digest (e.g. sha256:2c26b46b...)
+	digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+	// Matches a git commit sha, which is a common image tag
+	commitShaRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// The options for updating the image of an application in the manifests
+type updateOptions struct {
+	updateType string
+	// The paths of the files to update, relative to the clone. A dir is the
+	// kustomization in it for the kustomize updates
+	files []string
+	// The name of the image. For the kustomize updates, it is the name that
+	// the images field matches (e.g. ghcr.io/org/app)
+	imageName   string
+	imageTag    string
+	imageDigest string
+	// The dot separated keys of the tag and digest in the Helm values
+	helmTagKey    string
+	helmDigestKey string
+	// The JSONPaths of the fields to set in the yaml files, with the value
+	// format
+	jsonPaths   []string
+	valueFormat string
+}
+
+func configureUpdateFlags(flags *pflag.FlagSet) {
+	flags.String("type", "", fmt.Sprintf("The type of the manifests to update. One of %s", updateTypes))
+
+	flags.StringArray(
+		"file",
+		nil,
+		"The path of a file to update, relative to the manifests repo. For kustomize, a dir is the kustomization in "+
+			"it. Can be repeated")
+
+	flags.String(
+		"image-name",
+		"",
+		"The name of the image (e.g. ghcr.io/org/app). For kustomize, the name that the images field matches")
+
+	flags.String("image-tag", "", "The new tag of the image (e.g. v1.2.3)")
+
+	flags.String("image-digest", "", "The new digest of the image (e.g. sha256:...)")
+
+	flags.String("helm-tag-key", DEFAULT_HELM_TAG_KEY, "The dot separated keys of the image tag in the Helm values")
+
+	flags.String(
+		"helm-digest-key",
+		DEFAULT_HELM_DIGEST_KEY,
+		"The dot separated keys of the image digest in the Helm values, which is set with image-digest")
+
+	flags.StringArray(
+		"json-path",
+		nil,
+		"The JSONPath of a field to set in the yaml files (e.g. "+
+			`{.spec.template.spec.containers[?(@.name=="app")].image}). Can be repeated`)
+
+	flags.String(
+		"value-format",
+		IMAGE_VALUE_FORMAT,
+		fmt.Sprintf("The value to set at the JSONPaths. One of %s", valueFormats))
+}
+
+func getUpdateOptions(flags *pflag.FlagSet) (updateOptions, error) {
+	var opts updateOptions
+	var err error
+
+	opts.updateType, err = flags.GetString("type")
+	if err != nil {
+		return opts, fmt.Errorf("error processing type flag")
+	}
+	if !slices.Contains(updateTypes, opts.updateType) {
+		return opts, fmt.Errorf("type must be one of %s: %s", updateTypes, opts.updateType)
+	}
+
+	opts.files, err = flags.GetStringArray("file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing file flag")
+	}
+	if len(opts.files) == 0 {
+		return opts, fmt.Errorf("file must be set")
+	}
+	for _, file := range opts.files {
+		if !filepath.IsLocal(file) {
+			return opts, fmt.Errorf("file must be a relative path in the manifests repo: %s", file)
+		}
+	}
+
+	opts.imageName, err = flags.GetString("image-name")
+	if err != nil {
+		return opts, fmt.Errorf("error processing image-name flag")
+	}
+
+	opts.imageTag, err = flags.GetString("image-tag")
+	if err != nil {
+		return opts, fmt.Errorf("error processing image-tag flag")
+	}
+
+	opts.imageDigest, err = flags.GetString("image-digest")
+	if err != nil {
+		return opts, fmt.Errorf("error processing image-digest flag")
+	}
+	if opts.imageTag == "" && opts.imageDigest == "" {
+		return opts, fmt.Errorf("image-tag or image-digest must be set")
+	}
+	if opts.imageDigest != "" && !digestRegexp.MatchString(opts.imageDigest) {
+		return opts, fmt.Errorf("image-digest must be a digest (e.g. sha256:...): %s", opts.imageDigest)
+	}
+
+	opts.helmTagKey, err = flags.GetString("helm-tag-key")
+	if err != nil {
+		return opts, fmt.Errorf("error processing helm-tag-key flag")
+	}
+
+	opts.helmDigestKey, err = flags.GetString("helm-digest-key")
+	if err != nil {
+		return opts, fmt.Errorf("error processing helm-digest-key flag")
+	}
+
+	opts.jsonPaths, err = flags.GetStringArray("json-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing json-path flag")
+	}
+	for _, jsonPath := range opts.jsonPaths {
+		_, err = parseJsonPath(jsonPath)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	opts.valueFormat, err = flags.GetString("value-format")
+	if err != nil {
+		return opts, fmt.Errorf("error processing value-format flag")
+	}
+	if !slices.Contains(valueFormats, opts.valueFormat) {
+		return opts, fmt.Errorf("value-format must be one of %s: %s", valueFormats, opts.valueFormat)
+	}
+
+	switch opts.updateType {
+	case KUSTOMIZE_UPDATE:
+		if opts.imageName == "" {
+			return opts, fmt.Errorf("image-name must be set for the kustomize updates")
+		}
+	case HELM_UPDATE:
+		if opts.imageTag != "" && opts.helmTagKey == "" {
+			return opts, fmt.Errorf("helm-tag-key must be set with image-tag")
+		}
+		if opts.imageDigest != "" && opts.helmDigestKey == "" {
+			return opts, fmt.Errorf("helm-digest-key must be set with image-digest")
+		}
+	case YAML_UPDATE:
+		if len(opts.jsonPaths) == 0 {
+			return opts, fmt.Errorf("json-path must be set for the yaml updates")
+		}
+		_, err = opts.getFormattedValue()
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+func (opts updateOptions) logAttrs() []any {
+	return []any{
+		"type", opts.updateType,
+		"files", opts.files,
+		"imageName", opts.imageName,
+		"imageTag", opts.imageTag,
+		"imageDigest", opts.imageDigest,
+		"helmTagKey", opts.helmTagKey,
+		"helmDigestKey", opts.helmDigestKey,
+		"jsonPaths", opts.jsonPaths,
+		"valueFormat", opts.valueFormat,
+	}
+}
+
+// Returns the image reference with the tag and the digest
+func (opts updateOptions) getImageReference() string {
+	image := opts.imageName
+	if opts.imageTag != "" {
+		image += ":" + opts.imageTag
+	}
+	if opts.imageDigest != "" {
+		image += "@" + opts.imageDigest
+	}
+	return image
+}
+
+// Returns the version of the image, which is the tag and the digest
+func (opts updateOptions) getVersion() string {
+	switch {
+	case opts.imageTag == "":
+		return opts.imageDigest
+	case opts.imageDigest == "":
+		return opts.imageTag
+	}
+	return opts.imageTag + "@" + opts.imageDigest
+}
+
+// Returns the value to set at the JSONPaths of the yaml updates
+func (opts updateOptions) getFormattedValue() (string, error) {
+	switch opts.valueFormat {
+	case TAG_VALUE_FORMAT:
+		if opts.imageTag == "" {
+			return "", fmt.Errorf("image-tag must be set for the tag value format")
+		}
+		return opts.imageTag, nil
+	case DIGEST_VALUE_FORMAT:
+		if opts.imageDigest == "" {
+			return "", fmt.Errorf("image-digest must be set for the digest value format")
+		}
+		return opts.imageDigest, nil
+	}
+	if opts.imageName == "" {
+		return "", fmt.Errorf("image-name must be set for the image value format")
+	}
+	return opts.getImageReference(), nil
+}
+
+// Returns the short version of the image for the commit message, as in the
+// argocd step
+func (opts updateOptions) getShortVersion() string {
+	switch {
+	case opts.imageTag == "":
+		_, hash, _ := strings.Cut(opts.imageDigest, ":")
+		return hash[:min(len(hash), 12)]
+	case commitShaRegexp.MatchString(opts.imageTag):
+		return opts.imageTag[:8]
+	}
+	return opts.imageTag
+}
+
+// Updates the files in the clone, and returns the paths of the changed
+// files. An image that is already at the version changes nothing
+func (opts updateOptions) updateFiles(clonePath string) ([]string, error) {
+	changedFiles := []string{}
+	for _, file := range opts.files {
+		path := filepath.Join(clonePath, file)
+		if opts.updateType == KUSTOMIZE_UPDATE {
+			var err error
+			path, err = getKustomizationPath(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		yamlFile, err := readYamlFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opts.updateType {
+		case KUSTOMIZE_UPDATE:
+			err = opts.updateKustomization(yamlFile)
+		case HELM_UPDATE:
+			err = opts.updateHelmValues(yamlFile)
+		case YAML_UPDATE:
+			err = opts.updateJsonPaths(yamlFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		relativePath, _ := filepath.Rel(clonePath, path)
+		if !yamlFile.changed() {
+			slog.Info("The file is already up to date", "file", relativePath)
+			continue
+		}
+		err = yamlFile.write()
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Updated the file", "file", relativePath)
+		changedFiles = append(changedFiles, relativePath)
+	}
+	return changedFiles, nil
+}
+
+// Sets the newTag and the digest of the image in the images field of the
+// kustomization, adding the image if it is not there
+// See https://kubectl.docs.kubernetes.io/references/kustomize/kustomization/images
+func (opts updateOptions) updateKustomization(file *yamlFile) error {
+	roots := file.rootMappings()
+	if len(roots) != 1 {
+		return fmt.Errorf("%s: a kustomization must have one mapping document", file.path)
+	}
+	root := roots[0]
+
+	paths := []pathValue{}
+	nameLine, err := formatScalarLine("name", opts.imageName)
+	if err != nil {
+		return err
+	}
+	itemLines := []string{nameLine}
+	if opts.imageTag != "" {
+		paths = append(paths, pathValue{keys: []string{"newTag"}, value: opts.imageTag})
+		tagLine, err := formatScalarLine("newTag", opts.imageTag)
+		if err != nil {
+			return err
+		}
+		itemLines = append(itemLines, tagLine)
+	}
+	if opts.imageDigest != "" {
+		paths = append(paths, pathValue{keys: []string{"digest"}, value: opts.imageDigest})
+		digestLine, err := formatScalarLine("digest", opts.imageDigest)
+		if err != nil {
+			return err
+		}
+		itemLines = append(itemLines, digestLine)
+	}
+
+	images := getMappingValue(root, "images")
+	if images == nil {
+		slog.Info("Adding the images field to the kustomization", "file", file.path)
+		return file.insertMappingKey(root, "images", strings.Split(formatSequenceItem(itemLines, 0), "\n"))
+	}
+	if images.Kind != yaml.SequenceNode {
+		return fmt.Errorf("%s:%d: images is not a sequence", file.path, images.Line)
+	}
+	for _, image := range images.Content {
+		name := getMappingValue(image, "name")
+		if name == nil || name.Value != opts.imageName {
+			continue
+		}
+		// The digest replaces the tag in kustomize, so a new tag with the
+		// previous digest would not change the image
+		if opts.imageDigest == "" && getMappingValue(image, "digest") != nil {
+			return fmt.Errorf(
+				"%s:%d: the image %s has a digest, which overrides the tag, so image-digest must be set",
+				file.path,
+				image.Line,
+				opts.imageName)
+		}
+		return file.setMappingPaths(image, paths)
+	}
+	slog.Info("Adding the image to the kustomization", "file", file.path, "imageName", opts.imageName)
+	return file.insertSequenceItem(images, itemLines)
+}
+
+// Sets the image tag and digest keys of the Helm values, adding the keys
+// that are not there
+func (opts updateOptions) updateHelmValues(file *yamlFile) error {
+	roots := file.rootMappings()
+	if len(roots) != 1 {
+		return fmt.Errorf("%s: a Helm values file must have one mapping document", file.path)
+	}
+	paths := []pathValue{}
+	if opts.imageTag != "" {
+		paths = append(paths, pathValue{keys: strings.Split(opts.helmTagKey, "."), value: opts.imageTag})
+	}
+	if opts.imageDigest != "" {
+		paths = append(paths, pathValue{keys: strings.Split(opts.helmDigestKey, "."), value: opts.imageDigest})
+	}
+	return file.setMappingPaths(roots[0], paths)
+}
+
+// Sets the fields that the JSONPaths select in each document of the yaml
+// file. Each JSONPath must select a field in the file
+func (opts updateOptions) updateJsonPaths(file *yamlFile) error {
+	value, err := opts.getFormattedValue()
+	if err != nil {
+		return err
+	}
+	for _, jsonPath := range opts.jsonPaths {
+		segments, err := parseJsonPath(jsonPath)
+		if err != nil {
+			return err
+		}
+		matches := 0
+		for _, doc := range file.docs {
+			if len(doc.Content) == 0 {
+				continue
+			}
+			for _, node := range selectJsonPath(doc.Content[0], segments) {
+				err = file.setScalar(node, value)
+				if err != nil {
+					return err
+				}
+				matches++
+			}
+		}
+		if matches == 0 {
+			return fmt.Errorf("%s: the JSONPath %s selects no field", file.path, jsonPath)
+		}
+	}
+	return nil
+}
+
+// Returns the path of the kustomization file, which is in the dir if the
+// path is a dir
+func getKustomizationPath(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %s", path, err)
+	}
+	if !info.IsDir() {
+		return path, nil
+	}
+	for _, name := range kustomizationFileNames {
+		kustomizationPath := filepath.Join(path, name)
+		if _, err := os.Stat(kustomizationPath); err == nil {
+			return kustomizationPath, nil
+		}
+	}
+	return "", fmt.Errorf("no kustomization file in %s. Expected one of %s", path, kustomizationFileNames)
+}
+
+// Returns the "key: value" line with the plain yaml text of the value,
+// which the encoder quotes if needed
+func formatScalarLine(key string, value string) (string, error) {
+	text, err := formatScalar(value, 0)
+	if err != nil {
+		return "", fmt.Errorf("error formatting the %s value %q: %s", key, value, err)
+	}
+	return key + ": " + text, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A valid image digest
+var testDigest = "sha256:" + strings.Repeat("ab", 32)
+
+// Writes the file under the dir, creating its dir
+func writeTestFile(t *testing.T, dir string, file string, content string) {
+	t.Helper()
+	path := filepath.Join(dir, file)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(content), 0644)
+	}
+	if err != nil {
+		t.Fatalf("error writing %s: %s", file, err)
+	}
+}
+
+func TestUpdateFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  updateOptions
+		file    string
+		content string
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "kustomize",
+			update: updateOptions{updateType: KUSTOMIZE_UPDATE, files: []string{"app"}, imageName: "ghcr.io/org/app", imageTag: "v1.2.3"},
+			file:   "app/kustomization.yaml",
+			content: `resources:
+  - deployment.yaml
+images:
+  # The app image
+  - name: ghcr.io/org/app
+    newTag: v1.0.0
+`,
+			want: `resources:
+  - deployment.yaml
+images:
+  # The app image
+  - name: ghcr.io/org/app
+    newTag: v1.2.3
+`,
+		},
+		{
+			name:   "kustomize without the images",
+			update: updateOptions{updateType: KUSTOMIZE_UPDATE, files: []string{"app"}, imageName: "ghcr.io/org/app", imageTag: "1.10"},
+			file:   "app/kustomization.yaml",
+			content: `resources:
+  - deployment.yaml
+`,
+			// The new key is inserted before the first key
+			want: `images:
+- name: ghcr.io/org/app
+  newTag: "1.10"
+resources:
+  - deployment.yaml
+`,
+		},
+		{
+			name:   "kustomize tag of a digest image",
+			update: updateOptions{updateType: KUSTOMIZE_UPDATE, files: []string{"kustomization.yaml"}, imageName: "app", imageTag: "v2"},
+			file:   "kustomization.yaml",
+			content: `images:
+  - name: app
+    digest: sha256:0000
+`,
+			wantErr: "the image app has a digest, which overrides the tag, so image-digest must be set",
+		},
+		{
+			name: "helm",
+			update: updateOptions{
+				updateType:    HELM_UPDATE,
+				files:         []string{"values.yaml"},
+				imageTag:      "v1.2.3",
+				imageDigest:   testDigest,
+				helmTagKey:    DEFAULT_HELM_TAG_KEY,
+				helmDigestKey: DEFAULT_HELM_DIGEST_KEY,
+			},
+			file: "values.yaml",
+			content: `replicaCount: 2
+image:
+  repository: ghcr.io/org/app
+  tag: "v1.0.0" # The release
+`,
+			want: `replicaCount: 2
+image:
+  repository: ghcr.io/org/app
+  digest: ` + testDigest + `
+  tag: "v1.2.3" # The release
+`,
+		},
+		{
+			name: "yaml",
+			update: updateOptions{
+				updateType:  YAML_UPDATE,
+				files:       []string{"deployment.yaml"},
+				imageName:   "ghcr.io/org/app",
+				imageTag:    "v1.2.3",
+				jsonPaths:   []string{`{.spec.template.spec.containers[?(@.name=="app")].image}`},
+				valueFormat: IMAGE_VALUE_FORMAT,
+			},
+			file: "deployment.yaml",
+			content: `spec:
+  template:
+    spec:
+      containers:
+        - name: sidecar
+          image: envoy:v1
+        - name: app
+          image: ghcr.io/org/app:v1.0.0
+`,
+			want: `spec:
+  template:
+    spec:
+      containers:
+        - name: sidecar
+          image: envoy:v1
+        - name: app
+          image: ghcr.io/org/app:v1.2.3
+`,
+		},
+		{
+			name: "yaml without a match",
+			update: updateOptions{
+				updateType:  YAML_UPDATE,
+				files:       []string{"deployment.yaml"},
+				imageTag:    "v1.2.3",
+				jsonPaths:   []string{"{.spec.image}"},
+				valueFormat: TAG_VALUE_FORMAT,
+			},
+			file:    "deployment.yaml",
+			content: "spec:\n  replicas: 1\n",
+			wantErr: "the JSONPath {.spec.image} selects no field",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clonePath := t.TempDir()
+			writeTestFile(t, clonePath, tt.file, tt.content)
+
+			changedFiles, err := tt.update.updateFiles(clonePath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("updateFiles() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("updateFiles() error = %v", err)
+			}
+			if !reflect.DeepEqual(changedFiles, []string{tt.file}) {
+				t.Errorf("updateFiles() = %q, want %q", changedFiles, []string{tt.file})
+			}
+			content, err := os.ReadFile(filepath.Join(clonePath, tt.file))
+			if err != nil {
+				t.Fatalf("error reading %s: %s", tt.file, err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("got %s:\n%s\nwant:\n%s", tt.file, content, tt.want)
+			}
+
+			// An image that is already at the version changes nothing
+			changedFiles, err = tt.update.updateFiles(clonePath)
+			if err != nil || len(changedFiles) != 0 {
+				t.Errorf("updateFiles() again = %q, %v, want no changed files", changedFiles, err)
+			}
+		})
+	}
+}
+
+func TestGetShortVersion(t *testing.T) {
+	tests := []struct {
+		update updateOptions
+		want   string
+	}{
+		{update: updateOptions{imageTag: "v1.2.3", imageDigest: testDigest}, want: "v1.2.3"},
+		{update: updateOptions{imageTag: "0123456789abcdef0123456789abcdef01234567"}, want: "01234567"},
+		{update: updateOptions{imageDigest: testDigest}, want: "abababababab"},
+	}
+	for _, tt := range tests {
+		if got := tt.update.getShortVersion(); got != tt.want {
+			t.Errorf("getShortVersion(%+v) = %q, want %q", tt.update, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A yaml file that is edited in place. The edits replace the text of the
+// scalars and insert lines, instead of encoding the documents again, so the
+// formatting and the comments of the file are kept and the commit diff only
+// has the changed values
+type yamlFile struct {
+	path  string
+	lines []string
+	// The documents of the file, which are separated by ---
+	docs  []*yaml.Node
+	edits []yamlEdit
+}
+
+// A text edit of a line of the yaml file
+type yamlEdit struct {
+	// The 0-based index of the line
+	line int
+	// The 0-based rune offset of the replaced text in the line, and its
+	// length in runes. An insertion replaces nothing, and its text is the
+	// new lines that are inserted before the line
+	column int
+	length int
+	text   string
+	insert bool
+}
+
+func readYamlFile(path string) (*yamlFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", path, err)
+	}
+	file := &yamlFile{path: path, lines: strings.Split(string(content), "\n")}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		doc := &yaml.Node{}
+		err := decoder.Decode(doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", path, err)
+		}
+		file.docs = append(file.docs, doc)
+	}
+	return file, nil
+}
+
+// Returns the root mapping of each document, skipping the empty documents
+func (f *yamlFile) rootMappings() []*yaml.Node {
+	mappings := []*yaml.Node{}
+	for _, doc := range f.docs {
+		if len(doc.Content) > 0 && doc.Content[0].Kind == yaml.MappingNode {
+			mappings = append(mappings, doc.Content[0])
+		}
+	}
+	return mappings
+}
+
+// Returns whether any edit changes the file
+func (f *yamlFile) changed() bool {
+	return len(f.edits) > 0
+}
+
+// Writes the edits to the file
+func (f *yamlFile) write() error {
+	lines := slices.Clone(f.lines)
+	// The edits are applied from the end, so the positions of the other
+	// edits are not shifted
+	edits := slices.Clone(f.edits)
+	slices.SortStableFunc(edits, func(a, b yamlEdit) int {
+		if a.line != b.line {
+			return b.line - a.line
+		}
+		return b.column - a.column
+	})
+	for _, edit := range edits {
+		if edit.insert {
+			lines = slices.Insert(lines, edit.line, strings.Split(edit.text, "\n")...)
+			continue
+		}
+		line := []rune(lines[edit.line])
+		lines[edit.line] = string(line[:edit.column]) + edit.text + string(line[edit.column+edit.length:])
+	}
+	err := os.WriteFile(f.path, []byte(strings.Join(lines, "\n")), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %s", f.path, err)
+	}
+	return nil
+}
+
+// Sets the value of the scalar node, keeping its quoting style. A plain
+// scalar is quoted if the value would not be read as a string (e.g. 1.10)
+func (f *yamlFile) setScalar(node *yaml.Node, value string) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("%s:%d: the value is not a scalar", f.path, node.Line)
+	}
+	if node.Value == value && node.Tag == "!!str" {
+		return nil
+	}
+	lineIndex := node.Line - 1
+	column := node.Column - 1
+	if lineIndex < 0 || lineIndex >= len(f.lines) {
+		return fmt.Errorf("%s:%d: the value is out of the file", f.path, node.Line)
+	}
+	line := []rune(f.lines[lineIndex])
+	length, err := getScalarLength(line, column, node)
+	if err != nil {
+		return fmt.Errorf("%s:%d: %s", f.path, node.Line, err)
+	}
+
+	text, err := formatScalar(value, node.Style)
+	if err != nil {
+		return err
+	}
+	f.edits = append(f.edits, yamlEdit{line: lineIndex, column: column, length: length, text: text})
+	node.Value = value
+	node.Tag = "!!str"
+	return nil
+}
+
+// A value to set at the nested keys of a mapping (e.g. image and tag)
+type pathValue struct {
+	keys  []string
+	value string
+}
+
+// Sets the values at the keys of the mapping. The missing keys are inserted
+// together, so the values that share a missing parent (e.g. image.tag and
+// image.digest) are inserted under one parent key
+func (f *yamlFile) setMappingPaths(mapping *yaml.Node, paths []pathValue) error {
+	missingPaths := []pathValue{}
+	childPaths := map[string][]pathValue{}
+	childKeys := []string{}
+	for _, path := range paths {
+		key := path.keys[0]
+		child := getMappingValue(mapping, key)
+		switch {
+		case child == nil:
+			missingPaths = append(missingPaths, path)
+		case len(path.keys) == 1:
+			err := f.setScalar(child, path.value)
+			if err != nil {
+				return err
+			}
+		case child.Kind != yaml.MappingNode:
+			return fmt.Errorf("%s:%d: %s is not a mapping", f.path, child.Line, key)
+		default:
+			if _, found := childPaths[key]; !found {
+				childKeys = append(childKeys, key)
+			}
+			childPaths[key] = append(childPaths[key], pathValue{keys: path.keys[1:], value: path.value})
+		}
+	}
+	for _, key := range childKeys {
+		err := f.setMappingPaths(getMappingValue(mapping, key), childPaths[key])
+		if err != nil {
+			return err
+		}
+	}
+	if len(missingPaths) == 0 {
+		return nil
+	}
+
+	line, indent, err := f.getInsertPosition(mapping)
+	if err != nil {
+		return err
+	}
+	text, err := formatMappingLines(missingPaths, indent)
+	if err != nil {
+		return err
+	}
+	f.edits = append(f.edits, yamlEdit{line: line, text: strings.Join(text, "\n"), insert: true})
+	return nil
+}
+
+// Returns the block mapping lines of the values at the nested keys, with
+// the indent
+func formatMappingLines(paths []pathValue, indent int) ([]string, error) {
+	lines := []string{}
+	childPaths := map[string][]pathValue{}
+	childKeys := []string{}
+	for _, path := range paths {
+		key := path.keys[0]
+		_, found := childPaths[key]
+		if !found {
+			childKeys = append(childKeys, key)
+		}
+		childPaths[key] = append(childPaths[key], pathValue{keys: path.keys[1:], value: path.value})
+	}
+	for _, key := range childKeys {
+		keyText, err := formatScalar(key, 0)
+		if err != nil {
+			return nil, err
+		}
+		prefix := strings.Repeat(" ", indent) + keyText + ":"
+		children := childPaths[key]
+		if len(children) == 1 && len(children[0].keys) == 0 {
+			valueText, err := formatScalar(children[0].value, 0)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, prefix+" "+valueText)
+			continue
+		}
+		if slices.ContainsFunc(children, func(child pathValue) bool { return len(child.keys) == 0 }) {
+			return nil, fmt.Errorf("%s is set as both a value and a mapping", key)
+		}
+		childLines, err := formatMappingLines(children, indent+2)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, prefix)
+		lines = append(lines, childLines...)
+	}
+	return lines, nil
+}
+
+// Inserts the key into the mapping, with the value lines at the indent of
+// the key (e.g. a block sequence)
+func (f *yamlFile) insertMappingKey(mapping *yaml.Node, key string, valueLines []string) error {
+	line, indent, err := f.getInsertPosition(mapping)
+	if err != nil {
+		return err
+	}
+	keyText, err := formatScalar(key, 0)
+	if err != nil {
+		return err
+	}
+	text := []string{strings.Repeat(" ", indent) + keyText + ":"}
+	for _, valueLine := range valueLines {
+		text = append(text, strings.Repeat(" ", indent)+valueLine)
+	}
+	f.edits = append(f.edits, yamlEdit{line: line, text: strings.Join(text, "\n"), insert: true})
+	return nil
+}
+
+// Adds the mapping lines as an item of the block sequence (e.g. - name: app)
+func (f *yamlFile) insertSequenceItem(sequence *yaml.Node, itemLines []string) error {
+	if sequence.Style&yaml.FlowStyle != 0 || len(sequence.Content) == 0 {
+		return fmt.Errorf("%s:%d: cannot add an item to a flow or empty sequence", f.path, sequence.Line)
+	}
+	// The item is inserted before the first item, which has an exact line,
+	// unlike the end of the last item
+	first := sequence.Content[0]
+	lineIndex := first.Line - 1
+	line := []rune(f.lines[lineIndex])
+	dashColumn := -1
+	for i := min(first.Column-1, len(line)) - 1; i >= 0; i-- {
+		if line[i] == '-' {
+			dashColumn = i
+			break
+		}
+	}
+	if dashColumn < 0 || strings.TrimSpace(string(line[:dashColumn])) != "" {
+		return fmt.Errorf("%s:%d: cannot add an item to the sequence", f.path, sequence.Line)
+	}
+	f.edits = append(f.edits, yamlEdit{line: lineIndex, text: formatSequenceItem(itemLines, dashColumn), insert: true})
+	return nil
+}
+
+// Returns the lines of a block sequence item, with the indent of the dash
+func formatSequenceItem(itemLines []string, indent int) string {
+	text := []string{}
+	for i, itemLine := range itemLines {
+		prefix := "  "
+		if i == 0 {
+			prefix = "- "
+		}
+		text = append(text, strings.Repeat(" ", indent)+prefix+itemLine)
+	}
+	return strings.Join(text, "\n")
+}
+
+// Returns the line index to insert the new keys of the mapping at, and
+// their indent. The keys are inserted after the first key if its value is
+// on the same line, since a mapping in a sequence starts with the dash (e.g.
+// - name: app), and before the first key otherwise
+func (f *yamlFile) getInsertPosition(mapping *yaml.Node) (int, int, error) {
+	if mapping.Style&yaml.FlowStyle != 0 || len(mapping.Content) == 0 {
+		return 0, 0, fmt.Errorf("%s:%d: cannot add a key to a flow or empty mapping", f.path, mapping.Line)
+	}
+	firstKey := mapping.Content[0]
+	firstValue := mapping.Content[1]
+	indent := firstKey.Column - 1
+	if firstValue.Kind == yaml.ScalarNode && firstValue.Line == firstKey.Line &&
+		firstValue.Style&(yaml.LiteralStyle|yaml.FoldedStyle) == 0 && !strings.Contains(firstValue.Value, "\n") {
+		return firstKey.Line, indent, nil
+	}
+	line := []rune(f.lines[firstKey.Line-1])
+	if strings.TrimSpace(string(line[:indent])) != "" {
+		return 0, 0, fmt.Errorf("%s:%d: cannot add a key to the mapping", f.path, mapping.Line)
+	}
+	return firstKey.Line - 1, indent, nil
+}
+
+// Returns the value of the key in the mapping, or nil if it is not set
+func getMappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Returns the yaml text of the value in the quoting style
+func formatScalar(value string, style yaml.Style) (string, error) {
+	switch {
+	case style&yaml.DoubleQuotedStyle != 0:
+		// A JSON string is a valid double quoted yaml scalar
+		quoted, err := json.Marshal(value)
+		return string(quoted), err
+	case style&yaml.SingleQuotedStyle != 0:
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'", nil
+	}
+	// The encoder quotes the values that would not be read as a string
+	encoded, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSuffix(string(encoded), "\n")
+	if strings.Contains(text, "\n") {
+		return formatScalar(value, yaml.DoubleQuotedStyle)
+	}
+	return text, nil
+}
+
+// Returns the length in runes of the scalar text that starts at the column
+// of the line
+func getScalarLength(line []rune, column int, node *yaml.Node) (int, error) {
+	if column < 0 || column >= len(line) {
+		return 0, errors.New("the value is out of the line")
+	}
+	if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		return 0, errors.New("a block scalar cannot be edited")
+	}
+	if line[column] == '!' {
+		return 0, errors.New("a tagged scalar cannot be edited")
+	}
+
+	switch line[column] {
+	case '"':
+		for i := column + 1; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				return i - column + 1, nil
+			}
+		}
+		return 0, errors.New("a multi-line scalar cannot be edited")
+	case '\'':
+		for i := column + 1; i < len(line); i++ {
+			if line[i] != '\'' {
+				continue
+			}
+			if i+1 < len(line) && line[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i - column + 1, nil
+		}
+		return 0, errors.New("a multi-line scalar cannot be edited")
+	}
+
+	// A plain scalar ends before a comment, or before the flow indicators in
+	// a flow collection (e.g. [a, b])
+	text := string(line[column:])
+	if index := strings.Index(text, " #"); index >= 0 {
+		text = text[:index]
+	}
+	text = strings.TrimRight(text, " \t\r")
+	if text != node.Value {
+		if index := strings.IndexAny(text, ",]}"); index >= 0 {
+			text = strings.TrimRight(text[:index], " \t")
+		}
+	}
+	if text != node.Value {
+		return 0, errors.New("the value cannot be edited in place")
+	}
+	return len([]rune(text)), nil
+}
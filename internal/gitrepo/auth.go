@@ -0,0 +1,144 @@
+// Package gitrepo runs git in the clones of the deploy steps, with the token
+// or the ssh key auth, and commits and pushes the changes to the branches of
+// the manifests repos
+package gitrepo
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// The default username of the token auth, which GitHub expects for the
+// installation access tokens
+const DEFAULT_TOKEN_USERNAME = "x-access-token"
+
+// The options for authenticating to the repo. The token is used for the
+// https urls, and the ssh key for the ssh urls
+type AuthOptions struct {
+	// The path to a file with the token (e.g. a mounted secret)
+	tokenFile     string
+	tokenUsername string
+	// The path to the private key and the known hosts for ssh
+	sshKeyFile        string
+	sshKnownHostsFile string
+}
+
+// Adds the auth flags, which GetAuthOptions reads
+func ConfigureAuthFlags(flags *pflag.FlagSet) {
+	flags.String(
+		"token-file",
+		"",
+		"The path to a file with the token for the https repo urls (e.g. a GitHub installation access token). "+
+			"The token is passed in a header, so it is not stored in the clone")
+	flags.String("token-username", DEFAULT_TOKEN_USERNAME, "The username of the token auth")
+	flags.String("ssh-key-file", "", "The path to the private key for the ssh repo urls")
+	flags.String(
+		"ssh-known-hosts-file",
+		"",
+		"The path to the ssh known hosts file. If not set, the host key is accepted on the first connection")
+}
+
+func GetAuthOptions(flags *pflag.FlagSet) (AuthOptions, error) {
+	var opts AuthOptions
+	var err error
+
+	opts.tokenFile, err = flags.GetString("token-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing token-file flag")
+	}
+
+	opts.tokenUsername, err = flags.GetString("token-username")
+	if err != nil {
+		return opts, fmt.Errorf("error processing token-username flag")
+	}
+
+	opts.sshKeyFile, err = flags.GetString("ssh-key-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing ssh-key-file flag")
+	}
+
+	opts.sshKnownHostsFile, err = flags.GetString("ssh-known-hosts-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing ssh-known-hosts-file flag")
+	}
+	if opts.sshKnownHostsFile != "" && opts.sshKeyFile == "" {
+		return opts, fmt.Errorf("ssh-key-file must be set with ssh-known-hosts-file")
+	}
+	return opts, nil
+}
+
+func (opts AuthOptions) LogAttrs() []any {
+	return []any{
+		"tokenFile", opts.tokenFile,
+		"tokenUsername", opts.tokenUsername,
+		"sshKeyFile", opts.sshKeyFile,
+		"sshKnownHostsFile", opts.sshKnownHostsFile,
+	}
+}
+
+// Returns the environment variables that configure the git auth for the
+// repo, and a func that removes the temp files. The token header is set
+// with the GIT_CONFIG_* variables, so it is not in the process args or the
+// git config of the clone, and it is only sent to the host of the repo
+func (opts AuthOptions) Env(repo string) ([]string, func(), error) {
+	env := []string{}
+	cleanup := func() {}
+
+	if opts.tokenFile != "" {
+		bytes, err := os.ReadFile(opts.tokenFile)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("error reading token file: %s", err)
+		}
+		token := strings.TrimSpace(string(bytes))
+		if token == "" {
+			return nil, cleanup, fmt.Errorf("token file is empty: %s", opts.tokenFile)
+		}
+		repoUrl, err := url.Parse(repo)
+		if err != nil || (repoUrl.Scheme != "https" && repoUrl.Scheme != "http") {
+			return nil, cleanup, fmt.Errorf("token-file is only supported for the http repo urls: %s", repo)
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(opts.tokenUsername + ":" + token))
+		env = append(
+			env,
+			"GIT_CONFIG_COUNT=1",
+			fmt.Sprintf("GIT_CONFIG_KEY_0=http.%s://%s/.extraHeader", repoUrl.Scheme, repoUrl.Host),
+			fmt.Sprintf("GIT_CONFIG_VALUE_0=Authorization: Basic %s", credentials),
+		)
+	}
+
+	if opts.sshKeyFile != "" {
+		// ssh refuses a private key that other users can read, which is
+		// the default mode of a mounted secret, so a copy is used
+		keyBytes, err := os.ReadFile(opts.sshKeyFile)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("error reading ssh key file: %s", err)
+		}
+		keyFile, err := os.CreateTemp("", "deploy-steps-ssh-key-")
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("error creating ssh key file: %s", err)
+		}
+		cleanup = func() { os.Remove(keyFile.Name()) }
+		_, err = keyFile.Write(keyBytes)
+		keyFile.Close()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("error writing ssh key file: %s", err)
+		}
+
+		sshCommand := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes", keyFile.Name())
+		if opts.sshKnownHostsFile != "" {
+			sshCommand += fmt.Sprintf(" -o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes", opts.sshKnownHostsFile)
+		} else {
+			slog.Warn("No ssh known hosts file is set, so the host key is accepted on the first connection")
+			sshCommand += " -o StrictHostKeyChecking=accept-new"
+		}
+		env = append(env, fmt.Sprintf("GIT_SSH_COMMAND=%s", sshCommand))
+	}
+	return env, cleanup, nil
+}
@@ -0,0 +1,305 @@
+package gitrepo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default branch of the manifests repo, which Argo CD syncs
+	DEFAULT_BRANCH = "main"
+	// The default number of push attempts. A push is rejected when another
+	// deploy pushes to the branch first, so the change is applied again on
+	// the new branch tip
+	DEFAULT_PUSH_ATTEMPTS = 5
+	// The delay before the change is applied again after a rejected push
+	PUSH_RETRY_DELAY = 2 * time.Second
+)
+
+// The options for committing a change to a branch of a repo, such as the
+// manifests repo that Argo CD syncs
+type BranchOptions struct {
+	repo   string
+	branch string
+	// The path to clone the repo to, or a temp dir if not set
+	clonePath     string
+	commitMessage string
+	authorName    string
+	authorEmail   string
+	// Whether the commit is pushed, which is turned off for a dry run
+	push         bool
+	pushAttempts int
+	gitPath      string
+	auth         AuthOptions
+}
+
+// A change to the files of the clone
+type Change interface {
+	// Applies the change to the clone, and returns the changed files. It is
+	// applied to the branch tip, and again after each rejected push
+	Apply(ctx context.Context, git Runner) ([]string, error)
+	// Returns the default commit message of the changed files
+	CommitMessage(files []string) string
+}
+
+// The outcome of the change to the branch
+type BranchResult struct {
+	// Whether the change changed any files. A change that is already on the
+	// branch is not committed
+	Changed bool
+	Files   []string
+	Commit  string
+	Pushed  bool
+}
+
+// Returns the options of the repo, branch, clone-path, commit-message,
+// author-name, author-email, push, push-attempts, git-path, and auth flags
+func GetBranchOptions(flags *pflag.FlagSet) (BranchOptions, error) {
+	var opts BranchOptions
+	var err error
+
+	opts.repo, err = flags.GetString("repo")
+	if err != nil {
+		return opts, fmt.Errorf("error processing repo flag")
+	}
+
+	opts.branch, err = flags.GetString("branch")
+	if err != nil {
+		return opts, fmt.Errorf("error processing branch flag")
+	}
+	if opts.branch == "" {
+		return opts, fmt.Errorf("branch must be set")
+	}
+
+	opts.clonePath, err = flags.GetString("clone-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing clone-path flag")
+	}
+
+	opts.commitMessage, err = flags.GetString("commit-message")
+	if err != nil {
+		return opts, fmt.Errorf("error processing commit-message flag")
+	}
+
+	opts.authorName, err = flags.GetString("author-name")
+	if err != nil {
+		return opts, fmt.Errorf("error processing author-name flag")
+	}
+
+	opts.authorEmail, err = flags.GetString("author-email")
+	if err != nil {
+		return opts, fmt.Errorf("error processing author-email flag")
+	}
+
+	opts.push, err = flags.GetBool("push")
+	if err != nil {
+		return opts, fmt.Errorf("error processing push flag")
+	}
+
+	opts.pushAttempts, err = flags.GetInt("push-attempts")
+	if err != nil {
+		return opts, fmt.Errorf("error processing push-attempts flag")
+	}
+	if opts.pushAttempts < 1 {
+		return opts, fmt.Errorf("push-attempts must be at least 1: %d", opts.pushAttempts)
+	}
+
+	opts.gitPath, err = flags.GetString("git-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing git-path flag")
+	}
+
+	opts.auth, err = GetAuthOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (opts BranchOptions) LogAttrs() []any {
+	attrs := []any{
+		"repo", RedactUrlCredentials(opts.repo),
+		"branch", opts.branch,
+		"clonePath", opts.clonePath,
+		"commitMessage", opts.commitMessage,
+		"authorName", opts.authorName,
+		"authorEmail", opts.authorEmail,
+		"push", opts.push,
+		"pushAttempts", opts.pushAttempts,
+		"gitPath", opts.gitPath,
+	}
+	return append(attrs, opts.auth.LogAttrs()...)
+}
+
+func (opts BranchOptions) Repo() string {
+	return opts.repo
+}
+
+func (opts BranchOptions) Branch() string {
+	return opts.branch
+}
+
+// Whether the commit is pushed
+func (opts BranchOptions) Push() bool {
+	return opts.push
+}
+
+// Clones the branch to the clone path, or to a temp dir with the prefix if
+// the clone path is not set. The clone args select the history (e.g.
+// --depth=1 for the branch tip). Returns the runner of the clone, and a
+// func that removes the temp dir and the auth files
+func (opts BranchOptions) Clone(ctx context.Context, tempDirPrefix string, cloneArgs ...string) (Runner, func(), error) {
+	cleanups := []func(){}
+	cleanup := func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+
+	clonePath := opts.clonePath
+	if clonePath == "" {
+		var err error
+		clonePath, err = os.MkdirTemp("", tempDirPrefix)
+		if err != nil {
+			return Runner{}, cleanup, fmt.Errorf("error creating the clone dir: %s", err)
+		}
+		cleanups = append(cleanups, func() { os.RemoveAll(clonePath) })
+	} else {
+		err := CheckClonePathEmpty(clonePath)
+		if err != nil {
+			return Runner{}, cleanup, err
+		}
+	}
+	authEnv, authCleanup, err := opts.auth.Env(opts.repo)
+	if err != nil {
+		cleanup()
+		return Runner{}, func() {}, err
+	}
+	cleanups = append(cleanups, authCleanup)
+	git := Runner{
+		GitPath:   opts.gitPath,
+		ClonePath: clonePath,
+		// A prompt for credentials would hang the step
+		Env: append(authEnv, "GIT_TERMINAL_PROMPT=0"),
+	}
+
+	slog.Info("Cloning the repo", "branch", opts.branch, "clonePath", clonePath)
+	args := []string{"clone", "--quiet", "--single-branch", "--no-tags", "--branch", opts.branch}
+	args = append(args, cloneArgs...)
+	_, err = git.Run(ctx, append(args, "--", opts.repo, ".")...)
+	if err != nil {
+		cleanup()
+		return Runner{}, func() {}, err
+	}
+	return git, cleanup, nil
+}
+
+// Applies the change to the clone, and commits the changed files. A change
+// that changed no files is not committed
+func (opts BranchOptions) CommitChange(ctx context.Context, git Runner, change Change) (BranchResult, error) {
+	result := BranchResult{Files: []string{}}
+	files, err := change.Apply(ctx, git)
+	if err != nil {
+		return result, err
+	}
+	if len(files) == 0 {
+		slog.Info("Skipping the commit. The files already have the change")
+		return result, nil
+	}
+	result.Files = files
+	result.Changed = true
+	result.Commit, err = opts.commit(ctx, git, change, files)
+	return result, err
+}
+
+// Pushes the commit to the branch. A rejected push, such as when another
+// deploy pushed first, is retried by applying the change again on the new
+// branch tip, so the retries do not depend on a rebase of the commit. The
+// fetch args select the history of the fetch, as with the clone args
+func (opts BranchOptions) PushBranch(
+	ctx context.Context,
+	git Runner,
+	change Change,
+	result BranchResult,
+	fetchArgs ...string,
+) (BranchResult, error) {
+	for attempt := 1; ; attempt++ {
+		slog.Info("Pushing the commit", "branch", opts.branch, "commit", result.Commit, "attempt", attempt)
+		_, err := git.Run(ctx, "push", "--quiet", "origin", "HEAD:refs/heads/"+opts.branch)
+		if err == nil {
+			result.Pushed = true
+			slog.Info("Pushed the commit", "branch", opts.branch, "commit", result.Commit)
+			return result, nil
+		}
+		if attempt >= opts.pushAttempts {
+			return result, fmt.Errorf("error pushing to %s after %d attempts: %s", opts.branch, attempt, err)
+		}
+
+		slog.Warn("The push failed. Applying the change again on the branch tip", "error", err)
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(PUSH_RETRY_DELAY):
+		}
+		args := append([]string{"fetch", "--quiet"}, fetchArgs...)
+		_, err = git.Run(ctx, append(args, "--no-tags", "origin", opts.branch)...)
+		if err != nil {
+			return result, err
+		}
+		_, err = git.Run(ctx, "reset", "--quiet", "--hard", "FETCH_HEAD")
+		if err != nil {
+			return result, err
+		}
+		result, err = opts.CommitChange(ctx, git, change)
+		if err != nil {
+			return result, err
+		}
+		if !result.Changed {
+			// Another deploy pushed the same change
+			slog.Info("Skipping the push. The branch tip already has the change")
+			return result, nil
+		}
+	}
+}
+
+// Returns the commit message, which is the commit-message flag if set, or
+// the message of the change
+func (opts BranchOptions) GetCommitMessage(change Change, files []string) string {
+	if opts.commitMessage != "" {
+		return opts.commitMessage
+	}
+	return change.CommitMessage(files)
+}
+
+// Commits the changed files, and returns the commit hash
+func (opts BranchOptions) commit(ctx context.Context, git Runner, change Change, files []string) (string, error) {
+	_, err := git.Run(ctx, append([]string{"add", "--"}, files...)...)
+	if err != nil {
+		return "", err
+	}
+	git.Env = append(
+		git.Env,
+		"GIT_AUTHOR_NAME="+opts.authorName,
+		"GIT_AUTHOR_EMAIL="+opts.authorEmail,
+		"GIT_COMMITTER_NAME="+opts.authorName,
+		"GIT_COMMITTER_EMAIL="+opts.authorEmail,
+	)
+	message := opts.GetCommitMessage(change, files)
+	_, err = git.RunInput(ctx, message, "commit", "--quiet", "--no-verify", "--file=-")
+	if err != nil {
+		return "", err
+	}
+	commit, err := git.Run(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	commit = strings.TrimSpace(commit)
+	slog.Info("Committed the change", "commit", commit, "files", files)
+	return commit, nil
+}
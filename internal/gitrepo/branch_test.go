@@ -0,0 +1,208 @@
+package gitrepo
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// Writes the version to the version file, and returns it as changed if the
+// file had another version
+type versionChange struct {
+	version string
+}
+
+func (change versionChange) Apply(ctx context.Context, git Runner) ([]string, error) {
+	path := filepath.Join(git.ClonePath, "version.txt")
+	current, err := os.ReadFile(path)
+	if err == nil && string(current) == change.version {
+		return nil, nil
+	}
+	err = os.WriteFile(path, []byte(change.version), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"version.txt"}, nil
+}
+
+func (change versionChange) CommitMessage(files []string) string {
+	return "Bump " + strings.Join(files, ", ") + " to " + change.version
+}
+
+// Creates a bare repo with a main branch in a temp dir. Returns the path of
+// the bare repo
+func newTestOrigin(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	origin := t.TempDir()
+	gitTest(t, origin, "init", "--quiet", "--bare", "--initial-branch=main")
+
+	seed := gitTestClone(t, origin)
+	commitTestFile(t, seed, "README.md", "readme")
+	gitTest(t, seed, "push", "--quiet", "origin", "HEAD:refs/heads/main")
+	return origin
+}
+
+// Clones the origin to a temp dir, with the test author. Returns the path of
+// the clone
+func gitTestClone(t *testing.T, origin string) string {
+	t.Helper()
+	clonePath := t.TempDir()
+	gitTest(t, clonePath, "clone", "--quiet", "--", origin, ".")
+	gitTest(t, clonePath, "config", "user.name", "test")
+	gitTest(t, clonePath, "config", "user.email", "test@example.com")
+	gitTest(t, clonePath, "config", "commit.gpgsign", "false")
+	return clonePath
+}
+
+// Writes the file and commits it in the clone
+func commitTestFile(t *testing.T, clonePath string, file string, content string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(clonePath, file), []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("error writing file: %s", err)
+	}
+	gitTest(t, clonePath, "add", "--", file)
+	gitTest(t, clonePath, "commit", "--quiet", "--message", "test")
+}
+
+// Runs the git command in the path, and returns the trimmed stdout
+func gitTest(t *testing.T, path string, args ...string) string {
+	t.Helper()
+	output, err := Runner{GitPath: DEFAULT_GIT_PATH, ClonePath: path}.Run(context.Background(), args...)
+	if err != nil {
+		t.Fatalf("git %s failed: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(output)
+}
+
+// Returns the branch options of the flags, with the defaults of a step
+func getTestBranchOptions(t *testing.T, args ...string) (BranchOptions, error) {
+	t.Helper()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("repo", "", "")
+	flags.String("branch", DEFAULT_BRANCH, "")
+	flags.String("clone-path", "", "")
+	flags.String("commit-message", "", "")
+	flags.String("author-name", "test-step", "")
+	flags.String("author-email", "test-step@localhost", "")
+	flags.Bool("push", true, "")
+	flags.Int("push-attempts", DEFAULT_PUSH_ATTEMPTS, "")
+	flags.String("git-path", DEFAULT_GIT_PATH, "")
+	ConfigureAuthFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		t.Fatalf("error parsing flags: %s", err)
+	}
+	return GetBranchOptions(flags)
+}
+
+func TestGetBranchOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "defaults", args: []string{"--repo=https://github.com/org/manifests.git"}},
+		{name: "empty branch", args: []string{"--branch="}, wantErr: true},
+		{name: "no push attempts", args: []string{"--push-attempts=0"}, wantErr: true},
+		{name: "known hosts without key", args: []string{"--ssh-known-hosts-file=known_hosts"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getTestBranchOptions(t, tt.args...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetBranchOptions() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCommitChange(t *testing.T) {
+	origin := newTestOrigin(t)
+	ctx := context.Background()
+	opts, err := getTestBranchOptions(t, "--repo="+origin)
+	if err != nil {
+		t.Fatalf("GetBranchOptions() error = %v", err)
+	}
+
+	git, cleanup, err := opts.Clone(ctx, "gitrepo-test-", "--depth=1")
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("Clone() error = %v", err)
+	}
+	result, err := opts.CommitChange(ctx, git, versionChange{version: "v1"})
+	if err != nil {
+		t.Fatalf("CommitChange() error = %v", err)
+	}
+	if !result.Changed || !slices.Equal(result.Files, []string{"version.txt"}) || result.Commit == "" {
+		t.Errorf("CommitChange() = %+v, want a commit of version.txt", result)
+	}
+	message := gitTest(t, git.ClonePath, "log", "-1", "--format=%an <%ae> %s")
+	if message != "test-step <test-step@localhost> Bump version.txt to v1" {
+		t.Errorf("commit = %q, want the author and the message of the change", message)
+	}
+
+	// The change is already in the clone, so it is not committed again
+	result, err = opts.CommitChange(ctx, git, versionChange{version: "v1"})
+	if err != nil {
+		t.Fatalf("CommitChange() error = %v", err)
+	}
+	if result.Changed || len(result.Files) != 0 || result.Commit != "" {
+		t.Errorf("CommitChange() of an applied change = %+v, want no commit", result)
+	}
+}
+
+func TestPushBranchRetry(t *testing.T) {
+	origin := newTestOrigin(t)
+	ctx := context.Background()
+	opts, err := getTestBranchOptions(t, "--repo="+origin, "--commit-message=Deploy v2")
+	if err != nil {
+		t.Fatalf("GetBranchOptions() error = %v", err)
+	}
+
+	git, cleanup, err := opts.Clone(ctx, "gitrepo-test-", "--depth=1")
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("Clone() error = %v", err)
+	}
+	change := versionChange{version: "v2"}
+	result, err := opts.CommitChange(ctx, git, change)
+	if err != nil {
+		t.Fatalf("CommitChange() error = %v", err)
+	}
+
+	// Another deploy pushes first, so the first push is rejected and the
+	// change is applied again on the new branch tip
+	other := gitTestClone(t, origin)
+	commitTestFile(t, other, "other.txt", "other")
+	gitTest(t, other, "push", "--quiet", "origin", "HEAD:refs/heads/main")
+
+	result, err = opts.PushBranch(ctx, git, change, result, "--depth=1")
+	if err != nil {
+		t.Fatalf("PushBranch() error = %v", err)
+	}
+	if !result.Pushed || !result.Changed {
+		t.Errorf("PushBranch() = %+v, want a pushed change", result)
+	}
+	originCommit := gitTest(t, origin, "rev-parse", "main")
+	if originCommit != result.Commit {
+		t.Errorf("origin main = %s, want the pushed commit %s", originCommit, result.Commit)
+	}
+	files := gitTest(t, origin, "ls-tree", "--name-only", "main")
+	if files != "README.md\nother.txt\nversion.txt" {
+		t.Errorf("origin main files = %q, want the files of both deploys", files)
+	}
+	message := gitTest(t, origin, "log", "-1", "--format=%s", "main")
+	if message != "Deploy v2" {
+		t.Errorf("commit message = %q, want the commit-message flag", message)
+	}
+}
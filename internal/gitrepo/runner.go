@@ -0,0 +1,73 @@
+package gitrepo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The default git path, which is resolved with the PATH
+const DEFAULT_GIT_PATH = "git"
+
+// Runs the git commands in the clone path with the auth environment
+type Runner struct {
+	GitPath   string
+	ClonePath string
+	Env       []string
+}
+
+// Runs the git command and returns the stdout
+func (g Runner) Run(ctx context.Context, args ...string) (string, error) {
+	return g.RunInput(ctx, "", args...)
+}
+
+// Runs the git command with the input on stdin and returns the stdout
+func (g Runner) RunInput(ctx context.Context, input string, args ...string) (string, error) {
+	args = append([]string{"-C", g.ClonePath}, args...)
+	slog.Debug("Running git", "args", args)
+
+	stdout := &bytes.Buffer{}
+	gitCmd := exec.CommandContext(ctx, g.GitPath, args...)
+	gitCmd.Env = append(os.Environ(), g.Env...)
+	gitCmd.Stdin = strings.NewReader(input)
+	gitCmd.Stdout = stdout
+	gitCmd.Stderr = os.Stderr
+	err := gitCmd.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf("git %s failed: %w", args[2], err)
+	}
+	return stdout.String(), nil
+}
+
+// Returns an error if the clone path has any files, since a previous
+// clone would be mixed with the new one. A missing clone path is created
+func CheckClonePathEmpty(clonePath string) error {
+	entries, err := os.ReadDir(clonePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.MkdirAll(clonePath, 0755)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading clone path: %s", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("clone path is not empty: %s", clonePath)
+	}
+	return nil
+}
+
+// Removes any user info from the url, since it may contain credentials
+func RedactUrlCredentials(rawUrl string) string {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil || parsedUrl.User == nil {
+		return rawUrl
+	}
+	parsedUrl.User = nil
+	return parsedUrl.String()
+}
@@ -0,0 +1,10 @@
+module github.com/osoriano/deploy-steps/internal
+
+go 1.24.1
+
+require (
+	github.com/spf13/cobra v1.9.1
+	github.com/spf13/pflag v1.0.6
+)
+
+require github.com/inconshreveable/mousetrap v1.1.0 // indirect
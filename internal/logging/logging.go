@@ -0,0 +1,109 @@
+// Package logging configures the slog logger of the deploy steps, with the
+// text format for the Argo UI and the JSON format for log pipelines
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// Logs the message with the attributes on the following lines as
+	// "- key: value", which is easy to read in the Argo UI
+	LOG_FORMAT_TEXT = "text"
+	// Logs each record as a JSON object, for log pipelines that index fields
+	LOG_FORMAT_JSON = "json"
+)
+
+// The supported log formats
+var LogFormats = []string{LOG_FORMAT_TEXT, LOG_FORMAT_JSON}
+
+// Configures the default logger from the log-format and debug flags of the
+// command, which the steps add as persistent flags
+func ConfigureFromFlags(cmd *cobra.Command, stepName string) error {
+	logFormat, err := cmd.Flags().GetString("log-format")
+	if err != nil {
+		return fmt.Errorf("error processing %s log-format flag", cmd.Name())
+	}
+	debug, err := cmd.Flags().GetBool("debug")
+	if err != nil {
+		return fmt.Errorf("error processing %s debug flag", cmd.Name())
+	}
+	return Configure(logFormat, debug, stepName, cmd.Name())
+}
+
+// Configures the default logger for the subcommand of the step. Debug
+// records are only logged if debug is set. The step and the subcommand are
+// added to the JSON logs
+func Configure(logFormat string, debug bool, stepName string, subcommand string) error {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+
+	switch logFormat {
+	case LOG_FORMAT_TEXT:
+		slog.SetDefault(slog.New(NewTextHandler(os.Stdout, level)))
+	case LOG_FORMAT_JSON:
+		handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+		slog.SetDefault(slog.New(handler).With("step", stepName, "subcommand", subcommand))
+	default:
+		return fmt.Errorf("log-format must be one of %s: %s", LogFormats, logFormat)
+	}
+	return nil
+}
+
+// A slog handler for the text log format. The attributes added with
+// Logger.With (e.g. step and subcommand) are omitted, since they are
+// the same for every record
+type textLogHandler struct {
+	mu    *sync.Mutex
+	out   io.Writer
+	level slog.Level
+}
+
+// Returns the handler of the text log format, which is also the default
+// logger before the flags are parsed
+func NewTextHandler(out io.Writer, level slog.Level) slog.Handler {
+	return &textLogHandler{mu: &sync.Mutex{}, out: out, level: level}
+}
+
+func (h *textLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	buf := &bytes.Buffer{}
+	switch {
+	case record.Level >= slog.LevelError:
+		buf.WriteString("Error: ")
+	case record.Level >= slog.LevelWarn:
+		buf.WriteString("Warning: ")
+	}
+	buf.WriteString(record.Message)
+	buf.WriteString("\n")
+	record.Attrs(func(attr slog.Attr) bool {
+		fmt.Fprintf(buf, "- %s: %s\n", attr.Key, attr.Value.Resolve())
+		return true
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.out.Write(buf.Bytes())
+	return err
+}
+
+func (h *textLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *textLogHandler) WithGroup(name string) slog.Handler {
+	return h
+}
@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestTextHandler(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := slog.New(NewTextHandler(out, slog.LevelInfo)).With("step", "test")
+	logger.Debug("Debug record")
+	logger.Info("Cloned repo", "revision", "abc123", "depth", 1)
+	logger.Warn("Retrying push")
+	logger.Error("Error executing command", "error", "exit status 1")
+
+	want := "Cloned repo\n" +
+		"- revision: abc123\n" +
+		"- depth: 1\n" +
+		"Warning: Retrying push\n" +
+		"Error: Error executing command\n" +
+		"- error: exit status 1\n"
+	if out.String() != want {
+		t.Errorf("text log output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestConfigureFromFlags(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	tests := []struct {
+		name      string
+		logFormat string
+		debug     bool
+		wantErr   bool
+	}{
+		{name: "text", logFormat: LOG_FORMAT_TEXT},
+		{name: "json with debug", logFormat: LOG_FORMAT_JSON, debug: true},
+		{name: "unknown format", logFormat: "yaml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &cobra.Command{Use: "commit"}
+			cmd.Flags().Bool("debug", tt.debug, "")
+			cmd.Flags().String("log-format", tt.logFormat, "")
+
+			err := ConfigureFromFlags(cmd, "test-step")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ConfigureFromFlags() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err == nil && slog.Default().Enabled(t.Context(), slog.LevelDebug) != tt.debug {
+				t.Errorf("debug records enabled = %t, want %t", !tt.debug, tt.debug)
+			}
+		})
+	}
+}
+
+func TestConfigureFromFlagsMissingFlags(t *testing.T) {
+	err := ConfigureFromFlags(&cobra.Command{Use: "commit"}, "test-step")
+	if err == nil {
+		t.Errorf("ConfigureFromFlags() without the flags did not fail")
+	}
+}
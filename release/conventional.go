@@ -0,0 +1,65 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// Matches the header of a conventional commit (e.g. feat(api)!: add
+	// the endpoint)
+	// See https://www.conventionalcommits.org
+	conventionalHeaderRegexp = regexp.MustCompile(`^([a-zA-Z]+)(?:\(([^()]*)\))?(!)?: (.+)$`)
+	// Matches the breaking change footer of a conventional commit, with the
+	// description of the change
+	breakingChangeRegexp = regexp.MustCompile(`(?m)^BREAKING[ -]CHANGE: (.*)$`)
+)
+
+// A commit message parsed as a conventional commit
+type conventionalCommit struct {
+	// The lowercase type (e.g. feat or fix), or empty if the message is not
+	// a conventional commit
+	commitType string
+	scope      string
+	// The description of the header, or the first line of the message if it
+	// is not a conventional commit
+	description string
+	breaking    bool
+	// The description of the breaking change footer, if any
+	breakingNote string
+}
+
+func parseConventionalCommit(message string) conventionalCommit {
+	header, _, _ := strings.Cut(message, "\n")
+	header = strings.TrimSpace(header)
+	match := conventionalHeaderRegexp.FindStringSubmatch(header)
+	if match == nil {
+		return conventionalCommit{description: header}
+	}
+	parsed := conventionalCommit{
+		commitType:  strings.ToLower(match[1]),
+		scope:       match[2],
+		description: match[4],
+		breaking:    match[3] == "!",
+	}
+	if footer := breakingChangeRegexp.FindStringSubmatch(message); footer != nil {
+		parsed.breaking = true
+		parsed.breakingNote = strings.TrimSpace(footer[1])
+	}
+	return parsed
+}
+
+// Returns the bump of the commit. A breaking change is a major bump, a
+// feature is a minor bump, a fix or a performance improvement is a patch
+// bump, and the other commits need no release
+func (c conventionalCommit) bump() string {
+	switch {
+	case c.breaking:
+		return BUMP_MAJOR
+	case c.commitType == "feat":
+		return BUMP_MINOR
+	case c.commitType == "fix" || c.commitType == "perf":
+		return BUMP_PATCH
+	}
+	return BUMP_NONE
+}
@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func TestParseConventionalCommit(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		want     conventionalCommit
+		wantBump string
+	}{
+		{
+			name:     "feat",
+			message:  "feat: add the endpoint",
+			want:     conventionalCommit{commitType: "feat", description: "add the endpoint"},
+			wantBump: BUMP_MINOR,
+		},
+		{
+			name:     "fix with scope",
+			message:  "fix(api): handle the empty body\n\nThe body may be empty",
+			want:     conventionalCommit{commitType: "fix", scope: "api", description: "handle the empty body"},
+			wantBump: BUMP_PATCH,
+		},
+		{
+			name:     "perf",
+			message:  "perf: cache the lookups",
+			want:     conventionalCommit{commitType: "perf", description: "cache the lookups"},
+			wantBump: BUMP_PATCH,
+		},
+		{
+			name:     "uppercase type",
+			message:  "Feat: add the endpoint",
+			want:     conventionalCommit{commitType: "feat", description: "add the endpoint"},
+			wantBump: BUMP_MINOR,
+		},
+		{
+			name:     "feat with bang",
+			message:  "feat(api)!: remove the v1 endpoint",
+			want:     conventionalCommit{commitType: "feat", scope: "api", description: "remove the v1 endpoint", breaking: true},
+			wantBump: BUMP_MAJOR,
+		},
+		{
+			name:    "breaking change footer",
+			message: "refactor: rename the config\n\nBREAKING CHANGE: the config key is renamed to server",
+			want: conventionalCommit{
+				commitType:   "refactor",
+				description:  "rename the config",
+				breaking:     true,
+				breakingNote: "the config key is renamed to server",
+			},
+			wantBump: BUMP_MAJOR,
+		},
+		{
+			name:     "breaking change footer with a dash",
+			message:  "fix: drop the flag\n\nBREAKING-CHANGE: the flag is removed",
+			want:     conventionalCommit{commitType: "fix", description: "drop the flag", breaking: true, breakingNote: "the flag is removed"},
+			wantBump: BUMP_MAJOR,
+		},
+		{
+			name:     "chore",
+			message:  "chore: bump the deps",
+			want:     conventionalCommit{commitType: "chore", description: "bump the deps"},
+			wantBump: BUMP_NONE,
+		},
+		{
+			name:     "non conventional subject",
+			message:  "Update the README\n\nfeat: is not in the header",
+			want:     conventionalCommit{description: "Update the README"},
+			wantBump: BUMP_NONE,
+		},
+		{
+			name:     "footer of a non conventional subject",
+			message:  "Remove the v1 api\n\nBREAKING CHANGE: the v1 api is removed",
+			want:     conventionalCommit{description: "Remove the v1 api"},
+			wantBump: BUMP_NONE,
+		},
+		{
+			name:     "missing space after the colon",
+			message:  "feat:add the endpoint",
+			want:     conventionalCommit{description: "feat:add the endpoint"},
+			wantBump: BUMP_NONE,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseConventionalCommit(tt.message)
+			if got != tt.want {
+				t.Errorf("parseConventionalCommit() = %+v, want %+v", got, tt.want)
+			}
+			if bump := got.bump(); bump != tt.wantBump {
+				t.Errorf("bump() = %q, want %q", bump, tt.wantBump)
+			}
+		})
+	}
+}
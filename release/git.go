@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A commit of the release history
+type commit struct {
+	hash    string
+	message string
+}
+
+// Returns the commits of the revision that are not in the base revision,
+// from the newest to the oldest. All of the commits of the revision are
+// returned if the base is empty. The merge commits are skipped, since the
+// merged commits describe the changes
+func getCommits(ctx context.Context, gitPath string, clonePath string, baseRevision string, revision string) ([]commit, error) {
+	revisionRange := revision
+	if baseRevision != "" {
+		revisionRange = fmt.Sprintf("%s..%s", baseRevision, revision)
+	}
+	output, err := runGit(ctx, gitPath, clonePath, "log", "--no-merges", "--format=%H%x00%B%x1e", revisionRange, "--")
+	if err != nil {
+		return nil, fmt.Errorf("error reading the commits of %s: %s", revisionRange, err)
+	}
+
+	commits := []commit{}
+	for _, record := range strings.Split(output, "\x1e") {
+		hash, message, found := strings.Cut(strings.TrimSpace(record), "\x00")
+		if !found {
+			continue
+		}
+		commits = append(commits, commit{hash: hash, message: strings.TrimSpace(message)})
+	}
+	return commits, nil
+}
+
+// Returns the PR numbers of the commits that a PR merge commit merged, by
+// the commit hash. The squash merges have the PR number in the subject of
+// the commit itself instead
+func getMergedPrNumbers(
+	ctx context.Context,
+	gitPath string,
+	clonePath string,
+	baseRevision string,
+	revision string,
+) (map[string]int, error) {
+	revisionRange := revision
+	if baseRevision != "" {
+		revisionRange = fmt.Sprintf("%s..%s", baseRevision, revision)
+	}
+	output, err := runGit(ctx, gitPath, clonePath, "log", "--merges", "--format=%P%x00%B%x1e", revisionRange, "--")
+	if err != nil {
+		return nil, fmt.Errorf("error reading the merge commits of %s: %s", revisionRange, err)
+	}
+
+	prNumbers := map[string]int{}
+	for _, record := range strings.Split(output, "\x1e") {
+		parents, message, found := strings.Cut(strings.TrimSpace(record), "\x00")
+		if !found {
+			continue
+		}
+		prNumber := getPrNumber(strings.TrimSpace(message))
+		parentHashes := strings.Fields(parents)
+		if prNumber == 0 || len(parentHashes) < 2 {
+			continue
+		}
+		// The merged commits are the commits of the second parent that are
+		// not in the first parent. The merges are read from the newest, so
+		// a nested PR overwrites the PR that merged it
+		mergedRange := fmt.Sprintf("%s..%s", parentHashes[0], parentHashes[1])
+		mergedOutput, err := runGit(ctx, gitPath, clonePath, "rev-list", mergedRange, "--")
+		if err != nil {
+			return nil, fmt.Errorf("error reading the commits of PR #%d: %s", prNumber, err)
+		}
+		for _, hash := range strings.Fields(mergedOutput) {
+			prNumbers[hash] = prNumber
+		}
+	}
+	return prNumbers, nil
+}
+
+// Returns the url of the origin remote, or empty if it is not set
+func getOriginUrl(ctx context.Context, gitPath string, clonePath string) string {
+	originUrl, err := runGit(ctx, gitPath, clonePath, "config", "--get", "remote.origin.url")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(originUrl)
+}
+
+// Returns the commit hash of the revision
+func getCommitHash(ctx context.Context, gitPath string, clonePath string, revision string) (string, error) {
+	hash, err := runGit(ctx, gitPath, clonePath, "rev-parse", "--verify", revision+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("error resolving revision %s: %s", revision, err)
+	}
+	return strings.TrimSpace(hash), nil
+}
+
+// Runs the git command in the clone path and returns the stdout
+func runGit(ctx context.Context, gitPath string, clonePath string, args ...string) (string, error) {
+	return runGitEnv(ctx, gitPath, clonePath, nil, args...)
+}
+
+// Runs the git command in the clone path with the extra environment
+// variables (e.g. the auth) and returns the stdout
+func runGitEnv(ctx context.Context, gitPath string, clonePath string, env []string, args ...string) (string, error) {
+	args = append([]string{"-C", clonePath}, args...)
+	slog.Debug("Running git", "args", args)
+
+	stdout := &bytes.Buffer{}
+	gitCmd := exec.CommandContext(ctx, gitPath, args...)
+	gitCmd.Env = append(os.Environ(), env...)
+	gitCmd.Stdout = stdout
+	gitCmd.Stderr = os.Stderr
+	err := gitCmd.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf("git %s failed: %w", args[2], err)
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Creates a git repo in a temp dir. Returns the clone path of the repo
+func newTestRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	clonePath := t.TempDir()
+	gitTest(t, clonePath, "init", "--quiet", "--initial-branch", "main")
+	gitTest(t, clonePath, "config", "user.name", "test")
+	gitTest(t, clonePath, "config", "user.email", "test@example.com")
+	gitTest(t, clonePath, "config", "commit.gpgsign", "false")
+	gitTest(t, clonePath, "config", "tag.gpgsign", "false")
+	return clonePath
+}
+
+// Runs the git command in the test repo, and returns the trimmed stdout
+func gitTest(t *testing.T, clonePath string, args ...string) string {
+	t.Helper()
+	output, err := runGit(context.Background(), DEFAULT_GIT_PATH, clonePath, args...)
+	if err != nil {
+		t.Fatalf("git %s failed: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(output)
+}
+
+// Commits an empty change with the message. Returns the commit hash
+func commitTest(t *testing.T, clonePath string, message string) string {
+	t.Helper()
+	gitTest(t, clonePath, "commit", "--quiet", "--allow-empty", "--message", message)
+	return gitTest(t, clonePath, "rev-parse", "HEAD")
+}
+
+func TestGetCommits(t *testing.T) {
+	clonePath := newTestRepo(t)
+	ctx := context.Background()
+
+	first := commitTest(t, clonePath, "feat: first")
+	second := commitTest(t, clonePath, "fix: second\n\nWith a body")
+
+	commits, err := getCommits(ctx, DEFAULT_GIT_PATH, clonePath, "", second)
+	if err != nil {
+		t.Fatalf("getCommits() error = %v", err)
+	}
+	want := []commit{
+		{hash: second, message: "fix: second\n\nWith a body"},
+		{hash: first, message: "feat: first"},
+	}
+	if !slices.Equal(commits, want) {
+		t.Errorf("getCommits() = %q, want %q", commits, want)
+	}
+
+	commits, err = getCommits(ctx, DEFAULT_GIT_PATH, clonePath, first, second)
+	if err != nil {
+		t.Fatalf("getCommits() error = %v", err)
+	}
+	if !slices.Equal(commits, want[:1]) {
+		t.Errorf("getCommits() since the base = %q, want %q", commits, want[:1])
+	}
+}
+
+func TestGetMergedPrNumbers(t *testing.T) {
+	clonePath := newTestRepo(t)
+	ctx := context.Background()
+
+	base := commitTest(t, clonePath, "feat: first")
+
+	// PR #2 is merged into the branch of PR #1, which is merged into main
+	gitTest(t, clonePath, "checkout", "--quiet", "-b", "outer")
+	outer := commitTest(t, clonePath, "feat: outer")
+	gitTest(t, clonePath, "checkout", "--quiet", "-b", "nested")
+	nested := commitTest(t, clonePath, "fix: nested")
+	gitTest(t, clonePath, "checkout", "--quiet", "outer")
+	gitTest(t, clonePath, "merge", "--quiet", "--no-ff", "--message", "Merge pull request #2 from org/nested", "nested")
+	nestedMerge := gitTest(t, clonePath, "rev-parse", "HEAD")
+	gitTest(t, clonePath, "checkout", "--quiet", "main")
+	gitTest(t, clonePath, "merge", "--quiet", "--no-ff", "--message", "Merge pull request #1 from org/outer", "outer")
+
+	// A merge without a PR number is skipped
+	gitTest(t, clonePath, "checkout", "--quiet", "-b", "other")
+	other := commitTest(t, clonePath, "docs: other")
+	gitTest(t, clonePath, "checkout", "--quiet", "main")
+	gitTest(t, clonePath, "merge", "--quiet", "--no-ff", "--message", "Merge branch other", "other")
+
+	// The squash merges have the PR number in their own subject
+	commitTest(t, clonePath, "feat: squashed (#3)")
+
+	prNumbers, err := getMergedPrNumbers(ctx, DEFAULT_GIT_PATH, clonePath, base, "HEAD")
+	if err != nil {
+		t.Fatalf("getMergedPrNumbers() error = %v", err)
+	}
+	want := map[string]int{
+		outer:       1,
+		nestedMerge: 1,
+		// The nested PR overwrites the PR that merged it
+		nested: 2,
+	}
+	if !maps.Equal(prNumbers, want) {
+		t.Errorf("getMergedPrNumbers() = %v, want %v", prNumbers, want)
+	}
+	if _, found := prNumbers[other]; found {
+		t.Errorf("getMergedPrNumbers() has the commit of a merge without a PR number")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "release"
+
+const (
+	// The default git path, which is resolved with the PATH
+	DEFAULT_GIT_PATH = "git"
+)
+
+var (
+	mainCmd = &cobra.Command{
+		Use:   "release",
+		Short: "Release the revision of a repo",
+		Long: `Releases the revision of a repo.
+The release version and the release notes are computed from the conventional
+commits since the previous version tag, and the revision is tagged`,
+		PersistentPreRunE: loadFlagValues,
+		RunE:              handleMainCmd,
+	}
+	versionCmd = &cobra.Command{
+		Use:   "version",
+		Short: "Compute the next version of the revision",
+		Long: `Computes the next version of the revision.
+The latest version tag in the history is bumped by the largest change of the
+conventional commits since it. A breaking change bumps the major version, a
+feat bumps the minor version, and a fix or perf bumps the patch version`,
+		RunE: handleVersionCmd,
+	}
+	notesCmd = &cobra.Command{
+		Use:   "notes",
+		Short: "Generate the release notes of the revision",
+		Long: `Generates the release notes of the revision.
+The commits since the previous version tag are grouped by their conventional
+commit type, with the PR and commit links, and written as Markdown for the
+GitHub Releases and as JSON for the Slack announcements`,
+		RunE: handleNotesCmd,
+	}
+	tagCmd = &cobra.Command{
+		Use:   "tag",
+		Short: "Create and push the annotated tag of the revision",
+		Long: `Creates and pushes the annotated tag of the revision.
+The tag is the version tag (e.g. from the version subcommand) or a deploy
+marker. A tag that already points at the revision is kept, so a retry
+succeeds`,
+		RunE: handleTagCmd,
+	}
+)
+
+func configureCmds() {
+	versionFlags := versionCmd.Flags()
+
+	versionFlags.String("clone-path", "", "The path to the cloned repo, with the history and the tags fetched")
+	versionCmd.MarkFlagRequired("clone-path")
+
+	versionFlags.String("revision-hash", "HEAD", "The revision id to compute the version of (e.g. commit sha hash)")
+
+	versionFlags.String("tag-prefix", DEFAULT_TAG_PREFIX, "The prefix of the version tags")
+
+	versionFlags.String(
+		"initial-version",
+		DEFAULT_INITIAL_VERSION,
+		"The version when the history has no version tag")
+
+	versionFlags.String(
+		"default-bump",
+		BUMP_NONE,
+		fmt.Sprintf(
+			"The bump when no commit since the previous version is a feat, fix, perf, or breaking change. One of %s",
+			bumps[:3]))
+
+	versionFlags.String("output-file", "", "The path to write the version to, without the tag prefix (e.g. 1.2.3)")
+	versionCmd.MarkFlagRequired("output-file")
+
+	versionFlags.String(
+		"result-file",
+		"",
+		"The path to write the JSON result to, with the tag, the previous version, the bump, and the commit count")
+
+	versionFlags.String("git-path", DEFAULT_GIT_PATH, "The path to the git executable")
+
+	configureNotesFlags(notesCmd.Flags())
+	notesCmd.MarkFlagRequired("clone-path")
+
+	tagFlags := tagCmd.Flags()
+
+	tagFlags.String("clone-path", "", "The path to the cloned repo")
+	tagCmd.MarkFlagRequired("clone-path")
+
+	tagFlags.String("revision-hash", "HEAD", "The revision id to tag (e.g. commit sha hash)")
+
+	tagFlags.String("tag", "", "The name of the tag (e.g. v1.2.3 or deploy/prod)")
+
+	tagFlags.String(
+		"version-file",
+		"",
+		"The path to a file with the version (e.g. the version output file), which is tagged with the tag prefix. "+
+			"Cannot be set with tag")
+
+	tagFlags.String("tag-prefix", DEFAULT_TAG_PREFIX, "The prefix of the version tag of the version file")
+
+	tagFlags.String("message", "", "The message of the tag. Defaults to Release and the tag name")
+
+	tagFlags.String("message-file", "", "The path to a file with the message of the tag (e.g. the Markdown notes)")
+
+	tagFlags.String("tagger-name", DEFAULT_TAGGER_NAME, "The name of the tagger")
+
+	tagFlags.String("tagger-email", DEFAULT_TAGGER_EMAIL, "The email of the tagger")
+
+	tagFlags.String("remote", DEFAULT_REMOTE, "The remote to push the tag to")
+
+	tagFlags.Bool("push", true, "Whether to push the tag to the remote")
+
+	gitrepo.ConfigureAuthFlags(tagFlags)
+
+	tagFlags.String("git-path", DEFAULT_GIT_PATH, "The path to the git executable")
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the git args")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+
+	mainCmd.AddCommand(versionCmd)
+	mainCmd.AddCommand(notesCmd)
+	mainCmd.AddCommand(tagCmd)
+}
+
+func configureNotesFlags(notesFlags *pflag.FlagSet) {
+	notesFlags.String("clone-path", "", "The path to the cloned repo, with the history and the tags fetched")
+
+	notesFlags.String("revision-hash", "HEAD", "The revision id to generate the notes of (e.g. commit sha hash)")
+
+	notesFlags.String(
+		"base-revision-hash",
+		"",
+		"The revision id of the previous release. Defaults to the latest version tag in the history of the revision, "+
+			"or all of the commits if there is none")
+
+	notesFlags.String("tag-prefix", DEFAULT_TAG_PREFIX, "The prefix of the version tags")
+
+	notesFlags.String("title", "", "The heading of the notes (e.g. the version tag)")
+
+	notesFlags.String(
+		"repo-url",
+		"",
+		"The web url of the repo for the PR and commit links (e.g. https://github.com/org/repo). Defaults to the url "+
+			"of the origin remote")
+
+	notesFlags.String(
+		"pr-url-template",
+		"",
+		fmt.Sprintf(
+			"The url of a PR, with %s for the PR number (e.g. https://gitlab.com/org/repo/-/merge_requests/%s). "+
+				"Defaults to the GitHub PR url of the repo url",
+			PR_NUMBER_PLACEHOLDER,
+			PR_NUMBER_PLACEHOLDER))
+
+	notesFlags.StringArray(
+		"exclude-section",
+		nil,
+		fmt.Sprintf("A section to leave out of the notes (e.g. chore). One of %s. Can be repeated", getNoteSectionTypes()))
+
+	notesFlags.String("markdown-file", "", "The path to write the Markdown notes to")
+
+	notesFlags.String(
+		"json-file",
+		"",
+		"The path to write the JSON notes to, with the sections, the Markdown, and the Slack mrkdwn text")
+
+	notesFlags.String("git-path", DEFAULT_GIT_PATH, "The path to the git executable")
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	return fmt.Errorf("Must specify a subcommand")
+}
+
+func handleVersionCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	versionOpts, err := getVersionOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Release version with params", versionOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	result, err := versionOpts.computeVersion(cmd.Context())
+	if err != nil {
+		return err
+	}
+	slog.Info(
+		"Computed the release version",
+		"release", result.Release,
+		"version", result.Version,
+		"tag", result.Tag,
+		"previousTag", result.PreviousTag,
+		"bump", result.Bump,
+		"commits", result.Commits,
+	)
+	return versionOpts.writeResult(result)
+}
+
+func handleNotesCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	notesOpts, err := getNotesOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Release notes with params", notesOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	notes, err := notesOpts.generateNotes(cmd.Context())
+	if err != nil {
+		return err
+	}
+	entries := 0
+	for _, section := range notes.Sections {
+		entries += len(section.Entries)
+	}
+	slog.Info(
+		"Generated the release notes",
+		"baseRevision", notes.BaseRevision,
+		"revision", notes.Revision,
+		"sections", len(notes.Sections),
+		"commits", entries,
+	)
+	return notesOpts.writeNotes(notes)
+}
+
+func handleTagCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	tagOpts, err := getTagOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Release tag with params", tagOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	return tagOpts.createTag(cmd.Context())
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		os.Exit(1)
+	}
+}
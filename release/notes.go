@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The section of the breaking changes, which lists them regardless of
+	// their type
+	BREAKING_SECTION = "breaking"
+	// The section of the commits that are not conventional commits, or that
+	// have an unknown type
+	OTHER_SECTION = "other"
+	// The placeholder of the PR number in the PR url template
+	PR_NUMBER_PLACEHOLDER = "{number}"
+	// The length of the short hashes of the notes, as GitHub shows them
+	SHORT_HASH_LENGTH = 7
+)
+
+var (
+	// The sections of the notes, in order. The commits are grouped by their
+	// conventional commit type
+	noteSections = []noteSection{
+		{BREAKING_SECTION, "Breaking Changes"},
+		{"feat", "Features"},
+		{"fix", "Bug Fixes"},
+		{"perf", "Performance Improvements"},
+		{"revert", "Reverts"},
+		{"refactor", "Code Refactoring"},
+		{"docs", "Documentation"},
+		{"test", "Tests"},
+		{"build", "Build System"},
+		{"ci", "Continuous Integration"},
+		{"style", "Styles"},
+		{"chore", "Chores"},
+		{OTHER_SECTION, "Other Changes"},
+	}
+
+	// Match the PR number in the commit subject of a merged PR, for the
+	// merge commits (e.g. Merge pull request #123 from org/branch), and the
+	// squash merges (e.g. Add the feature (#123))
+	prNumberSubjectRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`^Merge pull request #(\d+) from `),
+		regexp.MustCompile(`\s*\(#(\d+)\)$`),
+	}
+	// Matches the merge request number in the message of a GitLab merge
+	// commit (e.g. See merge request org/repo!123)
+	prNumberMessageRegexp = regexp.MustCompile(`(?m)^See merge request \S+!(\d+)$`)
+	// Matches the scp-like ssh urls of git (e.g. git@github.com:org/repo.git)
+	scpUrlRegexp = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+)
+
+// A section of the notes, by the conventional commit type
+type noteSection struct {
+	commitType string
+	title      string
+}
+
+// The options for generating the release notes of a revision
+type notesOptions struct {
+	clonePath string
+	revision  string
+	// The revision of the previous release. Defaults to the latest version
+	// tag in the history of the revision
+	baseRevision string
+	tagPrefix    string
+	// The heading of the notes (e.g. the version tag)
+	title string
+	// The web url of the repo, for the PR and commit links. Defaults to the
+	// url of the origin remote
+	repoUrl       string
+	prUrlTemplate string
+	// The sections to leave out of the notes (e.g. chore)
+	excludeSections []string
+	markdownFile    string
+	jsonFile        string
+	gitPath         string
+}
+
+// The release notes, which are written to the JSON file
+type releaseNotes struct {
+	Title        string `json:"title,omitempty"`
+	BaseRevision string `json:"baseRevision,omitempty"`
+	Revision     string `json:"revision"`
+	// The url of the diff between the base revision and the revision, if
+	// the repo url is known
+	CompareUrl string             `json:"compareUrl,omitempty"`
+	Sections   []releaseNoteGroup `json:"sections"`
+	// The notes as Markdown, for the GitHub Releases
+	Markdown string `json:"markdown"`
+	// The notes as Slack mrkdwn, for the Slack announcements
+	SlackText string `json:"slackText"`
+}
+
+// The commits of a section of the notes
+type releaseNoteGroup struct {
+	// The conventional commit type, or breaking or other
+	Type    string             `json:"type"`
+	Title   string             `json:"title"`
+	Entries []releaseNoteEntry `json:"entries"`
+}
+
+// A commit of the notes
+type releaseNoteEntry struct {
+	Hash        string `json:"hash"`
+	ShortHash   string `json:"shortHash"`
+	Scope       string `json:"scope,omitempty"`
+	Description string `json:"description"`
+	// The description of the breaking change, if the commit has one
+	BreakingNote string `json:"breakingNote,omitempty"`
+	PrNumber     int    `json:"prNumber,omitempty"`
+	PrUrl        string `json:"prUrl,omitempty"`
+	CommitUrl    string `json:"commitUrl,omitempty"`
+}
+
+func getNotesOptions(flags *pflag.FlagSet) (notesOptions, error) {
+	var opts notesOptions
+	var err error
+
+	opts.clonePath, err = flags.GetString("clone-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes clone-path flag")
+	}
+
+	opts.revision, err = flags.GetString("revision-hash")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes revision-hash flag")
+	}
+
+	opts.baseRevision, err = flags.GetString("base-revision-hash")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes base-revision-hash flag")
+	}
+
+	opts.tagPrefix, err = flags.GetString("tag-prefix")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes tag-prefix flag")
+	}
+
+	opts.title, err = flags.GetString("title")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes title flag")
+	}
+
+	opts.repoUrl, err = flags.GetString("repo-url")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes repo-url flag")
+	}
+
+	opts.prUrlTemplate, err = flags.GetString("pr-url-template")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes pr-url-template flag")
+	}
+	if opts.prUrlTemplate != "" && !strings.Contains(opts.prUrlTemplate, PR_NUMBER_PLACEHOLDER) {
+		return opts, fmt.Errorf("pr-url-template must contain %s: %s", PR_NUMBER_PLACEHOLDER, opts.prUrlTemplate)
+	}
+
+	opts.excludeSections, err = flags.GetStringArray("exclude-section")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes exclude-section flag")
+	}
+	for _, excludeSection := range opts.excludeSections {
+		if !slices.ContainsFunc(noteSections, func(s noteSection) bool { return s.commitType == excludeSection }) {
+			return opts, fmt.Errorf("exclude-section must be one of %s: %s", getNoteSectionTypes(), excludeSection)
+		}
+	}
+
+	opts.markdownFile, err = flags.GetString("markdown-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes markdown-file flag")
+	}
+
+	opts.jsonFile, err = flags.GetString("json-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes json-file flag")
+	}
+	if opts.markdownFile == "" && opts.jsonFile == "" {
+		return opts, fmt.Errorf("markdown-file or json-file must be set")
+	}
+
+	opts.gitPath, err = flags.GetString("git-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing notes git-path flag")
+	}
+	return opts, nil
+}
+
+func (opts notesOptions) logAttrs() []any {
+	return []any{
+		"clonePath", opts.clonePath,
+		"revisionHash", opts.revision,
+		"baseRevisionHash", opts.baseRevision,
+		"tagPrefix", opts.tagPrefix,
+		"title", opts.title,
+		"repoUrl", opts.repoUrl,
+		"prUrlTemplate", opts.prUrlTemplate,
+		"excludeSections", opts.excludeSections,
+		"markdownFile", opts.markdownFile,
+		"jsonFile", opts.jsonFile,
+		"gitPath", opts.gitPath,
+	}
+}
+
+// Returns the types of the note sections, for the flag usage
+func getNoteSectionTypes() []string {
+	types := []string{}
+	for _, section := range noteSections {
+		types = append(types, section.commitType)
+	}
+	return types
+}
+
+// Returns the release notes of the commits between the base revision and
+// the revision, grouped by the conventional commit type
+func (opts notesOptions) generateNotes(ctx context.Context) (releaseNotes, error) {
+	notes := releaseNotes{Title: opts.title}
+	hash, err := getCommitHash(ctx, opts.gitPath, opts.clonePath, opts.revision)
+	if err != nil {
+		return notes, err
+	}
+	notes.Revision = hash
+
+	notes.BaseRevision = opts.baseRevision
+	if notes.BaseRevision == "" {
+		notes.BaseRevision, err = getPreviousVersionTag(ctx, opts.gitPath, opts.clonePath, opts.tagPrefix, hash)
+		if err != nil {
+			return notes, err
+		}
+		if notes.BaseRevision == "" {
+			slog.Info("The history has no previous version tag, so all of the commits are in the notes")
+		} else {
+			slog.Info("Generating the notes since the previous version tag", "previousTag", notes.BaseRevision)
+		}
+	}
+
+	commits, err := getCommits(ctx, opts.gitPath, opts.clonePath, notes.BaseRevision, hash)
+	if err != nil {
+		return notes, err
+	}
+	mergedPrNumbers, err := getMergedPrNumbers(ctx, opts.gitPath, opts.clonePath, notes.BaseRevision, hash)
+	if err != nil {
+		return notes, err
+	}
+
+	repoUrl := opts.repoUrl
+	if repoUrl == "" {
+		repoUrl = getRepoWebUrl(getOriginUrl(ctx, opts.gitPath, opts.clonePath))
+	}
+	repoUrl = strings.TrimSuffix(repoUrl, "/")
+	prUrlTemplate := opts.prUrlTemplate
+	if prUrlTemplate == "" && repoUrl != "" {
+		prUrlTemplate = repoUrl + "/pull/" + PR_NUMBER_PLACEHOLDER
+	}
+	if repoUrl != "" && notes.BaseRevision != "" {
+		notes.CompareUrl = fmt.Sprintf("%s/compare/%s...%s", repoUrl, notes.BaseRevision, hash)
+	}
+
+	entriesByType := map[string][]releaseNoteEntry{}
+	for _, commit := range commits {
+		parsed := parseConventionalCommit(commit.message)
+		entry := releaseNoteEntry{
+			Hash:         commit.hash,
+			ShortHash:    commit.hash[:min(len(commit.hash), SHORT_HASH_LENGTH)],
+			Scope:        parsed.scope,
+			Description:  parsed.description,
+			BreakingNote: parsed.breakingNote,
+			PrNumber:     mergedPrNumbers[commit.hash],
+		}
+		// A squash merge has the PR number at the end of the description,
+		// which the link replaces
+		if prNumber, description := cutPrNumber(commit.message, entry.Description); prNumber != 0 {
+			entry.PrNumber = prNumber
+			entry.Description = description
+		}
+		if entry.PrNumber != 0 && prUrlTemplate != "" {
+			entry.PrUrl = strings.ReplaceAll(prUrlTemplate, PR_NUMBER_PLACEHOLDER, strconv.Itoa(entry.PrNumber))
+		}
+		if repoUrl != "" {
+			entry.CommitUrl = repoUrl + "/commit/" + commit.hash
+		}
+
+		sectionType := getNoteSectionType(parsed)
+		entriesByType[sectionType] = append(entriesByType[sectionType], entry)
+	}
+
+	notes.Sections = []releaseNoteGroup{}
+	for _, section := range noteSections {
+		entries := entriesByType[section.commitType]
+		if len(entries) == 0 || slices.Contains(opts.excludeSections, section.commitType) {
+			continue
+		}
+		// The commits are listed from the oldest, as they were merged
+		slices.Reverse(entries)
+		notes.Sections = append(notes.Sections, releaseNoteGroup{
+			Type:    section.commitType,
+			Title:   section.title,
+			Entries: entries,
+		})
+	}
+	notes.Markdown = notes.renderMarkdown()
+	notes.SlackText = notes.renderSlackText()
+	return notes, nil
+}
+
+// Writes the notes to the Markdown file and the JSON file
+func (opts notesOptions) writeNotes(notes releaseNotes) error {
+	if opts.markdownFile != "" {
+		err := writeOutputFile(opts.markdownFile, []byte(notes.Markdown))
+		if err != nil {
+			return err
+		}
+	}
+	if opts.jsonFile != "" {
+		bytes, err := json.MarshalIndent(notes, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error marshalling release notes: %s", err)
+		}
+		err = writeOutputFile(opts.jsonFile, append(bytes, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the section of the commit. The breaking changes are in their own
+// section, so they stand out
+func getNoteSectionType(parsed conventionalCommit) string {
+	if parsed.breaking {
+		return BREAKING_SECTION
+	}
+	for _, section := range noteSections {
+		if section.commitType == parsed.commitType && parsed.commitType != BREAKING_SECTION {
+			return section.commitType
+		}
+	}
+	return OTHER_SECTION
+}
+
+// Returns the previous version tag of the revision, which is the latest
+// version tag in its history that is not on the revision itself, or empty if
+// there is none
+func getPreviousVersionTag(
+	ctx context.Context,
+	gitPath string,
+	clonePath string,
+	tagPrefix string,
+	revision string,
+) (string, error) {
+	tags, err := getVersionTags(ctx, gitPath, clonePath, tagPrefix, "--merged", revision)
+	if err != nil {
+		return "", err
+	}
+	pointingTags, err := getVersionTags(ctx, gitPath, clonePath, tagPrefix, "--points-at", revision)
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		if !slices.Contains(pointingTags, tag) {
+			return tag.name, nil
+		}
+	}
+	return "", nil
+}
+
+// Returns the PR number from the commit subject or message of a merged PR,
+// or 0 if it cannot be derived
+func getPrNumber(message string) int {
+	subject, _, _ := strings.Cut(message, "\n")
+	for _, prNumberRegexp := range prNumberSubjectRegexps {
+		if match := prNumberRegexp.FindStringSubmatch(subject); match != nil {
+			prNumber, _ := strconv.Atoi(match[1])
+			return prNumber
+		}
+	}
+	if match := prNumberMessageRegexp.FindStringSubmatch(message); match != nil {
+		prNumber, _ := strconv.Atoi(match[1])
+		return prNumber
+	}
+	return 0
+}
+
+// Returns the PR number of a commit, and the description without the PR
+// number suffix of a squash merge (e.g. Add the feature (#123))
+func cutPrNumber(message string, description string) (int, string) {
+	prNumber := getPrNumber(message)
+	if prNumber == 0 {
+		return 0, description
+	}
+	suffixRegexp := prNumberSubjectRegexps[1]
+	return prNumber, suffixRegexp.ReplaceAllString(description, "")
+}
+
+// Returns the web url of the repo from its git url (e.g.
+// git@github.com:org/repo.git is https://github.com/org/repo), or empty if
+// the url is not an http or ssh url. The credentials are removed
+func getRepoWebUrl(gitUrl string) string {
+	if gitUrl == "" {
+		return ""
+	}
+	if match := scpUrlRegexp.FindStringSubmatch(gitUrl); match != nil && !strings.Contains(gitUrl, "://") {
+		return "https://" + match[1] + "/" + strings.TrimSuffix(strings.TrimPrefix(match[2], "/"), ".git")
+	}
+	parsedUrl, err := url.Parse(gitUrl)
+	if err != nil || parsedUrl.Host == "" {
+		return ""
+	}
+	switch parsedUrl.Scheme {
+	case "http", "https", "ssh":
+	default:
+		return ""
+	}
+	webUrl := url.URL{
+		Scheme: "https",
+		Host:   parsedUrl.Hostname(),
+		Path:   strings.TrimSuffix(parsedUrl.Path, ".git"),
+	}
+	if parsedUrl.Scheme == "http" {
+		webUrl.Scheme = "http"
+		webUrl.Host = parsedUrl.Host
+	}
+	return webUrl.String()
+}
+
+// Returns the notes as Markdown, with a heading per section
+func (notes releaseNotes) renderMarkdown() string {
+	var sb strings.Builder
+	if notes.Title != "" {
+		fmt.Fprintf(&sb, "## %s\n\n", notes.Title)
+	}
+	if len(notes.Sections) == 0 {
+		sb.WriteString("No changes\n\n")
+	}
+	for _, section := range notes.Sections {
+		fmt.Fprintf(&sb, "### %s\n\n", section.Title)
+		for _, entry := range section.Entries {
+			sb.WriteString("- ")
+			if entry.Scope != "" {
+				fmt.Fprintf(&sb, "**%s:** ", entry.Scope)
+			}
+			sb.WriteString(entry.Description)
+			if entry.PrNumber != 0 {
+				sb.WriteString(" (" + markdownLink(fmt.Sprintf("#%d", entry.PrNumber), entry.PrUrl) + ")")
+			}
+			sb.WriteString(" (" + markdownLink(entry.ShortHash, entry.CommitUrl) + ")\n")
+			if entry.BreakingNote != "" {
+				fmt.Fprintf(&sb, "  - %s\n", entry.BreakingNote)
+			}
+		}
+		sb.WriteString("\n")
+	}
+	if notes.CompareUrl != "" {
+		fmt.Fprintf(&sb, "**Full Changelog**: %s\n", notes.CompareUrl)
+	}
+	return strings.TrimRight(sb.String(), "\n") + "\n"
+}
+
+// Returns the notes as Slack mrkdwn, with a bold line per section
+// See https://api.slack.com/reference/surfaces/formatting
+func (notes releaseNotes) renderSlackText() string {
+	var sb strings.Builder
+	if notes.Title != "" {
+		fmt.Fprintf(&sb, "*%s*\n", slackEscape(notes.Title))
+	}
+	if len(notes.Sections) == 0 {
+		sb.WriteString("No changes\n")
+	}
+	for _, section := range notes.Sections {
+		fmt.Fprintf(&sb, "*%s*\n", section.Title)
+		for _, entry := range section.Entries {
+			sb.WriteString("• ")
+			if entry.Scope != "" {
+				fmt.Fprintf(&sb, "*%s:* ", slackEscape(entry.Scope))
+			}
+			sb.WriteString(slackEscape(entry.Description))
+			if entry.PrNumber != 0 {
+				sb.WriteString(" (" + slackLink(fmt.Sprintf("#%d", entry.PrNumber), entry.PrUrl) + ")")
+			}
+			sb.WriteString("\n")
+		}
+	}
+	if notes.CompareUrl != "" {
+		sb.WriteString(slackLink("Full changelog", notes.CompareUrl) + "\n")
+	}
+	return sb.String()
+}
+
+func markdownLink(text string, linkUrl string) string {
+	if linkUrl == "" {
+		return text
+	}
+	return fmt.Sprintf("[%s](%s)", text, linkUrl)
+}
+
+func slackLink(text string, linkUrl string) string {
+	if linkUrl == "" {
+		return text
+	}
+	return fmt.Sprintf("<%s|%s>", linkUrl, text)
+}
+
+// Escapes the control characters of Slack mrkdwn
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
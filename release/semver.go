@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+const (
+	// The commits need no release
+	BUMP_NONE = "none"
+	// The commits fix bugs
+	BUMP_PATCH = "patch"
+	// The commits add features
+	BUMP_MINOR = "minor"
+	// The commits have breaking changes
+	BUMP_MAJOR = "major"
+)
+
+// The bumps, from the smallest to the largest
+var bumps = []string{BUMP_NONE, BUMP_PATCH, BUMP_MINOR, BUMP_MAJOR}
+
+// Matches a release version, without a pre-release or build metadata
+// See https://semver.org
+var semverRegexp = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)$`)
+
+// A release version
+type semver struct {
+	major int
+	minor int
+	patch int
+}
+
+func parseSemver(version string) (semver, bool) {
+	match := semverRegexp.FindStringSubmatch(version)
+	if match == nil {
+		return semver{}, false
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	patch, _ := strconv.Atoi(match[3])
+	return semver{major: major, minor: minor, patch: patch}, true
+}
+
+func (v semver) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+// Returns a negative number if v is lower than other, 0 if they are equal,
+// and a positive number if v is higher
+func (v semver) compare(other semver) int {
+	if v.major != other.major {
+		return v.major - other.major
+	}
+	if v.minor != other.minor {
+		return v.minor - other.minor
+	}
+	return v.patch - other.patch
+}
+
+// Returns the version with the bump applied
+func (v semver) bump(bump string) semver {
+	switch bump {
+	case BUMP_MAJOR:
+		return semver{major: v.major + 1}
+	case BUMP_MINOR:
+		return semver{major: v.major, minor: v.minor + 1}
+	case BUMP_PATCH:
+		return semver{major: v.major, minor: v.minor, patch: v.patch + 1}
+	}
+	return v
+}
+
+// Returns the larger of the bumps
+func maxBump(a string, b string) string {
+	if bumpIndex(a) >= bumpIndex(b) {
+		return a
+	}
+	return b
+}
+
+func bumpIndex(bump string) int {
+	for i, b := range bumps {
+		if b == bump {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		version   string
+		want      semver
+		wantValid bool
+	}{
+		{version: "1.2.3", want: semver{major: 1, minor: 2, patch: 3}, wantValid: true},
+		{version: "0.0.0", want: semver{}, wantValid: true},
+		{version: "10.20.30", want: semver{major: 10, minor: 20, patch: 30}, wantValid: true},
+		{version: "v1.2.3"},
+		{version: "1.2"},
+		{version: "01.2.3"},
+		{version: "1.2.3-rc.1"},
+		{version: "1.2.3+build"},
+	}
+	for _, tt := range tests {
+		got, valid := parseSemver(tt.version)
+		if valid != tt.wantValid || got != tt.want {
+			t.Errorf("parseSemver(%q) = %s, %t, want %s, %t", tt.version, got, valid, tt.want, tt.wantValid)
+		}
+	}
+}
+
+func TestSemverBump(t *testing.T) {
+	version := semver{major: 1, minor: 2, patch: 3}
+	tests := []struct {
+		bump string
+		want string
+	}{
+		{bump: BUMP_NONE, want: "1.2.3"},
+		{bump: BUMP_PATCH, want: "1.2.4"},
+		{bump: BUMP_MINOR, want: "1.3.0"},
+		// A major bump resets the minor and the patch versions
+		{bump: BUMP_MAJOR, want: "2.0.0"},
+	}
+	for _, tt := range tests {
+		got := version.bump(tt.bump).String()
+		if got != tt.want {
+			t.Errorf("bump(%q) = %s, want %s", tt.bump, got, tt.want)
+		}
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{a: "1.2.3", b: "1.2.3", want: 0},
+		{a: "1.10.0", b: "1.9.9", want: 1},
+		{a: "1.9.9", b: "2.0.0", want: -1},
+		{a: "1.2.10", b: "1.2.9", want: 1},
+	}
+	for _, tt := range tests {
+		a, _ := parseSemver(tt.a)
+		b, _ := parseSemver(tt.b)
+		got := a.compare(b)
+		if (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+			t.Errorf("compare(%s, %s) = %d, want the sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMaxBump(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want string
+	}{
+		{a: BUMP_NONE, b: BUMP_NONE, want: BUMP_NONE},
+		{a: BUMP_NONE, b: BUMP_PATCH, want: BUMP_PATCH},
+		{a: BUMP_MINOR, b: BUMP_PATCH, want: BUMP_MINOR},
+		{a: BUMP_MINOR, b: BUMP_MAJOR, want: BUMP_MAJOR},
+		{a: BUMP_MAJOR, b: BUMP_NONE, want: BUMP_MAJOR},
+	}
+	for _, tt := range tests {
+		got := maxBump(tt.a, tt.b)
+		if got != tt.want {
+			t.Errorf("maxBump(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default remote to push the tag to, which git-clone adds
+	DEFAULT_REMOTE = "origin"
+	// The default tagger of the annotated tags
+	DEFAULT_TAGGER_NAME  = "release"
+	DEFAULT_TAGGER_EMAIL = "release@localhost"
+)
+
+// The options for creating and pushing the tag of a revision
+type tagOptions struct {
+	clonePath string
+	revision  string
+	// The name of the tag. Set with the tag flag, or read from the version
+	// file with the tag prefix
+	tag         string
+	message     string
+	messageFile string
+	taggerName  string
+	taggerEmail string
+	remote      string
+	push        bool
+	auth        gitrepo.AuthOptions
+	gitPath     string
+}
+
+func getTagOptions(flags *pflag.FlagSet) (tagOptions, error) {
+	var opts tagOptions
+	var err error
+
+	opts.clonePath, err = flags.GetString("clone-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag clone-path flag")
+	}
+
+	opts.revision, err = flags.GetString("revision-hash")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag revision-hash flag")
+	}
+
+	opts.tag, err = flags.GetString("tag")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag tag flag")
+	}
+
+	versionFile, err := flags.GetString("version-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag version-file flag")
+	}
+
+	tagPrefix, err := flags.GetString("tag-prefix")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag tag-prefix flag")
+	}
+
+	if (opts.tag == "") == (versionFile == "") {
+		return opts, fmt.Errorf("exactly one of tag or version-file must be set")
+	}
+	if versionFile != "" {
+		bytes, err := os.ReadFile(versionFile)
+		if err != nil {
+			return opts, fmt.Errorf("error reading version file: %s", err)
+		}
+		version := strings.TrimSpace(string(bytes))
+		if version == "" {
+			return opts, fmt.Errorf("version file is empty, since the version step found nothing to release: %s", versionFile)
+		}
+		opts.tag = tagPrefix + version
+	}
+
+	opts.message, err = flags.GetString("message")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag message flag")
+	}
+
+	opts.messageFile, err = flags.GetString("message-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag message-file flag")
+	}
+	if opts.message != "" && opts.messageFile != "" {
+		return opts, fmt.Errorf("message and message-file cannot be set together")
+	}
+
+	opts.taggerName, err = flags.GetString("tagger-name")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag tagger-name flag")
+	}
+
+	opts.taggerEmail, err = flags.GetString("tagger-email")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag tagger-email flag")
+	}
+
+	opts.remote, err = flags.GetString("remote")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag remote flag")
+	}
+
+	opts.push, err = flags.GetBool("push")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag push flag")
+	}
+
+	opts.auth, err = gitrepo.GetAuthOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.gitPath, err = flags.GetString("git-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing tag git-path flag")
+	}
+	return opts, nil
+}
+
+func (opts tagOptions) logAttrs() []any {
+	attrs := []any{
+		"clonePath", opts.clonePath,
+		"revisionHash", opts.revision,
+		"tag", opts.tag,
+		"message", opts.message,
+		"messageFile", opts.messageFile,
+		"taggerName", opts.taggerName,
+		"taggerEmail", opts.taggerEmail,
+		"remote", opts.remote,
+		"push", opts.push,
+		"gitPath", opts.gitPath,
+	}
+	return append(attrs, opts.auth.LogAttrs()...)
+}
+
+// Creates the annotated tag at the revision and pushes it to the remote.
+// A tag that already points at the revision is kept, so a retry succeeds,
+// and a tag that points at another commit is an error
+func (opts tagOptions) createTag(ctx context.Context) error {
+	tagRef := "refs/tags/" + opts.tag
+	_, err := runGit(ctx, opts.gitPath, opts.clonePath, "check-ref-format", tagRef)
+	if err != nil {
+		return fmt.Errorf("invalid tag name %s: %s", opts.tag, err)
+	}
+
+	hash, err := getCommitHash(ctx, opts.gitPath, opts.clonePath, opts.revision)
+	if err != nil {
+		return err
+	}
+
+	var env []string
+	if opts.push {
+		remoteUrl, err := runGit(ctx, opts.gitPath, opts.clonePath, "config", "--get", "remote."+opts.remote+".url")
+		if err != nil {
+			return fmt.Errorf("error reading the url of remote %s: %s", opts.remote, err)
+		}
+		authEnv, cleanup, err := opts.auth.Env(strings.TrimSpace(remoteUrl))
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		env = append([]string{"GIT_TERMINAL_PROMPT=0"}, authEnv...)
+
+		remoteCommit, err := opts.getRemoteTagCommit(ctx, env, tagRef)
+		if err != nil {
+			return err
+		}
+		if remoteCommit == hash {
+			slog.Info("The tag already points at the revision in the remote", "tag", opts.tag, "remote", opts.remote)
+			return nil
+		}
+		if remoteCommit != "" {
+			return fmt.Errorf("tag %s already points at commit %s in remote %s, not %s", opts.tag, remoteCommit, opts.remote, hash)
+		}
+	}
+
+	localCommit, err := opts.getLocalTagCommit(ctx, tagRef)
+	if err != nil {
+		return err
+	}
+	switch localCommit {
+	case hash:
+		slog.Info("The tag already points at the revision", "tag", opts.tag)
+	case "":
+		err = opts.createAnnotatedTag(ctx, hash)
+		if err != nil {
+			return err
+		}
+		slog.Info("Created the tag", "tag", opts.tag, "commit", hash)
+	default:
+		return fmt.Errorf("tag %s already points at commit %s, not %s", opts.tag, localCommit, hash)
+	}
+
+	if !opts.push {
+		return nil
+	}
+	_, err = runGitEnv(ctx, opts.gitPath, opts.clonePath, env, "push", opts.remote, tagRef+":"+tagRef)
+	if err != nil {
+		// Another run may have pushed the tag since it was checked, which
+		// is a success if it points at the revision
+		remoteCommit, remoteErr := opts.getRemoteTagCommit(ctx, env, tagRef)
+		if remoteErr == nil && remoteCommit == hash {
+			slog.Info("The tag was pushed by another run", "tag", opts.tag, "remote", opts.remote)
+			return nil
+		}
+		return fmt.Errorf("error pushing tag %s: %s", opts.tag, err)
+	}
+	slog.Info("Pushed the tag", "tag", opts.tag, "remote", opts.remote)
+	return nil
+}
+
+// Creates the annotated tag with the message, which defaults to the tag name
+func (opts tagOptions) createAnnotatedTag(ctx context.Context, hash string) error {
+	args := []string{"tag", "--annotate", opts.tag, hash}
+	switch {
+	case opts.messageFile != "":
+		args = append(args, "--file", opts.messageFile)
+	case opts.message != "":
+		args = append(args, "--message", opts.message)
+	default:
+		args = append(args, "--message", "Release "+opts.tag)
+	}
+	// The tagger is the committer identity, since the clone may have no
+	// user config
+	env := []string{
+		"GIT_COMMITTER_NAME=" + opts.taggerName,
+		"GIT_COMMITTER_EMAIL=" + opts.taggerEmail,
+	}
+	_, err := runGitEnv(ctx, opts.gitPath, opts.clonePath, env, args...)
+	if err != nil {
+		return fmt.Errorf("error creating tag %s: %s", opts.tag, err)
+	}
+	return nil
+}
+
+// Returns the commit of the tag in the clone, or empty if there is no tag
+func (opts tagOptions) getLocalTagCommit(ctx context.Context, tagRef string) (string, error) {
+	output, err := runGit(ctx, opts.gitPath, opts.clonePath, "for-each-ref", "--format=%(objectname) %(*objectname)", tagRef)
+	if err != nil {
+		return "", fmt.Errorf("error reading tag %s: %s", opts.tag, err)
+	}
+	// An annotated tag has the commit as the peeled object, and a
+	// lightweight tag is the commit itself
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[len(fields)-1], nil
+}
+
+// Returns the commit of the tag in the remote, or empty if there is no tag
+func (opts tagOptions) getRemoteTagCommit(ctx context.Context, env []string, tagRef string) (string, error) {
+	output, err := runGitEnv(ctx, opts.gitPath, opts.clonePath, env, "ls-remote", opts.remote, tagRef, tagRef+"^{}")
+	if err != nil {
+		return "", fmt.Errorf("error reading tag %s from remote %s: %s", opts.tag, opts.remote, err)
+	}
+	commit := ""
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		// The peeled ref of an annotated tag is the commit, and the ref of a
+		// lightweight tag is the commit itself
+		if fields[1] == tagRef+"^{}" || commit == "" {
+			commit = fields[0]
+		}
+	}
+	return commit, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default prefix of the version tags (e.g. v1.2.3)
+	DEFAULT_TAG_PREFIX = "v"
+	// The default version when the revision has no version tag
+	DEFAULT_INITIAL_VERSION = "0.1.0"
+)
+
+// The options for computing the next version of the revision
+type versionOptions struct {
+	clonePath string
+	revision  string
+	tagPrefix string
+	// The version when the revision has no version tag
+	initialVersion semver
+	// The bump when the commits need no release (e.g. patch, so every
+	// commit has a new version)
+	defaultBump string
+	// The paths to write the version, and the JSON result, to
+	outputFile string
+	resultFile string
+	gitPath    string
+}
+
+// The computed version, which is written to the result file
+type versionResult struct {
+	// The version, without the tag prefix (e.g. 1.2.3)
+	Version string `json:"version"`
+	// The tag of the version (e.g. v1.2.3)
+	Tag             string `json:"tag"`
+	PreviousVersion string `json:"previousVersion,omitempty"`
+	PreviousTag     string `json:"previousTag,omitempty"`
+	// Whether the revision is released with the version. False if no commit
+	// since the previous version needs a release, in which case the version
+	// and the tag are empty, since the previous tag is on another commit
+	Release bool `json:"release"`
+	// One of none, patch, minor, or major
+	Bump string `json:"bump"`
+	// The number of commits since the previous tag
+	Commits int `json:"commits"`
+}
+
+// A version tag of the repo
+type versionTag struct {
+	name    string
+	version semver
+}
+
+func getVersionOptions(flags *pflag.FlagSet) (versionOptions, error) {
+	var opts versionOptions
+	var err error
+
+	opts.clonePath, err = flags.GetString("clone-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing version clone-path flag")
+	}
+
+	opts.revision, err = flags.GetString("revision-hash")
+	if err != nil {
+		return opts, fmt.Errorf("error processing version revision-hash flag")
+	}
+
+	opts.tagPrefix, err = flags.GetString("tag-prefix")
+	if err != nil {
+		return opts, fmt.Errorf("error processing version tag-prefix flag")
+	}
+
+	initialVersion, err := flags.GetString("initial-version")
+	if err != nil {
+		return opts, fmt.Errorf("error processing version initial-version flag")
+	}
+	var valid bool
+	opts.initialVersion, valid = parseSemver(initialVersion)
+	if !valid {
+		return opts, fmt.Errorf("initial-version must be a version in the format MAJOR.MINOR.PATCH: %s", initialVersion)
+	}
+
+	opts.defaultBump, err = flags.GetString("default-bump")
+	if err != nil {
+		return opts, fmt.Errorf("error processing version default-bump flag")
+	}
+	if !slices.Contains(bumps, opts.defaultBump) || opts.defaultBump == BUMP_MAJOR {
+		return opts, fmt.Errorf("default-bump must be one of %s: %s", bumps[:3], opts.defaultBump)
+	}
+
+	opts.outputFile, err = flags.GetString("output-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing version output-file flag")
+	}
+
+	opts.resultFile, err = flags.GetString("result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing version result-file flag")
+	}
+
+	opts.gitPath, err = flags.GetString("git-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing version git-path flag")
+	}
+	return opts, nil
+}
+
+func (opts versionOptions) logAttrs() []any {
+	return []any{
+		"clonePath", opts.clonePath,
+		"revisionHash", opts.revision,
+		"tagPrefix", opts.tagPrefix,
+		"initialVersion", opts.initialVersion,
+		"defaultBump", opts.defaultBump,
+		"outputFile", opts.outputFile,
+		"resultFile", opts.resultFile,
+		"gitPath", opts.gitPath,
+	}
+}
+
+// Returns the next version of the revision. The version is the latest
+// version tag of the history with the largest bump of the conventional
+// commits since it. A revision that already has a version tag keeps its
+// version, so a retry computes the same version
+func (opts versionOptions) computeVersion(ctx context.Context) (versionResult, error) {
+	result := versionResult{Bump: BUMP_NONE}
+	hash, err := getCommitHash(ctx, opts.gitPath, opts.clonePath, opts.revision)
+	if err != nil {
+		return result, err
+	}
+
+	pointingTags, err := getVersionTags(ctx, opts.gitPath, opts.clonePath, opts.tagPrefix, "--points-at", hash)
+	if err != nil {
+		return result, err
+	}
+	if len(pointingTags) > 0 {
+		tag := pointingTags[0]
+		slog.Info("The revision already has a version tag", "tag", tag.name)
+		result.Version = tag.version.String()
+		result.Tag = tag.name
+		result.Release = true
+		return result, nil
+	}
+
+	previousTag, err := getLatestVersionTag(ctx, opts.gitPath, opts.clonePath, opts.tagPrefix, hash)
+	if err != nil {
+		return result, err
+	}
+	if previousTag == nil {
+		commits, err := getCommits(ctx, opts.gitPath, opts.clonePath, "", hash)
+		if err != nil {
+			return result, err
+		}
+		slog.Info("The history has no version tag, so the initial version is used", "tagPrefix", opts.tagPrefix)
+		result.Version = opts.initialVersion.String()
+		result.Tag = opts.tagPrefix + result.Version
+		result.Release = true
+		result.Commits = len(commits)
+		return result, nil
+	}
+
+	commits, err := getCommits(ctx, opts.gitPath, opts.clonePath, previousTag.name, hash)
+	if err != nil {
+		return result, err
+	}
+	for _, commit := range commits {
+		parsed := parseConventionalCommit(commit.message)
+		slog.Debug("Read commit", "hash", commit.hash, "type", parsed.commitType, "bump", parsed.bump())
+		result.Bump = maxBump(result.Bump, parsed.bump())
+	}
+	if result.Bump == BUMP_NONE && len(commits) > 0 {
+		result.Bump = opts.defaultBump
+	}
+	result.PreviousVersion = previousTag.version.String()
+	result.PreviousTag = previousTag.name
+	result.Commits = len(commits)
+	if result.Bump == BUMP_NONE {
+		slog.Info("Nothing to release, since no commit since the previous version needs a release", "previousTag", previousTag.name)
+		return result, nil
+	}
+
+	result.Version = previousTag.version.bump(result.Bump).String()
+	result.Tag = opts.tagPrefix + result.Version
+	result.Release = true
+	return result, nil
+}
+
+// Writes the version to the output file, and the result to the result file.
+// The output file is empty if there is nothing to release
+func (opts versionOptions) writeResult(result versionResult) error {
+	version := ""
+	if result.Release {
+		version = result.Version + "\n"
+	}
+	err := writeOutputFile(opts.outputFile, []byte(version))
+	if err != nil {
+		return err
+	}
+	if opts.resultFile != "" {
+		bytes, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error marshalling version result: %s", err)
+		}
+		err = writeOutputFile(opts.resultFile, append(bytes, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the latest version tag in the history of the revision, or nil if
+// there is none
+func getLatestVersionTag(
+	ctx context.Context,
+	gitPath string,
+	clonePath string,
+	tagPrefix string,
+	revision string,
+) (*versionTag, error) {
+	tags, err := getVersionTags(ctx, gitPath, clonePath, tagPrefix, "--merged", revision)
+	if err != nil || len(tags) == 0 {
+		return nil, err
+	}
+	return &tags[0], nil
+}
+
+// Returns the version tags matching the filter (e.g. --merged HEAD), from
+// the highest to the lowest version. The tags that are not a release
+// version after the prefix are skipped
+func getVersionTags(
+	ctx context.Context,
+	gitPath string,
+	clonePath string,
+	tagPrefix string,
+	filter string,
+	revision string,
+) ([]versionTag, error) {
+	output, err := runGit(ctx, gitPath, clonePath, "tag", "--list", tagPrefix+"*", filter, revision)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the version tags: %s", err)
+	}
+
+	tags := []versionTag{}
+	for _, name := range strings.Fields(output) {
+		version, valid := parseSemver(strings.TrimPrefix(name, tagPrefix))
+		if valid {
+			tags = append(tags, versionTag{name: name, version: version})
+		}
+	}
+	slices.SortFunc(tags, func(a, b versionTag) int { return b.version.compare(a.version) })
+	return tags, nil
+}
+
+// Writes the output file, creating its dir
+func writeOutputFile(outputFile string, content []byte) error {
+	err := os.MkdirAll(filepath.Dir(outputFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating the dir of %s: %s", outputFile, err)
+	}
+	err = os.WriteFile(outputFile, content, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %s", outputFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestGetVersionTags(t *testing.T) {
+	clonePath := newTestRepo(t)
+	ctx := context.Background()
+
+	commitTest(t, clonePath, "feat: first")
+	for _, tag := range []string{"v1.2.0", "v1.10.0", "v1.9.3", "v2.0.0-rc.1", "vnext", "app/v3.0.0", "1.11.0"} {
+		gitTest(t, clonePath, "tag", tag)
+	}
+
+	// The tags are sorted by their version, and the tags that are not a
+	// release version after the prefix are skipped
+	tests := []struct {
+		tagPrefix string
+		want      []string
+	}{
+		{tagPrefix: "v", want: []string{"v1.10.0", "v1.9.3", "v1.2.0"}},
+		{tagPrefix: "app/v", want: []string{"app/v3.0.0"}},
+		{tagPrefix: "", want: []string{"1.11.0"}},
+		{tagPrefix: "other/v", want: []string{}},
+	}
+	for _, tt := range tests {
+		tags, err := getVersionTags(ctx, DEFAULT_GIT_PATH, clonePath, tt.tagPrefix, "--merged", "HEAD")
+		if err != nil {
+			t.Fatalf("getVersionTags() error = %v", err)
+		}
+		names := []string{}
+		for _, tag := range tags {
+			names = append(names, tag.name)
+		}
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("getVersionTags(%q) = %q, want %q", tt.tagPrefix, names, tt.want)
+		}
+	}
+}
+
+func TestComputeVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		tags        []string
+		messages    []string
+		defaultBump string
+		want        versionResult
+	}{
+		{
+			name:     "initial version",
+			messages: []string{"feat: first"},
+			want:     versionResult{Version: "0.1.0", Tag: "v0.1.0", Release: true, Bump: BUMP_NONE, Commits: 2},
+		},
+		{
+			name:     "feat",
+			tags:     []string{"v1.2.3"},
+			messages: []string{"fix: second", "feat: third"},
+			want: versionResult{
+				Version: "1.3.0", Tag: "v1.3.0", PreviousVersion: "1.2.3", PreviousTag: "v1.2.3",
+				Release: true, Bump: BUMP_MINOR, Commits: 2,
+			},
+		},
+		{
+			name:     "breaking change",
+			tags:     []string{"v1.2.3"},
+			messages: []string{"feat!: second", "fix: third"},
+			want: versionResult{
+				Version: "2.0.0", Tag: "v2.0.0", PreviousVersion: "1.2.3", PreviousTag: "v1.2.3",
+				Release: true, Bump: BUMP_MAJOR, Commits: 2,
+			},
+		},
+		{
+			name:     "no bump",
+			tags:     []string{"v1.2.3"},
+			messages: []string{"chore: second", "Update the README"},
+			want: versionResult{
+				PreviousVersion: "1.2.3", PreviousTag: "v1.2.3", Bump: BUMP_NONE, Commits: 2,
+			},
+		},
+		{
+			name:        "default bump",
+			tags:        []string{"v1.2.3"},
+			messages:    []string{"chore: second", "Update the README"},
+			defaultBump: BUMP_PATCH,
+			want: versionResult{
+				Version: "1.2.4", Tag: "v1.2.4", PreviousVersion: "1.2.3", PreviousTag: "v1.2.3",
+				Release: true, Bump: BUMP_PATCH, Commits: 2,
+			},
+		},
+		{
+			name:        "default bump without commits",
+			tags:        []string{"v1.2.3"},
+			defaultBump: BUMP_PATCH,
+			want:        versionResult{Version: "1.2.3", Tag: "v1.2.3", Release: true, Bump: BUMP_NONE},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clonePath := newTestRepo(t)
+			commitTest(t, clonePath, "feat: first")
+			for _, tag := range tt.tags {
+				gitTest(t, clonePath, "tag", tag)
+			}
+			for _, message := range tt.messages {
+				commitTest(t, clonePath, message)
+			}
+
+			opts := versionOptions{
+				clonePath:      clonePath,
+				revision:       "HEAD",
+				tagPrefix:      DEFAULT_TAG_PREFIX,
+				initialVersion: semver{minor: 1},
+				defaultBump:    BUMP_NONE,
+				gitPath:        DEFAULT_GIT_PATH,
+			}
+			if tt.defaultBump != "" {
+				opts.defaultBump = tt.defaultBump
+			}
+			result, err := opts.computeVersion(context.Background())
+			if err != nil {
+				t.Fatalf("computeVersion() error = %v", err)
+			}
+			if result != tt.want {
+				t.Errorf("computeVersion() = %+v, want %+v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		result versionResult
+		want   string
+	}{
+		{
+			name:   "release",
+			result: versionResult{Version: "1.3.0", Tag: "v1.3.0", Release: true, Bump: BUMP_MINOR},
+			want:   "1.3.0\n",
+		},
+		{
+			name:   "nothing to release",
+			result: versionResult{PreviousVersion: "1.2.3", PreviousTag: "v1.2.3", Bump: BUMP_NONE},
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := versionOptions{
+				outputFile: filepath.Join(dir, "out", "version"),
+				resultFile: filepath.Join(dir, "out", "result.json"),
+			}
+			err := opts.writeResult(tt.result)
+			if err != nil {
+				t.Fatalf("writeResult() error = %v", err)
+			}
+			version, err := os.ReadFile(opts.outputFile)
+			if err != nil {
+				t.Fatalf("error reading the output file: %s", err)
+			}
+			if string(version) != tt.want {
+				t.Errorf("got version %q, want %q", version, tt.want)
+			}
+			bytes, err := os.ReadFile(opts.resultFile)
+			if err != nil {
+				t.Fatalf("error reading the result file: %s", err)
+			}
+			var result versionResult
+			err = json.Unmarshal(bytes, &result)
+			if err != nil {
+				t.Fatalf("error unmarshalling the result file: %s", err)
+			}
+			if result != tt.result {
+				t.Errorf("got result %+v, want %+v", result, tt.result)
+			}
+		})
+	}
+}
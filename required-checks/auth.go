@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// The options for authenticating to the GitHub API. Either the token file
+// or the GitHub App is set
+type authOptions struct {
+	// The path to a file with the token (e.g. a mounted secret)
+	tokenFile string
+	// The GitHub App, whose installation access token for the repo is
+	// generated, as in the github-check step
+	appId      string
+	appKeyFile string
+}
+
+func configureAuthFlags(flags *pflag.FlagSet) {
+	flags.String("token-file", "", "The path to a file with the GitHub token. Cannot be set with app-id")
+	flags.String(
+		"app-id",
+		"",
+		"The id of the GitHub App, whose installation access token for the repo is used for the API requests")
+	flags.String("app-key-file", "", "The path to the private key of the GitHub App")
+}
+
+func getAuthOptions(flags *pflag.FlagSet) (authOptions, error) {
+	var opts authOptions
+	var err error
+
+	opts.tokenFile, err = flags.GetString("token-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing token-file flag")
+	}
+
+	opts.appId, err = flags.GetString("app-id")
+	if err != nil {
+		return opts, fmt.Errorf("error processing app-id flag")
+	}
+
+	opts.appKeyFile, err = flags.GetString("app-key-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing app-key-file flag")
+	}
+
+	if (opts.appId == "") != (opts.appKeyFile == "") {
+		return opts, fmt.Errorf("app-id and app-key-file must be set together")
+	}
+	if (opts.tokenFile == "") == (opts.appId == "") {
+		return opts, fmt.Errorf("exactly one of token-file or app-id must be set")
+	}
+	return opts, nil
+}
+
+func (opts authOptions) logAttrs() []any {
+	return []any{
+		"tokenFile", opts.tokenFile,
+		"appId", opts.appId,
+		"appKeyFile", opts.appKeyFile,
+	}
+}
+
+// Returns the token for the API requests to the repo
+func (opts authOptions) getToken(ctx context.Context, apiUrl string, repo string) (string, error) {
+	if opts.tokenFile != "" {
+		bytes, err := os.ReadFile(opts.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading token file: %s", err)
+		}
+		token := strings.TrimSpace(string(bytes))
+		if token == "" {
+			return "", fmt.Errorf("token file is empty: %s", opts.tokenFile)
+		}
+		return token, nil
+	}
+	return opts.getInstallationToken(ctx, apiUrl, repo)
+}
+
+// Returns an installation access token of the GitHub App for the repo
+// See https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-an-installation-access-token-for-a-github-app
+func (opts authOptions) getInstallationToken(ctx context.Context, apiUrl string, repo string) (string, error) {
+	jwt, err := opts.generateJwt()
+	if err != nil {
+		return "", err
+	}
+
+	respBody, err := doApiRequest(ctx, http.MethodGet, fmt.Sprintf("%s/repos/%s/installation", apiUrl, repo), "Bearer "+jwt)
+	if err != nil {
+		return "", fmt.Errorf("error getting the GitHub App installation of %s: %w", repo, err)
+	}
+	installation := struct {
+		Id int64 `json:"id"`
+	}{}
+	err = json.Unmarshal(respBody, &installation)
+	if err != nil || installation.Id == 0 {
+		return "", fmt.Errorf("no GitHub App installation found for %s", repo)
+	}
+
+	tokenUrl := fmt.Sprintf("%s/app/installations/%d/access_tokens", apiUrl, installation.Id)
+	respBody, err = doApiRequest(ctx, http.MethodPost, tokenUrl, "Bearer "+jwt)
+	if err != nil {
+		return "", fmt.Errorf("error generating the installation access token: %w", err)
+	}
+	response := struct {
+		Token string `json:"token"`
+	}{}
+	err = json.Unmarshal(respBody, &response)
+	if err != nil || response.Token == "" {
+		return "", fmt.Errorf("no installation access token was returned")
+	}
+	return response.Token, nil
+}
+
+// Returns the JWT of the GitHub App, which is valid for 10 minutes
+// See https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app
+func (opts authOptions) generateJwt() (string, error) {
+	key, err := readRsaPrivateKey(opts.appKeyFile)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "RS256"})
+	payload, _ := json.Marshal(map[string]any{
+		// Issued 60 seconds in the past, for the clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+		"iss": opts.appId,
+	})
+	headerPayload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(headerPayload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("error signing the GitHub App JWT: %s", err)
+	}
+	return headerPayload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Reads the RSA private key in the PKCS #1 format, which GitHub generates,
+// or in the PKCS #8 format
+func readRsaPrivateKey(keyFile string) (*rsa.PrivateKey, error) {
+	bytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading app key file: %s", err)
+	}
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, fmt.Errorf("app key file is not a PEM file: %s", keyFile)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing app key file: %s", err)
+	}
+	key, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("app key file is not an RSA private key: %s", keyFile)
+	}
+	return key, nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default maximum duration to wait for the required checks
+	DEFAULT_WAIT_TIMEOUT = 30 * time.Minute
+	// The default interval between the GitHub API polls
+	DEFAULT_WAIT_POLL_INTERVAL = 30 * time.Second
+
+	// The required checks and the branch protection allow the deploy
+	PASSED_STATUS = "Passed"
+	// A required check failed, or the PR cannot be merged as is
+	FAILED_STATUS = "Failed"
+	// A required check has not completed, and the wait is over or disabled
+	PENDING_STATUS = "Pending"
+
+	// The states of a required check
+	SUCCESS_STATE = "success"
+	FAILURE_STATE = "failure"
+	PENDING_STATE = "pending"
+
+	// The exit code when a required check failed, or the PR cannot be merged
+	CHECKS_FAILED_EXIT_CODE = 2
+	// The exit code when a required check is still pending
+	CHECKS_PENDING_EXIT_CODE = 3
+)
+
+var (
+	// The conclusions of a completed check run that satisfy a required check
+	successConclusions = []string{"success", "neutral", "skipped"}
+	// The mergeable states of a PR that block it regardless of the checks.
+	// A PR is behind when the protection requires it to be up to date with
+	// the base branch, and dirty when it has merge conflicts
+	blockingMergeableStates = map[string]string{
+		"behind": "the PR is not up to date with the base branch",
+		"dirty":  "the PR has merge conflicts",
+	}
+)
+
+// The options for checking the required checks of a revision
+type checksOptions struct {
+	apiUrl string
+	repo   string
+	// The PR, whose base branch protection and head revision are checked
+	prNumber int
+	// The branch whose protection applies. Defaults to the PR base branch
+	branch string
+	// The revision to check. Defaults to the PR head revision
+	revision string
+	// The checks to require in addition to the branch protection, and the
+	// checks to leave out (e.g. the check of the pipeline itself)
+	extraChecks  []string
+	ignoreChecks []string
+	wait         bool
+	timeout      time.Duration
+	pollInterval time.Duration
+	resultFile   string
+	auth         authOptions
+}
+
+// The result of the required checks, which is written to the result file
+type checksResult struct {
+	// One of Passed, Failed, or Pending
+	Status   string `json:"status"`
+	Reason   string `json:"reason"`
+	Branch   string `json:"branch"`
+	Revision string `json:"revision"`
+	PrNumber int    `json:"prNumber,omitempty"`
+	// The mergeable state of the PR (e.g. clean or behind)
+	MergeableState string        `json:"mergeableState,omitempty"`
+	Checks         []checkResult `json:"checks"`
+}
+
+// The state of a required check
+type checkResult struct {
+	Name string `json:"name"`
+	// One of success, failure, or pending
+	State string `json:"state"`
+	// The check run conclusion or status, or the commit status state, or
+	// missing if the check has not been reported
+	Detail string `json:"detail"`
+	Url    string `json:"url,omitempty"`
+}
+
+// A required check, from the branch protection, the rulesets, or the flags
+type requirement struct {
+	name string
+	// The app that must report the check, or 0 for any app
+	appId int64
+}
+
+// The error when the required checks do not pass, with the exit code of
+// the status
+type checksError struct {
+	result checksResult
+}
+
+func (e *checksError) Error() string {
+	if e.result.Status == PENDING_STATUS {
+		return fmt.Sprintf("the required checks are pending: %s", e.result.Reason)
+	}
+	return fmt.Sprintf("the required checks failed: %s", e.result.Reason)
+}
+
+func (e *checksError) exitCode() int {
+	if e.result.Status == PENDING_STATUS {
+		return CHECKS_PENDING_EXIT_CODE
+	}
+	return CHECKS_FAILED_EXIT_CODE
+}
+
+func getChecksOptions(flags *pflag.FlagSet) (checksOptions, error) {
+	var opts checksOptions
+	var err error
+
+	opts.apiUrl, err = flags.GetString("api-url")
+	if err != nil {
+		return opts, fmt.Errorf("error processing api-url flag")
+	}
+	opts.apiUrl = strings.TrimSuffix(opts.apiUrl, "/")
+
+	opts.repo, err = flags.GetString("repo")
+	if err != nil {
+		return opts, fmt.Errorf("error processing repo flag")
+	}
+	if strings.Count(opts.repo, "/") != 1 || strings.HasPrefix(opts.repo, "/") || strings.HasSuffix(opts.repo, "/") {
+		return opts, fmt.Errorf("repo must be the owner and name of the repo (e.g. org/repo): %s", opts.repo)
+	}
+
+	opts.prNumber, err = flags.GetInt("pr-number")
+	if err != nil {
+		return opts, fmt.Errorf("error processing pr-number flag")
+	}
+	if opts.prNumber < 0 {
+		return opts, fmt.Errorf("pr-number must be positive: %d", opts.prNumber)
+	}
+
+	opts.branch, err = flags.GetString("branch")
+	if err != nil {
+		return opts, fmt.Errorf("error processing branch flag")
+	}
+
+	opts.revision, err = flags.GetString("revision-hash")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revision-hash flag")
+	}
+	if opts.prNumber == 0 && (opts.branch == "" || opts.revision == "") {
+		return opts, fmt.Errorf("branch and revision-hash must be set without pr-number")
+	}
+
+	opts.extraChecks, err = flags.GetStringArray("check")
+	if err != nil {
+		return opts, fmt.Errorf("error processing check flag")
+	}
+
+	opts.ignoreChecks, err = flags.GetStringArray("ignore-check")
+	if err != nil {
+		return opts, fmt.Errorf("error processing ignore-check flag")
+	}
+
+	opts.wait, err = flags.GetBool("wait")
+	if err != nil {
+		return opts, fmt.Errorf("error processing wait flag")
+	}
+
+	opts.timeout, err = flags.GetDuration("timeout")
+	if err != nil {
+		return opts, fmt.Errorf("error processing timeout flag")
+	}
+	if opts.timeout <= 0 {
+		return opts, fmt.Errorf("timeout must be positive: %s", opts.timeout)
+	}
+
+	opts.pollInterval, err = flags.GetDuration("poll-interval")
+	if err != nil {
+		return opts, fmt.Errorf("error processing poll-interval flag")
+	}
+	if opts.pollInterval <= 0 {
+		return opts, fmt.Errorf("poll-interval must be positive: %s", opts.pollInterval)
+	}
+
+	opts.resultFile, err = flags.GetString("result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing result-file flag")
+	}
+
+	opts.auth, err = getAuthOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (opts checksOptions) logAttrs() []any {
+	attrs := []any{
+		"apiUrl", opts.apiUrl,
+		"repo", opts.repo,
+		"prNumber", opts.prNumber,
+		"branch", opts.branch,
+		"revisionHash", opts.revision,
+		"extraChecks", opts.extraChecks,
+		"ignoreChecks", opts.ignoreChecks,
+		"wait", opts.wait,
+		"timeout", opts.timeout,
+		"pollInterval", opts.pollInterval,
+		"resultFile", opts.resultFile,
+	}
+	return append(attrs, opts.auth.logAttrs()...)
+}
+
+// Checks the required checks of the revision. Without the wait, a pending
+// check blocks right away. With the wait, the checks are polled until they
+// pass, a check fails, or the timeout expires
+func (opts checksOptions) checkRequiredChecks(ctx context.Context) (checksResult, error) {
+	token, err := opts.auth.getToken(ctx, opts.apiUrl, opts.repo)
+	if err != nil {
+		return checksResult{}, err
+	}
+	client := githubClient{apiUrl: opts.apiUrl, repo: opts.repo, token: token}
+
+	startTime := time.Now()
+	deadline := startTime.Add(opts.timeout)
+	var requirements []requirement
+	for attempt := 1; ; attempt++ {
+		result, err := opts.getResult(ctx, client, &requirements)
+		if err != nil {
+			return result, err
+		}
+		slog.Info(
+			"Read the required checks",
+			"status", result.Status,
+			"reason", result.Reason,
+			"attempt", attempt,
+		)
+		if result.Status != PENDING_STATUS || !opts.wait {
+			return result, nil
+		}
+		if !time.Now().Before(deadline) {
+			result.Reason = fmt.Sprintf("%s after waiting %s", result.Reason, time.Since(startTime).Round(time.Second))
+			return result, nil
+		}
+
+		select {
+		case <-time.After(min(opts.pollInterval, time.Until(deadline))):
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+	}
+}
+
+// Returns the current result of the required checks. The requirements are
+// read on the first call, since the PR base branch is needed
+func (opts checksOptions) getResult(
+	ctx context.Context,
+	client githubClient,
+	requirements *[]requirement,
+) (checksResult, error) {
+	result := checksResult{
+		Branch:   opts.branch,
+		Revision: opts.revision,
+		PrNumber: opts.prNumber,
+		Checks:   []checkResult{},
+	}
+	if opts.prNumber != 0 {
+		pr, err := client.getPullRequest(ctx, opts.prNumber)
+		if err != nil {
+			return result, fmt.Errorf("error reading PR #%d: %w", opts.prNumber, err)
+		}
+		if result.Branch == "" {
+			result.Branch = pr.Base.Ref
+		}
+		if result.Revision == "" {
+			result.Revision = pr.Head.Sha
+		}
+		result.MergeableState = pr.MergeableState
+	}
+
+	if *requirements == nil {
+		var err error
+		*requirements, err = opts.getRequirements(ctx, client, result.Branch)
+		if err != nil {
+			return result, err
+		}
+		names := []string{}
+		for _, r := range *requirements {
+			names = append(names, r.name)
+		}
+		slog.Info("Read the required checks of the branch", "branch", result.Branch, "checks", names)
+	}
+
+	checkRuns, err := client.getCheckRuns(ctx, result.Revision)
+	if err != nil {
+		return result, fmt.Errorf("error reading the check runs of %s: %w", result.Revision, err)
+	}
+	statuses, err := client.getCommitStatuses(ctx, result.Revision)
+	if err != nil {
+		return result, fmt.Errorf("error reading the commit statuses of %s: %w", result.Revision, err)
+	}
+
+	failed := []string{}
+	pending := []string{}
+	for _, r := range *requirements {
+		check := r.getCheckResult(checkRuns, statuses)
+		result.Checks = append(result.Checks, check)
+		switch check.State {
+		case FAILURE_STATE:
+			failed = append(failed, check.Name)
+		case PENDING_STATE:
+			pending = append(pending, check.Name)
+		}
+	}
+
+	blockingReason, blocking := blockingMergeableStates[result.MergeableState]
+	switch {
+	case blocking:
+		result.Status = FAILED_STATUS
+		result.Reason = blockingReason
+	case len(failed) > 0:
+		result.Status = FAILED_STATUS
+		result.Reason = fmt.Sprintf("the checks failed: %s", strings.Join(failed, ", "))
+	case len(pending) > 0:
+		result.Status = PENDING_STATUS
+		result.Reason = fmt.Sprintf("the checks are not complete: %s", strings.Join(pending, ", "))
+	case len(result.Checks) == 0:
+		result.Status = PASSED_STATUS
+		result.Reason = "the branch has no required checks"
+	default:
+		result.Status = PASSED_STATUS
+		result.Reason = fmt.Sprintf("all of the %d required checks passed", len(result.Checks))
+	}
+	return result, nil
+}
+
+// Returns the required checks of the branch, from the branch protection and
+// the rulesets, with the checks of the flags. The ignored checks are left
+// out
+func (opts checksOptions) getRequirements(ctx context.Context, client githubClient, branchName string) ([]requirement, error) {
+	requirements := []requirement{}
+	add := func(name string, appId *int64) {
+		if slices.Contains(opts.ignoreChecks, name) {
+			slog.Info("Ignoring the required check", "check", name)
+			return
+		}
+		r := requirement{name: name}
+		if appId != nil && *appId > 0 {
+			r.appId = *appId
+		}
+		if !slices.ContainsFunc(requirements, func(other requirement) bool { return other.name == name }) {
+			requirements = append(requirements, r)
+		}
+	}
+
+	b, err := client.getBranch(ctx, branchName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading branch %s: %w", branchName, err)
+	}
+	statusChecks := b.Protection.RequiredStatusChecks
+	if b.Protected && statusChecks.EnforcementLevel != "off" {
+		for _, check := range statusChecks.Checks {
+			add(check.Context, check.AppId)
+		}
+		for _, checkContext := range statusChecks.Contexts {
+			add(checkContext, nil)
+		}
+	}
+
+	rules, err := client.getBranchRules(ctx, branchName)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.statusCode == http.StatusNotFound {
+		// The rulesets are not available on older GitHub Enterprise Server
+		// versions
+		slog.Warn("The branch rules are not available, so only the branch protection is checked", "error", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading the rules of branch %s: %w", branchName, err)
+	}
+	for _, rule := range rules {
+		if rule.Type != "required_status_checks" {
+			continue
+		}
+		for _, check := range rule.Parameters.RequiredStatusChecks {
+			add(check.Context, check.IntegrationId)
+		}
+	}
+
+	for _, check := range opts.extraChecks {
+		add(check, nil)
+	}
+	return requirements, nil
+}
+
+// Returns the state of the required check. A check run of the required app
+// takes precedence over a commit status with the same name
+func (r requirement) getCheckResult(checkRuns []checkRun, statuses []commitStatus) checkResult {
+	result := checkResult{Name: r.name, State: PENDING_STATE, Detail: "missing"}
+	for _, run := range checkRuns {
+		if run.Name != r.name || (r.appId != 0 && run.App.Id != r.appId) {
+			continue
+		}
+		result.Url = run.HtmlUrl
+		switch {
+		case run.Status != "completed":
+			result.Detail = run.Status
+		case slices.Contains(successConclusions, run.Conclusion):
+			result.State = SUCCESS_STATE
+			result.Detail = run.Conclusion
+		default:
+			result.State = FAILURE_STATE
+			result.Detail = run.Conclusion
+		}
+		return result
+	}
+	for _, status := range statuses {
+		if status.Context != r.name {
+			continue
+		}
+		result.Url = status.TargetUrl
+		result.Detail = status.State
+		switch status.State {
+		case "success":
+			result.State = SUCCESS_STATE
+		case "failure", "error":
+			result.State = FAILURE_STATE
+		}
+		return result
+	}
+	return result
+}
+
+// Writes the result to the result file as JSON
+func (opts checksOptions) writeResult(result checksResult) error {
+	if opts.resultFile == "" {
+		return nil
+	}
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling result file: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(opts.resultFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating result file dir: %s", err)
+	}
+	err = os.WriteFile(opts.resultFile, append(bytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing result file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Returns a fake GitHub API server with the JSON responses of the request
+// paths, without the query
+func newTestApi(t *testing.T, responses map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		response, found := responses[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Writes the token file of the fake GitHub API. Returns its path
+func writeTestTokenFile(t *testing.T) string {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("test-token\n"), 0600)
+	if err != nil {
+		t.Fatalf("error writing token file: %s", err)
+	}
+	return tokenFile
+}
+
+func TestGetChecksOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "pr", args: []string{"--pr-number", "12"}},
+		{name: "branch and revision", args: []string{"--branch", "main", "--revision-hash", "abc"}},
+		{
+			name:    "repo without the owner",
+			args:    []string{"--repo", "repo", "--pr-number", "12"},
+			wantErr: "repo must be the owner and name of the repo (e.g. org/repo): repo",
+		},
+		{
+			name:    "repo with a trailing slash",
+			args:    []string{"--repo", "org/", "--pr-number", "12"},
+			wantErr: "repo must be the owner and name of the repo (e.g. org/repo): org/",
+		},
+		{
+			name:    "negative pr number",
+			args:    []string{"--pr-number", "-1"},
+			wantErr: "pr-number must be positive: -1",
+		},
+		{
+			name:    "branch without the revision",
+			args:    []string{"--branch", "main"},
+			wantErr: "branch and revision-hash must be set without pr-number",
+		},
+		{
+			name:    "zero timeout",
+			args:    []string{"--pr-number", "12", "--timeout", "0s"},
+			wantErr: "timeout must be positive: 0s",
+		},
+		{
+			name:    "negative poll interval",
+			args:    []string{"--pr-number", "12", "--poll-interval", "-1s"},
+			wantErr: "poll-interval must be positive: -1s",
+		},
+		{
+			name:    "no token",
+			args:    []string{"--pr-number", "12", "--token-file", ""},
+			wantErr: "exactly one of token-file or app-id must be set",
+		},
+		{
+			name:    "token and app",
+			args:    []string{"--pr-number", "12", "--app-id", "1", "--app-key-file", "key.pem"},
+			wantErr: "exactly one of token-file or app-id must be set",
+		},
+		{
+			name:    "app without the key",
+			args:    []string{"--pr-number", "12", "--token-file", "", "--app-id", "1"},
+			wantErr: "app-id and app-key-file must be set together",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet("required-checks", pflag.ContinueOnError)
+			configureChecksFlags(flags)
+			args := append([]string{"--repo", "org/repo", "--token-file", "token"}, tt.args...)
+			err := flags.Parse(args)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			_, err = getChecksOptions(flags)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("getChecksOptions() error = %v", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("getChecksOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetCheckResult(t *testing.T) {
+	checkRuns := []checkRun{
+		{Name: "build", Status: "completed", Conclusion: "success", HtmlUrl: "https://ci/build"},
+		{Name: "lint", Status: "completed", Conclusion: "skipped"},
+		{Name: "test", Status: "completed", Conclusion: "failure"},
+		{Name: "e2e", Status: "in_progress"},
+	}
+	checkRuns[0].App.Id = 1
+	statuses := []commitStatus{
+		{Context: "build", State: "failure"},
+		{Context: "deploy", State: "error", TargetUrl: "https://ci/deploy"},
+		{Context: "docs", State: "pending"},
+	}
+	tests := []struct {
+		requirement requirement
+		want        checkResult
+	}{
+		// The check run takes precedence over the commit status
+		{requirement{name: "build"}, checkResult{Name: "build", State: SUCCESS_STATE, Detail: "success", Url: "https://ci/build"}},
+		{requirement{name: "build", appId: 1}, checkResult{Name: "build", State: SUCCESS_STATE, Detail: "success", Url: "https://ci/build"}},
+		// The check run of another app does not satisfy the check
+		{requirement{name: "build", appId: 2}, checkResult{Name: "build", State: FAILURE_STATE, Detail: "failure"}},
+		{requirement{name: "lint"}, checkResult{Name: "lint", State: SUCCESS_STATE, Detail: "skipped"}},
+		{requirement{name: "test"}, checkResult{Name: "test", State: FAILURE_STATE, Detail: "failure"}},
+		{requirement{name: "e2e"}, checkResult{Name: "e2e", State: PENDING_STATE, Detail: "in_progress"}},
+		{requirement{name: "deploy"}, checkResult{Name: "deploy", State: FAILURE_STATE, Detail: "error", Url: "https://ci/deploy"}},
+		{requirement{name: "docs"}, checkResult{Name: "docs", State: PENDING_STATE, Detail: "pending"}},
+		{requirement{name: "security"}, checkResult{Name: "security", State: PENDING_STATE, Detail: "missing"}},
+	}
+	for _, tt := range tests {
+		if got := tt.requirement.getCheckResult(checkRuns, statuses); got != tt.want {
+			t.Errorf("getCheckResult(%+v) = %+v, want %+v", tt.requirement, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRequiredChecks(t *testing.T) {
+	branchResponse := `{
+		"protected": true,
+		"protection": {
+			"required_status_checks": {
+				"enforcement_level": "everyone",
+				"contexts": ["build", "pipeline"],
+				"checks": [{"context": "build", "app_id": 1}, {"context": "pipeline", "app_id": null}]
+			}
+		}
+	}`
+	rulesResponse := `[
+		{"type": "pull_request"},
+		{"type": "required_status_checks", "parameters": {"required_status_checks": [{"context": "test"}]}}
+	]`
+	tests := []struct {
+		name           string
+		prResponse     string
+		rulesResponse  string
+		checkRuns      string
+		statuses       string
+		wantStatus     string
+		wantReason     string
+		wantBranch     string
+		wantChecks     []checkResult
+		wantMergeState string
+	}{
+		{
+			name:          "passed",
+			prResponse:    `{"number": 12, "mergeable_state": "clean", "head": {"sha": "abc"}, "base": {"ref": "main"}}`,
+			rulesResponse: rulesResponse,
+			checkRuns: `{"check_runs": [
+				{"name": "build", "status": "completed", "conclusion": "success", "app": {"id": 1}},
+				{"name": "test", "status": "completed", "conclusion": "success"},
+				{"name": "lint", "status": "completed", "conclusion": "failure"}
+			]}`,
+			statuses:       `{"statuses": [{"context": "release", "state": "success", "target_url": "https://ci/release"}]}`,
+			wantStatus:     PASSED_STATUS,
+			wantReason:     "all of the 3 required checks passed",
+			wantBranch:     "main",
+			wantMergeState: "clean",
+			wantChecks: []checkResult{
+				{Name: "build", State: SUCCESS_STATE, Detail: "success"},
+				{Name: "test", State: SUCCESS_STATE, Detail: "success"},
+				{Name: "release", State: SUCCESS_STATE, Detail: "success", Url: "https://ci/release"},
+			},
+		},
+		{
+			name:       "failed",
+			prResponse: `{"number": 12, "mergeable_state": "blocked", "head": {"sha": "abc"}, "base": {"ref": "main"}}`,
+			// No rules response, as on older GitHub Enterprise Server versions,
+			// so only the branch protection is checked
+			checkRuns: `{"check_runs": [
+				{"name": "build", "status": "completed", "conclusion": "failure", "app": {"id": 1}},
+				{"name": "release", "status": "queued"}
+			]}`,
+			wantStatus:     FAILED_STATUS,
+			wantReason:     "the checks failed: build",
+			wantBranch:     "main",
+			wantMergeState: "blocked",
+			wantChecks: []checkResult{
+				{Name: "build", State: FAILURE_STATE, Detail: "failure"},
+				{Name: "release", State: PENDING_STATE, Detail: "queued"},
+			},
+		},
+		{
+			name:          "pending",
+			prResponse:    `{"number": 12, "mergeable_state": "unstable", "head": {"sha": "abc"}, "base": {"ref": "main"}}`,
+			rulesResponse: rulesResponse,
+			checkRuns:     `{"check_runs": [{"name": "build", "status": "completed", "conclusion": "success", "app": {"id": 1}}]}`,
+			wantStatus:    PENDING_STATUS,
+			wantReason:    "the checks are not complete: test, release",
+			wantBranch:    "main",
+			wantChecks: []checkResult{
+				{Name: "build", State: SUCCESS_STATE, Detail: "success"},
+				{Name: "test", State: PENDING_STATE, Detail: "missing"},
+				{Name: "release", State: PENDING_STATE, Detail: "missing"},
+			},
+			wantMergeState: "unstable",
+		},
+		{
+			name:          "behind",
+			prResponse:    `{"number": 12, "mergeable_state": "behind", "head": {"sha": "abc"}, "base": {"ref": "main"}}`,
+			rulesResponse: rulesResponse,
+			checkRuns: `{"check_runs": [
+				{"name": "build", "status": "completed", "conclusion": "success", "app": {"id": 1}},
+				{"name": "test", "status": "completed", "conclusion": "success"},
+				{"name": "release", "status": "completed", "conclusion": "success"}
+			]}`,
+			wantStatus:     FAILED_STATUS,
+			wantReason:     "the PR is not up to date with the base branch",
+			wantBranch:     "main",
+			wantMergeState: "behind",
+			wantChecks: []checkResult{
+				{Name: "build", State: SUCCESS_STATE, Detail: "success"},
+				{Name: "test", State: SUCCESS_STATE, Detail: "success"},
+				{Name: "release", State: SUCCESS_STATE, Detail: "success"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{
+				"/repos/org/repo/pulls/12":               tt.prResponse,
+				"/repos/org/repo/branches/main":          branchResponse,
+				"/repos/org/repo/commits/abc/check-runs": tt.checkRuns,
+				"/repos/org/repo/commits/abc/status":     `{"statuses": []}`,
+			}
+			if tt.statuses != "" {
+				responses["/repos/org/repo/commits/abc/status"] = tt.statuses
+			}
+			if tt.rulesResponse != "" {
+				responses["/repos/org/repo/rules/branches/main"] = tt.rulesResponse
+			}
+			server := newTestApi(t, responses)
+
+			opts := checksOptions{
+				apiUrl:       server.URL,
+				repo:         "org/repo",
+				prNumber:     12,
+				extraChecks:  []string{"release"},
+				ignoreChecks: []string{"pipeline"},
+				timeout:      time.Minute,
+				pollInterval: time.Second,
+				resultFile:   filepath.Join(t.TempDir(), "result", "checks.json"),
+				auth:         authOptions{tokenFile: writeTestTokenFile(t)},
+			}
+			result, err := opts.checkRequiredChecks(context.Background())
+			if err != nil {
+				t.Fatalf("checkRequiredChecks() error = %v", err)
+			}
+			want := checksResult{
+				Status:         tt.wantStatus,
+				Reason:         tt.wantReason,
+				Branch:         tt.wantBranch,
+				Revision:       "abc",
+				PrNumber:       12,
+				MergeableState: tt.wantMergeState,
+				Checks:         tt.wantChecks,
+			}
+			if !reflect.DeepEqual(result, want) {
+				t.Errorf("checkRequiredChecks() = %+v, want %+v", result, want)
+			}
+
+			err = opts.writeResult(result)
+			if err != nil {
+				t.Fatalf("writeResult() error = %v", err)
+			}
+			content, err := os.ReadFile(opts.resultFile)
+			if err != nil {
+				t.Fatalf("error reading result file: %s", err)
+			}
+			var got checksResult
+			err = json.Unmarshal(content, &got)
+			if err != nil {
+				t.Fatalf("error unmarshalling result file: %s", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got result file %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCheckRequiredChecksWait(t *testing.T) {
+	branchResponse := `{"protected": true, "protection": {"required_status_checks": {"contexts": ["build"]}}}`
+	server := newTestApi(t, map[string]string{
+		"/repos/org/repo/branches/main":          branchResponse,
+		"/repos/org/repo/rules/branches/main":    `[]`,
+		"/repos/org/repo/commits/abc/check-runs": `{"check_runs": [{"name": "build", "status": "in_progress"}]}`,
+		"/repos/org/repo/commits/abc/status":     `{"statuses": []}`,
+	})
+
+	opts := checksOptions{
+		apiUrl:       server.URL,
+		repo:         "org/repo",
+		branch:       "main",
+		revision:     "abc",
+		wait:         true,
+		timeout:      50 * time.Millisecond,
+		pollInterval: 10 * time.Millisecond,
+		auth:         authOptions{tokenFile: writeTestTokenFile(t)},
+	}
+	result, err := opts.checkRequiredChecks(context.Background())
+	if err != nil {
+		t.Fatalf("checkRequiredChecks() error = %v", err)
+	}
+	if result.Status != PENDING_STATUS {
+		t.Errorf("got status %s, want %s", result.Status, PENDING_STATUS)
+	}
+	checksErr := &checksError{result: result}
+	if checksErr.exitCode() != CHECKS_PENDING_EXIT_CODE {
+		t.Errorf("got exit code %d, want %d", checksErr.exitCode(), CHECKS_PENDING_EXIT_CODE)
+	}
+
+	// No result file is written without the flag
+	err = opts.writeResult(result)
+	if err != nil {
+		t.Errorf("writeResult() error = %v", err)
+	}
+}
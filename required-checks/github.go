@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// The default url of the GitHub API. GitHub Enterprise Server has the
+	// API under /api/v3 of its host
+	DEFAULT_API_URL = "https://api.github.com"
+	// The GitHub API version of the requests
+	// See https://docs.github.com/en/rest/about-the-rest-api/api-versions
+	API_VERSION = "2022-11-28"
+	// The timeout of each request to the GitHub API
+	API_REQUEST_TIMEOUT = 30 * time.Second
+	// The page size of the list requests, which is the maximum of the API
+	API_PAGE_SIZE = 100
+)
+
+// The client for the requests to the GitHub API
+var apiHttpClient = &http.Client{Timeout: API_REQUEST_TIMEOUT}
+
+// A client of the GitHub API for a repo
+type githubClient struct {
+	apiUrl string
+	// The owner and name of the repo (e.g. org/repo)
+	repo  string
+	token string
+}
+
+// The fields of a pull request
+// See https://docs.github.com/en/rest/pulls/pulls#get-a-pull-request
+type pullRequest struct {
+	Number int    `json:"number"`
+	State  string `json:"state"`
+	Draft  bool   `json:"draft"`
+	// One of clean, blocked, behind, dirty, draft, has_hooks, unknown, or
+	// unstable. It is computed in the background, so it can be unknown
+	MergeableState string `json:"mergeable_state"`
+	Head           struct {
+		Sha string `json:"sha"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+// The fields of a branch with its protection
+// See https://docs.github.com/en/rest/branches/branches#get-a-branch
+type branch struct {
+	Protected  bool `json:"protected"`
+	Protection struct {
+		RequiredStatusChecks struct {
+			// One of off, non_admins, or everyone
+			EnforcementLevel string          `json:"enforcement_level"`
+			Contexts         []string        `json:"contexts"`
+			Checks           []requiredCheck `json:"checks"`
+		} `json:"required_status_checks"`
+	} `json:"protection"`
+}
+
+// A required status check of the branch protection
+type requiredCheck struct {
+	Context string `json:"context"`
+	// The app that must set the check, or unset for any app
+	AppId *int64 `json:"app_id"`
+}
+
+// A rule of the rulesets that apply to a branch
+// See https://docs.github.com/en/rest/repos/rules#get-rules-for-a-branch
+type branchRule struct {
+	Type       string `json:"type"`
+	Parameters struct {
+		RequiredStatusChecks []struct {
+			Context       string `json:"context"`
+			IntegrationId *int64 `json:"integration_id"`
+		} `json:"required_status_checks"`
+	} `json:"parameters"`
+}
+
+// A check run of a commit
+// See https://docs.github.com/en/rest/checks/runs#list-check-runs-for-a-git-reference
+type checkRun struct {
+	Name string `json:"name"`
+	// One of queued, in_progress, completed, waiting, requested, or pending
+	Status string `json:"status"`
+	// Set when the status is completed (e.g. success or failure)
+	Conclusion string `json:"conclusion"`
+	HtmlUrl    string `json:"html_url"`
+	App        struct {
+		Id int64 `json:"id"`
+	} `json:"app"`
+}
+
+// A commit status, which is the latest status of its context
+// See https://docs.github.com/en/rest/commits/statuses#get-the-combined-status-for-a-specific-reference
+type commitStatus struct {
+	Context string `json:"context"`
+	// One of error, failure, pending, or success
+	State     string `json:"state"`
+	TargetUrl string `json:"target_url"`
+}
+
+func (c githubClient) getPullRequest(ctx context.Context, number int) (pullRequest, error) {
+	pr := pullRequest{}
+	err := c.get(ctx, fmt.Sprintf("/repos/%s/pulls/%d", c.repo, number), &pr)
+	return pr, err
+}
+
+func (c githubClient) getBranch(ctx context.Context, name string) (branch, error) {
+	b := branch{}
+	err := c.get(ctx, fmt.Sprintf("/repos/%s/branches/%s", c.repo, url.PathEscape(name)), &b)
+	return b, err
+}
+
+// Returns the ruleset rules that apply to the branch
+func (c githubClient) getBranchRules(ctx context.Context, name string) ([]branchRule, error) {
+	rules := []branchRule{}
+	for page := 1; ; page++ {
+		pageRules := []branchRule{}
+		path := fmt.Sprintf("/repos/%s/rules/branches/%s?per_page=%d&page=%d", c.repo, url.PathEscape(name), API_PAGE_SIZE, page)
+		err := c.get(ctx, path, &pageRules)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, pageRules...)
+		if len(pageRules) < API_PAGE_SIZE {
+			return rules, nil
+		}
+	}
+}
+
+// Returns the latest check runs of the commit, by name
+func (c githubClient) getCheckRuns(ctx context.Context, sha string) ([]checkRun, error) {
+	checkRuns := []checkRun{}
+	for page := 1; ; page++ {
+		response := struct {
+			CheckRuns []checkRun `json:"check_runs"`
+		}{}
+		path := fmt.Sprintf("/repos/%s/commits/%s/check-runs?filter=latest&per_page=%d&page=%d", c.repo, sha, API_PAGE_SIZE, page)
+		err := c.get(ctx, path, &response)
+		if err != nil {
+			return nil, err
+		}
+		checkRuns = append(checkRuns, response.CheckRuns...)
+		if len(response.CheckRuns) < API_PAGE_SIZE {
+			return checkRuns, nil
+		}
+	}
+}
+
+// Returns the latest commit status of each context of the commit
+func (c githubClient) getCommitStatuses(ctx context.Context, sha string) ([]commitStatus, error) {
+	statuses := []commitStatus{}
+	for page := 1; ; page++ {
+		response := struct {
+			Statuses []commitStatus `json:"statuses"`
+		}{}
+		path := fmt.Sprintf("/repos/%s/commits/%s/status?per_page=%d&page=%d", c.repo, sha, API_PAGE_SIZE, page)
+		err := c.get(ctx, path, &response)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, response.Statuses...)
+		if len(response.Statuses) < API_PAGE_SIZE {
+			return statuses, nil
+		}
+	}
+}
+
+// Sends the GET request to the API path and decodes the JSON response
+func (c githubClient) get(ctx context.Context, path string, response any) error {
+	respBody, err := doApiRequest(ctx, http.MethodGet, c.apiUrl+path, "token "+c.token)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(respBody, response)
+	if err != nil {
+		return fmt.Errorf("error parsing the response of %s: %s", path, err)
+	}
+	return nil
+}
+
+// Sends the request to the GitHub API with the authorization header, and
+// returns the response body. A response that is not 2xx is an error
+func doApiRequest(ctx context.Context, method string, requestUrl string, authorization string) ([]byte, error) {
+	slog.Debug("Sending GitHub API request", "method", method, "url", requestUrl)
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("X-GitHub-Api-Version", API_VERSION)
+
+	resp, err := apiHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &apiError{
+			url:        req.URL.Redacted(),
+			statusCode: resp.StatusCode,
+			status:     resp.Status,
+			body:       strings.TrimSpace(string(respBody)),
+		}
+	}
+	return respBody, nil
+}
+
+// A response of the GitHub API that is not 2xx
+type apiError struct {
+	url        string
+	statusCode int
+	status     string
+	body       string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s returned %s: %s", e.url, e.status, e.body)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "required-checks"
+
+var mainCmd = &cobra.Command{
+	Use:   "required-checks",
+	Short: "Block until the required checks of a revision pass",
+	Long: `Blocks until the required checks of a revision pass.
+The required status checks of the branch protection and the rulesets are read
+from GitHub, so a deploy does not race ahead of the other pipelines of the
+revision. A failed check, or a PR that is behind or has conflicts, fails right
+away, and a pending check fails unless the wait is set`,
+	PersistentPreRunE: loadFlagValues,
+	RunE:              handleMainCmd,
+}
+
+func configureCmds() {
+	configureChecksFlags(mainCmd.Flags())
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the API requests")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+}
+
+func configureChecksFlags(flags *pflag.FlagSet) {
+	flags.String("repo", "", "The owner and name of the GitHub repo (e.g. osoriano/deploy-steps)")
+	cobra.MarkFlagRequired(flags, "repo")
+
+	flags.Int("pr-number", 0, "The number of the PR, whose base branch protection and head revision are checked")
+
+	flags.String("branch", "", "The branch whose protection applies. Defaults to the base branch of the PR")
+
+	flags.String("revision-hash", "", "The revision id to check (e.g. commit sha hash). Defaults to the PR head")
+
+	flags.StringArray(
+		"check",
+		nil,
+		"The name of a check to require in addition to the branch protection. Can be repeated")
+
+	flags.StringArray(
+		"ignore-check",
+		nil,
+		"The name of a required check to leave out, such as the check of the running pipeline. Can be repeated")
+
+	flags.Bool("wait", false, "Whether to wait for the pending checks, instead of failing right away")
+
+	flags.Duration("timeout", DEFAULT_WAIT_TIMEOUT, "The maximum duration to wait for the pending checks")
+
+	flags.Duration("poll-interval", DEFAULT_WAIT_POLL_INTERVAL, "The interval between the GitHub API polls")
+
+	flags.String(
+		"result-file",
+		"",
+		"The path to write the result to as JSON, with the status and the state of each required check")
+
+	flags.String("api-url", DEFAULT_API_URL, "The url of the GitHub API (e.g. https://github.example.com/api/v3)")
+
+	configureAuthFlags(flags)
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	checksOpts, err := getChecksOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Required checks with params", checksOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	result, err := checksOpts.checkRequiredChecks(cmd.Context())
+	if err != nil {
+		return err
+	}
+	for _, check := range result.Checks {
+		slog.Info("Required check", "name", check.Name, "state", check.State, "detail", check.Detail, "url", check.Url)
+	}
+	err = checksOpts.writeResult(result)
+	if err != nil {
+		return err
+	}
+	if result.Status != PASSED_STATUS {
+		return &checksError{result: result}
+	}
+	slog.Info("The required checks passed", "reason", result.Reason)
+	return nil
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		var checksErr *checksError
+		if errors.As(err, &checksErr) {
+			os.Exit(checksErr.exitCode())
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/osoriano/deploy-steps/internal/gitrepo"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default author of the commits
+	DEFAULT_AUTHOR_NAME  = "rollback"
+	DEFAULT_AUTHOR_EMAIL = "rollback@localhost"
+)
+
+// The options for restoring the manifests repo to the good deploy
+type gitopsOptions struct {
+	branch gitrepo.BranchOptions
+	// The manifest files that the deploy updated, which are restored
+	files []string
+}
+
+// The restore of the manifest files to the manifests commit of the good
+// deploy
+type restoreChange struct {
+	branch string
+	files  []string
+	record deployRecord
+}
+
+func configureGitopsFlags(flags *pflag.FlagSet) {
+	flags.String(
+		"repo",
+		"",
+		"The manifests repo clone url for the gitops target (e.g. https://github.com/org/manifests.git)")
+	flags.String("branch", gitrepo.DEFAULT_BRANCH, "The branch of the manifests repo to roll back")
+	flags.StringArray(
+		"file",
+		nil,
+		"The path of a manifest file to restore, relative to the repo root. May be repeated")
+	flags.String("clone-path", "", "The path to clone the repo to. Must be empty or not exist. Defaults to a temp dir")
+	flags.String(
+		"commit-message",
+		"",
+		"The commit message. Defaults to \"Roll back <file> to `<version>`\", with the full version in the body")
+	flags.String("author-name", DEFAULT_AUTHOR_NAME, "The name of the commit author and committer")
+	flags.String("author-email", DEFAULT_AUTHOR_EMAIL, "The email of the commit author and committer")
+	flags.Bool("push", true, "Whether to push the commit. Set to false for a dry run")
+	flags.Int(
+		"push-attempts",
+		gitrepo.DEFAULT_PUSH_ATTEMPTS,
+		"The number of push attempts. A rejected push restores the files again on the branch tip")
+	flags.String("git-path", gitrepo.DEFAULT_GIT_PATH, "The path to the git executable")
+	gitrepo.ConfigureAuthFlags(flags)
+}
+
+func getGitopsOptions(flags *pflag.FlagSet) (gitopsOptions, error) {
+	var opts gitopsOptions
+	var err error
+
+	opts.branch, err = gitrepo.GetBranchOptions(flags)
+	if err != nil {
+		return opts, err
+	}
+	if opts.branch.Repo() == "" {
+		return opts, fmt.Errorf("repo must be set for the gitops target")
+	}
+
+	opts.files, err = flags.GetStringArray("file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert file flag")
+	}
+	if len(opts.files) == 0 {
+		return opts, fmt.Errorf("file must be set for the gitops target")
+	}
+	return opts, nil
+}
+
+func (opts gitopsOptions) logAttrs() []any {
+	return append(opts.branch.LogAttrs(), "files", opts.files)
+}
+
+// Clones the branch of the manifests repo, restores the files to the
+// manifests commit of the good deploy, and commits and pushes the change,
+// so Argo CD syncs the good version. The history of the branch is kept, so
+// the rollback is a new commit rather than a force push
+func (opts gitopsOptions) revertManifests(
+	ctx context.Context,
+	record deployRecord,
+	result revertResult,
+) (revertResult, error) {
+	if record.ManifestsCommit == "" {
+		return result, fmt.Errorf("the rollback target has no manifests commit, so the gitops target cannot restore it")
+	}
+	change := restoreChange{branch: opts.branch.Branch(), files: opts.files, record: record}
+
+	// The manifests commit is in the history of the branch, so the clone is
+	// not shallow. The blobs are fetched only for the checked out files
+	git, cleanup, err := opts.branch.Clone(ctx, "rollback-", "--filter=blob:none")
+	defer cleanup()
+	if err != nil {
+		return result, err
+	}
+
+	branchResult, err := opts.branch.CommitChange(ctx, git, change)
+	result = withBranchResult(result, branchResult)
+	if err != nil || !branchResult.Changed {
+		return result, err
+	}
+
+	if !opts.branch.Push() {
+		slog.Info("Skipping the push", "commit", result.Commit)
+		return result, nil
+	}
+	branchResult, err = opts.branch.PushBranch(ctx, git, change, branchResult)
+	return withBranchResult(result, branchResult), err
+}
+
+// Returns the result with the files, the commit, and the push of the branch
+// result
+func withBranchResult(result revertResult, branchResult gitrepo.BranchResult) revertResult {
+	result.Changed = branchResult.Changed
+	result.Files = branchResult.Files
+	result.Commit = branchResult.Commit
+	result.Pushed = branchResult.Pushed
+	return result
+}
+
+// Restores the files to the manifests commit, and returns the paths of the
+// changed files. The manifests commit must be in the history of the branch,
+// so an unrelated commit is not deployed
+func (change restoreChange) Apply(ctx context.Context, git gitrepo.Runner) ([]string, error) {
+	_, err := git.Run(ctx, "merge-base", "--is-ancestor", change.record.ManifestsCommit, "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf(
+			"the manifests commit %s is not in the history of the branch %s: %s",
+			change.record.ManifestsCommit,
+			change.branch,
+			err)
+	}
+	_, err = git.Run(ctx, append([]string{"checkout", "--quiet", change.record.ManifestsCommit, "--"}, change.files...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := git.Run(ctx, append([]string{"status", "--porcelain", "--"}, change.files...)...)
+	if err != nil {
+		return nil, err
+	}
+	changedFiles := []string{}
+	for _, line := range strings.Split(strings.TrimRight(status, "\n"), "\n") {
+		if len(line) > 3 {
+			changedFiles = append(changedFiles, line[3:])
+		}
+	}
+	return changedFiles, nil
+}
+
+// Returns the commit message, which names the good version and the
+// manifests commit that the files are restored from
+func (change restoreChange) CommitMessage(files []string) string {
+	path := strings.Join(files, ", ")
+	return fmt.Sprintf(
+		"Roll back %s to `%s`\n\nRoll back resource %s to version:\n%s\n\nRestored from commit %s\n",
+		path,
+		change.record.getShortVersion(),
+		path,
+		change.record.getImageReference(),
+		change.record.ManifestsCommit)
+}
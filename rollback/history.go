@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default number of records that the history keeps
+	DEFAULT_MAX_RECORDS = 20
+)
+
+const (
+	// The docker-build result statuses whose image can be deployed. A skipped
+	// build reuses the image of a previous build, if it has one
+	BUILT_BUILD_STATUS   = "Built"
+	SKIPPED_BUILD_STATUS = "Skipped"
+)
+
+var deployableBuildStatuses = []string{BUILT_BUILD_STATUS, SKIPPED_BUILD_STATUS}
+
+// The history of the good deploys, which is written by the record
+// subcommand after the verification passes, and read by the revert
+// subcommand
+type history struct {
+	// The records, from the newest to the oldest
+	Records []deployRecord `json:"records"`
+}
+
+// A good deploy of an image
+type deployRecord struct {
+	// The image reference, including the tag
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+	// The commit of the manifests repo that deployed the image (e.g. from the
+	// gitops-update result), which the gitops rollback restores
+	ManifestsCommit string    `json:"manifestsCommit,omitempty"`
+	RecordedAt      time.Time `json:"recordedAt"`
+}
+
+// The options for recording a good deploy in the history
+type recordOptions struct {
+	historyFile string
+	record      deployRecord
+	maxRecords  int
+}
+
+func getRecordOptions(flags *pflag.FlagSet) (recordOptions, error) {
+	var opts recordOptions
+	var err error
+
+	opts.historyFile, err = flags.GetString("history-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing record history-file flag")
+	}
+
+	buildResultFile, err := flags.GetString("build-result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing record build-result-file flag")
+	}
+	if buildResultFile != "" {
+		opts.record.Image, opts.record.Digest, err = readBuildResultFile(buildResultFile)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	image, err := flags.GetString("image")
+	if err != nil {
+		return opts, fmt.Errorf("error processing record image flag")
+	}
+	if image != "" {
+		opts.record.Image = image
+	}
+
+	digest, err := flags.GetString("digest")
+	if err != nil {
+		return opts, fmt.Errorf("error processing record digest flag")
+	}
+	if digest != "" {
+		opts.record.Digest = digest
+	}
+	// A skipped build result without an image is allowed, and nothing is
+	// recorded for it
+	if opts.record.Image == "" && buildResultFile == "" {
+		return opts, fmt.Errorf("build-result-file or image must be set")
+	}
+
+	gitopsResultFile, err := flags.GetString("gitops-result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing record gitops-result-file flag")
+	}
+	if gitopsResultFile != "" {
+		opts.record.ManifestsCommit, err = readGitopsResultFile(gitopsResultFile)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	manifestsCommit, err := flags.GetString("manifests-commit")
+	if err != nil {
+		return opts, fmt.Errorf("error processing record manifests-commit flag")
+	}
+	if manifestsCommit != "" {
+		opts.record.ManifestsCommit = manifestsCommit
+	}
+
+	opts.maxRecords, err = flags.GetInt("max-records")
+	if err != nil {
+		return opts, fmt.Errorf("error processing record max-records flag")
+	}
+	if opts.maxRecords < 1 {
+		return opts, fmt.Errorf("max-records must be at least 1: %d", opts.maxRecords)
+	}
+	return opts, nil
+}
+
+func (opts recordOptions) logAttrs() []any {
+	return []any{
+		"historyFile", opts.historyFile,
+		"image", opts.record.Image,
+		"digest", opts.record.Digest,
+		"manifestsCommit", opts.record.ManifestsCommit,
+		"maxRecords", opts.maxRecords,
+	}
+}
+
+// Adds the record to the front of the history. A previous record of the
+// same image is replaced, so a redeploy of the image moves it to the front.
+// A record without an image, from a skipped build, is not added
+func (opts recordOptions) recordDeploy() error {
+	if opts.record.Image == "" {
+		slog.Info("The build was skipped without an image, so no deploy is recorded")
+		return nil
+	}
+	h, err := readHistoryFile(opts.historyFile)
+	if err != nil {
+		return err
+	}
+	record := opts.record
+	record.RecordedAt = time.Now().UTC()
+
+	records := []deployRecord{record}
+	for _, previous := range h.Records {
+		if !previous.isImage(record.Image, record.Digest) {
+			records = append(records, previous)
+		}
+	}
+	h.Records = records[:min(len(records), opts.maxRecords)]
+
+	err = writeHistoryFile(opts.historyFile, h)
+	if err != nil {
+		return err
+	}
+	slog.Info("Recorded the deploy", "image", record.Image, "digest", record.Digest, "records", len(h.Records))
+	return nil
+}
+
+// Returns the newest record that is not of the failed image, which is the
+// rollback target
+func (h history) getRollbackTarget(failedImage string, failedDigest string) (deployRecord, error) {
+	for _, record := range h.Records {
+		if record.isImage(failedImage, failedDigest) {
+			slog.Info("Skipping the record of the failed image", "image", record.Image, "digest", record.Digest)
+			continue
+		}
+		return record, nil
+	}
+	return deployRecord{}, fmt.Errorf("the history has no good deploy before the failed image %s", failedImage)
+}
+
+// Returns whether the record is of the image. The digest identifies the
+// image if both are set, since a tag may be pushed again
+func (r deployRecord) isImage(image string, digest string) bool {
+	if r.Digest != "" && digest != "" {
+		return r.Digest == digest
+	}
+	return r.Image == image
+}
+
+// Returns the image reference with the digest, if any, which pins the
+// image in the cluster
+func (r deployRecord) getImageReference() string {
+	if r.Digest == "" || strings.Contains(r.Image, "@") {
+		return r.Image
+	}
+	return r.Image + "@" + r.Digest
+}
+
+// Returns the short version for the commit subject, which is the tag, or
+// the start of the digest hash if the image has no tag
+func (r deployRecord) getShortVersion() string {
+	repository, tag := getImageRepository(r.Image)
+	if tag != "" {
+		return tag
+	}
+	_, hash, _ := strings.Cut(r.Digest, ":")
+	if hash == "" {
+		return repository
+	}
+	return hash[:min(len(hash), 12)]
+}
+
+// Returns the repository and the tag of the image reference, without the
+// digest. The tag is empty if the image has none
+func getImageRepository(image string) (string, string) {
+	image, _, _ = strings.Cut(image, "@")
+	separator := strings.LastIndex(image, ":")
+	if separator <= strings.LastIndex(image, "/") {
+		return image, ""
+	}
+	return image[:separator], image[separator+1:]
+}
+
+// Returns the image and the digest of the docker-build result file
+func readBuildResultFile(buildResultFile string) (string, string, error) {
+	resultBytes, err := os.ReadFile(buildResultFile)
+	if err != nil {
+		return "", "", fmt.Errorf("error reading build result file: %s", err)
+	}
+	var result struct {
+		Status string `json:"status"`
+		Image  string `json:"image"`
+		Digest string `json:"digest"`
+	}
+	err = json.Unmarshal(resultBytes, &result)
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing build result file: %s", err)
+	}
+	if !slices.Contains(deployableBuildStatuses, result.Status) {
+		return "", "", fmt.Errorf("the build result status must be one of %s: %s", deployableBuildStatuses, result.Status)
+	}
+	// A build that is skipped by the status file, or by the content hash
+	// without a content hash image, has no image, since nothing is pushed
+	// for the revision
+	if result.Image == "" && result.Status != SKIPPED_BUILD_STATUS {
+		return "", "", fmt.Errorf("the build result has no image, since its status is %s", result.Status)
+	}
+	return result.Image, result.Digest, nil
+}
+
+// Returns the manifests commit of the gitops-update result file
+func readGitopsResultFile(gitopsResultFile string) (string, error) {
+	resultBytes, err := os.ReadFile(gitopsResultFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading gitops result file: %s", err)
+	}
+	var result struct {
+		Commit string `json:"commit"`
+		Pushed bool   `json:"pushed"`
+	}
+	err = json.Unmarshal(resultBytes, &result)
+	if err != nil {
+		return "", fmt.Errorf("error parsing gitops result file: %s", err)
+	}
+	// An update that changed nothing has no commit, so the deploy is not
+	// tied to a manifests commit
+	if result.Commit != "" && !result.Pushed {
+		return "", fmt.Errorf("the gitops result commit was not pushed: %s", result.Commit)
+	}
+	return result.Commit, nil
+}
+
+// Returns the history of the history file. A missing file is an empty
+// history
+func readHistoryFile(historyFile string) (history, error) {
+	var h history
+	historyBytes, err := os.ReadFile(historyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, fmt.Errorf("error reading history file: %s", err)
+	}
+	err = json.Unmarshal(historyBytes, &h)
+	if err != nil {
+		return h, fmt.Errorf("error parsing history file: %s", err)
+	}
+	return h, nil
+}
+
+func writeHistoryFile(historyFile string, h history) error {
+	bytes, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling history file: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(historyFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating history file dir: %s", err)
+	}
+	err = os.WriteFile(historyFile, append(bytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing history file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// The result files as written by docker-build commit
+const (
+	// Skipped by the status file of the diff check
+	statusFileSkippedResult = `{
+  "status": "Skipped",
+  "skipReason": "No changes to the app"
+}
+`
+	// Skipped by the content hash, with only the content hash file set
+	contentHashSkippedResult = `{
+  "status": "Skipped",
+  "skipReason": "The build inputs did not change since the last successful build",
+  "contentHash": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+}
+`
+	// Skipped since the image already exists in the registry
+	existingImageSkippedResult = `{
+  "status": "Skipped",
+  "skipReason": "The image already exists in the registry",
+  "image": "registry.example.com/team/app:0123456",
+  "digest": "sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"
+}
+`
+	builtResult = `{
+  "status": "Built",
+  "image": "registry.example.com/team/app:0123456",
+  "digest": "sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+  "startTime": "2026-10-16T10:00:00Z",
+  "endTime": "2026-10-16T10:02:00Z",
+  "durationSeconds": 120
+}
+`
+	failedResult = `{
+  "status": "Failed",
+  "error": "BuildError",
+  "errorMessage": "error building image"
+}
+`
+)
+
+func writeTestFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "result.json")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("error writing test file: %s", err)
+	}
+	return path
+}
+
+func TestReadBuildResultFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		result     string
+		wantImage  string
+		wantDigest string
+		wantErr    bool
+	}{
+		{name: "status file skipped", result: statusFileSkippedResult},
+		{name: "content hash skipped", result: contentHashSkippedResult},
+		{
+			name:       "existing image skipped",
+			result:     existingImageSkippedResult,
+			wantImage:  "registry.example.com/team/app:0123456",
+			wantDigest: "sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+		},
+		{
+			name:       "built",
+			result:     builtResult,
+			wantImage:  "registry.example.com/team/app:0123456",
+			wantDigest: "sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+		},
+		{name: "failed", result: failedResult, wantErr: true},
+		{name: "built without image", result: `{"status": "Built"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, digest, err := readBuildResultFile(writeTestFile(t, tt.result))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readBuildResultFile() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if image != tt.wantImage || digest != tt.wantDigest {
+				t.Errorf(
+					"readBuildResultFile() = (%q, %q), want (%q, %q)",
+					image, digest, tt.wantImage, tt.wantDigest)
+			}
+		})
+	}
+}
+
+func TestRecordDeploySkippedWithoutImage(t *testing.T) {
+	buildResultFile := writeTestFile(t, statusFileSkippedResult)
+	historyFile := filepath.Join(t.TempDir(), "history.json")
+
+	flags := pflag.NewFlagSet("record", pflag.ContinueOnError)
+	configureRecordFlags(flags)
+	flags.Set("history-file", historyFile)
+	flags.Set("build-result-file", buildResultFile)
+
+	opts, err := getRecordOptions(flags)
+	if err != nil {
+		t.Fatalf("getRecordOptions() error = %v", err)
+	}
+	err = opts.recordDeploy()
+	if err != nil {
+		t.Fatalf("recordDeploy() error = %v", err)
+	}
+	_, err = os.Stat(historyFile)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the history file was written for a skipped build without an image: %v", err)
+	}
+}
+
+func TestRecordDeploy(t *testing.T) {
+	historyFile := filepath.Join(t.TempDir(), "history.json")
+	images := []string{
+		"registry.example.com/team/app:1",
+		"registry.example.com/team/app:2",
+		"registry.example.com/team/app:1",
+		"registry.example.com/team/app:3",
+	}
+	for _, image := range images {
+		opts := recordOptions{
+			historyFile: historyFile,
+			record:      deployRecord{Image: image},
+			maxRecords:  2,
+		}
+		err := opts.recordDeploy()
+		if err != nil {
+			t.Fatalf("recordDeploy(%s) error = %v", image, err)
+		}
+	}
+
+	h, err := readHistoryFile(historyFile)
+	if err != nil {
+		t.Fatalf("readHistoryFile() error = %v", err)
+	}
+	want := []string{"registry.example.com/team/app:3", "registry.example.com/team/app:1"}
+	if len(h.Records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(h.Records), len(want))
+	}
+	for i, record := range h.Records {
+		if record.Image != want[i] {
+			t.Errorf("record %d image = %s, want %s", i, record.Image, want[i])
+		}
+	}
+
+	record, err := h.getRollbackTarget("registry.example.com/team/app:3", "")
+	if err != nil {
+		t.Fatalf("getRollbackTarget() error = %v", err)
+	}
+	if record.Image != "registry.example.com/team/app:1" {
+		t.Errorf("getRollbackTarget() image = %s, want registry.example.com/team/app:1", record.Image)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default kubectl path, which is resolved with the PATH
+	DEFAULT_KUBECTL_PATH = "kubectl"
+	// The default maximum duration to wait for the workload
+	DEFAULT_WAIT_TIMEOUT = 10 * time.Minute
+	// The default interval between the rollout polls
+	DEFAULT_POLL_INTERVAL = 10 * time.Second
+
+	// The phases of an Argo Rollout
+	// See https://argoproj.github.io/argo-rollouts/features/specification
+	HEALTHY_ROLLOUT_PHASE  = "Healthy"
+	DEGRADED_ROLLOUT_PHASE = "Degraded"
+
+	// The JSON patch of the container image, which is tested first, so a
+	// concurrent change of the image is not overwritten
+	IMAGE_PATCH = `[{"op":"test","path":"/spec/template/spec/containers/%d/image","value":%q},` +
+		`{"op":"replace","path":"/spec/template/spec/containers/%d/image","value":%q}]`
+)
+
+// The kubectl resources of the workload targets
+var targetResources = map[string]string{
+	DEPLOYMENT_TARGET: "deployments.apps",
+	ROLLOUT_TARGET:    "rollouts.argoproj.io",
+}
+
+// The options for patching the image of the workload in the cluster
+type kubeOptions struct {
+	target    string
+	namespace string
+	name      string
+	// The container to roll back. If not set, it is the container whose
+	// image repository is the repository of the good image
+	container    string
+	wait         bool
+	timeout      time.Duration
+	pollInterval time.Duration
+	kubectl      kubectlRunner
+}
+
+// The fields of a Deployment or an Argo Rollout that the rollback uses
+type workload struct {
+	Metadata struct {
+		Generation int64 `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Template struct {
+			Spec struct {
+				Containers []struct {
+					Name  string `json:"name"`
+					Image string `json:"image"`
+				} `json:"containers"`
+			} `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+	Status struct {
+		Phase          string `json:"phase"`
+		Message        string `json:"message"`
+		CurrentPodHash string `json:"currentPodHash"`
+		StableRS       string `json:"stableRS"`
+		// The generation of the spec that the controller observed, which is
+		// a string in the rollout status
+		ObservedGeneration json.RawMessage `json:"observedGeneration"`
+	} `json:"status"`
+}
+
+func configureKubeFlags(flags *pflag.FlagSet) {
+	flags.String("namespace", "", "The namespace of the workload for the deployment and rollout targets")
+	flags.String("name", "", "The name of the workload for the deployment and rollout targets")
+	flags.String(
+		"container",
+		"",
+		"The container to roll back. Defaults to the container with the repository of the good image")
+	flags.Bool("wait", false, "Whether to wait until the workload is rolled out with the good image")
+	flags.Duration("timeout", DEFAULT_WAIT_TIMEOUT, "The maximum duration to wait for the workload")
+	flags.Duration("poll-interval", DEFAULT_POLL_INTERVAL, "The interval between the rollout polls")
+	flags.String("kubectl-path", DEFAULT_KUBECTL_PATH, "The path to the kubectl executable")
+	flags.String("kubeconfig", "", "The path to the kubeconfig. Defaults to the in cluster config")
+	flags.String("context", "", "The kubeconfig context. Defaults to the current context")
+}
+
+func getKubeOptions(flags *pflag.FlagSet, target string) (kubeOptions, error) {
+	opts := kubeOptions{target: target}
+	var err error
+
+	opts.namespace, err = flags.GetString("namespace")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert namespace flag")
+	}
+	if opts.namespace == "" {
+		return opts, fmt.Errorf("namespace must be set for the %s target", target)
+	}
+
+	opts.name, err = flags.GetString("name")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert name flag")
+	}
+	if opts.name == "" {
+		return opts, fmt.Errorf("name must be set for the %s target", target)
+	}
+
+	opts.container, err = flags.GetString("container")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert container flag")
+	}
+
+	opts.wait, err = flags.GetBool("wait")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert wait flag")
+	}
+
+	opts.timeout, err = flags.GetDuration("timeout")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert timeout flag")
+	}
+	if opts.timeout <= 0 {
+		return opts, fmt.Errorf("timeout must be positive: %s", opts.timeout)
+	}
+
+	opts.pollInterval, err = flags.GetDuration("poll-interval")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert poll-interval flag")
+	}
+	if opts.pollInterval <= 0 {
+		return opts, fmt.Errorf("poll-interval must be positive: %s", opts.pollInterval)
+	}
+
+	opts.kubectl.namespace = opts.namespace
+	opts.kubectl.kubectlPath, err = flags.GetString("kubectl-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert kubectl-path flag")
+	}
+
+	opts.kubectl.kubeconfig, err = flags.GetString("kubeconfig")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert kubeconfig flag")
+	}
+
+	opts.kubectl.context, err = flags.GetString("context")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert context flag")
+	}
+	return opts, nil
+}
+
+func (opts kubeOptions) logAttrs() []any {
+	return []any{
+		"namespace", opts.namespace,
+		"name", opts.name,
+		"container", opts.container,
+		"wait", opts.wait,
+		"timeout", opts.timeout,
+		"pollInterval", opts.pollInterval,
+		"kubectlPath", opts.kubectl.kubectlPath,
+		"kubeconfig", opts.kubectl.kubeconfig,
+		"context", opts.kubectl.context,
+	}
+}
+
+// Patches the container image of the workload to the good image, and waits
+// for the rollout if set. The image is pinned to the digest, if any
+func (opts kubeOptions) revertWorkload(
+	ctx context.Context,
+	record deployRecord,
+	result revertResult,
+) (revertResult, error) {
+	resource := targetResources[opts.target]
+	w, err := opts.kubectl.getWorkload(ctx, resource, opts.name)
+	if err != nil {
+		return result, err
+	}
+	index, err := opts.getContainerIndex(w, record)
+	if err != nil {
+		return result, err
+	}
+	container := w.Spec.Template.Spec.Containers[index]
+	result.Container = container.Name
+
+	image := record.getImageReference()
+	if container.Image == image {
+		slog.Info("Skipping the patch. The container is already at the good image", "container", container.Name)
+	} else {
+		slog.Info(
+			"Patching the container image",
+			"container", container.Name,
+			"currentImage", container.Image,
+			"image", image)
+		patch := fmt.Sprintf(IMAGE_PATCH, index, container.Image, index, image)
+		err = opts.kubectl.patchWorkload(ctx, resource, opts.name, patch)
+		if err != nil {
+			return result, err
+		}
+		result.Changed = true
+	}
+	if !opts.wait {
+		return result, nil
+	}
+
+	if opts.target == DEPLOYMENT_TARGET {
+		err = opts.kubectl.waitForDeployment(ctx, opts.name, opts.timeout)
+	} else {
+		err = opts.waitForRollout(ctx)
+	}
+	return result, err
+}
+
+// Returns the index of the container to roll back. Without the container
+// flag, exactly one container must have the repository of the good image
+func (opts kubeOptions) getContainerIndex(w workload, record deployRecord) (int, error) {
+	containers := w.Spec.Template.Spec.Containers
+	if opts.container != "" {
+		for i, container := range containers {
+			if container.Name == opts.container {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("the %s %s has no container %s", opts.target, opts.name, opts.container)
+	}
+
+	repository, _ := getImageRepository(record.Image)
+	matches := []int{}
+	for i, container := range containers {
+		containerRepository, _ := getImageRepository(container.Image)
+		if containerRepository == repository {
+			matches = append(matches, i)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("the %s %s has no container with the image %s", opts.target, opts.name, repository)
+	case 1:
+		return matches[0], nil
+	}
+	return 0, fmt.Errorf(
+		"the %s %s has %d containers with the image %s, so the container must be set",
+		opts.target,
+		opts.name,
+		len(matches),
+		repository)
+}
+
+// Polls the rollout until the good image is the stable version, or the
+// timeout. The rollout is checked once the controller observed the patch
+func (opts kubeOptions) waitForRollout(ctx context.Context) error {
+	resource := targetResources[ROLLOUT_TARGET]
+	deadline := time.Now().Add(opts.timeout)
+	for {
+		w, err := opts.kubectl.getWorkload(ctx, resource, opts.name)
+		if err != nil {
+			return err
+		}
+		if w.isObserved() {
+			switch {
+			case w.Status.Phase == HEALTHY_ROLLOUT_PHASE && w.Status.CurrentPodHash == w.Status.StableRS:
+				slog.Info("The rollout is rolled back", "name", opts.name)
+				return nil
+			case w.Status.Phase == DEGRADED_ROLLOUT_PHASE:
+				return fmt.Errorf("the rollout %s is degraded after the rollback: %s", opts.name, w.Status.Message)
+			}
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf(
+				"the rollout %s did not finish after %s, since it is %s: %s",
+				opts.name,
+				opts.timeout,
+				w.Status.Phase,
+				w.Status.Message)
+		}
+		slog.Info("Waiting for the rollout", "name", opts.name, "phase", w.Status.Phase, "message", w.Status.Message)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(min(opts.pollInterval, remaining)):
+		}
+	}
+}
+
+// Returns whether the controller observed the latest spec of the workload.
+// The observed generation is a string in the rollout status
+func (w workload) isObserved() bool {
+	observedGeneration, err := strconv.Unquote(string(w.Status.ObservedGeneration))
+	if err != nil {
+		observedGeneration = string(w.Status.ObservedGeneration)
+	}
+	return observedGeneration == strconv.FormatInt(w.Metadata.Generation, 10)
+}
+
+// Runs the kubectl commands for the workload, with the kubeconfig and the
+// context of the flags. Without a kubeconfig, kubectl uses the in cluster
+// config of the service account
+type kubectlRunner struct {
+	kubectlPath string
+	kubeconfig  string
+	context     string
+	namespace   string
+}
+
+// Returns the workload of the resource
+func (k kubectlRunner) getWorkload(ctx context.Context, resource string, name string) (workload, error) {
+	var w workload
+	stdout, err := k.run(ctx, "get", resource, name, "--output=json")
+	if err != nil {
+		return w, err
+	}
+	err = json.Unmarshal([]byte(stdout), &w)
+	if err != nil {
+		return w, fmt.Errorf("error parsing the %s %s: %s", resource, name, err)
+	}
+	return w, nil
+}
+
+// JSON patches the workload of the resource
+func (k kubectlRunner) patchWorkload(ctx context.Context, resource string, name string, patch string) error {
+	slog.Debug("Patching the workload", "resource", resource, "name", name, "patch", patch)
+	_, err := k.run(ctx, "patch", resource, name, "--type=json", "--patch="+patch)
+	return err
+}
+
+// Waits until the deployment is rolled out, or the timeout
+func (k kubectlRunner) waitForDeployment(ctx context.Context, name string, timeout time.Duration) error {
+	slog.Info("Waiting for the deployment", "name", name)
+	_, err := k.run(ctx, "rollout", "status", "deployments.apps/"+name, "--timeout="+timeout.String())
+	if err != nil {
+		return err
+	}
+	slog.Info("The deployment is rolled back", "name", name)
+	return nil
+}
+
+// Runs the kubectl command and returns the stdout. The stderr is in the
+// error, since it has the reason of the failure
+func (k kubectlRunner) run(ctx context.Context, args ...string) (string, error) {
+	globalArgs := []string{"--namespace=" + k.namespace}
+	if k.kubeconfig != "" {
+		globalArgs = append(globalArgs, "--kubeconfig="+k.kubeconfig)
+	}
+	if k.context != "" {
+		globalArgs = append(globalArgs, "--context="+k.context)
+	}
+	args = append(globalArgs, args...)
+	slog.Debug("Running kubectl", "args", args)
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	kubectlCmd := exec.CommandContext(ctx, k.kubectlPath, args...)
+	kubectlCmd.Env = os.Environ()
+	kubectlCmd.Stdout = stdout
+	kubectlCmd.Stderr = stderr
+	err := kubectlCmd.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf(
+			"kubectl %s failed: %w: %s",
+			args[len(globalArgs)],
+			err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "rollback"
+
+var (
+	mainCmd = &cobra.Command{
+		Use:   "rollback",
+		Short: "Roll back to the last good deploy",
+		Long: `Rolls back to the last good deploy when the verification fails.
+The good deploys are recorded in a history file after the verification passes,
+with the image of the docker-build result and the manifests commit of the
+gitops-update result. The rollback restores the manifests repo, or patches the
+Deployment or the Argo Rollout, to the newest good image`,
+		PersistentPreRunE: loadFlagValues,
+		RunE:              handleMainCmd,
+	}
+	recordCmd = &cobra.Command{
+		Use:   "record",
+		Short: "Record a good deploy in the history",
+		Long: `Records a good deploy in the history file, which is created if missing. It
+should run after the verification passes. A previous record of the same image
+is replaced, and the oldest records are dropped after the max records`,
+		RunE: handleRecordCmd,
+	}
+	revertCmd = &cobra.Command{
+		Use:   "revert",
+		Short: "Roll back to the last good deploy in the history",
+		Long: `Rolls back to the newest good deploy in the history file that is not the
+failed image. The gitops target restores the manifest files to the manifests
+commit of the good deploy, and pushes the change. The deployment and rollout
+targets patch the container image of the workload to the good image`,
+		RunE: handleRevertCmd,
+	}
+)
+
+func configureCmds() {
+	configureRecordFlags(recordCmd.Flags())
+
+	revertFlags := revertCmd.Flags()
+
+	revertFlags.String("history-file", "", "The path to the history file of the good deploys")
+	revertCmd.MarkFlagRequired("history-file")
+
+	revertFlags.String(
+		"failed-build-result-file",
+		"",
+		"The path to the docker-build result file of the failed deploy, whose image is skipped in the history")
+
+	revertFlags.String("failed-image", "", "The image reference of the failed deploy. Overrides the build result")
+
+	revertFlags.String("failed-digest", "", "The image digest of the failed deploy. Overrides the build result")
+
+	revertFlags.String("target", "", fmt.Sprintf("The target to roll back. One of %s", revertTargets))
+	revertCmd.MarkFlagRequired("target")
+
+	revertFlags.String(
+		"result-file",
+		"",
+		"The path to write the result to as JSON, with the good image and the commit")
+
+	configureGitopsFlags(revertFlags)
+
+	configureKubeFlags(revertFlags)
+
+	mainCmd.AddCommand(recordCmd)
+	mainCmd.AddCommand(revertCmd)
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the git and kubectl args")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+}
+
+func configureRecordFlags(recordFlags *pflag.FlagSet) {
+	recordFlags.String("history-file", "", "The path to the history file of the good deploys")
+	cobra.MarkFlagRequired(recordFlags, "history-file")
+
+	recordFlags.String(
+		"build-result-file",
+		"",
+		"The path to the docker-build result file, with the image and the digest of the good deploy")
+
+	recordFlags.String("image", "", "The image reference of the good deploy. Overrides the build result")
+
+	recordFlags.String("digest", "", "The image digest of the good deploy. Overrides the build result")
+
+	recordFlags.String(
+		"gitops-result-file",
+		"",
+		"The path to the gitops-update result file, with the manifests commit of the good deploy")
+
+	recordFlags.String(
+		"manifests-commit",
+		"",
+		"The manifests repo commit of the good deploy. Overrides the gitops result")
+
+	recordFlags.Int("max-records", DEFAULT_MAX_RECORDS, "The maximum number of records to keep in the history")
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	return fmt.Errorf("Must specify a subcommand")
+}
+
+func handleRecordCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	recordOpts, err := getRecordOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Rollback record with params", recordOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	return recordOpts.recordDeploy()
+}
+
+func handleRevertCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	revertOpts, err := getRevertOptions(cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Rollback revert with params", revertOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	result, err := revertOpts.revert(cmd.Context())
+	if err != nil {
+		return err
+	}
+	err = revertOpts.writeResult(result)
+	if err != nil {
+		return err
+	}
+	slog.Info("Rolled back to the last good deploy", "image", result.Image, "changed", result.Changed)
+	return nil
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		os.Exit(1)
+	}
+}
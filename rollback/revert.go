@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The targets of the rollback. The gitops target restores the manifests
+	// repo, which Argo CD syncs, and the other targets patch the image of the
+	// workload in the cluster
+	GITOPS_TARGET     = "gitops"
+	DEPLOYMENT_TARGET = "deployment"
+	ROLLOUT_TARGET    = "rollout"
+)
+
+var revertTargets = []string{GITOPS_TARGET, DEPLOYMENT_TARGET, ROLLOUT_TARGET}
+
+// The options for rolling back to the last good deploy
+type revertOptions struct {
+	historyFile string
+	// The image that failed the verification, which is skipped in the
+	// history. If not set, the newest record is the rollback target
+	failedImage  string
+	failedDigest string
+	target       string
+	resultFile   string
+	gitops       gitopsOptions
+	kube         kubeOptions
+}
+
+// The result of the rollback, which is written to the result file
+type revertResult struct {
+	Target          string    `json:"target"`
+	Image           string    `json:"image"`
+	Digest          string    `json:"digest,omitempty"`
+	ManifestsCommit string    `json:"manifestsCommit,omitempty"`
+	RecordedAt      time.Time `json:"recordedAt"`
+	// Whether the rollback changed anything. A target that is already at the
+	// good image is not changed
+	Changed bool     `json:"changed"`
+	Files   []string `json:"files,omitempty"`
+	Commit  string   `json:"commit,omitempty"`
+	Pushed  bool     `json:"pushed"`
+	// The container of the workload that is rolled back
+	Container string `json:"container,omitempty"`
+}
+
+func getRevertOptions(flags *pflag.FlagSet) (revertOptions, error) {
+	var opts revertOptions
+	var err error
+
+	opts.historyFile, err = flags.GetString("history-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert history-file flag")
+	}
+
+	failedBuildResultFile, err := flags.GetString("failed-build-result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert failed-build-result-file flag")
+	}
+	if failedBuildResultFile != "" {
+		opts.failedImage, opts.failedDigest, err = readBuildResultFile(failedBuildResultFile)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	failedImage, err := flags.GetString("failed-image")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert failed-image flag")
+	}
+	if failedImage != "" {
+		opts.failedImage = failedImage
+	}
+
+	failedDigest, err := flags.GetString("failed-digest")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert failed-digest flag")
+	}
+	if failedDigest != "" {
+		opts.failedDigest = failedDigest
+	}
+
+	opts.target, err = flags.GetString("target")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert target flag")
+	}
+
+	opts.resultFile, err = flags.GetString("result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing revert result-file flag")
+	}
+
+	switch opts.target {
+	case GITOPS_TARGET:
+		opts.gitops, err = getGitopsOptions(flags)
+	case DEPLOYMENT_TARGET, ROLLOUT_TARGET:
+		opts.kube, err = getKubeOptions(flags, opts.target)
+	default:
+		err = fmt.Errorf("target must be one of %s: %s", revertTargets, opts.target)
+	}
+	return opts, err
+}
+
+func (opts revertOptions) logAttrs() []any {
+	attrs := []any{
+		"historyFile", opts.historyFile,
+		"failedImage", opts.failedImage,
+		"failedDigest", opts.failedDigest,
+		"target", opts.target,
+		"resultFile", opts.resultFile,
+	}
+	if opts.target == GITOPS_TARGET {
+		return append(attrs, opts.gitops.logAttrs()...)
+	}
+	return append(attrs, opts.kube.logAttrs()...)
+}
+
+// Finds the last good deploy in the history, and rolls the target back to
+// its image
+func (opts revertOptions) revert(ctx context.Context) (revertResult, error) {
+	h, err := readHistoryFile(opts.historyFile)
+	if err != nil {
+		return revertResult{}, err
+	}
+	record, err := h.getRollbackTarget(opts.failedImage, opts.failedDigest)
+	if err != nil {
+		return revertResult{}, err
+	}
+	slog.Info(
+		"Rolling back to the last good deploy",
+		"image", record.Image,
+		"digest", record.Digest,
+		"manifestsCommit", record.ManifestsCommit,
+		"recordedAt", record.RecordedAt)
+
+	result := revertResult{
+		Target:          opts.target,
+		Image:           record.Image,
+		Digest:          record.Digest,
+		ManifestsCommit: record.ManifestsCommit,
+		RecordedAt:      record.RecordedAt,
+	}
+	if opts.target == GITOPS_TARGET {
+		return opts.gitops.revertManifests(ctx, record, result)
+	}
+	return opts.kube.revertWorkload(ctx, record, result)
+}
+
+// Writes the result to the result file as JSON, if set
+func (opts revertOptions) writeResult(result revertResult) error {
+	if opts.resultFile == "" {
+		return nil
+	}
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling result file: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(opts.resultFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating result file dir: %s", err)
+	}
+	err = os.WriteFile(opts.resultFile, append(bytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing result file: %s", err)
+	}
+	return nil
+}
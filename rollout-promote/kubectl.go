@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Runs the kubectl commands for the rollout, with the kubeconfig and the
+// context of the flags. Without a kubeconfig, kubectl uses the in cluster
+// config of the service account
+type kubectlRunner struct {
+	kubectlPath string
+	kubeconfig  string
+	context     string
+	namespace   string
+}
+
+// Returns the rollout
+func (k kubectlRunner) getRollout(ctx context.Context, name string) (rollout, error) {
+	var ro rollout
+	stdout, err := k.run(ctx, "get", "rollouts.argoproj.io", name, "--output=json")
+	if err != nil {
+		return ro, err
+	}
+	err = json.Unmarshal([]byte(stdout), &ro)
+	if err != nil {
+		return ro, fmt.Errorf("error parsing the rollout %s: %s", name, err)
+	}
+	return ro, nil
+}
+
+// Merge patches the rollout. The status patches use the status
+// subresource, as in the kubectl argo rollouts plugin
+func (k kubectlRunner) patchRollout(ctx context.Context, name string, patch string, status bool) error {
+	args := []string{"patch", "rollouts.argoproj.io", name, "--type=merge", "--patch=" + patch}
+	if status {
+		args = append(args, "--subresource=status")
+	}
+	slog.Info("Patching the rollout", "name", name, "patch", patch, "status", status)
+	_, err := k.run(ctx, args...)
+	return err
+}
+
+// Runs the kubectl command and returns the stdout. The stderr is in the
+// error, since it has the reason of the failure
+func (k kubectlRunner) run(ctx context.Context, args ...string) (string, error) {
+	globalArgs := []string{"--namespace=" + k.namespace}
+	if k.kubeconfig != "" {
+		globalArgs = append(globalArgs, "--kubeconfig="+k.kubeconfig)
+	}
+	if k.context != "" {
+		globalArgs = append(globalArgs, "--context="+k.context)
+	}
+	args = append(globalArgs, args...)
+	slog.Debug("Running kubectl", "args", args)
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	kubectlCmd := exec.CommandContext(ctx, k.kubectlPath, args...)
+	kubectlCmd.Env = os.Environ()
+	kubectlCmd.Stdout = stdout
+	kubectlCmd.Stderr = stderr
+	err := kubectlCmd.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf(
+			"kubectl %s failed: %w: %s",
+			args[len(globalArgs)],
+			err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
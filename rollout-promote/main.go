@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/osoriano/deploy-steps/internal/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// The name of the step, added to the JSON logs
+const STEP_NAME = "rollout-promote"
+
+var (
+	mainCmd = &cobra.Command{
+		Use:   "rollout-promote",
+		Short: "Promote or abort an Argo Rollout",
+		Long: `Promotes or aborts an Argo Rollout.
+The canary or blue-green update of the rollout is driven from the pipeline, so
+it is promoted after the verification steps pass, or aborted when they fail`,
+		PersistentPreRunE: loadFlagValues,
+		RunE:              handleMainCmd,
+	}
+	promoteCmd = &cobra.Command{
+		Use:   "promote",
+		Short: "Promote the rollout",
+		Long: `Promotes the rollout, as the promote command of the kubectl argo rollouts
+plugin. The pause of the rollout is cleared, or the canary moves to the next
+step. The full promotion skips the remaining steps and analysis. The wait is
+until the rollout is fully promoted`,
+		RunE: handlePromoteCmd,
+	}
+	abortCmd = &cobra.Command{
+		Use:   "abort",
+		Short: "Abort the update of the rollout",
+		Long: `Aborts the update of the rollout, as the abort command of the kubectl argo
+rollouts plugin. The stable pods are scaled back up, and the canary pods are
+scaled down. The wait is until the stable pods are available`,
+		RunE: handleAbortCmd,
+	}
+)
+
+func configureCmds() {
+	configurePromoteFlags(promoteCmd.Flags())
+	promoteCmd.MarkFlagRequired("namespace")
+	promoteCmd.MarkFlagRequired("name")
+
+	configureAbortFlags(abortCmd.Flags())
+	abortCmd.MarkFlagRequired("namespace")
+	abortCmd.MarkFlagRequired("name")
+
+	mainCmd.AddCommand(promoteCmd)
+	mainCmd.AddCommand(abortCmd)
+
+	mainCmd.PersistentFlags().Bool("debug", false, "Log debug records, such as the kubectl args")
+	mainCmd.PersistentFlags().String(
+		"log-format",
+		logging.LOG_FORMAT_TEXT,
+		fmt.Sprintf("The log format. One of %s", logging.LogFormats))
+}
+
+func configurePromoteFlags(promoteFlags *pflag.FlagSet) {
+	configureRolloutFlags(promoteFlags)
+
+	promoteFlags.Bool("full", false, "Whether to skip the remaining steps and analysis, and promote fully")
+
+	promoteFlags.Bool(
+		"wait",
+		false,
+		"Whether to wait until the rollout is fully promoted. A pause at a later step exits with code 3")
+}
+
+func configureAbortFlags(abortFlags *pflag.FlagSet) {
+	configureRolloutFlags(abortFlags)
+
+	abortFlags.Bool("wait", false, "Whether to wait until the stable pods are available")
+}
+
+func loadFlagValues(cmd *cobra.Command, args []string) error {
+	return logging.ConfigureFromFlags(cmd, STEP_NAME)
+}
+
+func handleMainCmd(cmd *cobra.Command, args []string) error {
+	return fmt.Errorf("Must specify a subcommand")
+}
+
+func handlePromoteCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	rolloutOpts, err := getRolloutOptions(cmd.Flags(), PROMOTE_ACTION)
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Rollout promote with params", rolloutOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	result, err := rolloutOpts.promote(cmd.Context())
+	if err != nil {
+		return err
+	}
+	return handleResult(rolloutOpts, result, PROMOTED_STATUS)
+}
+
+func handleAbortCmd(cmd *cobra.Command, args []string) error {
+	// Parse command flags
+	rolloutOpts, err := getRolloutOptions(cmd.Flags(), ABORT_ACTION)
+	if err != nil {
+		return err
+	}
+
+	// Log command flags
+	slog.Info("Rollout abort with params", rolloutOpts.logAttrs()...)
+
+	// Errors after this point are not usage errors
+	cmd.SilenceUsage = true
+
+	result, err := rolloutOpts.abort(cmd.Context())
+	if err != nil {
+		return err
+	}
+	return handleResult(rolloutOpts, result, ABORTED_STATUS)
+}
+
+// Writes the result, and returns an error if the rollout is not at the
+// expected status
+func handleResult(rolloutOpts rolloutOptions, result rolloutResult, expectedStatus string) error {
+	err := rolloutOpts.writeResult(result)
+	if err != nil {
+		return err
+	}
+	if result.Status != expectedStatus {
+		return &rolloutError{result: result}
+	}
+	slog.Info("Finished the rollout action", "action", result.Action, "reason", result.Reason, "phase", result.Phase)
+	return nil
+}
+
+func main() {
+	configureCmds()
+	slog.SetDefault(slog.New(logging.NewTextHandler(os.Stdout, slog.LevelInfo)))
+	if err := mainCmd.Execute(); err != nil {
+		slog.Error("Error executing command", "error", err)
+		var rolloutErr *rolloutError
+		if errors.As(err, &rolloutErr) {
+			os.Exit(rolloutErr.exitCode())
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// The default kubectl path, which is resolved with the PATH
+	DEFAULT_KUBECTL_PATH = "kubectl"
+	// The default maximum duration to wait for the rollout
+	DEFAULT_WAIT_TIMEOUT = 30 * time.Minute
+	// The default interval between the rollout polls
+	DEFAULT_POLL_INTERVAL = 10 * time.Second
+
+	// The actions on the rollout
+	PROMOTE_ACTION = "promote"
+	ABORT_ACTION   = "abort"
+
+	// The rollout is promoted, or fully promoted with the wait
+	PROMOTED_STATUS = "promoted"
+	// The rollout paused at a later step before it was fully promoted
+	PAUSED_STATUS = "paused"
+	// The update of the rollout is aborted
+	ABORTED_STATUS = "aborted"
+	// The rollout is degraded, or cannot be promoted or aborted
+	FAILED_STATUS = "failed"
+	// The rollout did not finish before the timeout
+	TIMEOUT_STATUS = "timeout"
+
+	// The exit codes of the failed and the unfinished rollouts, so a
+	// pipeline can tell them apart from the other errors
+	FAILED_EXIT_CODE     = 2
+	UNFINISHED_EXIT_CODE = 3
+)
+
+// The options for promoting or aborting the rollout
+type rolloutOptions struct {
+	action    string
+	namespace string
+	name      string
+	// Whether the promotion skips the remaining steps and analysis
+	full bool
+	// Whether to wait for the full promotion or the abort
+	wait         bool
+	timeout      time.Duration
+	pollInterval time.Duration
+	resultFile   string
+	kubectl      kubectlRunner
+}
+
+// The result of the action, which is written to the result file
+type rolloutResult struct {
+	Namespace      string `json:"namespace"`
+	Name           string `json:"name"`
+	Action         string `json:"action"`
+	Status         string `json:"status"`
+	Reason         string `json:"reason"`
+	Phase          string `json:"phase"`
+	Message        string `json:"message,omitempty"`
+	StepIndex      int32  `json:"stepIndex"`
+	StepCount      int32  `json:"stepCount"`
+	StableRS       string `json:"stableRS"`
+	CurrentPodHash string `json:"currentPodHash"`
+}
+
+// The error of a rollout that failed or did not finish, which sets the exit
+// code
+type rolloutError struct {
+	result rolloutResult
+}
+
+func (e *rolloutError) Error() string {
+	return fmt.Sprintf(
+		"could not %s the rollout %s/%s: %s",
+		e.result.Action,
+		e.result.Namespace,
+		e.result.Name,
+		e.result.Reason)
+}
+
+func (e *rolloutError) exitCode() int {
+	if e.result.Status == FAILED_STATUS {
+		return FAILED_EXIT_CODE
+	}
+	return UNFINISHED_EXIT_CODE
+}
+
+func configureRolloutFlags(flags *pflag.FlagSet) {
+	flags.String("namespace", "", "The namespace of the rollout")
+	flags.String("name", "", "The name of the rollout")
+	flags.Duration("timeout", DEFAULT_WAIT_TIMEOUT, "The maximum duration to wait for the rollout")
+	flags.Duration("poll-interval", DEFAULT_POLL_INTERVAL, "The interval between the rollout polls")
+	flags.String("result-file", "", "The path to write the result to as JSON, with the status and the rollout phase")
+	flags.String("kubectl-path", DEFAULT_KUBECTL_PATH, "The path to the kubectl executable")
+	flags.String("kubeconfig", "", "The path to the kubeconfig. Defaults to the in cluster config")
+	flags.String("context", "", "The kubeconfig context. Defaults to the current context")
+}
+
+func getRolloutOptions(flags *pflag.FlagSet, action string) (rolloutOptions, error) {
+	opts := rolloutOptions{action: action}
+	var err error
+
+	opts.namespace, err = flags.GetString("namespace")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s namespace flag", action)
+	}
+	if opts.namespace == "" {
+		return opts, fmt.Errorf("namespace must be set")
+	}
+
+	opts.name, err = flags.GetString("name")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s name flag", action)
+	}
+	if opts.name == "" {
+		return opts, fmt.Errorf("name must be set")
+	}
+
+	if action == PROMOTE_ACTION {
+		opts.full, err = flags.GetBool("full")
+		if err != nil {
+			return opts, fmt.Errorf("error processing %s full flag", action)
+		}
+	}
+
+	opts.wait, err = flags.GetBool("wait")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s wait flag", action)
+	}
+
+	opts.timeout, err = flags.GetDuration("timeout")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s timeout flag", action)
+	}
+	if opts.timeout <= 0 {
+		return opts, fmt.Errorf("timeout must be positive: %s", opts.timeout)
+	}
+
+	opts.pollInterval, err = flags.GetDuration("poll-interval")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s poll-interval flag", action)
+	}
+	if opts.pollInterval <= 0 {
+		return opts, fmt.Errorf("poll-interval must be positive: %s", opts.pollInterval)
+	}
+
+	opts.resultFile, err = flags.GetString("result-file")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s result-file flag", action)
+	}
+
+	opts.kubectl.namespace = opts.namespace
+	opts.kubectl.kubectlPath, err = flags.GetString("kubectl-path")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s kubectl-path flag", action)
+	}
+
+	opts.kubectl.kubeconfig, err = flags.GetString("kubeconfig")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s kubeconfig flag", action)
+	}
+
+	opts.kubectl.context, err = flags.GetString("context")
+	if err != nil {
+		return opts, fmt.Errorf("error processing %s context flag", action)
+	}
+	return opts, nil
+}
+
+func (opts rolloutOptions) logAttrs() []any {
+	return []any{
+		"namespace", opts.namespace,
+		"name", opts.name,
+		"full", opts.full,
+		"wait", opts.wait,
+		"timeout", opts.timeout,
+		"pollInterval", opts.pollInterval,
+		"resultFile", opts.resultFile,
+		"kubectlPath", opts.kubectl.kubectlPath,
+		"kubeconfig", opts.kubectl.kubeconfig,
+		"context", opts.kubectl.context,
+	}
+}
+
+// Promotes the rollout, and waits for the full promotion if set. A rollout
+// that is already fully promoted is left as is
+func (opts rolloutOptions) promote(ctx context.Context) (rolloutResult, error) {
+	ro, err := opts.kubectl.getRollout(ctx, opts.name)
+	if err != nil {
+		return rolloutResult{}, err
+	}
+	slog.Info("Promoting the rollout", "name", opts.name, "state", ro.describe())
+	switch {
+	case ro.isPromoted():
+		return opts.getResult(ro, PROMOTED_STATUS, "the rollout is already fully promoted"), nil
+	case ro.Status.Abort:
+		return opts.getResult(ro, FAILED_STATUS, "the rollout is aborted, so a new update is needed"), nil
+	}
+
+	for _, patch := range ro.getPromotePatches(opts.full) {
+		err = opts.kubectl.patchRollout(ctx, opts.name, patch.patch, patch.status)
+		if err != nil {
+			return rolloutResult{}, err
+		}
+	}
+	if !opts.wait {
+		return opts.getResult(ro, PROMOTED_STATUS, "the rollout is promoted"), nil
+	}
+
+	startStepIndex := ro.getStepIndex()
+	return opts.waitForRollout(ctx, func(ro rollout) (string, string) {
+		switch {
+		case ro.isPromoted():
+			return PROMOTED_STATUS, "the rollout is fully promoted"
+		case ro.Status.Abort || ro.Status.Phase == DEGRADED_ROLLOUT_PHASE:
+			return FAILED_STATUS, "the rollout is " + ro.describe()
+		case ro.Status.Phase == PAUSED_ROLLOUT_PHASE && ro.getStepIndex() > startStepIndex:
+			return PAUSED_STATUS, "the rollout needs another promotion, since it is " + ro.describe()
+		}
+		return "", ""
+	})
+}
+
+// Aborts the update of the rollout, which scales the stable pods back up,
+// and waits for the abort if set
+func (opts rolloutOptions) abort(ctx context.Context) (rolloutResult, error) {
+	ro, err := opts.kubectl.getRollout(ctx, opts.name)
+	if err != nil {
+		return rolloutResult{}, err
+	}
+	slog.Info("Aborting the rollout", "name", opts.name, "state", ro.describe())
+	switch {
+	case ro.isPromoted():
+		return opts.getResult(ro, FAILED_STATUS, "the rollout is already fully promoted, so there is no update to abort"), nil
+	case !ro.Status.Abort:
+		err = opts.kubectl.patchRollout(ctx, opts.name, ABORT_PATCH, true)
+		if err != nil {
+			return rolloutResult{}, err
+		}
+	}
+	if !opts.wait {
+		return opts.getResult(ro, ABORTED_STATUS, "the rollout is aborted"), nil
+	}
+
+	return opts.waitForRollout(ctx, func(ro rollout) (string, string) {
+		if ro.isAborted() {
+			return ABORTED_STATUS, "the rollout is aborted, and the stable pods are available"
+		}
+		return "", ""
+	})
+}
+
+// Polls the rollout until the check returns a status, or the timeout. The
+// rollout is checked once the controller observed the latest spec
+func (opts rolloutOptions) waitForRollout(
+	ctx context.Context,
+	check func(ro rollout) (string, string),
+) (rolloutResult, error) {
+	deadline := time.Now().Add(opts.timeout)
+	for {
+		ro, err := opts.kubectl.getRollout(ctx, opts.name)
+		if err != nil {
+			return rolloutResult{}, err
+		}
+		if ro.isObserved() {
+			status, reason := check(ro)
+			if status != "" {
+				return opts.getResult(ro, status, reason), nil
+			}
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			reason := fmt.Sprintf("the rollout did not finish after %s, since it is %s", opts.timeout, ro.describe())
+			return opts.getResult(ro, TIMEOUT_STATUS, reason), nil
+		}
+		slog.Info("Waiting for the rollout", "name", opts.name, "state", ro.describe())
+		select {
+		case <-ctx.Done():
+			return rolloutResult{}, ctx.Err()
+		case <-time.After(min(opts.pollInterval, remaining)):
+		}
+	}
+}
+
+func (opts rolloutOptions) getResult(ro rollout, status string, reason string) rolloutResult {
+	return rolloutResult{
+		Namespace:      opts.namespace,
+		Name:           opts.name,
+		Action:         opts.action,
+		Status:         status,
+		Reason:         reason,
+		Phase:          ro.Status.Phase,
+		Message:        ro.Status.Message,
+		StepIndex:      ro.getStepIndex(),
+		StepCount:      ro.getStepCount(),
+		StableRS:       ro.Status.StableRS,
+		CurrentPodHash: ro.Status.CurrentPodHash,
+	}
+}
+
+// Writes the result to the result file as JSON, if set
+func (opts rolloutOptions) writeResult(result rolloutResult) error {
+	if opts.resultFile == "" {
+		return nil
+	}
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling result file: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(opts.resultFile), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating result file dir: %s", err)
+	}
+	err = os.WriteFile(opts.resultFile, append(bytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing result file: %s", err)
+	}
+	return nil
+}
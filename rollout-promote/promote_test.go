@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// The rollouts of the promote tests, with the canary paused at the second
+// of the four steps
+const (
+	testPausedRollout = `{"metadata": {"generation": 2},
+		"spec": {"strategy": {"canary": {"steps": [{"setWeight": 20}, {"pause": {}}, {"setWeight": 50}, {"pause": {}}]}}},
+		"status": {"observedGeneration": "2", "phase": "Paused", "message": "CanaryPauseStep", "currentStepIndex": 1,
+			"pauseConditions": [{"reason": "CanaryPauseStep"}], "currentPodHash": "def", "stableRS": "abc"}}`
+	testProgressingRollout = `{"metadata": {"generation": 2},
+		"spec": {"strategy": {"canary": {"steps": [{"setWeight": 20}, {"pause": {}}, {"setWeight": 50}, {"pause": {}}]}}},
+		"status": {"observedGeneration": "2", "phase": "Progressing", "currentStepIndex": 2,
+			"currentPodHash": "def", "stableRS": "abc"}}`
+	testNextPauseRollout = `{"metadata": {"generation": 2},
+		"spec": {"strategy": {"canary": {"steps": [{"setWeight": 20}, {"pause": {}}, {"setWeight": 50}, {"pause": {}}]}}},
+		"status": {"observedGeneration": "2", "phase": "Paused", "message": "CanaryPauseStep", "currentStepIndex": 3,
+			"pauseConditions": [{"reason": "CanaryPauseStep"}], "currentPodHash": "def", "stableRS": "abc"}}`
+	testPromotedRollout = `{"metadata": {"generation": 2},
+		"spec": {"strategy": {"canary": {"steps": [{"setWeight": 20}, {"pause": {}}, {"setWeight": 50}, {"pause": {}}]}}},
+		"status": {"observedGeneration": "2", "phase": "Healthy", "currentStepIndex": 4,
+			"currentPodHash": "def", "stableRS": "def"}}`
+)
+
+// Writes a fake kubectl to the dir, which logs the patch args to
+// kubectl.log. Each get returns the next rollout, and the last rollout
+// after them. Returns the path of the fake kubectl
+func writeTestKubectl(t *testing.T, dir string, rollouts ...string) string {
+	t.Helper()
+	for i, ro := range rollouts {
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("rollout-%d.json", i)), []byte(ro), 0644)
+		if err != nil {
+			t.Fatalf("error writing rollout: %s", err)
+		}
+	}
+	path := filepath.Join(dir, "kubectl")
+	script := fmt.Sprintf(`#!/bin/sh
+dir=$(dirname "$0")
+case " $* " in
+*" get "*)
+	gets=$(cat "$dir/gets" 2>/dev/null || echo 0)
+	echo $((gets + 1)) > "$dir/gets"
+	cat "$dir/rollout-$(( gets < %d ? gets : %d )).json";;
+*" patch "*)
+	echo "$@" >> "$dir/kubectl.log";;
+esac
+`, len(rollouts), len(rollouts)-1)
+	err := os.WriteFile(path, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("error writing the kubectl script: %s", err)
+	}
+	return path
+}
+
+func TestGetRolloutOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   string
+		args     []string
+		wantFull bool
+		wantErr  string
+	}{
+		{name: "promote", action: PROMOTE_ACTION, args: []string{"--full", "--wait"}, wantFull: true},
+		{name: "abort", action: ABORT_ACTION, args: []string{"--wait"}},
+		{name: "no namespace", action: PROMOTE_ACTION, args: []string{"--namespace", ""}, wantErr: "namespace must be set"},
+		{name: "no name", action: ABORT_ACTION, args: []string{"--name", ""}, wantErr: "name must be set"},
+		{name: "zero timeout", action: PROMOTE_ACTION, args: []string{"--timeout", "0s"}, wantErr: "timeout must be positive: 0s"},
+		{
+			name:    "negative poll interval",
+			action:  ABORT_ACTION,
+			args:    []string{"--poll-interval", "-1s"},
+			wantErr: "poll-interval must be positive: -1s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet(tt.action, pflag.ContinueOnError)
+			if tt.action == PROMOTE_ACTION {
+				configurePromoteFlags(flags)
+			} else {
+				configureAbortFlags(flags)
+			}
+			err := flags.Parse(append([]string{"--namespace", "team", "--name", "app"}, tt.args...))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			opts, err := getRolloutOptions(flags, tt.action)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("getRolloutOptions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getRolloutOptions() error = %v", err)
+			}
+			if opts.full != tt.wantFull || !opts.wait || opts.kubectl.namespace != "team" {
+				t.Errorf("got options %+v, want full %t, the wait, and the namespace of kubectl", opts, tt.wantFull)
+			}
+		})
+	}
+}
+
+func TestPromote(t *testing.T) {
+	tests := []struct {
+		name       string
+		rollouts   []string
+		wait       bool
+		wantStatus string
+		wantReason string
+		wantPatch  bool
+		wantStep   int32
+	}{
+		{
+			name:       "promote",
+			rollouts:   []string{testPausedRollout},
+			wantStatus: PROMOTED_STATUS,
+			wantReason: "the rollout is promoted",
+			wantPatch:  true,
+			wantStep:   1,
+		},
+		{
+			name:       "promote and wait",
+			rollouts:   []string{testPausedRollout, testPausedRollout, testProgressingRollout, testPromotedRollout},
+			wait:       true,
+			wantStatus: PROMOTED_STATUS,
+			wantReason: "the rollout is fully promoted",
+			wantPatch:  true,
+			wantStep:   4,
+		},
+		{
+			name:       "paused at the next step",
+			rollouts:   []string{testPausedRollout, testProgressingRollout, testNextPauseRollout},
+			wait:       true,
+			wantStatus: PAUSED_STATUS,
+			wantReason: "the rollout needs another promotion, since it is Paused at step 3 of 4: CanaryPauseStep",
+			wantPatch:  true,
+			wantStep:   3,
+		},
+		{
+			name:       "already promoted",
+			rollouts:   []string{testPromotedRollout},
+			wantStatus: PROMOTED_STATUS,
+			wantReason: "the rollout is already fully promoted",
+			wantStep:   4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := rolloutOptions{
+				action:       PROMOTE_ACTION,
+				namespace:    "team",
+				name:         "app",
+				wait:         tt.wait,
+				timeout:      time.Minute,
+				pollInterval: time.Millisecond,
+				resultFile:   filepath.Join(dir, "result", "promote.json"),
+				kubectl:      kubectlRunner{kubectlPath: writeTestKubectl(t, dir, tt.rollouts...), namespace: "team"},
+			}
+			result, err := opts.promote(context.Background())
+			if err != nil {
+				t.Fatalf("promote() error = %v", err)
+			}
+			if result.Status != tt.wantStatus || result.Reason != tt.wantReason || result.StepIndex != tt.wantStep {
+				t.Errorf(
+					"promote() = %q, %q at step %d, want %q, %q at step %d",
+					result.Status,
+					result.Reason,
+					result.StepIndex,
+					tt.wantStatus,
+					tt.wantReason,
+					tt.wantStep)
+			}
+
+			kubectlLog, _ := os.ReadFile(filepath.Join(dir, "kubectl.log"))
+			wantLog := ""
+			if tt.wantPatch {
+				wantLog = "--namespace=team patch rollouts.argoproj.io app --type=merge --patch=" +
+					CLEAR_PAUSE_CONDITIONS_PATCH + " --subresource=status\n"
+			}
+			if string(kubectlLog) != wantLog {
+				t.Errorf("got kubectl patches %q, want %q", kubectlLog, wantLog)
+			}
+
+			err = opts.writeResult(result)
+			if err != nil {
+				t.Fatalf("writeResult() error = %v", err)
+			}
+			content, err := os.ReadFile(opts.resultFile)
+			if err != nil {
+				t.Fatalf("error reading result file: %s", err)
+			}
+			var got rolloutResult
+			err = json.Unmarshal(content, &got)
+			if err != nil {
+				t.Fatalf("error unmarshalling result file: %s", err)
+			}
+			if got != result {
+				t.Errorf("got result file %+v, want %+v", got, result)
+			}
+		})
+	}
+}
+
+func TestAbort(t *testing.T) {
+	abortedRollout := `{"metadata": {"generation": 2}, "spec": {"replicas": 2},
+		"status": {"observedGeneration": "2", "phase": "Degraded", "abort": true, "availableReplicas": 2,
+			"message": "RolloutAborted: Rollout aborted update to revision 2", "currentPodHash": "def", "stableRS": "abc"}}`
+	tests := []struct {
+		name       string
+		rollouts   []string
+		wait       bool
+		timeout    time.Duration
+		wantStatus string
+		wantReason string
+		wantPatch  bool
+	}{
+		{
+			name:       "abort and wait",
+			rollouts:   []string{testPausedRollout, abortedRollout},
+			wait:       true,
+			timeout:    time.Minute,
+			wantStatus: ABORTED_STATUS,
+			wantReason: "the rollout is aborted, and the stable pods are available",
+			wantPatch:  true,
+		},
+		{
+			name:       "already promoted",
+			rollouts:   []string{testPromotedRollout},
+			wantStatus: FAILED_STATUS,
+			wantReason: "the rollout is already fully promoted, so there is no update to abort",
+		},
+		{
+			name:       "timeout",
+			rollouts:   []string{testPausedRollout},
+			wait:       true,
+			timeout:    20 * time.Millisecond,
+			wantStatus: TIMEOUT_STATUS,
+			wantReason: "the rollout did not finish after 20ms, since it is Paused at step 1 of 4: CanaryPauseStep",
+			wantPatch:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := rolloutOptions{
+				action:       ABORT_ACTION,
+				namespace:    "team",
+				name:         "app",
+				wait:         tt.wait,
+				timeout:      tt.timeout,
+				pollInterval: 5 * time.Millisecond,
+				kubectl:      kubectlRunner{kubectlPath: writeTestKubectl(t, dir, tt.rollouts...), namespace: "team"},
+			}
+			result, err := opts.abort(context.Background())
+			if err != nil {
+				t.Fatalf("abort() error = %v", err)
+			}
+			if result.Status != tt.wantStatus || result.Reason != tt.wantReason {
+				t.Errorf("abort() = %q, %q, want %q, %q", result.Status, result.Reason, tt.wantStatus, tt.wantReason)
+			}
+			kubectlLog, _ := os.ReadFile(filepath.Join(dir, "kubectl.log"))
+			if patched := strings.Contains(string(kubectlLog), "--patch="+ABORT_PATCH); patched != tt.wantPatch {
+				t.Errorf("got kubectl patches %q, want the abort patch %t", kubectlLog, tt.wantPatch)
+			}
+
+			// The exit code tells the failed and the unfinished rollouts apart
+			if result.Status != ABORTED_STATUS {
+				rolloutErr := &rolloutError{result: result}
+				wantExitCode := UNFINISHED_EXIT_CODE
+				if tt.wantStatus == FAILED_STATUS {
+					wantExitCode = FAILED_EXIT_CODE
+				}
+				if rolloutErr.exitCode() != wantExitCode {
+					t.Errorf("got exit code %d, want %d", rolloutErr.exitCode(), wantExitCode)
+				}
+			}
+
+			// No result file is written without the flag
+			err = opts.writeResult(result)
+			if err != nil {
+				t.Errorf("writeResult() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The phases of a rollout
+	// See https://argoproj.github.io/argo-rollouts/features/specification
+	HEALTHY_ROLLOUT_PHASE  = "Healthy"
+	PAUSED_ROLLOUT_PHASE   = "Paused"
+	DEGRADED_ROLLOUT_PHASE = "Degraded"
+
+	// The prefix of the status message of an aborted rollout
+	ABORTED_MESSAGE_PREFIX = "RolloutAborted"
+	// The status of an analysis run that needs a person to decide
+	INCONCLUSIVE_ANALYSIS_STATUS = "Inconclusive"
+
+	// The patches of the kubectl argo rollouts plugin
+	// See https://github.com/argoproj/argo-rollouts/blob/master/pkg/kubectl-argo-rollouts/cmd/promote/promote.go
+	UNPAUSE_PATCH                          = `{"spec":{"paused":false}}`
+	CLEAR_PAUSE_CONDITIONS_PATCH           = `{"status":{"pauseConditions":null}}`
+	CLEAR_CONTROLLER_PAUSE_PATCH_WITH_STEP = `{"status":{"pauseConditions":null,"controllerPause":false,"currentStepIndex":%d}}`
+	SET_CURRENT_STEP_INDEX_PATCH           = `{"status":{"currentStepIndex":%d}}`
+	PROMOTE_FULL_PATCH                     = `{"status":{"promoteFull":true}}`
+	ABORT_PATCH                            = `{"status":{"abort":true}}`
+)
+
+// The fields of an Argo Rollout
+// See https://argoproj.github.io/argo-rollouts/features/specification
+type rollout struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Replicas *int32 `json:"replicas"`
+		Paused   bool   `json:"paused"`
+		Strategy struct {
+			Canary *struct {
+				Steps []json.RawMessage `json:"steps"`
+			} `json:"canary"`
+		} `json:"strategy"`
+	} `json:"spec"`
+	Status struct {
+		Phase           string `json:"phase"`
+		Message         string `json:"message"`
+		Abort           bool   `json:"abort"`
+		PauseConditions []struct {
+			Reason string `json:"reason"`
+		} `json:"pauseConditions"`
+		ControllerPause  bool   `json:"controllerPause"`
+		CurrentStepIndex *int32 `json:"currentStepIndex"`
+		CurrentPodHash   string `json:"currentPodHash"`
+		StableRS         string `json:"stableRS"`
+		// The generation of the spec that the controller observed, which is
+		// a string in the rollout status
+		ObservedGeneration string `json:"observedGeneration"`
+		AvailableReplicas  int32  `json:"availableReplicas"`
+		Canary             struct {
+			CurrentStepAnalysisRunStatus *struct {
+				Status string `json:"status"`
+			} `json:"currentStepAnalysisRunStatus"`
+		} `json:"canary"`
+	} `json:"status"`
+}
+
+// A patch of the rollout spec or status
+type rolloutPatch struct {
+	patch  string
+	status bool
+}
+
+// Returns whether the controller observed the latest spec of the rollout,
+// so the phase is current
+func (ro rollout) isObserved() bool {
+	return ro.Status.ObservedGeneration == strconv.FormatInt(ro.Metadata.Generation, 10)
+}
+
+// Returns whether the update of the rollout is fully promoted, so the
+// stable pods are the current pods
+func (ro rollout) isPromoted() bool {
+	return ro.Status.Phase == HEALTHY_ROLLOUT_PHASE && ro.Status.CurrentPodHash == ro.Status.StableRS
+}
+
+// Returns whether the abort of the update is done, so the stable pods are
+// available again
+func (ro rollout) isAborted() bool {
+	return ro.Status.Abort &&
+		ro.Status.Phase == DEGRADED_ROLLOUT_PHASE &&
+		strings.HasPrefix(ro.Status.Message, ABORTED_MESSAGE_PREFIX) &&
+		ro.Status.AvailableReplicas >= ro.getReplicas()
+}
+
+// Returns the desired replicas, which default to 1
+func (ro rollout) getReplicas() int32 {
+	if ro.Spec.Replicas == nil {
+		return 1
+	}
+	return *ro.Spec.Replicas
+}
+
+// Returns the number of canary steps, or 0 for the other strategies
+func (ro rollout) getStepCount() int32 {
+	if ro.Spec.Strategy.Canary == nil {
+		return 0
+	}
+	return int32(len(ro.Spec.Strategy.Canary.Steps))
+}
+
+// Returns the index of the current canary step, or -1 if the rollout has no
+// canary steps. A rollout with steps and without the index is at the first
+// step
+func (ro rollout) getStepIndex() int32 {
+	if ro.getStepCount() == 0 {
+		return -1
+	}
+	if ro.Status.CurrentStepIndex == nil {
+		return 0
+	}
+	return *ro.Status.CurrentStepIndex
+}
+
+// Returns the description of the rollout state for the logs and the errors
+func (ro rollout) describe() string {
+	description := ro.Status.Phase
+	if stepCount := ro.getStepCount(); stepCount > 0 {
+		description += fmt.Sprintf(" at step %d of %d", ro.getStepIndex(), stepCount)
+	}
+	if ro.Status.Message != "" {
+		description += ": " + ro.Status.Message
+	}
+	return description
+}
+
+// Returns the patches that promote the rollout, as in the promote command
+// of the kubectl argo rollouts plugin. The full promotion skips the
+// remaining steps and analysis. Otherwise, the pause is cleared, or the
+// canary moves to the next step
+func (ro rollout) getPromotePatches(full bool) []rolloutPatch {
+	patches := []rolloutPatch{}
+	if ro.Spec.Paused {
+		patches = append(patches, rolloutPatch{patch: UNPAUSE_PATCH})
+	}
+	if full {
+		return append(patches, rolloutPatch{patch: PROMOTE_FULL_PATCH, status: true})
+	}
+
+	stepCount := ro.getStepCount()
+	nextStepIndex := min(ro.getStepIndex()+1, stepCount)
+	analysisRunStatus := ro.Status.Canary.CurrentStepAnalysisRunStatus
+	inconclusive := analysisRunStatus != nil && analysisRunStatus.Status == INCONCLUSIVE_ANALYSIS_STATUS
+	switch {
+	case stepCount > 0 && inconclusive && len(ro.Status.PauseConditions) > 0 && ro.Status.ControllerPause:
+		// An inconclusive analysis pauses the controller, which the next
+		// step resumes
+		patch := fmt.Sprintf(CLEAR_CONTROLLER_PAUSE_PATCH_WITH_STEP, nextStepIndex)
+		patches = append(patches, rolloutPatch{patch: patch, status: true})
+	case len(ro.Status.PauseConditions) > 0:
+		patches = append(patches, rolloutPatch{patch: CLEAR_PAUSE_CONDITIONS_PATCH, status: true})
+	case stepCount > 0:
+		// The canary is running an analysis or an experiment step, which is
+		// skipped
+		patch := fmt.Sprintf(SET_CURRENT_STEP_INDEX_PATCH, nextStepIndex)
+		patches = append(patches, rolloutPatch{patch: patch, status: true})
+	}
+	return patches
+}
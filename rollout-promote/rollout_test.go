@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Returns the rollout of the JSON
+func parseTestRollout(t *testing.T, rolloutJson string) rollout {
+	t.Helper()
+	var ro rollout
+	err := json.Unmarshal([]byte(rolloutJson), &ro)
+	if err != nil {
+		t.Fatalf("error parsing rollout: %s", err)
+	}
+	return ro
+}
+
+func TestGetPromotePatches(t *testing.T) {
+	steps := `"strategy": {"canary": {"steps": [{"setWeight": 20}, {"pause": {}}, {"setWeight": 50}, {"pause": {}}]}}`
+	tests := []struct {
+		name    string
+		rollout string
+		full    bool
+		want    []rolloutPatch
+	}{
+		{
+			name:    "paused step",
+			rollout: `{"spec": {` + steps + `}, "status": {"currentStepIndex": 1, "pauseConditions": [{"reason": "CanaryPauseStep"}]}}`,
+			want:    []rolloutPatch{{patch: CLEAR_PAUSE_CONDITIONS_PATCH, status: true}},
+		},
+		{
+			name:    "paused spec",
+			rollout: `{"spec": {"paused": true, ` + steps + `}, "status": {"currentStepIndex": 1}}`,
+			want:    []rolloutPatch{{patch: UNPAUSE_PATCH}, {patch: `{"status":{"currentStepIndex":2}}`, status: true}},
+		},
+		{
+			name: "inconclusive analysis",
+			rollout: `{"spec": {` + steps + `}, "status": {"currentStepIndex": 2, "controllerPause": true,
+				"pauseConditions": [{"reason": "InconclusiveAnalysisRun"}],
+				"canary": {"currentStepAnalysisRunStatus": {"status": "Inconclusive"}}}}`,
+			want: []rolloutPatch{
+				{patch: `{"status":{"pauseConditions":null,"controllerPause":false,"currentStepIndex":3}}`, status: true},
+			},
+		},
+		{
+			name:    "last step",
+			rollout: `{"spec": {` + steps + `}, "status": {"currentStepIndex": 4}}`,
+			want:    []rolloutPatch{{patch: `{"status":{"currentStepIndex":4}}`, status: true}},
+		},
+		{
+			name:    "full",
+			rollout: `{"spec": {"paused": true, ` + steps + `}, "status": {"currentStepIndex": 1}}`,
+			full:    true,
+			want:    []rolloutPatch{{patch: UNPAUSE_PATCH}, {patch: PROMOTE_FULL_PATCH, status: true}},
+		},
+		{
+			name:    "blue green",
+			rollout: `{"spec": {"strategy": {}}, "status": {"pauseConditions": [{"reason": "BlueGreenPause"}]}}`,
+			want:    []rolloutPatch{{patch: CLEAR_PAUSE_CONDITIONS_PATCH, status: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseTestRollout(t, tt.rollout).getPromotePatches(tt.full)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getPromotePatches(%t) = %+v, want %+v", tt.full, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRolloutState(t *testing.T) {
+	tests := []struct {
+		name          string
+		rollout       string
+		wantObserved  bool
+		wantPromoted  bool
+		wantAborted   bool
+		wantDescribed string
+	}{
+		{
+			name: "promoted",
+			rollout: `{"metadata": {"generation": 3}, "spec": {"strategy": {"canary": {"steps": [{"setWeight": 20}]}}},
+				"status": {"observedGeneration": "3", "phase": "Healthy", "currentStepIndex": 1,
+					"currentPodHash": "abc", "stableRS": "abc"}}`,
+			wantObserved:  true,
+			wantPromoted:  true,
+			wantDescribed: "Healthy at step 1 of 1",
+		},
+		{
+			name: "paused",
+			rollout: `{"metadata": {"generation": 4}, "spec": {"strategy": {"canary": {"steps": [{"pause": {}}, {"pause": {}}]}}},
+				"status": {"observedGeneration": "3", "phase": "Paused", "message": "CanaryPauseStep",
+					"currentPodHash": "def", "stableRS": "abc"}}`,
+			wantDescribed: "Paused at step 0 of 2: CanaryPauseStep",
+		},
+		{
+			name: "aborted",
+			rollout: `{"metadata": {"generation": 2}, "spec": {"replicas": 2},
+				"status": {"observedGeneration": "2", "phase": "Degraded", "abort": true, "availableReplicas": 2,
+					"message": "RolloutAborted: Rollout aborted update to revision 2"}}`,
+			wantObserved:  true,
+			wantAborted:   true,
+			wantDescribed: "Degraded: RolloutAborted: Rollout aborted update to revision 2",
+		},
+		{
+			name: "aborting",
+			rollout: `{"metadata": {"generation": 2}, "spec": {"replicas": 2},
+				"status": {"observedGeneration": "2", "phase": "Degraded", "abort": true, "availableReplicas": 1,
+					"message": "RolloutAborted: Rollout aborted update to revision 2"}}`,
+			wantObserved:  true,
+			wantDescribed: "Degraded: RolloutAborted: Rollout aborted update to revision 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ro := parseTestRollout(t, tt.rollout)
+			if got := ro.isObserved(); got != tt.wantObserved {
+				t.Errorf("isObserved() = %t, want %t", got, tt.wantObserved)
+			}
+			if got := ro.isPromoted(); got != tt.wantPromoted {
+				t.Errorf("isPromoted() = %t, want %t", got, tt.wantPromoted)
+			}
+			if got := ro.isAborted(); got != tt.wantAborted {
+				t.Errorf("isAborted() = %t, want %t", got, tt.wantAborted)
+			}
+			if got := ro.describe(); got != tt.wantDescribed {
+				t.Errorf("describe() = %q, want %q", got, tt.wantDescribed)
+			}
+		})
+	}
+}